@@ -16,9 +16,10 @@ import (
 func main() {
 	// TODO: Can we outsource flag parsing and share code across command line
 	// tools?
-	var configFilename, logFilename string
+	var configFilename, logFilename, shard string
 	flag.StringVar(&configFilename, "config", "", "Configuration file.")
 	flag.StringVar(&logFilename, "log", "", "File to write logs to.")
+	flag.StringVar(&shard, "shard", "", "Shard of the backend to run, if the backend is sharded.")
 	flag.Parse()
 
 	var logOutput io.Writer = os.Stderr
@@ -39,6 +40,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if shard != "" {
+		if err := internal.SelectShard(cfg, shard); err != nil {
+			log.Fatal(err)
+		}
+	}
 	b := internal.BackendContext{}
 	b.InitBackend(cfg)
 }
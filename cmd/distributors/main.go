@@ -9,20 +9,32 @@ import (
 	"log"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	bridgesMail "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/email"
 	gettorMail "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/gettor"
 	httpsUI "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/https"
 	i2phttpsUI "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/i2p"
+	loxWeb "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/lox"
 	moatWeb "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/moat"
+	nostrBot "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/nostr"
+	reservedAPI "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/reserved"
 	salmonWeb "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/salmon"
 	stubWeb "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/stub"
 	telegramBot "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/telegram"
+	webpushAPI "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/webpush"
+	xmppBot "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/xmpp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/email"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/gettor"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/https"
 	i2phttps "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/i2p"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/lox"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/nostr"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/reserved"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/salmon"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/stub"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/webpush"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/xmpp"
 )
 
 func main() {
@@ -51,6 +63,12 @@ func main() {
 		gettor.DistName:   gettorMail.InitFrontend,
 		moat.DistName:     moatWeb.InitFrontend,
 		telegram.DistName: telegramBot.InitFrontend,
+		xmpp.DistName:     xmppBot.InitFrontend,
+		email.DistName:    bridgesMail.InitFrontend,
+		nostr.DistName:    nostrBot.InitFrontend,
+		lox.DistName:      loxWeb.InitFrontend,
+		webpush.DistName:  webpushAPI.InitFrontend,
+		reserved.DistName: reservedAPI.InitFrontend,
 	}
 	runFunc, exists := constructors[distName]
 	if !exists {
@@ -0,0 +1,95 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal/simulation"
+)
+
+func main() {
+	var configFilename, logFilename, strategyName string
+	var params simulation.Params
+	var newPoolShare float64
+	var jsonOutput bool
+	flag.StringVar(&strategyName, "strategy", "all", "Distributor to simulate: salmon, moat, telegram, or all.")
+	flag.StringVar(&configFilename, "config", "", "Configuration file with the settings of the distributors.  Defaults are used if not given.")
+	flag.StringVar(&logFilename, "log", "", "File to write the logs of the distributors to.  They are discarded if not given.")
+	flag.IntVar(&params.Days, "days", 30, "Number of simulated days.")
+	flag.IntVar(&params.Bridges, "bridges", 1000, "Number of bridges.")
+	flag.IntVar(&params.UsersPerDay, "users", 50, "Number of honest users that join every day.")
+	flag.IntVar(&params.Censor.AgentsPerDay, "agents", 5, "Number of new agents of the censor every day.")
+	flag.IntVar(&params.Censor.BlockingDelay, "delay", 1, "Days that the censor takes to block a bridge it learned.")
+	flag.StringVar(&params.Censor.Country, "country", "cn", "Country of the censor and the users.")
+	flag.Int64Var(&params.Seed, "seed", 1, "Seed of the simulation.")
+	flag.Float64Var(&newPoolShare, "telegram-new-pool", 0.5, "Share of the bridges in telegram's new pool.")
+	flag.BoolVar(&jsonOutput, "json", false, "Write the reports as JSON instead of tables.")
+	flag.Parse()
+
+	// The distributors are chatty, keep their logs out of the reports.
+	var logOutput io.Writer = ioutil.Discard
+	if logFilename != "" {
+		logFd, err := os.OpenFile(logFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logOutput = logFd
+		defer logFd.Close()
+	}
+
+	cfg := simulation.DefaultConfig()
+	if configFilename != "" {
+		var err error
+		cfg, err = internal.LoadConfig(configFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := params.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	names := []string{strategyName}
+	if strategyName == "all" {
+		names = simulation.StrategyNames
+	}
+	var reports []*simulation.Report
+	for _, name := range names {
+		strategy, err := simulation.NewStrategy(name, cfg, newPoolShare)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.SetOutput(logOutput)
+		report, err := simulation.Run(strategy, params)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			log.Fatalf("Error simulating %s: %s", name, err)
+		}
+		reports = append(reports, report)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, report := range reports {
+		if err := report.Write(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.WriteString("\n")
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	gettorUpdater "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/updaters/gettor"
@@ -14,9 +15,13 @@ import (
 )
 
 func main() {
-	var configFilename, updName string
+	var configFilename, updName, platforms, locales string
+	var dryRun bool
 	flag.StringVar(&updName, "name", "", "Updater name.")
 	flag.StringVar(&configFilename, "config", "", "Configuration file.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Report what would be uploaded without uploading it, and exit.")
+	flag.StringVar(&platforms, "platforms", "", "Comma-separated list of the platforms to update, all if empty.")
+	flag.StringVar(&locales, "locales", "", "Comma-separated list of the locales to update, all if empty.")
 	flag.Parse()
 
 	if updName == "" {
@@ -30,6 +35,15 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if dryRun {
+		cfg.Updaters.Gettor.DryRun = true
+	}
+	if platforms != "" {
+		cfg.Updaters.Gettor.Platforms = strings.Split(platforms, ",")
+	}
+	if locales != "" {
+		cfg.Updaters.Gettor.Locales = strings.Split(locales, ",")
+	}
 
 	var constructors = map[string]func(*internal.Config){
 		gettor.UpdName: gettorUpdater.InitUpdater,
@@ -0,0 +1,271 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	AlertCheckInterval = time.Minute
+	webhookTimeout     = 30 * time.Second
+
+	// The events that trigger alerts.
+	AlertResourcesDropped           = "resources_dropped"
+	AlertNotEnoughRunning           = "not_enough_running"
+	AlertEnoughRunning              = "enough_running"
+	AlertDistributingNonFunctional  = "distributing_non_functional"
+	AlertDistributingOnlyFunctional = "distributing_only_functional"
+	AlertDistributorDown            = "distributor_down"
+	AlertDistributorUp              = "distributor_up"
+)
+
+// Alert is an anomalous event of the backend, or the end of one.  It's what
+// the webhooks get, as JSON or as the input of their template.
+type Alert struct {
+	Event   string            `json:"event"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type webhook struct {
+	cfg      WebhookConfig
+	template *template.Template
+}
+
+// Alerter watches the state of the backend and calls the webhooks of the
+// configuration when something looks wrong.  All the methods can be called
+// on a nil alerter and do nothing.
+type Alerter struct {
+	sync.Mutex
+	cfg      AlertsConfig
+	webhooks []webhook
+	liveness *LivenessTracker
+	client   *http.Client
+	// deliveries waits for the webhook requests in flight
+	deliveries sync.WaitGroup
+
+	checked             bool
+	resources           map[string]int
+	ignoringDescriptors bool
+	onlyFunctional      bool
+	nonFunctional       bool
+	downSince           map[string]time.Time
+	down                map[string]bool
+}
+
+// templateFuncs are the functions available to the templates of the
+// webhooks, json quotes a value to be embedded in a JSON body.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+}
+
+// NewAlerter returns an alerter for the configuration, or nil if no webhooks
+// are configured.  Webhooks with an invalid template are skipped.
+func NewAlerter(cfg *Config, liveness *LivenessTracker) *Alerter {
+	alertsCfg := cfg.Backend.Alerts
+	var webhooks []webhook
+	for i, whCfg := range alertsCfg.Webhooks {
+		w := webhook{cfg: whCfg}
+		if whCfg.Template != "" {
+			var err error
+			w.template, err = template.New("webhook-" + strconv.Itoa(i)).Funcs(templateFuncs).Parse(whCfg.Template)
+			if err != nil {
+				log.Printf("Skipping alert webhook %s with invalid template: %s", whCfg.Url, err)
+				continue
+			}
+		}
+		webhooks = append(webhooks, w)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	return &Alerter{
+		cfg:       alertsCfg,
+		webhooks:  webhooks,
+		liveness:  liveness,
+		client:    &http.Client{Timeout: webhookTimeout},
+		resources: make(map[string]int),
+		downSince: make(map[string]time.Time),
+		down:      make(map[string]bool),
+	}
+}
+
+// CheckResources looks for anomalies after a reload of the bridge
+// descriptors, reloadErr is the error of the reload.
+func (a *Alerter) CheckResources(rcol *core.BackendResources, reloadErr error) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now().UTC()
+
+	ignoring := errors.Is(reloadErr, NotEnoughRunningError)
+	if ignoring && !a.ignoringDescriptors {
+		a.send(Alert{Event: AlertNotEnoughRunning, Time: now,
+			Message: "The bridge descriptors are ignored: " + reloadErr.Error()})
+	} else if !ignoring && a.ignoringDescriptors {
+		a.send(Alert{Event: AlertEnoughRunning, Time: now,
+			Message: "The bridge descriptors are not ignored anymore"})
+	}
+	a.ignoringDescriptors = ignoring
+
+	// After a restart most resources are untested, so we only alert if
+	// we saw the backend distributing only functional resources before.
+	if a.checked && a.onlyFunctional && !rcol.OnlyFunctional {
+		a.send(Alert{Event: AlertDistributingNonFunctional, Time: now,
+			Message: "Not enough resources are functional, distributing resources without testing them"})
+		a.nonFunctional = true
+	} else if a.nonFunctional && rcol.OnlyFunctional {
+		a.send(Alert{Event: AlertDistributingOnlyFunctional, Time: now,
+			Message: "Distributing only functional resources again"})
+		a.nonFunctional = false
+	}
+	a.onlyFunctional = rcol.OnlyFunctional
+
+	for rType, hashring := range rcol.Collection {
+		num := hashring.Len()
+		prev, exists := a.resources[rType]
+		a.resources[rType] = num
+		if !exists || prev == 0 || a.cfg.ResourceDropPercent <= 0 {
+			continue
+		}
+		drop := float64(prev-num) * 100 / float64(prev)
+		if drop > a.cfg.ResourceDropPercent {
+			a.send(Alert{
+				Event:   AlertResourcesDropped,
+				Time:    now,
+				Message: fmt.Sprintf("The number of %s resources dropped by %.0f%%, from %d to %d", rType, drop, prev, num),
+				Details: map[string]string{
+					"type":     rType,
+					"previous": strconv.Itoa(prev),
+					"current":  strconv.Itoa(num),
+				},
+			})
+		}
+	}
+	a.checked = true
+}
+
+// Run checks the liveness of the distributors every AlertCheckInterval until
+// it's told to shut down.
+func (a *Alerter) Run(shutdown chan bool) {
+	if a == nil || a.cfg.DistributorDownMinutes <= 0 {
+		return
+	}
+	ticker := time.NewTicker(AlertCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			a.deliveries.Wait()
+			return
+		case now := <-ticker.C:
+			a.checkDistributors(now.UTC())
+		}
+	}
+}
+
+// checkDistributors alerts about the distributors that have not been alive
+// for longer than DistributorDownMinutes, and about the ones that are back.
+// The distributors that never sent a heartbeat are not checked, they may be
+// too old to send them.
+func (a *Alerter) checkDistributors(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	maxDown := time.Duration(a.cfg.DistributorDownMinutes) * time.Minute
+	for _, status := range a.liveness.Statuses(now) {
+		name := status.Name
+		if status.State == DistributorAlive || status.State == DistributorNoHeartbeat {
+			if a.down[name] {
+				a.send(Alert{Event: AlertDistributorUp, Time: now,
+					Message: fmt.Sprintf("Distributor %s is %s again", name, status.State),
+					Details: map[string]string{"distributor": name}})
+			}
+			delete(a.downSince, name)
+			delete(a.down, name)
+			continue
+		}
+
+		since, exists := a.downSince[name]
+		if !exists {
+			a.downSince[name] = now
+			continue
+		}
+		if !a.down[name] && now.Sub(since) >= maxDown {
+			a.send(Alert{Event: AlertDistributorDown, Time: now,
+				Message: fmt.Sprintf("Distributor %s is %s since %s", name, status.State, since.Format(time.RFC3339)),
+				Details: map[string]string{"distributor": name, "state": status.State}})
+			a.down[name] = true
+		}
+	}
+}
+
+// send logs the alert and delivers it to the webhooks in the background.
+func (a *Alerter) send(alert Alert) {
+	log.Printf("Alert %s: %s", alert.Event, alert.Message)
+	for _, w := range a.webhooks {
+		a.deliveries.Add(1)
+		go func(w webhook) {
+			defer a.deliveries.Done()
+			if err := a.deliver(w, &alert); err != nil {
+				log.Printf("Error calling alert webhook %s: %s", w.cfg.Url, err)
+			}
+		}(w)
+	}
+}
+
+func (a *Alerter) deliver(w webhook, alert *Alert) error {
+	var body bytes.Buffer
+	if w.template == nil {
+		if err := json.NewEncoder(&body).Encode(alert); err != nil {
+			return err
+		}
+	} else if err := w.template.Execute(&body, alert); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.cfg.Url, &body)
+	if err != nil {
+		return err
+	}
+	contentType := w.cfg.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range w.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got HTTP status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+type webhookRecorder struct {
+	sync.Mutex
+	bodies []string
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rec.Lock()
+	defer rec.Unlock()
+	rec.bodies = append(rec.bodies, r.Header.Get("X-Token")+" "+string(body))
+}
+
+func (rec *webhookRecorder) take() []string {
+	rec.Lock()
+	defer rec.Unlock()
+	bodies := rec.bodies
+	rec.bodies = nil
+	return bodies
+}
+
+func dummyResources(num int, onlyFunctional bool) *core.BackendResources {
+	rcol := core.NewBackendResources()
+	rcol.AddResourceType("dummy", false, nil)
+	for i := 0; i < num; i++ {
+		rcol.Add(core.NewDummy(core.NewHashkey(fmt.Sprintf("oid-%d", i)), core.NewHashkey(fmt.Sprintf("uid-%d", i))))
+	}
+	rcol.OnlyFunctional = onlyFunctional
+	return rcol
+}
+
+func TestAlertResources(t *testing.T) {
+	rec := &webhookRecorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	cfg := &Config{}
+	cfg.Backend.Alerts = AlertsConfig{
+		Webhooks: []WebhookConfig{
+			{Url: server.URL},
+			{Url: server.URL, Template: `{"text": {{json .Message}}}`, Headers: map[string]string{"X-Token": "secret"}},
+			{Url: server.URL, Template: "{{.Invalid"},
+		},
+		ResourceDropPercent: 20,
+	}
+	alerter := NewAlerter(cfg, nil)
+	if len(alerter.webhooks) != 2 {
+		t.Fatalf("The webhook with an invalid template was not skipped: %d webhooks", len(alerter.webhooks))
+	}
+
+	alerter.CheckResources(dummyResources(10, false), nil)
+	alerter.CheckResources(dummyResources(10, true), nil)
+	alerter.CheckResources(dummyResources(9, true), nil)
+	alerter.deliveries.Wait()
+	if bodies := rec.take(); len(bodies) != 0 {
+		t.Fatalf("Unexpected alerts: %v", bodies)
+	}
+
+	alerter.CheckResources(dummyResources(5, true), nil)
+	alerter.deliveries.Wait()
+	bodies := rec.take()
+	if len(bodies) != 2 {
+		t.Fatalf("Expected the drop alert on both webhooks, got %v", bodies)
+	}
+	var alert Alert
+	var text struct{ Text string }
+	for _, body := range bodies {
+		if body[0] == ' ' {
+			err := json.Unmarshal([]byte(body[1:]), &alert)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			err := json.Unmarshal([]byte(body[len("secret "):]), &text)
+			if err != nil {
+				t.Fatalf("The template didn't make valid JSON %q: %s", body, err)
+			}
+		}
+	}
+	if alert.Event != AlertResourcesDropped || alert.Details["previous"] != "9" || alert.Details["current"] != "5" {
+		t.Errorf("Wrong alert: %+v", alert)
+	}
+	if text.Text != alert.Message {
+		t.Errorf("Wrong message of the template: %q", text.Text)
+	}
+
+	alerter.CheckResources(dummyResources(5, false), NotEnoughRunningError)
+	alerter.CheckResources(dummyResources(5, false), NotEnoughRunningError)
+	alerter.CheckResources(dummyResources(5, true), nil)
+	alerter.deliveries.Wait()
+	events := []string{}
+	for _, body := range rec.take() {
+		if body[0] == ' ' {
+			json.Unmarshal([]byte(body[1:]), &alert)
+			events = append(events, alert.Event)
+		}
+	}
+	expected := map[string]bool{
+		AlertNotEnoughRunning:           true,
+		AlertDistributingNonFunctional:  true,
+		AlertEnoughRunning:              true,
+		AlertDistributingOnlyFunctional: true,
+	}
+	if len(events) != len(expected) {
+		t.Errorf("Wrong alerts: %v", events)
+	}
+	for _, event := range events {
+		if !expected[event] {
+			t.Errorf("Unexpected alert %s", event)
+		}
+	}
+}
+
+func TestAlertDistributors(t *testing.T) {
+	rec := &webhookRecorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	cfg := &Config{}
+	cfg.Backend.Alerts = AlertsConfig{
+		Webhooks:               []WebhookConfig{{Url: server.URL, Template: "{{.Event}} {{index .Details \"distributor\"}}"}},
+		DistributorDownMinutes: 5,
+	}
+	cfg.Backend.DistProportions = map[string]int{"https": 1, "moat": 1}
+	liveness := NewLivenessTracker(cfg, nil)
+	alerter := NewAlerter(cfg, liveness)
+
+	now := time.Now().UTC()
+	liveness.StreamOpened("https")
+	liveness.Heartbeat(&core.Heartbeat{RequestOrigin: "https", Streaming: true}, now)
+	liveness.StreamOpened("moat")
+
+	alerter.checkDistributors(now)
+	liveness.StreamClosed("https")
+	alerter.checkDistributors(now.Add(time.Minute))
+	alerter.checkDistributors(now.Add(5 * time.Minute))
+	alerter.deliveries.Wait()
+	if bodies := rec.take(); len(bodies) != 0 {
+		t.Fatalf("Unexpected alerts: %v", bodies)
+	}
+
+	alerter.checkDistributors(now.Add(6 * time.Minute))
+	alerter.checkDistributors(now.Add(7 * time.Minute))
+	alerter.deliveries.Wait()
+	bodies := rec.take()
+	if len(bodies) != 1 || bodies[0] != " "+AlertDistributorDown+" https" {
+		t.Fatalf("Expected one down alert, got %v", bodies)
+	}
+
+	liveness.StreamOpened("https")
+	liveness.Heartbeat(&core.Heartbeat{RequestOrigin: "https", Streaming: true}, now.Add(8*time.Minute))
+	alerter.checkDistributors(now.Add(8 * time.Minute))
+	alerter.deliveries.Wait()
+	bodies = rec.take()
+	if len(bodies) != 1 || bodies[0] != " "+AlertDistributorUp+" https" {
+		t.Errorf("Expected one up alert, got %v", bodies)
+	}
+}
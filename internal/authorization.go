@@ -0,0 +1,119 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+var (
+	OriginMismatchError         = errors.New("the request origin doesn't belong to the API token")
+	UnknownResourceTypeError    = errors.New("unknown resource type")
+	ResourceTypeNotAllowedError = errors.New("the resource type is not distributed by the request origin")
+	RemovalNotAllowedError      = errors.New("the API token can't remove resources of this type")
+	AdditionNotAllowedError     = errors.New("the API token can't add resources of this type")
+)
+
+// addableResources maps the names of the API tokens that can add resources to
+// the backend to the resource types that they can add.  The bridges come from
+// the bridge descriptors, only the gettor updater adds the links of its
+// releases.
+var addableResources = map[string][]string{
+	"gettor": {resources.ResourceTypeTBLink},
+}
+
+// removableResources maps the names of the API tokens that can remove
+// resources from the backend to the resource types that they can remove.
+// Only the gettor updater deletes its releases, so it's the only one that
+// removes the links of them.
+var removableResources = map[string][]string{
+	"gettor": {resources.ResourceTypeTBLink},
+}
+
+// originsOf returns the request origins that the API token with the given
+// name may use: its own name and the origins of the api_token_origins of the
+// configuration.
+func originsOf(cfg *Config, tokenName string) []string {
+	return append([]string{tokenName}, cfg.Backend.ApiTokenOrigins[tokenName]...)
+}
+
+// authorizeResourceRequest returns an error if the API token with the given
+// name may not make the given resource request.  The backend only hands out
+// the partition of the request origin, so the origin must belong to the token,
+// and the requested resource types must be distributed by the origin.
+func authorizeResourceRequest(cfg *Config, rcol *core.BackendResources, tokenName string, req *core.ResourceRequest) error {
+
+	if !contains(originsOf(cfg, tokenName), req.RequestOrigin) {
+		return fmt.Errorf("%w: %q can't request resources for %q", OriginMismatchError, tokenName, req.RequestOrigin)
+	}
+
+	for _, rType := range req.ResourceTypes {
+		if _, exists := rcol.Collection[rType]; !exists {
+			return fmt.Errorf("%w: %q", UnknownResourceTypeError, rType)
+		}
+		distNames := cfg.Backend.Resources[rType].Distributors
+		if len(distNames) != 0 && !contains(distNames, req.RequestOrigin) {
+			return fmt.Errorf("%w: %q isn't distributed by %q", ResourceTypeNotAllowedError, rType, req.RequestOrigin)
+		}
+	}
+	return nil
+}
+
+// isAuthorized authorizes the given resource request of the API token with
+// the given name.  If this fails, it writes an error to the given
+// ResponseWriter and returns false.
+func (b *BackendContext) isAuthorized(w http.ResponseWriter, tokenName string, req *core.ResourceRequest) bool {
+
+	err := authorizeResourceRequest(b.Config, &b.Resources, tokenName, req)
+	if err == nil {
+		return true
+	}
+	log.Printf("Rejecting resource request: %s", err)
+	if errors.Is(err, UnknownResourceTypeError) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return false
+}
+
+// authorizeRemoval returns an error if the API token with the given name may
+// not remove the given resources.
+func authorizeRemoval(tokenName string, rs []core.Resource) error {
+
+	for _, r := range rs {
+		if !contains(removableResources[tokenName], r.Type()) {
+			return fmt.Errorf("%w: %q can't remove %q", RemovalNotAllowedError, tokenName, r.Type())
+		}
+	}
+	return nil
+}
+
+// authorizeAddition returns an error if the API token with the given name may
+// not add the given resources.
+func authorizeAddition(tokenName string, rs []core.Resource) error {
+
+	for _, r := range rs {
+		if !contains(addableResources[tokenName], r.Type()) {
+			return fmt.Errorf("%w: %q can't add %q", AdditionNotAllowedError, tokenName, r.Type())
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
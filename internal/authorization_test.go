@@ -0,0 +1,83 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestAuthorizeResourceRequest(t *testing.T) {
+
+	cfg := Config{}
+	cfg.Backend.ApiTokenOrigins = map[string][]string{"moat": {"settings"}}
+	cfg.Backend.Resources = map[string]ResourceConfig{
+		"vanilla": {Distributors: []string{"https"}},
+		"obfs4":   {},
+	}
+	rcol := core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		rcol.AddResourceType(rType, false, map[string]int{"https": 1, "moat": 1})
+	}
+
+	tests := []struct {
+		tokenName string
+		req       core.ResourceRequest
+		err       error
+	}{
+		{"https", core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"vanilla", "obfs4"}}, nil},
+		{"moat", core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"obfs4"}}, nil},
+		{"moat", core.ResourceRequest{RequestOrigin: "settings", ResourceTypes: []string{"obfs4"}}, nil},
+		{"moat", core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}}, OriginMismatchError},
+		{"https", core.ResourceRequest{RequestOrigin: "settings", ResourceTypes: []string{"obfs4"}}, OriginMismatchError},
+		{"moat", core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"vanilla"}}, ResourceTypeNotAllowedError},
+		{"https", core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"snowflake"}}, UnknownResourceTypeError},
+	}
+	for _, test := range tests {
+		err := authorizeResourceRequest(&cfg, rcol, test.tokenName, &test.req)
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("Got the error %v instead of %v for %q requesting %q for %q",
+				err, test.err, test.tokenName, test.req.ResourceTypes, test.req.RequestOrigin)
+		}
+	}
+}
+
+func TestResourcesHandlerRejectsOtherOrigins(t *testing.T) {
+
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.ApiTokens = map[string]string{"https": "foo", "moat": "bar"}
+	cfg.Backend.ResourcesEndpoint = "/resources"
+	cfg.Backend.ResourceStreamEndpoint = "/resource-stream"
+	b.Config = &cfg
+	b.Resources = *core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		b.Resources.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+
+	request := func(endpoint, token, origin string) int {
+		body, _ := json.Marshal(&core.ResourceRequest{RequestOrigin: origin, ResourceTypes: []string{"obfs4"}})
+		req := httptest.NewRequest("GET", endpoint, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		b.resourcesHandler(rec, req)
+		return rec.Code
+	}
+	if code := request("/resources", "foo", "https"); code != http.StatusOK {
+		t.Errorf("Got the status code %d instead of %d for the own origin", code, http.StatusOK)
+	}
+	for _, endpoint := range []string{"/resources", "/resource-stream"} {
+		if code := request(endpoint, "bar", "https"); code != http.StatusForbidden {
+			t.Errorf("Got the status code %d instead of %d for another origin on %s",
+				code, http.StatusForbidden, endpoint)
+		}
+	}
+}
@@ -6,11 +6,13 @@ package internal
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,6 +21,7 @@ import (
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -32,6 +35,27 @@ type BackendContext struct {
 	rTestPool *ResourceTestPool
 	metrics   *Metrics
 	rStore    *ResourceStore
+	releaser  *UnallocatedReleaser
+	rotator   *ResourceRotator
+	exposure  *ExposureTracker
+	feedback  *FeedbackTracker
+	labels    *LabelStore
+	locator   *BridgeLocator
+	liveness  *LivenessTracker
+	alerter   *Alerter
+	nats      *NatsPublisher
+	srv       http.Server
+	wg        sync.WaitGroup
+	quit      chan bool
+	reload    chan chan bool
+
+	// replicator is set while the backend is the standby of a primary.
+	replicator      *Replicator
+	replicationLock sync.Mutex
+
+	// signingKey signs the resource streams and the resources responses if
+	// it's set.
+	signingKey ed25519.PrivateKey
 }
 
 // metricsWrapper keeps track of the number of times each of our API endpoints
@@ -43,9 +67,9 @@ func metricsWrapper(f http.HandlerFunc, endpoint string, metrics *Metrics) http.
 	}
 }
 
-// startWebApi starts our Web server.
-func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
-	log.Printf("Starting Web API at %s.", cfg.Backend.WebApi.ApiAddress)
+// startWebApi starts our Web server on the given listener.
+func (b *BackendContext) startWebApi(listener net.Listener, cfg *Config) {
+	log.Printf("Starting Web API at %s.", listener.Addr())
 
 	mux := http.NewServeMux()
 	endpoints := map[string]http.HandlerFunc{
@@ -55,40 +79,83 @@ func (b *BackendContext) startWebApi(cfg *Config, srv *http.Server) {
 		cfg.Backend.TargetsEndpoint:        b.targetsHandler,
 		cfg.Backend.MetricsEndpoint:        promhttp.Handler().(http.HandlerFunc),
 	}
+	if cfg.Backend.HandoutsEndpoint != "" {
+		endpoints[cfg.Backend.HandoutsEndpoint] = b.handoutsHandler
+	}
+	if cfg.Backend.FeedbackEndpoint != "" {
+		endpoints[cfg.Backend.FeedbackEndpoint] = b.feedbackHandler
+	}
+	if cfg.Backend.LabelsEndpoint != "" {
+		endpoints[cfg.Backend.LabelsEndpoint] = b.labelsHandler
+	}
+	if cfg.Backend.ReplicationEndpoint != "" {
+		endpoints[cfg.Backend.ReplicationEndpoint] = b.replicationHandler
+		endpoints[cfg.Backend.ReplicationEndpoint+replicationStreamPath] = b.replicationHandler
+		endpoints[cfg.Backend.ReplicationEndpoint+replicationPromotePath] = b.replicationHandler
+	}
 	for endpoint, handler := range endpoints {
 		mux.Handle(endpoint, metricsWrapper(handler, endpoint, b.metrics))
 	}
-	srv.Handler = mux
-	srv.Addr = cfg.Backend.WebApi.ApiAddress
+	b.srv.Handler = mux
+	b.srv.Addr = listener.Addr().String()
 
 	var err error
 	if cfg.Backend.WebApi.CertFile != "" && cfg.Backend.WebApi.KeyFile != "" {
-		err = srv.ListenAndServeTLS(cfg.Backend.WebApi.CertFile, cfg.Backend.WebApi.KeyFile)
+		err = b.srv.ServeTLS(listener, cfg.Backend.WebApi.CertFile, cfg.Backend.WebApi.KeyFile)
 	} else {
-		err = srv.ListenAndServe()
+		err = b.srv.Serve(listener)
 	}
 	log.Printf("Web API shut down: %s", err)
 }
 
 // stopWebApi stops our Web server.
-func (b *BackendContext) stopWebApi(srv *http.Server) {
+func (b *BackendContext) stopWebApi() {
 	// Give our Web server five seconds to shut down.
 	t := time.Now().Add(5 * time.Second)
 	ctx, cancel := context.WithDeadline(context.Background(), t)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := b.srv.Shutdown(ctx); err != nil {
 		log.Printf("Error while shutting down Web API: %s", err)
 	}
 }
 
-// InitBackend initialises our backend.
+// InitBackend initialises our backend.  This function does not return until
+// it receives a SIGINT.
 func (b *BackendContext) InitBackend(cfg *Config) {
 
+	listener, err := net.Listen("tcp", cfg.Backend.WebApi.ApiAddress)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %s", cfg.Backend.WebApi.ApiAddress, err)
+	}
+	b.StartBackend(listener, cfg)
+
+	// We're done bootstrapping.  Now wait for a SIGTERM.
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	<-sigint
+	log.Println("Received SIGINT.")
+	b.StopBackend()
+}
+
+// StartBackend initialises our backend and serves its Web API on the given
+// listener.  The function returns once the kraken parsed our bridge
+// descriptors, or once a standby backend got the state of its primary.  It is identical to InitBackend except that it takes a
+// net.Listener and doesn't wait for a SIGINT, so the backend can run in the
+// same process as its distributors, e.g. in tests.  Call StopBackend to shut
+// it down.
+func (b *BackendContext) StartBackend(listener net.Listener, cfg *Config) {
+
 	log.Println("Initialising backend.")
 	b.Config = cfg
 	b.metrics = InitMetrics()
 
+	signingKey, err := loadSigningKey(cfg)
+	if err != nil {
+		log.Fatalf("Error loading signing key from %s: %s", cfg.Backend.SigningKeyFile, err)
+	}
+	b.signingKey = signingKey
+
 	b.Resources = *core.NewBackendResources()
 	for rType, conf := range cfg.Backend.Resources {
 		if _, exists := resources.ResourceMap[rType]; !exists {
@@ -106,44 +173,110 @@ func (b *BackendContext) InitBackend(cfg *Config) {
 	}
 
 	b.rTestPool = NewResourceTestPool(cfg.Backend.BridgestrapEndpoint)
-	defer b.rTestPool.Stop()
 
-	quit := make(chan bool)
+	b.quit = make(chan bool)
+	b.reload = make(chan chan bool)
 
 	b.rStore = InitResourceStore(cfg, &b.Resources)
+	b.releaser = NewUnallocatedReleaser(cfg, b.metrics)
+	b.rotator = NewResourceRotator(cfg, &b.Resources, b.metrics)
+	b.exposure = NewExposureTracker(cfg, b.metrics)
+	b.feedback = NewFeedbackTracker(cfg, b.metrics)
+	b.labels = NewLabelStore(cfg)
+	b.locator = NewBridgeLocator(cfg)
+	b.liveness = NewLivenessTracker(cfg, b.metrics)
+	b.alerter = NewAlerter(cfg, b.liveness)
+	b.nats = NewNatsPublisher(cfg, &b.Resources, b.processResourceRequest, b.signingKey)
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.startWebApi(listener, cfg)
+	}()
 
-	var wg sync.WaitGroup
-	ready := make(chan bool, 1)
+	if cfg.Backend.Replication.PrimaryAddress != "" {
+		// A standby replicates its primary instead of parsing the bridge
+		// descriptors and rotating the resources, until it's promoted.
+		b.replicator = NewReplicator(cfg, &b.Resources, b.rStore, b.rotator)
+		ready := make(chan bool, 1)
+		b.wg.Add(1)
+		go func(replicator *Replicator) {
+			defer b.wg.Done()
+			replicator.Run(b.quit, ready)
+		}(b.replicator)
+		<-ready
+	} else {
+		b.startPrimary()
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.alerter.Run(b.quit)
+	}()
+
+	b.wg.Add(1)
 	go func() {
-		wg.Add(1)
-		defer wg.Done()
-		InitKraken(cfg, quit, ready, b)
+		defer b.wg.Done()
+		b.nats.Run(b.quit)
 	}()
 
-	var srv http.Server
+	b.wg.Add(1)
 	go func() {
-		wg.Add(1)
-		defer wg.Done()
-		b.startWebApi(cfg, &srv)
+		defer b.wg.Done()
+		b.exposure.Run(b.quit)
+	}()
+}
+
+// startPrimary starts the kraken and waits until it parsed our bridge
+// descriptors, then starts the rotations.
+func (b *BackendContext) startPrimary() {
+	ready := make(chan bool, 1)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		InitKraken(b.Config, b.quit, ready, b)
 	}()
 
 	// Wait until our data kraken parsed our bridge descriptors.
 	<-ready
 	log.Println("Kraken finished parsing bridge descriptors.")
 
-	// We're done bootstrapping.  Now wait for a SIGTERM.
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	<-sigint
-	log.Println("Received SIGINT.")
-	close(quit)
-	b.stopWebApi(&srv)
+	// Rotations need the resources to be loaded.
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.rotator.Run(b.quit)
+	}()
+}
+
+// StopBackend shuts down the backend that StartBackend started and waits
+// until all of its goroutines are done.
+func (b *BackendContext) StopBackend() {
+	close(b.quit)
+	b.stopWebApi()
 
 	// Wait for goroutines to finish.
-	wg.Wait()
+	b.wg.Wait()
+	b.rTestPool.Stop()
 	log.Println("All goroutines have finished.  Exiting.")
 }
 
+// ReloadDescriptors makes the kraken reload our bridge descriptors right away
+// instead of waiting for its next tick, and returns once it's done.  A
+// standby backend has no kraken, so it returns right away.
+func (b *BackendContext) ReloadDescriptors() {
+	if b.isStandby() {
+		return
+	}
+	done := make(chan bool)
+	select {
+	case b.reload <- done:
+		<-done
+	case <-b.quit:
+	}
+}
+
 // extractResourceRequest extracts a ResourceRequest from the given HTTP
 // request.  If an error occurs, the function writes the error to the given
 // response writer and returns an error.
@@ -165,43 +298,96 @@ func extractResourceRequest(w http.ResponseWriter, r *http.Request) (*core.Resou
 		return nil, err
 	}
 
+	if err := req.ValidateFilters(); err != nil {
+		log.Printf("Invalid resource request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+
 	return req, nil
 }
 
 // isAuthenticated authenticates the given HTTP request.  If this fails, it
 // writes an error to the given ResponseWriter and returns false.
 func (b *BackendContext) isAuthenticated(w http.ResponseWriter, r *http.Request) bool {
+	return hasValidToken(w, r, b.Config.Backend.ApiTokens)
+}
+
+// authenticatedToken authenticates the given HTTP request and returns the name
+// of its API token.  If this fails, it writes an error to the given
+// ResponseWriter and returns false.
+func (b *BackendContext) authenticatedToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return validTokenName(w, r, b.Config.Backend.ApiTokens)
+}
+
+// isAdmin authenticates the given HTTP request with the admin tokens.  If this
+// fails, it writes an error to the given ResponseWriter and returns false.
+func (b *BackendContext) isAdmin(w http.ResponseWriter, r *http.Request) bool {
+	return hasValidToken(w, r, b.Config.Backend.AdminTokens)
+}
+
+// hasValidToken returns true if the given HTTP request carries one of the
+// given bearer tokens.  If not, it writes an error to the given
+// ResponseWriter.
+func hasValidToken(w http.ResponseWriter, r *http.Request, tokens map[string]string) bool {
+	_, ok := validTokenName(w, r, tokens)
+	return ok
+}
+
+// lookupToken returns the name of the bearer token of the given HTTP request
+// if it's one of the given tokens.  Unlike validTokenName, it doesn't write an
+// error if it's not.
+func lookupToken(r *http.Request, tokens map[string]string) (string, bool) {
+
+	tokenLine := r.Header.Get("Authorization")
+	if !strings.HasPrefix(tokenLine, "Bearer ") {
+		return "", false
+	}
+	givenToken := strings.Split(tokenLine, " ")[1]
+	for name, savedToken := range tokens {
+		if savedToken != "" && givenToken == savedToken {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// validTokenName returns the name of the bearer token of the given HTTP
+// request if it's one of the given tokens.  If not, it writes an error to the
+// given ResponseWriter and returns false.
+func validTokenName(w http.ResponseWriter, r *http.Request, tokens map[string]string) (string, bool) {
 
 	// First, we take the bearer token from the 'Authorization' HTTP header.
 	tokenLine := r.Header.Get("Authorization")
 	if tokenLine == "" {
 		log.Printf("Request carries no 'Authorization' HTTP header.")
-		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
-		return false
+		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusUnauthorized)
+		return "", false
 	}
 	if !strings.HasPrefix(tokenLine, "Bearer ") {
 		log.Printf("Authorization header contains no bearer token.")
-		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
-		return false
+		http.Error(w, "authorization header contains no bearer token", http.StatusUnauthorized)
+		return "", false
 	}
 	fields := strings.Split(tokenLine, " ")
 	givenToken := fields[1]
 
 	// Do we have the given token on record?
-	for _, savedToken := range b.Config.Backend.ApiTokens {
+	for name, savedToken := range tokens {
 		if givenToken == savedToken {
-			return true
+			return name, true
 		}
 	}
 	log.Printf("Invalid authentication token.")
 	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
 
-	return false
+	return "", false
 }
 
 func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !b.isAuthenticated(w, r) {
+	tokenName, ok := b.authenticatedToken(w, r)
+	if !ok {
 		return
 	}
 
@@ -210,6 +396,9 @@ func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !b.isAuthorized(w, tokenName, req) {
+		return
+	}
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -217,34 +406,26 @@ func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	stream := b.newDiffStream(w, r, flusher, req.RequestOrigin)
+	defer stream.close()
 
 	diffs := make(chan *core.ResourceDiff)
 	b.Resources.RegisterChan(req, diffs)
 	defer b.Resources.UnregisterChan(req.RequestOrigin, diffs)
 	defer close(diffs)
-
-	sendDiff := func(diff *core.ResourceDiff) error {
-		jsonBlurb, err := json.MarshalIndent(diff, "", "    ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return err
-		}
-
-		if _, err := fmt.Fprintf(w, string(jsonBlurb)); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return err
-		}
-		fmt.Fprintf(w, "\r") // delimiter
-		flusher.Flush()
-		return nil
-	}
+	b.liveness.StreamOpened(req.RequestOrigin)
+	defer b.liveness.StreamClosed(req.RequestOrigin)
 
 	resourceMap := b.processResourceRequest(req)
 	log.Printf("Sending distributor initial batch: %s", resourceMap)
-	if err := sendDiff(&core.ResourceDiff{New: resourceMap}); err != nil {
+	streamDiffs(stream, r, &core.ResourceDiff{New: resourceMap}, diffs)
+}
+
+// streamDiffs sends the initial diff and then the diffs of the channel on the
+// stream, until the HTTP connection is done.
+func streamDiffs(stream *diffStream, r *http.Request, initial *core.ResourceDiff, diffs chan *core.ResourceDiff) {
+
+	if err := stream.send(initial); err != nil {
 		log.Printf("Error sending initial diff to distributor: %s.", err)
 	}
 
@@ -259,13 +440,13 @@ func (b *BackendContext) getResourceStreamHandler(w http.ResponseWriter, r *http
 				select {
 				case diff := <-diffs:
 					log.Printf("Sending remaining hashring diff.")
-					sendDiff(diff)
+					stream.send(diff)
 				default:
 					return
 				}
 			}
 		case diff := <-diffs:
-			if err := sendDiff(diff); err != nil {
+			if err := stream.send(diff); err != nil {
 				log.Printf("Error sending diff to distributor: %s.", err)
 				break
 			}
@@ -283,9 +464,10 @@ func (b *BackendContext) statusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Without a bridge to look up we show the liveness of the distributors.
 	id := r.FormValue("id")
 	if id == "" {
-		http.Error(w, "no 'id' parameter given", http.StatusBadRequest)
+		b.distributorsStatus(w)
 		return
 	}
 	id = strings.TrimSpace(id)
@@ -299,18 +481,7 @@ func (b *BackendContext) statusHandler(w http.ResponseWriter, r *http.Request) {
 	foundResource := false
 	statuses := []string{"not yet tested", "functional", "dysfunctional"}
 	for rType, sHashring := range b.Resources.Collection {
-		resources := sHashring.Filter(func(r core.Resource) bool {
-			fingerprint, err := getFingerprint(r)
-			if err != nil {
-				return false
-			}
-			if fingerprint == id {
-				return true
-			}
-
-			hFingerprint, err := resources.HashFingerprint(fingerprint)
-			return err == nil && hFingerprint == id
-		}).GetAll()
+		resources := sHashring.Filter(hasFingerprint(id)).GetAll()
 		if len(resources) != 0 {
 			foundResource = true
 		}
@@ -335,19 +506,59 @@ func (b *BackendContext) statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// distributorsStatus writes the liveness of the distributors to the given
+// response writer.
+func (b *BackendContext) distributorsStatus(w http.ResponseWriter) {
+	statuses := b.liveness.Statuses(time.Now().UTC())
+	if len(statuses) == 0 {
+		http.Error(w, "no 'id' parameter given and no distributors connected", http.StatusNotFound)
+		return
+	}
+
+	result := []string{"Distributors:\n\n"}
+	for _, status := range statuses {
+		dResult := fmt.Sprintf("* %s: %s\n", status.Name, status.State)
+		if !status.LastSeen.IsZero() {
+			tDiff := time.Now().UTC().Sub(status.LastSeen)
+			dResult += fmt.Sprintf("  Last seen: %s (%s ago)\n", status.LastSeen, tDiff)
+		}
+		dResult += fmt.Sprintf("  Resource streams: %d\n", status.Streams)
+		result = append(result, dResult+"\n")
+	}
+	fmt.Fprint(w, strings.Join(result, ""))
+}
+
 func (b *BackendContext) processResourceRequest(req *core.ResourceRequest) core.ResourceMap {
 
 	resources := make(core.ResourceMap)
 	for _, rType := range req.ResourceTypes {
-		resources[rType] = b.Resources.Get(req.RequestOrigin, rType)
+		resources[rType] = acceptedResources(req, b.Resources.Get(req.RequestOrigin, rType))
 	}
 
 	return resources
 }
 
+// acceptedResources returns the resources that the given request accepts,
+// i.e. the ones that are not blocked in the locations of the request.
+func acceptedResources(req *core.ResourceRequest, resources []core.Resource) []core.Resource {
+
+	if !req.IsFiltered() {
+		return resources
+	}
+
+	accepted := []core.Resource{}
+	for _, r := range resources {
+		if req.AcceptsResource(r) {
+			accepted = append(accepted, r)
+		}
+	}
+	return accepted
+}
+
 func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !b.isAuthenticated(w, r) {
+	tokenName, ok := b.authenticatedToken(w, r)
+	if !ok {
 		return
 	}
 
@@ -355,11 +566,14 @@ func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Requ
 	if err != nil {
 		return
 	}
+	if !b.isAuthorized(w, tokenName, req) {
+		return
+	}
 	log.Printf("Distributor %q is asking for %q.", req.RequestOrigin, req.ResourceTypes)
 
 	var resources []core.Resource
 	for _, rType := range req.ResourceTypes {
-		resources = append(resources, b.Resources.Get(req.RequestOrigin, rType)...)
+		resources = append(resources, acceptedResources(req, b.Resources.Get(req.RequestOrigin, rType))...)
 	}
 	log.Printf("Returning %d resources of type %s to distributor %q.",
 		len(resources), req.ResourceTypes, req.RequestOrigin)
@@ -369,9 +583,14 @@ func (b *BackendContext) getResourcesHandler(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "error while turning resources into JSON", http.StatusInternalServerError)
 		return
 	}
+	jsonBlurb = append(jsonBlurb, '\n')
 	w.Header().Set("Content-Type", "application/json")
+	if b.signingKey != nil {
+		signature := mechanisms.SignPayload(b.signingKey, mechanisms.SignatureContextResources, req.RequestOrigin, requestNonce(r), 0, jsonBlurb)
+		w.Header().Set(mechanisms.SignatureHeader, signature)
+	}
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, string(jsonBlurb))
+	w.Write(jsonBlurb)
 }
 
 // UnmarshalResources unmarshals a slice of raw JSON messages into the
@@ -408,28 +627,50 @@ func UnmarshalResources(rawResources []json.RawMessage) ([]core.Resource, error)
 	return rs, nil
 }
 
-// postResourcesHandler handles POST requests that register a resource with our
-// backend.
-func (b *BackendContext) postResourcesHandler(w http.ResponseWriter, req *http.Request) {
+// readResources reads the resources in the body of the given HTTP request.  If
+// an error occurs, the function writes the error to the given response writer
+// and returns an error.
+func readResources(w http.ResponseWriter, req *http.Request) ([]core.Resource, error) {
 
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		log.Printf("Error reading %s's request body: %s", req.RemoteAddr, err)
 		http.Error(w, "failed to read request body", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	rawResources := []json.RawMessage{}
 	if err := json.Unmarshal(body, &rawResources); err != nil {
 		log.Printf("Error unmarshalling %s's raw resources: %s", req.RemoteAddr, err)
 		http.Error(w, "failed to unmarshal raw resources", http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
 	rs, err := UnmarshalResources(rawResources)
 	if err != nil {
 		log.Printf("Error unmarshalling %s's resources: %s", req.RemoteAddr, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	return rs, nil
+}
+
+// postResourcesHandler handles POST requests that register a resource with our
+// backend.
+func (b *BackendContext) postResourcesHandler(w http.ResponseWriter, req *http.Request) {
+
+	tokenName, ok := b.authenticatedToken(w, req)
+	if !ok {
+		return
+	}
+
+	rs, err := readResources(w, req)
+	if err != nil {
+		return
+	}
+	if err := authorizeAddition(tokenName, rs); err != nil {
+		log.Printf("Rejecting %s's addition: %s", req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -449,10 +690,110 @@ func (b *BackendContext) postResourcesHandler(w http.ResponseWriter, req *http.R
 	fmt.Fprintln(w, "{}")
 }
 
+// deleteResourcesHandler handles DELETE requests that remove resources from
+// our backend, like the links of the releases that an updater deleted.  The
+// resources are found by their unique ID and their distributors are told that
+// they are gone.  Only the tokens of removableResources can remove resources,
+// and only of their types.
+func (b *BackendContext) deleteResourcesHandler(w http.ResponseWriter, req *http.Request) {
+
+	tokenName, ok := b.authenticatedToken(w, req)
+	if !ok {
+		return
+	}
+
+	rs, err := readResources(w, req)
+	if err != nil {
+		return
+	}
+	if err := authorizeRemoval(tokenName, rs); err != nil {
+		log.Printf("Rejecting %s's removal: %s", req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rTypes := map[string]struct{}{}
+	for _, r := range rs {
+		if !b.Resources.Remove(r) {
+			continue
+		}
+		rTypes[r.Type()] = struct{}{}
+		log.Printf("Removed %s's %q resource from collection.", req.RemoteAddr, r.Type())
+	}
+
+	for rType := range rTypes {
+		b.rStore.Save(rType)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "{}")
+}
+
+// heartbeatHandler handles the heartbeats that the distributors POST to the
+// resource stream endpoint.
+func (b *BackendContext) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+
+	tokenName, ok := b.authenticatedToken(w, r)
+	if !ok {
+		return
+	}
+	b.recordHeartbeat(w, r, originsOf(b.Config, tokenName))
+}
+
+// recordHeartbeat records the heartbeat in the body of the HTTP request, if
+// its request origin is one of the given origins.
+func (b *BackendContext) recordHeartbeat(w http.ResponseWriter, r *http.Request, origins []string) {
+
+	var heartbeat core.Heartbeat
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read HTTP body.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &heartbeat); err != nil {
+		log.Printf("Failed to unmarshal heartbeat %q.", body)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if heartbeat.RequestOrigin == "" {
+		http.Error(w, "no request origin given", http.StatusBadRequest)
+		return
+	}
+	if !contains(origins, heartbeat.RequestOrigin) {
+		log.Printf("Rejecting the heartbeat of %q, the token may only send heartbeats for %q.", heartbeat.RequestOrigin, origins)
+		http.Error(w, OriginMismatchError.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := b.liveness.Heartbeat(&heartbeat, time.Now().UTC()); err != nil {
+		log.Printf("Rejecting the heartbeat of %q: %s", heartbeat.RequestOrigin, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !heartbeat.Streaming {
+		log.Printf("Distributor %q is alive but not connected to the resource stream.", heartbeat.RequestOrigin)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "{}")
+}
+
 // resourcesHandler handles requests coming from distributors (if it's GET
-// requests) and from proxies (if it's POST requests).
+// requests or POST requests to the resource stream endpoint, which are
+// heartbeats), from proxies (if it's POST requests) and from updaters (if it's
+// POST or DELETE requests).  A standby backend gets its resources from its
+// primary, so it refuses the POST and DELETE requests of resources.
 func (b *BackendContext) resourcesHandler(w http.ResponseWriter, r *http.Request) {
 
+	if r.URL.Path == b.Config.Backend.ResourcesEndpoint &&
+		(r.Method == http.MethodPost || r.Method == http.MethodDelete) && b.isStandby() {
+		http.Error(w, "the backend is a standby", http.StatusServiceUnavailable)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		if r.URL.Path == b.Config.Backend.ResourcesEndpoint {
@@ -463,6 +804,12 @@ func (b *BackendContext) resourcesHandler(w http.ResponseWriter, r *http.Request
 	case http.MethodPost:
 		if r.URL.Path == b.Config.Backend.ResourcesEndpoint {
 			b.postResourcesHandler(w, r)
+		} else if r.URL.Path == b.Config.Backend.ResourceStreamEndpoint {
+			b.heartbeatHandler(w, r)
+		}
+	case http.MethodDelete:
+		if r.URL.Path == b.Config.Backend.ResourcesEndpoint {
+			b.deleteResourcesHandler(w, r)
 		}
 	default:
 		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
@@ -470,26 +817,185 @@ func (b *BackendContext) resourcesHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
-// targetsHandler handles requests coming from censorship measurement clients
-// like OONI.
-func (b *BackendContext) targetsHandler(w http.ResponseWriter, r *http.Request) {
+// handoutsHandler handles POST requests coming from distributors that report
+// how many times they handed out each resource.  We reply with the resources
+// of the distributor that are over-exposed.
+func (b *BackendContext) handoutsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
+		http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	tokenName, ok := b.authenticatedToken(w, r)
+	if !ok {
+		return
+	}
+	if b.exposure == nil {
+		http.Error(w, "handout tracking is disabled", http.StatusNotFound)
+		return
+	}
+
+	var report core.HandoutReport
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read HTTP body.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		log.Printf("Failed to unmarshal handout report %q.", body)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !contains(originsOf(b.Config, tokenName), report.RequestOrigin) {
+		log.Printf("Rejecting the handouts of %q reported by %q.", report.RequestOrigin, tokenName)
+		http.Error(w, OriginMismatchError.Error(), http.StatusForbidden)
+		return
+	}
+
+	exposure := b.exposure.Record(&report)
+	log.Printf("Distributor %q reported handouts of %d resources, %d of them are over-exposed.",
+		report.RequestOrigin, len(report.Handouts), len(exposure.OverExposed))
+
+	jsonBlurb, err := json.Marshal(exposure)
+	if err != nil {
+		http.Error(w, "error while turning the exposure report into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// feedbackHandler handles POST requests coming from distributors that report
+// the circumvention feedback of their clients.  We reply with the
+// effectiveness of the transports of each country.
+func (b *BackendContext) feedbackHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !b.isAuthenticated(w, r) {
+	if r.Method != http.MethodPost {
+		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
+		http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	tokenName, ok := b.authenticatedToken(w, r)
+	if !ok {
+		return
+	}
+	if b.feedback == nil {
+		http.Error(w, "feedback tracking is disabled", http.StatusNotFound)
+		return
+	}
+
+	var report core.FeedbackReport
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read HTTP body.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		log.Printf("Failed to unmarshal feedback report %q.", body)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !contains(originsOf(b.Config, tokenName), report.RequestOrigin) {
+		log.Printf("Rejecting the feedback of %q reported by %q.", report.RequestOrigin, tokenName)
+		http.Error(w, OriginMismatchError.Error(), http.StatusForbidden)
+		return
+	}
+
+	effectiveness := b.feedback.Record(&report)
+	log.Printf("Distributor %q reported feedback of %d countries, %d countries have enough feedback.",
+		report.RequestOrigin, len(report.Results), len(effectiveness.Effectiveness))
+
+	jsonBlurb, err := json.Marshal(effectiveness)
+	if err != nil {
+		http.Error(w, "error while turning the effectiveness report into JSON", http.StatusInternalServerError)
 		return
 	}
-	http.Error(w, "not yet implemented", http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
 }
 
-func getFingerprint(resource core.Resource) (string, error) {
-	transport, ok := resource.(*resources.Transport)
-	if ok {
-		return transport.Fingerprint, nil
+// labelsHandler handles requests to list (GET) and to set (POST) the labels of
+// the bridges.  POST requests look like:
+//
+//	{"fingerprint": "0123...", "labels": {"bandwidth": "high"}}
+//
+// and remove the labels of the bridge if no labels are given.
+func (b *BackendContext) labelsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !b.isAdmin(w, r) {
+		return
 	}
 
-	bridge, ok := resource.(*resources.Bridge)
-	if ok {
-		return bridge.Fingerprint, nil
+	switch r.Method {
+	case http.MethodGet:
+		jsonBlurb, err := json.Marshal(b.labels.GetAll())
+		if err != nil {
+			http.Error(w, "error while turning the labels into JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, string(jsonBlurb))
+
+	case http.MethodPost:
+		var req struct {
+			Fingerprint string      `json:"fingerprint"`
+			Labels      core.Labels `json:"labels"`
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			log.Printf("Failed to read HTTP body.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			log.Printf("Failed to unmarshal labels %q.", body)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Fingerprint == "" {
+			http.Error(w, "no fingerprint given", http.StatusBadRequest)
+			return
+		}
+
+		b.labels.Set(req.Fingerprint, req.Labels)
+		log.Printf("Set %d labels for bridge %s.", len(req.Labels), req.Fingerprint)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
+		http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func getFingerprint(resource core.Resource) (string, error) {
+	if fingerprint, ok := resources.Fingerprint(resource); ok {
+		return fingerprint, nil
 	}
 
 	return "", fmt.Errorf("No fingerprint for given resource %s", resource.Type())
 }
+
+// hasFingerprint returns a filter function that only keeps the resources of
+// the bridge with the given fingerprint, or hashed fingerprint, in upper case.
+func hasFingerprint(id string) core.FilterFunc {
+	return func(r core.Resource) bool {
+		fingerprint, err := getFingerprint(r)
+		if err != nil {
+			return false
+		}
+		if fingerprint == id {
+			return true
+		}
+
+		hFingerprint, err := resources.HashFingerprint(fingerprint)
+		return err == nil && hFingerprint == id
+	}
+}
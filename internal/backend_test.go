@@ -61,34 +61,118 @@ func TestPostResourcesHandler(t *testing.T) {
 	b.Config = &Config{}
 	b.Config.Backend.ApiTokens = make(map[string]string)
 	b.Config.Backend.ApiTokens["foo"] = "bar"
+	b.Config.Backend.ApiTokens["gettor"] = "baz"
 
 	b.Resources = *core.NewBackendResources()
 	b.Resources.AddResourceType("obfs4", false, nil)
+	b.Resources.AddResourceType("tblink", false, nil)
 	b.rStore = &ResourceStore{}
 
-	rr := httptest.NewRecorder()
-	body := strings.NewReader("[{\"type\": \"obfs4\", \"address\": \"1.2.3.4\", \"port\": 1234}]")
-	req, err := http.NewRequest("POST", "/resources", body)
-	if err != nil {
-		t.Fatal(err)
+	bridge := "[{\"type\": \"obfs4\", \"address\": \"1.2.3.4\", \"port\": 1234}]"
+	link := "[{\"type\": \"tblink\", \"locale\": \"en\", \"platform\": \"linux64\", \"provider\": \"github\", \"link\": \"https://example.com/tb.tar.xz\"}]"
+	add := func(resource, token string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/resources", strings.NewReader(resource))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		b.postResourcesHandler(rr, req)
+		return rr.Code
 	}
-	req.Header.Add("Authorization", "Bearer bar")
 
-	b.postResourcesHandler(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected HTTP return code 200 but got %d", rr.Code)
+	if code := add(link, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP return code 401 without a token but got %d", code)
+	}
+	if code := add(link, "qux"); code != http.StatusUnauthorized {
+		t.Errorf("expected HTTP return code 401 for an invalid token but got %d", code)
+	}
+	// only the gettor updater can add resources, and only links
+	if code := add(link, "bar"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for another token but got %d", code)
+	}
+	if code := add(bridge, "baz"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for a bridge but got %d", code)
+	}
+	if n := b.Resources.Collection["obfs4"].Len() + b.Resources.Collection["tblink"].Len(); n != 0 {
+		t.Errorf("expected no resources but got %d", n)
 	}
 
-	rr = httptest.NewRecorder()
-	body = strings.NewReader("")
-	req, err = http.NewRequest("POST", "/resources", body)
-	if err != nil {
-		t.Fatal(err)
+	if code := add(link, "baz"); code != http.StatusOK {
+		t.Errorf("expected HTTP return code 200 but got %d", code)
+	}
+	if n := b.Resources.Collection["tblink"].Len(); n != 1 {
+		t.Errorf("expected 1 link but got %d", n)
 	}
-	req.Header.Add("Authorization", "Bearer bar")
+	if code := add("", "baz"); code != http.StatusBadRequest {
+		t.Errorf("expected HTTP return code 400 but got %d", code)
+	}
+}
+
+func TestDeleteResourcesHandler(t *testing.T) {
+
+	b := BackendContext{}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = make(map[string]string)
+	b.Config.Backend.ApiTokens["foo"] = "bar"
+	b.Config.Backend.ApiTokens["gettor"] = "baz"
 
-	b.postResourcesHandler(rr, req)
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected HTTP return code 400 but got %d", rr.Code)
+	b.Resources = *core.NewBackendResources()
+	b.Resources.AddResourceType("obfs4", false, nil)
+	b.Resources.AddResourceType("tblink", false, nil)
+	b.rStore = &ResourceStore{}
+
+	bridge := "[{\"type\": \"obfs4\", \"address\": \"1.2.3.4\", \"port\": 1234}]"
+	link := "[{\"type\": \"tblink\", \"locale\": \"en\", \"platform\": \"linux64\", \"provider\": \"github\", \"link\": \"https://example.com/tb.tar.xz\"}]"
+	for _, resource := range []string{bridge, link} {
+		var raw []json.RawMessage
+		if err := json.Unmarshal([]byte(resource), &raw); err != nil {
+			t.Fatal(err)
+		}
+		rs, err := UnmarshalResources(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Resources.Add(rs[0])
+	}
+	if n := b.Resources.Collection["obfs4"].Len() + b.Resources.Collection["tblink"].Len(); n != 2 {
+		t.Fatalf("expected 2 resources but got %d", n)
+	}
+
+	remove := func(resource, token string) int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("DELETE", "/resources", strings.NewReader(resource))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		b.deleteResourcesHandler(rr, req)
+		return rr.Code
+	}
+
+	// the removal needs to be authenticated
+	if code := remove(link, ""); code == http.StatusOK {
+		t.Error("unauthenticated removal was accepted")
+	}
+	// only the gettor updater can remove resources, and only links
+	if code := remove(link, "bar"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for another token but got %d", code)
+	}
+	if code := remove(bridge, "baz"); code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for a bridge but got %d", code)
+	}
+	if n := b.Resources.Collection["obfs4"].Len(); n != 1 {
+		t.Errorf("expected the bridge to be kept but got %d bridges", n)
+	}
+
+	if code := remove(link, "baz"); code != http.StatusOK {
+		t.Errorf("expected HTTP return code 200 but got %d", code)
+	}
+	if n := b.Resources.Collection["tblink"].Len(); n != 0 {
+		t.Errorf("expected no links but got %d", n)
 	}
 }
@@ -5,6 +5,7 @@
 package internal
 
 import (
+	"context"
 	"log"
 	"sync"
 	"time"
@@ -21,6 +22,9 @@ const (
 	// MaxResources determines the maximum number of resources that we're
 	// willing to buffer before sending a request to bridgestrap.
 	MaxResources = 25
+	// BridgestrapTimeout determines for how long we wait for bridgestrap to
+	// test a batch of resources before giving up.
+	BridgestrapTimeout = 10 * time.Minute
 )
 
 // BridgestrapRequest represents a request for bridgestrap.  Here's what its
@@ -160,7 +164,9 @@ func (p *ResourceTestPool) testResources(rMap map[string]core.Resource) {
 		req.BridgeLines = append(req.BridgeLines, bridgeLine)
 	}
 
-	if err := p.ipc.MakeJsonRequest(req, &resp); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), BridgestrapTimeout)
+	defer cancel()
+	if err := p.ipc.MakeJsonRequest(ctx, req, &resp); err != nil {
 		log.Printf("Bridgestrap request failed: %s", err)
 		return
 	}
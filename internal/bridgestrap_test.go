@@ -5,6 +5,7 @@
 package internal
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -17,7 +18,7 @@ type DummyDelivery struct{}
 
 func (d *DummyDelivery) StartStream(*core.ResourceRequest) {}
 func (d *DummyDelivery) StopStream()                       {}
-func (d *DummyDelivery) MakeJsonRequest(req interface{}, resp interface{}) error {
+func (d *DummyDelivery) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
 	resp.(*BridgestrapResponse).Bridges = make(map[string]*BridgeTest)
 	for _, bridgeLine := range req.(BridgestrapRequest).BridgeLines {
 		resp.(*BridgestrapResponse).Bridges[bridgeLine] = &BridgeTest{Functional: true}
@@ -0,0 +1,147 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+const (
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+// countingWriter counts the bytes written to an HTTP response.
+type countingWriter struct {
+	w     http.ResponseWriter
+	count int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += n
+	return n, err
+}
+
+// diffStream writes the diffs of a resource stream to an HTTP response, and
+// compresses them if the client accepts it.  The diffs are signed for the
+// request origin if the backend has a signing key.
+type diffStream struct {
+	wire       *countingWriter
+	flusher    http.Flusher
+	encoding   string
+	gz         *gzip.Writer
+	metrics    *Metrics
+	signingKey ed25519.PrivateKey
+	origin     string
+	// nonce is the nonce of the request of the stream and seq the number
+	// of the last chunk we sent, both are signed into the chunks
+	nonce string
+	seq   uint64
+}
+
+// negotiateEncoding returns the content encoding of the resource stream for
+// the Accept-Encoding header of the given request.
+func negotiateEncoding(r *http.Request) string {
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(field, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != EncodingGzip {
+			continue
+		}
+		// A quality of 0 means that the client refuses the encoding.
+		refused := false
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[len("q="):], 64); err == nil && q == 0 {
+				refused = true
+			}
+		}
+		if !refused {
+			return EncodingGzip
+		}
+	}
+	return EncodingIdentity
+}
+
+// newDiffStream writes the headers of a resource stream to the given
+// response and returns the stream to send the diffs of the given request
+// origin with.
+func (b *BackendContext) newDiffStream(w http.ResponseWriter, r *http.Request, flusher http.Flusher, origin string) *diffStream {
+	s := &diffStream{
+		wire:       &countingWriter{w: w},
+		flusher:    flusher,
+		encoding:   negotiateEncoding(r),
+		metrics:    b.metrics,
+		signingKey: b.signingKey,
+		origin:     origin,
+		nonce:      requestNonce(r),
+	}
+
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Content-Type", "application/json")
+	if s.encoding == EncodingGzip {
+		w.Header().Set("Content-Encoding", EncodingGzip)
+		s.gz = gzip.NewWriter(s.wire)
+	}
+	if s.signingKey != nil {
+		w.Header().Set(mechanisms.StreamSignatureHeader, mechanisms.SignatureAlgorithm)
+	}
+	w.WriteHeader(http.StatusOK)
+	return s
+}
+
+// send writes the given diff to the stream and flushes it, so the client gets
+// it right away.
+func (s *diffStream) send(diff *core.ResourceDiff) error {
+	jsonBlurb, err := json.MarshalIndent(diff, "", "    ")
+	if err != nil {
+		return err
+	}
+	if s.signingKey != nil {
+		s.seq++
+		jsonBlurb = mechanisms.SignChunk(s.signingKey, s.origin, s.nonce, s.seq, jsonBlurb)
+	}
+	jsonBlurb = append(jsonBlurb, mechanisms.InterMessageDelimiter)
+
+	before := s.wire.count
+	if s.gz == nil {
+		_, err = s.wire.Write(jsonBlurb)
+	} else if _, err = s.gz.Write(jsonBlurb); err == nil {
+		err = s.gz.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+
+	if s.metrics != nil {
+		sent := s.wire.count - before
+		s.metrics.StreamBytes.With(prometheus.Labels{"encoding": s.encoding}).Add(float64(sent))
+		if saved := len(jsonBlurb) - sent; saved > 0 {
+			s.metrics.StreamBytesSaved.Add(float64(saved))
+		}
+	}
+	return nil
+}
+
+// close ends the compressed stream.
+func (s *diffStream) close() {
+	if s.gz != nil {
+		s.gz.Close()
+	}
+}
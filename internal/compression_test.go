@@ -0,0 +1,87 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	expected := map[string]string{
+		"":                      EncodingIdentity,
+		"gzip":                  EncodingGzip,
+		"deflate, GZIP;q=0.5":   EncodingGzip,
+		"br, gzip;q=0":          EncodingIdentity,
+		"gzip; q=0.000, zstd":   EncodingIdentity,
+		"identity, x-gzip, foo": EncodingIdentity,
+	}
+	for header, encoding := range expected {
+		r, _ := http.NewRequest("GET", "/resource-stream", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if e := negotiateEncoding(r); e != encoding {
+			t.Errorf("Accept-Encoding %q was negotiated as %q instead of %q", header, e, encoding)
+		}
+	}
+}
+
+func TestCompressedResourceStream(t *testing.T) {
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.ApiTokens = map[string]string{"moat": "foo"}
+	cfg.Backend.ResourceStreamEndpoint = "/resource-stream"
+	b.Config = &cfg
+	b.metrics = metrics
+	b.Resources = *core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		b.Resources.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(&cfg, &b.Resources, nil, metrics, nil, nil, nil)
+
+	server := httptest.NewServer(http.HandlerFunc(b.resourcesHandler))
+	defer server.Close()
+
+	sentBefore := testutil.ToFloat64(metrics.StreamBytes.WithLabelValues(EncodingGzip))
+	savedBefore := testutil.ToFloat64(metrics.StreamBytesSaved)
+
+	ipc := mechanisms.NewHttpsIpc(server.URL+"/resource-stream", "GET", "foo")
+	diffs := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"obfs4"}, Receiver: diffs})
+	defer ipc.StopStream()
+
+	receive := func() *core.ResourceDiff {
+		select {
+		case diff := <-diffs:
+			return diff
+		case <-time.After(5 * time.Second):
+			t.Fatal("Got no diff from the compressed stream")
+		}
+		return nil
+	}
+	initial := receive()
+	if len(initial.New["obfs4"]) != len(b.Resources.Get("moat", "obfs4")) {
+		t.Errorf("The initial diff has %d resources instead of %d", len(initial.New["obfs4"]), len(b.Resources.Get("moat", "obfs4")))
+	}
+
+	// Later diffs are flushed through the compression too.
+	gone := initial.New["obfs4"][0]
+	b.Resources.Remove(gone)
+	if diff := receive(); len(diff.Gone["obfs4"]) != 1 || diff.Gone["obfs4"][0].Uid() != gone.Uid() {
+		t.Errorf("Wrong diff after the removal: %v", diff)
+	}
+
+	if sent := testutil.ToFloat64(metrics.StreamBytes.WithLabelValues(EncodingGzip)); sent <= sentBefore {
+		t.Error("The stream was not compressed")
+	}
+	if saved := testutil.ToFloat64(metrics.StreamBytesSaved); saved <= savedBefore {
+		t.Error("The compression saved no bytes")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+// ExposureSaveInterval is how often the distribution history is saved, if the
+// distributors reported handouts since it was last saved.
+var ExposureSaveInterval = time.Minute
+
+// resourceExposure is the distribution history of a resource.
+type resourceExposure struct {
+	FirstHandout time.Time `json:"first_handout"`
+	LastHandout  time.Time `json:"last_handout"`
+	// Distributors maps the name of each distributor to the number of
+	// times it handed out the resource
+	Distributors map[string]int `json:"distributors"`
+	// Daily maps the number of days since the epoch to the number of
+	// handouts of that day
+	Daily map[int64]int `json:"daily"`
+}
+
+// ExposureTracker keeps the history of the handouts reported by the
+// distributors, to find out which resources are over-exposed.
+type ExposureTracker struct {
+	sync.Mutex
+	cfg       ExposureConfig
+	metrics   *Metrics
+	store     persistence.Mechanism
+	resources map[core.Hashkey]*resourceExposure
+	// dirty tells if there are handouts that we didn't save yet
+	dirty bool
+}
+
+// NewExposureTracker returns an exposure tracker, or nil if no maximum
+// number of handouts is configured.
+func NewExposureTracker(cfg *Config, metrics *Metrics) *ExposureTracker {
+	if cfg.Backend.Exposure.MaxHandouts <= 0 {
+		return nil
+	}
+
+	t := &ExposureTracker{
+		cfg:     cfg.Backend.Exposure,
+		metrics: metrics,
+	}
+	if cfg.Backend.StorageDir != "" {
+		t.store = pjson.New("exposure", cfg.Backend.StorageDir)
+		err := t.store.Load(&t.resources)
+		if err != nil {
+			log.Println("Can't load the distribution history:", err)
+		}
+	}
+	if t.resources == nil {
+		t.resources = make(map[core.Hashkey]*resourceExposure)
+	}
+	return t
+}
+
+// Record adds the handouts of the report to the distribution history and
+// returns the resources of the reporting distributor that are over-exposed.
+func (t *ExposureTracker) Record(report *core.HandoutReport) *core.ExposureReport {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now().UTC()
+	distName := report.RequestOrigin
+	total := 0
+	for uid, num := range report.Handouts {
+		if num <= 0 {
+			continue
+		}
+		e, exists := t.resources[uid]
+		if !exists {
+			e = &resourceExposure{
+				FirstHandout: now,
+				Distributors: make(map[string]int),
+				Daily:        make(map[int64]int),
+			}
+			t.resources[uid] = e
+		}
+		e.LastHandout = now
+		e.Distributors[distName] += num
+		e.Daily[day(now)] += num
+		total += num
+	}
+	t.metrics.Handouts.With(prometheus.Labels{"distributor": distName}).Add(float64(total))
+
+	var overExposed []core.Hashkey
+	for uid, e := range t.resources {
+		if e.Distributors[distName] != 0 && t.isOverExposed(e, now) {
+			overExposed = append(overExposed, uid)
+		}
+	}
+	sort.Slice(overExposed, func(i, j int) bool { return overExposed[i] < overExposed[j] })
+	t.updateMetrics(now)
+	t.dirty = true
+	return &core.ExposureReport{OverExposed: overExposed}
+}
+
+// Run saves the distribution history every ExposureSaveInterval if it
+// changed, so the reports of the distributors don't write it every time, and
+// when we're told to shut down.
+func (t *ExposureTracker) Run(shutdown chan bool) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(ExposureSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			t.saveIfDirty()
+			return
+		}
+		t.saveIfDirty()
+	}
+}
+
+func (t *ExposureTracker) saveIfDirty() {
+	t.Lock()
+	defer t.Unlock()
+	if t.dirty {
+		t.save()
+	}
+}
+
+// Prune forgets the resources that are not in the collection anymore and the
+// handouts that are out of the window.
+func (t *ExposureTracker) Prune(rcol *core.BackendResources) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	present := make(map[core.Hashkey]bool)
+	for _, hashring := range rcol.Collection {
+		for _, r := range hashring.GetAll() {
+			present[r.Uid()] = true
+		}
+	}
+
+	now := time.Now().UTC()
+	for uid, e := range t.resources {
+		if !present[uid] {
+			delete(t.resources, uid)
+			continue
+		}
+		if t.cfg.WindowDays <= 0 {
+			continue
+		}
+		for d := range e.Daily {
+			if d <= day(now)-int64(t.cfg.WindowDays) {
+				delete(e.Daily, d)
+			}
+		}
+		if len(e.Daily) == 0 {
+			delete(t.resources, uid)
+		}
+	}
+	t.updateMetrics(now)
+	t.save()
+}
+
+// handouts returns the number of handouts of the resource in the window.
+func (t *ExposureTracker) handouts(e *resourceExposure, now time.Time) int {
+	num := 0
+	for d, n := range e.Daily {
+		if t.cfg.WindowDays <= 0 || d > day(now)-int64(t.cfg.WindowDays) {
+			num += n
+		}
+	}
+	return num
+}
+
+func (t *ExposureTracker) isOverExposed(e *resourceExposure, now time.Time) bool {
+	return t.handouts(e, now) >= t.cfg.MaxHandouts
+}
+
+func (t *ExposureTracker) updateMetrics(now time.Time) {
+	overExposed := 0
+	for _, e := range t.resources {
+		if t.isOverExposed(e, now) {
+			overExposed++
+		}
+	}
+	t.metrics.OverExposedResources.Set(float64(overExposed))
+}
+
+// save saves the distribution history, it needs to be called with the lock
+// held.
+func (t *ExposureTracker) save() {
+	if t.store == nil {
+		return
+	}
+	t.dirty = false
+	err := t.store.Save(t.resources)
+	if err != nil {
+		log.Println("Can't save the distribution history:", err)
+	}
+}
+
+// day returns the number of days since the epoch.
+func day(t time.Time) int64 {
+	return t.Unix() / (24 * 60 * 60)
+}
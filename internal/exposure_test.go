@@ -0,0 +1,141 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestExposureDisabled(t *testing.T) {
+	if NewExposureTracker(&testCfg, metrics) != nil {
+		t.Error("Got an exposure tracker without a maximum of handouts")
+	}
+}
+
+func TestExposure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exposure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testCfg
+	cfg.Backend.StorageDir = dir
+	cfg.Backend.Exposure = ExposureConfig{MaxHandouts: 3, WindowDays: 2}
+	tracker := NewExposureTracker(&cfg, metrics)
+	shutdown := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		tracker.Run(shutdown)
+		close(done)
+	}()
+
+	report := tracker.Record(&core.HandoutReport{
+		RequestOrigin: "https",
+		Handouts:      map[core.Hashkey]int{1: 2, 2: 1},
+	})
+	if len(report.OverExposed) != 0 {
+		t.Fatalf("Got over-exposed resources too early: %v", report.OverExposed)
+	}
+
+	report = tracker.Record(&core.HandoutReport{
+		RequestOrigin: "https",
+		Handouts:      map[core.Hashkey]int{1: 1},
+	})
+	if len(report.OverExposed) != 1 || report.OverExposed[0] != 1 {
+		t.Fatalf("Wrong over-exposed resources: %v", report.OverExposed)
+	}
+
+	// resources are only reported to the distributors that handed them out
+	report = tracker.Record(&core.HandoutReport{
+		RequestOrigin: "moat",
+		Handouts:      map[core.Hashkey]int{2: 1},
+	})
+	if len(report.OverExposed) != 0 {
+		t.Errorf("Got over-exposed resources of another distributor: %v", report.OverExposed)
+	}
+
+	// the reports are not saved one by one, but the history survives a
+	// restart
+	if restored := NewExposureTracker(&cfg, metrics); len(restored.resources) != 0 {
+		t.Errorf("The distribution history was saved before the save interval: %+v", restored.resources)
+	}
+	close(shutdown)
+	<-done
+	tracker = NewExposureTracker(&cfg, metrics)
+	if e := tracker.resources[1]; e == nil || e.Distributors["https"] != 3 {
+		t.Fatalf("The distribution history was not restored: %+v", tracker.resources)
+	}
+
+	// old handouts don't count
+	now := time.Now().UTC()
+	e := tracker.resources[1]
+	e.Daily = map[int64]int{day(now) - 2: 3}
+	if tracker.isOverExposed(e, now) {
+		t.Error("Handouts out of the window are counted")
+	}
+}
+
+func TestExposurePrune(t *testing.T) {
+	cfg := testCfg
+	cfg.Backend.Exposure = ExposureConfig{MaxHandouts: 1, WindowDays: 1}
+	tracker := NewExposureTracker(&cfg, metrics)
+
+	rcol := newTestCollection(&cfg, nil)
+	resource := rcol.Collection["obfs4"].GetAll()[0]
+	tracker.Record(&core.HandoutReport{
+		RequestOrigin: "https",
+		Handouts:      map[core.Hashkey]int{resource.Uid(): 1, resource.Uid() + 1: 1},
+	})
+	tracker.Prune(rcol)
+	if len(tracker.resources) != 1 || tracker.resources[resource.Uid()] == nil {
+		t.Errorf("Gone resources were not pruned: %v", tracker.resources)
+	}
+
+	tracker.resources[resource.Uid()].Daily = map[int64]int{day(time.Now().UTC()) - 1: 1}
+	tracker.Prune(rcol)
+	if len(tracker.resources) != 0 {
+		t.Errorf("Resources out of the window were not pruned: %v", tracker.resources)
+	}
+}
+
+func TestHandoutsHandler(t *testing.T) {
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.ApiTokens = map[string]string{"moat": "foo", "https": "bar"}
+	cfg.Backend.Exposure = ExposureConfig{MaxHandouts: 1}
+	b.Config = &cfg
+	b.exposure = NewExposureTracker(&cfg, metrics)
+
+	request := func(token, origin string) int {
+		body, _ := json.Marshal(&core.HandoutReport{
+			RequestOrigin: origin,
+			Handouts:      map[core.Hashkey]int{1: 1},
+		})
+		req := httptest.NewRequest("POST", "/handouts", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		b.handoutsHandler(rec, req)
+		return rec.Code
+	}
+	if code := request("foo", "moat"); code != http.StatusOK {
+		t.Errorf("Got the status code %d for the handouts of the own origin", code)
+	}
+	if code := request("bar", "moat"); code != http.StatusForbidden {
+		t.Errorf("Got the status code %d instead of %d for the handouts of another origin", code, http.StatusForbidden)
+	}
+	if e := b.exposure.resources[1]; e.Distributors["moat"] != 1 || e.Distributors["https"] != 0 {
+		t.Errorf("Wrong distribution history: %+v", e)
+	}
+}
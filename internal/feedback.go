@@ -0,0 +1,153 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+var feedbackCountryRegexp = regexp.MustCompile("^[a-z]{2}$")
+
+// FeedbackTracker aggregates the circumvention feedback that the distributors
+// collect from their clients, to find out which transports work in each
+// country.
+type FeedbackTracker struct {
+	sync.Mutex
+	cfg     FeedbackConfig
+	metrics *Metrics
+	store   persistence.Mechanism
+	// feedback maps countries to transports to the number of days since
+	// the epoch to the results of that day
+	feedback map[string]map[string]map[int64]core.FeedbackResults
+}
+
+// NewFeedbackTracker returns a feedback tracker, or nil if the backend has no
+// feedback endpoint configured.
+func NewFeedbackTracker(cfg *Config, metrics *Metrics) *FeedbackTracker {
+	if cfg.Backend.FeedbackEndpoint == "" {
+		return nil
+	}
+
+	t := &FeedbackTracker{
+		cfg:     cfg.Backend.Feedback,
+		metrics: metrics,
+	}
+	if cfg.Backend.StorageDir != "" {
+		t.store = pjson.New("feedback", cfg.Backend.StorageDir)
+		err := t.store.Load(&t.feedback)
+		if err != nil {
+			log.Println("Can't load the circumvention feedback:", err)
+		}
+	}
+	if t.feedback == nil {
+		t.feedback = make(map[string]map[string]map[int64]core.FeedbackResults)
+	}
+	return t
+}
+
+// Record adds the results of the report to the feedback and returns the
+// effectiveness of the transports of every country that got enough feedback
+// in the window.  The results of invalid country codes are ignored.
+func (t *FeedbackTracker) Record(report *core.FeedbackReport) *core.EffectivenessReport {
+	t.Lock()
+	defer t.Unlock()
+
+	today := day(time.Now().UTC())
+	for country, transports := range report.Results {
+		if !feedbackCountryRegexp.MatchString(country) {
+			log.Printf("Ignoring the feedback of the invalid country code %q.", country)
+			continue
+		}
+		for transport, results := range transports {
+			if transport == "" || results.Worked < 0 || results.Failed < 0 || results.Total() == 0 {
+				continue
+			}
+			if t.feedback[country] == nil {
+				t.feedback[country] = make(map[string]map[int64]core.FeedbackResults)
+			}
+			if t.feedback[country][transport] == nil {
+				t.feedback[country][transport] = make(map[int64]core.FeedbackResults)
+			}
+			daily := t.feedback[country][transport][today]
+			daily.Worked += results.Worked
+			daily.Failed += results.Failed
+			t.feedback[country][transport][today] = daily
+
+			labels := prometheus.Labels{"country": country, "transport": transport}
+			labels["result"] = "worked"
+			t.metrics.CircumventionFeedback.With(labels).Add(float64(results.Worked))
+			labels["result"] = "failed"
+			t.metrics.CircumventionFeedback.With(labels).Add(float64(results.Failed))
+		}
+	}
+
+	t.prune(today)
+	t.save()
+	return t.effectiveness()
+}
+
+// prune forgets the results that are out of the window.
+func (t *FeedbackTracker) prune(today int64) {
+	if t.cfg.WindowDays <= 0 {
+		return
+	}
+	for country, transports := range t.feedback {
+		for transport, daily := range transports {
+			for d := range daily {
+				if d <= today-int64(t.cfg.WindowDays) {
+					delete(daily, d)
+				}
+			}
+			if len(daily) == 0 {
+				delete(transports, transport)
+			}
+		}
+		if len(transports) == 0 {
+			delete(t.feedback, country)
+		}
+	}
+}
+
+// effectiveness returns the results of the transports that have at least
+// MinResults results in the window.  It needs to be called with the lock held
+// and after prune.
+func (t *FeedbackTracker) effectiveness() *core.EffectivenessReport {
+	effectiveness := make(map[string]map[string]core.FeedbackResults)
+	for country, transports := range t.feedback {
+		for transport, daily := range transports {
+			var total core.FeedbackResults
+			for _, results := range daily {
+				total.Worked += results.Worked
+				total.Failed += results.Failed
+			}
+			if total.Total() == 0 || total.Total() < t.cfg.MinResults {
+				continue
+			}
+			if effectiveness[country] == nil {
+				effectiveness[country] = make(map[string]core.FeedbackResults)
+			}
+			effectiveness[country][transport] = total
+		}
+	}
+	return &core.EffectivenessReport{Effectiveness: effectiveness}
+}
+
+func (t *FeedbackTracker) save() {
+	if t.store == nil {
+		return
+	}
+	err := t.store.Save(t.feedback)
+	if err != nil {
+		log.Println("Can't save the circumvention feedback:", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestFeedbackDisabled(t *testing.T) {
+	if NewFeedbackTracker(&testCfg, metrics) != nil {
+		t.Error("Got a feedback tracker without a feedback endpoint")
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feedback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testCfg
+	cfg.Backend.StorageDir = dir
+	cfg.Backend.FeedbackEndpoint = "/feedback"
+	cfg.Backend.Feedback = FeedbackConfig{WindowDays: 2, MinResults: 4}
+	tracker := NewFeedbackTracker(&cfg, metrics)
+
+	report := tracker.Record(&core.FeedbackReport{
+		RequestOrigin: "moat",
+		Results: map[string]map[string]core.FeedbackResults{
+			"ru":  {"obfs4": {Worked: 1, Failed: 2}, "snowflake": {Worked: 1}},
+			"RUS": {"obfs4": {Worked: 10}},
+		},
+	})
+	if len(report.Effectiveness) != 0 {
+		t.Fatalf("Got effectiveness without enough results: %v", report.Effectiveness)
+	}
+
+	report = tracker.Record(&core.FeedbackReport{
+		RequestOrigin: "moat",
+		Results: map[string]map[string]core.FeedbackResults{
+			"ru": {"obfs4": {Failed: 1}},
+		},
+	})
+	if results := report.Effectiveness["ru"]["obfs4"]; results.Worked != 1 || results.Failed != 3 {
+		t.Errorf("Wrong effectiveness of obfs4 in ru: %v", report.Effectiveness)
+	}
+	if _, ok := report.Effectiveness["ru"]["snowflake"]; ok {
+		t.Errorf("Got the effectiveness of snowflake without enough results: %v", report.Effectiveness)
+	}
+	if _, ok := report.Effectiveness["RUS"]; ok {
+		t.Errorf("Got the effectiveness of an invalid country code: %v", report.Effectiveness)
+	}
+
+	// the feedback survives a restart
+	tracker = NewFeedbackTracker(&cfg, metrics)
+	if len(tracker.feedback["ru"]["obfs4"]) != 1 {
+		t.Fatalf("The feedback was not restored: %v", tracker.feedback)
+	}
+
+	// old feedback doesn't count
+	tracker.feedback["ru"]["obfs4"] = map[int64]core.FeedbackResults{day(time.Now().UTC()) - 2: {Worked: 10}}
+	report = tracker.Record(&core.FeedbackReport{RequestOrigin: "moat"})
+	if _, ok := tracker.feedback["ru"]["obfs4"]; ok || len(report.Effectiveness) != 0 {
+		t.Errorf("Feedback out of the window was not pruned: %v", tracker.feedback)
+	}
+}
+
+func TestFeedbackHandler(t *testing.T) {
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.ApiTokens = map[string]string{"moat": "foo", "https": "bar"}
+	cfg.Backend.FeedbackEndpoint = "/feedback"
+	b.Config = &cfg
+	b.feedback = NewFeedbackTracker(&cfg, metrics)
+
+	request := func(token, origin string) (int, *core.EffectivenessReport) {
+		body, _ := json.Marshal(&core.FeedbackReport{
+			RequestOrigin: origin,
+			Results:       map[string]map[string]core.FeedbackResults{"ru": {"obfs4": {Worked: 1}}},
+		})
+		req := httptest.NewRequest("POST", "/feedback", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		b.feedbackHandler(rec, req)
+
+		var report core.EffectivenessReport
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return rec.Code, &report
+	}
+	code, report := request("foo", "moat")
+	if code != http.StatusOK || report.Effectiveness["ru"]["obfs4"].Worked != 1 {
+		t.Errorf("Got the status code %d and the report %v", code, report)
+	}
+	if code, _ := request("bar", "moat"); code != http.StatusForbidden {
+		t.Errorf("Got the status code %d instead of %d for the feedback of another origin", code, http.StatusForbidden)
+	}
+}
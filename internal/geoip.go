@@ -0,0 +1,54 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"log"
+	"net"
+
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// BridgeLocator geolocates the addresses of the bridges, so distributors can
+// avoid handing out bridges hosted in the requester's own country.
+type BridgeLocator struct {
+	geoipdb *geoip.Geoip
+}
+
+// NewBridgeLocator returns a bridge locator using the geoip databases of the
+// configuration, or nil if there are none or they can't be loaded.  All the
+// methods of BridgeLocator can be called on a nil locator.
+func NewBridgeLocator(cfg *Config) *BridgeLocator {
+	if cfg.Backend.GeoipDB == "" && cfg.Backend.Geoip6DB == "" {
+		return nil
+	}
+
+	geoipdb, err := geoip.New(cfg.Backend.GeoipDB, cfg.Backend.Geoip6DB)
+	if err != nil {
+		log.Println("Can't load geoip databases, bridges will not be geolocated:", err)
+		return nil
+	}
+	return &BridgeLocator{geoipdb: geoipdb}
+}
+
+// Locate returns the location of the given address, or nil if it's unknown.
+func (l *BridgeLocator) Locate(addr resources.Addr) *core.Location {
+	if l == nil || addr.Addr == nil {
+		return nil
+	}
+
+	ip := net.ParseIP(addr.String())
+	if ip == nil {
+		// hostnames, e.g. of I2P bridges, can't be located
+		return nil
+	}
+	country, ok := l.geoipdb.GetCountryByAddr(ip)
+	if !ok {
+		return nil
+	}
+	return &core.Location{CountryCode: country}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestBridgeLocator(t *testing.T) {
+	if NewBridgeLocator(&testCfg) != nil {
+		t.Error("Got a bridge locator without geoip databases")
+	}
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 192.0.2.0/24 and 2001:db8::/32
+	geoipFile := filepath.Join(dir, "geoip")
+	geoip6File := filepath.Join(dir, "geoip6")
+	if err := ioutil.WriteFile(geoipFile, []byte("3221225984,3221226239,DE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(geoip6File, []byte("2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,FR\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testCfg
+	cfg.Backend.GeoipDB = geoipFile
+	cfg.Backend.Geoip6DB = geoip6File
+	locator := NewBridgeLocator(&cfg)
+	if locator == nil {
+		t.Fatal("Can't load the geoip databases")
+	}
+
+	for addr, country := range map[string]string{"192.0.2.1": "DE", "2001:db8::1": "FR"} {
+		location := locator.Locate(resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP(addr)}})
+		if location == nil || location.CountryCode != country {
+			t.Errorf("Wrong location for %s: %v", addr, location)
+		}
+	}
+	if location := locator.Locate(resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP("198.51.100.1")}}); location != nil {
+		t.Errorf("Got a location for an unknown address: %v", location)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package integration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	DescriptorsFile   = "bridge-descriptors"
+	ExtrainfoFile     = "cached-extrainfo"
+	NetworkstatusFile = "networkstatus-bridges"
+
+	distributionRequestPrefix = "bridge-distribution-request "
+	fingerprintPrefix         = "fingerprint "
+	routerPrefix              = "router "
+)
+
+var (
+	// assetFiles are the files that the harness copies from the assets
+	// directory.
+	assetFiles = []string{DescriptorsFile, ExtrainfoFile, ExtrainfoFile + ".new", NetworkstatusFile}
+)
+
+// Harness runs the real rdsys backend and distributors in a single process:
+// the backend's kraken parses bridge descriptors from a copy of the test
+// assets, and the distributors get their resources through the backend's
+// resource stream over HTTP, exactly like in production.  Tests change the
+// descriptors, reload them, and check what the distributors hand out.
+type Harness struct {
+	// Config is the configuration of the backend and the distributors.
+	// Tests configure the distributors in Config.Distributors before
+	// calling Start.
+	Config *internal.Config
+	// Dir is the temporary directory with the bridge descriptors that the
+	// backend reads.
+	Dir string
+
+	backend      internal.BackendContext
+	distributors []distributors.Distributor
+}
+
+// NewHarness copies the bridge descriptors in the given assets directory,
+// e.g. internal/test_assets, to a temporary directory and returns a harness
+// whose backend distributes them to the distributors with the given names in
+// equal proportions.
+func NewHarness(assetsDir string, distNames ...string) (*Harness, error) {
+	dir, err := ioutil.TempDir("", "rdsys-integration-")
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range assetFiles {
+		content, err := ioutil.ReadFile(filepath.Join(assetsDir, filename))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), content, 0600); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	cfg := &internal.Config{}
+	cfg.Backend = internal.BackendConfig{
+		ExtrainfoFile:          filepath.Join(dir, ExtrainfoFile),
+		NetworkstatusFile:      filepath.Join(dir, NetworkstatusFile),
+		DescriptorsFile:        filepath.Join(dir, DescriptorsFile),
+		ApiTokens:              make(map[string]string),
+		ResourcesEndpoint:      "/resources",
+		ResourceStreamEndpoint: "/resource-stream",
+		TargetsEndpoint:        "/targets",
+		StatusEndpoint:         "/status",
+		MetricsEndpoint:        "/metrics",
+		DistProportions:        make(map[string]int),
+		Resources: map[string]internal.ResourceConfig{
+			resources.ResourceTypeVanilla: {},
+			resources.ResourceTypeObfs4:   {},
+		},
+	}
+	for _, name := range distNames {
+		cfg.Backend.ApiTokens[name] = name + "-token"
+		cfg.Backend.DistProportions[name] = 1
+	}
+
+	return &Harness{Config: cfg, Dir: dir}, nil
+}
+
+// Start starts the backend on a free local port and then initialises the
+// given distributors, which connect to it.  The function returns once the
+// backend parsed the bridge descriptors, the distributors may still be
+// receiving their initial resources.
+func (h *Harness) Start(dists ...distributors.Distributor) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	h.Config.Backend.WebApi.ApiAddress = listener.Addr().String()
+	h.backend.StartBackend(listener, h.Config)
+
+	for _, dist := range dists {
+		dist.Init(h.Config)
+		h.distributors = append(h.distributors, dist)
+	}
+	return nil
+}
+
+// Stop shuts down the distributors and the backend, and removes the temporary
+// directory.
+func (h *Harness) Stop() {
+	for _, dist := range h.distributors {
+		dist.Shutdown()
+	}
+	h.backend.StopBackend()
+	if err := os.RemoveAll(h.Dir); err != nil {
+		log.Printf("Error removing %s: %s", h.Dir, err)
+	}
+}
+
+// BackendResources returns the resources of the given type that the backend
+// assigned to the given distributor.
+func (h *Harness) BackendResources(distName, rType string) []core.Resource {
+	return h.backend.Resources.Get(distName, rType)
+}
+
+// Reload makes the backend reload the bridge descriptors and returns once
+// it's done.  The distributors may still be receiving the resulting diffs.
+func (h *Harness) Reload() {
+	h.backend.ReloadDescriptors()
+}
+
+// SetDistributionRequest changes the distribution request of the bridge with
+// the given fingerprint in the bridge descriptors.  Call Reload to make the
+// backend pick up the change.
+func (h *Harness) SetDistributionRequest(fingerprint, distName string) error {
+	filename := filepath.Join(h.Dir, DescriptorsFile)
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(content), "\n")
+	found := false
+	requestLine := -1
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, routerPrefix):
+			requestLine = -1
+		case strings.HasPrefix(line, distributionRequestPrefix):
+			requestLine = i
+		case strings.HasPrefix(line, fingerprintPrefix):
+			fp := strings.Replace(strings.TrimPrefix(line, fingerprintPrefix), " ", "", -1)
+			if fp != fingerprint {
+				continue
+			}
+			if requestLine == -1 {
+				return fmt.Errorf("bridge %s has no distribution request", fingerprint)
+			}
+			lines[requestLine] = distributionRequestPrefix + distName
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("bridge %s not found in %s", fingerprint, filename)
+	}
+
+	return ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0600)
+}
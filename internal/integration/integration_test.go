@@ -0,0 +1,139 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/stub"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/xmpp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	assetsDir   = "../test_assets"
+	fingerprint = "56E04AE5C0F64F22206A49939B33FB597BFE1AA7"
+)
+
+func startHarness(t *testing.T) (*Harness, *stub.StubDistributor, *xmpp.XMPPDistributor) {
+	h, err := NewHarness(assetsDir, stub.DistName, xmpp.DistName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Config.Distributors.Stub.Resources = []string{resources.ResourceTypeObfs4}
+	h.Config.Distributors.XMPP.Resources = []string{resources.ResourceTypeObfs4}
+	h.Config.Distributors.XMPP.NumBridgesPerRequest = 2
+	h.Config.Distributors.XMPP.RotationPeriodHours = 24
+	if err := h.SetDistributionRequest(fingerprint, stub.DistName); err != nil {
+		t.Fatal(err)
+	}
+
+	stubDist := &stub.StubDistributor{}
+	xmppDist := &xmpp.XMPPDistributor{}
+	if err := h.Start(stubDist, xmppDist); err != nil {
+		t.Fatal(err)
+	}
+	return h, stubDist, xmppDist
+}
+
+// sameResources returns true if the distributor's resources are the ones that
+// the backend assigned to it, with the same bridge lines.
+func sameResources(backend, dist []core.Resource) bool {
+	if len(backend) != len(dist) {
+		return false
+	}
+	lines := make(map[core.Hashkey]string)
+	for _, r := range backend {
+		lines[r.Oid()] = r.String()
+	}
+	for _, r := range dist {
+		if line, exists := lines[r.Oid()]; !exists || line != r.String() {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInitialResources(t *testing.T) {
+	h, stubDist, xmppDist := startHarness(t)
+	defer h.Stop()
+
+	backendStub := h.BackendResources(stub.DistName, resources.ResourceTypeObfs4)
+	backendXMPP := h.BackendResources(xmpp.DistName, resources.ResourceTypeObfs4)
+	if len(backendStub) == 0 || len(backendXMPP) == 0 {
+		t.Fatalf("The backend didn't assign resources to both distributors: %d %d", len(backendStub), len(backendXMPP))
+	}
+
+	err := testsupport.WaitFor(func() bool { return sameResources(backendStub, stubDist.Partition()) })
+	if err != nil {
+		t.Errorf("The stub distributor didn't get the backend's resources: %d instead of %d",
+			len(stubDist.Partition()), len(backendStub))
+	}
+	err = testsupport.WaitFor(func() bool {
+		return xmppDist.Stats().Resources[resources.ResourceTypeObfs4] == len(backendXMPP)
+	})
+	if err != nil {
+		t.Errorf("The xmpp distributor didn't get the backend's resources: %v", xmppDist.Stats())
+	}
+
+	if len(stubDist.Lookup(fingerprint)) == 0 {
+		t.Errorf("The stub distributor didn't get bridge %s", fingerprint)
+	}
+	bridges, err := xmppDist.GetResources(context.Background(), "user@example.com")
+	if err != nil {
+		t.Fatal("Can't get bridges from the xmpp distributor:", err)
+	}
+	if len(bridges) != 2 {
+		t.Fatalf("Wrong number of bridges: %d", len(bridges))
+	}
+	for _, bridge := range bridges {
+		transport, ok := bridge.(*resources.Transport)
+		if !ok || !transport.IsValid() || transport.Fingerprint == "" {
+			t.Errorf("The xmpp distributor handed out an incomplete bridge: %s", bridge)
+		}
+	}
+}
+
+func TestDescriptorChanges(t *testing.T) {
+	h, stubDist, xmppDist := startHarness(t)
+	defer h.Stop()
+
+	numXMPP := len(h.BackendResources(xmpp.DistName, resources.ResourceTypeObfs4))
+	err := testsupport.WaitFor(func() bool { return len(stubDist.Lookup(fingerprint)) != 0 })
+	if err != nil {
+		t.Fatalf("The stub distributor didn't get bridge %s", fingerprint)
+	}
+
+	// Move the bridge from the stub to the xmpp distributor.  The stub has to
+	// learn that it's gone and xmpp that it's new.
+	if err := h.SetDistributionRequest(fingerprint, xmpp.DistName); err != nil {
+		t.Fatal(err)
+	}
+	h.Reload()
+
+	err = testsupport.WaitFor(func() bool { return len(stubDist.Lookup(fingerprint)) == 0 })
+	if err != nil {
+		t.Errorf("The stub distributor still has bridge %s", fingerprint)
+	}
+	numMoved := len(h.BackendResources(xmpp.DistName, resources.ResourceTypeObfs4))
+	if numMoved <= numXMPP {
+		t.Fatalf("The backend didn't move bridge %s to xmpp", fingerprint)
+	}
+	err = testsupport.WaitFor(func() bool {
+		return xmppDist.Stats().Resources[resources.ResourceTypeObfs4] == numMoved
+	})
+	if err != nil {
+		t.Errorf("The xmpp distributor has %d bridges instead of %d",
+			xmppDist.Stats().Resources[resources.ResourceTypeObfs4], numMoved)
+	}
+
+	backendStub := h.BackendResources(stub.DistName, resources.ResourceTypeObfs4)
+	if !sameResources(backendStub, stubDist.Partition()) {
+		t.Errorf("The stub distributor's resources diverged from the backend's")
+	}
+}
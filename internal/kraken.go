@@ -12,7 +12,6 @@ import (
 	"log"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +29,9 @@ const (
 	TransportPrefix       = "transport"
 	ExtraInfoPrefix       = "extra-info"
 	RecordEndPrefix       = "-----END SIGNATURE-----"
+	// MaxExtrainfoLineLength is the longest line that we accept in the
+	// extra-info documents.
+	MaxExtrainfoLineLength = 1 << 20
 )
 
 var (
@@ -45,11 +47,23 @@ func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendC
 	testFunc := bCtx.rTestPool.GetTestFunc()
 	// Immediately parse bridge descriptor when we're called, and let caller
 	// know when we're done.
-	reloadBridgeDescriptors(cfg, rcol, testFunc, bCtx.metrics)
+	err := reloadBridgeDescriptors(cfg, rcol, testFunc, bCtx.metrics, bCtx.releaser, bCtx.labels, bCtx.locator)
 	calcTestedResources(bCtx.metrics, rcol)
+	bCtx.alerter.CheckResources(rcol, err)
 	ready <- true
 	bCtx.metrics.updateDistributors(cfg, rcol)
 
+	update := func() {
+		bCtx.releaser.Update(rcol)
+		err := reloadBridgeDescriptors(cfg, rcol, testFunc, bCtx.metrics, bCtx.releaser, bCtx.labels, bCtx.locator)
+		pruneExpiredResources(bCtx.metrics, rcol)
+		bCtx.exposure.Prune(rcol)
+		calcTestedResources(bCtx.metrics, rcol)
+		bCtx.alerter.CheckResources(rcol, err)
+		bCtx.metrics.updateDistributors(cfg, rcol)
+		log.Printf("Backend resources: %s", rcol)
+	}
+
 	for {
 		select {
 		case <-shutdown:
@@ -57,11 +71,11 @@ func InitKraken(cfg *Config, shutdown chan bool, ready chan bool, bCtx *BackendC
 			return
 		case <-ticker.C:
 			log.Println("Kraken's ticker is ticking.")
-			reloadBridgeDescriptors(cfg, rcol, testFunc, bCtx.metrics)
-			pruneExpiredResources(bCtx.metrics, rcol)
-			calcTestedResources(bCtx.metrics, rcol)
-			bCtx.metrics.updateDistributors(cfg, rcol)
-			log.Printf("Backend resources: %s", rcol)
+			update()
+		case done := <-bCtx.reload:
+			log.Println("Kraken was asked to reload bridge descriptors.")
+			update()
+			close(done)
 		}
 	}
 }
@@ -123,39 +137,45 @@ func pruneExpiredResources(metrics *Metrics, rcol *core.BackendResources) {
 }
 
 // reloadBridgeDescriptors reloads bridge descriptors from the given
-// cached-extrainfo file and its corresponding cached-extrainfo.new.
-func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc resources.TestFunc, metrics *Metrics) {
+// cached-extrainfo file and its corresponding cached-extrainfo.new.  It
+// returns NotEnoughRunningError if the descriptors were ignored.
+func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc resources.TestFunc, metrics *Metrics, releaser *UnallocatedReleaser, labels *LabelStore, locator *BridgeLocator) error {
 
 	//First load bridge descriptors from network status file
 	bridges, err := loadBridgesFromNetworkstatus(cfg.Backend.NetworkstatusFile)
+	// A reload without network statuses doesn't tell us which bridges are gone.
+	trackAbsences := err == nil && cfg.Backend.GoneAfterReloads > 0
 	if err != nil {
 		if errors.Is(err, NotEnoughRunningError) {
 			log.Printf("Ignore the bridges descriptor: %s", err.Error())
 			metrics.IgnoringBridgeDescriptors.Set(1)
-			return
+			return err
 		}
 		log.Printf("Error loading network statuses: %s", err.Error())
 	}
 	metrics.IgnoringBridgeDescriptors.Set(0)
 
 	distributorNames := make([]string, 0, len(cfg.Backend.DistProportions)+1)
-	distributorNames = append(distributorNames, "none")
+	distributorNames = append(distributorNames, DistributionNone)
 	for dist := range cfg.Backend.DistProportions {
 		distributorNames = append(distributorNames, dist)
 	}
 
-	err = getBridgeDistributionRequest(cfg.Backend.DescriptorsFile, distributorNames, bridges)
+	err = getBridgeDistributionRequest(cfg.Backend.DescriptorsFile, distributorNames, bridges, labels)
 	if err != nil {
 		log.Printf("Error loading bridge descriptors file: %s", err.Error())
 	}
+	releaser.Apply(bridges)
 
 	//Update bridges from extrainfo files
+	malformed := 0
 	for _, filename := range []string{cfg.Backend.ExtrainfoFile, cfg.Backend.ExtrainfoFile + ".new"} {
-		descriptors, err := loadBridgesFromExtrainfo(filename)
+		descriptors, numMalformed, err := loadBridgesFromExtrainfo(filename)
 		if err != nil {
 			log.Printf("Failed to reload bridge descriptors: %s", err)
 			continue
 		}
+		malformed += numMalformed
 
 		for fingerprint, desc := range descriptors {
 			bridge, ok := bridges[fingerprint]
@@ -166,6 +186,7 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 			bridge.Transports = desc.Transports
 		}
 	}
+	metrics.MalformedDescriptors.Set(float64(malformed))
 
 	bl, err := newBlockList(cfg.Backend.BlocklistFile, cfg.Backend.AllowlistFile)
 	if err != nil {
@@ -173,8 +194,10 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 	}
 
 	log.Printf("Adding %d bridges.", len(bridges))
+	present := make(map[core.Hashkey]bool)
 	for _, bridge := range bridges {
 		blockedIn := bl.blockedIn(bridge.Fingerprint)
+		bridgeLabels := labels.Labels(bridge.Fingerprint, bridge.Labels())
 
 		for _, t := range bridge.Transports {
 			if t.Address.Invalid() {
@@ -184,8 +207,11 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 			t.Flags = bridge.Flags
 			t.Distribution = bridge.Distribution
 			t.SetBlockedIn(blockedIn)
+			t.SetLabels(bridgeLabels)
+			t.Location = locator.Locate(t.Address)
 			t.SetTestFunc(testFunc)
 			rcol.Add(t)
+			present[t.Uid()] = true
 		}
 
 		// only hand out vanilla flavour if there are no transports
@@ -195,10 +221,18 @@ func reloadBridgeDescriptors(cfg *Config, rcol *core.BackendResources, testFunc
 				continue
 			}
 			bridge.SetBlockedIn(blockedIn)
+			bridge.SetLabels(bridgeLabels)
+			bridge.Location = locator.Locate(bridge.Address)
 			bridge.SetTestFunc(testFunc)
 			rcol.Add(bridge)
+			present[bridge.Uid()] = true
 		}
 	}
+
+	if trackAbsences {
+		rcol.PruneAbsent(present, cfg.Backend.GoneAfterReloads)
+	}
+	return nil
 }
 
 // learn about available bridges by parsing a network status file
@@ -223,7 +257,7 @@ func loadBridgesFromNetworkstatus(networkstatusFile string) (map[string]*resourc
 		b.Fingerprint = string(status.GetFingerprint())
 
 		if addr, err := net.ResolveIPAddr("", status.Address.IPv6Address.String()); err == nil {
-			b.Address = resources.Addr{addr}
+			b.Address = resources.Addr{Addr: addr}
 			b.Port = status.Address.IPv6ORPort
 			oraddress := resources.ORAddress{
 				IPVersion: 6,
@@ -233,7 +267,7 @@ func loadBridgesFromNetworkstatus(networkstatusFile string) (map[string]*resourc
 			b.ORAddresses = append(b.ORAddresses, oraddress)
 		}
 		if addr, err := net.ResolveIPAddr("", status.Address.IPv4Address.String()); err == nil {
-			b.Address = resources.Addr{addr}
+			b.Address = resources.Addr{Addr: addr}
 			b.Port = status.Address.IPv4ORPort
 			oraddress := resources.ORAddress{
 				IPVersion: 4,
@@ -268,8 +302,9 @@ func loadBridgesFromNetworkstatus(networkstatusFile string) (map[string]*resourc
 	return bridges, nil
 }
 
-// getBridgeDistributionRequest from the bridge-descriptors file
-func getBridgeDistributionRequest(descriptorsFile string, distributorNames []string, bridges map[string]*resources.Bridge) error {
+// getBridgeDistributionRequest from the bridge-descriptors file, together with
+// the labels annotated in the contact line of the descriptors
+func getBridgeDistributionRequest(descriptorsFile string, distributorNames []string, bridges map[string]*resources.Bridge, labels *LabelStore) error {
 	descriptors, err := zoossh.ParseUnsafeDescriptorFile(descriptorsFile)
 	if err != nil {
 		return err
@@ -282,6 +317,8 @@ func getBridgeDistributionRequest(descriptorsFile string, distributorNames []str
 			continue
 		}
 
+		bridge.SetLabels(labels.ParseAnnotations(descriptor.Contact))
+
 		if descriptor.BridgeDistributionRequest != "any" {
 			for _, dist := range distributorNames {
 				if dist == descriptor.BridgeDistributionRequest {
@@ -298,69 +335,100 @@ func getBridgeDistributionRequest(descriptorsFile string, distributorNames []str
 }
 
 // loadBridgesFromExtrainfo loads and returns bridges from Serge's extrainfo
-// files.
-func loadBridgesFromExtrainfo(extrainfoFile string) (map[string]*resources.Bridge, error) {
+// files, and the number of malformed records that it skipped.
+func loadBridgesFromExtrainfo(extrainfoFile string) (map[string]*resources.Bridge, int, error) {
 
 	file, err := os.Open(extrainfoFile)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer file.Close()
 
-	extra, err := parseExtrainfoDoc(file)
+	extra, malformed, err := parseExtrainfoDoc(file)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	for _, err := range malformed {
+		log.Printf("Skipping malformed record in %s: %s", extrainfoFile, err)
 	}
 
-	return extra, nil
+	return extra, len(malformed), nil
 }
 
 // parseExtrainfoDoc parses the given extra-info document and returns the
 // content as a Bridges object.  Note that the extra-info document format is as
 // it's produced by the bridge authority.
-func parseExtrainfoDoc(r io.Reader) (map[string]*resources.Bridge, error) {
+//
+// A malformed record doesn't stop the parsing: a bad 'extra-info' line skips
+// the whole bridge and a bad 'transport' line skips only that transport.  The
+// returned slice has an error for each of them, with its line number.
+func parseExtrainfoDoc(r io.Reader) (map[string]*resources.Bridge, []error, error) {
 
 	bridges := make(map[string]*resources.Bridge)
+	var malformed []error
 
 	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxExtrainfoLineLength)
 	b := resources.NewBridge()
+	// skipRecord is true while we're in a record whose 'extra-info' line is
+	// malformed.
+	skipRecord := false
+	lineNum := 0
 	for scanner.Scan() {
+		lineNum++
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
 
 		// We're dealing with a new extra-info block, i.e., a new bridge.
-		if strings.HasPrefix(line, ExtraInfoPrefix) {
-			words := strings.Split(line, " ")
+		if strings.HasPrefix(line, ExtraInfoPrefix+" ") {
+			b = resources.NewBridge()
+			skipRecord = false
+			words := strings.Fields(line)
 			if len(words) != 3 {
-				return nil, errors.New("incorrect number of words in 'extra-info' line")
+				malformed = append(malformed, fmt.Errorf("line %d: incorrect number of words in 'extra-info' line", lineNum))
+				skipRecord = true
+				continue
+			}
+			if !resources.ValidFingerprint(words[2]) {
+				malformed = append(malformed, fmt.Errorf("line %d: invalid fingerprint %q", lineNum, words[2]))
+				skipRecord = true
+				continue
 			}
 			b.Fingerprint = words[2]
 		}
 
 		// We're dealing with a bridge's transport protocols.  There may be
 		// several.
-		if strings.HasPrefix(line, TransportPrefix) {
+		if strings.HasPrefix(line, TransportPrefix+" ") && !skipRecord {
+			if b.Fingerprint == "" {
+				malformed = append(malformed, fmt.Errorf("line %d: 'transport' line outside of an extra-info record", lineNum))
+				continue
+			}
 			t := resources.NewTransport()
 			t.Fingerprint = b.Fingerprint
 			err := populateTransportInfo(line, t)
 			if err != nil {
-				return nil, err
+				malformed = append(malformed, fmt.Errorf("line %d: bridge %s: %w", lineNum, b.Fingerprint, err))
+				continue
 			}
 			b.AddTransport(t)
 		}
 
 		// Let's store the bridge when the record ends
 		if strings.HasPrefix(line, RecordEndPrefix) {
-			bridges[b.Fingerprint] = b
+			if !skipRecord && b.Fingerprint != "" {
+				bridges[b.Fingerprint] = b
+			}
 			b = resources.NewBridge()
+			skipRecord = false
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return bridges, nil
+	return bridges, malformed, nil
 }
 
 // populateTransportInfo parses the given transport line of the format:
@@ -374,33 +442,28 @@ func populateTransportInfo(transport string, t *resources.Transport) error {
 		return errors.New("no 'transport' prefix")
 	}
 
-	words := strings.Split(transport, " ")
+	words := strings.Fields(transport)
 	if len(words) < MinTransportWords {
 		return errors.New("not enough arguments in 'transport' line")
 	}
+	if words[0] != TransportPrefix {
+		return errors.New("no 'transport' prefix")
+	}
 	t.SetType(words[1])
 
-	host, port, err := net.SplitHostPort(words[2])
-	if err != nil {
-		return err
-	}
-	addr, err := net.ResolveIPAddr("", host)
-	if err != nil {
-		return err
-	}
-	t.Address = resources.Addr{&net.IPAddr{addr.IP, addr.Zone}}
-	p, err := strconv.Atoi(port)
+	addr, port, err := resources.ParseAddrPort(words[2])
 	if err != nil {
 		return err
 	}
-	t.Port = uint16(p)
+	t.Address = addr
+	t.Port = port
 
 	// We may be dealing with one or more key=value pairs.
 	if len(words) > MinTransportWords {
 		args := strings.Split(words[3], ",")
 		for _, arg := range args {
 			kv := strings.Split(arg, "=")
-			if len(kv) != 2 {
+			if len(kv) != 2 || kv[0] == "" {
 				return fmt.Errorf("key:value pair in %q not separated by a '='", words[3])
 			}
 			t.Parameters[kv[0]] = kv[1]
@@ -6,6 +6,7 @@ package internal
 
 import (
 	"errors"
+	"strings"
 	"testing"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
@@ -37,7 +38,7 @@ func TestDistributionMechanism(t *testing.T) {
 	for _, rType := range resourceTypes {
 		rcol.AddResourceType(rType, false, testCfg.Backend.DistProportions)
 	}
-	reloadBridgeDescriptors(&testCfg, rcol, nil, metrics)
+	reloadBridgeDescriptors(&testCfg, rcol, nil, metrics, nil, nil, nil)
 
 	foundAny := make([]bool, len(distributor["any"]))
 	for distName := range testCfg.Backend.DistProportions {
@@ -86,7 +87,7 @@ func TestDistributionMechanismUpdated(t *testing.T) {
 		rcol.AddResourceType(rType, false, testCfg.Backend.DistProportions)
 	}
 
-	reloadBridgeDescriptors(&testCfg, rcol, nil, metrics)
+	reloadBridgeDescriptors(&testCfg, rcol, nil, metrics, nil, nil, nil)
 	rs := rcol.Get("email", "obfs4")
 	found := false
 	for _, res := range rs {
@@ -103,7 +104,7 @@ func TestDistributionMechanismUpdated(t *testing.T) {
 
 	cfg := testCfg
 	cfg.Backend.DescriptorsFile = "./test_assets/bridge-descriptors_update"
-	reloadBridgeDescriptors(&cfg, rcol, nil, metrics)
+	reloadBridgeDescriptors(&cfg, rcol, nil, metrics, nil, nil, nil)
 	rs = rcol.Get("moat", "obfs4")
 	found = false
 	for _, res := range rs {
@@ -127,7 +128,7 @@ func TestOnlyFunctional(t *testing.T) {
 		rcol.AddResourceType(rType, false, testCfg.Backend.DistProportions)
 	}
 
-	reloadBridgeDescriptors(&testCfg, rcol, nil, metrics)
+	reloadBridgeDescriptors(&testCfg, rcol, nil, metrics, nil, nil, nil)
 	calcTestedResources(metrics, rcol)
 	if rcol.OnlyFunctional {
 		t.Errorf("OnlyFunctional flag enabled when most resources are untested")
@@ -199,3 +200,91 @@ func TestFailUnrunning(t *testing.T) {
 		t.Fatalf("Didn't fail for an update with any running bridges")
 	}
 }
+
+const (
+	extrainfoFingerprint  = "1F8A76D9581D72B9B9D84411463445052A78AB71"
+	extrainfoFingerprint2 = "97742B46FFFDAD3E703BA564B3D920739FDA4F38"
+)
+
+func extrainfoRecord(header string, transports ...string) string {
+	record := header + "\npublished 2021-05-16 11:18:37\n"
+	for _, t := range transports {
+		record += t + "\n"
+	}
+	return record + "router-signature\n-----BEGIN SIGNATURE-----\nAAAA\n-----END SIGNATURE-----\n"
+}
+
+func TestParseExtrainfoDocMalformed(t *testing.T) {
+	doc := "transport obfs4 1.2.3.4:443 cert=abc\n" +
+		extrainfoRecord("extra-info Unnamed "+extrainfoFingerprint,
+			"transport obfs4 1.2.3.4:443 cert=abc,iat-mode=0",
+			"transport obfs4 1.2.3.4:99999",
+			"transport obfs4 example.com:443",
+			"transport obfs4",
+			"transport obfs4 1.2.3.4:443 cert",
+			"transport obfs4 1.2.3.4:443 =abc",
+			"transport meek [2001:db8::1]:443") +
+		extrainfoRecord("extra-info Unnamed 97742B46",
+			"transport obfs4 1.2.3.5:443") +
+		extrainfoRecord("extra-info Unnamed",
+			"transport obfs4 1.2.3.6:443") +
+		extrainfoRecord("extra-info Unnamed "+extrainfoFingerprint2,
+			"transport obfs4 1.2.3.7:443")
+
+	bridges, malformed, err := parseExtrainfoDoc(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Failed to parse the document: %s", err)
+	}
+	if len(malformed) != 8 {
+		t.Errorf("Wrong number of malformed records %d: %v", len(malformed), malformed)
+	}
+	if len(bridges) != 2 {
+		t.Fatalf("Wrong number of bridges: %d", len(bridges))
+	}
+	b, ok := bridges[extrainfoFingerprint]
+	if !ok {
+		t.Fatalf("Bridge %s is missing", extrainfoFingerprint)
+	}
+	if len(b.Transports) != 2 {
+		t.Errorf("Wrong number of transports: %d", len(b.Transports))
+	}
+	if _, ok := bridges[extrainfoFingerprint2]; !ok {
+		t.Errorf("Bridge %s after the malformed records is missing", extrainfoFingerprint2)
+	}
+}
+
+func TestParseExtrainfoDocTruncated(t *testing.T) {
+	doc := extrainfoRecord("extra-info Unnamed "+extrainfoFingerprint,
+		"transport obfs4 [2001:db8::1]:443 cert=abc,iat-mode=0")
+
+	// None of the prefixes of a valid document, or of its lines, should make
+	// us panic or return a bridge with a malformed transport.
+	for i := range doc {
+		bridges, _, err := parseExtrainfoDoc(strings.NewReader(doc[:i]))
+		if err != nil {
+			t.Fatalf("Failed to parse truncated document: %s", err)
+		}
+		for _, b := range bridges {
+			for _, tr := range b.Transports {
+				if tr.Address.Invalid() || tr.Port == 0 {
+					t.Errorf("Invalid transport in truncated document: %v", tr)
+				}
+			}
+		}
+	}
+	lines := strings.Split(doc, "\n")
+	for i, line := range lines {
+		for j := range line {
+			truncated := append(append([]string{}, lines[:i]...), line[:j])
+			truncated = append(truncated, lines[i+1:]...)
+			_, _, err := parseExtrainfoDoc(strings.NewReader(strings.Join(truncated, "\n")))
+			if err != nil {
+				t.Fatalf("Failed to parse truncated document: %s", err)
+			}
+		}
+	}
+
+	if _, _, err := parseExtrainfoDoc(strings.NewReader(strings.Repeat("a", MaxExtrainfoLineLength+1))); err == nil {
+		t.Errorf("Parsed a line longer than the maximum")
+	}
+}
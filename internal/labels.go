@@ -0,0 +1,146 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+const (
+	// AnnotationPrefix is the prefix of the label annotations in the
+	// contact line of bridge descriptors, e.g. "rdsys-label:bandwidth=high"
+	AnnotationPrefix = "rdsys-label:"
+)
+
+// LabelStore keeps the labels of the bridges, keyed by fingerprint.  Labels
+// come from three sources, each one overriding the previous ones: the
+// annotations in the bridge descriptors, the configuration, and the labels
+// API.  Only the labels set through the API are persisted, the other ones
+// are read again in each reload of the bridge descriptors.
+type LabelStore struct {
+	sync.Mutex
+	allowedAnnotations map[string]bool
+	configured         map[string]core.Labels
+	store              persistence.Mechanism
+	labels             map[string]core.Labels
+}
+
+// NewLabelStore returns a label store with the labels of the configuration
+// and the ones previously set through the labels API.
+func NewLabelStore(cfg *Config) *LabelStore {
+	s := &LabelStore{
+		allowedAnnotations: make(map[string]bool),
+		configured:         make(map[string]core.Labels),
+	}
+	for _, key := range cfg.Backend.AnnotationLabels {
+		s.allowedAnnotations[key] = true
+	}
+	for fingerprint, labels := range cfg.Backend.Labels {
+		s.configured[fingerprint] = labels
+	}
+
+	if cfg.Backend.StorageDir != "" {
+		s.store = pjson.New("labels", cfg.Backend.StorageDir)
+		err := s.store.Load(&s.labels)
+		if err != nil {
+			log.Println("Can't load the labels of the bridges:", err)
+		}
+	}
+	if s.labels == nil {
+		s.labels = make(map[string]core.Labels)
+	}
+	return s
+}
+
+// ParseAnnotations returns the labels annotated in the given contact line of
+// a bridge descriptor.  Only the label keys listed in the configuration are
+// accepted, as the operators of the bridges can write anything there.
+func (s *LabelStore) ParseAnnotations(contact string) core.Labels {
+	if s == nil {
+		return nil
+	}
+
+	labels := make(core.Labels)
+	for _, field := range strings.Fields(contact) {
+		if !strings.HasPrefix(field, AnnotationPrefix) {
+			continue
+		}
+		keyValue := strings.SplitN(strings.TrimPrefix(field, AnnotationPrefix), "=", 2)
+		if !s.allowedAnnotations[keyValue[0]] {
+			continue
+		}
+		value := ""
+		if len(keyValue) == 2 {
+			value = keyValue[1]
+		}
+		labels[keyValue[0]] = value
+	}
+	return labels
+}
+
+// Labels returns the labels of the bridge with the given fingerprint, merging
+// the given annotated labels with the configured ones and the ones set
+// through the API.
+func (s *LabelStore) Labels(fingerprint string, annotated core.Labels) core.Labels {
+	labels := make(core.Labels)
+	for key, value := range annotated {
+		labels[key] = value
+	}
+	if s == nil {
+		return labels
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, source := range []core.Labels{s.configured[fingerprint], s.labels[fingerprint]} {
+		for key, value := range source {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// Set replaces the labels set through the API for the bridge with the given
+// fingerprint.  Setting no labels removes them.  The new labels are applied
+// in the next reload of the bridge descriptors.
+func (s *LabelStore) Set(fingerprint string, labels core.Labels) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(labels) == 0 {
+		delete(s.labels, fingerprint)
+	} else {
+		s.labels[fingerprint] = labels
+	}
+	s.save()
+}
+
+// GetAll returns the labels set through the API, keyed by fingerprint.
+func (s *LabelStore) GetAll() map[string]core.Labels {
+	s.Lock()
+	defer s.Unlock()
+
+	all := make(map[string]core.Labels)
+	for fingerprint, labels := range s.labels {
+		all[fingerprint] = labels
+	}
+	return all
+}
+
+func (s *LabelStore) save() {
+	if s.store == nil {
+		return
+	}
+	err := s.store.Save(s.labels)
+	if err != nil {
+		log.Println("Can't save the labels of the bridges:", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	cfg := Config{}
+	cfg.Backend.AnnotationLabels = []string{"bandwidth", "port-443"}
+	s := NewLabelStore(&cfg)
+
+	labels := s.ParseAnnotations("Somebody <somebody@example.com> rdsys-label:bandwidth=high rdsys-label:port-443 rdsys-label:donor=partner")
+	if !labels.Equal(core.Labels{"bandwidth": "high", "port-443": ""}) {
+		t.Errorf("Wrong annotated labels: %v", labels)
+	}
+}
+
+func TestLabelStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{}
+	cfg.Backend.StorageDir = dir
+	cfg.Backend.Labels = map[string]map[string]string{"AAAA": {"bandwidth": "high", "donor": "partner"}}
+	s := NewLabelStore(&cfg)
+
+	labels := s.Labels("AAAA", core.Labels{"bandwidth": "low", "port-443": ""})
+	if !labels.Equal(core.Labels{"bandwidth": "high", "donor": "partner", "port-443": ""}) {
+		t.Errorf("Configured labels don't override annotations: %v", labels)
+	}
+
+	s.Set("AAAA", core.Labels{"donor": "community"})
+	s = NewLabelStore(&cfg)
+	labels = s.Labels("AAAA", nil)
+	if !labels.Equal(core.Labels{"bandwidth": "high", "donor": "community"}) {
+		t.Errorf("Labels set through the API don't override configured ones: %v", labels)
+	}
+
+	s.Set("AAAA", nil)
+	if len(s.GetAll()) != 0 {
+		t.Errorf("Labels were not removed: %v", s.GetAll())
+	}
+}
+
+func TestReloadLabels(t *testing.T) {
+	fingerprint := distributor["moat"][0]
+	cfg := testCfg
+	cfg.Backend.Labels = map[string]map[string]string{fingerprint: {"bandwidth": "high"}}
+
+	rcol := core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		rcol.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(&cfg, rcol, nil, metrics, nil, NewLabelStore(&cfg), nil)
+
+	for _, res := range rcol.Get("moat", "obfs4") {
+		transport := res.(*resources.Transport)
+		labeled := transport.Labels()["bandwidth"] == "high"
+		if labeled != (transport.Fingerprint == fingerprint) {
+			t.Errorf("Wrong labels for bridge %s: %v", transport.Fingerprint, transport.Labels())
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	defaultDistributorTimeout = 3 * time.Minute
+
+	// The states of a distributor on the status page.
+	DistributorAlive       = "alive"
+	DistributorLostStream  = "lost stream"
+	DistributorSilent      = "silent"
+	DistributorNoHeartbeat = "no heartbeats"
+)
+
+var UnknownDistributorError = errors.New("the distributor is not configured")
+
+// distributorLiveness is what the backend knows about a distributor.
+type distributorLiveness struct {
+	lastSeen  time.Time
+	streaming bool
+	streams   int
+}
+
+// DistributorStatus is the liveness of a distributor as shown on the status
+// page.
+type DistributorStatus struct {
+	Name     string
+	State    string
+	LastSeen time.Time
+	Streams  int
+}
+
+// LivenessTracker keeps track of the heartbeats and the resource streams of
+// the distributors, to find the ones that are dead or silently lost their
+// stream.  All the methods can be called on a nil tracker and do nothing.
+type LivenessTracker struct {
+	sync.Mutex
+	timeout      time.Duration
+	metrics      *Metrics
+	known        map[string]bool
+	distributors map[string]*distributorLiveness
+}
+
+// NewLivenessTracker returns a liveness tracker for the distributors of the
+// given configuration.
+func NewLivenessTracker(cfg *Config, metrics *Metrics) *LivenessTracker {
+	timeout := time.Duration(cfg.Backend.DistributorTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultDistributorTimeout
+	}
+	return &LivenessTracker{
+		timeout:      timeout,
+		metrics:      metrics,
+		known:        configuredDistributors(cfg),
+		distributors: make(map[string]*distributorLiveness),
+	}
+}
+
+// configuredDistributors returns the names of the distributors that the
+// configuration knows about: the ones of distribution_proportions, of the
+// distributors of the resources, of api_token_origins and of api_tokens, and
+// the standby backends.
+func configuredDistributors(cfg *Config) map[string]bool {
+	known := map[string]bool{ReplicaOrigin: true}
+	for distName := range cfg.Backend.DistProportions {
+		known[distName] = true
+	}
+	for _, rConfig := range cfg.Backend.Resources {
+		for _, distName := range rConfig.Distributors {
+			known[distName] = true
+		}
+	}
+	for tokenName, origins := range cfg.Backend.ApiTokenOrigins {
+		known[tokenName] = true
+		for _, distName := range origins {
+			known[distName] = true
+		}
+	}
+	for tokenName := range cfg.Backend.ApiTokens {
+		known[tokenName] = true
+	}
+	return known
+}
+
+func (t *LivenessTracker) get(distName string) *distributorLiveness {
+	d, exists := t.distributors[distName]
+	if !exists {
+		d = &distributorLiveness{}
+		t.distributors[distName] = d
+	}
+	return d
+}
+
+// Heartbeat records a heartbeat of a distributor.  It returns
+// UnknownDistributorError if the configuration doesn't know the distributor.
+func (t *LivenessTracker) Heartbeat(heartbeat *core.Heartbeat, now time.Time) error {
+	if t == nil {
+		return nil
+	}
+	if !t.known[heartbeat.RequestOrigin] {
+		return UnknownDistributorError
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	d := t.get(heartbeat.RequestOrigin)
+	d.lastSeen = now
+	d.streaming = heartbeat.Streaming
+	if t.metrics != nil {
+		t.metrics.DistributorLastSeen.
+			With(prometheus.Labels{"distributor": heartbeat.RequestOrigin}).
+			Set(float64(now.Unix()))
+	}
+	return nil
+}
+
+// StreamOpened records that a distributor opened a resource stream.
+func (t *LivenessTracker) StreamOpened(distName string) {
+	t.addStreams(distName, 1)
+}
+
+// StreamClosed records that a resource stream of a distributor is closed.
+func (t *LivenessTracker) StreamClosed(distName string) {
+	t.addStreams(distName, -1)
+}
+
+func (t *LivenessTracker) addStreams(distName string, num int) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	d := t.get(distName)
+	d.streams += num
+	if t.metrics != nil {
+		t.metrics.DistributorStreams.
+			With(prometheus.Labels{"distributor": distName}).
+			Set(float64(d.streams))
+	}
+}
+
+// Statuses returns the liveness of all the distributors that sent a heartbeat
+// or opened a stream, sorted by name.
+func (t *LivenessTracker) Statuses(now time.Time) []DistributorStatus {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	statuses := make([]DistributorStatus, 0, len(t.distributors))
+	for name, d := range t.distributors {
+		status := DistributorStatus{
+			Name:     name,
+			LastSeen: d.lastSeen,
+			Streams:  d.streams,
+		}
+		switch {
+		case d.lastSeen.IsZero():
+			// Distributors that don't send heartbeats yet
+			status.State = DistributorNoHeartbeat
+		case now.Sub(d.lastSeen) > t.timeout:
+			status.State = DistributorSilent
+		case d.streams == 0 || !d.streaming:
+			status.State = DistributorLostStream
+		default:
+			status.State = DistributorAlive
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestLiveness(t *testing.T) {
+	cfg := &Config{}
+	cfg.Backend.DistProportions = map[string]int{"https": 1, "salmon": 1}
+	cfg.Backend.ApiTokens = map[string]string{"telegram": "foo"}
+	tracker := NewLivenessTracker(cfg, nil)
+	now := time.Now().UTC()
+
+	tracker.StreamOpened("https")
+	tracker.StreamOpened("moat")
+	tracker.Heartbeat(&core.Heartbeat{RequestOrigin: "https", Streaming: true}, now)
+	tracker.Heartbeat(&core.Heartbeat{RequestOrigin: "salmon", Streaming: true}, now)
+	tracker.Heartbeat(&core.Heartbeat{RequestOrigin: "telegram", Streaming: false}, now)
+	tracker.StreamOpened("telegram")
+	if err := tracker.Heartbeat(&core.Heartbeat{RequestOrigin: "unknown", Streaming: true}, now); err != UnknownDistributorError {
+		t.Errorf("Got the error %v instead of an unknown distributor", err)
+	}
+
+	expected := map[string]string{
+		"https":    DistributorAlive,
+		"moat":     DistributorNoHeartbeat,
+		"salmon":   DistributorLostStream,
+		"telegram": DistributorLostStream,
+	}
+	statuses := tracker.Statuses(now)
+	if len(statuses) != len(expected) {
+		t.Fatalf("Wrong number of distributors: %d", len(statuses))
+	}
+	for i, status := range statuses {
+		if i > 0 && statuses[i-1].Name > status.Name {
+			t.Errorf("The distributors are not sorted: %s > %s", statuses[i-1].Name, status.Name)
+		}
+		if status.State != expected[status.Name] {
+			t.Errorf("Distributor %s is %q instead of %q", status.Name, status.State, expected[status.Name])
+		}
+	}
+
+	statuses = tracker.Statuses(now.Add(defaultDistributorTimeout + time.Second))
+	if statuses[0].Name != "https" || statuses[0].State != DistributorSilent {
+		t.Errorf("The distributor without recent heartbeats is %q", statuses[0].State)
+	}
+
+	tracker.StreamClosed("https")
+	statuses = tracker.Statuses(now)
+	if statuses[0].State != DistributorLostStream || statuses[0].Streams != 0 {
+		t.Errorf("The distributor without streams is %q with %d streams", statuses[0].State, statuses[0].Streams)
+	}
+}
+
+func TestHeartbeatHandler(t *testing.T) {
+	b := BackendContext{}
+	b.Config = &Config{}
+	b.Config.Backend.ApiTokens = map[string]string{"https": "foo", "moat": "bar"}
+	b.Config.Backend.ResourceStreamEndpoint = "/resource-stream"
+	b.Config.Backend.ResourcesEndpoint = "/resources"
+	b.liveness = NewLivenessTracker(b.Config, nil)
+
+	req, err := http.NewRequest("POST", "/resource-stream", strings.NewReader(`{"request_origin": "https", "streaming": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	b.resourcesHandler(rr, req)
+	if rr.Code == http.StatusOK {
+		t.Error("unauthenticated heartbeat was accepted")
+	}
+
+	req, err = http.NewRequest("POST", "/resource-stream", strings.NewReader(`{"request_origin": "https", "streaming": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer foo")
+	rr = httptest.NewRecorder()
+	b.resourcesHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	b.liveness.StreamOpened("https")
+
+	// moat can't send heartbeats for https
+	req, err = http.NewRequest("POST", "/resource-stream", strings.NewReader(`{"request_origin": "https", "streaming": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "Bearer bar")
+	rr = httptest.NewRecorder()
+	b.resourcesHandler(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected HTTP return code 403 for the heartbeat of another distributor but got %d", rr.Code)
+	}
+
+	req, err = http.NewRequest("GET", "/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	b.statusHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected HTTP return code 200 but got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "* https: "+DistributorAlive) {
+		t.Errorf("The status page doesn't show the distributor as alive: %s", rr.Body.String())
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -27,13 +28,40 @@ type Metrics struct {
 	TestedResources           *prometheus.GaugeVec
 	DistributingNonFunctional prometheus.Gauge
 	IgnoringBridgeDescriptors prometheus.Gauge
+	MalformedDescriptors      prometheus.Gauge
 	Resources                 *prometheus.GaugeVec
 	DistributorResources      *prometheus.GaugeVec
 	Requests                  *prometheus.CounterVec
+	UnallocatedResources      prometheus.Gauge
+	PendingReleases           *prometheus.GaugeVec
+	ReleasedResources         *prometheus.CounterVec
+	RotatedResources          *prometheus.CounterVec
+	Handouts                  *prometheus.CounterVec
+	OverExposedResources      prometheus.Gauge
+	CircumventionFeedback     *prometheus.CounterVec
+	DistributorLastSeen       *prometheus.GaugeVec
+	DistributorStreams        *prometheus.GaugeVec
+	StreamBytes               *prometheus.CounterVec
+	StreamBytesSaved          prometheus.Counter
 }
 
-// InitMetrics initialises our Prometheus metrics.
+var (
+	initMetricsOnce sync.Once
+	initMetrics     *Metrics
+)
+
+// InitMetrics initialises our Prometheus metrics.  The metrics are registered
+// in Prometheus' default registry, so they are only created once and all the
+// calls return the same metrics, e.g. when running more than one backend in
+// the same process.
 func InitMetrics() *Metrics {
+	initMetricsOnce.Do(func() {
+		initMetrics = newMetrics()
+	})
+	return initMetrics
+}
+
+func newMetrics() *Metrics {
 
 	metrics := &Metrics{}
 
@@ -62,6 +90,14 @@ func InitMetrics() *Metrics {
 		},
 	)
 
+	metrics.MalformedDescriptors = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "malformed_descriptors",
+			Help:      "The number of malformed records skipped in the last load of the extra-info files",
+		},
+	)
+
 	metrics.Resources = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: PrometheusNamespace,
@@ -89,6 +125,102 @@ func InitMetrics() *Metrics {
 		[]string{"target"},
 	)
 
+	metrics.UnallocatedResources = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "unallocated_resources",
+			Help:      "The number of unallocated bridges that can still be released",
+		},
+	)
+
+	metrics.PendingReleases = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "pending_releases",
+			Help:      "The number of unallocated bridges owed to each distributor to replace blocked ones",
+		},
+		[]string{"distributor"},
+	)
+
+	metrics.ReleasedResources = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "released_resources_total",
+			Help:      "The number of unallocated bridges released to each distributor",
+		},
+		[]string{"distributor"},
+	)
+
+	metrics.RotatedResources = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "rotated_resources_total",
+			Help:      "The number of resources rotated away from each distributor",
+		},
+		[]string{"distributor", "type"},
+	)
+
+	metrics.Handouts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "handouts_total",
+			Help:      "The number of resource handouts reported by each distributor",
+		},
+		[]string{"distributor"},
+	)
+
+	metrics.OverExposedResources = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "over_exposed_resources",
+			Help:      "The number of resources that were handed out too often",
+		},
+	)
+
+	metrics.CircumventionFeedback = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "circumvention_feedback_total",
+			Help:      "The number of circumvention feedback results reported by the clients of each country",
+		},
+		[]string{"country", "transport", "result"},
+	)
+
+	metrics.DistributorLastSeen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "distributor_last_seen_timestamp_seconds",
+			Help:      "The time of the last heartbeat of each distributor",
+		},
+		[]string{"distributor"},
+	)
+
+	metrics.DistributorStreams = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "distributor_streams",
+			Help:      "The number of open resource streams of each distributor",
+		},
+		[]string{"distributor"},
+	)
+
+	metrics.StreamBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "resource_stream_bytes_total",
+			Help:      "The number of bytes sent on the resource streams, by content encoding",
+		},
+		[]string{"encoding"},
+	)
+
+	metrics.StreamBytesSaved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "resource_stream_bytes_saved_total",
+			Help:      "The number of bytes that the compression of the resource streams saved",
+		},
+	)
+
 	return metrics
 }
 
@@ -0,0 +1,366 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+const (
+	defaultNatsSubjectPrefix = "rdsys"
+	defaultNatsReplayHours   = 24
+	// natsBackendInbox is the prefix of the subjects that the backend
+	// receives the acknowledgments of JetStream on
+	natsBackendInbox = "_INBOX.backend"
+)
+
+// natsPrefix returns the prefix of the NATS subjects of the configuration.
+func natsPrefix(cfg *Config) string {
+	if cfg.Backend.Nats.SubjectPrefix == "" {
+		return defaultNatsSubjectPrefix
+	}
+	return cfg.Backend.Nats.SubjectPrefix
+}
+
+// natsReplayPeriod returns how long the streams keep the diffs and the
+// snapshots of the distributors.
+func natsReplayPeriod(cfg *Config) time.Duration {
+	hours := cfg.Backend.Nats.ReplayHours
+	if hours == 0 {
+		hours = defaultNatsReplayHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// natsTLSConfig returns the TLS configuration of the connections to NATS.
+func natsTLSConfig(cfg *Config) *tls.Config {
+	natsCfg := cfg.Backend.Nats
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if natsCfg.CaFile != "" {
+		pem, err := ioutil.ReadFile(natsCfg.CaFile)
+		if err != nil {
+			log.Fatalf("Can't read the NATS CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates in the NATS CA file %s", natsCfg.CaFile)
+		}
+	}
+	if natsCfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(natsCfg.CertFile, natsCfg.KeyFile)
+		if err != nil {
+			log.Fatalf("Can't load the NATS client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig
+}
+
+// natsDistributor is a distributor whose diffs we publish.  The backend
+// sends the diffs to the channel while holding its lock, so they are queued
+// and published from another goroutine, that never blocks the backend.
+type natsDistributor struct {
+	name  string
+	req   *core.ResourceRequest
+	diffs chan *core.ResourceDiff
+	// conns tells the publishing goroutine about a new connection, or nil
+	// when we lose it
+	conns chan *mechanisms.NatsConn
+
+	queueLock sync.Mutex
+	queue     []*core.ResourceDiff
+	queued    chan bool
+
+	// seq is the number of the last diff we published, only used by the
+	// publishing goroutine
+	seq uint64
+}
+
+// NatsPublisher publishes the diffs of the resources of every distributor,
+// and periodic snapshots of all of their resources, on JetStream.  Each
+// distributor has its own stream, so all the replicas of a distributor can
+// subscribe to the diffs and catch up from the stream when they join or miss
+// one.  All the methods can be called on a nil publisher and do nothing.
+type NatsPublisher struct {
+	// signingKey signs the diffs and the snapshots if it's set
+	signingKey   ed25519.PrivateKey
+	url          string
+	prefix       string
+	tlsConfig    *tls.Config
+	replayPeriod time.Duration
+	// epoch tells the distributors that we started numbering the diffs again
+	epoch        string
+	rcol         *core.BackendResources
+	snapshot     func(*core.ResourceRequest) core.ResourceMap
+	distributors map[string]*natsDistributor
+	stop         chan bool
+	wg           sync.WaitGroup
+}
+
+// NewNatsPublisher returns a publisher for the distributors of the
+// configuration, or nil if NATS is not configured.  snapshot returns all the
+// resources of a request.  If signingKey is not nil, it signs the diffs.
+func NewNatsPublisher(cfg *Config, rcol *core.BackendResources, snapshot func(*core.ResourceRequest) core.ResourceMap, signingKey ed25519.PrivateKey) *NatsPublisher {
+	if cfg.Backend.Nats.Url == "" {
+		return nil
+	}
+
+	rTypes := []string{}
+	for rType := range rcol.Collection {
+		rTypes = append(rTypes, rType)
+	}
+	sort.Strings(rTypes)
+	distributors := make(map[string]*natsDistributor)
+	for distName := range cfg.Backend.DistProportions {
+		distributors[distName] = &natsDistributor{
+			name: distName,
+			req: &core.ResourceRequest{
+				RequestOrigin: distName,
+				ResourceTypes: rTypes,
+			},
+			diffs:  make(chan *core.ResourceDiff),
+			conns:  make(chan *mechanisms.NatsConn),
+			queued: make(chan bool, 1),
+		}
+	}
+
+	epoch := make([]byte, 8)
+	rand.Read(epoch)
+	return &NatsPublisher{
+		signingKey:   signingKey,
+		url:          cfg.Backend.Nats.Url,
+		prefix:       natsPrefix(cfg),
+		tlsConfig:    natsTLSConfig(cfg),
+		replayPeriod: natsReplayPeriod(cfg),
+		epoch:        hex.EncodeToString(epoch),
+		rcol:         rcol,
+		snapshot:     snapshot,
+		distributors: distributors,
+		stop:         make(chan bool),
+	}
+}
+
+// Run publishes the diffs until it's told to shut down, and reconnects to
+// NATS when it loses its connection.  The diffs while we're not connected
+// are lost, we publish snapshots when we connect again.
+func (p *NatsPublisher) Run(shutdown chan bool) {
+	if p == nil {
+		return
+	}
+
+	for _, d := range p.distributors {
+		p.rcol.RegisterChan(d.req, d.diffs)
+		p.wg.Add(2)
+		go p.queueDiffs(d)
+		go p.publish(d)
+	}
+
+	opts := &mechanisms.NatsOptions{TLSConfig: p.tlsConfig, InboxPrefix: natsBackendInbox}
+	timeBeforeRetry := mechanisms.DefaultTimeBeforeRetry
+	for {
+		conn, err := mechanisms.DialNats(p.url, opts)
+		if err == nil {
+			err = p.createStreams(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Error connecting to NATS: %s", err)
+			select {
+			case <-time.After(timeBeforeRetry):
+			case <-shutdown:
+				p.shutdown()
+				return
+			}
+			timeBeforeRetry *= 2
+			if timeBeforeRetry > mechanisms.MaxTimeBeforeRetry {
+				timeBeforeRetry = mechanisms.MaxTimeBeforeRetry
+			}
+			continue
+		}
+		timeBeforeRetry = mechanisms.DefaultTimeBeforeRetry
+
+		err = p.serve(conn, shutdown)
+		conn.Close()
+		if err == nil {
+			p.shutdown()
+			return
+		}
+		log.Printf("Lost connection to NATS (%s).  Retrying.", err)
+	}
+}
+
+// createStreams creates the stream of every distributor, that keeps its
+// diffs and snapshots for the replay period.
+func (p *NatsPublisher) createStreams(conn *mechanisms.NatsConn) error {
+	for distName := range p.distributors {
+		err := conn.EnsureStream(&mechanisms.JetStreamConfig{
+			Name: mechanisms.NatsStreamName(p.prefix, distName),
+			Subjects: []string{
+				mechanisms.NatsDiffSubject(p.prefix, distName),
+				mechanisms.NatsSnapshotSubject(p.prefix, distName),
+			},
+			Storage:   "file",
+			Retention: "limits",
+			Discard:   "old",
+			MaxAge:    p.replayPeriod,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serve hands the connection to the publishing goroutines and waits until
+// we're told to shut down, or returns the error of the connection.
+func (p *NatsPublisher) serve(conn *mechanisms.NatsConn, shutdown chan bool) error {
+	p.setConn(conn)
+	defer p.setConn(nil)
+	log.Printf("Publishing the resource diffs on NATS at %s.", p.url)
+
+	select {
+	case <-shutdown:
+		return nil
+	case <-conn.Closed():
+		return conn.Err()
+	}
+}
+
+func (p *NatsPublisher) setConn(conn *mechanisms.NatsConn) {
+	for _, d := range p.distributors {
+		select {
+		case d.conns <- conn:
+		case <-p.stop:
+		}
+	}
+}
+
+// queueDiffs queues the diffs of the distributor until we're told to stop.
+func (p *NatsPublisher) queueDiffs(d *natsDistributor) {
+	defer p.wg.Done()
+	for {
+		select {
+		case diff := <-d.diffs:
+			d.queueLock.Lock()
+			d.queue = append(d.queue, diff)
+			d.queueLock.Unlock()
+			select {
+			case d.queued <- true:
+			default:
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// publish publishes the queued diffs of the distributor, and a snapshot of
+// all of its resources when we connect, after we fail to publish a diff and
+// four times per replay period, so the stream always has a snapshot to
+// start from.  Everything is published from this goroutine, so the stream
+// has the diffs after a snapshot in order.
+func (p *NatsPublisher) publish(d *natsDistributor) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.replayPeriod / 4)
+	defer ticker.Stop()
+
+	var conn *mechanisms.NatsConn
+	for {
+		select {
+		case conn = <-d.conns:
+			if conn != nil {
+				p.publishSnapshot(conn, d)
+			}
+		case <-d.queued:
+			d.queueLock.Lock()
+			queue := d.queue
+			d.queue = nil
+			d.queueLock.Unlock()
+			if conn == nil {
+				// the snapshot when we connect again has these
+				continue
+			}
+			for _, diff := range queue {
+				if err := p.publishDiff(conn, d, diff); err != nil {
+					log.Printf("Error publishing diff of %s on NATS: %s", d.name, err)
+					p.publishSnapshot(conn, d)
+					break
+				}
+			}
+		case <-ticker.C:
+			if conn != nil {
+				p.publishSnapshot(conn, d)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *NatsPublisher) publishDiff(conn *mechanisms.NatsConn, d *natsDistributor, diff *core.ResourceDiff) error {
+	encoded, err := p.encodeNatsDiff(d, d.seq+1, diff, false)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.PublishDurable(mechanisms.NatsDiffSubject(p.prefix, d.name), encoded); err != nil {
+		return err
+	}
+	d.seq++
+	return nil
+}
+
+// publishSnapshot publishes all the resources of the distributor.  The
+// backend sent the queued diffs after updating its resources, so the
+// snapshot has at least the changes of the diffs up to the last one we
+// published and may have the changes of the queued ones, that are applied
+// again.
+func (p *NatsPublisher) publishSnapshot(conn *mechanisms.NatsConn, d *natsDistributor) {
+	diff := &core.ResourceDiff{New: p.snapshot(d.req)}
+	encoded, err := p.encodeNatsDiff(d, d.seq, diff, true)
+	if err != nil {
+		log.Printf("Error encoding snapshot of %s for NATS: %s", d.name, err)
+		return
+	}
+	if _, err := conn.PublishDurable(mechanisms.NatsSnapshotSubject(p.prefix, d.name), encoded); err != nil {
+		log.Printf("Error publishing snapshot of %s on NATS: %s", d.name, err)
+	}
+}
+
+// shutdown unregisters our channels and stops publishing.  The channels are
+// unregistered first, so the backend is not blocked sending us a diff.
+func (p *NatsPublisher) shutdown() {
+	for distName, d := range p.distributors {
+		p.rcol.UnregisterChan(distName, d.diffs)
+	}
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *NatsPublisher) encodeNatsDiff(d *natsDistributor, seq uint64, diff *core.ResourceDiff, snapshot bool) ([]byte, error) {
+	encodedDiff, err := json.Marshal(diff)
+	if err != nil {
+		return nil, err
+	}
+	natsDiff := &mechanisms.NatsDiff{Epoch: p.epoch, Seq: seq, Diff: encodedDiff}
+	if p.signingKey != nil {
+		mechanisms.SignNatsDiff(p.signingKey, d.name, natsDiff, snapshot)
+	}
+	return json.Marshal(natsDiff)
+}
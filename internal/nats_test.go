@@ -0,0 +1,448 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+// natsStream is a JetStream stream of the natsBroker.
+type natsStream struct {
+	subjects []string
+	msgs     []*mechanisms.JetStreamMsg
+}
+
+// natsBroker is a minimal NATS server over TLS that routes the published
+// messages to the subscriptions of its clients, and emulates the parts of
+// JetStream that we use.  It records the subjects that each user subscribes
+// and publishes to.
+type natsBroker struct {
+	sync.Mutex
+	listener  net.Listener
+	tlsConfig *tls.Config
+	caFile    string
+	subs      map[net.Conn]map[string]string
+	streams   map[string]*natsStream
+	// subjects has the subjects that each user subscribed and published to
+	subjects map[string][]string
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and
+// its PEM encoding.
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nats-test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newNatsBroker(t *testing.T, dir string) *natsBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, certPem := newTestCertificate(t)
+	caFile := filepath.Join(dir, "nats-ca.pem")
+	if err := ioutil.WriteFile(caFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	broker := &natsBroker{
+		listener:  listener,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		caFile:    caFile,
+		subs:      make(map[net.Conn]map[string]string),
+		streams:   make(map[string]*natsStream),
+		subjects:  make(map[string][]string),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (broker *natsBroker) url(user string) string {
+	return "tls://" + user + ":password@" + broker.listener.Addr().String()
+}
+
+func subjectMatches(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+func (broker *natsBroker) serve(rawConn net.Conn) {
+	defer rawConn.Close()
+	fmt.Fprintf(rawConn, "INFO {\"auth_required\": true, \"tls_required\": true}\r\n")
+	conn := tls.Server(rawConn, broker.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+
+	broker.Lock()
+	broker.subs[conn] = make(map[string]string)
+	broker.Unlock()
+	defer func() {
+		broker.Lock()
+		delete(broker.subs, conn)
+		broker.Unlock()
+	}()
+
+	user := ""
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			var opts struct {
+				User string `json:"user"`
+			}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &opts)
+			user = opts.User
+		case "PING":
+			broker.write(conn, "PONG\r\n")
+		case "SUB":
+			broker.Lock()
+			broker.subs[conn][fields[2]] = fields[1]
+			broker.subjects[user] = append(broker.subjects[user], fields[1])
+			broker.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			reply := ""
+			if len(fields) == 4 {
+				reply = fields[2]
+			}
+			broker.Lock()
+			broker.subjects[user] = append(broker.subjects[user], fields[1])
+			broker.Unlock()
+			broker.publish(fields[1], reply, payload[:size])
+		}
+	}
+}
+
+// publish routes the message to the subscriptions, stores it in the stream
+// that has its subject and answers the requests to the JetStream API.
+func (broker *natsBroker) publish(subject, reply string, data []byte) {
+	if strings.HasPrefix(subject, "$JS.API.") {
+		broker.deliver(reply, "", broker.jetStreamApi(subject, data))
+		return
+	}
+	broker.deliver(subject, reply, data)
+
+	broker.Lock()
+	defer broker.Unlock()
+	for name, stream := range broker.streams {
+		for _, pattern := range stream.subjects {
+			if !subjectMatches(pattern, subject) {
+				continue
+			}
+			seq := uint64(len(stream.msgs) + 1)
+			stream.msgs = append(stream.msgs, &mechanisms.JetStreamMsg{Subject: subject, Seq: seq, Data: data})
+			if reply != "" {
+				ack, _ := json.Marshal(map[string]interface{}{"stream": name, "seq": seq})
+				go broker.deliver(reply, "", ack)
+			}
+			return
+		}
+	}
+}
+
+func (broker *natsBroker) deliver(subject, reply string, data []byte) {
+	if reply != "" {
+		reply += " "
+	}
+	broker.Lock()
+	defer broker.Unlock()
+	for c, subs := range broker.subs {
+		for sid, pattern := range subs {
+			if subjectMatches(pattern, subject) {
+				fmt.Fprintf(c, "MSG %s %s %s%d\r\n%s\r\n", subject, sid, reply, len(data), data)
+			}
+		}
+	}
+}
+
+func (broker *natsBroker) jetStreamApi(subject string, data []byte) []byte {
+	broker.Lock()
+	defer broker.Unlock()
+	jsError := func(code, errCode int, description string) []byte {
+		resp, _ := json.Marshal(map[string]interface{}{"error": map[string]interface{}{"code": code, "err_code": errCode, "description": description}})
+		return resp
+	}
+
+	tokens := strings.Split(subject, ".")
+	name := tokens[len(tokens)-1]
+	stream, exists := broker.streams[name]
+	switch strings.Join(tokens[2:len(tokens)-1], ".") {
+	case "STREAM.CREATE", "STREAM.UPDATE":
+		var cfg mechanisms.JetStreamConfig
+		json.Unmarshal(data, &cfg)
+		if exists && tokens[3] == "CREATE" {
+			return jsError(400, 10058, "stream name already in use")
+		}
+		if !exists {
+			stream = &natsStream{}
+			broker.streams[name] = stream
+		}
+		stream.subjects = cfg.Subjects
+		return []byte("{}")
+	case "STREAM.MSG.GET":
+		if !exists {
+			return jsError(404, 10059, "stream not found")
+		}
+		var req struct {
+			LastBySubject string `json:"last_by_subj"`
+			NextBySubject string `json:"next_by_subj"`
+			Seq           uint64 `json:"seq"`
+		}
+		json.Unmarshal(data, &req)
+		var found *mechanisms.JetStreamMsg
+		for _, msg := range stream.msgs {
+			if req.LastBySubject != "" && msg.Subject == req.LastBySubject {
+				found = msg
+			}
+			if req.NextBySubject != "" && msg.Subject == req.NextBySubject && msg.Seq >= req.Seq {
+				found = msg
+				break
+			}
+		}
+		if found == nil {
+			return jsError(404, 10037, "no message found")
+		}
+		resp, _ := json.Marshal(map[string]interface{}{"message": found})
+		return resp
+	}
+	return jsError(400, 10000, "unsupported API")
+}
+
+func (broker *natsBroker) write(conn net.Conn, s string) {
+	broker.Lock()
+	defer broker.Unlock()
+	io.WriteString(conn, s)
+}
+
+func TestNatsDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broker := newNatsBroker(t, dir)
+	defer broker.listener.Close()
+
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.Nats = NatsConfig{
+		Url:             broker.url("rdsys"),
+		DistributorUrls: map[string]string{"moat": broker.url("moat")},
+		CaFile:          broker.caFile,
+		Subscribe:       true,
+	}
+	publicKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Distributors.BackendPublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	b.Config = &cfg
+	b.Resources = *core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		b.Resources.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(&cfg, &b.Resources, nil, metrics, nil, nil, nil)
+	moat := b.Resources.Get("moat", "obfs4")
+	if len(moat) < 2 {
+		t.Fatalf("Not enough moat resources in the test assets: %d", len(moat))
+	}
+
+	publisher := NewNatsPublisher(&cfg, &b.Resources, b.processResourceRequest, signingKey)
+	shutdown := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		publisher.Run(shutdown)
+		close(done)
+	}()
+	defer func() {
+		close(shutdown)
+		<-done
+	}()
+
+	receive := func(diffs chan *core.ResourceDiff) *core.ResourceDiff {
+		select {
+		case diff := <-diffs:
+			return diff
+		case <-time.After(5 * time.Second):
+			t.Fatal("Got no diff from NATS")
+		}
+		return nil
+	}
+	subscribe := func() (chan *core.ResourceDiff, func()) {
+		ipc := NewResourceStreamIpc(&cfg, []string{"obfs4"}, "")
+		if _, ok := ipc.(*mechanisms.NatsIpcContext); !ok {
+			t.Fatalf("The distributors don't subscribe to NATS: %T", ipc)
+		}
+		diffs := make(chan *core.ResourceDiff)
+		ipc.StartStream(&core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"obfs4"}, Receiver: diffs})
+		return diffs, ipc.StopStream
+	}
+
+	// Two replicas of the distributor get all of its resources.  The
+	// publisher may not have published a snapshot yet, they try again until
+	// it does.
+	defer func(timeout time.Duration) { mechanisms.NatsSnapshotTimeout = timeout }(mechanisms.NatsSnapshotTimeout)
+	mechanisms.NatsSnapshotTimeout = 100 * time.Millisecond
+	replica1, stop1 := subscribe()
+	defer stop1()
+	replica2, stop2 := subscribe()
+	defer stop2()
+	for _, replica := range []chan *core.ResourceDiff{replica1, replica2} {
+		diff := receive(replica)
+		if len(diff.New["obfs4"]) != len(moat) || len(diff.New["vanilla"]) != 0 {
+			t.Errorf("The replay has %d obfs4 and %d vanilla resources instead of %d obfs4", len(diff.New["obfs4"]), len(diff.New["vanilla"]), len(moat))
+		}
+	}
+
+	b.Resources.Remove(moat[0])
+	for _, replica := range []chan *core.ResourceDiff{replica1, replica2} {
+		diff := receive(replica)
+		if len(diff.Gone["obfs4"]) != 1 || diff.Gone["obfs4"][0].Uid() != moat[0].Uid() {
+			t.Errorf("Wrong diff after the removal: %v", diff)
+		}
+	}
+
+	// A late joiner gets the snapshot from the stream and then the removal,
+	// that the stream has after it.
+	replica3, stop3 := subscribe()
+	defer stop3()
+	if diff := receive(replica3); len(diff.New["obfs4"]) != len(moat) {
+		t.Errorf("The snapshot of the late joiner has %d resources instead of %d", len(diff.New["obfs4"]), len(moat))
+	}
+	if diff := receive(replica3); len(diff.Gone["obfs4"]) != 1 || diff.Gone["obfs4"][0].Uid() != moat[0].Uid() {
+		t.Errorf("Wrong diff from the stream after the snapshot: %v", diff)
+	}
+
+	// An empty snapshot of another epoch that is not signed by the backend,
+	// or an old one, is ignored.
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	forged := &mechanisms.NatsDiff{Epoch: "forged", Diff: []byte("{}")}
+	mechanisms.SignNatsDiff(otherKey, "moat", forged, true)
+	old := &mechanisms.NatsDiff{Epoch: "old", Diff: []byte("{}")}
+	old.Signature = "1 0 " + strings.Fields(forged.Signature)[2]
+	for _, natsDiff := range []*mechanisms.NatsDiff{forged, old} {
+		encoded, _ := json.Marshal(natsDiff)
+		broker.deliver(mechanisms.NatsSnapshotSubject("rdsys", "moat"), "", encoded)
+	}
+	select {
+	case diff := <-replica1:
+		t.Errorf("Applied a snapshot that is not signed by the backend: %v", diff)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The distributor only used its own subjects, and the inbox of its
+	// replies.
+	broker.Lock()
+	defer broker.Unlock()
+	for _, subject := range broker.subjects["moat"] {
+		switch {
+		case subject == mechanisms.NatsDiffSubject("rdsys", "moat"),
+			subject == mechanisms.NatsSnapshotSubject("rdsys", "moat"),
+			subject == "$JS.API.STREAM.MSG.GET."+mechanisms.NatsStreamName("rdsys", "moat"),
+			strings.HasPrefix(subject, mechanisms.NatsInboxPrefix("moat")+"."):
+		default:
+			t.Errorf("The distributor used the subject %s", subject)
+		}
+	}
+}
+
+func TestNatsRequiresTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "INFO {\"auth_required\": true}\r\n")
+			conn.Close()
+		}
+	}()
+
+	url := "nats://token@" + listener.Addr().String()
+	if _, err := mechanisms.DialNats(url, nil); err != mechanisms.NatsTLSRequiredError {
+		t.Errorf("Connected to NATS without TLS configuration: %v", err)
+	}
+	if _, err := mechanisms.DialNats(url, &mechanisms.NatsOptions{TLSConfig: &tls.Config{}}); err != mechanisms.NatsTLSRequiredError {
+		t.Errorf("Connected to a NATS server without TLS: %v", err)
+	}
+}
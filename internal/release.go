@@ -0,0 +1,228 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	// DistributionNone is the distribution request of the bridges that don't
+	// go to any distributor
+	DistributionNone = "none"
+)
+
+// releaseState is the state of the releaser that is kept across restarts.
+type releaseState struct {
+	// Released maps the fingerprints of the released bridges to the
+	// distributor they were released to
+	Released map[string]string `json:"released"`
+	// Blocked is the number of blocked resources that we last saw in each
+	// distributor
+	Blocked map[string]int `json:"blocked"`
+	// Pending is the number of bridges that each distributor is owed
+	Pending map[string]int `json:"pending"`
+	// Budget is how many bridges we can release right now
+	Budget     float64   `json:"budget"`
+	LastUpdate time.Time `json:"last_update"`
+}
+
+// UnallocatedReleaser slowly releases the unallocated bridges (the ones with
+// the distribution request "none") into the distributor pools, one for each
+// resource that gets blocked in a distributor, as long as the release rate
+// allows it.
+type UnallocatedReleaser struct {
+	cfg          *ReleaseConfig
+	distributors []string
+	metrics      *Metrics
+	store        persistence.Mechanism
+	state        releaseState
+}
+
+// NewUnallocatedReleaser returns a releaser for the configuration, or nil if
+// releasing unallocated bridges is disabled.
+func NewUnallocatedReleaser(cfg *Config, metrics *Metrics) *UnallocatedReleaser {
+	releaseCfg := &cfg.Backend.UnallocatedRelease
+	if releaseCfg.MaxPerDay <= 0 {
+		return nil
+	}
+
+	r := &UnallocatedReleaser{
+		cfg:          releaseCfg,
+		distributors: releaseCfg.Distributors,
+		metrics:      metrics,
+	}
+	if len(r.distributors) == 0 {
+		for dist := range cfg.Backend.DistProportions {
+			r.distributors = append(r.distributors, dist)
+		}
+	}
+	sort.Strings(r.distributors)
+
+	if cfg.Backend.StorageDir != "" {
+		r.store = pjson.New("unallocated-release", cfg.Backend.StorageDir)
+		err := r.store.Load(&r.state)
+		if err != nil {
+			log.Println("Can't load the state of the unallocated releases:", err)
+		}
+	}
+	if r.state.Released == nil {
+		r.state.Released = make(map[string]string)
+	}
+	if r.state.Blocked == nil {
+		r.state.Blocked = make(map[string]int)
+	}
+	if r.state.Pending == nil {
+		r.state.Pending = make(map[string]int)
+	}
+	if r.state.LastUpdate.IsZero() {
+		r.state.Budget = float64(releaseCfg.MaxPerDay)
+		r.state.LastUpdate = time.Now()
+	}
+	return r
+}
+
+func resourceFingerprint(r core.Resource) string {
+	switch b := r.(type) {
+	case *resources.Transport:
+		return b.Fingerprint
+	case *resources.Bridge:
+		return b.Fingerprint
+	}
+	return ""
+}
+
+// Apply sets the distribution of the released bridges, it has to be called
+// after the distribution requests are loaded and before the bridges are added
+// to the resources.  Bridges that changed their distribution request since
+// they were released are forgotten, so the operator's choice always wins.
+func (r *UnallocatedReleaser) Apply(bridges map[string]*resources.Bridge) {
+	if r == nil {
+		return
+	}
+
+	for fingerprint, dist := range r.state.Released {
+		bridge, ok := bridges[fingerprint]
+		if !ok {
+			continue
+		}
+		if bridge.Distribution != DistributionNone {
+			delete(r.state.Released, fingerprint)
+			continue
+		}
+		bridge.Distribution = dist
+	}
+	r.save()
+}
+
+// Update looks for resources blocked since the last update and releases
+// unallocated bridges to replace them.  The releases take effect the next
+// time the bridge descriptors are reloaded.
+func (r *UnallocatedReleaser) Update(rcol *core.BackendResources) {
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+	perDay := float64(r.cfg.MaxPerDay)
+	r.state.Budget += perDay * now.Sub(r.state.LastUpdate).Hours() / 24
+	if r.state.Budget > perDay {
+		r.state.Budget = perDay
+	}
+	r.state.LastUpdate = now
+
+	blocked := make(map[string]int)
+	unallocated := make(map[string]bool)
+	for _, hashring := range rcol.Collection {
+		for _, res := range hashring.GetAll() {
+			fingerprint := resourceFingerprint(res)
+			if fingerprint == "" {
+				continue
+			}
+			isBlocked := len(res.BlockedIn()) != 0
+			if res.Distributor() == DistributionNone {
+				if _, released := r.state.Released[fingerprint]; !released {
+					// a bridge is only as good as its most blocked transport
+					unallocated[fingerprint] = unallocated[fingerprint] || isBlocked
+				}
+				continue
+			}
+			if !isBlocked {
+				continue
+			}
+			for _, dist := range r.distributors {
+				if hashring.DoesDistOwnResource(res, dist) {
+					blocked[dist]++
+					break
+				}
+			}
+		}
+	}
+
+	for _, dist := range r.distributors {
+		if last, seen := r.state.Blocked[dist]; seen && blocked[dist] > last {
+			r.state.Pending[dist] += blocked[dist] - last
+		}
+		r.state.Blocked[dist] = blocked[dist]
+	}
+
+	var candidates []string
+	for fingerprint, isBlocked := range unallocated {
+		if !isBlocked {
+			candidates = append(candidates, fingerprint)
+		}
+	}
+	sort.Strings(candidates)
+
+	for len(candidates) > 0 && r.state.Budget >= 1 {
+		dist := r.mostPending()
+		if dist == "" {
+			break
+		}
+		fingerprint := candidates[0]
+		candidates = candidates[1:]
+		r.state.Released[fingerprint] = dist
+		r.state.Pending[dist]--
+		r.state.Budget--
+		log.Printf("Releasing unallocated bridge %s to distributor %s.", fingerprint, dist)
+		r.metrics.ReleasedResources.With(prometheus.Labels{"distributor": dist}).Inc()
+	}
+
+	r.metrics.UnallocatedResources.Set(float64(len(candidates)))
+	for _, dist := range r.distributors {
+		r.metrics.PendingReleases.With(prometheus.Labels{"distributor": dist}).Set(float64(r.state.Pending[dist]))
+	}
+	r.save()
+}
+
+// mostPending returns the distributor that is owed the most bridges, or an
+// empty string if none is owed any.
+func (r *UnallocatedReleaser) mostPending() string {
+	dist := ""
+	for _, d := range r.distributors {
+		if r.state.Pending[d] > 0 && (dist == "" || r.state.Pending[d] > r.state.Pending[dist]) {
+			dist = d
+		}
+	}
+	return dist
+}
+
+func (r *UnallocatedReleaser) save() {
+	if r.store == nil {
+		return
+	}
+	err := r.store.Save(r.state)
+	if err != nil {
+		log.Println("Can't save the state of the unallocated releases:", err)
+	}
+}
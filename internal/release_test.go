@@ -0,0 +1,108 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func newTestCollection(cfg *Config, releaser *UnallocatedReleaser) *core.BackendResources {
+	rcol := core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		rcol.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(cfg, rcol, nil, metrics, releaser, nil, nil)
+	return rcol
+}
+
+// blockDistributor blocks num obfs4 resources of distName.
+func blockDistributor(rcol *core.BackendResources, distName string, num int) {
+	for _, r := range rcol.Get(distName, "obfs4") {
+		if num == 0 {
+			return
+		}
+		r.SetBlockedIn(core.LocationSet{"ru": true})
+		num--
+	}
+}
+
+func countUnallocated(rcol *core.BackendResources) int {
+	n := 0
+	for _, r := range rcol.Collection["obfs4"].GetAll() {
+		if r.Distributor() == DistributionNone {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUnallocatedReleaseDisabled(t *testing.T) {
+	if NewUnallocatedReleaser(&testCfg, metrics) != nil {
+		t.Error("Got a releaser without a release rate")
+	}
+}
+
+func TestUnallocatedRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testCfg
+	cfg.Backend.StorageDir = dir
+	cfg.Backend.UnallocatedRelease = ReleaseConfig{MaxPerDay: 2, Distributors: []string{"email"}}
+	releaser := NewUnallocatedReleaser(&cfg, metrics)
+	rcol := newTestCollection(&cfg, releaser)
+	unallocated := countUnallocated(rcol)
+	if unallocated == 0 {
+		t.Fatal("No unallocated bridges in the test assets")
+	}
+	numEmail := len(rcol.Get("email", "obfs4"))
+
+	// the blocks that were there before the first update don't count
+	blockDistributor(rcol, "email", 1)
+	releaser.Update(rcol)
+	if len(releaser.state.Released) != 0 {
+		t.Fatalf("Released bridges without new blocks: %v", releaser.state.Released)
+	}
+
+	blockDistributor(rcol, "email", 4)
+	blockDistributor(rcol, "moat", 2)
+	releaser.Update(rcol)
+	if len(releaser.state.Released) != 2 {
+		t.Fatalf("Released %d bridges instead of the daily rate", len(releaser.state.Released))
+	}
+	if releaser.state.Pending["email"] != 1 {
+		t.Errorf("Wrong number of pending releases: %d", releaser.state.Pending["email"])
+	}
+	for fingerprint, dist := range releaser.state.Released {
+		if dist != "email" {
+			t.Errorf("Bridge %s released to %s", fingerprint, dist)
+		}
+	}
+
+	reloadBridgeDescriptors(&cfg, rcol, nil, metrics, releaser, nil, nil)
+	if n := len(rcol.Get("email", "obfs4")); n != numEmail+2 {
+		t.Errorf("Wrong number of email resources after the release: %d", n)
+	}
+	if n := countUnallocated(rcol); n != unallocated-2 {
+		t.Errorf("Wrong number of unallocated resources after the release: %d", n)
+	}
+
+	// the releases survive a restart
+	releaser = NewUnallocatedReleaser(&cfg, metrics)
+	if len(releaser.state.Released) != 2 || releaser.state.Pending["email"] != 1 {
+		t.Errorf("The release state was not restored: %+v", releaser.state)
+	}
+	rcol = newTestCollection(&cfg, releaser)
+	if n := len(rcol.Get("email", "obfs4")); n != numEmail+2 {
+		t.Errorf("Wrong number of email resources after a restart: %d", n)
+	}
+}
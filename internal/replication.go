@@ -0,0 +1,371 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+const (
+	// ReplicaOrigin is the request origin of the standby backends in the
+	// replication stream and its heartbeats.
+	ReplicaOrigin = "standby"
+
+	defaultSnapshotInterval = time.Minute
+	snapshotTimeout         = time.Minute
+
+	replicationStreamPath  = "/stream"
+	replicationPromotePath = "/promote"
+)
+
+// replicationSnapshot is the state of the primary backend that the standby
+// backends fetch from the replication endpoint.  The resource stream doesn't
+// have the test results or the rotations of the resources, and diffs can be
+// lost when the stream reconnects.
+type replicationSnapshot struct {
+	Time           time.Time                                     `json:"time"`
+	OnlyFunctional bool                                          `json:"only_functional"`
+	Resources      map[string][]json.RawMessage                  `json:"resources"`
+	Tests          map[string]map[core.Hashkey]core.ResourceTest `json:"tests"`
+	Generations    map[string]map[core.Hashkey]uint64            `json:"generations"`
+	LastRotation   map[string]time.Time                          `json:"last_rotation"`
+}
+
+// Replicator keeps the resources of a standby backend in sync with the ones
+// of its primary, so the distributors can fail over to the standby without
+// waiting for it to parse the bridge descriptors.  It consumes the
+// replication stream of the primary, which has the updates of all the
+// resources, and fetches a snapshot of its state every snapshot interval.
+type Replicator struct {
+	endpoint string
+	token    string
+	interval time.Duration
+	rcol     *core.BackendResources
+	rStore   *ResourceStore
+	rotator  *ResourceRotator
+	ipc      *mechanisms.HttpsIpcContext
+	client   *http.Client
+	stop     chan bool
+	done     chan bool
+}
+
+// NewReplicator returns a replicator of the primary backend of the
+// configuration.
+func NewReplicator(cfg *Config, rcol *core.BackendResources, rStore *ResourceStore, rotator *ResourceRotator) *Replicator {
+	replicationCfg := cfg.Backend.Replication
+	interval := time.Duration(replicationCfg.SnapshotIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	endpoint := "http://" + replicationCfg.PrimaryAddress + cfg.Backend.ReplicationEndpoint
+
+	return &Replicator{
+		endpoint: endpoint,
+		token:    replicationCfg.ApiToken,
+		interval: interval,
+		rcol:     rcol,
+		rStore:   rStore,
+		rotator:  rotator,
+		ipc:      mechanisms.NewHttpsIpc(endpoint+replicationStreamPath, "GET", replicationCfg.ApiToken),
+		client:   &http.Client{Timeout: snapshotTimeout},
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+}
+
+// Run replicates the primary backend until shutdown is closed or the
+// replicator is stopped.  It writes to ready once it applied the first
+// snapshot of the primary, or when it returns.
+func (r *Replicator) Run(shutdown chan bool, ready chan bool) {
+	defer close(r.done)
+	var readyOnce sync.Once
+	signalReady := func() {
+		readyOnce.Do(func() { ready <- true })
+	}
+	defer signalReady()
+
+	log.Printf("Replicating the primary backend at %s.", r.endpoint)
+	rTypes := make([]string, 0, len(r.rcol.Collection))
+	for rType := range r.rcol.Collection {
+		rTypes = append(rTypes, rType)
+	}
+	diffs := make(chan *core.ResourceDiff)
+	r.ipc.StartStream(&core.ResourceRequest{
+		RequestOrigin: ReplicaOrigin,
+		ResourceTypes: rTypes,
+		Receiver:      diffs,
+	})
+	defer r.ipc.StopStream()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	syncSnapshot := func() {
+		if err := r.sync(); err != nil {
+			log.Printf("Error fetching the state of the primary backend: %s", err)
+			return
+		}
+		signalReady()
+	}
+
+	syncSnapshot()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-r.stop:
+			log.Printf("Stopped replicating the primary backend.")
+			return
+		case diff := <-diffs:
+			r.apply(diff)
+		case <-ticker.C:
+			syncSnapshot()
+		}
+	}
+}
+
+// Stop stops the replication and waits until it's done.
+func (r *Replicator) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// apply applies a diff of the replication stream to the resources.
+func (r *Replicator) apply(diff *core.ResourceDiff) {
+	for _, rm := range []core.ResourceMap{diff.New, diff.Changed} {
+		for _, queue := range rm {
+			for _, resource := range queue {
+				r.add(resource)
+			}
+		}
+	}
+	for _, queue := range diff.Gone {
+		for _, resource := range queue {
+			r.rcol.Remove(resource)
+		}
+	}
+}
+
+// add adds the resource to the collection.  The resources of the stream are
+// not tested, so they keep the test result of the resource they replace until
+// the next snapshot.
+func (r *Replicator) add(resource core.Resource) {
+	hashring, exists := r.rcol.Collection[resource.Type()]
+	if !exists {
+		return
+	}
+	if old, err := hashring.GetExact(resource.Uid()); err == nil {
+		if old.TestResult() != nil && resource.TestResult() != nil {
+			*resource.TestResult() = *old.TestResult()
+		}
+	}
+	r.rcol.Add(resource)
+}
+
+// sync fetches a snapshot of the primary and makes the resources match it.
+func (r *Replicator) sync() error {
+	req, err := http.NewRequest(http.MethodGet, r.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status code %d: %s", resp.StatusCode, body)
+	}
+
+	var snapshot replicationSnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return err
+	}
+	r.applySnapshot(&snapshot)
+	return nil
+}
+
+func (r *Replicator) applySnapshot(snapshot *replicationSnapshot) {
+	total := 0
+	for rType, hashring := range r.rcol.Collection {
+		rawResources, exists := snapshot.Resources[rType]
+		if !exists {
+			continue
+		}
+		resources, err := UnmarshalResources(rawResources)
+		if err != nil {
+			log.Printf("Error unmarshalling the %s resources of the primary backend: %s", rType, err)
+			continue
+		}
+
+		present := make(map[core.Hashkey]bool, len(resources))
+		for _, resource := range resources {
+			present[resource.Uid()] = true
+			r.rcol.Add(resource)
+		}
+		tests := snapshot.Tests[rType]
+		for _, resource := range hashring.GetAll() {
+			if !present[resource.Uid()] {
+				r.rcol.Remove(resource)
+				continue
+			}
+			test, tested := tests[resource.Uid()]
+			if tested && resource.TestResult() != nil {
+				*resource.TestResult() = test
+			}
+		}
+		if hashring.Stencil != nil {
+			generations := snapshot.Generations[rType]
+			if generations == nil {
+				generations = make(map[core.Hashkey]uint64)
+			}
+			hashring.SetGenerations(generations)
+		}
+		r.rStore.Save(rType)
+		total += len(resources)
+	}
+	r.rcol.OnlyFunctional = snapshot.OnlyFunctional
+	r.rotator.SetLastRotations(snapshot.LastRotation)
+	log.Printf("Applied the snapshot of the primary backend from %s with %d resources.", snapshot.Time, total)
+}
+
+// isStandby returns true if the backend replicates a primary backend.
+func (b *BackendContext) isStandby() bool {
+	b.replicationLock.Lock()
+	defer b.replicationLock.Unlock()
+	return b.replicator != nil
+}
+
+// Promote turns a standby backend into a primary: it stops replicating the
+// primary backend and starts parsing the bridge descriptors and rotating the
+// resources itself.  The function returns once the kraken parsed the bridge
+// descriptors, and false if the backend is not a standby.
+func (b *BackendContext) Promote() bool {
+	b.replicationLock.Lock()
+	defer b.replicationLock.Unlock()
+
+	if b.replicator == nil {
+		return false
+	}
+	log.Println("Promoting the standby backend to primary.")
+	b.replicator.Stop()
+	b.replicator = nil
+	b.startPrimary()
+	return true
+}
+
+// replicationHandler handles the requests of the standby backends (GET
+// requests for the snapshot and the replication stream, and POST requests to
+// the replication stream, which are heartbeats) and the promotions of a
+// standby backend (POST requests to promote).
+func (b *BackendContext) replicationHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !b.isAdmin(w, r) {
+		return
+	}
+
+	endpoint := b.Config.Backend.ReplicationEndpoint
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == endpoint:
+		b.snapshotHandler(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == endpoint+replicationStreamPath:
+		b.replicationStreamHandler(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == endpoint+replicationStreamPath:
+		b.recordHeartbeat(w, r, []string{ReplicaOrigin})
+	case r.Method == http.MethodPost && r.URL.Path == endpoint+replicationPromotePath:
+		if !b.Promote() {
+			http.Error(w, "the backend is not a standby", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "{}")
+	default:
+		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
+		http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *BackendContext) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	snapshot := replicationSnapshot{
+		Time:           time.Now().UTC(),
+		OnlyFunctional: b.Resources.OnlyFunctional,
+		Resources:      make(map[string][]json.RawMessage),
+		Tests:          make(map[string]map[core.Hashkey]core.ResourceTest),
+		Generations:    make(map[string]map[core.Hashkey]uint64),
+		LastRotation:   b.rotator.LastRotations(),
+	}
+	for rType, hashring := range b.Resources.Collection {
+		rawResources := []json.RawMessage{}
+		tests := make(map[core.Hashkey]core.ResourceTest)
+		for _, resource := range hashring.GetAll() {
+			raw, err := json.Marshal(resource)
+			if err != nil {
+				http.Error(w, "error while turning resources into JSON", http.StatusInternalServerError)
+				return
+			}
+			rawResources = append(rawResources, raw)
+			if test := resource.TestResult(); test != nil && test.State != core.StateUntested {
+				tests[resource.Uid()] = *test
+			}
+		}
+		snapshot.Resources[rType] = rawResources
+		snapshot.Tests[rType] = tests
+		if hashring.Stencil != nil {
+			snapshot.Generations[rType] = hashring.Generations()
+		}
+	}
+
+	jsonBlurb, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, "error while turning the snapshot into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// replicationStreamHandler streams the updates of all the resources to a
+// standby backend.  The first diff has all the resources.
+func (b *BackendContext) replicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "http streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	stream := b.newDiffStream(w, r, flusher, ReplicaOrigin)
+	defer stream.close()
+
+	diffs := make(chan *core.ResourceDiff)
+	b.Resources.RegisterReplica(diffs)
+	defer b.Resources.UnregisterReplica(diffs)
+	defer close(diffs)
+	b.liveness.StreamOpened(ReplicaOrigin)
+	defer b.liveness.StreamClosed(ReplicaOrigin)
+
+	resourceMap := make(core.ResourceMap)
+	for rType, hashring := range b.Resources.Collection {
+		resourceMap[rType] = hashring.GetAll()
+	}
+	log.Printf("Sending standby backend %s the initial batch.", r.RemoteAddr)
+	streamDiffs(stream, r, &core.ResourceDiff{New: resourceMap}, diffs)
+}
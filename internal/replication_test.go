@@ -0,0 +1,109 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestReplication(t *testing.T) {
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.AdminTokens = map[string]string{"standby": "foo"}
+	cfg.Backend.ReplicationEndpoint = "/replication"
+	b.Config = &cfg
+	b.liveness = NewLivenessTracker(&cfg, nil)
+	b.Resources = *core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		b.Resources.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(&cfg, &b.Resources, nil, metrics, nil, nil, nil)
+	primary := b.Resources.Collection["obfs4"].GetAll()
+	if len(primary) < 2 {
+		t.Fatalf("Not enough obfs4 resources in the test assets: %d", len(primary))
+	}
+	*primary[0].TestResult() = core.ResourceTest{State: core.StateFunctional, LastTested: time.Now().UTC()}
+
+	server := httptest.NewServer(http.HandlerFunc(b.replicationHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("unauthenticated snapshot request was accepted")
+	}
+
+	standbyCfg := cfg
+	standbyCfg.Backend.Replication = ReplicationConfig{
+		PrimaryAddress: strings.TrimPrefix(server.URL, "http://"),
+		ApiToken:       "foo",
+	}
+	standby := core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		standby.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	replicator := NewReplicator(&standbyCfg, standby, InitResourceStore(&standbyCfg, standby), nil)
+
+	if err := replicator.sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rType := range resourceTypes {
+		if standby.Collection[rType].Len() != b.Resources.Collection[rType].Len() {
+			t.Errorf("The standby has %d %s resources instead of %d", standby.Collection[rType].Len(), rType, b.Resources.Collection[rType].Len())
+		}
+	}
+	replica, err := standby.Collection["obfs4"].GetExact(primary[0].Uid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.TestResult().State != core.StateFunctional {
+		t.Errorf("The test result was not replicated: %v", replica.TestResult().State)
+	}
+
+	shutdown := make(chan bool)
+	defer close(shutdown)
+	ready := make(chan bool, 1)
+	go replicator.Run(shutdown, ready)
+	<-ready
+
+	// Wait for the replication stream to be registered before the removal.
+	for i := 0; i < 100 && len(b.liveness.Statuses(time.Now())) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	b.Resources.Remove(primary[1])
+	removed := false
+	for i := 0; i < 100 && !removed; i++ {
+		_, err := standby.Collection["obfs4"].GetExact(primary[1].Uid())
+		removed = err != nil
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !removed {
+		t.Error("The removal was not replicated through the stream")
+	}
+	replicator.Stop()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/replication/promote", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer foo")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Promoting a primary backend returned %d", resp.StatusCode)
+	}
+}
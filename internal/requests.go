@@ -0,0 +1,41 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+// NewBackendIpc returns a mechanism that sends requests with the given method
+// and token to the given endpoint of the Web API of the backend.  The requests
+// follow the timeout and the retries of the configuration, and the resources
+// are verified with the public key of the backend if it's configured.
+func NewBackendIpc(cfg *Config, endpoint, method, token string) *mechanisms.HttpsIpcContext {
+	ipc := mechanisms.NewHttpsIpc("http://"+cfg.Backend.WebApi.ApiAddress+endpoint, method, token)
+	ipc.Policy = requestPolicy(cfg)
+	ipc.PublicKey = backendPublicKey(cfg)
+	return ipc
+}
+
+// requestPolicy returns the request policy of the configuration.  The values
+// that are not set are taken from mechanisms.DefaultRequestPolicy.
+func requestPolicy(cfg *Config) mechanisms.RequestPolicy {
+	policy := mechanisms.DefaultRequestPolicy
+	requestsCfg := cfg.Backend.Requests
+	if requestsCfg.TimeoutSeconds != 0 {
+		policy.Timeout = time.Duration(requestsCfg.TimeoutSeconds) * time.Second
+	}
+	if requestsCfg.Retries < 0 {
+		policy.Retries = 0
+	} else if requestsCfg.Retries != 0 {
+		policy.Retries = requestsCfg.Retries
+	}
+	if requestsCfg.RetryDelaySeconds != 0 {
+		policy.TimeBeforeRetry = time.Duration(requestsCfg.RetryDelaySeconds) * time.Second
+	}
+	return policy
+}
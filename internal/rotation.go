@@ -0,0 +1,228 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+const (
+	// RotationCheckInterval is how often we check if a distributor is due
+	// for a rotation
+	RotationCheckInterval = 10 * time.Minute
+)
+
+// rotationState is the state of the rotations that is kept across restarts.
+type rotationState struct {
+	// Generations of the rotated resources, for each resource type
+	Generations map[string]map[core.Hashkey]uint64 `json:"generations"`
+	// LastRotation is when each distributor was last rotated
+	LastRotation map[string]time.Time `json:"last_rotation"`
+}
+
+// ResourceRotator periodically moves a fraction of the resources of each
+// distributor to other distributors, so a compromised distributor can only
+// give away the resources it had since its last rotations.
+type ResourceRotator struct {
+	// The mutex protects the state, that standby backends replicate.
+	sync.Mutex
+	cfg     map[string]RotationConfig
+	rcol    *core.BackendResources
+	metrics *Metrics
+	store   persistence.Mechanism
+	state   rotationState
+	rng     *rand.Rand
+}
+
+// NewResourceRotator returns a rotator for the configured distributors, or
+// nil if no distributor has rotations configured.  It restores the previous
+// rotations into the resource collection, so it has to be called before any
+// resource is handed out.
+func NewResourceRotator(cfg *Config, rcol *core.BackendResources, metrics *Metrics) *ResourceRotator {
+	rotationCfg := make(map[string]RotationConfig)
+	for distName, c := range cfg.Backend.Rotation {
+		if c.PeriodHours <= 0 || c.Fraction <= 0 {
+			continue
+		}
+		if c.Fraction > 1 {
+			c.Fraction = 1
+		}
+		rotationCfg[distName] = c
+	}
+	if len(rotationCfg) == 0 {
+		return nil
+	}
+
+	r := &ResourceRotator{
+		cfg:     rotationCfg,
+		rcol:    rcol,
+		metrics: metrics,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if cfg.Backend.StorageDir != "" {
+		r.store = pjson.New("rotation", cfg.Backend.StorageDir)
+		err := r.store.Load(&r.state)
+		if err != nil {
+			log.Println("Can't load the state of the rotations:", err)
+		}
+	}
+	if r.state.LastRotation == nil {
+		r.state.LastRotation = make(map[string]time.Time)
+	}
+	for rType, generations := range r.state.Generations {
+		hashring, exists := rcol.Collection[rType]
+		if exists && hashring.Stencil != nil {
+			hashring.SetGenerations(generations)
+		}
+	}
+	return r
+}
+
+// Run rotates the distributors when they are due until shutdown is closed.
+func (r *ResourceRotator) Run(shutdown chan bool) {
+	if r == nil {
+		return
+	}
+	log.Println("Initialising resource rotation.")
+	ticker := time.NewTicker(RotationCheckInterval)
+	defer ticker.Stop()
+
+	r.rotateDue()
+	for {
+		select {
+		case <-shutdown:
+			log.Printf("Resource rotation shut down.")
+			return
+		case <-ticker.C:
+			r.rotateDue()
+		}
+	}
+}
+
+// rotateDue rotates the distributors whose rotation period passed.  The
+// distributors that were never rotated start counting their period now.
+func (r *ResourceRotator) rotateDue() {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	rotated := false
+	for distName, c := range r.cfg {
+		last, exists := r.state.LastRotation[distName]
+		if !exists {
+			r.state.LastRotation[distName] = now
+			rotated = true
+			continue
+		}
+		if now.Sub(last) < time.Duration(c.PeriodHours)*time.Hour {
+			continue
+		}
+		r.Rotate(distName)
+		r.state.LastRotation[distName] = now
+		rotated = true
+	}
+	if rotated {
+		r.save()
+	}
+}
+
+// Rotate moves the configured fraction of the resources of the distributor
+// to other distributors.  Resources with a distribution requested by their
+// operator stay where they are.
+func (r *ResourceRotator) Rotate(distName string) {
+	fraction := r.cfg[distName].Fraction
+	total := 0
+	for rType, hashring := range r.rcol.Collection {
+		if hashring.Stencil == nil {
+			continue
+		}
+		owned, err := hashring.GetForDist(distName)
+		if err != nil {
+			log.Printf("Can't get the %s resources of distributor %s: %s", rType, distName, err)
+			continue
+		}
+
+		var candidates []core.Resource
+		for _, res := range owned.GetAll() {
+			if res.Distributor() == "" {
+				candidates = append(candidates, res)
+			}
+		}
+		num := int(math.Round(fraction * float64(len(candidates))))
+		r.rng.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		moved := r.rcol.Rotate(rType, candidates[:num])
+		total += moved
+		r.metrics.RotatedResources.With(prometheus.Labels{"distributor": distName, "type": rType}).Add(float64(moved))
+	}
+	log.Printf("Rotated %d resources away from distributor %s.", total, distName)
+}
+
+// LastRotations returns when each distributor was last rotated.
+func (r *ResourceRotator) LastRotations() map[string]time.Time {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	lastRotation := make(map[string]time.Time, len(r.state.LastRotation))
+	for distName, last := range r.state.LastRotation {
+		lastRotation[distName] = last
+	}
+	return lastRotation
+}
+
+// SetLastRotations replaces when each distributor was last rotated, e.g. with
+// the ones of the primary backend, and stores them with the generations of
+// the resources.
+func (r *ResourceRotator) SetLastRotations(lastRotation map[string]time.Time) {
+	if r == nil || lastRotation == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	r.state.LastRotation = lastRotation
+	r.save()
+}
+
+// save stores the generations of the resources that we still have and the
+// time of the last rotations.
+func (r *ResourceRotator) save() {
+	r.state.Generations = make(map[string]map[core.Hashkey]uint64)
+	for rType, hashring := range r.rcol.Collection {
+		if hashring.Stencil == nil {
+			continue
+		}
+		generations := hashring.Generations()
+		for uid := range generations {
+			if _, err := hashring.GetExact(uid); err != nil {
+				delete(generations, uid)
+			}
+		}
+		if len(generations) != 0 {
+			r.state.Generations[rType] = generations
+		}
+	}
+
+	if r.store == nil {
+		return
+	}
+	err := r.store.Save(r.state)
+	if err != nil {
+		log.Println("Can't save the state of the rotations:", err)
+	}
+}
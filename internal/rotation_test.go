@@ -0,0 +1,87 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// rotatableResources returns the unique ids of the obfs4 resources of
+// distName that have no distribution requested by their operator.
+func rotatableResources(rcol *core.BackendResources, distName string) map[core.Hashkey]bool {
+	uids := make(map[core.Hashkey]bool)
+	for _, r := range rcol.Get(distName, "obfs4") {
+		if r.Distributor() == "" {
+			uids[r.Uid()] = true
+		}
+	}
+	return uids
+}
+
+func TestRotationDisabled(t *testing.T) {
+	cfg := testCfg
+	cfg.Backend.Rotation = map[string]RotationConfig{"moat": {PeriodHours: 0, Fraction: 0.5}}
+	if NewResourceRotator(&cfg, core.NewBackendResources(), metrics) != nil {
+		t.Error("Got a rotator without a rotation period")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testCfg
+	cfg.Backend.StorageDir = dir
+	cfg.Backend.DistProportions = map[string]int{"moat": 1, "https": 1}
+	cfg.Backend.Rotation = map[string]RotationConfig{"moat": {PeriodHours: 24, Fraction: 0.5}}
+
+	rcol := newTestCollection(&cfg, nil)
+	rotator := NewResourceRotator(&cfg, rcol, metrics)
+	before := rotatableResources(rcol, "moat")
+	if len(before) < 2 {
+		t.Fatalf("Not enough moat resources in the test assets: %d", len(before))
+	}
+
+	// the first check only starts counting the period
+	rotator.rotateDue()
+	if after := rotatableResources(rcol, "moat"); len(after) != len(before) {
+		t.Fatalf("Rotated before the period passed")
+	}
+
+	rotator.state.LastRotation["moat"] = time.Now().Add(-25 * time.Hour)
+	rotator.rotateDue()
+	after := rotatableResources(rcol, "moat")
+	moved := 0
+	for uid := range before {
+		if !after[uid] {
+			moved++
+		}
+	}
+	expected := (len(before) + 1) / 2
+	if moved != expected || len(after) != len(before)-moved {
+		t.Errorf("Rotated %d of %d resources, expected %d", moved, len(before), expected)
+	}
+
+	// the assignments survive a restart
+	rcol = newTestCollection(&cfg, nil)
+	NewResourceRotator(&cfg, rcol, metrics)
+	restored := rotatableResources(rcol, "moat")
+	if len(restored) != len(after) {
+		t.Fatalf("Got %d moat resources after a restart instead of %d", len(restored), len(after))
+	}
+	for uid := range after {
+		if !restored[uid] {
+			t.Errorf("Resource %d not in moat after a restart", uid)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+var UnknownShardError = errors.New("unknown shard")
+
+// SelectShard makes the configuration the one of the backend instance of the
+// given shard: the backend listens on the address of the shard and only has
+// the resource types that the shard owns.
+func SelectShard(cfg *Config, name string) error {
+	if err := validateShards(cfg.Backend.Shards); err != nil {
+		return err
+	}
+	shard, exists := cfg.Backend.Shards[name]
+	if !exists {
+		return fmt.Errorf("%w %q", UnknownShardError, name)
+	}
+
+	resources := make(map[string]ResourceConfig)
+	for _, rType := range shard.Resources {
+		conf, exists := cfg.Backend.Resources[rType]
+		if !exists {
+			log.Printf("Shard %s owns resource type %q that is not configured.", name, rType)
+			continue
+		}
+		resources[rType] = conf
+	}
+	cfg.Backend.Resources = resources
+	cfg.Backend.WebApi.ApiAddress = shard.ApiAddress
+	// Each shard numbers its own diffs, so they need their own subjects.
+	cfg.Backend.Nats.SubjectPrefix = natsPrefix(cfg) + "." + name
+	log.Printf("Running shard %s with resource types %q.", name, shard.Resources)
+	return nil
+}
+
+// validateShards makes sure that every resource type is owned by one shard
+// at most.
+func validateShards(shards map[string]ShardConfig) error {
+	owners := make(map[string]string)
+	for _, name := range shardNames(shards) {
+		for _, rType := range shards[name].Resources {
+			if owner, exists := owners[rType]; exists {
+				return fmt.Errorf("resource type %q is owned by shards %q and %q", rType, owner, name)
+			}
+			owners[rType] = name
+		}
+	}
+	return nil
+}
+
+func shardNames(shards map[string]ShardConfig) []string {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewResourceStreamIpc returns the delivery mechanism of the resource stream
+// of a distributor.  If the backend is sharded, the mechanism subscribes to
+// every shard that owns one of the given resource types.  The state of the
+// stream is cached in the StreamStateDir of the distributors, in a
+// subdirectory per shard.  If the distributors subscribe to NATS, the state
+// is not cached: they catch up from the JetStream streams of the backend.
+func NewResourceStreamIpc(cfg *Config, resourceTypes []string, token string) delivery.Mechanism {
+	stateDir := cfg.Distributors.StreamStateDir
+	stateMaxAge := time.Duration(cfg.Distributors.StreamStateMaxAgeHours) * time.Hour
+	useNats := cfg.Backend.Nats.Subscribe
+	var natsTLS *tls.Config
+	if useNats {
+		natsTLS = natsTLSConfig(cfg)
+	}
+	newNatsIpc := func(prefix string) *mechanisms.NatsIpcContext {
+		ipc := mechanisms.NewNatsIpc(cfg.Backend.Nats.DistributorUrls, natsTLS, prefix)
+		ipc.PublicKey = backendPublicKey(cfg)
+		ipc.MaxAge = natsReplayPeriod(cfg)
+		return ipc
+	}
+	if useNats && len(cfg.Backend.Shards) == 0 {
+		return newNatsIpc(natsPrefix(cfg))
+	}
+	if len(cfg.Backend.Shards) == 0 {
+		ipc := NewBackendIpc(cfg, cfg.Backend.ResourceStreamEndpoint, "GET", token)
+		ipc.StateDir = stateDir
+		ipc.StateMaxAge = stateMaxAge
+		return ipc
+	}
+
+	wanted := make(map[string]bool)
+	for _, rType := range resourceTypes {
+		wanted[rType] = true
+	}
+	mux := mechanisms.NewMultiplexIpc()
+	for _, name := range shardNames(cfg.Backend.Shards) {
+		shard := cfg.Backend.Shards[name]
+		rTypes := []string{}
+		for _, rType := range shard.Resources {
+			if wanted[rType] {
+				rTypes = append(rTypes, rType)
+			}
+		}
+		if len(rTypes) == 0 {
+			continue
+		}
+		if useNats {
+			mux.AddBackend(newNatsIpc(natsPrefix(cfg)+"."+name), rTypes)
+			continue
+		}
+		ipc := mechanisms.NewHttpsIpc(
+			"http://"+shard.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
+			"GET",
+			token)
+		ipc.Policy = requestPolicy(cfg)
+		ipc.PublicKey = backendPublicKey(cfg)
+		if stateDir != "" {
+			ipc.StateDir = filepath.Join(stateDir, name)
+			ipc.StateMaxAge = stateMaxAge
+		}
+		mux.AddBackend(ipc, rTypes)
+	}
+	return mux
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestSelectShard(t *testing.T) {
+	cfg := &Config{}
+	cfg.Backend.Resources = map[string]ResourceConfig{"vanilla": {}, "obfs4": {}, "snowflake": {}}
+	cfg.Backend.Shards = map[string]ShardConfig{
+		"bridges":   {ApiAddress: "127.0.0.1:7100", Resources: []string{"vanilla", "obfs4"}},
+		"snowflake": {ApiAddress: "127.0.0.1:7101", Resources: []string{"snowflake"}},
+	}
+
+	if err := SelectShard(cfg, "foo"); !errors.Is(err, UnknownShardError) {
+		t.Errorf("Selecting an unknown shard returned %v", err)
+	}
+	if err := SelectShard(cfg, "bridges"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Backend.Resources) != 2 || cfg.Backend.WebApi.ApiAddress != "127.0.0.1:7100" {
+		t.Errorf("Wrong configuration of the shard: %v at %s", cfg.Backend.Resources, cfg.Backend.WebApi.ApiAddress)
+	}
+	if _, exists := cfg.Backend.Resources["snowflake"]; exists {
+		t.Error("The shard has the resources of another shard")
+	}
+
+	cfg.Backend.Shards["snowflake"] = ShardConfig{Resources: []string{"snowflake", "obfs4"}}
+	if err := SelectShard(cfg, "snowflake"); err == nil {
+		t.Error("Two shards owning the same resource type were accepted")
+	}
+}
+
+// shardBackend is a backend that streams one resource of each requested type.
+type shardBackend struct {
+	requested chan []string
+}
+
+func (s *shardBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req core.ResourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Method != http.MethodGet {
+		return
+	}
+	s.requested <- req.ResourceTypes
+
+	diff := []string{}
+	for i, rType := range req.ResourceTypes {
+		diff = append(diff, fmt.Sprintf(`"%s": [{"type": "%s", "address": "1.2.3.4", "port": %d}]`, rType, rType, 1000+i))
+	}
+	fmt.Fprintf(w, `{"new": {%s}}`+"\r", strings.Join(diff, ", "))
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+func TestShardedResourceStream(t *testing.T) {
+	bridges := &shardBackend{requested: make(chan []string, 1)}
+	bridgesServer := httptest.NewServer(bridges)
+	defer bridgesServer.Close()
+	snowflake := &shardBackend{requested: make(chan []string, 1)}
+	snowflakeServer := httptest.NewServer(snowflake)
+	defer snowflakeServer.Close()
+	unused := &shardBackend{requested: make(chan []string, 1)}
+	unusedServer := httptest.NewServer(unused)
+	defer unusedServer.Close()
+
+	cfg := &Config{}
+	cfg.Backend.ResourceStreamEndpoint = "/resource-stream"
+	cfg.Backend.Shards = map[string]ShardConfig{
+		"bridges":   {ApiAddress: strings.TrimPrefix(bridgesServer.URL, "http://"), Resources: []string{"vanilla", "obfs4"}},
+		"snowflake": {ApiAddress: strings.TrimPrefix(snowflakeServer.URL, "http://"), Resources: []string{"snowflake"}},
+		"meek":      {ApiAddress: strings.TrimPrefix(unusedServer.URL, "http://"), Resources: []string{"meek"}},
+	}
+
+	rTypes := []string{"obfs4", "snowflake"}
+	ipc := NewResourceStreamIpc(cfg, rTypes, "")
+	diffs := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: rTypes, Receiver: diffs})
+	defer ipc.StopStream()
+
+	received := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case diff := <-diffs:
+			for rType, queue := range diff.New {
+				received[rType] += len(queue)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only got the diffs of %v", received)
+		}
+	}
+	if len(received) != 2 || received["obfs4"] != 1 || received["snowflake"] != 1 {
+		t.Errorf("Wrong resources from the shards: %v", received)
+	}
+
+	if requested := <-bridges.requested; len(requested) != 1 || requested[0] != "obfs4" {
+		t.Errorf("The bridges shard was asked for %v", requested)
+	}
+	select {
+	case requested := <-unused.requested:
+		t.Errorf("The shard without the requested types was asked for %v", requested)
+	default:
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+var NotEd25519KeyError = errors.New("the signing key is not an Ed25519 private key")
+
+// loadSigningKey returns the signing key of the backend, or nil if the
+// configuration has none.  The key is a PEM-encoded PKCS #8 private key, as
+// generated by "openssl genpkey -algorithm ed25519".
+func loadSigningKey(cfg *Config) (ed25519.PrivateKey, error) {
+	if cfg.Backend.SigningKeyFile == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(cfg.Backend.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, NotEd25519KeyError
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, NotEd25519KeyError
+	}
+
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	log.Printf("Signing the resources with the Ed25519 key %s.", base64.StdEncoding.EncodeToString(publicKey))
+	return signingKey, nil
+}
+
+// backendPublicKey returns the public key of the backend that the distributors
+// verify the resources with, or nil if the configuration has none.  An
+// invalid key is fatal: the distributor would hand out unverified resources.
+func backendPublicKey(cfg *Config) ed25519.PublicKey {
+	if cfg.Distributors.BackendPublicKey == "" {
+		return nil
+	}
+
+	key, err := mechanisms.ParsePublicKey(cfg.Distributors.BackendPublicKey)
+	if err != nil {
+		log.Fatalf("Invalid public key of the backend: %s", err)
+	}
+	return key
+}
+
+// requestNonce returns the nonce that the distributor sent with its request,
+// which we sign into the response.  Nonces that are not valid are ignored.
+func requestNonce(r *http.Request) string {
+	nonce := r.Header.Get(mechanisms.NonceHeader)
+	if !mechanisms.ValidNonce(nonce) {
+		return ""
+	}
+	return nonce
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+)
+
+func TestLoadSigningKey(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "rdsys-signing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{}
+	if key, err := loadSigningKey(&cfg); key != nil || err != nil {
+		t.Errorf("Got the key %v and the error %v without a signing key file", key, err)
+	}
+	cfg.Backend.SigningKeyFile = keyFile
+	key, err := loadSigningKey(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), publicKey) {
+		t.Error("Loaded the wrong signing key")
+	}
+
+	ioutil.WriteFile(keyFile, []byte("foo"), 0600)
+	if _, err := loadSigningKey(&cfg); err == nil {
+		t.Error("Loaded an invalid signing key")
+	}
+}
+
+func TestSignedResources(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.ApiTokens = map[string]string{"moat": "foo"}
+	cfg.Backend.ResourcesEndpoint = "/resources"
+	cfg.Backend.ResourceStreamEndpoint = "/resource-stream"
+	b.Config = &cfg
+	b.Resources = *core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		b.Resources.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(&cfg, &b.Resources, nil, metrics, nil, nil, nil)
+	b.signingKey = privateKey
+	numResources := len(b.Resources.Get("moat", "obfs4"))
+
+	server := httptest.NewServer(http.HandlerFunc(b.resourcesHandler))
+	defer server.Close()
+
+	stream := func(key ed25519.PublicKey) *core.ResourceDiff {
+		ipc := mechanisms.NewHttpsIpc(server.URL+"/resource-stream", "GET", "foo")
+		ipc.PublicKey = key
+		diffs := make(chan *core.ResourceDiff)
+		ipc.StartStream(&core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"obfs4"}, Receiver: diffs})
+		defer ipc.StopStream()
+		select {
+		case diff := <-diffs:
+			return diff
+		case <-time.After(500 * time.Millisecond):
+			return nil
+		}
+	}
+	// Distributors without the key of the backend can still read the
+	// signed stream.
+	for _, key := range []ed25519.PublicKey{publicKey, nil} {
+		if diff := stream(key); diff == nil || len(diff.New["obfs4"]) != numResources {
+			t.Errorf("Didn't get the %d resources of the signed stream: %v", numResources, diff)
+		}
+	}
+	if diff := stream(otherKey); diff != nil {
+		t.Errorf("Accepted a stream signed with another key: %v", diff)
+	}
+
+	query := func(key ed25519.PublicKey) error {
+		ipc := mechanisms.NewHttpsIpc(server.URL+"/resources", "GET", "foo")
+		ipc.PublicKey = key
+		var resources []interface{}
+		req := &core.ResourceRequest{RequestOrigin: "moat", ResourceTypes: []string{"obfs4"}}
+		err := ipc.MakeJsonRequest(context.Background(), req, &resources)
+		if err == nil && len(resources) != numResources {
+			t.Errorf("Got %d resources instead of %d", len(resources), numResources)
+		}
+		return err
+	}
+	if err := query(publicKey); err != nil {
+		t.Errorf("Rejected the signed resources: %s", err)
+	}
+	if err := query(otherKey); !errors.Is(err, mechanisms.InvalidSignatureError) {
+		t.Errorf("Got the error %v instead of an invalid signature for resources signed with another key", err)
+	}
+
+	// Without a signing key the distributors with a key reject the
+	// resources.
+	b.signingKey = nil
+	if err := query(publicKey); !errors.Is(err, mechanisms.MissingSignatureError) {
+		t.Errorf("Got the error %v instead of a missing signature for unsigned resources", err)
+	}
+	if diff := stream(publicKey); diff != nil {
+		t.Errorf("Accepted an unsigned stream: %v", diff)
+	}
+}
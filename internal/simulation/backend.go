@@ -0,0 +1,141 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"fmt"
+	"net"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	// maxBridges is the number of synthetic bridges that fit in
+	// 100.64.0.0/10.
+	maxBridges = 1 << 22
+)
+
+// newBridge returns the i-th synthetic obfs4 bridge, blocked in the given
+// country if it's not empty.  Every call returns a new copy of the bridge, so
+// distributors can compare it with the copy they already have.
+func newBridge(i int, blockedIn string) *resources.Transport {
+	t := resources.NewTransport()
+	t.RType = resources.ResourceTypeObfs4
+	ip := net.IPv4(100, byte(64+i>>16), byte(i>>8), byte(i))
+	t.Address = resources.Addr{Addr: &net.IPAddr{IP: ip}}
+	t.Port = 443
+	t.Fingerprint = fmt.Sprintf("%040X", i)
+	t.Parameters["cert"] = fmt.Sprintf("simulated%d", i)
+	t.Parameters["iat-mode"] = "0"
+	if blockedIn != "" {
+		t.SetBlockedIn(core.LocationSet{blockedIn: true})
+	}
+	return t
+}
+
+// bridgeSet keeps the synthetic bridges of a simulation and which of them are
+// blocked.
+type bridgeSet struct {
+	country string
+	lines   []string
+	index   map[string]int
+	blocked map[string]bool
+}
+
+func newBridgeSet(num int, country string) *bridgeSet {
+	b := &bridgeSet{
+		country: country,
+		index:   make(map[string]int, num),
+		blocked: make(map[string]bool),
+	}
+	for i := 0; i < num; i++ {
+		line := newBridge(i, "").String()
+		b.lines = append(b.lines, line)
+		b.index[line] = i
+	}
+	return b
+}
+
+// resources returns a new copy of all the bridges with their blocking state.
+func (b *bridgeSet) resources() []core.Resource {
+	var rs []core.Resource
+	for i, line := range b.lines {
+		blockedIn := ""
+		if b.blocked[line] {
+			blockedIn = b.country
+		}
+		rs = append(rs, newBridge(i, blockedIn))
+	}
+	return rs
+}
+
+// exists returns true if the given bridge line is one of our bridges.
+func (b *bridgeSet) exists(line string) bool {
+	_, exists := b.index[line]
+	return exists
+}
+
+// block marks the given bridge as blocked and returns a copy of it that is
+// blocked in the country of the censor.
+func (b *bridgeSet) block(line string) core.Resource {
+	b.blocked[line] = true
+	return newBridge(b.index[line], b.country)
+}
+
+// stream plays the role of the rdsys backend for a distributor that gets its
+// bridges from a fake backend.  Like the backend, it only sends the bridges
+// that the distributor's resource request accepts, and the bridges that
+// aren't accepted anymore are gone.
+type stream struct {
+	backend *testsupport.FakeBackend
+	req     *core.ResourceRequest
+}
+
+// newStream waits for the distributor to start its resource stream.
+func newStream(backend *testsupport.FakeBackend) (*stream, error) {
+	req, err := backend.ResourceRequest()
+	if err != nil {
+		return nil, err
+	}
+	return &stream{backend: backend, req: req}, nil
+}
+
+// add hands the given new bridges to the distributor.
+func (s *stream) add(bridges []core.Resource) error {
+	diff := core.NewResourceDiff()
+	for _, r := range bridges {
+		if s.req.HasResourceType(r.Type()) && s.req.AcceptsResource(r) {
+			diff.New[r.Type()] = append(diff.New[r.Type()], r)
+		}
+	}
+	return s.send(diff)
+}
+
+// update tells the distributor about the new state of the given bridges.
+func (s *stream) update(bridges []core.Resource) error {
+	diff := core.NewResourceDiff()
+	for _, r := range bridges {
+		if !s.req.HasResourceType(r.Type()) {
+			continue
+		}
+		if s.req.AcceptsResource(r) {
+			diff.Changed[r.Type()] = append(diff.Changed[r.Type()], r)
+		} else {
+			diff.Gone[r.Type()] = append(diff.Gone[r.Type()], r)
+		}
+	}
+	return s.send(diff)
+}
+
+// send sends the diff and returns once the distributor processed it, so the
+// simulation never runs ahead of the distributor.
+func (s *stream) send(diff *core.ResourceDiff) error {
+	if err := s.backend.Send(diff); err != nil {
+		return err
+	}
+	return s.backend.Sync()
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"fmt"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/salmon"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
+)
+
+var (
+	// StrategyNames are the names of the distributors that can be simulated.
+	StrategyNames = []string{salmon.DistName, moat.DistName, telegram.DistName}
+)
+
+// DefaultConfig returns the distributor configuration that the simulator uses
+// if it isn't given a configuration file.
+func DefaultConfig() *internal.Config {
+	cfg := &internal.Config{}
+	cfg.Distributors.Moat.NumBridgesPerRequest = 3
+	cfg.Distributors.Moat.RotationPeriodHours = 24
+	cfg.Distributors.Moat.NumPeriods = 2
+	cfg.Distributors.Telegram.NumBridgesPerRequest = 2
+	cfg.Distributors.Telegram.RotationPeriodHours = 24
+	cfg.Distributors.Telegram.MinUserID = 1000000
+	return cfg
+}
+
+// NewStrategy returns the strategy of the distributor with the given name.
+// newPoolShare is the share of bridges in the new pool of telegram.
+func NewStrategy(name string, cfg *internal.Config, newPoolShare float64) (Strategy, error) {
+	switch name {
+	case salmon.DistName:
+		return NewSalmonStrategy(cfg), nil
+	case moat.DistName:
+		return NewMoatStrategy(cfg), nil
+	case telegram.DistName:
+		return NewTelegramStrategy(cfg, newPoolShare), nil
+	}
+	return nil, fmt.Errorf("no simulation strategy for distributor %q", name)
+}
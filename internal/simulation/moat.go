@@ -0,0 +1,97 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// moatDefaults are the circumvention defaults of the simulation: obfs4
+// bridges from the rotation pools.
+const moatDefaults = `{"settings": [{"bridges": {"type": "obfs4", "source": "bridgedb"}}]}`
+
+// MoatStrategy simulates the moat distributor.  Users are IP addresses in the
+// censor's country, so the rotation periods and the country pools of the
+// configuration decide who gets which bridges.
+type MoatStrategy struct {
+	cfg    internal.Config
+	world  *World
+	dist   *moat.MoatDistributor
+	stream *stream
+}
+
+// NewMoatStrategy returns a moat strategy with the moat configuration of the
+// given config.
+func NewMoatStrategy(cfg *internal.Config) *MoatStrategy {
+	return &MoatStrategy{cfg: *cfg}
+}
+
+func (s *MoatStrategy) Name() string {
+	return moat.DistName
+}
+
+func (s *MoatStrategy) Start(world *World, bridges []core.Resource) error {
+	s.world = world
+	s.cfg.Backend = internal.BackendConfig{}
+	s.cfg.Distributors.Moat.Resources = []string{resources.ResourceTypeObfs4}
+	s.cfg.Distributors.Moat.BuiltInBridgesTypes = nil
+
+	backend := testsupport.NewFakeBackend()
+	s.dist = &moat.MoatDistributor{
+		IPC:           backend,
+		Now:           world.Clock.Now,
+		CountryFromIP: func(net.IP) string { return world.Country },
+	}
+	if err := s.dist.LoadCircumventionDefaults(strings.NewReader(moatDefaults)); err != nil {
+		return err
+	}
+	s.dist.Init(&s.cfg)
+
+	var err error
+	s.stream, err = newStream(backend)
+	if err != nil {
+		return err
+	}
+	return s.stream.add(bridges)
+}
+
+func (s *MoatStrategy) NewUser(agent bool) (string, error) {
+	r := s.world.Rand
+	ip := net.IPv4(byte(1+r.Intn(223)), byte(r.Intn(256)), byte(r.Intn(256)), byte(1+r.Intn(254)))
+	return ip.String(), nil
+}
+
+func (s *MoatStrategy) Request(id string) ([]string, error) {
+	types := []string{resources.ResourceTypeObfs4}
+	settings, err := s.dist.GetCircumventionDefaults(context.Background(), types, net.ParseIP(id))
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, setting := range settings.Settings {
+		lines = append(lines, setting.Bridges.BridgeStrings...)
+	}
+	return lines, nil
+}
+
+func (s *MoatStrategy) Block(bridges []core.Resource) error {
+	return s.stream.update(bridges)
+}
+
+func (s *MoatStrategy) NewDay() error {
+	return nil
+}
+
+func (s *MoatStrategy) Stop() {
+	s.dist.Shutdown()
+}
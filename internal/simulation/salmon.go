@@ -0,0 +1,123 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/salmon"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// SalmonStrategy simulates the salmon distributor.  Every user joins with an
+// invite of a random user that is allowed to issue invites, or of the admin
+// if there is none, so agents end up spread over the invitation tree.
+type SalmonStrategy struct {
+	cfg    internal.Config
+	world  *World
+	dist   *salmon.SalmonDistributor
+	stream *stream
+	dir    string
+	admin  string
+	users  []string
+}
+
+// NewSalmonStrategy returns a salmon strategy with the salmon configuration of
+// the given config.
+func NewSalmonStrategy(cfg *internal.Config) *SalmonStrategy {
+	return &SalmonStrategy{cfg: *cfg}
+}
+
+func (s *SalmonStrategy) Name() string {
+	return salmon.DistName
+}
+
+func (s *SalmonStrategy) Start(world *World, bridges []core.Resource) error {
+	dir, err := ioutil.TempDir("", "rdsys-simulator-")
+	if err != nil {
+		return err
+	}
+	s.dir = dir
+	s.world = world
+	s.cfg.Backend = internal.BackendConfig{}
+	s.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	s.cfg.Distributors.Salmon.WorkingDir = dir + string(filepath.Separator)
+
+	backend := testsupport.NewFakeBackend()
+	s.dist = salmon.NewSalmonDistributor()
+	s.dist.IPC = backend
+	s.dist.Now = world.Clock.Now
+	s.dist.Init(&s.cfg)
+	for id, u := range s.dist.Users {
+		if u.Trust == salmon.UntouchableTrustLevel {
+			s.admin = id
+		}
+	}
+
+	s.stream, err = newStream(backend)
+	if err != nil {
+		return err
+	}
+	return s.stream.add(bridges)
+}
+
+func (s *SalmonStrategy) NewUser(agent bool) (string, error) {
+	var inviters []string
+	for _, id := range s.users {
+		u := s.dist.Users[id]
+		if !u.Banned && u.Trust >= salmon.MaxTrustLevel {
+			inviters = append(inviters, id)
+		}
+	}
+	inviter := s.admin
+	if len(inviters) != 0 {
+		inviter = inviters[s.world.Rand.Intn(len(inviters))]
+	}
+
+	token, err := s.dist.CreateInvite(inviter)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.dist.RedeemInvite(token)
+	if err != nil {
+		return "", err
+	}
+	s.users = append(s.users, id)
+	return id, nil
+}
+
+func (s *SalmonStrategy) Request(id string) ([]string, error) {
+	proxies, err := s.dist.GetProxies(id, resources.ResourceTypeObfs4, s.world.Country)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, proxy := range proxies {
+		lines = append(lines, proxy.String())
+	}
+	return lines, nil
+}
+
+func (s *SalmonStrategy) Block(bridges []core.Resource) error {
+	return s.stream.update(bridges)
+}
+
+func (s *SalmonStrategy) NewDay() error {
+	s.dist.UpdateTrustLevels()
+	return nil
+}
+
+func (s *SalmonStrategy) Stop() {
+	s.dist.Shutdown()
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("Error removing %s: %s", s.dir, err)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	Day = 24 * time.Hour
+)
+
+var (
+	// StartTime is the simulated time when every simulation starts.
+	StartTime = time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	InvalidParamsError = errors.New("invalid simulation parameters")
+)
+
+// Censor describes the behaviour of the simulated censor.
+type Censor struct {
+	// Country is where the censor blocks bridges.
+	Country string
+	// AgentsPerDay is the enumeration rate: the number of new identities
+	// (accounts, IP addresses, or invited users) that the censor uses every
+	// day to request bridges.  Agents keep requesting bridges every day.
+	AgentsPerDay int
+	// BlockingDelay is the number of days between the censor learning a
+	// bridge and blocking it.
+	BlockingDelay int
+}
+
+// Params are the parameters of a simulation.
+type Params struct {
+	// Days is how many days the simulation lasts.
+	Days int
+	// Bridges is the number of synthetic bridges that the distributor gets
+	// at the beginning of the simulation.
+	Bridges int
+	// UsersPerDay is the number of honest users that join every day.
+	// Honest users only request bridges when they don't know any that
+	// works.
+	UsersPerDay int
+	Censor      Censor
+	// Seed initialises the randomness of the simulation.
+	Seed int64
+}
+
+// Validate returns an error if the parameters can't be simulated.
+func (p *Params) Validate() error {
+	switch {
+	case p.Days <= 0:
+		return fmt.Errorf("%w: the number of days must be positive", InvalidParamsError)
+	case p.Bridges <= 0 || p.Bridges > maxBridges:
+		return fmt.Errorf("%w: the number of bridges must be between 1 and %d", InvalidParamsError, maxBridges)
+	case p.UsersPerDay < 0 || p.Censor.AgentsPerDay < 0 || p.Censor.BlockingDelay < 0:
+		return fmt.Errorf("%w: users, agents and blocking delay can't be negative", InvalidParamsError)
+	case p.Censor.Country == "":
+		return fmt.Errorf("%w: the censor needs a country", InvalidParamsError)
+	}
+	return nil
+}
+
+// World is the simulated environment that the strategies share with the
+// simulation.
+type World struct {
+	Clock *Clock
+	// Rand is the source of randomness of the simulation.  Strategies use
+	// it to make up users, so the same seed gives the same users.
+	Rand *rand.Rand
+	// Country is the country of the users and the censor.
+	Country string
+}
+
+// Strategy plugs a real distributor into the simulation.
+type Strategy interface {
+	// Name returns the name of the distributor.
+	Name() string
+	// Start initialises the distributor in the given world and hands it the
+	// given bridges.
+	Start(world *World, bridges []core.Resource) error
+	// NewUser adds a user to the distributor and returns its ID.  Agents of
+	// the censor are users too.
+	NewUser(agent bool) (string, error)
+	// Request returns the bridge lines that the distributor hands out to the
+	// given user.
+	Request(id string) ([]string, error)
+	// Block tells the distributor that the given bridges got blocked.  The
+	// bridges carry their new blocking state.
+	Block(bridges []core.Resource) error
+	// NewDay runs the daily tasks of the distributor.
+	NewDay() error
+	// Stop shuts down the distributor.
+	Stop()
+}
+
+// DayReport is the state of a simulation at the end of a day.
+type DayReport struct {
+	Day int `json:"day"`
+	// Unblocked is the number of bridges that are not blocked yet.
+	Unblocked int `json:"unblocked"`
+	// Survival is the fraction of bridges that are not blocked yet.
+	Survival float64 `json:"survival"`
+	// Users is the number of honest users.
+	Users int `json:"users"`
+	// Connected is the fraction of honest users that know a bridge that is
+	// not blocked.
+	Connected float64 `json:"connected"`
+	// Agents is the number of agents of the censor.
+	Agents int `json:"agents"`
+	// Learned is the number of bridges that the censor knows.
+	Learned int `json:"learned"`
+}
+
+// Report is the outcome of simulating a strategy: its bridge survival curve
+// and how well connected its honest users are, day by day.
+type Report struct {
+	Strategy string      `json:"strategy"`
+	Params   Params      `json:"params"`
+	Days     []DayReport `json:"days"`
+}
+
+// Write writes the report as a table to the given writer.
+func (r *Report) Write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# %s: %d bridges, %d users/day, %d agents/day, blocking delay %d days\n",
+		r.Strategy, r.Params.Bridges, r.Params.UsersPerDay, r.Params.Censor.AgentsPerDay, r.Params.Censor.BlockingDelay)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%5s %9s %8s %7s %9s %7s %7s\n",
+		"day", "unblocked", "survival", "users", "connected", "agents", "learned")
+	if err != nil {
+		return err
+	}
+	for _, day := range r.Days {
+		_, err = fmt.Fprintf(w, "%5d %9d %8.3f %7d %9.3f %7d %7d\n",
+			day.Day, day.Unblocked, day.Survival, day.Users, day.Connected, day.Agents, day.Learned)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clock is the simulated clock that the distributors use instead of
+// time.Now, so a simulation can go through months in seconds.
+type Clock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewClock returns a clock that starts at the given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the simulated time.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// user is a simulated user of a distributor.
+type user struct {
+	id string
+	// bridges are the bridge lines that the user got last.
+	bridges []string
+}
+
+// simulation keeps the state of a running simulation.
+type simulation struct {
+	params   Params
+	strategy Strategy
+	bridges  *bridgeSet
+	users    []*user
+	agents   []*user
+	// learned maps the bridges that the censor knows to the day it learned
+	// them.
+	learned map[string]int
+}
+
+// Run simulates the given strategy with the given parameters, day by day, and
+// returns its report.  Every day new honest users and agents join, the agents
+// request bridges and report them to the censor, the censor blocks the
+// bridges it learned BlockingDelay days ago, and the honest users without a
+// working bridge request new ones.
+func Run(strategy Strategy, params Params) (*Report, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	world := &World{
+		Clock:   NewClock(StartTime),
+		Rand:    rand.New(rand.NewSource(params.Seed)),
+		Country: params.Censor.Country,
+	}
+	sim := &simulation{
+		params:   params,
+		strategy: strategy,
+		bridges:  newBridgeSet(params.Bridges, params.Censor.Country),
+		learned:  make(map[string]int),
+	}
+	if err := strategy.Start(world, sim.bridges.resources()); err != nil {
+		return nil, err
+	}
+	defer strategy.Stop()
+
+	report := &Report{Strategy: strategy.Name(), Params: params}
+	for day := 0; day < params.Days; day++ {
+		if day > 0 {
+			world.Clock.Advance(Day)
+			if err := strategy.NewDay(); err != nil {
+				return nil, err
+			}
+		}
+		if err := sim.simulateDay(day); err != nil {
+			return nil, fmt.Errorf("day %d: %w", day, err)
+		}
+		report.Days = append(report.Days, sim.dayReport(day))
+	}
+	return report, nil
+}
+
+func (sim *simulation) simulateDay(day int) error {
+	for i := 0; i < sim.params.UsersPerDay; i++ {
+		if err := sim.join(false); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < sim.params.Censor.AgentsPerDay; i++ {
+		if err := sim.join(true); err != nil {
+			return err
+		}
+	}
+
+	// Agents get banned or throttled by some distributors, which is the
+	// point of those distributors, so their errors are not fatal.
+	for _, agent := range sim.agents {
+		lines, err := sim.strategy.Request(agent.id)
+		if err != nil {
+			continue
+		}
+		for _, line := range lines {
+			if _, known := sim.learned[line]; !known && sim.bridges.exists(line) {
+				sim.learned[line] = day
+			}
+		}
+	}
+
+	var blocked []core.Resource
+	for _, line := range sim.bridges.lines {
+		learnedDay, known := sim.learned[line]
+		if known && !sim.bridges.blocked[line] && day >= learnedDay+sim.params.Censor.BlockingDelay {
+			blocked = append(blocked, sim.bridges.block(line))
+		}
+	}
+	if len(blocked) != 0 {
+		if err := sim.strategy.Block(blocked); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range sim.users {
+		if sim.connected(u) {
+			continue
+		}
+		lines, err := sim.strategy.Request(u.id)
+		if err != nil {
+			continue
+		}
+		u.bridges = lines
+	}
+	return nil
+}
+
+func (sim *simulation) join(agent bool) error {
+	id, err := sim.strategy.NewUser(agent)
+	if err != nil {
+		return err
+	}
+	u := &user{id: id}
+	if agent {
+		sim.agents = append(sim.agents, u)
+	} else {
+		sim.users = append(sim.users, u)
+	}
+	return nil
+}
+
+// connected returns true if the user knows a bridge that is not blocked.
+func (sim *simulation) connected(u *user) bool {
+	for _, line := range u.bridges {
+		if sim.bridges.exists(line) && !sim.bridges.blocked[line] {
+			return true
+		}
+	}
+	return false
+}
+
+func (sim *simulation) dayReport(day int) DayReport {
+	r := DayReport{
+		Day:       day,
+		Unblocked: len(sim.bridges.lines) - len(sim.bridges.blocked),
+		Users:     len(sim.users),
+		Agents:    len(sim.agents),
+		Learned:   len(sim.learned),
+	}
+	r.Survival = float64(r.Unblocked) / float64(len(sim.bridges.lines))
+
+	connected := 0
+	for _, u := range sim.users {
+		if sim.connected(u) {
+			connected++
+		}
+	}
+	if len(sim.users) != 0 {
+		r.Connected = float64(connected) / float64(len(sim.users))
+	}
+	return r
+}
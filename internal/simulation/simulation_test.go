@@ -0,0 +1,122 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testParams() Params {
+	return Params{
+		Days:        8,
+		Bridges:     60,
+		UsersPerDay: 4,
+		Censor:      Censor{Country: "cn", AgentsPerDay: 1, BlockingDelay: 2},
+		Seed:        1,
+	}
+}
+
+func runStrategy(t *testing.T, name string, params Params) *Report {
+	strategy, err := NewStrategy(name, DefaultConfig(), 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Run(strategy, params)
+	if err != nil {
+		t.Fatalf("Can't simulate %s: %s", name, err)
+	}
+	if report.Strategy != name || len(report.Days) != params.Days {
+		t.Fatalf("Wrong report for %s: %+v", name, report)
+	}
+	return report
+}
+
+func TestNoCensor(t *testing.T) {
+	params := testParams()
+	params.Censor.AgentsPerDay = 0
+	for _, name := range StrategyNames {
+		report := runStrategy(t, name, params)
+		for _, day := range report.Days {
+			if day.Unblocked != params.Bridges || day.Learned != 0 {
+				t.Errorf("%s: bridges got blocked without a censor: %+v", name, day)
+			}
+			if day.Connected != 1 {
+				t.Errorf("%s: not all users are connected: %+v", name, day)
+			}
+		}
+	}
+}
+
+func TestCensor(t *testing.T) {
+	params := testParams()
+	for _, name := range StrategyNames {
+		report := runStrategy(t, name, params)
+		for i, day := range report.Days {
+			if day.Agents != (i+1)*params.Censor.AgentsPerDay {
+				t.Errorf("%s: wrong number of agents: %+v", name, day)
+			}
+			if i > 0 && day.Unblocked > report.Days[i-1].Unblocked {
+				t.Errorf("%s: bridges got unblocked: %+v", name, day)
+			}
+			if i < params.Censor.BlockingDelay && day.Unblocked != params.Bridges {
+				t.Errorf("%s: bridges got blocked before the blocking delay: %+v", name, day)
+			}
+		}
+		last := report.Days[len(report.Days)-1]
+		if last.Learned == 0 || last.Unblocked == params.Bridges {
+			t.Errorf("%s: the censor didn't block any bridge: %+v", name, last)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	for _, params := range []Params{
+		{Days: 0, Bridges: 1, Censor: Censor{Country: "cn"}},
+		{Days: 1, Bridges: 0, Censor: Censor{Country: "cn"}},
+		{Days: 1, Bridges: 1, Censor: Censor{Country: "cn", BlockingDelay: -1}},
+		{Days: 1, Bridges: 1},
+	} {
+		if _, err := Run(NewMoatStrategy(DefaultConfig()), params); !errors.Is(err, InvalidParamsError) {
+			t.Errorf("Expected invalid params error for %+v: %v", params, err)
+		}
+	}
+	if _, err := NewStrategy("foo", DefaultConfig(), 0); err == nil {
+		t.Error("Got a strategy for an unknown distributor")
+	}
+}
+
+func TestBridges(t *testing.T) {
+	b := newBridgeSet(3, "cn")
+	rs := b.resources()
+	if len(rs) != 3 || rs[0].String() == rs[1].String() {
+		t.Fatalf("Wrong bridges: %v", rs)
+	}
+	blocked := b.block(b.lines[1])
+	if !blocked.BlockedIn()["cn"] || rs[1].BlockedIn()["cn"] {
+		t.Error("Blocking a bridge changed the copies of the distributors")
+	}
+	if !b.resources()[1].BlockedIn()["cn"] {
+		t.Error("New copies of the bridge are not blocked")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	report := &Report{
+		Strategy: "moat",
+		Params:   testParams(),
+		Days:     []DayReport{{Day: 0, Unblocked: 60, Survival: 1, Users: 4, Connected: 1}},
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "# moat") {
+		t.Errorf("Wrong report:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simulation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	// telegramUpdater is the name of the updater that pushes the bridges of
+	// the new pool.
+	telegramUpdater = "simulator"
+	// telegramOldAccounts is the fraction of honest users with an account
+	// older than min_user_id.  The agents of the censor always create new
+	// accounts.
+	telegramOldAccounts = 0.5
+)
+
+// TelegramStrategy simulates the telegram distributor.  A share of the
+// bridges goes to the new pool, pushed by an updater that tests the bridges
+// and drops the blocked ones, and the rest comes from the backend, which
+// drops the bridges blocked in the censor's country.
+type TelegramStrategy struct {
+	cfg          internal.Config
+	newPoolShare float64
+	world        *World
+	dist         *telegram.TelegramDistributor
+	stream       *stream
+	// newPool are the bridges of the new pool that are not blocked.
+	newPool  []core.Resource
+	oldUsers int64
+	newUsers int64
+}
+
+// NewTelegramStrategy returns a telegram strategy with the telegram
+// configuration of the given config, that puts the given share of the
+// bridges in the new pool.
+func NewTelegramStrategy(cfg *internal.Config, newPoolShare float64) *TelegramStrategy {
+	return &TelegramStrategy{cfg: *cfg, newPoolShare: newPoolShare}
+}
+
+func (s *TelegramStrategy) Name() string {
+	return telegram.DistName
+}
+
+func (s *TelegramStrategy) Start(world *World, bridges []core.Resource) error {
+	tCfg := &s.cfg.Distributors.Telegram
+	if tCfg.RotationPeriodHours <= 0 {
+		return errors.New("the telegram distributor needs a rotation period")
+	}
+	numBridges := tCfg.NumBridgesPerRequest
+	if len(tCfg.Resources) != 0 {
+		numBridges = tCfg.Resources[0].NumBridges
+	}
+	tCfg.Resources = []internal.TelegramResourceConfig{{Type: resources.ResourceTypeObfs4, NumBridges: numBridges}}
+	tCfg.NotBlockedIn = []string{world.Country}
+	tCfg.EnableInvites = false
+	s.cfg.Backend = internal.BackendConfig{}
+	s.world = world
+
+	backend := testsupport.NewFakeBackend()
+	s.dist = &telegram.TelegramDistributor{
+		IPC: backend,
+		Now: world.Clock.Now,
+	}
+	s.dist.Init(&s.cfg)
+
+	var err error
+	s.stream, err = newStream(backend)
+	if err != nil {
+		return err
+	}
+	numNew := int(float64(len(bridges)) * s.newPoolShare)
+	s.newPool = bridges[:numNew]
+	if err := s.pushNewPool(); err != nil {
+		return err
+	}
+	return s.stream.add(bridges[numNew:])
+}
+
+// pushNewPool loads the unblocked bridges of the new pool into the
+// distributor, like the updater does.
+func (s *TelegramStrategy) pushNewPool() error {
+	var bridgelines []string
+	for _, r := range s.newPool {
+		bridgelines = append(bridgelines, "Bridge "+r.String())
+	}
+	body, err := json.Marshal(map[string][]string{"bridgelines": bridgelines})
+	if err != nil {
+		return err
+	}
+	return s.dist.LoadNewBridges(telegramUpdater, bytes.NewReader(body))
+}
+
+func (s *TelegramStrategy) NewUser(agent bool) (string, error) {
+	if !agent && s.oldUsers+1 < s.cfg.Distributors.Telegram.MinUserID &&
+		s.world.Rand.Float64() < telegramOldAccounts {
+		s.oldUsers++
+		return strconv.FormatInt(s.oldUsers, 10), nil
+	}
+	id := s.cfg.Distributors.Telegram.MinUserID + s.newUsers
+	s.newUsers++
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (s *TelegramStrategy) Request(id string) ([]string, error) {
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, r := range s.dist.GetResources(context.Background(), userID) {
+		lines = append(lines, r.String())
+	}
+	return lines, nil
+}
+
+func (s *TelegramStrategy) Block(bridges []core.Resource) error {
+	blocked := make(map[core.Hashkey]bool)
+	for _, r := range bridges {
+		blocked[r.Uid()] = true
+	}
+
+	var newPool []core.Resource
+	for _, r := range s.newPool {
+		if blocked[r.Uid()] {
+			delete(blocked, r.Uid())
+		} else {
+			newPool = append(newPool, r)
+		}
+	}
+	if len(newPool) != len(s.newPool) {
+		s.newPool = newPool
+		if err := s.pushNewPool(); err != nil {
+			return err
+		}
+	}
+
+	// The remaining blocked bridges come from the backend.
+	var oldPool []core.Resource
+	for _, r := range bridges {
+		if blocked[r.Uid()] {
+			oldPool = append(oldPool, r)
+		}
+	}
+	return s.stream.update(oldPool)
+}
+
+func (s *TelegramStrategy) NewDay() error {
+	return nil
+}
+
+func (s *TelegramStrategy) Stop() {
+	s.dist.Shutdown()
+}
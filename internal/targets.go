@@ -0,0 +1,162 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// targetsHandler handles the ad-hoc queries of the distributors and of
+// censorship measurement clients like OONI.  GET requests carry a
+// core.TargetsRequest and get a core.TargetsResponse.  The queries of an API
+// token are limited to its request origins, the ones of an admin token are
+// not.
+func (b *BackendContext) targetsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		log.Printf("Received unsupported request method %q from %s.", r.Method, r.RemoteAddr)
+		http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, isAdmin := lookupToken(r, b.Config.Backend.AdminTokens)
+	tokenName := ""
+	if !isAdmin {
+		var ok bool
+		tokenName, ok = b.authenticatedToken(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	var req core.TargetsRequest
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read HTTP body.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Printf("Failed to unmarshal targets request %q.", body)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		log.Printf("Invalid targets request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rType := range req.ResourceTypes {
+		if _, exists := b.Resources.Collection[rType]; !exists {
+			http.Error(w, fmt.Sprintf("unknown resource type %q", rType), http.StatusBadRequest)
+			return
+		}
+	}
+	if !isAdmin && req.Query == core.TargetsQueryCount {
+		// distributors can only count the resources of their own partition
+		rReq := core.ResourceRequest{RequestOrigin: req.RequestOrigin, ResourceTypes: req.ResourceTypes}
+		if !b.isAuthorized(w, tokenName, &rReq) {
+			return
+		}
+	}
+	log.Printf("Distributor %q is asking for the %s of %q.", req.RequestOrigin, req.Query, req.ResourceTypes)
+
+	var resp *core.TargetsResponse
+	switch req.Query {
+	case core.TargetsQueryOwner:
+		resp = b.ownerQuery(&req)
+		if !isAdmin {
+			resp.Owners = ownedBy(resp.Owners, originsOf(b.Config, tokenName))
+		}
+	case core.TargetsQueryCount:
+		resp = b.countQuery(&req)
+	}
+
+	jsonBlurb, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "error while turning the targets response into JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(jsonBlurb))
+}
+
+// ownerQuery returns the distributors that own the resources of the bridge
+// of the given request.
+func (b *BackendContext) ownerQuery(req *core.TargetsRequest) *core.TargetsResponse {
+
+	rTypes := req.ResourceTypes
+	if len(rTypes) == 0 {
+		for rType := range b.Resources.Collection {
+			rTypes = append(rTypes, rType)
+		}
+		sort.Strings(rTypes)
+	}
+
+	resp := &core.TargetsResponse{Owners: []core.ResourceOwner{}}
+	id := strings.ToUpper(strings.TrimSpace(req.Fingerprint))
+	stateFilter, _ := req.StateFilter()
+	for _, rType := range rTypes {
+		sHashring := b.Resources.Collection[rType]
+		for _, resource := range sHashring.Filter(hasFingerprint(id)).GetAll() {
+			if !stateFilter(resource) {
+				continue
+			}
+			owner := core.ResourceOwner{
+				Type:  rType,
+				State: core.StateName(resource.TestResult().State),
+			}
+			if sHashring.Stencil != nil {
+				distName, err := sHashring.Stencil.Owner(resource)
+				if err != nil {
+					log.Printf("Failed to find the owner of a %s resource: %s", rType, err)
+					continue
+				}
+				owner.Distributor = distName
+			}
+			resp.Owners = append(resp.Owners, owner)
+		}
+	}
+	return resp
+}
+
+// ownedBy returns the owners that are one of the given distributors, or that
+// are not partitioned and thus handed out by all of them.
+func ownedBy(owners []core.ResourceOwner, distNames []string) []core.ResourceOwner {
+
+	filtered := []core.ResourceOwner{}
+	for _, owner := range owners {
+		if owner.Distributor == "" || contains(distNames, owner.Distributor) {
+			filtered = append(filtered, owner)
+		}
+	}
+	return filtered
+}
+
+// countQuery returns the number of resources of each type of the given
+// request in the partition of the requesting distributor.
+func (b *BackendContext) countQuery(req *core.TargetsRequest) *core.TargetsResponse {
+
+	resp := &core.TargetsResponse{Counts: make(map[string]int)}
+	stateFilter, _ := req.StateFilter()
+	for _, rType := range req.ResourceTypes {
+		resp.Counts[rType] = 0
+		for _, resource := range b.Resources.Get(req.RequestOrigin, rType) {
+			if stateFilter(resource) {
+				resp.Counts[rType]++
+			}
+		}
+	}
+	return resp
+}
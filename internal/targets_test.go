@@ -0,0 +1,102 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestTargetsHandler(t *testing.T) {
+	b := BackendContext{}
+	cfg := testCfg
+	cfg.Backend.ApiTokens = map[string]string{"moat": "foo", "https": "bar"}
+	cfg.Backend.AdminTokens = map[string]string{"ooni": "baz"}
+	b.Config = &cfg
+	b.Resources = *core.NewBackendResources()
+	for _, rType := range resourceTypes {
+		b.Resources.AddResourceType(rType, false, cfg.Backend.DistProportions)
+	}
+	reloadBridgeDescriptors(&cfg, &b.Resources, nil, metrics, nil, nil, nil)
+
+	queryWith := func(token, body string) (int, *core.TargetsResponse) {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/targets", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		b.targetsHandler(rr, req)
+		var resp core.TargetsResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, &resp
+	}
+	query := func(body string) (int, *core.TargetsResponse) {
+		return queryWith("foo", body)
+	}
+
+	moat := b.Resources.Get("moat", "obfs4")
+	if len(moat) == 0 {
+		t.Fatal("No moat resources in the test assets")
+	}
+	code, resp := query(`{"request_origin": "moat", "query": "count", "resource_types": ["obfs4"]}`)
+	if code != http.StatusOK || resp.Counts["obfs4"] != len(moat) {
+		t.Errorf("Count query got %d and %v instead of %d obfs4", code, resp.Counts, len(moat))
+	}
+	code, resp = query(`{"request_origin": "moat", "query": "count", "resource_types": ["obfs4"], "state": "functional"}`)
+	if code != http.StatusOK || resp.Counts["obfs4"] != 0 {
+		t.Errorf("Count query of the functional resources got %d and %v instead of none", code, resp.Counts)
+	}
+
+	fingerprint := moat[0].(*resources.Transport).Fingerprint
+	code, resp = query(`{"request_origin": "moat", "query": "owner", "fingerprint": "` + strings.ToLower(fingerprint) + `", "resource_types": ["obfs4"]}`)
+	if code != http.StatusOK || len(resp.Owners) != 1 {
+		t.Fatalf("Owner query got %d and %v instead of one owner", code, resp.Owners)
+	}
+	if owner := resp.Owners[0]; owner.Distributor != "moat" || owner.Type != "obfs4" || owner.State != "untested" {
+		t.Errorf("Wrong owner: %v", owner)
+	}
+	ownerQuery := `{"request_origin": "https", "query": "owner", "fingerprint": "` + fingerprint + `", "resource_types": ["obfs4"]}`
+	if code, resp = queryWith("bar", ownerQuery); code != http.StatusOK || len(resp.Owners) != 0 {
+		t.Errorf("Owner query of another distributor's bridge got %d and %v", code, resp.Owners)
+	}
+	if code, resp = queryWith("baz", ownerQuery); code != http.StatusOK || len(resp.Owners) != 1 {
+		t.Errorf("Owner query of an admin got %d and %v instead of one owner", code, resp.Owners)
+	}
+	if code, _ = query(`{"request_origin": "https", "query": "count", "resource_types": ["obfs4"]}`); code != http.StatusForbidden {
+		t.Errorf("Count query of another distributor got %d instead of %d", code, http.StatusForbidden)
+	}
+	if code, resp = queryWith("baz", `{"request_origin": "moat", "query": "count", "resource_types": ["obfs4"]}`); code != http.StatusOK || resp.Counts["obfs4"] != len(moat) {
+		t.Errorf("Count query of an admin got %d and %v instead of %d obfs4", code, resp.Counts, len(moat))
+	}
+
+	code, resp = query(`{"request_origin": "moat", "query": "owner", "fingerprint": "0000000000000000000000000000000000000000"}`)
+	if code != http.StatusOK || len(resp.Owners) != 0 {
+		t.Errorf("Owner query of an unknown bridge got %d and %v", code, resp.Owners)
+	}
+
+	invalid := []string{
+		`{"request_origin": "moat", "query": "foo"}`,
+		`{"request_origin": "moat", "query": "owner"}`,
+		`{"request_origin": "moat", "query": "count"}`,
+		`{"request_origin": "moat", "query": "count", "resource_types": ["foo"]}`,
+		`{"request_origin": "moat", "query": "count", "resource_types": ["obfs4"], "state": "foo"}`,
+	}
+	for _, body := range invalid {
+		if code, _ := query(body); code != http.StatusBadRequest {
+			t.Errorf("Invalid query %s got %d instead of %d", body, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -34,6 +34,9 @@ type BackendResources struct {
 	// recipient struct that helps us keep track of notifying distributors when
 	// their resources change.
 	EventRecipients map[string]*EventRecipient
+	// replicas are the channels of the standby backends, they get the
+	// updates of all the resources.
+	replicas []chan *ResourceDiff
 }
 
 // EventRecipient represents the recipient of a resource event, i.e. a
@@ -41,6 +44,9 @@ type BackendResources struct {
 type EventRecipient struct {
 	EventChans []chan *ResourceDiff
 	Request    *ResourceRequest
+	// Requests maps each channel to the request it was registered with, as
+	// instances of the same distributor can request different resources.
+	Requests map[chan *ResourceDiff]*ResourceRequest
 }
 
 // NewBackendResources creates and returns a new resource collection.
@@ -55,18 +61,78 @@ func NewBackendResources() *BackendResources {
 // Add adds the given resource to the resource collection.  If the resource
 // already exists but has changed (i.e. its unique ID remains the same but its
 // object ID changed), we update the existing resource.
+//
+// A resource that gets blocked in new locations is updated too, even if its
+// object ID didn't change, so the distributors learn where it's blocked.  The
+// resource stays in the pools of its distributor, so it can still be handed
+// out in the locations that don't block it.  Blocks are never lifted by an
+// update.  The same goes for a resource whose labels changed.
+//
+// If the update moves the resource to another distributor, e.g. because its
+// operator changed its distribution request, the old distributor is told that
+// it's gone and the new one that it's new.
 func (ctx *BackendResources) Add(r1 Resource) {
 	hashring, exists := ctx.Collection[r1.Type()]
 	if !exists {
 		return
 	}
 
+	newlyBlocked := false
+	relabeled := false
+	oldDist := ""
+	if r2, err := hashring.GetExact(r1.Uid()); err == nil {
+		newlyBlocked = r1.BlockedIn().HasLocationsNotIn(r2.BlockedIn())
+		r1.SetBlockedIn(r2.BlockedIn())
+		relabeled = !labelsOf(r1).Equal(labelsOf(r2))
+		if hashring.Stencil != nil {
+			oldDist, _ = hashring.Owner(r2)
+		}
+	}
+
 	event := hashring.AddOrUpdate(r1)
+	if event == ResourceUnchanged && (newlyBlocked || relabeled) {
+		if newlyBlocked {
+			log.Printf("Resource %q is now blocked in %s.", r1.String(), r1.BlockedIn())
+		}
+		if err := hashring.Update(r1); err == nil {
+			event = ResourceChanged
+		}
+	}
+	if event == ResourceChanged && oldDist != "" {
+		if newDist, err := hashring.Owner(r1); err == nil && newDist != oldDist {
+			ctx.RLock()
+			defer ctx.RUnlock()
+			ctx.sendUpdate(oldDist, r1, ResourceIsGone)
+			ctx.sendUpdate(newDist, r1, ResourceIsNew)
+			ctx.sendReplicas(r1, ResourceChanged)
+			return
+		}
+	}
 	if event != ResourceUnchanged {
 		ctx.propagateUpdate(r1, event)
 	}
 }
 
+// Remove removes the resource with the unique ID of the given one from the
+// collection and tells its distributors that it's gone.  It returns false if
+// there was no such resource.
+func (ctx *BackendResources) Remove(r Resource) bool {
+	hashring, exists := ctx.Collection[r.Type()]
+	if !exists {
+		return false
+	}
+
+	existing, err := hashring.GetExact(r.Uid())
+	if err != nil {
+		return false
+	}
+	if err := hashring.Remove(existing); err != nil {
+		return false
+	}
+	ctx.propagateUpdate(existing, ResourceIsGone)
+	return true
+}
+
 // Prune removes expired resources.
 func (ctx *BackendResources) Prune() {
 
@@ -78,6 +144,26 @@ func (ctx *BackendResources) Prune() {
 	}
 }
 
+// PruneAbsent removes the resources that were missing from the last
+// maxAbsences reloads and tells their distributors that they are gone.  The
+// given set contains the unique IDs of the resources of the last reload.
+// Waiting for a few reloads avoids churning the distributors when a resource
+// is missing from a single reload because of a transient glitch.  The grace
+// period doesn't delay the expiry of the resources, Prune still removes the
+// ones that expire while they are missing.
+func (ctx *BackendResources) PruneAbsent(present map[Hashkey]bool, maxAbsences int) {
+
+	for rType, hashring := range ctx.Collection {
+		prunedResources := hashring.PruneAbsent(present, maxAbsences)
+		if len(prunedResources) > 0 {
+			log.Printf("Pruned %d %s resources missing from the last %d reloads.", len(prunedResources), rType, maxAbsences)
+		}
+		for _, resource := range prunedResources {
+			ctx.propagateUpdate(resource, ResourceIsGone)
+		}
+	}
+}
+
 // propagateUpdate sends updates about new, changed, and gone resources to
 // channels, allowing the backend to immediately inform a distributor of the
 // update.
@@ -89,7 +175,25 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 		return
 	}
 
-	// Prepare the hashring difference that we're about to send.
+	for distName := range ctx.EventRecipients {
+
+		// A distributor should only receive a diff if the resource in the diff
+		// maps to the distributor.
+		if !ctx.Collection[r.Type()].DoesDistOwnResource(r, distName) {
+			continue
+		}
+		ctx.sendUpdate(distName, r, event)
+	}
+	ctx.sendReplicas(r, event)
+}
+
+// sendReplicas sends the update about the given resource to the channels of
+// the replicas.  It has to be called with the read lock held.
+func (ctx *BackendResources) sendReplicas(r Resource, event int) {
+	if len(ctx.replicas) == 0 {
+		return
+	}
+
 	diff := &ResourceDiff{}
 	rm := ResourceMap{r.Type(): []Resource{r}}
 	switch event {
@@ -102,24 +206,91 @@ func (ctx *BackendResources) propagateUpdate(r Resource, event int) {
 	default:
 		return
 	}
+	for _, c := range ctx.replicas {
+		c <- diff
+	}
+}
 
-	for distName, eventRecipient := range ctx.EventRecipients {
+// sendUpdate sends the update about the given resource to the channels of the
+// given distributor.  It has to be called with the read lock held.
+func (ctx *BackendResources) sendUpdate(distName string, r Resource, event int) {
+	eventRecipient, exists := ctx.EventRecipients[distName]
+	if !exists {
+		return
+	}
 
-		// A distributor should only receive a diff if the resource in the diff
-		// maps to the distributor.
-		if !ctx.Collection[r.Type()].DoesDistOwnResource(r, distName) {
-			continue
+	for _, c := range eventRecipient.EventChans {
+		req, exists := eventRecipient.Requests[c]
+		if !exists {
+			req = eventRecipient.Request
 		}
-		if !ctx.EventRecipients[distName].Request.HasResourceType(r.Type()) {
+		if !req.HasResourceType(r.Type()) {
 			continue
 		}
 
-		for _, c := range eventRecipient.EventChans {
-			c <- diff
+		// Resources that the request doesn't accept are gone for it, if it
+		// had them before.
+		reqEvent := event
+		if !req.AcceptsResource(r) {
+			if event == ResourceIsNew {
+				continue
+			}
+			reqEvent = ResourceIsGone
+		}
+
+		// Prepare the hashring difference that we're about to send.
+		diff := &ResourceDiff{}
+		rm := ResourceMap{r.Type(): []Resource{r}}
+		switch reqEvent {
+		case ResourceIsNew:
+			diff.New = rm
+		case ResourceChanged:
+			diff.Changed = rm
+		case ResourceIsGone:
+			diff.Gone = rm
+		default:
+			return
 		}
+		c <- diff
 	}
 }
 
+// Rotate moves the given resources of type rType to other distributors.  The
+// distributors that owned them are told that they are gone, and the ones that
+// own them now that they are new.  It returns the number of resources that
+// moved.
+func (ctx *BackendResources) Rotate(rType string, resources []Resource) int {
+	hashring, exists := ctx.Collection[rType]
+	if !exists || hashring.Stencil == nil {
+		return 0
+	}
+
+	ctx.RLock()
+	defer ctx.RUnlock()
+
+	moved := 0
+	for _, r := range resources {
+		oldDist, err := hashring.Owner(r)
+		if err != nil {
+			log.Printf("Can't find the distributor of resource %q: %s", r.String(), err)
+			continue
+		}
+		newDist, err := hashring.Stencil.Rotate(r)
+		if err != nil {
+			log.Printf("Can't rotate resource %q: %s", r.String(), err)
+			continue
+		}
+		if newDist == oldDist {
+			continue
+		}
+
+		moved++
+		ctx.sendUpdate(oldDist, r, ResourceIsGone)
+		ctx.sendUpdate(newDist, r, ResourceIsNew)
+	}
+	return moved
+}
+
 // RegisterChan registers a channel to be informed about resource updates.
 func (ctx *BackendResources) RegisterChan(req *ResourceRequest, recipient chan *ResourceDiff) {
 	ctx.Lock()
@@ -129,10 +300,15 @@ func (ctx *BackendResources) RegisterChan(req *ResourceRequest, recipient chan *
 	log.Printf("Registered new channel for distributor %q to receive updates.", distName)
 	_, exists := ctx.EventRecipients[distName]
 	if !exists {
-		er := &EventRecipient{Request: req, EventChans: []chan *ResourceDiff{recipient}}
+		er := &EventRecipient{
+			Request:    req,
+			EventChans: []chan *ResourceDiff{recipient},
+			Requests:   map[chan *ResourceDiff]*ResourceRequest{recipient: req},
+		}
 		ctx.EventRecipients[distName] = er
 	} else {
 		ctx.EventRecipients[distName].EventChans = append(ctx.EventRecipients[distName].EventChans, recipient)
+		ctx.EventRecipients[distName].Requests[recipient] = req
 	}
 }
 
@@ -157,6 +333,31 @@ func (ctx *BackendResources) UnregisterChan(distName string, recipient chan *Res
 		}
 	}
 	ctx.EventRecipients[distName].EventChans = newSlice
+	delete(ctx.EventRecipients[distName].Requests, recipient)
+}
+
+// RegisterReplica registers a channel of a standby backend to be informed
+// about the updates of all the resources.
+func (ctx *BackendResources) RegisterReplica(recipient chan *ResourceDiff) {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	log.Printf("Registered new channel for a replica to receive updates.")
+	ctx.replicas = append(ctx.replicas, recipient)
+}
+
+// UnregisterReplica unregisters a channel of a standby backend.
+func (ctx *BackendResources) UnregisterReplica(recipient chan *ResourceDiff) {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	replicas := []chan *ResourceDiff{}
+	for _, c := range ctx.replicas {
+		if c != recipient {
+			replicas = append(replicas, c)
+		}
+	}
+	ctx.replicas = replicas
 }
 
 // Get returns a slice of resources of the requested type for the given
@@ -184,3 +385,12 @@ func (ctx *BackendResources) Get(distName string, rType string) []Resource {
 	}
 	return resources
 }
+
+// labelsOf returns the labels of the given resource, or nil if it can't carry
+// labels.
+func labelsOf(r Resource) Labels {
+	if lr, ok := r.(LabeledResource); ok {
+		return lr.Labels()
+	}
+	return nil
+}
@@ -72,7 +72,7 @@ func TestPruneCollection(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to retrieve existing resource: %s", err)
 	}
-	node := c.Collection[d.Type()].hashnodes[i]
+	node := c.Collection[d.Type()].nodes()[i]
 	node.lastUpdate = time.Now().UTC().Add(-d.ExpiryTime - time.Minute)
 
 	c.Prune()
@@ -105,3 +105,243 @@ func TestCollectionProportions(t *testing.T) {
 		t.Errorf("Unexpected dummy resource: %v", resources[0])
 	}
 }
+
+func TestRotateCollection(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", false, map[string]int{"foo": 1, "bar": 1})
+	for i := 1; i <= 20; i++ {
+		c.Add(NewDummy(Hashkey(i), Hashkey(i)))
+	}
+
+	chans := make(map[string]chan *ResourceDiff)
+	for _, distName := range []string{"foo", "bar"} {
+		chans[distName] = make(chan *ResourceDiff, 40)
+		req := &ResourceRequest{RequestOrigin: distName, ResourceTypes: []string{"dummy"}}
+		c.RegisterChan(req, chans[distName])
+	}
+
+	foo := c.Get("foo", "dummy")
+	numBar := len(c.Get("bar", "dummy"))
+	if len(foo) == 0 {
+		t.Fatal("No resources for foo")
+	}
+	moved := c.Rotate("dummy", foo)
+	if moved != len(foo) {
+		t.Errorf("Only %d of %d resources moved", moved, len(foo))
+	}
+	if n := len(c.Get("foo", "dummy")); n != 0 {
+		t.Errorf("foo still has %d resources", n)
+	}
+	if n := len(c.Get("bar", "dummy")); n != numBar+moved {
+		t.Errorf("bar has %d resources instead of %d", n, numBar+moved)
+	}
+
+	for i := 0; i < moved; i++ {
+		gone := <-chans["foo"]
+		if len(gone.Gone["dummy"]) != 1 || gone.New != nil {
+			t.Errorf("Unexpected diff for the old distributor: %v", gone)
+		}
+		isNew := <-chans["bar"]
+		if len(isNew.New["dummy"]) != 1 || isNew.Gone != nil {
+			t.Errorf("Unexpected diff for the new distributor: %v", isNew)
+		}
+	}
+}
+
+func TestMoveCollection(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", false, map[string]int{"foo": 1, "bar": 1})
+	d := NewDummy(1, 1)
+	d.Distribution = "foo"
+	c.Add(d)
+
+	chans := make(map[string]chan *ResourceDiff)
+	for _, distName := range []string{"foo", "bar"} {
+		chans[distName] = make(chan *ResourceDiff, 1)
+		req := &ResourceRequest{RequestOrigin: distName, ResourceTypes: []string{"dummy"}}
+		c.RegisterChan(req, chans[distName])
+	}
+
+	// The operator asked for another distributor.
+	moved := NewDummy(2, 1)
+	moved.Distribution = "bar"
+	c.Add(moved)
+	if len(c.Get("foo", "dummy")) != 0 || len(c.Get("bar", "dummy")) != 1 {
+		t.Fatal("The resource didn't move to bar")
+	}
+
+	gone := <-chans["foo"]
+	if len(gone.Gone["dummy"]) != 1 || gone.New != nil || gone.Changed != nil {
+		t.Errorf("Unexpected diff for the old distributor: %v", gone)
+	}
+	isNew := <-chans["bar"]
+	if len(isNew.New["dummy"]) != 1 || isNew.Gone != nil || isNew.Changed != nil {
+		t.Errorf("Unexpected diff for the new distributor: %v", isNew)
+	}
+}
+
+func TestAddBlockedCollection(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", true, nil)
+	c.Add(NewDummy(1, 1))
+
+	diffs := make(chan *ResourceDiff, 2)
+	req := &ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}}
+	c.RegisterChan(req, diffs)
+
+	d := NewDummy(1, 1)
+	d.SetBlockedIn(LocationSet{"ru": true})
+	c.Add(d)
+	if len(diffs) != 1 {
+		t.Fatalf("Got %d diffs for a newly blocked resource", len(diffs))
+	}
+	diff := <-diffs
+	if len(diff.Changed["dummy"]) != 1 || !diff.Changed["dummy"][0].BlockedIn()["ru"] {
+		t.Errorf("Unexpected diff for a newly blocked resource: %v", diff)
+	}
+
+	// blocks are not lifted by an update
+	c.Add(NewDummy(1, 1))
+	if len(diffs) != 0 {
+		t.Errorf("Got a diff for a resource without new blocks")
+	}
+	r, err := c.Collection["dummy"].GetExact(1)
+	if err != nil || !r.BlockedIn()["ru"] {
+		t.Errorf("Lost the block of the resource: %v", r)
+	}
+
+	// distributors keep serving the resource in other locations
+	dist := NewHashring()
+	dist.Add(NewDummy(1, 1))
+	dist.ApplyDiff(diff)
+	if dist.Filter(NotBlockedIn("ru")).Len() != 0 || dist.Filter(NotBlockedIn("cn")).Len() != 1 {
+		t.Error("Wrong resources after filtering the blocked ones")
+	}
+}
+
+func TestRelabelCollection(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", true, nil)
+	c.Add(NewDummy(1, 1))
+
+	diffs := make(chan *ResourceDiff, 2)
+	req := &ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}}
+	c.RegisterChan(req, diffs)
+
+	d := NewDummy(1, 1)
+	d.SetLabels(Labels{"bandwidth": "high"})
+	c.Add(d)
+	if len(diffs) != 1 {
+		t.Fatalf("Got %d diffs for a relabeled resource", len(diffs))
+	}
+	diff := <-diffs
+	if len(diff.Changed["dummy"]) != 1 {
+		t.Fatalf("Unexpected diff for a relabeled resource: %v", diff)
+	}
+
+	d = NewDummy(1, 1)
+	d.SetLabels(Labels{"bandwidth": "high"})
+	c.Add(d)
+	if len(diffs) != 0 {
+		t.Errorf("Got a diff for a resource with the same labels")
+	}
+
+	if c.Collection.GetWithLabels("foo", "dummy", "bandwidth=high").Len() != 1 {
+		t.Error("Didn't get the labeled resource")
+	}
+	if c.Collection.GetWithLabels("foo", "dummy", "!bandwidth").Len() != 0 {
+		t.Error("Got a labeled resource that should be excluded")
+	}
+}
+
+func TestPruneAbsentCollection(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", true, nil)
+	c.Add(NewDummy(1, 1))
+	c.Add(NewDummy(2, 2))
+
+	diffs := make(chan *ResourceDiff, 2)
+	req := &ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}}
+	c.RegisterChan(req, diffs)
+
+	c.PruneAbsent(map[Hashkey]bool{1: true, 2: true}, 1)
+	c.PruneAbsent(map[Hashkey]bool{1: true}, 1)
+	if n := len(c.Get("foo", "dummy")); n != 1 {
+		t.Fatalf("expected 1 resource but got %d", n)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs instead of 1", len(diffs))
+	}
+	diff := <-diffs
+	if len(diff.Gone["dummy"]) != 1 || diff.Gone["dummy"][0].Uid() != 2 {
+		t.Errorf("unexpected diff for the absent resource: %v", diff)
+	}
+}
+
+func TestRemoveCollection(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", true, nil)
+	c.Add(NewDummy(1, 1))
+	c.Add(NewDummy(2, 2))
+
+	diffs := make(chan *ResourceDiff, 2)
+	req := &ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}}
+	c.RegisterChan(req, diffs)
+
+	// the resource is found by its unique ID, its object ID doesn't matter
+	if !c.Remove(NewDummy(3, 2)) {
+		t.Fatal("failed to remove an existing resource")
+	}
+	if c.Remove(NewDummy(3, 3)) {
+		t.Error("removed a resource that doesn't exist")
+	}
+	if n := len(c.Get("foo", "dummy")); n != 1 {
+		t.Fatalf("expected 1 resource but got %d", n)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs instead of 1", len(diffs))
+	}
+	diff := <-diffs
+	if len(diff.Gone["dummy"]) != 1 || diff.Gone["dummy"][0].Oid() != 2 {
+		t.Errorf("unexpected diff for the removed resource: %v", diff)
+	}
+}
+
+func TestFilteredStream(t *testing.T) {
+	c := NewBackendResources()
+	c.AddResourceType("dummy", true, nil)
+
+	all := make(chan *ResourceDiff, 4)
+	c.RegisterChan(&ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}}, all)
+	ir := make(chan *ResourceDiff, 4)
+	c.RegisterChan(&ResourceRequest{RequestOrigin: "foo", ResourceTypes: []string{"dummy"}, NotBlockedIn: []string{"ir"}}, ir)
+
+	blocked := NewDummy(1, 1)
+	blocked.SetBlockedIn(LocationSet{"ir": true})
+	c.Add(blocked)
+	c.Add(NewDummy(2, 2))
+	if len(all) != 2 || len(ir) != 1 {
+		t.Fatalf("Got %d and %d diffs instead of 2 and 1", len(all), len(ir))
+	}
+	if diff := <-ir; diff.New["dummy"][0].Uid() != 2 {
+		t.Errorf("Got a resource blocked in ir: %v", diff)
+	}
+
+	// a resource newly blocked in ir is gone for the filtered stream
+	d := NewDummy(2, 2)
+	d.SetBlockedIn(LocationSet{"ir": true})
+	c.Add(d)
+	if diff := <-ir; len(diff.Gone["dummy"]) != 1 || diff.Gone["dummy"][0].Uid() != 2 {
+		t.Errorf("Unexpected diff for the filtered stream: %v", diff)
+	}
+	<-all
+	<-all
+	if diff := <-all; len(diff.Changed["dummy"]) != 1 {
+		t.Errorf("Unexpected diff for the unfiltered stream: %v", diff)
+	}
+
+	c.UnregisterChan("foo", ir)
+	if len(c.EventRecipients["foo"].Requests) != 1 {
+		t.Error("The request of the unregistered channel was not removed")
+	}
+}
@@ -61,24 +61,43 @@ func (c Collection) GetHashring(distName string, rType string) *Hashring {
 	return subHashring
 }
 
+// GetWithLabels returns the resources of the requested type for the given
+// distributor whose labels match all the given selectors, e.g. to build a
+// pool of "bandwidth=high" bridges.
+func (c Collection) GetWithLabels(distName string, rType string, selectors ...string) *Hashring {
+	return c.GetHashring(distName, rType).Filter(WithLabels(selectors...))
+}
+
+// SetDeprioritized sets the resources that are deprioritized in the hashrings
+// of all the resource types.
+func (c Collection) SetDeprioritized(uids []Hashkey) {
+	for _, sHashring := range c {
+		sHashring.SetDeprioritized(uids)
+	}
+}
+
 // ApplyDiff updates the collection with the resources changed in ResrouceDiff
 func (c Collection) ApplyDiff(diff *ResourceDiff) {
-	for rType, resources := range diff.New {
-		log.Printf("Adding %d resources of type %s.", len(resources), rType)
-		for _, r := range resources {
-			c[rType].Add(r)
+	// Split the diff by resource type, so each hashring applies its part
+	// in a single write.
+	diffs := make(map[string]*ResourceDiff)
+	typeDiff := func(rType string) *ResourceDiff {
+		if _, exists := diffs[rType]; !exists {
+			diffs[rType] = NewResourceDiff()
 		}
+		return diffs[rType]
+	}
+	for rType, resources := range diff.New {
+		typeDiff(rType).New[rType] = resources
 	}
 	for rType, resources := range diff.Changed {
-		log.Printf("Changing %d resources of type %s.", len(resources), rType)
-		for _, r := range resources {
-			c[rType].AddOrUpdate(r)
-		}
+		typeDiff(rType).Changed[rType] = resources
 	}
 	for rType, resources := range diff.Gone {
-		log.Printf("Removing %d resources of type %s.", len(resources), rType)
-		for _, r := range resources {
-			c[rType].Remove(r)
-		}
+		typeDiff(rType).Gone[rType] = resources
+	}
+
+	for rType, d := range diffs {
+		c[rType].ApplyDiff(d)
 	}
 }
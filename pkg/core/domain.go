@@ -49,6 +49,59 @@ type Resource interface {
 	Distributor() string
 }
 
+// ParameterizedResource is implemented by the resources that have parameters
+// resource requests can filter by, e.g. the port of a bridge or the iat-mode
+// of an obfs4 bridge.
+type ParameterizedResource interface {
+	// Parameter returns the value of the given parameter and false if the
+	// resource doesn't have it.
+	Parameter(name string) (string, bool)
+}
+
+// Labels are arbitrary key/value pairs attached to a resource, like
+// "bandwidth": "high" or "donor": "partner".  Distributors can select
+// resources by their labels, see ResourceRequest.
+type Labels map[string]string
+
+// Equal returns true if both label sets contain the same labels.
+func (l Labels) Equal(other Labels) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for key, value := range l {
+		if v, exists := other[key]; !exists || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// LabeledResource is implemented by the resources that can carry labels.
+type LabeledResource interface {
+	Labels() Labels
+	// SetLabels replaces the labels of the resource.
+	SetLabels(Labels)
+}
+
+// LocatedResource is implemented by the resources that know where they are
+// hosted, e.g. bridges geolocated by the backend.
+type LocatedResource interface {
+	// HostLocation returns the location of the resource, or nil if it's
+	// unknown.
+	HostLocation() *Location
+}
+
+// IsHostedIn returns true if the resource is known to be hosted in the given
+// country.  The country code is compared case-insensitively.
+func IsHostedIn(r Resource, country string) bool {
+	lr, ok := r.(LocatedResource)
+	if !ok {
+		return false
+	}
+	location := lr.HostLocation()
+	return location != nil && location.CountryCode != "" && strings.EqualFold(location.CountryCode, country)
+}
+
 // ResourceTest represents the result of a test of a resource.  We use the tool
 // bridgestrap for testing:
 // https://gitlab.torproject.org/tpo/anti-censorship/bridgestrap
@@ -236,6 +289,7 @@ func (s1 LocationSet) HasLocationsNotIn(s2 LocationSet) bool {
 type ResourceBase struct {
 	RType      string      `json:"type"`
 	RBlockedIn LocationSet `json:"blocked_in"`
+	RLabels    Labels      `json:"labels,omitempty"`
 	Location   *Location
 	test       *ResourceTest
 }
@@ -261,6 +315,11 @@ func (r *ResourceBase) TestResult() *ResourceTest {
 	return r.test
 }
 
+// SetTestResult sets the resource's test result.
+func (r *ResourceBase) SetTestResult(test *ResourceTest) {
+	r.test = test
+}
+
 // BlockedIn returns the set of locations that block the resource.
 func (r *ResourceBase) BlockedIn() LocationSet {
 	return r.RBlockedIn
@@ -274,13 +333,149 @@ func (r *ResourceBase) SetBlockedIn(l LocationSet) {
 	}
 }
 
+// HostLocation returns the location where the resource is hosted, or nil if
+// it's unknown.
+func (r *ResourceBase) HostLocation() *Location {
+	return r.Location
+}
+
+// Labels returns the resource's labels.
+func (r *ResourceBase) Labels() Labels {
+	return r.RLabels
+}
+
+// SetLabels replaces the resource's labels with the given ones.
+func (r *ResourceBase) SetLabels(l Labels) {
+	r.RLabels = make(Labels)
+	for key, value := range l {
+		r.RLabels[key] = value
+	}
+}
+
 // ResourceRequest represents a request for resources.  Distributors use
 // ResourceRequest to request resources from the backend.
 type ResourceRequest struct {
 	// Name of requesting distributor.
-	RequestOrigin string             `json:"request_origin"`
-	ResourceTypes []string           `json:"resource_types"`
-	Receiver      chan *ResourceDiff `json:"-"`
+	RequestOrigin string   `json:"request_origin"`
+	ResourceTypes []string `json:"resource_types"`
+	// NotBlockedIn, if set, restricts the request to resources that are not
+	// blocked in any of the given locations.
+	NotBlockedIn []string `json:"not_blocked_in,omitempty"`
+	// NotHostedIn, if set, restricts the request to resources that are not
+	// hosted in any of the given countries, see LocatedResource.
+	NotHostedIn []string `json:"not_hosted_in,omitempty"`
+	// Filters, if set, restricts the request to resources whose parameters
+	// match all the given expressions.  Expressions look like
+	// "iat-mode=1" or "port!=80", see ParameterizedResource.
+	Filters []string `json:"filters,omitempty"`
+	// Labels, if set, restricts the request to resources whose labels match
+	// all the given selectors.  Selectors look like "bandwidth=high",
+	// "donor!=partner", "port-443" (the label exists) or "!port-443" (the
+	// label doesn't exist), see LabeledResource.
+	Labels   []string           `json:"labels,omitempty"`
+	Receiver chan *ResourceDiff `json:"-"`
+}
+
+// resourceFilter is a parsed filter expression of a resource request.
+type resourceFilter struct {
+	parameter string
+	value     string
+	negated   bool
+}
+
+// parseFilter parses a filter expression like "port=443" or "iat-mode!=0".
+func parseFilter(expr string) (*resourceFilter, error) {
+
+	f := &resourceFilter{}
+	i := strings.Index(expr, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("filter %q is not like parameter=value or parameter!=value", expr)
+	}
+	f.parameter = expr[:i]
+	f.value = expr[i+1:]
+	if strings.HasSuffix(f.parameter, "!") {
+		f.negated = true
+		f.parameter = strings.TrimSuffix(f.parameter, "!")
+	}
+	if f.parameter == "" {
+		return nil, fmt.Errorf("filter %q has no parameter", expr)
+	}
+	return f, nil
+}
+
+// matches returns true if the resource's parameter matches the filter.
+// Resources without the parameter only match negated filters.
+func (f *resourceFilter) matches(r Resource) bool {
+
+	var value string
+	var exists bool
+	if pr, ok := r.(ParameterizedResource); ok {
+		value, exists = pr.Parameter(f.parameter)
+	}
+	if f.negated {
+		return !exists || value != f.value
+	}
+	return exists && value == f.value
+}
+
+// labelSelector is a parsed label selector of a resource request.
+type labelSelector struct {
+	resourceFilter
+	// anyValue is true if the selector only checks whether the resource has
+	// the label, like "port-443" or "!port-443".
+	anyValue bool
+}
+
+// parseLabelSelector parses a label selector like "bandwidth=high",
+// "donor!=partner", "port-443" or "!port-443".
+func parseLabelSelector(expr string) (*labelSelector, error) {
+
+	if !strings.Contains(expr, "=") {
+		s := &labelSelector{anyValue: true}
+		s.negated = strings.HasPrefix(expr, "!")
+		s.parameter = strings.TrimPrefix(expr, "!")
+		if s.parameter == "" {
+			return nil, fmt.Errorf("label selector %q has no label", expr)
+		}
+		return s, nil
+	}
+
+	f, err := parseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &labelSelector{resourceFilter: *f}, nil
+}
+
+// matches returns true if the resource's labels match the selector.
+// Resources without labels only match negated selectors.
+func (s *labelSelector) matches(r Resource) bool {
+
+	var labels Labels
+	if lr, ok := r.(LabeledResource); ok {
+		labels = lr.Labels()
+	}
+	value, exists := labels[s.parameter]
+	if s.anyValue {
+		return exists != s.negated
+	}
+	if s.negated {
+		return !exists || value != s.value
+	}
+	return exists && value == s.value
+}
+
+// MatchesLabels returns true if the resource's labels match all the given
+// selectors.  Invalid selectors don't match any resource.
+func MatchesLabels(r Resource, selectors []string) bool {
+
+	for _, expr := range selectors {
+		s, err := parseLabelSelector(expr)
+		if err != nil || !s.matches(r) {
+			return false
+		}
+	}
+	return true
 }
 
 // HasResourceType returns true if the resource request contains the given
@@ -294,3 +489,116 @@ func (r *ResourceRequest) HasResourceType(rType1 string) bool {
 	}
 	return false
 }
+
+// IsFiltered returns true if the resource request doesn't accept all the
+// resources of its types.
+func (r *ResourceRequest) IsFiltered() bool {
+	return len(r.NotBlockedIn) != 0 || len(r.NotHostedIn) != 0 || len(r.Filters) != 0 || len(r.Labels) != 0
+}
+
+// ValidateFilters returns an error if any of the filter expressions or label
+// selectors of the resource request is not valid.
+func (r *ResourceRequest) ValidateFilters() error {
+
+	for _, expr := range r.Filters {
+		if _, err := parseFilter(expr); err != nil {
+			return err
+		}
+	}
+	for _, expr := range r.Labels {
+		if _, err := parseLabelSelector(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AcceptsResource returns true if the given resource is not blocked in nor
+// hosted in any of the locations of the resource request and matches all of
+// its filters and label selectors.  Invalid filters don't match any resource.
+func (r *ResourceRequest) AcceptsResource(res Resource) bool {
+
+	blockedIn := res.BlockedIn()
+	for _, location := range r.NotBlockedIn {
+		if blockedIn[location] {
+			return false
+		}
+	}
+	for _, country := range r.NotHostedIn {
+		if IsHostedIn(res, country) {
+			return false
+		}
+	}
+	for _, expr := range r.Filters {
+		f, err := parseFilter(expr)
+		if err != nil || !f.matches(res) {
+			return false
+		}
+	}
+	return MatchesLabels(res, r.Labels)
+}
+
+// HandoutReport represents a report of handouts.  Distributors use
+// HandoutReport to tell the backend how many times they handed out each
+// resource since their last report.
+type HandoutReport struct {
+	// Name of reporting distributor.
+	RequestOrigin string          `json:"request_origin"`
+	Handouts      map[Hashkey]int `json:"handouts"`
+}
+
+// Heartbeat represents the periodic message that distributors send to the
+// resource stream endpoint of the backend, so the backend knows that they are
+// alive even when there are no resource updates.
+type Heartbeat struct {
+	// Name of the distributor.
+	RequestOrigin string `json:"request_origin"`
+	// Streaming is true if the distributor is connected to the resource
+	// stream.
+	Streaming bool `json:"streaming"`
+}
+
+// ExposureReport is the backend's response to a HandoutReport.  It contains
+// the unique IDs of the resources of the distributor that were handed out too
+// often and should be deprioritized.
+type ExposureReport struct {
+	OverExposed []Hashkey `json:"over_exposed"`
+}
+
+// FeedbackResults counts how many clients could and couldn't connect with the
+// circumvention settings of a transport.
+type FeedbackResults struct {
+	Worked int `json:"worked"`
+	Failed int `json:"failed"`
+}
+
+// Total returns the number of results.
+func (f FeedbackResults) Total() int {
+	return f.Worked + f.Failed
+}
+
+// SuccessRate returns the fraction of the results that worked, or 0 if there
+// are no results.
+func (f FeedbackResults) SuccessRate() float64 {
+	if f.Total() == 0 {
+		return 0
+	}
+	return float64(f.Worked) / float64(f.Total())
+}
+
+// FeedbackReport represents the feedback of the clients of a distributor about
+// the circumvention settings that they got since the last report.
+type FeedbackReport struct {
+	// Name of reporting distributor.
+	RequestOrigin string `json:"request_origin"`
+	// Results maps country codes to transports to the results of the
+	// clients in the country.
+	Results map[string]map[string]FeedbackResults `json:"results"`
+}
+
+// EffectivenessReport is the backend's response to a FeedbackReport.  It
+// contains the results of the feedback window, from all the distributors, of
+// the countries and transports that got enough feedback.
+type EffectivenessReport struct {
+	Effectiveness map[string]map[string]FeedbackResults `json:"effectiveness"`
+}
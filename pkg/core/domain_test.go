@@ -177,6 +177,131 @@ func TestHasResourceType(t *testing.T) {
 	}
 }
 
+// paramDummy is a Dummy with parameters to filter by.
+type paramDummy struct {
+	*Dummy
+	params map[string]string
+}
+
+func (d *paramDummy) Parameter(name string) (string, bool) {
+	value, exists := d.params[name]
+	return value, exists
+}
+
+func TestResourceRequestFilters(t *testing.T) {
+	r := &paramDummy{NewDummy(1, 1), map[string]string{"port": "443", "iat-mode": "1"}}
+
+	for _, filters := range [][]string{
+		{"port=443"},
+		{"port=443", "iat-mode=1"},
+		{"iat-mode!=0"},
+		{"foo!=bar"},
+	} {
+		req := ResourceRequest{Filters: filters}
+		if err := req.ValidateFilters(); err != nil {
+			t.Errorf("Filters %v are not valid: %s", filters, err)
+		}
+		if !req.AcceptsResource(r) {
+			t.Errorf("Filters %v don't accept the resource", filters)
+		}
+	}
+
+	for _, filters := range [][]string{
+		{"port=80"},
+		{"port=443", "iat-mode=0"},
+		{"port!=443"},
+		{"foo=bar"},
+	} {
+		req := ResourceRequest{Filters: filters}
+		if req.AcceptsResource(r) {
+			t.Errorf("Filters %v accept the resource", filters)
+		}
+	}
+
+	// resources without parameters only match negated filters
+	req := ResourceRequest{Filters: []string{"port!=80"}}
+	if !req.AcceptsResource(NewDummy(2, 2)) {
+		t.Error("Negated filter doesn't accept a resource without parameters")
+	}
+
+	for _, expr := range []string{"port", "=443", "!=443"} {
+		req := ResourceRequest{Filters: []string{expr}}
+		if req.ValidateFilters() == nil {
+			t.Errorf("Invalid filter %q was accepted", expr)
+		}
+	}
+}
+
+func TestResourceRequestLabels(t *testing.T) {
+	r := NewDummy(1, 1)
+	r.SetLabels(Labels{"bandwidth": "high", "port-443": ""})
+
+	for _, selectors := range [][]string{
+		{"bandwidth=high"},
+		{"port-443"},
+		{"bandwidth=high", "!donor"},
+		{"donor!=partner"},
+	} {
+		req := ResourceRequest{Labels: selectors}
+		if err := req.ValidateFilters(); err != nil {
+			t.Errorf("Selectors %v are not valid: %s", selectors, err)
+		}
+		if !req.AcceptsResource(r) {
+			t.Errorf("Selectors %v don't accept the resource", selectors)
+		}
+	}
+
+	for _, selectors := range [][]string{
+		{"bandwidth=low"},
+		{"bandwidth!=high"},
+		{"!port-443"},
+		{"donor"},
+	} {
+		req := ResourceRequest{Labels: selectors}
+		if req.AcceptsResource(r) {
+			t.Errorf("Selectors %v accept the resource", selectors)
+		}
+	}
+
+	for _, expr := range []string{"", "!", "=high"} {
+		req := ResourceRequest{Labels: []string{expr}}
+		if req.ValidateFilters() == nil {
+			t.Errorf("Invalid selector %q was accepted", expr)
+		}
+	}
+}
+
+func TestResourceBaseLabels(t *testing.T) {
+	r := NewResourceBase()
+	labels := Labels{"bandwidth": "high"}
+	r.SetLabels(labels)
+	labels["bandwidth"] = "low"
+	if r.Labels()["bandwidth"] != "high" {
+		t.Error("The labels of the resource are shared with the caller")
+	}
+	if !r.Labels().Equal(Labels{"bandwidth": "high"}) || r.Labels().Equal(labels) {
+		t.Error("Wrong comparison of labels")
+	}
+}
+
+func TestResourceRequestNotHostedIn(t *testing.T) {
+	r := NewDummy(1, 1)
+	r.Loc = &Location{CountryCode: "CN"}
+
+	req := ResourceRequest{NotHostedIn: []string{"cn"}}
+	if req.AcceptsResource(r) {
+		t.Error("Accepted a resource hosted in an excluded country")
+	}
+	req = ResourceRequest{NotHostedIn: []string{"ir"}}
+	if !req.AcceptsResource(r) {
+		t.Error("Didn't accept a resource hosted in another country")
+	}
+	req = ResourceRequest{NotHostedIn: []string{"cn"}}
+	if !req.AcceptsResource(NewDummy(2, 2)) {
+		t.Error("Didn't accept a resource without location")
+	}
+}
+
 func TestResourceMapString(t *testing.T) {
 
 	m := make(ResourceMap)
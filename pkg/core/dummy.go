@@ -17,6 +17,9 @@ type Dummy struct {
 	test         *ResourceTest
 	testFunc     func(Resource)
 	Distribution string
+	Blocked      LocationSet
+	LabelSet     Labels
+	Loc          *Location
 }
 
 func NewDummy(oid Hashkey, uid Hashkey) *Dummy {
@@ -67,7 +70,25 @@ func (d *Dummy) IsValid() bool {
 	return true
 }
 func (d *Dummy) BlockedIn() LocationSet {
-	return make(LocationSet)
+	if d.Blocked == nil {
+		return make(LocationSet)
+	}
+	return d.Blocked
+}
+func (d *Dummy) SetBlockedIn(l LocationSet) {
+	if d.Blocked == nil {
+		d.Blocked = make(LocationSet)
+	}
+	for key := range l {
+		d.Blocked[key] = true
+	}
+}
+func (d *Dummy) Labels() Labels {
+	return d.LabelSet
+}
+func (d *Dummy) SetLabels(l Labels) {
+	d.LabelSet = l
 }
-func (d *Dummy) SetBlockedIn(LocationSet) {
+func (d *Dummy) HostLocation() *Location {
+	return d.Loc
 }
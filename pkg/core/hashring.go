@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,23 +32,84 @@ type ResourceDiff struct {
 // Hashkey represents an index in a hashring.
 type Hashkey uint64
 
-// Hashnodes represents a node in a hashring.
+// Hashnodes represents a node in a hashring.  The hash key and the element of
+// a node never change once it's part of a snapshot, updates replace the node.
+// The other fields are only used by the writers of the hashring.
 type hashnode struct {
 	hashkey    Hashkey
 	elem       Resource
 	lastUpdate time.Time
+	// reloaded is true if the resource was part of a reload, see
+	// PruneAbsent
+	reloaded bool
+	// absences is the number of consecutive reloads the resource was
+	// missing from
+	absences int
 }
 
 // Hashring represents a hashring consisting of resources.
+//
+// Reads never block: they work on an immutable snapshot of the hashring.
+// Writers build a new snapshot and swap it in atomically, so a reload of all
+// the resources doesn't stall the distributors answering requests in the
+// meantime.
 type Hashring struct {
+	// snapshot holds the current *ringSnapshot.
+	snapshot atomic.Value
+	// writeLock serializes the writers.  Readers don't take it.
+	writeLock sync.Mutex
+}
+
+// ringSnapshot is an immutable view of the resources of a hashring.
+type ringSnapshot struct {
+	// hashnodes are sorted by hash key.
 	hashnodes []*hashnode
-	sync.RWMutex
+	// deprioritized contains the resources that GetMany only returns if
+	// there are not enough other resources, e.g. because they are
+	// over-exposed.  The map is replaced but never modified, so it can be
+	// shared with the hashrings created by Filter.
+	deprioritized map[Hashkey]bool
 }
 
 // FilterFunc takes as input a resource and returns true or false, depending on
 // its filtering criteria.
 type FilterFunc func(r Resource) bool
 
+// NotBlockedIn returns a filter function that only keeps the resources that
+// are not blocked in the given location.  Resources blocked somewhere else
+// are still useful here, so we keep handing them out in this location.
+func NotBlockedIn(location string) FilterFunc {
+	return func(r Resource) bool {
+		return !r.BlockedIn()[location]
+	}
+}
+
+// NotHostedIn returns a filter function that only keeps the resources that
+// are not known to be hosted in the given country.  A bridge hosted in the
+// requester's own country is behind the same censor, so it's useless there
+// and handing it out only exposes it.
+func NotHostedIn(country string) FilterFunc {
+	return func(r Resource) bool {
+		return !IsHostedIn(r, country)
+	}
+}
+
+// OfType returns a filter function that only keeps the resources of the given
+// type.
+func OfType(rType string) FilterFunc {
+	return func(r Resource) bool {
+		return r.Type() == rType
+	}
+}
+
+// WithLabels returns a filter function that only keeps the resources whose
+// labels match all the given selectors, see ResourceRequest.Labels.
+func WithLabels(selectors ...string) FilterFunc {
+	return func(r Resource) bool {
+		return MatchesLabels(r, selectors)
+	}
+}
+
 // NewResourceDiff returns a new ResourceDiff.
 func NewResourceDiff() *ResourceDiff {
 	return &ResourceDiff{
@@ -91,64 +153,152 @@ func (m *ResourceDiff) String() string {
 	return "Resource diff: " + strings.Join(s, ", ")
 }
 
-// Len implements the sort interface.
-// This function is unsafe and needs a mutex lock before being used
+// load returns the current snapshot of the hashring.
+func (h *Hashring) load() *ringSnapshot {
+	s, _ := h.snapshot.Load().(*ringSnapshot)
+	if s == nil {
+		return &ringSnapshot{}
+	}
+	return s
+}
+
+// store replaces the snapshot of the hashring with the given nodes, keeping
+// the deprioritized resources.  It must be called with the write lock held.
+func (h *Hashring) store(nodes []*hashnode) {
+	h.snapshot.Store(&ringSnapshot{hashnodes: nodes, deprioritized: h.load().deprioritized})
+}
+
+// nodes returns the nodes of the current snapshot.
+func (h *Hashring) nodes() []*hashnode {
+	return h.load().hashnodes
+}
+
+// Len returns the number of resources in the hashring.
 func (h *Hashring) Len() int {
-	return len(h.hashnodes)
+	return len(h.load().hashnodes)
 }
 
-// Less implements the sort interface.
-// This function is unsafe and needs a mutex lock before being used
-func (h *Hashring) Less(i, j int) bool {
-	return h.hashnodes[i].hashkey < h.hashnodes[j].hashkey
+// withNode returns a copy of the nodes with the node at index i replaced by
+// the given one.
+func withNode(nodes []*hashnode, i int, n *hashnode) []*hashnode {
+	newNodes := make([]*hashnode, len(nodes))
+	copy(newNodes, nodes)
+	newNodes[i] = n
+	return newNodes
 }
 
-// Swap implements the sort interface.
-// This function is unsafe and needs a mutex lock before being used
-func (h *Hashring) Swap(i, j int) {
-	h.hashnodes[i], h.hashnodes[j] = h.hashnodes[j], h.hashnodes[i]
+// withInserted returns a copy of the nodes with the given node inserted in
+// order of its hash key.
+func withInserted(nodes []*hashnode, n *hashnode) []*hashnode {
+	i := sort.Search(len(nodes), func(i int) bool {
+		return nodes[i].hashkey >= n.hashkey
+	})
+	newNodes := make([]*hashnode, 0, len(nodes)+1)
+	newNodes = append(newNodes, nodes[:i]...)
+	newNodes = append(newNodes, n)
+	return append(newNodes, nodes[i:]...)
+}
+
+// withRemoved returns a copy of the nodes without the node at index i.
+func withRemoved(nodes []*hashnode, i int) []*hashnode {
+	newNodes := make([]*hashnode, 0, len(nodes)-1)
+	newNodes = append(newNodes, nodes[:i]...)
+	return append(newNodes, nodes[i+1:]...)
 }
 
 // ApplyDiff applies the given ResourceDiff to the hashring.  New resources are
 // added, changed resources are updated, and gone resources are removed.
+//
+// The whole diff is applied in a single write: the hashring is copied and
+// sorted once, instead of once per resource, so the initial diff of a
+// distributor with tens of thousands of resources doesn't take quadratic
+// time.
 func (h *Hashring) ApplyDiff(d *ResourceDiff) {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	s := h.load()
+	now := time.Now().UTC()
+	nodes := make([]*hashnode, len(s.hashnodes))
+	copy(nodes, s.hashnodes)
+	index := make(map[Hashkey]int, len(nodes))
+	for i, n := range nodes {
+		index[n.hashkey] = i
+	}
+
+	sorted := true
+	insert := func(r Resource) {
+		s.maybeTestResource(r)
+		index[r.Uid()] = len(nodes)
+		nodes = append(nodes, NewHashnode(r.Uid(), r))
+		sorted = false
+	}
 
 	for rType, resources := range d.New {
 		log.Printf("Adding %d resources of type %s.", len(resources), rType)
 		for _, r := range resources {
-			h.Add(r)
+			if i, exists := index[r.Uid()]; exists {
+				nodes[i].lastUpdate = now
+				continue
+			}
+			insert(r)
 		}
 	}
 	for rType, resources := range d.Changed {
 		log.Printf("Changing %d resources of type %s.", len(resources), rType)
 		for _, r := range resources {
-			h.AddOrUpdate(r)
+			i, exists := index[r.Uid()]
+			if !exists {
+				insert(r)
+				continue
+			}
+			// The backend also sends changes that keep the object
+			// ID, e.g. new blocks, so we always take the new version.
+			s.maybeTestResource(r)
+			n := *nodes[i]
+			n.elem = r
+			n.lastUpdate = now
+			nodes[i] = &n
 		}
 	}
+	gone := make(map[Hashkey]bool)
 	for rType, resources := range d.Gone {
 		log.Printf("Removing %d resources of type %s.", len(resources), rType)
 		for _, r := range resources {
-			h.Remove(r)
+			gone[r.Uid()] = true
+		}
+	}
+
+	if len(gone) > 0 {
+		remaining := nodes[:0]
+		for _, n := range nodes {
+			if !gone[n.hashkey] {
+				remaining = append(remaining, n)
+			}
 		}
+		nodes = remaining
 	}
+	if !sorted {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].hashkey < nodes[j].hashkey })
+	}
+	h.store(nodes)
 }
 
 // Add adds the given resource to the hashring.  If the resource is already
 // present, we update its timestamp and return an error.
 func (h *Hashring) Add(r Resource) error {
-	h.Lock()
-	defer h.Unlock()
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 
+	s := h.load()
 	// Does the hashring already have the resource?
-	if i, err := h.getIndex(r.Uid()); err == nil {
-		h.hashnodes[i].lastUpdate = time.Now().UTC()
+	if i, err := s.getIndex(r.Uid()); err == nil {
+		s.hashnodes[i].lastUpdate = time.Now().UTC()
 		return errors.New("resource already present in hashring")
 	}
-	h.maybeTestResource(r)
+	s.maybeTestResource(r)
 
-	n := NewHashnode(r.Uid(), r)
-	h.hashnodes = append(h.hashnodes, n)
-	sort.Sort(h)
+	h.store(withInserted(s.hashnodes, NewHashnode(r.Uid(), r)))
 	return nil
 }
 
@@ -157,12 +307,12 @@ func (h *Hashring) Add(r Resource) error {
 //
 //   * The resource (as identified by its UID *and* OID) already exists.
 //   * The resource has been last tested before the resource's expiry.
-func (h *Hashring) maybeTestResource(r Resource) {
+func (s *ringSnapshot) maybeTestResource(r Resource) {
 
 	var oldR Resource
 	// Does the resource already exist in our hashring?
-	if i, err := h.getIndex(r.Uid()); err == nil {
-		oldR = h.hashnodes[i].elem
+	if i, err := s.getIndex(r.Uid()); err == nil {
+		oldR = s.hashnodes[i].elem
 		// And is it exactly the same as the one we're dealing with?
 		if oldR.Oid() == r.Oid() {
 			rTest := oldR.TestResult()
@@ -183,47 +333,59 @@ func (h *Hashring) maybeTestResource(r Resource) {
 // already is in the hashring, we update it if (and only if) its object ID
 // changed.
 func (h *Hashring) AddOrUpdate(r Resource) (event int) {
-	h.Lock()
-	defer h.Unlock()
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 
 	event = ResourceUnchanged
-	h.maybeTestResource(r)
+	s := h.load()
+	s.maybeTestResource(r)
 	// Does the hashring already have the resource?
-	if i, err := h.getIndex(r.Uid()); err == nil {
-		h.hashnodes[i].lastUpdate = time.Now().UTC()
+	if i, err := s.getIndex(r.Uid()); err == nil {
+		s.hashnodes[i].lastUpdate = time.Now().UTC()
 		// If so, we only update it if its object ID changed.
-		if h.hashnodes[i].elem.Oid() != r.Oid() {
-			h.hashnodes[i].elem = r
+		if s.hashnodes[i].elem.Oid() != r.Oid() {
+			n := *s.hashnodes[i]
+			n.elem = r
+			h.store(withNode(s.hashnodes, i, &n))
 			event = ResourceChanged
 		}
 	} else {
-		n := NewHashnode(r.Uid(), r)
-		h.hashnodes = append(h.hashnodes, n)
-		sort.Sort(h)
+		h.store(withInserted(s.hashnodes, NewHashnode(r.Uid(), r)))
 		event = ResourceIsNew
 	}
 	return
 }
 
+// Update replaces the resource in the hashring that has the same unique ID as
+// the given resource.  If there is no such resource, an error is returned.
+func (h *Hashring) Update(r Resource) error {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	s := h.load()
+	i, err := s.getIndex(r.Uid())
+	if err != nil {
+		return err
+	}
+	n := *s.hashnodes[i]
+	n.elem = r
+	n.lastUpdate = time.Now().UTC()
+	h.store(withNode(s.hashnodes, i, &n))
+	return nil
+}
+
 // Remove removes the given resource from the hashring.  If the hashring is
 // empty or we cannot find the key, an error is returned.
 func (h *Hashring) Remove(r Resource) error {
-	h.Lock()
-	defer h.Unlock()
-	return h.remove(r)
-}
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 
-// remove without locking the mutex
-func (h *Hashring) remove(r Resource) error {
-	i, err := h.getIndex(r.Uid())
+	s := h.load()
+	i, err := s.getIndex(r.Uid())
 	if err != nil {
 		return err
 	}
-
-	leftPart := h.hashnodes[:i]
-	rightPart := h.hashnodes[i+1:]
-	h.hashnodes = append(leftPart, rightPart...)
-
+	h.store(withRemoved(s.hashnodes, i))
 	return nil
 }
 
@@ -233,20 +395,25 @@ func (h *Hashring) remove(r Resource) error {
 // is returned *and* the returned index is set to the *next* matching element
 // in the hashring.
 func (h *Hashring) getIndex(k Hashkey) (int, error) {
+	return h.load().getIndex(k)
+}
 
-	if h.Len() == 0 {
+// getIndex behaves like Hashring.getIndex on the snapshot.
+func (s *ringSnapshot) getIndex(k Hashkey) (int, error) {
+
+	if len(s.hashnodes) == 0 {
 		return -1, errors.New("hashring is empty")
 	}
 
-	i := sort.Search(h.Len(), func(i int) bool {
-		return h.hashnodes[i].hashkey >= k
+	i := sort.Search(len(s.hashnodes), func(i int) bool {
+		return s.hashnodes[i].hashkey >= k
 	})
 
-	if i >= h.Len() {
+	if i >= len(s.hashnodes) {
 		i = 0
 	}
 
-	if i < h.Len() && h.hashnodes[i].hashkey == k {
+	if s.hashnodes[i].hashkey == k {
 		return i, nil
 	} else {
 		return i, errors.New("could not find key in hashring")
@@ -258,59 +425,87 @@ func (h *Hashring) getIndex(k Hashkey) (int, error) {
 // the given hash key, we return the element whose hash key is the closest to
 // the given hash key in descending direction.
 func (h *Hashring) Get(k Hashkey) (Resource, error) {
-	h.RLock()
-	defer h.RUnlock()
+	s := h.load()
 
-	i, err := h.getIndex(k)
+	i, err := s.getIndex(k)
 	if err != nil && i == -1 {
 		return nil, err
 	}
-	return h.hashnodes[i].elem, nil
+	return s.hashnodes[i].elem, nil
 }
 
 // GetExact attempts to retrieve the element identified by the given hash key.
 // If we cannot find the element, an error is returned.
 func (h *Hashring) GetExact(k Hashkey) (Resource, error) {
-	h.RLock()
-	defer h.RUnlock()
+	s := h.load()
 
-	i, err := h.getIndex(k)
+	i, err := s.getIndex(k)
 	if err != nil {
 		return nil, err
 	}
-	return h.hashnodes[i].elem, nil
+	return s.hashnodes[i].elem, nil
 }
 
 // GetMany behaves like Get with the exception that it attempts to return the
 // given number of elements.  If the number of desired elements exceeds the
 // number of elements in the hashring, an error is returned.
 func (h *Hashring) GetMany(k Hashkey, num int) ([]Resource, error) {
-	h.RLock()
-	defer h.RUnlock()
+	s := h.load()
+	length := len(s.hashnodes)
 
-	if num > h.Len() {
+	if num > length {
 		return nil, errors.New("requested more elements than hashring has")
 	}
 
 	var resources []Resource
-	i, err := h.getIndex(k)
+	i, err := s.getIndex(k)
 	if err != nil && i == -1 {
 		return nil, err
 	}
 
-	for j := i; j < num+i; j++ {
-		resources = append(resources, h.hashnodes[j%h.Len()].elem)
+	// Deprioritized resources are only used to fill the gaps, in the order
+	// they appear in the hashring.
+	var deprioritized []Resource
+	for j := i; j < length+i && len(resources) < num; j++ {
+		elem := s.hashnodes[j%length].elem
+		if s.deprioritized[elem.Uid()] {
+			deprioritized = append(deprioritized, elem)
+			continue
+		}
+		resources = append(resources, elem)
+	}
+	for _, elem := range deprioritized {
+		if len(resources) == num {
+			break
+		}
+		resources = append(resources, elem)
 	}
 	return resources, nil
 }
 
+// SetDeprioritized replaces the set of resources that GetMany only returns if
+// there are not enough other resources.
+func (h *Hashring) SetDeprioritized(uids []Hashkey) {
+	deprioritized := make(map[Hashkey]bool)
+	for _, uid := range uids {
+		deprioritized[uid] = true
+	}
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+	h.snapshot.Store(&ringSnapshot{hashnodes: h.nodes(), deprioritized: deprioritized})
+}
+
+// IsDeprioritized returns true if the resource with the given unique ID is
+// deprioritized.
+func (h *Hashring) IsDeprioritized(uid Hashkey) bool {
+	return h.load().deprioritized[uid]
+}
+
 // GetAll returns all of the hashring's resources.
 func (h *Hashring) GetAll() []Resource {
-	h.RLock()
-	defer h.RUnlock()
-
 	var elems []Resource
-	for _, node := range h.hashnodes {
+	for _, node := range h.nodes() {
 		elems = append(elems, node.elem)
 	}
 	return elems
@@ -319,31 +514,68 @@ func (h *Hashring) GetAll() []Resource {
 // Filter filters the resources of this hashring with the given filter function
 // and returns the remaining resources as another hashring.
 func (h *Hashring) Filter(f FilterFunc) *Hashring {
-	h.RLock()
-	defer h.RUnlock()
-
-	r := &Hashring{}
-	for _, n := range h.hashnodes {
-		if f(n.elem.(Resource)) {
-			r.Add(n.elem.(Resource))
+	s := h.load()
+
+	// The nodes are already sorted, and are copied so the writers of both
+	// hashrings don't share them.
+	var nodes []*hashnode
+	for _, n := range s.hashnodes {
+		if f(n.elem) {
+			nodes = append(nodes, NewHashnode(n.hashkey, n.elem))
 		}
 	}
+	r := &Hashring{}
+	r.snapshot.Store(&ringSnapshot{hashnodes: nodes, deprioritized: s.deprioritized})
 	return r
 }
 
+// PruneAbsent tells the hashring which resources were present in the last
+// reload of its resources.  The resources that were part of earlier reloads
+// but were missing from the last maxAbsences reloads are removed from the
+// hashring and returned.  Resources that were never part of a reload are left
+// alone.  Prune still removes the missing resources that expire before that.
+func (h *Hashring) PruneAbsent(present map[Hashkey]bool, maxAbsences int) []Resource {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	pruned := []Resource{}
+	nodes := []*hashnode{}
+	for _, node := range h.nodes() {
+		if present[node.hashkey] {
+			node.reloaded = true
+			node.absences = 0
+		} else if node.reloaded {
+			node.absences++
+			if node.absences >= maxAbsences {
+				pruned = append(pruned, node.elem)
+				continue
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	h.store(nodes)
+
+	return pruned
+}
+
 // Prune prunes and returns expired resources from the hashring.
 func (h *Hashring) Prune() []Resource {
-	h.Lock()
-	defer h.Unlock()
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 
 	now := time.Now().UTC()
 	pruned := []Resource{}
+	nodes := []*hashnode{}
 
-	for _, node := range h.hashnodes {
+	for _, node := range h.nodes() {
 		if now.Sub(node.lastUpdate) > node.elem.Expiry() {
 			pruned = append(pruned, node.elem)
-			h.remove(node.elem)
+			continue
 		}
+		nodes = append(nodes, node)
+	}
+	if len(pruned) > 0 {
+		h.store(nodes)
 	}
 
 	return pruned
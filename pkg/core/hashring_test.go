@@ -5,6 +5,10 @@
 package core
 
 import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -152,6 +156,36 @@ func TestGetMany(t *testing.T) {
 	}
 }
 
+func TestGetManyDeprioritized(t *testing.T) {
+	h := NewHashring()
+	for i := 1; i <= 4; i++ {
+		h.Add(NewDummy(Hashkey(i*5), Hashkey(i*5)))
+	}
+	h.SetDeprioritized([]Hashkey{15})
+
+	elems, err := h.GetMany(11, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elems[0].(*Dummy).UniqueId != 20 || elems[1].(*Dummy).UniqueId != 5 {
+		t.Errorf("got wrong elements: %v", elems)
+	}
+
+	// deprioritized resources fill the gaps
+	elems, err = h.GetMany(11, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 4 || elems[3].(*Dummy).UniqueId != 15 {
+		t.Errorf("got wrong elements: %v", elems)
+	}
+
+	filtered := h.Filter(func(r Resource) bool { return r.Uid() != 5 })
+	if !filtered.IsDeprioritized(15) {
+		t.Error("filtered hashring lost the deprioritized resources")
+	}
+}
+
 func TestRemove(t *testing.T) {
 	d1 := NewDummy(1, 1)
 	d2 := NewDummy(2, 2)
@@ -226,19 +260,19 @@ func TestAddOrUpdate(t *testing.T) {
 
 	// Adding an already-existing resource should update its LastUpdate.
 	i, _ := h.getIndex(d.Uid())
-	oldTimestamp := h.hashnodes[i].lastUpdate
+	oldTimestamp := h.nodes()[i].lastUpdate
 
 	h.AddOrUpdate(newD)
 
 	i, _ = h.getIndex(d.Uid())
-	newTimestamp := h.hashnodes[i].lastUpdate
+	newTimestamp := h.nodes()[i].lastUpdate
 
 	if newTimestamp == oldTimestamp {
 		t.Fatal("failed to update timestamp of hashnode")
 	}
 
 	i, _ = h.getIndex(d.Uid())
-	sameTimestamp := h.hashnodes[i].lastUpdate
+	sameTimestamp := h.nodes()[i].lastUpdate
 
 	if newTimestamp != sameTimestamp {
 		t.Fatal("timestamp should be identical")
@@ -253,7 +287,7 @@ func TestPrune(t *testing.T) {
 	h.Add(d1)
 
 	now := time.Now().UTC()
-	h.hashnodes[0].lastUpdate = now.Add(-time.Duration(time.Hour * 2))
+	h.nodes()[0].lastUpdate = now.Add(-time.Duration(time.Hour * 2))
 	if h.Len() != 1 {
 		t.Fatal("hashring has incorrect length")
 	}
@@ -279,6 +313,60 @@ func TestPrune(t *testing.T) {
 
 }
 
+func TestPruneAbsent(t *testing.T) {
+	d1 := NewDummy(1, 1)
+	d2 := NewDummy(2, 2)
+	d3 := NewDummy(3, 3)
+	h := NewHashring()
+	h.Add(d1)
+	h.Add(d2)
+	h.Add(d3)
+
+	// d3 was never part of a reload, so it's never pruned
+	present := map[Hashkey]bool{1: true, 2: true}
+	if pruned := h.PruneAbsent(present, 2); len(pruned) != 0 {
+		t.Fatalf("pruned resources present in the reload: %v", pruned)
+	}
+
+	present = map[Hashkey]bool{1: true}
+	if pruned := h.PruneAbsent(present, 2); len(pruned) != 0 {
+		t.Fatalf("pruned resources before the grace period: %v", pruned)
+	}
+	pruned := h.PruneAbsent(present, 2)
+	if len(pruned) != 1 || pruned[0].Uid() != 2 {
+		t.Fatalf("expected resource 2 to be pruned but got %v", pruned)
+	}
+	if h.Len() != 2 {
+		t.Fatalf("hashring has incorrect length %d", h.Len())
+	}
+
+	// being present again resets the count of absences
+	present = map[Hashkey]bool{}
+	h.PruneAbsent(present, 2)
+	h.PruneAbsent(map[Hashkey]bool{1: true}, 2)
+	if pruned := h.PruneAbsent(present, 2); len(pruned) != 0 {
+		t.Fatalf("absences were not reset: %v", pruned)
+	}
+	if _, err := h.GetExact(3); err != nil {
+		t.Error("pruned a resource that was never part of a reload")
+	}
+}
+
+func TestPruneAbsentExpiry(t *testing.T) {
+	d1 := NewDummy(1, 1)
+	d1.ExpiryTime = time.Hour
+	h := NewHashring()
+	h.Add(d1)
+	h.PruneAbsent(map[Hashkey]bool{1: true}, 10)
+	h.PruneAbsent(map[Hashkey]bool{}, 10)
+
+	// the grace period of the missing resources doesn't delay their expiry
+	h.nodes()[0].lastUpdate = time.Now().UTC().Add(-2 * time.Hour)
+	if pruned := h.Prune(); len(pruned) != 1 {
+		t.Errorf("a missing resource didn't expire: %v", pruned)
+	}
+}
+
 func TestMaybeTestResource(t *testing.T) {
 	numTests := 0
 	d1 := NewDummy(0, 0)
@@ -339,3 +427,98 @@ func TestMaybeTestResource(t *testing.T) {
 		t.Fatal("resource state was not set corrected by testing")
 	}
 }
+
+func TestSnapshotReads(t *testing.T) {
+	h := NewHashring()
+	for i := 0; i < 10; i++ {
+		h.Add(NewDummy(Hashkey(i), Hashkey(i)))
+	}
+
+	// readers keep working on the snapshot they got while writers change
+	// the hashring
+	resources := h.Filter(func(Resource) bool { return true })
+	done := make(chan bool)
+	go func() {
+		for i := 10; i < 100; i++ {
+			h.Add(NewDummy(Hashkey(i), Hashkey(i)))
+			h.Remove(NewDummy(Hashkey(i-10), Hashkey(i-10)))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		if r, err := h.GetMany(Hashkey(i), 5); err != nil || len(r) != 5 {
+			t.Fatalf("Failed to get resources while writing: %v", err)
+		}
+	}
+	<-done
+
+	if h.Len() != 10 {
+		t.Errorf("Expected 10 resources but got %d", h.Len())
+	}
+	if resources.Len() != 10 {
+		t.Errorf("A filtered hashring changed with its original: %d", resources.Len())
+	}
+	for i, n := range h.nodes()[1:] {
+		if h.nodes()[i].hashkey >= n.hashkey {
+			t.Fatal("Hashring is not sorted")
+		}
+	}
+}
+
+const benchmarkNumResources = 10000
+
+func newBenchmarkDiff(first, num int) *ResourceDiff {
+	diff := NewResourceDiff()
+	for i := first; i < first+num; i++ {
+		diff.New["dummy"] = append(diff.New["dummy"], NewDummy(Hashkey(i), NewHashkey(fmt.Sprint(i))))
+	}
+	return diff
+}
+
+// BenchmarkAddOneByOne adds the resources one at a time, like the diffs used
+// to be applied.
+func BenchmarkAddOneByOne(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	diff := newBenchmarkDiff(0, benchmarkNumResources)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		h := NewHashring()
+		for _, r := range diff.New["dummy"] {
+			h.Add(r)
+		}
+	}
+}
+
+// BenchmarkApplyDiff applies the initial diff of a distributor.
+func BenchmarkApplyDiff(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	diff := newBenchmarkDiff(0, benchmarkNumResources)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		NewHashring().ApplyDiff(diff)
+	}
+}
+
+// BenchmarkApplyDiffUpdate applies a diff with a tenth of the resources new,
+// changed, and gone.
+func BenchmarkApplyDiffUpdate(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	h := NewHashring()
+	h.ApplyDiff(newBenchmarkDiff(0, benchmarkNumResources))
+
+	num := benchmarkNumResources / 10
+	diff := newBenchmarkDiff(benchmarkNumResources, num)
+	existing := newBenchmarkDiff(0, 2*num).New["dummy"]
+	diff.Changed["dummy"] = existing[:num]
+	diff.Gone["dummy"] = existing[num:]
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		h.ApplyDiff(diff)
+	}
+}
@@ -6,17 +6,30 @@ package core
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"sort"
+	"sync"
 )
 
+// maxRotationAttempts is how many new generations we try for a rotated
+// resource until it maps to a different distributor.
+const maxRotationAttempts = 16
+
 // Stencil is a list of intervals that implements a "view" that can be
 // overlayed over a hashring.  Distributor-specific stencils make it easy to
 // deterministically select non-overlapping subsets of a hashring that should
 // be given to a distributor.
 type Stencil struct {
 	intervals []*Interval
+
+	// generations counts how many times each resource was rotated.  A
+	// resource is mapped to a distributor by its unique ID and its
+	// generation, so bumping the generation moves it to a (most likely)
+	// different distributor.
+	generationsLock sync.RWMutex
+	generations     map[Hashkey]uint64
 }
 
 // SplitHashring represents a hashring with a corresponding stencil.  The
@@ -135,12 +148,7 @@ func (s *Stencil) GetFilterFunc(distName string) (FilterFunc, error) {
 			return distributor == distName
 		}
 
-		// What interval does the resource's hash fall into?
-		seed := r.Uid()
-		rand.Seed(int64(seed))
-		n := rand.Intn(upperEnd + 1)
-
-		i, err := s.FindByValue(n)
+		i, err := s.findInterval(r.Uid(), s.Generation(r.Uid()), upperEnd)
 		if err != nil {
 			log.Printf("Bug: resource %q does not fall in any interval.", r.String())
 			return false
@@ -150,6 +158,101 @@ func (s *Stencil) GetFilterFunc(distName string) (FilterFunc, error) {
 	return f, nil
 }
 
+// findInterval returns the interval that the resource with the given unique
+// ID and generation falls into.
+func (s *Stencil) findInterval(uid Hashkey, generation uint64, upperEnd int) (*Interval, error) {
+	seed := uid
+	if generation != 0 {
+		seed = NewHashkey(fmt.Sprintf("%d-%d", uid, generation))
+	}
+	rand.Seed(int64(seed))
+	n := rand.Intn(upperEnd + 1)
+	return s.FindByValue(n)
+}
+
+// Owner returns the name of the distributor that the given resource maps to.
+func (s *Stencil) Owner(r Resource) (string, error) {
+	if distributor := r.Distributor(); distributor != "" {
+		return distributor, nil
+	}
+	upperEnd, err := s.GetUpperEnd()
+	if err != nil {
+		return "", err
+	}
+	i, err := s.findInterval(r.Uid(), s.Generation(r.Uid()), upperEnd)
+	if err != nil {
+		return "", err
+	}
+	return i.Name, nil
+}
+
+// Rotate bumps the generation of the given resource until it maps to a
+// different distributor, and returns the distributor it maps to now.
+// Resources with a distribution requested by their operator are not rotated.
+func (s *Stencil) Rotate(r Resource) (string, error) {
+	if distributor := r.Distributor(); distributor != "" {
+		return distributor, nil
+	}
+	upperEnd, err := s.GetUpperEnd()
+	if err != nil {
+		return "", err
+	}
+
+	uid := r.Uid()
+	generation := s.Generation(uid)
+	oldInterval, err := s.findInterval(uid, generation, upperEnd)
+	if err != nil {
+		return "", err
+	}
+	newInterval := oldInterval
+	for i := 0; i < maxRotationAttempts && newInterval.Name == oldInterval.Name; i++ {
+		generation++
+		newInterval, err = s.findInterval(uid, generation, upperEnd)
+		if err != nil {
+			return "", err
+		}
+	}
+	if newInterval.Name == oldInterval.Name {
+		return oldInterval.Name, nil
+	}
+
+	s.generationsLock.Lock()
+	defer s.generationsLock.Unlock()
+	if s.generations == nil {
+		s.generations = make(map[Hashkey]uint64)
+	}
+	s.generations[uid] = generation
+	return newInterval.Name, nil
+}
+
+// Generation returns how many times the resource with the given unique ID
+// was rotated.
+func (s *Stencil) Generation(uid Hashkey) uint64 {
+	s.generationsLock.RLock()
+	defer s.generationsLock.RUnlock()
+	return s.generations[uid]
+}
+
+// Generations returns a copy of the generations of all the rotated
+// resources.
+func (s *Stencil) Generations() map[Hashkey]uint64 {
+	s.generationsLock.RLock()
+	defer s.generationsLock.RUnlock()
+	generations := make(map[Hashkey]uint64, len(s.generations))
+	for uid, generation := range s.generations {
+		generations[uid] = generation
+	}
+	return generations
+}
+
+// SetGenerations replaces the generations of the rotated resources, e.g. with
+// the ones stored before a restart.
+func (s *Stencil) SetGenerations(generations map[Hashkey]uint64) {
+	s.generationsLock.Lock()
+	defer s.generationsLock.Unlock()
+	s.generations = generations
+}
+
 // GetForDist takes as input a distributor's name (e.g. "moat") and returns the
 // resources that are allocated for the given distributor.
 func (h *SplitHashring) GetForDist(distName string) (*Hashring, error) {
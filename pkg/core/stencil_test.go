@@ -119,3 +119,33 @@ func TestGetFitlerFuncWithDistributor(t *testing.T) {
 		}
 	}
 }
+
+func TestRotate(t *testing.T) {
+	s := BuildStencil(map[string]int{"foo": 1, "bar": 1})
+	d := NewDummy(1, 1)
+
+	owner, err := s.Owner(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOwner, err := s.Rotate(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newOwner == owner {
+		t.Errorf("Resource not rotated away from %s", owner)
+	}
+	if o, _ := s.Owner(d); o != newOwner {
+		t.Errorf("Resource owned by %s after rotating to %s", o, newOwner)
+	}
+	if s.Generation(d.Uid()) == 0 || s.Generations()[d.Uid()] != s.Generation(d.Uid()) {
+		t.Errorf("Wrong generations: %v", s.Generations())
+	}
+
+	// resources with a distribution request stay where they are
+	d.Distribution = "foo"
+	newOwner, err = s.Rotate(d)
+	if err != nil || newOwner != "foo" {
+		t.Errorf("Resource requested to be in foo rotated to %s: %v", newOwner, err)
+	}
+}
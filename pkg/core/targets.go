@@ -0,0 +1,120 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// TargetsQueryOwner asks for the distributors that own the resources
+	// of a bridge fingerprint.
+	TargetsQueryOwner = "owner"
+	// TargetsQueryCount asks for the number of resources of each type in
+	// the partition of the requesting distributor.
+	TargetsQueryCount = "count"
+)
+
+var (
+	UnknownTargetsQueryError = errors.New("unknown targets query")
+	NoFingerprintError       = errors.New("owner query without fingerprint")
+	NoResourceTypesError     = errors.New("count query without resource types")
+)
+
+// resourceStates maps the names of the resource states of a TargetsRequest to
+// the states of the resource tests.
+var resourceStates = map[string]int{
+	"untested":      StateUntested,
+	"functional":    StateFunctional,
+	"dysfunctional": StateDysfunctional,
+}
+
+// TargetsRequest represents an ad-hoc query of a distributor or of a
+// censorship measurement client to the targets endpoint of the backend, e.g.
+//
+//	{"request_origin": "moat", "query": "owner", "fingerprint": "0123..."}
+//	{"request_origin": "moat", "query": "count", "resource_types": ["obfs4"], "state": "functional"}
+type TargetsRequest struct {
+	// Name of requesting distributor.
+	RequestOrigin string `json:"request_origin"`
+	Query         string `json:"query"`
+	// Fingerprint is the fingerprint, or the hashed fingerprint, of the
+	// bridge of an owner query.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// ResourceTypes are the resource types to count, or to look the
+	// fingerprint up in.  Owner queries look in all the resource types
+	// if none are given.
+	ResourceTypes []string `json:"resource_types,omitempty"`
+	// State only counts the resources in the given state: "untested",
+	// "functional" or "dysfunctional".  All the resources are counted if
+	// it's empty.
+	State string `json:"state,omitempty"`
+}
+
+// ResourceOwner is the answer to an owner query for a single resource of the
+// bridge.
+type ResourceOwner struct {
+	Type string `json:"type"`
+	// Distributor is the name of the distributor that owns the resource,
+	// or empty if the resource type is not partitioned.
+	Distributor string `json:"distributor"`
+	State       string `json:"state"`
+}
+
+// TargetsResponse is the backend's response to a TargetsRequest.  Owners is
+// set for owner queries and Counts, which maps resource types to the number of
+// resources, for count queries.
+type TargetsResponse struct {
+	Owners []ResourceOwner `json:"owners,omitempty"`
+	Counts map[string]int  `json:"counts,omitempty"`
+}
+
+// Validate returns an error if the targets request is not a valid query.
+func (r *TargetsRequest) Validate() error {
+
+	switch r.Query {
+	case TargetsQueryOwner:
+		if r.Fingerprint == "" {
+			return NoFingerprintError
+		}
+	case TargetsQueryCount:
+		if len(r.ResourceTypes) == 0 {
+			return NoResourceTypesError
+		}
+	default:
+		return UnknownTargetsQueryError
+	}
+	if _, err := r.StateFilter(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// StateFilter returns a filter for the resources in the state of the request.
+// The filter accepts all the resources if the request has no state.
+func (r *TargetsRequest) StateFilter() (FilterFunc, error) {
+
+	if r.State == "" {
+		return func(Resource) bool { return true }, nil
+	}
+	state, exists := resourceStates[r.State]
+	if !exists {
+		return nil, fmt.Errorf("unknown resource state %q", r.State)
+	}
+	return func(res Resource) bool {
+		return res.TestResult().State == state
+	}, nil
+}
+
+// StateName returns the name of the given resource state.
+func StateName(state int) string {
+	for name, s := range resourceStates {
+		if s == state {
+			return name
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+// As returns the given resource as a T, and false if it's not a T.  Use it
+// instead of a type assertion, which panics on a resource of another type.
+func As[T Resource](r Resource) (T, bool) {
+	t, ok := r.(T)
+	return t, ok
+}
+
+// ResourcesOf returns the resources of the given slice that are Ts, in the
+// same order.  The other resources are skipped.
+func ResourcesOf[T Resource](rs []Resource) []T {
+	ts := make([]T, 0, len(rs))
+	for _, r := range rs {
+		if t, ok := As[T](r); ok {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// TypedResourceMap maps a resource type to a slice of resources of a known Go
+// type, e.g. the proxies of the Salmon distributor.
+type TypedResourceMap[T Resource] map[string][]T
+
+// MapOf returns the resources of the given map that are Ts.  The other
+// resources are skipped.
+func MapOf[T Resource](m ResourceMap) TypedResourceMap[T] {
+	typed := make(TypedResourceMap[T], len(m))
+	for rType, queue := range m {
+		typed[rType] = ResourcesOf[T](queue)
+	}
+	return typed
+}
+
+// Untyped returns the resources of the typed map as a ResourceMap.
+func (m TypedResourceMap[T]) Untyped() ResourceMap {
+	untyped := make(ResourceMap, len(m))
+	for rType, ts := range m {
+		queue := make(ResourceQueue, len(ts))
+		for i, t := range ts {
+			queue[i] = t
+		}
+		untyped[rType] = queue
+	}
+	return untyped
+}
+
+// ConvertMap returns a new map with the resources of the given map converted
+// by f, in the same order.  The given map is not modified, so it can be
+// shared, e.g. with the other receivers of a diff.
+func ConvertMap[T Resource](m ResourceMap, f func(Resource) T) TypedResourceMap[T] {
+	if m == nil {
+		return nil
+	}
+	converted := make(TypedResourceMap[T], len(m))
+	for rType, queue := range m {
+		ts := make([]T, len(queue))
+		for i, r := range queue {
+			ts[i] = f(r)
+		}
+		converted[rType] = ts
+	}
+	return converted
+}
+
+// ConvertDiff returns a new diff with the resources of the given diff
+// converted by f, in the same order.  The given diff is not modified.
+func ConvertDiff[T Resource](d *ResourceDiff, f func(Resource) T) *ResourceDiff {
+	convert := func(m ResourceMap) ResourceMap {
+		if m == nil {
+			return nil
+		}
+		return ConvertMap(m, f).Untyped()
+	}
+	return &ResourceDiff{
+		New:     convert(d.New),
+		Changed: convert(d.Changed),
+		Gone:    convert(d.Gone),
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+)
+
+// wrapper is a resource that wraps another one, like the proxies of Salmon.
+type wrapper struct {
+	Resource
+}
+
+func TestAs(t *testing.T) {
+
+	var r Resource = NewDummy(1, 1)
+	if d, ok := As[*Dummy](r); !ok || d.Uid() != 1 {
+		t.Errorf("failed to get dummy from resource")
+	}
+	if _, ok := As[*wrapper](r); ok {
+		t.Errorf("got wrapper from a dummy")
+	}
+
+	rs := []Resource{NewDummy(1, 1), &wrapper{NewDummy(2, 2)}, NewDummy(3, 3)}
+	dummies := ResourcesOf[*Dummy](rs)
+	if len(dummies) != 2 || dummies[0].Uid() != 1 || dummies[1].Uid() != 3 {
+		t.Errorf("got wrong dummies from resources: %v", dummies)
+	}
+}
+
+func TestTypedResourceMap(t *testing.T) {
+
+	m := ResourceMap{"dummy": ResourceQueue{NewDummy(1, 1), &wrapper{NewDummy(2, 2)}}}
+	typed := MapOf[*Dummy](m)
+	if len(typed["dummy"]) != 1 || typed["dummy"][0].Uid() != 1 {
+		t.Errorf("got wrong typed map: %v", typed)
+	}
+	untyped := typed.Untyped()
+	if len(untyped["dummy"]) != 1 || untyped["dummy"][0].Uid() != 1 {
+		t.Errorf("got wrong untyped map: %v", untyped)
+	}
+}
+
+func TestConvertDiff(t *testing.T) {
+
+	d1 := NewDummy(1, 1)
+	d2 := NewDummy(2, 2)
+	diff := &ResourceDiff{
+		New:     ResourceMap{"dummy": ResourceQueue{d1, d2}},
+		Changed: ResourceMap{"dummy": ResourceQueue{d2}},
+	}
+	converted := ConvertDiff(diff, func(r Resource) *wrapper { return &wrapper{r} })
+
+	if diff.New["dummy"][0] != d1 || diff.New["dummy"][1] != d2 || diff.Changed["dummy"][0] != d2 {
+		t.Errorf("converting diff modified the original diff")
+	}
+	if len(converted.New["dummy"]) != 2 || len(converted.Changed["dummy"]) != 1 {
+		t.Fatalf("got wrong converted diff: %v", converted)
+	}
+	for i, r := range converted.New["dummy"] {
+		if w, ok := As[*wrapper](r); !ok || w.Resource != diff.New["dummy"][i] {
+			t.Errorf("got wrong converted resource: %v", r)
+		}
+	}
+	if converted.Gone != nil {
+		t.Errorf("converted nil map to %v", converted.Gone)
+	}
+}
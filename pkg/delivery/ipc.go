@@ -5,11 +5,13 @@
 package delivery
 
 import (
+	"context"
+
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
 
 type Mechanism interface {
 	StartStream(*core.ResourceRequest)
 	StopStream()
-	MakeJsonRequest(interface{}, interface{}) error
+	MakeJsonRequest(context.Context, interface{}, interface{}) error
 }
@@ -7,15 +7,22 @@ package mechanisms
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
@@ -25,6 +32,23 @@ const (
 	MaxTimeBeforeRetry     = time.Hour
 )
 
+// HeartbeatInterval is how often a distributor with a resource stream sends a
+// heartbeat to the backend.
+var HeartbeatInterval = time.Minute
+
+// StateSaveInterval is how often the state of a resource stream is saved in
+// its StateDir, if it changed.
+var StateSaveInterval = time.Minute
+
+// StateRefreshInterval is how often the state of a resource stream is saved
+// again while the stream is up even if it didn't change, so its time stays
+// close to the last time it was in sync with the backend.
+var StateRefreshInterval = time.Hour
+
+// DefaultStateMaxAge is how old a cached state can be to be served at
+// startup, the expiry of the bridge descriptors.
+const DefaultStateMaxAge = 18 * time.Hour
+
 // HttpsIpcContext implements the delivery.Mechanism interface.
 type HttpsIpcContext struct {
 	apiEndpoint     string
@@ -35,6 +59,22 @@ type HttpsIpcContext struct {
 	wg              sync.WaitGroup
 	timeBeforeRetry time.Duration
 	Transport       func() *http.Transport
+	// StateDir is where the last state of the resource stream is cached,
+	// per request origin.  The cached state is served at startup until the
+	// stream of the backend catches up.  Nothing is cached if it's empty.
+	StateDir string
+	// StateMaxAge is how long ago the cached state can have been in sync
+	// with the backend to be served, DefaultStateMaxAge if it's 0.
+	StateMaxAge time.Duration
+	// Policy configures the timeout and the retries of MakeJsonRequest.
+	Policy RequestPolicy
+	// PublicKey is the key of the backend.  If it's set, the chunks of the
+	// resource stream and the responses to resource requests have to be
+	// signed with it.
+	PublicKey ed25519.PublicKey
+
+	streamingLock sync.Mutex
+	streaming     bool
 }
 
 func transport() *http.Transport {
@@ -47,16 +87,18 @@ func NewHttpsIpc(apiEndpoint string, method string, bearerToken string) *HttpsIp
 		apiEndpoint: apiEndpoint,
 		method:      method,
 		bearerToken: bearerToken,
-		Transport:   transport}
+		Transport:   transport,
+		Policy:      DefaultRequestPolicy}
 }
 
 // StartStream initates the start of the HTTP resource stream.
 func (ctx *HttpsIpcContext) StartStream(req *core.ResourceRequest) {
 	ctx.messages = req.Receiver
 	ctx.done = make(chan bool)
-	ctx.wg.Add(1)
+	ctx.wg.Add(2)
 	ctx.timeBeforeRetry = DefaultTimeBeforeRetry
 	go ctx.handleStream(req)
+	go ctx.sendHeartbeats(req.RequestOrigin)
 }
 
 // StopStream signals the HTTP resource stream to stop and waits until it's
@@ -68,27 +110,72 @@ func (ctx *HttpsIpcContext) StopStream() {
 
 // MakeJsonRequest marshalls the given request into JSON, sends it to the
 // destination that's set in the given context, and writes the resulting
-// response to the given return interface.  If an error occurs, the function
-// returns an error.
-func (ctx *HttpsIpcContext) MakeJsonRequest(req interface{}, ret interface{}) error {
+// response to the given return interface.  The request is aborted when the
+// given context is done.  Requests that fail with a transient error are sent
+// again, as configured by the Policy of the context.  If an error occurs, the
+// function returns a *RequestError.
+func (ctx *HttpsIpcContext) MakeJsonRequest(reqCtx context.Context, req interface{}, ret interface{}) error {
+
+	timeBeforeRetry := ctx.Policy.TimeBeforeRetry
+	for attempt := 0; ; attempt++ {
+		err := ctx.makeJsonRequest(reqCtx, req, ret)
+		if err == nil || !errors.Is(err, TransientRequestError) || attempt >= ctx.Policy.Retries || reqCtx.Err() != nil {
+			return err
+		}
+
+		log.Printf("Request to %s failed (%s).  Retrying in %s.", ctx.apiEndpoint, err, timeBeforeRetry)
+		select {
+		case <-time.After(timeBeforeRetry):
+		case <-reqCtx.Done():
+			return err
+		}
+		timeBeforeRetry *= 2
+		if timeBeforeRetry > MaxTimeBeforeRetry {
+			timeBeforeRetry = MaxTimeBeforeRetry
+		}
+	}
+}
+
+// makeJsonRequest is a single attempt of MakeJsonRequest.
+func (ctx *HttpsIpcContext) makeJsonRequest(reqCtx context.Context, req interface{}, ret interface{}) error {
 
-	resp, err := ctx.sendRequest(req)
+	if ctx.Policy.Timeout != 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, ctx.Policy.Timeout)
+		defer cancel()
+	}
+
+	httpReq, err := ctx.newRequest(reqCtx, ctx.method, req)
 	if err != nil {
-		return err
+		return &RequestError{Class: PermanentRequestError, Err: err}
+	}
+	nonce := NewNonce()
+	httpReq.Header.Set(NonceHeader, nonce)
+	resp, err := ctx.do(httpReq)
+	if err != nil {
+		return &RequestError{Class: TransientRequestError, Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("got HTTP status code %d", resp.StatusCode)
+		return newStatusError(resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return &RequestError{Class: TransientRequestError, StatusCode: resp.StatusCode, Err: err}
+	}
+
+	// Only the responses to resource requests are signed.
+	if resourceReq, ok := req.(*core.ResourceRequest); ok && ctx.PublicKey != nil {
+		signature := resp.Header.Get(SignatureHeader)
+		if _, err := VerifyPayload(ctx.PublicKey, SignatureContextResources, resourceReq.RequestOrigin, nonce, body, signature); err != nil {
+			return &RequestError{Class: PermanentRequestError, StatusCode: resp.StatusCode, Err: err}
+		}
 	}
 
 	if err := json.Unmarshal(body, &ret); err != nil {
-		return err
+		return &RequestError{Class: PermanentRequestError, StatusCode: resp.StatusCode, Err: err}
 	}
 
 	return nil
@@ -114,40 +201,123 @@ func (ctx *HttpsIpcContext) expBackoff() time.Duration {
 func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 
 	defer ctx.wg.Done()
+	// The stream's HTTP request is bound to streamCtx, so the connection is
+	// closed once we're told to terminate.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	retChan := make(chan error)
-	defer close(retChan)
-	incoming := make(chan []byte)
-	defer close(incoming)
+	incoming := make(chan streamChunk)
+	state := ctx.loadState(req.RequestOrigin)
+	if state != nil {
+		diff := state.diff()
+		log.Printf("Serving the cached state of the resource stream until the backend catches up.")
+		select {
+		case ctx.messages <- diff:
+		case <-ctx.done:
+			return
+		}
+	}
+	if state == nil && ctx.StateDir != "" {
+		state = newStreamState()
+	}
+	saveTicker := time.NewTicker(StateSaveInterval)
+	defer saveTicker.Stop()
+	defer ctx.saveState(req.RequestOrigin, state)
 
 	// setupConn tries to create a persistent HTTP connection to our backend.
-	// If that fails, the function continues to try again, indefinitely.  Once
-	// a connection was established, the function relays all data from the
-	// backend to the channel 'incoming'.  If the backend closes the connection
-	// on us, the function writes the error to the channel 'retChan' and
-	// returns.
+	// If that fails, the function continues to try again until we're told to
+	// terminate.  Once a connection was established, the function relays all
+	// data from the backend to the channel 'incoming'.  If the backend closes
+	// the connection on us, the function writes the error to the channel
+	// 'retChan' and returns.
 	setupConn := func() {
 		var err error
 		var resp *http.Response
+		// The backend signs the nonce into every chunk, so the chunks of
+		// another stream can't be passed off as ours.
+		var nonce string
 		for success := false; !success; success = (err == nil) {
 			log.Printf("Making HTTP request to initiate resource stream.")
-			resp, err = ctx.sendRequest(req)
+			nonce = NewNonce()
+			resp, err = ctx.sendStreamRequest(streamCtx, req, nonce)
+			if err == nil && ctx.PublicKey != nil && resp.Header.Get(StreamSignatureHeader) != SignatureAlgorithm {
+				resp.Body.Close()
+				err = MissingSignatureError
+			}
 			if err != nil {
 				log.Printf("Error making HTTP request: %s", err.Error())
 				log.Printf("Trying again in %s.", ctx.timeBeforeRetry)
-				time.Sleep(ctx.expBackoff())
+				select {
+				case <-time.After(ctx.expBackoff()):
+				case <-ctx.done:
+					return
+				}
 			}
 		}
 		defer resp.Body.Close()
 		ctx.timeBeforeRetry = DefaultTimeBeforeRetry
+		ctx.setStreaming(true)
 
-		reader := bufio.NewReader(resp.Body)
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				ctx.setStreaming(false)
+				select {
+				case retChan <- err:
+				case <-ctx.done:
+				}
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		reader := bufio.NewReader(body)
+		signed := resp.Header.Get(StreamSignatureHeader) == SignatureAlgorithm
+		// The first diff after connecting has all of our resources.
+		initial := true
+		var seq uint64
 		for {
 			line, err := reader.ReadBytes(InterMessageDelimiter)
+			data := bytes.TrimSpace(line)
+			if err == nil && signed {
+				var signature string
+				signature, data = splitChunk(data)
+				if ctx.PublicKey != nil {
+					var sig *Signature
+					sig, err = VerifyPayload(ctx.PublicKey, SignatureContextStream, req.RequestOrigin, nonce, data, signature)
+					if err == nil && sig.Seq != seq+1 {
+						err = OutOfOrderSignatureError
+					}
+					if err == nil {
+						seq = sig.Seq
+					}
+				}
+				if err != nil {
+					// We lost the diff, so we have to reconnect to get
+					// all of our resources again.
+					log.Printf("Error verifying chunk of the resource stream: %s", err)
+					select {
+					case <-time.After(ctx.expBackoff()):
+					case <-ctx.done:
+						return
+					}
+				}
+			}
 			if err != nil {
-				retChan <- err
+				ctx.setStreaming(false)
+				select {
+				case retChan <- err:
+				case <-ctx.done:
+				}
 				return
 			}
-			incoming <- bytes.TrimSpace(line)
+			select {
+			case incoming <- streamChunk{data: data, initial: initial}:
+			case <-ctx.done:
+				return
+			}
+			initial = false
 		}
 	}
 
@@ -157,7 +327,7 @@ func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 		// We got a new JSON chunk from our backend.
 		case chunk := <-incoming:
 			helper := resources.TmpResourceDiff{}
-			if err := json.Unmarshal(chunk, &helper); err != nil {
+			if err := json.Unmarshal(chunk.data, &helper); err != nil {
 				log.Printf("Error unmarshalling preliminary JSON from backend: %s", err)
 				break
 			}
@@ -166,11 +336,31 @@ func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 				log.Printf("Error unmarshalling remaining JSON from backend: %s", err)
 				break
 			}
-			ctx.messages <- diff
+			if state != nil {
+				if chunk.initial {
+					// The cached resources that the backend doesn't
+					// have anymore are gone.
+					state.replace(diff)
+				} else {
+					state.apply(diff)
+				}
+				state.synced = time.Now()
+			}
+			select {
+			case ctx.messages <- diff:
+			case <-ctx.done:
+				log.Printf("Stopping HTTP resource stream.")
+				return
+			}
 		// We lost our connection to the backend.  Let's try again.
 		case err := <-retChan:
 			log.Printf("Lost connection to backend (%s).  Retrying.", err.Error())
 			go setupConn()
+		case <-saveTicker.C:
+			if state != nil && ctx.isStreaming() {
+				state.synced = time.Now()
+			}
+			ctx.saveState(req.RequestOrigin, state)
 		// We're told to terminate.
 		case <-ctx.done:
 			log.Printf("Stopping HTTP resource stream.")
@@ -179,16 +369,177 @@ func (ctx *HttpsIpcContext) handleStream(req *core.ResourceRequest) {
 	}
 }
 
+// streamChunk is a JSON chunk of the resource stream.
+type streamChunk struct {
+	data []byte
+	// initial is set for the first chunk after connecting to the backend
+	initial bool
+}
+
+// cachedState is the state of a resource stream as it's cached, with the last
+// time it was in sync with the backend.
+type cachedState struct {
+	Synced    time.Time          `json:"synced"`
+	Resources *core.ResourceDiff `json:"resources"`
+}
+
+// loadState returns the cached state of the resource stream of the given
+// request origin, or nil if there is none or it's older than StateMaxAge.
+func (ctx *HttpsIpcContext) loadState(origin string) *streamState {
+	if ctx.StateDir == "" {
+		return nil
+	}
+
+	var helper struct {
+		Synced    time.Time                 `json:"synced"`
+		Resources resources.TmpResourceDiff `json:"resources"`
+	}
+	if err := pjson.New(origin, ctx.StateDir).Load(&helper); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error loading the cached state of the resource stream: %s", err)
+		}
+		return nil
+	}
+	maxAge := ctx.StateMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultStateMaxAge
+	}
+	if age := time.Since(helper.Synced); age > maxAge {
+		log.Printf("Ignoring the cached state of the resource stream, it was in sync with the backend %s ago.", age.Round(time.Second))
+		return nil
+	}
+	diff, err := resources.UnmarshalTmpResourceDiff(&helper.Resources)
+	if err != nil {
+		log.Printf("Error unmarshalling the cached state of the resource stream: %s", err)
+		return nil
+	}
+	state := newStreamState()
+	state.apply(diff)
+	state.dirty = false
+	state.synced = helper.Synced
+	state.saved = helper.Synced
+	return state
+}
+
+// saveState caches the state of the resource stream of the given request
+// origin, if it changed or it's StateRefreshInterval newer than the cached
+// one.
+func (ctx *HttpsIpcContext) saveState(origin string, state *streamState) {
+	if state == nil || (!state.dirty && state.synced.Sub(state.saved) < StateRefreshInterval) {
+		return
+	}
+	cached := cachedState{Synced: state.synced, Resources: state.diff()}
+	if err := pjson.New(origin, ctx.StateDir).Save(cached); err != nil {
+		log.Printf("Error caching the state of the resource stream: %s", err)
+		return
+	}
+	state.dirty = false
+	state.saved = state.synced
+}
+
+func (ctx *HttpsIpcContext) setStreaming(streaming bool) {
+	ctx.streamingLock.Lock()
+	defer ctx.streamingLock.Unlock()
+	ctx.streaming = streaming
+}
+
+func (ctx *HttpsIpcContext) isStreaming() bool {
+	ctx.streamingLock.Lock()
+	defer ctx.streamingLock.Unlock()
+	return ctx.streaming
+}
+
+// sendHeartbeats posts a heartbeat to the resource stream endpoint every
+// HeartbeatInterval, until we're told to terminate.  The backend tracks the
+// liveness of the distributors with them, and finds out about the streams
+// that it lost but the distributor believes are still up.
+func (ctx *HttpsIpcContext) sendHeartbeats(distName string) {
+
+	defer ctx.wg.Done()
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.done:
+			return
+		}
+
+		heartbeat := &core.Heartbeat{RequestOrigin: distName, Streaming: ctx.isStreaming()}
+		err := ctx.sendHeartbeat(heartbeat)
+		// Only log when the heartbeats start or stop failing, to not flood
+		// the logs while the backend is down.
+		if err != nil && !failing {
+			log.Printf("Error sending heartbeat to backend: %s", err)
+		} else if err == nil && failing {
+			log.Printf("Sending heartbeats to backend again.")
+		}
+		failing = err != nil
+	}
+}
+
+func (ctx *HttpsIpcContext) sendHeartbeat(heartbeat *core.Heartbeat) error {
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), HeartbeatInterval)
+	defer cancel()
+	resp, err := ctx.sendRequestWithMethod(reqCtx, http.MethodPost, heartbeat)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // sendRequest marshalls the given request into JSON and sends it to the API
-// endpoint that's part of the given context.
-func (ctx *HttpsIpcContext) sendRequest(req interface{}) (*http.Response, error) {
+// endpoint that's part of the given context.  The request is bound to the
+// given request context.
+func (ctx *HttpsIpcContext) sendRequest(reqCtx context.Context, req interface{}) (*http.Response, error) {
+	return ctx.sendRequestWithMethod(reqCtx, ctx.method, req)
+}
+
+// sendStreamRequest is like sendRequest but asks the backend to compress the
+// resource stream.  The caller has to decompress the body of the response if
+// its Content-Encoding is gzip.
+func (ctx *HttpsIpcContext) sendStreamRequest(reqCtx context.Context, req interface{}, nonce string) (*http.Response, error) {
+
+	httpReq, err := ctx.newRequest(reqCtx, ctx.method, req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set(NonceHeader, nonce)
+	// Setting the header ourselves keeps the transport from decompressing
+	// the stream, so we see what the backend sent.
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	return ctx.do(httpReq)
+}
+
+// sendRequestWithMethod is like sendRequest but uses the given HTTP method
+// instead of the method of the context.
+func (ctx *HttpsIpcContext) sendRequestWithMethod(reqCtx context.Context, method string, req interface{}) (*http.Response, error) {
+
+	httpReq, err := ctx.newRequest(reqCtx, method, req)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.do(httpReq)
+}
+
+// newRequest returns an HTTP request with the given request marshalled into
+// JSON as body.
+func (ctx *HttpsIpcContext) newRequest(reqCtx context.Context, method string, req interface{}) (*http.Request, error) {
 
 	encoded, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	httpReq, err := http.NewRequest(ctx.method, ctx.apiEndpoint, bytes.NewBuffer(encoded))
+	httpReq, err := http.NewRequestWithContext(reqCtx, method, ctx.apiEndpoint, bytes.NewBuffer(encoded))
 	if err != nil {
 		return nil, err
 	}
@@ -196,6 +547,11 @@ func (ctx *HttpsIpcContext) sendRequest(req interface{}) (*http.Response, error)
 	if ctx.bearerToken != "" {
 		httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ctx.bearerToken))
 	}
+	return httpReq, nil
+}
+
+// do sends the given HTTP request with the transport of the context.
+func (ctx *HttpsIpcContext) do(httpReq *http.Request) (*http.Response, error) {
 
 	tr := ctx.Transport()
 
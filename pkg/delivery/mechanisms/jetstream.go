@@ -0,0 +1,142 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// jetStreamTimeout is how long we wait for the API of JetStream to
+	// answer.
+	jetStreamTimeout = 10 * time.Second
+	// jetStreamNameInUse is the error code of creating a stream that exists.
+	jetStreamNameInUse = 10058
+	// jetStreamNotFound is the HTTP-like code of a missing message.
+	jetStreamNotFound = 404
+)
+
+var JetStreamNoMessageError = errors.New("no such message in the JetStream stream")
+
+// JetStreamConfig is the configuration of a JetStream stream.
+type JetStreamConfig struct {
+	Name      string   `json:"name"`
+	Subjects  []string `json:"subjects"`
+	Storage   string   `json:"storage"`
+	Retention string   `json:"retention"`
+	Discard   string   `json:"discard"`
+	// MaxAge is in nanoseconds, as the API of JetStream expects it.
+	MaxAge time.Duration `json:"max_age"`
+}
+
+// JetStreamMsg is a message stored in a JetStream stream.
+type JetStreamMsg struct {
+	Subject string    `json:"subject"`
+	Seq     uint64    `json:"seq"`
+	Data    []byte    `json:"data"`
+	Time    time.Time `json:"time"`
+}
+
+// jetStreamError is the error of a response of the API of JetStream.
+type jetStreamError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+func (e *jetStreamError) Error() string {
+	return fmt.Sprintf("JetStream error %d: %s", e.ErrCode, e.Description)
+}
+
+type jetStreamResponse struct {
+	Error *jetStreamError `json:"error"`
+	// Seq is the sequence number of the acknowledgment of a publication.
+	Seq uint64 `json:"seq"`
+	// Message is the message of a get request.
+	Message *JetStreamMsg `json:"message"`
+}
+
+// jetStreamRequest sends the request to the API of JetStream and returns
+// its response, or the error that it answers.
+func (c *NatsConn) jetStreamRequest(subject string, req interface{}) (*jetStreamResponse, error) {
+	data := []byte{}
+	if req != nil {
+		var err error
+		data, err = json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	msg, err := c.Request(subject, data, jetStreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var resp jetStreamResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return nil, fmt.Errorf("malformed JetStream response: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return &resp, nil
+}
+
+// EnsureStream creates the stream, or updates its configuration if it
+// already exists.
+func (c *NatsConn) EnsureStream(cfg *JetStreamConfig) error {
+	_, err := c.jetStreamRequest("$JS.API.STREAM.CREATE."+cfg.Name, cfg)
+	var jsErr *jetStreamError
+	if errors.As(err, &jsErr) && jsErr.ErrCode == jetStreamNameInUse {
+		_, err = c.jetStreamRequest("$JS.API.STREAM.UPDATE."+cfg.Name, cfg)
+	}
+	return err
+}
+
+// PublishDurable publishes the data on a subject of a stream and waits until
+// JetStream stored it.  It returns the sequence number of the message in
+// the stream.
+func (c *NatsConn) PublishDurable(subject string, data []byte) (uint64, error) {
+	msg, err := c.Request(subject, data, jetStreamTimeout)
+	if err != nil {
+		return 0, err
+	}
+	var resp jetStreamResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return 0, fmt.Errorf("malformed JetStream acknowledgment: %w", err)
+	}
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+	return resp.Seq, nil
+}
+
+// LastStreamMsg returns the last message of the subject in the stream.
+func (c *NatsConn) LastStreamMsg(stream, subject string) (*JetStreamMsg, error) {
+	return c.getStreamMsg(stream, map[string]interface{}{"last_by_subj": subject})
+}
+
+// NextStreamMsg returns the first message of the subject in the stream whose
+// sequence number is seq or later.
+func (c *NatsConn) NextStreamMsg(stream, subject string, seq uint64) (*JetStreamMsg, error) {
+	return c.getStreamMsg(stream, map[string]interface{}{"seq": seq, "next_by_subj": subject})
+}
+
+func (c *NatsConn) getStreamMsg(stream string, req map[string]interface{}) (*JetStreamMsg, error) {
+	resp, err := c.jetStreamRequest("$JS.API.STREAM.MSG.GET."+stream, req)
+	var jsErr *jetStreamError
+	if errors.As(err, &jsErr) && jsErr.Code == jetStreamNotFound {
+		return nil, JetStreamNoMessageError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Message == nil {
+		return nil, JetStreamNoMessageError
+	}
+	return resp.Message, nil
+}
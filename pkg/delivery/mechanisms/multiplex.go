@@ -0,0 +1,114 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"context"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+)
+
+// muxBackend is one of the backends of a MultiplexIpcContext, and the
+// resource types that it owns.
+type muxBackend struct {
+	ipc           delivery.Mechanism
+	resourceTypes []string
+}
+
+// MultiplexIpcContext implements the delivery.Mechanism interface on top of
+// the mechanisms of several backends, each one owning a subset of the
+// resource types.  The resource stream subscribes to every backend that owns
+// one of the requested resource types, and merges their diffs.
+type MultiplexIpcContext struct {
+	backends []*muxBackend
+	// streams are the mechanisms of the backends whose stream we started
+	streams  []delivery.Mechanism
+	receiver chan *core.ResourceDiff
+	done     chan bool
+	wg       sync.WaitGroup
+}
+
+func NewMultiplexIpc() *MultiplexIpcContext {
+	return &MultiplexIpcContext{}
+}
+
+// AddBackend adds the mechanism of a backend that owns the given resource
+// types.  It has to be called before StartStream.
+func (ctx *MultiplexIpcContext) AddBackend(ipc delivery.Mechanism, resourceTypes []string) {
+	ctx.backends = append(ctx.backends, &muxBackend{ipc: ipc, resourceTypes: resourceTypes})
+}
+
+// StartStream initiates the resource streams of the backends that own one of
+// the requested resource types.  Each backend only gets asked for its own
+// resource types.
+func (ctx *MultiplexIpcContext) StartStream(req *core.ResourceRequest) {
+	ctx.receiver = req.Receiver
+	ctx.done = make(chan bool)
+
+	for _, backend := range ctx.backends {
+		rTypes := []string{}
+		for _, rType := range backend.resourceTypes {
+			if req.HasResourceType(rType) {
+				rTypes = append(rTypes, rType)
+			}
+		}
+		if len(rTypes) == 0 {
+			continue
+		}
+
+		backendReq := *req
+		backendReq.ResourceTypes = rTypes
+		backendReq.Receiver = make(chan *core.ResourceDiff)
+		backend.ipc.StartStream(&backendReq)
+		ctx.streams = append(ctx.streams, backend.ipc)
+
+		ctx.wg.Add(1)
+		go ctx.relay(backendReq.Receiver)
+	}
+}
+
+// relay relays the diffs of a backend to the receiver of the stream until
+// we're told to terminate.
+func (ctx *MultiplexIpcContext) relay(diffs chan *core.ResourceDiff) {
+	defer ctx.wg.Done()
+	for {
+		select {
+		case diff := <-diffs:
+			select {
+			case ctx.receiver <- diff:
+			case <-ctx.done:
+				return
+			}
+		case <-ctx.done:
+			return
+		}
+	}
+}
+
+// StopStream stops the resource streams of all the backends and waits until
+// they're done.
+func (ctx *MultiplexIpcContext) StopStream() {
+	for _, ipc := range ctx.streams {
+		ipc.StopStream()
+	}
+	ctx.streams = nil
+	close(ctx.done)
+	ctx.wg.Wait()
+}
+
+// MakeJsonRequest sends the given request to all the backends and writes the
+// response of the last one to the given return interface.  It returns the
+// first error of the backends, after trying all of them.
+func (ctx *MultiplexIpcContext) MakeJsonRequest(reqCtx context.Context, req interface{}, ret interface{}) error {
+	var firstErr error
+	for _, backend := range ctx.backends {
+		if err := backend.ipc.MakeJsonRequest(reqCtx, req, ret); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// NatsSnapshotTimeout is how long a distributor waits before it tries again
+// to catch up with the stream of its resources.
+var NatsSnapshotTimeout = 10 * time.Second
+
+var (
+	NatsRequestsUnsupportedError = errors.New("the NATS mechanism only supports resource streams")
+	streamStoppedError           = errors.New("the resource stream was stopped")
+)
+
+// NatsDiff is a message of the backend on NATS: a diff of the resources of a
+// distributor, or a snapshot with all of its resources.  The diffs of a
+// distributor are numbered, so the distributors find out when they missed
+// one.  A snapshot has the number of the last diff it includes.  The numbers
+// start again when the backend restarts, with a new epoch.  If the backend
+// has a signing key, the signature covers the diff, the epoch and the
+// number.
+type NatsDiff struct {
+	Epoch     string          `json:"epoch"`
+	Seq       uint64          `json:"seq"`
+	Diff      json.RawMessage `json:"diff"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// SignNatsDiff signs the diff, or the snapshot, of the given distributor.
+func SignNatsDiff(key ed25519.PrivateKey, distName string, natsDiff *NatsDiff, snapshot bool) {
+	context := SignatureContextNatsDiff
+	if snapshot {
+		context = SignatureContextNatsSnapshot
+	}
+	natsDiff.Signature = SignPayload(key, context, distName, natsDiff.Epoch, natsDiff.Seq, natsDiff.Diff)
+}
+
+// NatsDiffSubject returns the subject that the backend publishes the diffs
+// of the given distributor on.
+func NatsDiffSubject(prefix, distName string) string {
+	return prefix + ".diffs." + distName
+}
+
+// NatsSnapshotSubject returns the subject that the backend publishes the
+// snapshots of all the resources of the given distributor on.
+func NatsSnapshotSubject(prefix, distName string) string {
+	return prefix + ".snapshots." + distName
+}
+
+// NatsStreamName returns the name of the JetStream stream that stores the
+// diffs and the snapshots of the given distributor.  Each distributor has
+// its own stream, so the permissions of the server can keep the replays of a
+// distributor to it.
+func NatsStreamName(prefix, distName string) string {
+	return strings.ReplaceAll(prefix, ".", "_") + "_" + distName
+}
+
+// NatsInboxPrefix returns the prefix of the subjects that the given
+// distributor receives the replies of JetStream on.
+func NatsInboxPrefix(distName string) string {
+	return "_INBOX." + distName
+}
+
+// NatsIpcContext implements the delivery.Mechanism interface on top of NATS.
+// Every replica of a distributor subscribes to the subjects of the
+// distributor, and catches up with the JetStream stream of the distributor
+// when it joins or misses a diff.
+type NatsIpcContext struct {
+	// PublicKey is the key of the backend.  If it's set, the diffs and the
+	// snapshots have to be signed with it.
+	PublicKey ed25519.PublicKey
+	// MaxAge is how old the diffs and the snapshots may be, it should be
+	// the replay period of the streams.  It's not limited if it's 0.
+	MaxAge time.Duration
+
+	urls            map[string]string
+	tlsConfig       *tls.Config
+	prefix          string
+	messages        chan *core.ResourceDiff
+	done            chan bool
+	finished        chan bool
+	timeBeforeRetry time.Duration
+}
+
+// NewNatsIpc returns a NATS mechanism that connects with the URL of the
+// requesting distributor in urls, so each distributor uses its own
+// credentials.
+func NewNatsIpc(urls map[string]string, tlsConfig *tls.Config, prefix string) *NatsIpcContext {
+	return &NatsIpcContext{urls: urls, tlsConfig: tlsConfig, prefix: prefix}
+}
+
+// StartStream subscribes to the diffs of the requesting distributor.
+func (ctx *NatsIpcContext) StartStream(req *core.ResourceRequest) {
+	url, ok := ctx.urls[req.RequestOrigin]
+	if !ok || url == "" {
+		log.Fatalf("No NATS URL configured for distributor %s.", req.RequestOrigin)
+	}
+	ctx.messages = req.Receiver
+	ctx.done = make(chan bool)
+	ctx.finished = make(chan bool)
+	ctx.timeBeforeRetry = DefaultTimeBeforeRetry
+	go ctx.handleStream(url, req)
+}
+
+// StopStream stops the stream and waits until it's done.
+func (ctx *NatsIpcContext) StopStream() {
+	close(ctx.done)
+	<-ctx.finished
+}
+
+// MakeJsonRequest is not supported by NATS, the requests of the distributors
+// have to use the HTTPS mechanism.
+func (ctx *NatsIpcContext) MakeJsonRequest(reqCtx context.Context, req interface{}, ret interface{}) error {
+	return NatsRequestsUnsupportedError
+}
+
+// handleStream connects to NATS and follows the diffs of the distributor,
+// reconnecting until we're told to terminate.
+func (ctx *NatsIpcContext) handleStream(url string, req *core.ResourceRequest) {
+	defer close(ctx.finished)
+	state := newStreamState()
+	opts := &NatsOptions{TLSConfig: ctx.tlsConfig, InboxPrefix: NatsInboxPrefix(req.RequestOrigin)}
+
+	for {
+		conn, err := DialNats(url, opts)
+		if err != nil {
+			log.Printf("Error connecting to NATS: %s", err)
+			log.Printf("Trying again in %s.", ctx.timeBeforeRetry)
+			select {
+			case <-time.After(ctx.nextBackoff()):
+				continue
+			case <-ctx.done:
+				return
+			}
+		}
+		ctx.timeBeforeRetry = DefaultTimeBeforeRetry
+
+		err = ctx.follow(conn, req, state)
+		conn.Close()
+		if err == nil || err == streamStoppedError {
+			log.Printf("Stopping NATS resource stream.")
+			return
+		}
+		log.Printf("Lost connection to NATS (%s).  Retrying.", err)
+	}
+}
+
+func (ctx *NatsIpcContext) nextBackoff() time.Duration {
+	ret := ctx.timeBeforeRetry
+	ctx.timeBeforeRetry *= 2
+	if ctx.timeBeforeRetry > MaxTimeBeforeRetry {
+		ctx.timeBeforeRetry = MaxTimeBeforeRetry
+	}
+	return ret
+}
+
+// natsFollower keeps track of the diffs of a distributor that we applied.
+type natsFollower struct {
+	ctx   *NatsIpcContext
+	req   *core.ResourceRequest
+	state *streamState
+	// synced is false until we applied a snapshot, and after we missed a
+	// diff until we catch up again
+	synced bool
+	epoch  string
+	seq    uint64
+	// timestamp is when the last diff that we applied was signed
+	timestamp int64
+}
+
+// follow relays the diffs of the distributor from the given connection until
+// we're told to terminate, or returns the error of the connection.
+func (ctx *NatsIpcContext) follow(conn *NatsConn, req *core.ResourceRequest, state *streamState) error {
+	diffSubject := NatsDiffSubject(ctx.prefix, req.RequestOrigin)
+	snapshotSubject := NatsSnapshotSubject(ctx.prefix, req.RequestOrigin)
+	stream := NatsStreamName(ctx.prefix, req.RequestOrigin)
+	for _, subject := range []string{diffSubject, snapshotSubject} {
+		if err := conn.Subscribe(subject); err != nil {
+			return err
+		}
+	}
+
+	f := &natsFollower{ctx: ctx, req: req, state: state}
+	if err := f.catchUp(conn, stream, diffSubject, snapshotSubject); err != nil {
+		return err
+	}
+	timer := time.NewTimer(NatsSnapshotTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.done:
+			return nil
+		case <-conn.Closed():
+			return conn.Err()
+		case <-timer.C:
+			if !f.synced {
+				if err := f.catchUp(conn, stream, diffSubject, snapshotSubject); err != nil {
+					return err
+				}
+			}
+			timer.Reset(NatsSnapshotTimeout)
+		case msg := <-conn.Msgs():
+			var natsDiff NatsDiff
+			if err := json.Unmarshal(msg.Data, &natsDiff); err != nil {
+				log.Printf("Error unmarshalling NATS message from backend: %s", err)
+				break
+			}
+			if msg.Subject == snapshotSubject {
+				if err := f.applySnapshot(&natsDiff); err != nil {
+					return err
+				}
+				break
+			}
+			if !f.synced {
+				// we wait for a snapshot, or to catch up when the timer expires
+				break
+			}
+			inOrder, err := f.applyDiff(&natsDiff)
+			if err != nil {
+				return err
+			}
+			if !inOrder {
+				log.Printf("Missed the diffs %d to %d.  Catching up.", f.seq+1, natsDiff.Seq)
+				if err := f.catchUp(conn, stream, diffSubject, snapshotSubject); err != nil {
+					return err
+				}
+				timer.Reset(NatsSnapshotTimeout)
+			}
+		}
+	}
+}
+
+// catchUp applies the last snapshot of the stream and the diffs that the
+// stream has after it.  If the stream has no snapshot yet, or it misses a
+// diff, we are not synced and try again later.
+func (f *natsFollower) catchUp(conn *NatsConn, stream, diffSubject, snapshotSubject string) error {
+	f.synced = false
+	msg, err := conn.LastStreamMsg(stream, snapshotSubject)
+	if err == JetStreamNoMessageError {
+		log.Printf("The stream %s has no snapshot of our resources yet.  Trying again in %s.", stream, NatsSnapshotTimeout)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot NatsDiff
+	if err := json.Unmarshal(msg.Data, &snapshot); err != nil {
+		log.Printf("Error unmarshalling snapshot from the stream %s: %s", stream, err)
+		return nil
+	}
+	if err := f.applySnapshot(&snapshot); err != nil {
+		return err
+	}
+
+	for pos := msg.Seq + 1; ; {
+		msg, err := conn.NextStreamMsg(stream, diffSubject, pos)
+		if err == JetStreamNoMessageError {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos = msg.Seq + 1
+
+		var natsDiff NatsDiff
+		if err := json.Unmarshal(msg.Data, &natsDiff); err != nil {
+			log.Printf("Error unmarshalling diff from the stream %s: %s", stream, err)
+			continue
+		}
+		inOrder, err := f.applyDiff(&natsDiff)
+		if err != nil {
+			return err
+		}
+		if !inOrder {
+			log.Printf("The stream %s misses the diffs %d to %d.  Waiting for a new snapshot.", stream, f.seq+1, natsDiff.Seq)
+			f.synced = false
+			return nil
+		}
+	}
+}
+
+// applySnapshot replaces the resources with the ones of the snapshot, unless
+// we already applied the diffs that it includes.  The resources that we had
+// and the snapshot doesn't have are gone.
+func (f *natsFollower) applySnapshot(natsDiff *NatsDiff) error {
+	if f.synced && natsDiff.Epoch == f.epoch && natsDiff.Seq <= f.seq {
+		return nil
+	}
+	timestamp, err := f.verify(natsDiff, SignatureContextNatsSnapshot)
+	if err != nil {
+		log.Printf("Error verifying snapshot from backend: %s", err)
+		return nil
+	}
+	diff, err := unmarshalNatsDiff(natsDiff, f.req)
+	if err != nil {
+		log.Printf("Error unmarshalling snapshot from backend: %s", err)
+		return nil
+	}
+	f.state.replace(diff)
+	if err := f.ctx.send(diff); err != nil {
+		return err
+	}
+	f.synced = true
+	f.epoch = natsDiff.Epoch
+	f.seq = natsDiff.Seq
+	f.timestamp = timestamp
+	return nil
+}
+
+// applyDiff applies the diff if it's the next one.  It returns false if we
+// missed diffs before it, and ignores the diffs that we already applied.
+func (f *natsFollower) applyDiff(natsDiff *NatsDiff) (bool, error) {
+	if natsDiff.Epoch != f.epoch || natsDiff.Seq > f.seq+1 {
+		return false, nil
+	}
+	if natsDiff.Seq <= f.seq {
+		return true, nil
+	}
+	timestamp, err := f.verify(natsDiff, SignatureContextNatsDiff)
+	if err != nil {
+		// we'll find the gap with the next diff and catch up
+		log.Printf("Error verifying diff from backend: %s", err)
+		return true, nil
+	}
+	f.seq = natsDiff.Seq
+	f.timestamp = timestamp
+	diff, err := unmarshalNatsDiff(natsDiff, f.req)
+	if err != nil {
+		log.Printf("Error unmarshalling diff from backend: %s", err)
+		return true, nil
+	}
+	f.state.apply(diff)
+	if len(diff.New)+len(diff.Changed)+len(diff.Gone) == 0 {
+		return true, nil
+	}
+	return true, f.ctx.send(diff)
+}
+
+// send relays the diff to the receiver of the stream.  It returns an error if
+// we're told to terminate.
+func (ctx *NatsIpcContext) send(diff *core.ResourceDiff) error {
+	select {
+	case ctx.messages <- diff:
+		return nil
+	case <-ctx.done:
+		return streamStoppedError
+	}
+}
+
+// verify checks the signature of the diff if we have the key of the backend,
+// and returns when it was signed.  The diff has to be younger than MaxAge,
+// and the first diff of a new epoch can't be older than the last diff that
+// we applied, so the diffs of an earlier run of the backend can't be sent
+// again.  The numbers of the diffs take care of the order within an epoch.
+func (f *natsFollower) verify(natsDiff *NatsDiff, context string) (int64, error) {
+	if f.ctx.PublicKey == nil {
+		return 0, nil
+	}
+	sig, err := verifySignature(f.ctx.PublicKey, context, f.req.RequestOrigin, natsDiff.Epoch, natsDiff.Diff, natsDiff.Signature)
+	if err != nil {
+		return 0, err
+	}
+	if sig.Seq != natsDiff.Seq {
+		return 0, InvalidSignatureError
+	}
+	age := time.Since(sig.Time())
+	if (f.ctx.MaxAge != 0 && age > f.ctx.MaxAge+SignatureMaxAge) || age < -SignatureMaxAge {
+		return 0, StaleSignatureError
+	}
+	if natsDiff.Epoch != f.epoch && sig.Timestamp < f.timestamp {
+		return 0, OutOfOrderSignatureError
+	}
+	return sig.Timestamp, nil
+}
+
+// unmarshalNatsDiff unmarshals the diff of the given message and only keeps
+// the resource types of the request.  The backend publishes all the resource
+// types of a distributor.
+func unmarshalNatsDiff(natsDiff *NatsDiff, req *core.ResourceRequest) (*core.ResourceDiff, error) {
+	helper := resources.TmpResourceDiff{}
+	if err := json.Unmarshal(natsDiff.Diff, &helper); err != nil {
+		return nil, err
+	}
+	diff, err := resources.UnmarshalTmpResourceDiff(&helper)
+	if err != nil {
+		return nil, err
+	}
+	for _, rm := range []core.ResourceMap{diff.New, diff.Changed, diff.Gone} {
+		for rType := range rm {
+			if !req.HasResourceType(rType) {
+				delete(rm, rType)
+			}
+		}
+	}
+	return diff, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The classes of the errors of the JSON requests.  Use errors.Is to find out
+// the class of an error returned by MakeJsonRequest.
+var (
+	// AuthRequestError means that the backend didn't accept our token.
+	AuthRequestError = errors.New("authentication failed")
+	// TransientRequestError means that the request may succeed if it's
+	// sent again, e.g. because the backend was unreachable or overloaded.
+	TransientRequestError = errors.New("transient failure")
+	// PermanentRequestError means that sending the request again won't
+	// help, e.g. because the backend rejected it.
+	PermanentRequestError = errors.New("permanent failure")
+)
+
+// RequestPolicy configures the timeout and the retries of the JSON requests.
+type RequestPolicy struct {
+	// Timeout is how long each attempt of a request can take.  There is no
+	// timeout besides the one of the request context if it's 0.
+	Timeout time.Duration
+	// Retries is how many times a request that failed with a transient
+	// error is sent again.
+	Retries int
+	// TimeBeforeRetry is how long we wait before the first retry.  The time
+	// doubles with each retry.
+	TimeBeforeRetry time.Duration
+}
+
+// DefaultRequestPolicy is the policy of the JSON requests of a new
+// HttpsIpcContext.
+var DefaultRequestPolicy = RequestPolicy{
+	Timeout:         time.Minute,
+	Retries:         2,
+	TimeBeforeRetry: DefaultTimeBeforeRetry,
+}
+
+// RequestError is the error of a JSON request.  Class is one of
+// AuthRequestError, TransientRequestError and PermanentRequestError.
+type RequestError struct {
+	Class error
+	// StatusCode is the HTTP status code of the response, or 0 if we got
+	// no response.
+	StatusCode int
+	Err        error
+}
+
+func newStatusError(statusCode int) *RequestError {
+	return &RequestError{
+		Class:      statusClass(statusCode),
+		StatusCode: statusCode,
+		Err:        fmt.Errorf("got HTTP status code %d", statusCode),
+	}
+}
+
+// statusClass returns the class of the error of the given HTTP status code.
+func statusClass(statusCode int) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return AuthRequestError
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests:
+		return TransientRequestError
+	case statusCode >= 500:
+		return TransientRequestError
+	default:
+		return PermanentRequestError
+	}
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if the target is the class of the error.
+func (e *RequestError) Is(target error) bool {
+	return target == e.Class
+}
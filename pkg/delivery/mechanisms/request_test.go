@@ -0,0 +1,106 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMakeJsonRequestRetries(t *testing.T) {
+	var lock sync.Mutex
+	statusCodes := []int{}
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		statusCode := http.StatusOK
+		if len(statusCodes) != 0 {
+			statusCode = statusCodes[0]
+			statusCodes = statusCodes[1:]
+		}
+		lock.Unlock()
+
+		switch statusCode {
+		case 0:
+			// Stall until the attempt times out.
+			time.Sleep(200 * time.Millisecond)
+		case http.StatusOK:
+			fmt.Fprintln(w, `{"answer": 42}`)
+		default:
+			w.WriteHeader(statusCode)
+		}
+	}))
+	defer server.Close()
+
+	request := func(codes ...int) (int, error) {
+		lock.Lock()
+		statusCodes = codes
+		attempts = 0
+		lock.Unlock()
+
+		ipc := NewHttpsIpc(server.URL, "GET", "foo")
+		ipc.Policy = RequestPolicy{Timeout: 50 * time.Millisecond, Retries: 2, TimeBeforeRetry: time.Millisecond}
+		var resp struct {
+			Answer int `json:"answer"`
+		}
+		err := ipc.MakeJsonRequest(context.Background(), struct{}{}, &resp)
+		if err == nil && resp.Answer != 42 {
+			t.Errorf("Got the wrong answer: %d", resp.Answer)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return attempts, err
+	}
+
+	// Transient errors and timeouts are retried.
+	if attempts, err := request(http.StatusServiceUnavailable, 0); err != nil || attempts != 3 {
+		t.Errorf("Request got %d attempts and error %v instead of succeeding after 3 attempts", attempts, err)
+	}
+	attempts, err := request(http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	if !errors.Is(err, TransientRequestError) || attempts != 3 {
+		t.Errorf("Request got %d attempts and error %v instead of a transient error after 3 attempts", attempts, err)
+	}
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("The error doesn't have the status code of the last attempt: %v", err)
+	}
+
+	// The other errors are not.
+	if attempts, err := request(http.StatusUnauthorized); !errors.Is(err, AuthRequestError) || attempts != 1 {
+		t.Errorf("Request got %d attempts and error %v instead of an authentication error", attempts, err)
+	}
+	if attempts, err := request(http.StatusBadRequest); !errors.Is(err, PermanentRequestError) || attempts != 1 {
+		t.Errorf("Request got %d attempts and error %v instead of a permanent error", attempts, err)
+	}
+}
+
+func TestMakeJsonRequestCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ipc := NewHttpsIpc(server.URL, "GET", "foo")
+	ipc.Policy = RequestPolicy{Retries: 100, TimeBeforeRetry: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- ipc.MakeJsonRequest(ctx, struct{}{}, nil) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, TransientRequestError) {
+			t.Errorf("Got error %v instead of a transient error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request kept retrying after its context was done")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the signature of the body of a resources
+	// response.
+	SignatureHeader = "Rdsys-Signature"
+	// StreamSignatureHeader is set to SignatureAlgorithm in the response of
+	// a resource stream whose chunks are signed.  Each chunk starts with
+	// its signature, on a line of its own.
+	StreamSignatureHeader = "Rdsys-Stream-Signature"
+	SignatureAlgorithm    = "ed25519"
+	// NonceHeader carries the nonce of a request that the backend signs
+	// into its response.
+	NonceHeader = "Rdsys-Nonce"
+
+	// The contexts of the signatures keep a signed payload of one kind
+	// from being passed off as a payload of another kind.
+	SignatureContextStream       = "resource-stream"
+	SignatureContextResources    = "resources"
+	SignatureContextNatsDiff     = "nats-diff"
+	SignatureContextNatsSnapshot = "nats-snapshot"
+)
+
+// SignatureMaxAge is how old a signed payload of the Web API of the backend
+// may be, and how far in the future, to allow for the skew of the clocks.
+var SignatureMaxAge = 5 * time.Minute
+
+var (
+	MissingSignatureError    = errors.New("the backend did not sign its payload")
+	InvalidSignatureError    = errors.New("invalid signature of the backend's payload")
+	StaleSignatureError      = errors.New("the backend's payload was signed too long ago")
+	OutOfOrderSignatureError = errors.New("the backend's payload is out of order")
+)
+
+// Signature is the signature of a payload of the backend.  Timestamp is when
+// the payload was signed, in Unix seconds, and Seq is the number of the
+// payload in its stream, or 0 if it's not part of a stream.  Both are
+// covered by the signature, so the distributors can reject old payloads and
+// the payloads of a stream that are sent again.
+type Signature struct {
+	Timestamp int64
+	Seq       uint64
+	Value     []byte
+}
+
+// String returns the signature as we send it: the timestamp, the sequence
+// number and the base64-encoded signature, separated by spaces.
+func (sig *Signature) String() string {
+	return fmt.Sprintf("%d %d %s", sig.Timestamp, sig.Seq, base64.StdEncoding.EncodeToString(sig.Value))
+}
+
+// Time returns when the payload was signed.
+func (sig *Signature) Time() time.Time {
+	return time.Unix(sig.Timestamp, 0)
+}
+
+func parseSignature(encoded string) (*Signature, error) {
+	fields := strings.Fields(encoded)
+	if len(fields) != 3 {
+		return nil, InvalidSignatureError
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, InvalidSignatureError
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, InvalidSignatureError
+	}
+	value, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, InvalidSignatureError
+	}
+	return &Signature{Timestamp: timestamp, Seq: seq, Value: value}, nil
+}
+
+// signedMessage returns the message that is signed for the given payload.  It
+// covers the context and the request origin, so the payload of a distributor
+// can't be replayed to another one, the nonce of the request, so it can't be
+// replayed to another request, and the timestamp and the sequence number.
+func signedMessage(context, origin, nonce string, timestamp int64, seq uint64, payload []byte) []byte {
+	message := []byte(fmt.Sprintf("rdsys %s %s %s %d %d\x00", context, origin, nonce, timestamp, seq))
+	return append(message, payload...)
+}
+
+// SignPayload returns the signature of the given payload for the given
+// request origin and nonce, signed now.
+func SignPayload(key ed25519.PrivateKey, context, origin, nonce string, seq uint64, payload []byte) string {
+	sig := &Signature{Timestamp: time.Now().Unix(), Seq: seq}
+	sig.Value = ed25519.Sign(key, signedMessage(context, origin, nonce, sig.Timestamp, seq, payload))
+	return sig.String()
+}
+
+// VerifyPayload returns an error if the given signature is not the signature
+// of the payload for the given request origin and nonce, or if it's older
+// than SignatureMaxAge.  The caller checks the sequence number of the
+// returned signature.
+func VerifyPayload(key ed25519.PublicKey, context, origin, nonce string, payload []byte, signature string) (*Signature, error) {
+	sig, err := verifySignature(key, context, origin, nonce, payload, signature)
+	if err != nil {
+		return nil, err
+	}
+	if age := time.Since(sig.Time()); age > SignatureMaxAge || age < -SignatureMaxAge {
+		return nil, StaleSignatureError
+	}
+	return sig, nil
+}
+
+// verifySignature is like VerifyPayload but doesn't check the age of the
+// signature.
+func verifySignature(key ed25519.PublicKey, context, origin, nonce string, payload []byte, signature string) (*Signature, error) {
+	if signature == "" {
+		return nil, MissingSignatureError
+	}
+	sig, err := parseSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, signedMessage(context, origin, nonce, sig.Timestamp, sig.Seq, payload), sig.Value) {
+		return nil, InvalidSignatureError
+	}
+	return sig, nil
+}
+
+// SignChunk returns the given chunk of a resource stream preceded by its
+// signature line.  seq is the number of the chunk in the stream, starting
+// at 1.
+func SignChunk(key ed25519.PrivateKey, origin, nonce string, seq uint64, chunk []byte) []byte {
+	signature := SignPayload(key, SignatureContextStream, origin, nonce, seq, chunk)
+	return append([]byte(signature+"\n"), chunk...)
+}
+
+// NewNonce returns a random nonce for a request whose response is signed.
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidNonce tells if the nonce of a request can be signed: a short
+// alphanumeric string.
+func ValidNonce(nonce string) bool {
+	if len(nonce) > 64 {
+		return false
+	}
+	for _, c := range nonce {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitChunk returns the signature and the payload of a signed chunk of a
+// resource stream.
+func splitChunk(chunk []byte) (string, []byte) {
+	i := bytes.IndexByte(chunk, '\n')
+	if i < 0 {
+		return "", chunk
+	}
+	return string(bytes.TrimSpace(chunk[:i])), bytes.TrimSpace(chunk[i+1:])
+}
+
+// ParsePublicKey parses a base64-encoded Ed25519 public key.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("an Ed25519 public key has %d bytes, not %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
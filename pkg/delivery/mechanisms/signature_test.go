@@ -0,0 +1,91 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestVerifyPayload(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"new": {}}`)
+	signature := SignPayload(privateKey, SignatureContextResources, "moat", "nonce", 0, payload)
+
+	if _, err := VerifyPayload(publicKey, SignatureContextResources, "moat", "nonce", payload, signature); err != nil {
+		t.Errorf("Rejected a valid signature: %s", err)
+	}
+	for _, tc := range []struct {
+		context, origin, nonce string
+	}{
+		{SignatureContextStream, "moat", "nonce"},
+		{SignatureContextResources, "https", "nonce"},
+		{SignatureContextResources, "moat", "other"},
+	} {
+		if _, err := VerifyPayload(publicKey, tc.context, tc.origin, tc.nonce, payload, signature); err != InvalidSignatureError {
+			t.Errorf("Got the error %v instead of an invalid signature for %v", err, tc)
+		}
+	}
+
+	signOld := func(age time.Duration) string {
+		sig := &Signature{Timestamp: time.Now().Add(-age).Unix()}
+		sig.Value = ed25519.Sign(privateKey, signedMessage(SignatureContextResources, "moat", "nonce", sig.Timestamp, 0, payload))
+		return sig.String()
+	}
+	for _, age := range []time.Duration{2 * SignatureMaxAge, -2 * SignatureMaxAge} {
+		if _, err := VerifyPayload(publicKey, SignatureContextResources, "moat", "nonce", payload, signOld(age)); err != StaleSignatureError {
+			t.Errorf("Got the error %v instead of a stale signature for a payload signed %s ago", err, age)
+		}
+	}
+	if _, err := VerifyPayload(publicKey, SignatureContextResources, "moat", "nonce", payload, signOld(time.Minute)); err != nil {
+		t.Errorf("Rejected a payload signed a minute ago: %s", err)
+	}
+}
+
+func TestStreamOutOfOrder(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The backend sends the first chunk again instead of the second one.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := r.Header.Get(NonceHeader)
+		w.Header().Set(StreamSignatureHeader, SignatureAlgorithm)
+		chunk := []byte(`{"new": {}, "full_update": true}`)
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(w, "%s%c", SignChunk(privateKey, "moat", nonce, 1, chunk), InterMessageDelimiter)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ipc := NewHttpsIpc(server.URL, "GET", "foo")
+	ipc.PublicKey = publicKey
+	diffs := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{RequestOrigin: "moat", Receiver: diffs})
+	defer ipc.StopStream()
+
+	select {
+	case <-diffs:
+	case <-time.After(time.Second):
+		t.Fatal("Didn't get the first chunk of the stream")
+	}
+	select {
+	case diff := <-diffs:
+		t.Errorf("Accepted a chunk that was sent again: %v", diff)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// streamState is the full state of a resource stream, i.e. the resources
+// that the diffs of the stream add up to.
+type streamState struct {
+	resources map[string]map[core.Hashkey]core.Resource
+	// dirty is set if the state changed since it was last saved
+	dirty bool
+	// synced is the last time the state was in sync with the backend, and
+	// saved the synced time of the state last saved
+	synced time.Time
+	saved  time.Time
+}
+
+func newStreamState() *streamState {
+	return &streamState{resources: make(map[string]map[core.Hashkey]core.Resource)}
+}
+
+// apply applies the given diff to the state.
+func (s *streamState) apply(diff *core.ResourceDiff) {
+	for _, rm := range []core.ResourceMap{diff.New, diff.Changed} {
+		for rType, queue := range rm {
+			if _, exists := s.resources[rType]; !exists {
+				s.resources[rType] = make(map[core.Hashkey]core.Resource)
+			}
+			for _, r := range queue {
+				s.resources[rType][r.Uid()] = r
+			}
+		}
+	}
+	for rType, queue := range diff.Gone {
+		for _, r := range queue {
+			delete(s.resources[rType], r.Uid())
+		}
+	}
+	s.dirty = true
+}
+
+// replace makes the state the resources of the given diff, that has all the
+// resources of the stream.  The resources of the state that are not in the
+// diff are added to its gone resources.
+func (s *streamState) replace(diff *core.ResourceDiff) {
+	old := s.resources
+	s.resources = make(map[string]map[core.Hashkey]core.Resource)
+	s.apply(diff)
+
+	for rType, rs := range old {
+		for uid, r := range rs {
+			if _, exists := s.resources[rType][uid]; exists {
+				continue
+			}
+			if diff.Gone == nil {
+				diff.Gone = make(core.ResourceMap)
+			}
+			diff.Gone[rType] = append(diff.Gone[rType], r)
+		}
+	}
+}
+
+// diff returns the state as a diff of new resources.
+func (s *streamState) diff() *core.ResourceDiff {
+	diff := core.NewResourceDiff()
+	for rType, rs := range s.resources {
+		for _, r := range rs {
+			diff.New[rType] = append(diff.New[rType], r)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mechanisms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// streamOnce returns a backend that streams one diff with obfs4 resources on
+// the given ports.
+func streamOnce(ports ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			return
+		}
+		rs := []string{}
+		for _, port := range ports {
+			rs = append(rs, fmt.Sprintf(`{"type": "obfs4", "address": "1.2.3.4", "port": %d}`, port))
+		}
+		fmt.Fprintf(w, `{"new": {"obfs4": [%s]}}`+"\r", strings.Join(rs, ", "))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+}
+
+func receiveDiff(t *testing.T, diffs chan *core.ResourceDiff) *core.ResourceDiff {
+	select {
+	case diff := <-diffs:
+		return diff
+	case <-time.After(5 * time.Second):
+		t.Fatal("Got no diff from the resource stream")
+	}
+	return nil
+}
+
+func TestStreamState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(streamOnce(1, 2))
+	ipc := NewHttpsIpc(server.URL, "GET", "")
+	ipc.StateDir = dir
+	diffs := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}, Receiver: diffs})
+	if diff := receiveDiff(t, diffs); len(diff.New["obfs4"]) != 2 {
+		t.Fatalf("Wrong diff from the backend: %v", diff)
+	}
+	ipc.StopStream()
+	server.Close()
+
+	// The backend lost one of the resources while we were down.
+	server = httptest.NewServer(streamOnce(1))
+	defer server.Close()
+	ipc = NewHttpsIpc(server.URL, "GET", "")
+	ipc.StateDir = dir
+	ipc.StartStream(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}, Receiver: diffs})
+	defer ipc.StopStream()
+
+	cached := receiveDiff(t, diffs)
+	if len(cached.New["obfs4"]) != 2 {
+		t.Errorf("The cached state has %d resources instead of 2", len(cached.New["obfs4"]))
+	}
+	live := receiveDiff(t, diffs)
+	if len(live.New["obfs4"]) != 1 || len(live.Gone["obfs4"]) != 1 {
+		t.Fatalf("The initial diff of the backend doesn't replace the cached state: %v", live)
+	}
+	if live.Gone["obfs4"][0].Uid() == live.New["obfs4"][0].Uid() {
+		t.Error("The resource that the backend still has is gone")
+	}
+}
+
+func TestStreamStateMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(streamOnce(1))
+	defer server.Close()
+	ipc := NewHttpsIpc(server.URL, "GET", "")
+	ipc.StateDir = dir
+	ipc.StateMaxAge = time.Hour
+
+	helper := resources.TmpResourceDiff{}
+	err = json.Unmarshal([]byte(`{"new": {"obfs4": [{"type": "obfs4", "address": "1.2.3.4", "port": 1}, {"type": "obfs4", "address": "1.2.3.4", "port": 2}]}}`), &helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := resources.UnmarshalTmpResourceDiff(&helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newStreamState()
+	state.apply(diff)
+	state.synced = time.Now().Add(-2 * time.Hour)
+	ipc.saveState("https", state)
+	if ipc.loadState("https") != nil {
+		t.Fatal("Loaded a cached state older than the max age")
+	}
+	state.dirty = true
+	state.synced = time.Now()
+	ipc.saveState("https", state)
+	if loaded := ipc.loadState("https"); loaded == nil || len(loaded.diff().New["obfs4"]) != 2 {
+		t.Fatalf("Didn't load the recent cached state: %v", loaded)
+	}
+
+	state.dirty = true
+	state.synced = time.Now().Add(-2 * time.Hour)
+	ipc.saveState("https", state)
+	diffs := make(chan *core.ResourceDiff)
+	ipc.StartStream(&core.ResourceRequest{RequestOrigin: "https", ResourceTypes: []string{"obfs4"}, Receiver: diffs})
+	defer ipc.StopStream()
+	if diff := receiveDiff(t, diffs); len(diff.New["obfs4"]) != 1 {
+		t.Errorf("Served the old cached state instead of the diff of the backend: %v", diff)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package distributorsdk
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+const (
+	DefaultResourceStreamEndpoint = "/resource-stream"
+)
+
+var (
+	NoBridgesError = errors.New("no bridges available")
+)
+
+// Config determines how a distributor connects to the rdsys backend.
+type Config struct {
+	// Name is the name of the distributor, the backend streams the
+	// resources assigned to it.  It's also the prefix of its metrics.
+	Name string
+	// BackendAddress is the address of the backend's Web API, e.g.
+	// "127.0.0.1:7100".
+	BackendAddress string
+	// ResourceStreamEndpoint is the backend's resource stream endpoint,
+	// DefaultResourceStreamEndpoint if empty.
+	ResourceStreamEndpoint string
+	// ApiToken authenticates the distributor to the backend.
+	ApiToken string
+	// Resources are the types of resources that the distributor asks for.
+	Resources []string
+	// StorageDir is where Store keeps the persisted state, nothing is
+	// persisted if empty.
+	StorageDir string
+	// TickInterval determines how often Hooks.OnTick is called, it's never
+	// called if 0.
+	TickInterval time.Duration
+	// IPC replaces the HTTP connection to the backend if set, e.g. with a
+	// testsupport.FakeBackend in tests or with the NATS subscription of
+	// FromRdsysConfig.
+	IPC delivery.Mechanism
+}
+
+// FromRdsysConfig returns the configuration for the distributor with the
+// given name from the rdsys configuration, for the distributors that are part
+// of rdsys.  Its IPC follows the resource stream of the rdsys configuration,
+// over NATS or from the shards of the backend if they are configured.
+func FromRdsysConfig(cfg *internal.Config, name string, resources []string) Config {
+	token := cfg.Backend.ApiTokens[name]
+	return Config{
+		Name:                   name,
+		BackendAddress:         cfg.Backend.WebApi.ApiAddress,
+		ResourceStreamEndpoint: cfg.Backend.ResourceStreamEndpoint,
+		ApiToken:               token,
+		Resources:              resources,
+		IPC:                    internal.NewResourceStreamIpc(cfg, resources, token),
+	}
+}
+
+// Hooks let distributors run their own logic in the housekeeping loop.  All
+// of them are optional.  They are called from the housekeeping goroutine, so
+// they never run concurrently with each other.
+type Hooks struct {
+	// OnDiff is called with each resource diff from the backend, after
+	// applying it to the hashring.
+	OnDiff func(diff *core.ResourceDiff)
+	// OnTick is called every Config.TickInterval.
+	OnTick func()
+	// OnShutdown is called when the housekeeping loop stops.
+	OnShutdown func()
+}
+
+// Distributor implements what every distributor needs: it keeps a hashring in
+// sync with the resource stream of the backend, runs the housekeeping loop,
+// handles the shutdown, and provides persistence and metrics.  Distributors
+// plug their own logic in through Hooks.
+type Distributor struct {
+	// Ring holds the resources that the backend assigned to the
+	// distributor.
+	Ring *core.Hashring
+
+	cfg      Config
+	hooks    Hooks
+	ipc      delivery.Mechanism
+	requests *prometheus.CounterVec
+	wg       sync.WaitGroup
+	shutdown chan bool
+}
+
+// New returns a distributor for the given configuration and hooks.  Call
+// Start to start receiving resources from the backend.
+func New(cfg Config, hooks Hooks) *Distributor {
+	endpoint := cfg.ResourceStreamEndpoint
+	if endpoint == "" {
+		endpoint = DefaultResourceStreamEndpoint
+	}
+
+	ipc := cfg.IPC
+	if ipc == nil {
+		ipc = mechanisms.NewHttpsIpc("http://"+cfg.BackendAddress+endpoint, "GET", cfg.ApiToken)
+	}
+
+	return &Distributor{
+		Ring:     core.NewHashring(),
+		cfg:      cfg,
+		hooks:    hooks,
+		ipc:      ipc,
+		requests: requestsCounter(cfg.Name),
+		shutdown: make(chan bool),
+	}
+}
+
+// requestsCounter returns the counter of bridge requests of the distributor
+// with the given name.  The counter is shared by all the distributors with
+// the same name in the process.
+func requestsCounter(name string) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name + "_bridges_request_total",
+		Help: "The total number of bridge requests",
+	},
+		[]string{"status"},
+	)
+	if err := prometheus.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		log.Printf("Can't register the metrics of %s: %s", name, err)
+	}
+	return counter
+}
+
+// Start starts the resource stream and the housekeeping loop.
+func (d *Distributor) Start() {
+	log.Printf("Initialising resource stream.")
+	rStream := make(chan *core.ResourceDiff)
+	req := core.ResourceRequest{
+		RequestOrigin: d.cfg.Name,
+		ResourceTypes: d.cfg.Resources,
+		Receiver:      rStream,
+	}
+	d.ipc.StartStream(&req)
+
+	d.wg.Add(1)
+	go d.housekeeping(rStream)
+}
+
+// Stop stops the housekeeping loop and the resource stream, and waits until
+// they are done.
+func (d *Distributor) Stop() {
+	close(d.shutdown)
+	d.wg.Wait()
+}
+
+// housekeeping applies the resource diffs from the backend and calls the
+// hooks.
+func (d *Distributor) housekeeping(rStream chan *core.ResourceDiff) {
+	defer d.wg.Done()
+	defer close(rStream)
+	defer d.ipc.StopStream()
+
+	var tick <-chan time.Time
+	if d.cfg.TickInterval != 0 {
+		ticker := time.NewTicker(d.cfg.TickInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case diff := <-rStream:
+			d.Ring.ApplyDiff(diff)
+			if d.hooks.OnDiff != nil {
+				d.hooks.OnDiff(diff)
+			}
+		case <-tick:
+			if d.hooks.OnTick != nil {
+				d.hooks.OnTick()
+			}
+		case <-d.shutdown:
+			log.Printf("Shutting down housekeeping.")
+			if d.hooks.OnShutdown != nil {
+				d.hooks.OnShutdown()
+			}
+			return
+		}
+	}
+}
+
+// Store returns a persistence mechanism with the given name in the storage
+// directory, or nil if there is no storage directory configured.
+func (d *Distributor) Store(name string) persistence.Mechanism {
+	if d.cfg.StorageDir == "" {
+		return nil
+	}
+	return pjson.New(name, d.cfg.StorageDir)
+}
+
+// RecordRequest counts a bridge request with the given status, e.g. "success"
+// or "error", in the metrics.
+func (d *Distributor) RecordRequest(status string) {
+	d.requests.WithLabelValues(status).Inc()
+}
+
+// HandOut returns num resources of the hashring for the given hashkey, or all
+// of them if there are fewer, and records the request in the metrics.
+func (d *Distributor) HandOut(key core.Hashkey, num int) ([]core.Resource, error) {
+	if d.Ring.Len() == 0 {
+		d.RecordRequest("error")
+		return nil, NoBridgesError
+	}
+
+	if num > d.Ring.Len() {
+		num = d.Ring.Len()
+	}
+	resources, err := d.Ring.GetMany(key, num)
+	if err != nil {
+		d.RecordRequest("error")
+		return nil, err
+	}
+	d.RecordRequest("success")
+	return resources, nil
+}
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *Distributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in the hashring.
+func (d *Distributor) Stats() distributors.Stats {
+	return distributors.Stats{Resources: distributors.CountResources(d.Ring)}
+}
+
+// RotationPeriod returns the number of the current rotation period, for
+// periods of the given number of hours.  Distributors include it in the
+// hashkeys so the same user gets the same resources during a period.  There is
+// no rotation if hours is 0 or negative, the period is always 0.
+func RotationPeriod(hours int) int64 {
+	if hours <= 0 {
+		return 0
+	}
+	now := time.Now().Unix() / (60 * 60)
+	return now / int64(hours)
+}
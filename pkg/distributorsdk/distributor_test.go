@@ -0,0 +1,96 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package distributorsdk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+)
+
+func TestHooks(t *testing.T) {
+	diffs := make(chan *core.ResourceDiff)
+	ticks := make(chan bool, 1)
+	stopped := false
+	backend := testsupport.NewFakeBackend()
+	cfg := Config{Name: "sdktest", Resources: []string{"dummy"}, TickInterval: time.Millisecond, IPC: backend}
+	d := New(cfg, Hooks{
+		OnDiff: func(diff *core.ResourceDiff) { diffs <- diff },
+		OnTick: func() {
+			select {
+			case ticks <- true:
+			default:
+			}
+		},
+		OnShutdown: func() { stopped = true },
+	})
+	d.Start()
+
+	req, err := backend.ResourceRequest()
+	if err != nil {
+		t.Fatal("The resource stream didn't start:", err)
+	}
+	if req.RequestOrigin != "sdktest" || len(req.ResourceTypes) != 1 {
+		t.Errorf("Wrong resource request: %+v", req)
+	}
+
+	diff := testsupport.NewScript().Add(testsupport.Dummies(2)...).Diffs()[0]
+	if err := backend.Send(diff); err != nil {
+		t.Fatal("Can't send the diff:", err)
+	}
+	if <-diffs != diff {
+		t.Error("OnDiff got the wrong diff")
+	}
+	if d.Ring.Len() != 2 {
+		t.Errorf("The diff wasn't applied to the hashring: %d resources", d.Ring.Len())
+	}
+	<-ticks
+
+	d.Stop()
+	if !stopped {
+		t.Error("OnShutdown wasn't called")
+	}
+}
+
+func TestHandOut(t *testing.T) {
+	d := New(Config{Name: "sdktest"}, Hooks{})
+	if _, err := d.HandOut(0, 1); !errors.Is(err, NoBridgesError) {
+		t.Error("Expected no bridges error:", err)
+	}
+	if err := d.Healthz(); err == nil {
+		t.Error("An empty distributor is healthy")
+	}
+
+	d.Ring.Add(core.NewDummy(1, 1))
+	d.Ring.Add(core.NewDummy(2, 2))
+	resources, err := d.HandOut(0, 3)
+	if err != nil {
+		t.Fatal("Can't hand out resources:", err)
+	}
+	if len(resources) != 2 {
+		t.Errorf("Wrong number of resources: %d", len(resources))
+	}
+	if err := d.Healthz(); err != nil {
+		t.Error("Unexpected health error:", err)
+	}
+	if d.Store("test") != nil {
+		t.Error("Got a store without a storage directory")
+	}
+}
+
+func TestRotationPeriod(t *testing.T) {
+	if period := RotationPeriod(0); period != 0 {
+		t.Errorf("Expected no rotation without a period, got %d", period)
+	}
+	if period := RotationPeriod(-1); period != 0 {
+		t.Errorf("Expected no rotation with a negative period, got %d", period)
+	}
+	if period, expected := RotationPeriod(1), time.Now().Unix()/(60*60); period != expected && period != expected-1 {
+		t.Errorf("Expected the period %d, got %d", expected, period)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fetchTimeout  = 30 * time.Second
+	fileURLPrefix = "file://"
+)
+
+// BridgesFetcher fetches builtin bridge lists remembering their ETag, so we
+// don't download them again if they didn't change.
+type BridgesFetcher struct {
+	sync.Mutex
+	client *http.Client
+	cached map[string]cachedBridges
+}
+
+type cachedBridges struct {
+	etag        string
+	bridgeLines []string
+}
+
+func NewBridgesFetcher() *BridgesFetcher {
+	return &BridgesFetcher{
+		client: &http.Client{Timeout: fetchTimeout},
+		cached: make(map[string]cachedBridges),
+	}
+}
+
+// FetchBridges gets the bridge lines from url.  The url can be a local path,
+// with or without the file:// prefix.
+func (f *BridgesFetcher) FetchBridges(url string) ([]string, error) {
+	if strings.HasPrefix(url, fileURLPrefix) || strings.HasPrefix(url, "/") {
+		body, err := os.ReadFile(strings.TrimPrefix(url, fileURLPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return parseBridgeLines(body), nil
+	}
+
+	f.Lock()
+	cached, isCached := f.cached[url]
+	f.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if isCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		return cached.bridgeLines, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	bridgeLines := parseBridgeLines(body)
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		f.Lock()
+		f.cached[url] = cachedBridges{etag, bridgeLines}
+		f.Unlock()
+	}
+	return bridgeLines, nil
+}
+
+func parseBridgeLines(body []byte) []string {
+	var bridgeLines []string
+	for _, line := range strings.Split(string(bytes.TrimSpace(body)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bridgeLines = append(bridgeLines, line)
+	}
+	return bridgeLines
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+var (
+	msgBridgesTitle = &i18n.Message{
+		ID:    "BridgesTitle",
+		Other: "Tor bridges",
+	}
+	msgBridgesIntro = &i18n.Message{
+		ID:    "BridgesIntro",
+		Other: "Bridges are Tor relays that are not publicly listed, they can help you connect to Tor where it's blocked.",
+	}
+	msgBridgesTransport = &i18n.Message{
+		ID:    "BridgesTransport",
+		Other: "Type of bridges",
+	}
+	msgBridgesAnyTransport = &i18n.Message{
+		ID:    "BridgesAnyTransport",
+		Other: "Any",
+	}
+	msgBridgesGet = &i18n.Message{
+		ID:    "BridgesGet",
+		Other: "Get bridges",
+	}
+	msgBridgesYours = &i18n.Message{
+		ID:    "BridgesYours",
+		Other: "Your {{.Transport}} bridges:",
+	}
+	msgBridgesHowTo = &i18n.Message{
+		ID:    "BridgesHowTo",
+		Other: "To use them, open Tor Browser settings, go to the \"Connection\" section and click on \"Add a Bridge Manually\". Copy the lines above and paste them there.",
+	}
+	msgBridgesNone = &i18n.Message{
+		ID:    "BridgesNone",
+		Other: "There are no bridges available right now, please try again later or ask for another type of bridges.",
+	}
+)
+
+var bridgesPageTemplate = template.Must(template.New("bridges").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}" dir="{{.Dir}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: auto; padding: 1em; }
+pre { white-space: pre-wrap; word-break: break-all; background: #f2f2f2; padding: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Intro}}</p>
+<form method="get">
+<label for="transport">{{.TransportLabel}}</label>
+<select id="transport" name="transport">
+<option value="">{{.AnyTransport}}</option>
+{{range .Transports}}<option value="{{.Name}}"{{if .Selected}} selected{{end}}>{{.Name}}</option>
+{{end}}</select>
+<button type="submit">{{.GetBridges}}</button>
+</form>
+{{if .Bridges}}<h2>{{.Yours}}</h2>
+<pre dir="ltr">{{range .Bridges}}{{.}}
+{{end}}</pre>
+<p>{{.HowTo}}</p>
+{{else if .NoBridges}}<p>{{.NoBridges}}</p>
+{{end}}</body>
+</html>
+`))
+
+// BridgesPage is what the bridges page of a web frontend shows.
+type BridgesPage struct {
+	// Transports are the types of bridges the user can choose, and
+	// Transport the chosen one, any of them if it's empty
+	Transports []string
+	Transport  string
+	// Bridges are the bridge lines handed out, of the type BridgesType
+	Bridges     []string
+	BridgesType string
+	// NoBridges is true if there were no bridges to hand out
+	NoBridges bool
+}
+
+type pageTransport struct {
+	Name     string
+	Selected bool
+}
+
+type bridgesPageData struct {
+	Lang           string
+	Dir            string
+	Title          string
+	Intro          string
+	TransportLabel string
+	AnyTransport   string
+	GetBridges     string
+	Transports     []pageTransport
+	Yours          string
+	Bridges        []string
+	HowTo          string
+	NoBridges      string
+}
+
+// RequestedTransport returns the transport of the request if it's one of the
+// supported ones, or an empty string to hand out any of them.
+func RequestedTransport(r *http.Request, supported []string) string {
+	transport := r.URL.Query().Get("transport")
+	for _, t := range supported {
+		if t == transport {
+			return transport
+		}
+	}
+	return ""
+}
+
+// WriteBridgesPage renders the page in the language of the lang parameter or
+// the Accept-Language of the request.
+func (l *Locales) WriteBridgesPage(w http.ResponseWriter, r *http.Request, page BridgesPage) {
+	localizer := l.Localizer(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+	lang, dir := PageLanguage(localizer, msgBridgesTitle)
+	data := bridgesPageData{
+		Lang:           lang,
+		Dir:            dir,
+		Title:          Localize(localizer, msgBridgesTitle, nil),
+		Intro:          Localize(localizer, msgBridgesIntro, nil),
+		TransportLabel: Localize(localizer, msgBridgesTransport, nil),
+		AnyTransport:   Localize(localizer, msgBridgesAnyTransport, nil),
+		GetBridges:     Localize(localizer, msgBridgesGet, nil),
+		Bridges:        page.Bridges,
+	}
+	for _, transport := range page.Transports {
+		data.Transports = append(data.Transports, pageTransport{transport, transport == page.Transport})
+	}
+	if len(page.Bridges) != 0 {
+		data.Yours = Localize(localizer, msgBridgesYours, map[string]interface{}{"Transport": page.BridgesType})
+		data.HowTo = Localize(localizer, msgBridgesHowTo, nil)
+	} else if page.NoBridges {
+		data.NoBridges = Localize(localizer, msgBridgesNone, nil)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if page.NoBridges {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := bridgesPageTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("Error rendering the bridges page: %v", err)
+	}
+}
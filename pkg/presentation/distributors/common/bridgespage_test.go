@@ -0,0 +1,52 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBridgesPage(t *testing.T) {
+	locales, err := NewLocales(localesDir, "i2p")
+	if err != nil {
+		t.Fatal("Can't load locales:", err)
+	}
+	transports := []string{"obfs4", "vanilla"}
+
+	r := httptest.NewRequest("GET", "/?transport=vanilla&lang=es", nil)
+	page := BridgesPage{Transports: transports, Transport: RequestedTransport(r, transports)}
+	if page.Transport != "vanilla" {
+		t.Errorf("Wrong requested transport: %s", page.Transport)
+	}
+	page.Bridges = []string{"1.2.3.4:1234 0123456789ABCDEF0123456789ABCDEF01234567"}
+	page.BridgesType = "vanilla"
+
+	w := httptest.NewRecorder()
+	locales.WriteBridgesPage(w, r, page)
+	body := w.Body.String()
+	for _, expected := range []string{
+		`<html lang="es" dir="ltr">`,
+		`<option value="vanilla" selected>vanilla</option>`,
+		"Tus puentes vanilla:",
+		page.Bridges[0],
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("The page doesn't contain %q:\n%s", expected, body)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/?transport=<script>", nil)
+	if transport := RequestedTransport(r, transports); transport != "" {
+		t.Errorf("Unsupported transport accepted: %s", transport)
+	}
+	w = httptest.NewRecorder()
+	locales.WriteBridgesPage(w, r, BridgesPage{Transports: transports, NoBridges: true})
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), msgBridgesNone.Other) {
+		t.Errorf("Wrong page without bridges %d:\n%s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	// RequestTimeout determines for how long a distributor frontend waits
+	// for the distributor to answer a request.
+	RequestTimeout = 30 * time.Second
+)
+
+// RequestContext returns the context to answer the given HTTP request with.
+// It's done when the client goes away or after RequestTimeout.
+func RequestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), RequestTimeout)
+}
+
+// NewRequestContext returns the context to answer a request that doesn't come
+// over HTTP, e.g. an email or a chat message.  It's done after RequestTimeout.
+func NewRequestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), RequestTimeout)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/email"
+)
+
+// DefaultConversationTTL is how long the conversations are kept without new
+// emails if no other TTL is given.
+const DefaultConversationTTL = 24 * time.Hour
+
+// Conversation is the state of a dialogue with a sender that takes more than
+// one email, like asking to confirm a request.  State is the step of the
+// dialogue and Data what the handler needs to remember between steps.
+type Conversation struct {
+	State   string            `json:"state"`
+	Data    map[string]string `json:"data,omitempty"`
+	Updated time.Time         `json:"updated"`
+}
+
+// Conversations keeps the state of the conversations of an email distributor.
+// They are identified by the sender and the email thread, the first email of
+// the References, so a sender can have several conversations at the same
+// time.  The senders are hashed with a secret key, to not keep the email
+// addresses on disk.
+type Conversations struct {
+	sync.Mutex
+	ttl           time.Duration
+	hasher        *senderHasher
+	conversations map[core.Hashkey]*Conversation
+	store         persistence.Mechanism
+}
+
+// NewConversations creates the conversations of the email account of cfg,
+// that are stored in its StorageDir if set.  The conversations without new
+// emails for ttl are forgotten.
+func NewConversations(cfg *internal.EmailConfig, ttl time.Duration) *Conversations {
+	if ttl <= 0 {
+		ttl = DefaultConversationTTL
+	}
+	c := &Conversations{ttl: ttl, hasher: newSenderHasher(cfg)}
+	if cfg.StorageDir != "" {
+		c.store = pjson.New("conversations-"+cfg.Address, cfg.StorageDir)
+		err := c.store.Load(&c.conversations)
+		if err != nil {
+			log.Println("Can't load the email conversations:", err)
+		}
+	}
+	if c.conversations == nil {
+		c.conversations = make(map[core.Hashkey]*Conversation)
+	}
+	return c
+}
+
+// Get returns the conversation the email belongs to, if there is one.
+func (c *Conversations) Get(msg *mail.Message) (Conversation, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	conversation, ok := c.conversations[c.key(msg)]
+	if !ok || time.Since(conversation.Updated) >= c.ttl {
+		return Conversation{}, false
+	}
+	data := make(map[string]string, len(conversation.Data))
+	for k, v := range conversation.Data {
+		data[k] = v
+	}
+	return Conversation{State: conversation.State, Data: data, Updated: conversation.Updated}, true
+}
+
+// Set stores the state of the conversation the email belongs to.  The
+// replies to the email continue it.
+func (c *Conversations) Set(msg *mail.Message, conversation Conversation) {
+	c.Lock()
+	defer c.Unlock()
+
+	conversation.Updated = time.Now()
+	c.conversations[c.key(msg)] = &conversation
+	c.prune(conversation.Updated)
+	c.save()
+}
+
+// End forgets the conversation the email belongs to.
+func (c *Conversations) End(msg *mail.Message) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := c.key(msg)
+	if _, ok := c.conversations[key]; !ok {
+		return
+	}
+	delete(c.conversations, key)
+	c.save()
+}
+
+// prune forgets the expired conversations, it needs to be called with the lock
+// held.
+func (c *Conversations) prune(now time.Time) {
+	for key, conversation := range c.conversations {
+		if now.Sub(conversation.Updated) >= c.ttl {
+			delete(c.conversations, key)
+		}
+	}
+}
+
+func (c *Conversations) save() {
+	if c.store == nil {
+		return
+	}
+	err := c.store.Save(c.conversations)
+	if err != nil {
+		log.Println("Can't save the email conversations:", err)
+	}
+}
+
+// key returns the key of the normalized sender and the thread of the email.
+func (c *Conversations) key(msg *mail.Message) core.Hashkey {
+	return c.hasher.hash(email.NormalizeAddress(senderAddress(msg)) + " " + threadID(msg))
+}
+
+// threadID returns the Message-ID of the first email of the thread of msg.
+func threadID(msg *mail.Message) string {
+	for _, header := range []string{"References", "In-Reply-To", "Message-ID"} {
+		if ids := strings.Fields(msg.Header.Get(header)); len(ids) != 0 {
+			return ids[0]
+		}
+	}
+	return ""
+}
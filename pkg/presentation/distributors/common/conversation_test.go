@@ -0,0 +1,88 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func parseTestEmail(t *testing.T, raw string) *mail.Message {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestConversations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conversations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &internal.EmailConfig{Address: "test@example.com", StorageDir: dir}
+
+	var replies [][]byte
+	e := emailClient{cfg: cfg}
+	e.outbox = newOutbox(cfg.Address, func(to string, msg []byte) error {
+		replies = append(replies, msg)
+		return nil
+	}, nil, nil)
+
+	first := parseTestEmail(t, testEmail)
+	conversations := NewConversations(cfg, time.Hour)
+	conversations.Set(first, Conversation{State: "confirm", Data: map[string]string{"locale": "es"}})
+
+	// the reply to our reply continues the conversation
+	if err := e.reply(first, "confirm", "reply yes", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	e.outbox.sendDue(time.Now())
+	ourReply, err := mail.ReadMessage(bytes.NewReader(replies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ourReply.Header.Get("References") != first.Header.Get("Message-ID") || ourReply.Header.Get("Message-ID") == "" {
+		t.Fatalf("Wrong thread headers in the reply: %v", ourReply.Header)
+	}
+	answer := parseTestEmail(t, "From: Test@Example.org\r\n"+
+		"Subject: Re: confirm\r\n"+
+		"Message-ID: <answer@example.org>\r\n"+
+		"In-Reply-To: "+ourReply.Header.Get("Message-ID")+"\r\n"+
+		"References: "+ourReply.Header.Get("References")+" "+ourReply.Header.Get("Message-ID")+"\r\n"+
+		"\r\n"+
+		"yes")
+
+	conversations = NewConversations(cfg, time.Hour)
+	conversation, ok := conversations.Get(answer)
+	if !ok || conversation.State != "confirm" || conversation.Data["locale"] != "es" {
+		t.Fatalf("The conversation was not found after a restart: %v %v", ok, conversation)
+	}
+
+	other := parseTestEmail(t, strings.Replace(testEmail, "test@example.org", "other@example.org", 1))
+	if _, ok := conversations.Get(other); ok {
+		t.Error("Another sender got the conversation")
+	}
+
+	conversations.End(answer)
+	if _, ok := conversations.Get(first); ok {
+		t.Error("The conversation didn't end")
+	}
+
+	conversations = NewConversations(cfg, time.Nanosecond)
+	conversations.Set(first, Conversation{State: "confirm"})
+	time.Sleep(time.Millisecond)
+	if _, ok := conversations.Get(first); ok {
+		t.Error("The conversation didn't expire")
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDKIMSignatures is how many signatures of an email are checked, the
+	// rest are ignored
+	maxDKIMSignatures = 5
+	minRSAKeyBits     = 1024
+	dkimLookupTimeout = 10 * time.Second
+)
+
+var (
+	NoDKIMSignatureError      = errors.New("the email has no DKIM signature")
+	MalformedDKIMError        = errors.New("malformed DKIM signature")
+	UnsupportedDKIMError      = errors.New("unsupported DKIM signature")
+	ExpiredDKIMError          = errors.New("the DKIM signature expired")
+	DKIMBodyHashError         = errors.New("the body doesn't match the DKIM signature")
+	DKIMKeyError              = errors.New("can't get the DKIM key")
+	InvalidDKIMSignatureError = errors.New("invalid DKIM signature")
+
+	whitespaceRegexp   = regexp.MustCompile(`[ \t]+`)
+	signatureTagRegexp = regexp.MustCompile(`([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+)
+
+// txtLookupFunc returns the TXT records of a domain name.
+type txtLookupFunc func(ctx context.Context, name string) ([]string, error)
+
+// dkimSignature is a parsed DKIM-Signature header.
+type dkimSignature struct {
+	field       string
+	algorithm   string
+	signature   []byte
+	bodyHash    []byte
+	headerCanon string
+	bodyCanon   string
+	domain      string
+	selector    string
+	headers     []string
+}
+
+// verifyDKIM checks the DKIM signatures of the raw email and returns the
+// domains of the valid ones.  If none is valid it returns the error of the
+// last one.  Emails without a single From header are rejected, so the signed
+// From is the one that we reply to.
+func verifyDKIM(raw []byte, lookup txtLookupFunc) ([]string, error) {
+	fields, body := splitEmail(raw)
+	froms := 0
+	for _, field := range fields {
+		if strings.EqualFold(fieldName(field), "From") {
+			froms++
+		}
+	}
+	if froms != 1 {
+		return nil, MissingSenderError
+	}
+
+	var domains []string
+	err := NoDKIMSignatureError
+	checked := 0
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			continue
+		}
+		if checked == maxDKIMSignatures {
+			break
+		}
+		checked++
+
+		sig, sigErr := parseDKIMSignature(field)
+		if sigErr == nil {
+			sigErr = sig.verify(fields, body, lookup)
+		}
+		if sigErr != nil {
+			err = sigErr
+			continue
+		}
+		domains = append(domains, sig.domain)
+	}
+	if len(domains) == 0 {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// splitEmail returns the header fields of the email, with their line breaks,
+// and its body.  It uses CRLF as line ending, like the email was sent.
+func splitEmail(raw []byte) ([]string, []byte) {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+
+	header := raw
+	var body []byte
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i != -1 {
+		header = raw[:i+2]
+		body = raw[i+4:]
+	}
+
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if len(fields) != 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields, body
+}
+
+func fieldName(field string) string {
+	i := strings.Index(field, ":")
+	if i == -1 {
+		return ""
+	}
+	return strings.TrimSpace(field[:i])
+}
+
+// parseTags parses a DKIM tag list, like "v=1; a=rsa-sha256".
+func parseTags(list string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(list, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags
+}
+
+// decodeBase64 decodes a base64 tag value, that can have whitespace in it.
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, value)
+	return base64.StdEncoding.DecodeString(value)
+}
+
+func parseDKIMSignature(field string) (*dkimSignature, error) {
+	tags := parseTags(field[strings.Index(field, ":")+1:])
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("%w: version %q", UnsupportedDKIMError, tags["v"])
+	}
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return nil, fmt.Errorf("%w: missing %s=", MalformedDKIMError, tag)
+		}
+	}
+	// the part of the body that is not signed could be anything
+	if _, ok := tags["l"]; ok {
+		return nil, fmt.Errorf("%w: body length limit", UnsupportedDKIMError)
+	}
+	if x, ok := tags["x"]; ok {
+		expiration, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: x=%s", MalformedDKIMError, x)
+		}
+		if time.Unix(expiration, 0).Before(time.Now()) {
+			return nil, ExpiredDKIMError
+		}
+	}
+
+	sig := &dkimSignature{
+		field:       field,
+		algorithm:   tags["a"],
+		headerCanon: "simple",
+		bodyCanon:   "simple",
+		domain:      strings.ToLower(tags["d"]),
+		selector:    tags["s"],
+	}
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return nil, fmt.Errorf("%w: algorithm %s", UnsupportedDKIMError, sig.algorithm)
+	}
+	if c, ok := tags["c"]; ok {
+		canon := strings.SplitN(c, "/", 2)
+		sig.headerCanon = canon[0]
+		if len(canon) == 2 {
+			sig.bodyCanon = canon[1]
+		}
+	}
+	for _, canon := range []string{sig.headerCanon, sig.bodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return nil, fmt.Errorf("%w: canonicalization %s", UnsupportedDKIMError, canon)
+		}
+	}
+
+	signsFrom := false
+	for _, h := range strings.Split(tags["h"], ":") {
+		h = strings.TrimSpace(h)
+		sig.headers = append(sig.headers, h)
+		if strings.EqualFold(h, "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return nil, fmt.Errorf("%w: the From header is not signed", MalformedDKIMError)
+	}
+
+	var err error
+	sig.signature, err = decodeBase64(tags["b"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: b=: %v", MalformedDKIMError, err)
+	}
+	sig.bodyHash, err = decodeBase64(tags["bh"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bh=: %v", MalformedDKIMError, err)
+	}
+	return sig, nil
+}
+
+func (sig *dkimSignature) verify(fields []string, body []byte, lookup txtLookupFunc) error {
+	bodyHash := sha256.Sum256(canonicalBody(body, sig.bodyCanon))
+	if !bytes.Equal(bodyHash[:], sig.bodyHash) {
+		return DKIMBodyHashError
+	}
+
+	h := sha256.New()
+	// the headers are signed from the bottom up if they appear several times
+	used := make(map[int]bool)
+	for _, name := range sig.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(canonicalHeader(fields[i], sig.headerCanon)))
+			break
+		}
+	}
+	unsigned := signatureTagRegexp.ReplaceAllString(sig.field, "$1")
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(unsigned, sig.headerCanon), "\r\n")))
+	hashed := h.Sum(nil)
+
+	key, err := sig.lookupKey(lookup)
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, sig.signature) != nil {
+			return InvalidDKIMSignatureError
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hashed, sig.signature) {
+			return InvalidDKIMSignatureError
+		}
+	}
+	return nil
+}
+
+// lookupKey gets the public key of the signature from the DNS.
+func (sig *dkimSignature) lookupKey(lookup txtLookupFunc) (crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dkimLookupTimeout)
+	defer cancel()
+	name := sig.selector + "._domainkey." + sig.domain
+	records, err := lookup(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", DKIMKeyError, name, err)
+	}
+
+	err = fmt.Errorf("%w %s: no key record", DKIMKeyError, name)
+	for _, record := range records {
+		tags := parseTags(record)
+		if v, ok := tags["v"]; ok && v != "DKIM1" {
+			continue
+		}
+		if tags["p"] == "" {
+			err = fmt.Errorf("%w %s: the key is revoked", DKIMKeyError, name)
+			continue
+		}
+		keyType := tags["k"]
+		if keyType == "" {
+			keyType = "rsa"
+		}
+		if !strings.HasPrefix(sig.algorithm, keyType+"-") {
+			err = fmt.Errorf("%w %s: the key is %s", DKIMKeyError, name, keyType)
+			continue
+		}
+		data, decodeErr := decodeBase64(tags["p"])
+		if decodeErr != nil {
+			err = fmt.Errorf("%w %s: %v", DKIMKeyError, name, decodeErr)
+			continue
+		}
+
+		key, parseErr := parseDKIMKey(keyType, data)
+		if parseErr != nil {
+			err = fmt.Errorf("%w %s: %v", DKIMKeyError, name, parseErr)
+			continue
+		}
+		return key, nil
+	}
+	return nil, err
+}
+
+func parseDKIMKey(keyType string, data []byte) (crypto.PublicKey, error) {
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong size of the ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+
+	var key *rsa.PublicKey
+	pub, err := x509.ParsePKIXPublicKey(data)
+	if err == nil {
+		var ok bool
+		key, ok = pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("the key is not rsa")
+		}
+	} else {
+		key, err = x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("the key has only %d bits", key.N.BitLen())
+	}
+	return key, nil
+}
+
+// canonicalHeader returns the header field, with its line break, in the
+// canonical form.
+func canonicalHeader(field, canon string) string {
+	i := strings.Index(field, ":")
+	if canon == "simple" || i == -1 {
+		return field
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(whitespaceRegexp.ReplaceAllString(value, " "))
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody returns the body in the canonical form, without the empty lines
+// at the end.
+func canonicalBody(body []byte, canon string) []byte {
+	text := string(body)
+	if canon == "relaxed" {
+		lines := strings.Split(text, "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(whitespaceRegexp.ReplaceAllString(line, " "), " ")
+		}
+		text = strings.Join(lines, "\r\n")
+	}
+	for strings.HasSuffix(text, "\r\n") {
+		text = strings.TrimSuffix(text, "\r\n")
+	}
+	if text == "" && canon == "relaxed" {
+		return nil
+	}
+	return []byte(text + "\r\n")
+}
+
+func lookupTXT(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const (
+	dkimTestHeader = "From: Alice <alice@mail.example.org>\r\n" +
+		"To: gettor@example.com\r\n" +
+		"Subject:  windows\r\n" +
+		"\tes\r\n" +
+		"Message-ID: <0000000@localhost/>\r\n"
+	dkimTestBody = "windows  es \r\n\r\n\r\n"
+)
+
+func TestCanonicalization(t *testing.T) {
+	// the example of RFC 6376 section 3.4.5
+	fields, body := splitEmail([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if len(fields) != 2 {
+		t.Fatalf("Wrong header fields: %q", fields)
+	}
+
+	relaxed := canonicalHeader(fields[0], "relaxed") + canonicalHeader(fields[1], "relaxed")
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("Wrong relaxed header: %q", relaxed)
+	}
+	if simple := fields[0] + fields[1]; canonicalHeader(fields[0], "simple")+canonicalHeader(fields[1], "simple") != simple {
+		t.Errorf("The simple header was modified")
+	}
+	if b := string(canonicalBody(body, "relaxed")); b != " C\r\nD E\r\n" {
+		t.Errorf("Wrong relaxed body: %q", b)
+	}
+	if b := string(canonicalBody(body, "simple")); b != " C \r\nD \t E\r\n" {
+		t.Errorf("Wrong simple body: %q", b)
+	}
+	if b := canonicalBody(nil, "simple"); string(b) != "\r\n" {
+		t.Errorf("Wrong simple empty body: %q", b)
+	}
+	if b := canonicalBody(nil, "relaxed"); len(b) != 0 {
+		t.Errorf("Wrong relaxed empty body: %q", b)
+	}
+}
+
+// dkimSign returns the DKIM-Signature header for the email.
+func dkimSign(t *testing.T, key crypto.Signer, algorithm, canon, domain, header, body string) string {
+	canons := strings.Split(canon, "/")
+	bodyHash := sha256.Sum256(canonicalBody([]byte(body), canons[1]))
+	field := "DKIM-Signature: v=1; a=" + algorithm + "; c=" + canon + "; d=" + domain +
+		"; s=test;\r\n\th=from:to:subject; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b=\r\n"
+
+	h := sha256.New()
+	fields, _ := splitEmail([]byte(header))
+	for _, name := range []string{"From", "To", "Subject"} {
+		for _, f := range fields {
+			if fieldName(f) == name {
+				h.Write([]byte(canonicalHeader(f, canons[0])))
+			}
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(field, canons[0]), "\r\n")))
+
+	var sig []byte
+	var err error
+	if algorithm == "ed25519-sha256" {
+		sig, err = key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	} else {
+		sig, err = key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal("Can't sign:", err)
+	}
+	return strings.TrimSuffix(field, "\r\n") + base64.StdEncoding.EncodeToString(sig) + "\r\n"
+}
+
+func testKeys(t *testing.T) (*rsa.PrivateKey, ed25519.PrivateKey, txtLookupFunc) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string][]string{
+		"test._domainkey.mail.example.org": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"test._domainkey.example.org":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		"test._domainkey.example.net":      {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+	}
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		r, ok := records[name]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return r, nil
+	}
+	return rsaKey, edKey, lookup
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, edKey, lookup := testKeys(t)
+
+	for _, canon := range []string{"simple/simple", "relaxed/relaxed", "relaxed/simple"} {
+		sig := dkimSign(t, rsaKey, "rsa-sha256", canon, "mail.example.org", dkimTestHeader, dkimTestBody)
+		domains, err := verifyDKIM([]byte(sig+dkimTestHeader+"\r\n"+dkimTestBody), lookup)
+		if err != nil || len(domains) != 1 || domains[0] != "mail.example.org" {
+			t.Errorf("Can't verify %s rsa signature: %v %v", canon, domains, err)
+		}
+	}
+
+	sig := dkimSign(t, edKey, "ed25519-sha256", "relaxed/relaxed", "example.org", dkimTestHeader, dkimTestBody)
+	domains, err := verifyDKIM([]byte(sig+dkimTestHeader+"\r\n"+dkimTestBody), lookup)
+	if err != nil || len(domains) != 1 || domains[0] != "example.org" {
+		t.Errorf("Can't verify ed25519 signature: %v %v", domains, err)
+	}
+
+	// LF line endings, like some IMAP servers store them
+	email := strings.Replace(sig+dkimTestHeader+"\r\n"+dkimTestBody, "\r\n", "\n", -1)
+	if _, err := verifyDKIM([]byte(email), lookup); err != nil {
+		t.Errorf("Can't verify the email with LF line endings: %v", err)
+	}
+
+	tampered := strings.Replace(dkimTestHeader, "Alice", "Mallory", 1)
+	if _, err := verifyDKIM([]byte(sig+tampered+"\r\n"+dkimTestBody), lookup); !errors.Is(err, InvalidDKIMSignatureError) {
+		t.Errorf("Tampered header not detected: %v", err)
+	}
+	if _, err := verifyDKIM([]byte(sig+dkimTestHeader+"\r\nlinux"), lookup); !errors.Is(err, DKIMBodyHashError) {
+		t.Errorf("Tampered body not detected: %v", err)
+	}
+	if _, err := verifyDKIM([]byte(dkimTestHeader+"\r\n"+dkimTestBody), lookup); !errors.Is(err, NoDKIMSignatureError) {
+		t.Errorf("Missing signature not detected: %v", err)
+	}
+
+	// a From added on top of the signed one
+	added := "From: Mallory <mallory@example.com>\r\n" + sig + dkimTestHeader + "\r\n" + dkimTestBody
+	if _, err := verifyDKIM([]byte(added), lookup); !errors.Is(err, MissingSenderError) {
+		t.Errorf("Email with two From headers not rejected: %v", err)
+	}
+
+	unknown := dkimSign(t, rsaKey, "rsa-sha256", "relaxed/relaxed", "example.com", dkimTestHeader, dkimTestBody)
+	if _, err := verifyDKIM([]byte(unknown+dkimTestHeader+"\r\n"+dkimTestBody), lookup); !errors.Is(err, DKIMKeyError) {
+		t.Errorf("Missing key not detected: %v", err)
+	}
+}
+
+func TestVerifySender(t *testing.T) {
+	rsaKey, _, lookup := testKeys(t)
+	parse := func(raw string) *mail.Message {
+		email, err := mail.ReadMessage(bytes.NewReader([]byte(raw)))
+		if err != nil {
+			t.Fatal("Can't parse the email:", err)
+		}
+		return email
+	}
+
+	// mail.example.org is aligned with the organizational domain example.org
+	for _, domain := range []string{"mail.example.org", "example.net"} {
+		raw := dkimSign(t, rsaKey, "rsa-sha256", "relaxed/relaxed", domain, dkimTestHeader, dkimTestBody) + dkimTestHeader + "\r\n" + dkimTestBody
+		err := verifySender([]byte(raw), parse(raw), "", lookup)
+		if domain == "mail.example.org" && err != nil {
+			t.Errorf("Aligned DKIM signature not accepted: %v", err)
+		}
+		if domain == "example.net" && !errors.Is(err, SenderNotVerifiedError) {
+			t.Errorf("Not aligned DKIM signature accepted: %v", err)
+		}
+	}
+
+	spf := "Authentication-Results: mx.example.com; spf=pass (sender is allowed) smtp.mailfrom=bounces@example.org\r\n" +
+		"Authentication-Results: mx.example.com; spf=fail smtp.mailfrom=example.org\r\n"
+	raw := spf + dkimTestHeader + "\r\n" + dkimTestBody
+	if err := verifySender([]byte(raw), parse(raw), "mx.example.com", lookup); err != nil {
+		t.Errorf("SPF pass of our MTA not accepted: %v", err)
+	}
+	if err := verifySender([]byte(raw), parse(raw), "", lookup); !errors.Is(err, SenderNotVerifiedError) {
+		t.Errorf("SPF accepted without authserv-id: %v", err)
+	}
+	if err := verifySender([]byte(raw), parse(raw), "mx.example.net", lookup); !errors.Is(err, SenderNotVerifiedError) {
+		t.Errorf("SPF of another MTA accepted: %v", err)
+	}
+
+	raw = "From: Mallory <mallory@example.com>\r\n" + spf + dkimTestHeader + "\r\n" + dkimTestBody
+	if err := verifySender([]byte(raw), parse(raw), "mx.example.com", lookup); !errors.Is(err, MissingSenderError) {
+		t.Errorf("Email with two From headers accepted: %v", err)
+	}
+
+	forged := "Authentication-Results: mx.example.com; spf=fail smtp.mailfrom=example.org\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.org\r\n"
+	raw = forged + dkimTestHeader + "\r\n" + dkimTestBody
+	if err := verifySender([]byte(raw), parse(raw), "mx.example.com", lookup); !errors.Is(err, SenderNotVerifiedError) {
+		t.Errorf("SPF result below the one of our MTA accepted: %v", err)
+	}
+}
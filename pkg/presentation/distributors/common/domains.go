@@ -0,0 +1,75 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+var (
+	NotAllowedDomainError = errors.New("the email provider is not in the allowed domains")
+	DeniedDomainError     = errors.New("the email provider is in the denied domains")
+)
+
+// checkDomain returns an error if the provider of the address doesn't get
+// replies.  The denied domains include their subdomains, the allowed ones need
+// to match exactly, so the providers that give subdomains to their users don't
+// make it easy to get many addresses.
+func checkDomain(cfg *internal.EmailConfig, address string) error {
+	domain := addressDomain(address)
+	for _, denied := range cfg.DeniedDomains {
+		denied = strings.ToLower(denied)
+		if domain == denied || strings.HasSuffix(domain, "."+denied) {
+			return DeniedDomainError
+		}
+	}
+	if len(cfg.AllowedDomains) == 0 {
+		return nil
+	}
+	for _, allowed := range cfg.AllowedDomains {
+		if domain == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return NotAllowedDomainError
+}
+
+// bounceBody returns the reply to the senders of the providers that don't get
+// replies.
+func bounceBody(cfg *internal.EmailConfig, domain string, err error) string {
+	if errors.Is(err, DeniedDomainError) {
+		return fmt.Sprintf(deniedDomainBody, domain)
+	}
+	return fmt.Sprintf(notAllowedDomainBody, domain, emailDomainList(cfg.AllowedDomains))
+}
+
+func emailDomainList(domains []string) string {
+	list := ""
+	for _, domain := range domains {
+		list += "\t" + domain + "\n"
+	}
+	return list
+}
+
+const (
+	domainBounceSubject  = "Your email provider is not supported"
+	notAllowedDomainBody = `This is an automated email response.
+
+Sorry, we don't answer emails from %s. To make this service harder to abuse
+we only answer emails from the following email providers:
+
+%s
+Please write again from an account of one of them.
+`
+	deniedDomainBody = `This is an automated email response.
+
+Sorry, we don't answer emails from %s, as it's often used to abuse this
+service. Please write again from an account of another email provider.
+`
+)
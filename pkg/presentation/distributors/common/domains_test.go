@@ -0,0 +1,54 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestCheckDomain(t *testing.T) {
+	cfg := &internal.EmailConfig{
+		AllowedDomains: []string{"gmail.com", "Riseup.net"},
+		DeniedDomains:  []string{"example.org"},
+	}
+	for address, expected := range map[string]error{
+		"user@gmail.com":        nil,
+		"user@RISEUP.NET":       nil,
+		"user@mail.riseup.net":  NotAllowedDomainError,
+		"user@yahoo.com":        NotAllowedDomainError,
+		"user@example.org":      DeniedDomainError,
+		"user@mail.example.org": DeniedDomainError,
+		"user@notexample.org":   NotAllowedDomainError,
+		"not an address":        NotAllowedDomainError,
+	} {
+		if err := checkDomain(cfg, address); !errors.Is(err, expected) {
+			t.Errorf("Wrong result for %s: %v", address, err)
+		}
+	}
+
+	cfg.AllowedDomains = nil
+	if err := checkDomain(cfg, "user@yahoo.com"); err != nil {
+		t.Errorf("Not denied domain not allowed without allowed domains: %v", err)
+	}
+	if err := checkDomain(cfg, "user@example.org"); !errors.Is(err, DeniedDomainError) {
+		t.Errorf("Denied domain allowed without allowed domains: %v", err)
+	}
+}
+
+func TestBounceBody(t *testing.T) {
+	cfg := &internal.EmailConfig{AllowedDomains: []string{"gmail.com", "riseup.net"}}
+	body := bounceBody(cfg, "yahoo.com", NotAllowedDomainError)
+	if !strings.Contains(body, "yahoo.com") || !strings.Contains(body, "\tgmail.com\n\triseup.net\n") {
+		t.Errorf("Wrong not allowed bounce: %s", body)
+	}
+	body = bounceBody(cfg, "example.org", DeniedDomainError)
+	if !strings.Contains(body, "example.org") || strings.Contains(body, "gmail.com") {
+		t.Errorf("Wrong denied bounce: %s", body)
+	}
+}
@@ -6,7 +6,11 @@ package common
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/mail"
 	"net/smtp"
@@ -19,17 +23,43 @@ import (
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap-idle"
 	"github.com/emersion/go-imap/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
 )
 
 const (
 	durationIgnoreEmails = 24 * time.Hour
+
+	imapFirstReconnectDelay = time.Second
+	imapMaxReconnectDelay   = 5 * time.Minute
+	// imapKeepaliveInterval is how long to idle without updates before
+	// checking the connection
+	imapKeepaliveInterval = 10 * time.Minute
+)
+
+var imapConnectedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "email_imap_connected",
+	Help: "If the connection to the IMAP server is up (1) or down (0)",
+},
+	[]string{"address"},
 )
 
-type SendFunction func(subject, body string) error
+// SendFunction sends a reply.  If html is not empty the reply is sent as
+// multipart/alternative with the body as the plain text fallback.
+type SendFunction func(subject, body, html string, attachments ...Attachment) error
 type IncomingEmailHandler func(msg *mail.Message, send SendFunction) error
 
+// Attachment is a file attached to a reply.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
 type imapClient struct {
 	*client.Client
 	*idle.IdleClient
@@ -41,28 +71,45 @@ type emailClient struct {
 	dist            distributors.Distributor
 	incomingHandler IncomingEmailHandler
 	smtpAuth        *smtp.Auth
+	limiter         *replyLimiter
+	outbox          *outbox
 }
 
 func StartEmail(emailCfg *internal.EmailConfig, distCfg *internal.Config,
 	dist distributors.Distributor, incomingHandler IncomingEmailHandler) {
 
+	switch emailCfg.SenderVerification {
+	case "", SenderVerificationDrop, SenderVerificationFlag:
+	default:
+		log.Fatalf("Unknown sender verification %q, it should be %q or %q", emailCfg.SenderVerification, SenderVerificationDrop, SenderVerificationFlag)
+	}
+
 	dist.Init(distCfg)
 	smtpHost := strings.Split(emailCfg.SmtpServer, ":")[0]
 	smtpAuth := smtp.PlainAuth("", emailCfg.SmtpUsername, emailCfg.SmtpPassword, smtpHost)
-	imap, err := initImap(emailCfg)
-	if err != nil {
-		log.Fatal("Can't start the imap client: ", err)
-	}
-
 	e := emailClient{
 		cfg:             emailCfg,
-		imap:            imap,
 		dist:            dist,
 		incomingHandler: incomingHandler,
 		smtpAuth:        &smtpAuth,
+		limiter:         newReplyLimiter(emailCfg),
+	}
+	var outboxStore persistence.Mechanism
+	if emailCfg.StorageDir != "" {
+		outboxStore = pjson.New("outbox-"+emailCfg.Address, emailCfg.StorageDir)
+	}
+	e.outbox = newOutbox(emailCfg.Address, e.sendMail, outboxStore, newSenderHasher(emailCfg).cipher("outbox"))
+	e.outbox.shaper = newSendShaper(emailCfg)
+	if emailCfg.Maildir == "" {
+		var err error
+		e.imap, err = initImap(emailCfg)
+		if err != nil {
+			log.Fatal("Can't start the imap client: ", err)
+		}
 	}
 
 	stop := make(chan struct{})
+	go e.outbox.run(stop)
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT)
 	signal.Notify(signalChan, syscall.SIGTERM)
@@ -72,9 +119,12 @@ func StartEmail(emailCfg *internal.EmailConfig, distCfg *internal.Config,
 		e.dist.Shutdown()
 
 		close(stop)
-		e.imap.Logout()
 	}()
 
+	if emailCfg.Maildir != "" {
+		e.listenMaildir(emailCfg.Maildir, stop)
+		return
+	}
 	if err := e.listenImapUpdates(stop); err != nil {
 		log.Println("Error listening emails:", err)
 	}
@@ -103,44 +153,99 @@ func initImap(emailCfg *internal.EmailConfig) (*imapClient, error) {
 	}
 
 	err = c.Login(emailCfg.ImapUsername, emailCfg.ImapPassword)
+	if err != nil {
+		c.Logout()
+		return nil, err
+	}
 	idleClient := idle.NewClient(c)
-	return &imapClient{c, idleClient}, err
+	return &imapClient{c, idleClient}, nil
 }
 
+// listenImapUpdates handles the emails of the inbox until stop is closed.  If
+// the connection fails it reconnects, waiting imapFirstReconnectDelay after
+// the failure and doubling it after every failed attempt.
 func (e *emailClient) listenImapUpdates(stop <-chan struct{}) error {
+	delay := imapFirstReconnectDelay
+	for {
+		err := e.idleInbox(stop)
+		e.imap.Logout()
+		if err == nil {
+			return nil
+		}
+		log.Println("Lost the imap connection:", err)
+		imapConnectedGauge.WithLabelValues(e.cfg.Address).Set(0)
+
+		for {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > imapMaxReconnectDelay {
+				delay = imapMaxReconnectDelay
+			}
+
+			e.imap, err = initImap(e.cfg)
+			if err == nil {
+				log.Println("Reconnected to the imap server")
+				break
+			}
+			log.Println("Error reconnecting to the imap server:", err)
+		}
+		delay = imapFirstReconnectDelay
+	}
+}
+
+// idleInbox fetches the emails of the inbox as they arrive until stop is
+// closed.  It checks the connection with a NOOP every imapKeepaliveInterval
+// without emails and returns an error if it fails.
+func (e *emailClient) idleInbox(stop <-chan struct{}) error {
 	mbox, err := e.imap.Select("INBOX", false)
 	if err != nil {
 		return err
 	}
+	imapConnectedGauge.WithLabelValues(e.cfg.Address).Set(1)
 	e.fetchMessages(mbox)
 
 	for {
+		update, err := e.waitForMailboxUpdate(stop, imapKeepaliveInterval)
+		if err != nil {
+			return err
+		}
 		select {
 		case <-stop:
 			return nil
 		default:
-			update, err := e.waitForMailboxUpdate()
-			if err != nil {
-				log.Println("Error imap idling", err)
-				continue
+		}
+
+		if update == nil {
+			if err := e.imap.Noop(); err != nil {
+				return err
 			}
-			e.fetchMessages(update.Mailbox)
+			continue
 		}
+		e.fetchMessages(update.Mailbox)
 	}
 }
 
-func (e *emailClient) waitForMailboxUpdate() (mboxUpdate *client.MailboxUpdate, err error) {
+// waitForMailboxUpdate idles until there is an update of the mailbox.  It
+// returns a nil update if there was none after timeout or stop is closed.
+func (e *emailClient) waitForMailboxUpdate(stop <-chan struct{}, timeout time.Duration) (mboxUpdate *client.MailboxUpdate, err error) {
 	// Create a channel to receive mailbox updates
 	updates := make(chan client.Update, 1)
 	e.imap.Updates = updates
 
 	// Start idling
 	done := make(chan error, 1)
-	stop := make(chan struct{})
+	stopIdle := make(chan struct{})
 	go func() {
-		done <- e.imap.IdleWithFallback(stop, 0)
+		done <- e.imap.IdleWithFallback(stopIdle, 0)
 	}()
 
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	// Listen for updates
 waitLoop:
 	for {
@@ -153,16 +258,20 @@ waitLoop:
 			}
 		case err := <-done:
 			return nil, err
+		case <-timer.C:
+			break waitLoop
+		case <-stop:
+			break waitLoop
 		}
 	}
 
 	// We need to nil the updates channel or the client will hang on it
 	// https://github.com/emersion/go-imap-idle/issues/16
 	e.imap.Updates = nil
-	close(stop)
-	<-done
+	close(stopIdle)
+	err = <-done
 
-	return mboxUpdate, nil
+	return mboxUpdate, err
 }
 
 func (e *emailClient) fetchMessages(mboxStatus *imap.MailboxStatus) {
@@ -194,30 +303,13 @@ func (e *emailClient) fetchMessages(mboxStatus *imap.MailboxStatus) {
 	for msg := range messages {
 		flag := ""
 		for _, literal := range msg.Body {
-			email, err := mail.ReadMessage(literal)
+			raw, err := ioutil.ReadAll(literal)
 			if err != nil {
-				log.Println("Error parsing incoming email", err)
+				log.Println("Error reading incoming email", err)
 				continue
 			}
-
-			send := func(subject, body string) error {
-				return e.reply(email, subject, body)
-			}
-
-			err = e.incomingHandler(email, send)
-			if err != nil {
-				log.Println("Error handling incoming email ", email.Header.Get("Message-ID"), ":", err)
-
-				date, err := email.Header.Date()
-				if flag == "" &&
-					(err != nil || date.Add(durationIgnoreEmails).Before(time.Now())) {
-
-					log.Println("Give up with the email, marked as readed so it will not be processed anymore")
-					flag = imap.SeenFlag
-				}
-			} else {
-				// delete the email as it was fully processed
-				flag = imap.DeletedFlag
+			if f := e.handleEmail(raw); f != "" {
+				flag = f
 			}
 		}
 		if flag != "" {
@@ -226,6 +318,10 @@ func (e *emailClient) fetchMessages(mboxStatus *imap.MailboxStatus) {
 
 			item := imap.FormatFlagsOp(imap.AddFlags, true)
 			flags := []interface{}{flag}
+			if flag == imap.FlaggedFlag {
+				// flagged emails stay in the inbox, but are not processed again
+				flags = append(flags, imap.SeenFlag)
+			}
 			err := e.imap.Store(seqset, item, flags, nil)
 			if err != nil {
 				log.Println("Error setting the delete flag", err)
@@ -238,30 +334,139 @@ func (e *emailClient) fetchMessages(mboxStatus *imap.MailboxStatus) {
 	}
 }
 
-func (e *emailClient) reply(originalMessage *mail.Message, subject, body string) error {
-	sender, err := originalMessage.Header.AddressList("From")
+// handleEmail verifies the email and passes it to the handler.  It returns the
+// flag for the email: deleted if it was processed, flagged if it should be
+// kept for review, seen to give up with it, or empty to retry it later.
+func (e *emailClient) handleEmail(raw []byte) string {
+	email, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
-		return err
+		log.Println("Error parsing incoming email", err)
+		return ""
+	}
+
+	if e.cfg.SenderVerification != "" {
+		err = verifySender(raw, email, e.cfg.AuthservID, lookupTXT)
+		if err != nil {
+			log.Println("Ignoring email", email.Header.Get("Message-ID"), "from an unverified sender:", err)
+			if e.cfg.SenderVerification == SenderVerificationFlag {
+				return imap.FlaggedFlag
+			}
+			return imap.DeletedFlag
+		}
+	}
+
+	if _, err := fromAddress(email.Header); err != nil {
+		log.Println("Ignoring email", email.Header.Get("Message-ID"), ":", err)
+		return imap.DeletedFlag
 	}
-	if len(sender) != 1 {
-		return fmt.Errorf("Unexpected email from: %s", originalMessage.Header.Get("From"))
+	sender := senderAddress(email)
+	if ok, limit := e.limiter.allow(sender); !ok {
+		log.Println("Ignoring email", email.Header.Get("Message-ID"), "because its", limit, "got too many replies")
+		throttledEmailsCount.WithLabelValues(e.cfg.Address, limit).Inc()
+		return imap.DeletedFlag
 	}
 
+	if err := checkDomain(e.cfg, sender); err != nil {
+		log.Println("Bouncing email", email.Header.Get("Message-ID"), ":", err)
+		err = e.reply(email, domainBounceSubject, bounceBody(e.cfg, addressDomain(sender), err), "", nil)
+		if err != nil {
+			log.Println("Error bouncing email", email.Header.Get("Message-ID"), ":", err)
+		} else {
+			e.limiter.record(sender)
+		}
+		return imap.DeletedFlag
+	}
+
+	send := func(subject, body, html string, attachments ...Attachment) error {
+		return e.reply(email, subject, body, html, attachments)
+	}
+
+	err = e.incomingHandler(email, send)
+	if err != nil {
+		log.Println("Error handling incoming email ", email.Header.Get("Message-ID"), ":", err)
+
+		date, err := email.Header.Date()
+		if err != nil || date.Add(durationIgnoreEmails).Before(time.Now()) {
+			log.Println("Give up with the email, marked as readed so it will not be processed anymore")
+			return imap.SeenFlag
+		}
+		return ""
+	}
+
+	// delete the email as it was fully processed
+	e.limiter.record(sender)
+	return imap.DeletedFlag
+}
+
+// senderAddress returns the address of the From of the email, or the header
+// itself if it can't be parsed.
+func senderAddress(msg *mail.Message) string {
+	from, err := fromAddress(msg.Header)
+	if err != nil {
+		return msg.Header.Get("From")
+	}
+	return from.Address
+}
+
+func (e *emailClient) reply(originalMessage *mail.Message, subject, body, html string, attachments []Attachment) error {
+	sender, err := fromAddress(originalMessage.Header)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, originalMessage.Header.Get("From"))
+	}
+
+	contentType := "text/plain; charset=\"utf-8\""
+	if html != "" {
+		body, contentType, err = multipartBody(body, html)
+		if err != nil {
+			return err
+		}
+	}
+	if len(attachments) != 0 {
+		body, contentType, err = mixedBody(body, contentType, attachments)
+		if err != nil {
+			return err
+		}
+	}
+
+	messageID, err := newMessageID(e.cfg.Address)
+	if err != nil {
+		return err
+	}
+	inReplyTo := originalMessage.Header.Get("Message-ID")
 	msg := fmt.Sprintf("From: %s\r\n"+
 		"To: %s\r\n"+
 		"Subject: %s\r\n"+
+		"Message-ID: %s\r\n"+
 		"In-Reply-To: %s\r\n"+
+		"References: %s\r\n"+
 		"MIME-version: 1.0\r\n"+
-		"Content-Type: text/plain; charset=\"utf-8\"\r\n"+
+		"Content-Type: %s\r\n"+
 		"\r\n",
 		e.cfg.Address,
-		sender[0].String(),
+		sender.String(),
 		subject,
-		originalMessage.Header.Get("Message-ID"),
+		messageID,
+		inReplyTo,
+		strings.TrimSpace(originalMessage.Header.Get("References")+" "+inReplyTo),
+		contentType,
 	)
 	scanner := bufio.NewScanner(strings.NewReader(body))
 	for scanner.Scan() {
 		msg += scanner.Text() + "\r\n"
 	}
-	return smtp.SendMail(e.cfg.SmtpServer, *e.smtpAuth, e.cfg.Address, []string{sender[0].Address}, []byte(msg))
+	e.outbox.enqueue(sender.Address, []byte(msg))
+	return nil
+}
+
+// newMessageID returns a random Message-ID in the domain of address.
+func newMessageID(address string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(id) + "@" + addressDomain(address) + ">", nil
+}
+
+func (e *emailClient) sendMail(to string, msg []byte) error {
+	return smtp.SendMail(e.cfg.SmtpServer, *e.smtpAuth, e.cfg.Address, []string{to}, msg)
 }
@@ -5,6 +5,7 @@
 package common
 
 import (
+	"net"
 	"net/mail"
 	"os"
 	"strings"
@@ -17,7 +18,9 @@ import (
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-imap/backend/memory"
 	"github.com/emersion/go-imap/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
 )
 
 const (
@@ -45,6 +48,8 @@ type testEmailDistributor struct{}
 
 func (ted *testEmailDistributor) Init(cfg *internal.Config) {}
 func (ted *testEmailDistributor) Shutdown()                 {}
+func (ted *testEmailDistributor) Healthz() error            { return nil }
+func (ted *testEmailDistributor) Stats() distributors.Stats { return distributors.Stats{} }
 
 func testImapServer() (*server.Server, backend.Mailbox) {
 	be := memory.New()
@@ -104,3 +109,74 @@ func checkInboxEmptyAndExit(t *testing.T, mbox backend.Mailbox) {
 	}
 	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 }
+
+func listenTestImapServer(t *testing.T, addr, subject string) (*server.Server, string) {
+	be := memory.New()
+	user, _ := be.Login(nil, testEmailCfg.ImapUsername, testEmailCfg.ImapPassword)
+	mbox, _ := user.GetMailbox("INBOX")
+	mbox.CreateMessage([]string{}, time.Now(), strings.NewReader(strings.Replace(testEmail, "Subject: win en", "Subject: "+subject, 1)))
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.Enable(idle.NewExtension())
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+func TestImapReconnect(t *testing.T) {
+	s, addr := listenTestImapServer(t, "127.0.0.1:0", "first")
+
+	cfg := testEmailCfg
+	cfg.ImapServer = "imap://" + addr
+	subjects := make(chan string, 2)
+	e := emailClient{
+		cfg: &cfg,
+		incomingHandler: func(msg *mail.Message, send SendFunction) error {
+			subjects <- msg.Header.Get("Subject")
+			return nil
+		},
+	}
+	var err error
+	e.imap, err = initImap(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- e.listenImapUpdates(stop) }()
+
+	waitSubject := func(expected string) {
+		select {
+		case subject := <-subjects:
+			if subject != expected {
+				t.Errorf("Unexpected email %s, expected %s", subject, expected)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for the email", expected)
+		}
+	}
+	waitSubject("first")
+	if connected := testutil.ToFloat64(imapConnectedGauge.WithLabelValues(cfg.Address)); connected != 1 {
+		t.Errorf("The connection is not marked as up: %f", connected)
+	}
+
+	s.Close()
+	s, _ = listenTestImapServer(t, addr, "second")
+	defer s.Close()
+	waitSubject("second")
+
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Error listening emails:", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("The imap client didn't stop")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const hashKeySize = 32
+
+// senderHasher hashes the email addresses, and the other identifiers of the
+// senders that we keep, with HMAC-SHA256 and a secret key.  Unlike a plain
+// hash, the stored hashes can't be matched with a list of addresses without
+// the key.  The same key encrypts what we need to store in the clear, like
+// the recipients of the outbox.
+type senderHasher struct {
+	key []byte
+}
+
+// newSenderHasher returns a hasher with the key of the hash_key_file of cfg.
+// If it's empty the key is kept in the StorageDir, and created the first time,
+// or only in memory if there is no StorageDir.
+func newSenderHasher(cfg *internal.EmailConfig) *senderHasher {
+	keyFile := cfg.HashKeyFile
+	if keyFile == "" && cfg.StorageDir != "" {
+		keyFile = filepath.Join(cfg.StorageDir, "hash-key-"+cfg.Address)
+	}
+	if keyFile == "" {
+		key := make([]byte, hashKeySize)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Can't create the hash key: %v", err)
+		}
+		return &senderHasher{key: key}
+	}
+
+	key, err := loadHashKey(keyFile, cfg.HashKeyFile == "")
+	if err != nil {
+		log.Fatalf("Can't load the hash key %s: %v", keyFile, err)
+	}
+	return &senderHasher{key: key}
+}
+
+// loadHashKey reads the base64 encoded key of the file, and if create is set
+// and the file doesn't exist it writes a new random key to it.
+func loadHashKey(keyFile string, create bool) ([]byte, error) {
+	content, err := os.ReadFile(keyFile)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		key := make([]byte, hashKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < hashKeySize {
+		return nil, fmt.Errorf("The hash key has %d bytes, it needs at least %d", len(key), hashKeySize)
+	}
+	return key, nil
+}
+
+// hash returns the first 64 bits of the HMAC of s.
+func (h *senderHasher) hash(s string) core.Hashkey {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(s))
+	return core.Hashkey(binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+// cipher returns the AES-256-GCM with the key of the given purpose, the HMAC
+// of the purpose.
+func (h *senderHasher) cipher(purpose string) cipher.AEAD {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(purpose))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"golang.org/x/text/language"
+)
+
+// Locales holds the translations of the messages of a distributor frontend.
+// The English text is the default message defined in the code, translations
+// are loaded from json files named <prefix>.<language>.json.
+type Locales struct {
+	bundle *i18n.Bundle
+}
+
+// NewLocales loads all the translations in dir for the given file prefix.  An
+// empty dir means there are no translations and everything is in English.
+func NewLocales(dir, prefix string) (*Locales, error) {
+	bundle := i18n.NewBundle(language.English)
+	bundle.RegisterUnmarshalFunc("json", json.Unmarshal)
+
+	l := &Locales{bundle}
+	if dir == "" {
+		return l, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, prefix+".*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		_, err = bundle.LoadMessageFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Loaded %d translations for %s.", len(files), prefix)
+	return l, nil
+}
+
+// Languages returns the languages that we have translations for.
+func (l *Locales) Languages() []language.Tag {
+	return l.bundle.LanguageTags()
+}
+
+// Localizer returns a localizer for the preferred languages in order.  Each
+// of them can be a language code or an Accept-Language header value.
+func (l *Locales) Localizer(langs ...string) *i18n.Localizer {
+	return i18n.NewLocalizer(l.bundle, langs...)
+}
+
+// RequestLocalizer returns a localizer for the Accept-Language of the request.
+func (l *Locales) RequestLocalizer(r *http.Request) *i18n.Localizer {
+	return l.Localizer(r.Header.Get("Accept-Language"))
+}
+
+// rtlLanguages are the languages written from right to left that we may have
+// translations for
+var rtlLanguages = map[string]bool{"ar": true, "fa": true, "he": true, "ur": true}
+
+// PageLanguage returns the language that the localizer uses for msg and its
+// direction, ltr or rtl, for the lang and dir attributes of the html pages.
+func PageLanguage(localizer *i18n.Localizer, msg *i18n.Message) (lang string, dir string) {
+	lang, dir = "en", "ltr"
+	if _, tag, err := localizer.LocalizeWithTag(&i18n.LocalizeConfig{DefaultMessage: msg}); err == nil {
+		base, _ := tag.Base()
+		lang = tag.String()
+		if rtlLanguages[base.String()] {
+			dir = "rtl"
+		}
+	}
+	return lang, dir
+}
+
+// Localize translates msg, falling back to its default English text if there
+// is any problem with the translation.
+func Localize(localizer *i18n.Localizer, msg *i18n.Message, data map[string]interface{}) string {
+	text, err := localizer.Localize(&i18n.LocalizeConfig{
+		DefaultMessage: msg,
+		TemplateData:   data,
+	})
+	if err != nil {
+		// messages not translated yet fall back to English
+		var notFound *i18n.MessageNotFoundErr
+		if !errors.As(err, &notFound) {
+			log.Printf("Error localizing message %s: %v", msg.ID, err)
+		}
+		if text == "" {
+			return msg.Other
+		}
+	}
+	return text
+}
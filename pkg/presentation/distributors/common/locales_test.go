@@ -0,0 +1,48 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+const localesDir = "../../../../locales"
+
+func TestLocalize(t *testing.T) {
+	locales, err := NewLocales(localesDir, "moat")
+	if err != nil {
+		t.Fatal("Can't load locales:", err)
+	}
+
+	msg := &i18n.Message{
+		ID:    "MoatInvalidRequest",
+		Other: "Not valid request",
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+
+	r.Header.Set("Accept-Language", "es-ES,es;q=0.9,en;q=0.8")
+	text := Localize(locales.RequestLocalizer(r), msg, nil)
+	if text != "Solicitud no válida" {
+		t.Errorf("Wrong spanish translation: %s", text)
+	}
+
+	r.Header.Set("Accept-Language", "xx")
+	text = Localize(locales.RequestLocalizer(r), msg, nil)
+	if text != msg.Other {
+		t.Errorf("Unknown language didn't fall back to english: %s", text)
+	}
+
+	untranslated := &i18n.Message{
+		ID:    "NotTranslated",
+		Other: "Not translated",
+	}
+	text = Localize(locales.Localizer("es"), untranslated, nil)
+	if text != untranslated.Other {
+		t.Errorf("Untranslated message didn't fall back to english: %s", text)
+	}
+}
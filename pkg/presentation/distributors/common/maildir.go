@@ -0,0 +1,115 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// maildirPollInterval is how often the maildir is checked if it can't
+	// be watched
+	maildirPollInterval = 5 * time.Second
+	// maildirRescanInterval is how often the watched maildir is checked
+	// anyway, for the emails to retry
+	maildirRescanInterval = time.Minute
+	// maildirRetryDelay is how long to wait to handle again an email that
+	// failed
+	maildirRetryDelay = 5 * time.Minute
+)
+
+// listenMaildir handles the emails that the MTA delivers to the Maildir dir,
+// until stop is closed.  The new directory is watched so the emails are
+// handled as soon as they are delivered, or polled if it can't be watched.
+func (e *emailClient) listenMaildir(dir string, stop <-chan struct{}) {
+	interval := maildirRescanInterval
+	events, unwatch, err := watchMaildir(filepath.Join(dir, "new"))
+	if err != nil {
+		log.Printf("Can't watch the maildir, checking it every %s: %s", maildirPollInterval, err)
+		interval = maildirPollInterval
+	} else {
+		defer unwatch()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	retries := make(map[string]time.Time)
+	for {
+		e.processMaildir(dir, retries)
+		select {
+		case <-stop:
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processMaildir handles the emails in the new directory of the Maildir.  Like
+// with IMAP, the processed ones are deleted and the ones to review or to give
+// up with are moved to cur with the flagged or seen flags.  The ones that fail
+// stay in new and are retried after maildirRetryDelay.
+func (e *emailClient) processMaildir(dir string, retries map[string]time.Time) {
+	newDir := filepath.Join(dir, "new")
+	files, err := ioutil.ReadDir(newDir)
+	if err != nil {
+		log.Println("Error reading the maildir:", err)
+		return
+	}
+
+	now := time.Now()
+	present := make(map[string]bool, len(files))
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		present[name] = true
+		if retry, ok := retries[name]; ok && now.Before(retry) {
+			continue
+		}
+
+		path := filepath.Join(newDir, name)
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Println("Error reading incoming email", err)
+			continue
+		}
+
+		switch e.handleEmail(raw) {
+		case imap.DeletedFlag:
+			err = os.Remove(path)
+		case imap.FlaggedFlag:
+			err = moveToCur(dir, name, "FS")
+		case imap.SeenFlag:
+			err = moveToCur(dir, name, "S")
+		default:
+			retries[name] = now.Add(maildirRetryDelay)
+			continue
+		}
+		if err != nil {
+			log.Println("Error updating the email in the maildir", err)
+		}
+		delete(retries, name)
+	}
+
+	for name := range retries {
+		if !present[name] {
+			delete(retries, name)
+		}
+	}
+}
+
+// moveToCur moves the email from new to cur with the Maildir flags.
+func moveToCur(dir, name, flags string) error {
+	return os.Rename(filepath.Join(dir, "new", name), filepath.Join(dir, "cur", name+":2,"+flags))
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package common
+
+import "errors"
+
+// watchMaildir is only supported in linux, the maildir is polled in the other
+// platforms.
+func watchMaildir(dir string) (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("watching the maildir is only supported in linux")
+}
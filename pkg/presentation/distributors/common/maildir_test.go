@@ -0,0 +1,110 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		os.Mkdir(filepath.Join(dir, sub), 0700)
+	}
+
+	recent := time.Now().Format(time.RFC1123Z)
+	emails := map[string]string{
+		"1.ok":    strings.Replace(testEmail, "Subject: win en", "Subject: ok", 1),
+		"2.retry": strings.Replace(strings.Replace(testEmail, "Subject: win en", "Subject: fail", 1), "Wed, 11 May 2016 14:31:59 +0000", recent, 1),
+		"3.old":   strings.Replace(testEmail, "Subject: win en", "Subject: fail", 1),
+	}
+	for name, email := range emails {
+		if err := ioutil.WriteFile(filepath.Join(dir, "new", name), []byte(email), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var replies []string
+	e := emailClient{
+		cfg: &internal.EmailConfig{Address: "test@example.com"},
+		incomingHandler: func(msg *mail.Message, send SendFunction) error {
+			if msg.Header.Get("Subject") == "fail" {
+				return errors.New("failed")
+			}
+			return send("re", "hello", "")
+		},
+	}
+	e.outbox = newOutbox(e.cfg.Address, func(to string, msg []byte) error {
+		replies = append(replies, to)
+		return nil
+	}, nil, nil)
+
+	retries := make(map[string]time.Time)
+	e.processMaildir(dir, retries)
+	e.outbox.sendDue(time.Now())
+
+	if len(replies) != 1 || replies[0] != "test@example.org" {
+		t.Errorf("Wrong replies: %v", replies)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new", "1.ok")); !os.IsNotExist(err) {
+		t.Errorf("The processed email was not deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new", "2.retry")); err != nil {
+		t.Errorf("The failed email is not in new anymore: %v", err)
+	}
+	if _, ok := retries["2.retry"]; !ok {
+		t.Errorf("The failed email is not going to be retried")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "3.old:2,S")); err != nil {
+		t.Errorf("The old email was not moved to cur as seen: %v", err)
+	}
+
+	// the failed email is not retried before the delay
+	e.processMaildir(dir, retries)
+	if _, err := os.Stat(filepath.Join(dir, "new", "2.retry")); err != nil {
+		t.Errorf("The failed email was retried too soon: %v", err)
+	}
+}
+
+func TestWatchMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events, unwatch, err := watchMaildir(dir)
+	if err != nil {
+		t.Skip("Can't watch the maildir:", err)
+	}
+	defer unwatch()
+
+	// the MTA writes the email in tmp and moves it to new
+	tmp := filepath.Join(os.TempDir(), filepath.Base(dir)+".email")
+	if err := ioutil.WriteFile(tmp, []byte(testEmail), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "1.new")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Error("Got no event for the delivered email")
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// maxMIMEDepth is how many multipart levels are walked looking for text
+	maxMIMEDepth = 10
+	// maxTextSize is the maximum size of the text read from an email
+	maxTextSize = 1 << 20
+	// base64LineLength is the length of the lines of the base64 attachments
+	base64LineLength = 76
+)
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// mimeHeader is the header of an email or of one of its MIME parts.
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// TextBody returns the text of the email to parse commands from.  It walks the
+// MIME parts of the email looking for the text ones, the plain text ones are
+// preferred and if there are none the html ones are converted to text.  The
+// attachments are ignored.
+func TextBody(msg *mail.Message) io.Reader {
+	plain, htmlText := textParts(msg.Header, msg.Body, 0)
+	if plain == "" && htmlText != "" {
+		plain = htmlToText(htmlText)
+	}
+	return strings.NewReader(plain)
+}
+
+// textParts returns the plain text and the html of the MIME entity.
+func textParts(header mimeHeader, body io.Reader, depth int) (plain string, htmlText string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 says that the default is plain text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.EqualFold(strings.TrimSpace(header.Get("Content-Transfer-Encoding")), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, &lineStripper{r: body})
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			log.Println("Ignoring MIME parts nested too deep")
+			return "", ""
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Println("Error reading MIME part:", err)
+				break
+			}
+			p, h := textParts(part.Header, part, depth+1)
+			plain += p
+			htmlText += h
+		}
+		return plain, htmlText
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", ""
+	}
+	if disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")); disposition == "attachment" {
+		return "", ""
+	}
+
+	text, err := readText(body, params["charset"])
+	if err != nil {
+		log.Println("Error reading the", mediaType, "part of the email:", err)
+		return "", ""
+	}
+	if mediaType == "text/html" {
+		return "", text
+	}
+	return text, ""
+}
+
+// readText reads the body decoding it from charset into utf-8.
+func readText(body io.Reader, charsetLabel string) (string, error) {
+	if charsetLabel != "" {
+		r, err := charset.NewReaderLabel(charsetLabel, body)
+		if err != nil {
+			return "", err
+		}
+		body = r
+	}
+	text, err := ioutil.ReadAll(io.LimitReader(body, maxTextSize))
+	if err != nil {
+		return "", err
+	}
+	return string(text) + "\n", nil
+}
+
+// lineStripper removes the line breaks of the base64 encoded parts, as the
+// base64 decoder doesn't ignore them.
+type lineStripper struct {
+	r io.Reader
+}
+
+func (l *lineStripper) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+// htmlToText returns the text of the html, without the scripts and styles.
+func htmlToText(htmlText string) string {
+	var text strings.Builder
+	skip := 0
+	z := nethtml.NewTokenizer(strings.NewReader(htmlText))
+	for {
+		tt := z.Next()
+		switch tt {
+		case nethtml.ErrorToken:
+			return strings.TrimSpace(text.String()) + "\n"
+		case nethtml.TextToken:
+			if skip == 0 {
+				text.Write(z.Text())
+			}
+		case nethtml.StartTagToken, nethtml.EndTagToken, nethtml.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Script, atom.Style:
+				if tt == nethtml.StartTagToken {
+					skip++
+				} else if tt == nethtml.EndTagToken && skip > 0 {
+					skip--
+				}
+			case atom.Br, atom.P, atom.Div, atom.Li, atom.Tr, atom.H1, atom.H2, atom.H3,
+				atom.H4, atom.H5, atom.H6, atom.Blockquote, atom.Pre:
+				text.WriteString("\n")
+			}
+		}
+	}
+}
+
+// TextToHTML returns an html version of the plain text reply, with its links
+// clickable.  The text is written right to left if rtl is true.
+func TextToHTML(text string, rtl bool) string {
+	dir := "ltr"
+	if rtl {
+		dir = "rtl"
+	}
+
+	var body strings.Builder
+	last := 0
+	for _, loc := range urlRegexp.FindAllStringIndex(text, -1) {
+		link := html.EscapeString(text[loc[0]:loc[1]])
+		body.WriteString(html.EscapeString(text[last:loc[0]]))
+		body.WriteString(`<a href="` + link + `">` + link + `</a>`)
+		last = loc[1]
+	}
+	body.WriteString(html.EscapeString(text[last:]))
+
+	return fmt.Sprintf(htmlReplyTemplate, dir, body.String())
+}
+
+// multipartBody returns the multipart/alternative body of the reply with both
+// the plain text and the html, and its Content-Type.
+func multipartBody(text, htmlText string) (string, string, error) {
+	var body strings.Builder
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain", text},
+		{"text/html", htmlText},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+"; charset=\"utf-8\"")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return "", "", err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return "", "", err
+		}
+		if err := qp.Close(); err != nil {
+			return "", "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return body.String(), "multipart/alternative; boundary=\"" + w.Boundary() + "\"", nil
+}
+
+// mixedBody returns the multipart/mixed body of the reply with the content
+// and the attachments, and its Content-Type.
+func mixedBody(content, contentType string, attachments []Attachment) (string, string, error) {
+	var body strings.Builder
+	w := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.WriteString(pw, content); err != nil {
+		return "", "", err
+	}
+
+	for _, attachment := range attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", attachment.ContentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		header.Set("Content-Transfer-Encoding", "base64")
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return "", "", err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > base64LineLength {
+			if _, err := io.WriteString(pw, encoded[:base64LineLength]+"\r\n"); err != nil {
+				return "", "", err
+			}
+			encoded = encoded[base64LineLength:]
+		}
+		if _, err := io.WriteString(pw, encoded+"\r\n"); err != nil {
+			return "", "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return body.String(), "multipart/mixed; boundary=\"" + w.Boundary() + "\"", nil
+}
+
+const htmlReplyTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"></head>
+<body dir="%s"><div style="white-space: pre-wrap; font-family: monospace">%s</div></body>
+</html>
+`
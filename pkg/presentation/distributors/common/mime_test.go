@@ -0,0 +1,140 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const multipartEmail = "From: test@example.org\r\n" +
+	"Subject: links\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=\"iso-8859-1\"\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"windows fr =E9t=E9\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=\"utf-8\"\r\n" +
+	"\r\n" +
+	"<p>windows fr</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"linux.txt\"\r\n" +
+	"\r\n" +
+	"linux\r\n" +
+	"--outer--\r\n"
+
+const htmlEmail = "From: test@example.org\r\n" +
+	"Subject: links\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: text/html; charset=\"utf-8\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PGh0bWw+PHN0eWxlPnAgeyBjb2xvcjogcmVkIH08L3N0eWxlPjxib2R5PjxwPm1hY29zPC9wPjxi\r\n" +
+	"cj5lbiAmYW1wOyB0b3Jicm93c2VyPC9ib2R5PjwvaHRtbD4=\r\n"
+
+func TestTextBody(t *testing.T) {
+	for raw, expected := range map[string]string{
+		testEmail:      "win en\n",
+		multipartEmail: "windows fr été\n",
+		htmlEmail:      "macos\n\nen & torbrowser\n",
+	} {
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, err := ioutil.ReadAll(TextBody(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(text) != expected {
+			t.Errorf("Wrong text body: %q, expected %q", text, expected)
+		}
+	}
+}
+
+func TestMultipartReply(t *testing.T) {
+	htmlText := TextToHTML("Download: https://example.com/?a=1&b=2\n<3", true)
+	if !strings.Contains(htmlText, `<a href="https://example.com/?a=1&amp;b=2">`) {
+		t.Errorf("The link is not clickable: %s", htmlText)
+	}
+	if !strings.Contains(htmlText, "&lt;3") || !strings.Contains(htmlText, `dir="rtl"`) {
+		t.Errorf("Wrong html: %s", htmlText)
+	}
+
+	body, contentType, err := multipartBody("hello été", htmlText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Wrong content type %s: %v", contentType, err)
+	}
+
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, expected := range []string{"hello été", htmlText} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(part)
+		if strings.ReplaceAll(string(content), "\r\n", "\n") != expected {
+			t.Errorf("Wrong part content: %q", content)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	png := []byte("\x89PNG not really a png but long enough to need more than one line of base64")
+	body, contentType, err := mixedBody("hello\r\n", "text/plain; charset=\"utf-8\"", []Attachment{
+		{Filename: "bridges.png", ContentType: "image/png", Content: png},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(part)
+	if string(content) != "hello\r\n" {
+		t.Errorf("Wrong content: %q", content)
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "bridges.png" || part.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Wrong attachment header: %v", part.Header)
+	}
+	content, _ = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, &lineStripper{r: part}))
+	if string(content) != string(png) {
+		t.Errorf("Wrong attachment: %q", content)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Unexpected part: %v", err)
+	}
+}
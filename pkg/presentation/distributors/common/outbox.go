@@ -0,0 +1,289 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+)
+
+const (
+	maxSendAttempts = 10
+	// the retries wait firstRetryDelay, doubling it every time up to
+	// maxRetryDelay
+	firstRetryDelay = time.Minute
+	maxRetryDelay   = 4 * time.Hour
+	// idleOutboxWait is how long the outbox sleeps when there is nothing to
+	// retry, new emails wake it up
+	idleOutboxWait = time.Hour
+)
+
+var undeliveredEmailsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "email_undelivered_total",
+	Help: "The total number of replies dropped after failing to send them too many times",
+},
+	[]string{"address"},
+)
+
+// sendMailFunc sends the email message to the address.
+type sendMailFunc func(to string, msg []byte) error
+
+// outgoingEmail is a reply waiting to be sent.
+type outgoingEmail struct {
+	To          string    `json:"to"`
+	Message     []byte    `json:"message"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// storedEmail is an outgoingEmail as it's stored.  The recipient, the
+// message and the last error, that often has the recipient, are encrypted.
+type storedEmail struct {
+	Sealed      []byte    `json:"sealed"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// sealedEmail is what the Sealed field of a storedEmail encrypts.
+type sealedEmail struct {
+	To        string `json:"to"`
+	Message   []byte `json:"message"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// outbox is a queue of replies that retries the ones it fails to send, so a
+// failure of the SMTP server doesn't lose them.  It's stored, encrypted with
+// sealer, to keep the pending replies after a restart.
+type outbox struct {
+	sync.Mutex
+	address    string
+	queue      []*outgoingEmail
+	send       sendMailFunc
+	store      persistence.Mechanism
+	sealer     cipher.AEAD
+	wake       chan struct{}
+	retryDelay time.Duration
+	shaper     *sendShaper
+}
+
+// newOutbox returns an outbox that sends the emails with send.  If store is
+// not nil the queue is stored there, encrypted with sealer.
+func newOutbox(address string, send sendMailFunc, store persistence.Mechanism, sealer cipher.AEAD) *outbox {
+	o := &outbox{
+		address:    address,
+		send:       send,
+		store:      store,
+		sealer:     sealer,
+		wake:       make(chan struct{}, 1),
+		retryDelay: firstRetryDelay,
+	}
+	if store != nil {
+		o.load()
+		if len(o.queue) != 0 {
+			log.Println("Loaded", len(o.queue), "outgoing emails")
+		}
+	}
+	return o
+}
+
+// enqueue adds the message to the queue, it's sent as soon as possible.
+func (o *outbox) enqueue(to string, msg []byte) {
+	o.Lock()
+	o.queue = append(o.queue, &outgoingEmail{To: to, Message: msg, NextAttempt: time.Now()})
+	o.save()
+	o.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued emails until stop is closed.
+func (o *outbox) run(stop <-chan struct{}) {
+	for {
+		o.sendDue(time.Now())
+
+		timer := time.NewTimer(o.nextWait(time.Now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-o.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendDue tries to send the emails whose next attempt is due, the ones over
+// the send rate of their domain are delayed.  The ones that fail are retried
+// later with exponential backoff, until they fail maxSendAttempts times and
+// are dropped.
+func (o *outbox) sendDue(now time.Time) {
+	o.Lock()
+	var due []*outgoingEmail
+	for _, email := range o.queue {
+		if email.NextAttempt.After(now) {
+			continue
+		}
+		if ok, next := o.shaper.allow(email.To, now); !ok {
+			// it's not a failure, it waits until the domain has tokens
+			email.NextAttempt = next
+			continue
+		}
+		due = append(due, email)
+	}
+	o.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	failed := make(map[*outgoingEmail]error)
+	for _, email := range due {
+		if err := o.send(email.To, email.Message); err != nil {
+			failed[email] = err
+		}
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	isDue := make(map[*outgoingEmail]bool, len(due))
+	for _, email := range due {
+		isDue[email] = true
+	}
+	queue := o.queue[:0]
+	for _, email := range o.queue {
+		if !isDue[email] {
+			queue = append(queue, email)
+			continue
+		}
+		err, ok := failed[email]
+		if !ok {
+			continue
+		}
+
+		email.Attempts++
+		email.LastError = err.Error()
+		if email.Attempts >= maxSendAttempts {
+			log.Printf("Dropping the reply to %s after %d failed attempts, the last one: %v", email.To, email.Attempts, err)
+			undeliveredEmailsCount.WithLabelValues(o.address).Inc()
+			continue
+		}
+		email.NextAttempt = now.Add(o.backoff(email.Attempts))
+		log.Printf("Error sending the reply to %s, retrying at %s: %v", email.To, email.NextAttempt.Format(time.RFC3339), err)
+		queue = append(queue, email)
+	}
+	o.queue = queue
+	o.save()
+}
+
+// backoff returns how long to wait after the given number of failed attempts.
+func (o *outbox) backoff(attempts int) time.Duration {
+	delay := o.retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// nextWait returns how long to wait until the next attempt is due.
+func (o *outbox) nextWait(now time.Time) time.Duration {
+	o.Lock()
+	defer o.Unlock()
+
+	wait := idleOutboxWait
+	for _, email := range o.queue {
+		if w := email.NextAttempt.Sub(now); w < wait {
+			wait = w
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// pending returns the number of emails in the queue.
+func (o *outbox) pending() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.queue)
+}
+
+// load reads the queue from the store, the emails that can't be decrypted are
+// dropped.
+func (o *outbox) load() {
+	var stored []storedEmail
+	err := o.store.Load(&stored)
+	if err != nil {
+		log.Println("Can't load the outgoing emails:", err)
+		return
+	}
+	nonceSize := o.sealer.NonceSize()
+	for _, s := range stored {
+		var sealed sealedEmail
+		if len(s.Sealed) < nonceSize {
+			log.Println("Dropping an outgoing email that is not encrypted")
+			continue
+		}
+		plaintext, err := o.sealer.Open(nil, s.Sealed[:nonceSize], s.Sealed[nonceSize:], []byte(o.address))
+		if err == nil {
+			err = json.Unmarshal(plaintext, &sealed)
+		}
+		if err != nil {
+			log.Println("Dropping an outgoing email that can't be decrypted:", err)
+			continue
+		}
+		o.queue = append(o.queue, &outgoingEmail{
+			To:          sealed.To,
+			Message:     sealed.Message,
+			Attempts:    s.Attempts,
+			NextAttempt: s.NextAttempt,
+			LastError:   sealed.LastError,
+		})
+	}
+}
+
+// save needs to be called with the lock held.
+func (o *outbox) save() {
+	if o.store == nil {
+		return
+	}
+	stored := make([]storedEmail, 0, len(o.queue))
+	for _, email := range o.queue {
+		plaintext, err := json.Marshal(sealedEmail{To: email.To, Message: email.Message, LastError: email.LastError})
+		if err != nil {
+			log.Println("Can't encode an outgoing email:", err)
+			continue
+		}
+		nonce := make([]byte, o.sealer.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			log.Println("Can't encrypt an outgoing email:", err)
+			continue
+		}
+		stored = append(stored, storedEmail{
+			Sealed:      o.sealer.Seal(nonce, nonce, plaintext, []byte(o.address)),
+			Attempts:    email.Attempts,
+			NextAttempt: email.NextAttempt,
+		})
+	}
+	err := o.store.Save(stored)
+	if err != nil {
+		log.Println("Can't save the outgoing emails:", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+func TestOutboxRetry(t *testing.T) {
+	failures := map[string]int{"retry@example.org": 2, "dead@example.org": maxSendAttempts}
+	var sent []string
+	send := func(to string, msg []byte) error {
+		if failures[to] > 0 {
+			failures[to]--
+			return errors.New("temporary failure")
+		}
+		sent = append(sent, to)
+		return nil
+	}
+
+	o := newOutbox("test@example.com", send, nil, nil)
+	o.enqueue("ok@example.org", []byte("hello"))
+	o.enqueue("retry@example.org", []byte("hello"))
+	o.enqueue("dead@example.org", []byte("hello"))
+
+	now := time.Now()
+	o.sendDue(now)
+	if len(sent) != 1 || sent[0] != "ok@example.org" || o.pending() != 2 {
+		t.Fatalf("Wrong first attempt: %v %d", sent, o.pending())
+	}
+
+	// nothing is retried before the backoff
+	o.sendDue(now.Add(firstRetryDelay / 2))
+	if len(sent) != 1 {
+		t.Errorf("Retried before the backoff: %v", sent)
+	}
+
+	for i := 0; i < maxSendAttempts; i++ {
+		now = now.Add(maxRetryDelay)
+		o.sendDue(now)
+	}
+	if len(sent) != 2 || sent[1] != "retry@example.org" {
+		t.Errorf("The retry was not sent: %v", sent)
+	}
+	if o.pending() != 0 {
+		t.Errorf("The failed email was not dropped: %d", o.pending())
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := newOutbox("test@example.com", nil, nil, nil)
+	for attempts, expected := range map[int]time.Duration{
+		1:  firstRetryDelay,
+		2:  2 * firstRetryDelay,
+		3:  4 * firstRetryDelay,
+		20: maxRetryDelay,
+	} {
+		if delay := o.backoff(attempts); delay != expected {
+			t.Errorf("Wrong backoff for %d attempts: %s", attempts, delay)
+		}
+	}
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := pjson.New("outbox", dir)
+	sealer := newSenderHasher(&internal.EmailConfig{}).cipher("outbox")
+
+	failing := func(to string, msg []byte) error { return errors.New("down") }
+	o := newOutbox("test@example.com", failing, store, sealer)
+	o.enqueue("user@example.org", []byte("hello"))
+	o.sendDue(time.Now())
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "outbox.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("user@example.org")) || bytes.Contains(raw, []byte("down")) {
+		t.Errorf("The outbox is stored in plaintext: %s", raw)
+	}
+	if newOutbox("test@example.com", failing, store, newSenderHasher(&internal.EmailConfig{}).cipher("outbox")).pending() != 0 {
+		t.Error("The outbox was loaded with another key")
+	}
+
+	sent := make(chan string, 1)
+	o = newOutbox("test@example.com", func(to string, msg []byte) error {
+		sent <- to + " " + string(msg)
+		return nil
+	}, store, sealer)
+	if o.pending() != 1 {
+		t.Fatalf("The pending email was not loaded: %d", o.pending())
+	}
+	o.retryDelay = time.Millisecond
+	o.queue[0].NextAttempt = time.Now()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go o.run(stop)
+	select {
+	case msg := <-sent:
+		if msg != "user@example.org hello" {
+			t.Errorf("Wrong email sent: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The pending email was not sent")
+	}
+}
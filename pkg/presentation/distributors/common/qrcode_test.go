@@ -0,0 +1,258 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestQRCodeCapacity(t *testing.T) {
+	// data codewords of the level M, from the standard
+	for version, codewords := range map[int]int{
+		1: 16, 2: 28, 3: 44, 4: 64, 5: 86, 6: 108, 7: 124, 8: 154, 9: 182, 10: 216, 40: 2334,
+	} {
+		if n := qrNumDataCodewords(version); n != codewords {
+			t.Errorf("Wrong number of data codewords for version %d: %d", version, n)
+		}
+	}
+
+	_, err := NewQRCode(make([]byte, 2332))
+	if err != QRCodeTooLongError {
+		t.Error("Expected too long error:", err)
+	}
+}
+
+// The golden vectors of the tests below are from ISO/IEC 18004, they check the
+// encoder against the standard instead of against itself.
+
+func TestQRCodeFormatBits(t *testing.T) {
+	// the format information of the level M, from the table C.1
+	for mask, expected := range []int{0x5412, 0x5125, 0x5e7c, 0x5b4b, 0x45f9, 0x40ce, 0x4f97, 0x4aa0} {
+		if bits := qrFormatBits(mask); bits != expected {
+			t.Errorf("Wrong format bits for the mask %d: %015b instead of %015b", mask, bits, expected)
+		}
+	}
+}
+
+func TestQRCodeVersionBits(t *testing.T) {
+	// the version information, from the table D.1
+	for version, expected := range map[int]int{
+		7: 0x07c94, 8: 0x085bc, 9: 0x09a99, 10: 0x0a4d3, 21: 0x15683, 32: 0x209d5, 40: 0x28c69,
+	} {
+		if bits := qrVersionBits(version); bits != expected {
+			t.Errorf("Wrong version bits for version %d: %018b instead of %018b", version, bits, expected)
+		}
+	}
+}
+
+func TestQRCodeAlignmentPositions(t *testing.T) {
+	// the row and column coordinates of the alignment patterns, from the
+	// table E.1
+	for version, expected := range map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		14: {6, 26, 46, 66},
+		22: {6, 26, 50, 74, 98},
+		32: {6, 34, 60, 86, 112, 138},
+		36: {6, 24, 50, 76, 102, 128, 154},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	} {
+		q := &QRCode{version: version, size: version*4 + 17}
+		if positions := q.alignmentPositions(); fmt.Sprint(positions) != fmt.Sprint(expected) {
+			t.Errorf("Wrong alignment patterns for version %d: %v instead of %v", version, positions, expected)
+		}
+	}
+}
+
+func TestQRCodeReedSolomon(t *testing.T) {
+	// the generator polynomial of degree 10 as exponents of alpha, from
+	// the annex A
+	exponents := []int{251, 67, 46, 61, 118, 70, 64, 94, 32, 45}
+	for i, coefficient := range reedSolomonDivisor(10) {
+		expected := byte(1)
+		for j := 0; j < exponents[i]; j++ {
+			expected = gfMultiply(expected, 2)
+		}
+		if coefficient != expected {
+			t.Errorf("Wrong coefficient %d of the generator polynomial: %#x instead of %#x", i, coefficient, expected)
+		}
+	}
+
+	// the data codewords of the version 1-M symbol of the annex I, that
+	// encodes "01234567", and its error correction codewords
+	data := []byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11}
+	expected := []byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55}
+	if ecc := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ecc, expected) {
+		t.Errorf("Wrong error correction codewords: %x instead of %x", ecc, expected)
+	}
+}
+
+// readQRCode reads back the data of the symbol, checking the format bits and
+// the error correction codewords.
+func readQRCode(t *testing.T, q *QRCode) []byte {
+	bits := 0
+	for i := 0; i <= 5; i++ {
+		if q.modules[i][8] {
+			bits |= 1 << uint(i)
+		}
+	}
+	for i, pos := range [][2]int{{8, 7}, {8, 8}, {7, 8}} {
+		if q.modules[pos[1]][pos[0]] {
+			bits |= 1 << uint(6+i)
+		}
+	}
+	for i := 9; i < 15; i++ {
+		if q.modules[8][14-i] {
+			bits |= 1 << uint(i)
+		}
+	}
+	bits ^= 0x5412
+	if bits>>13 != qrFormatBitsM {
+		t.Fatalf("Wrong error correction level: %d", bits>>13)
+	}
+	mask := (bits >> 10) & 7
+	rem := bits >> 10
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	if rem != bits&0x3ff {
+		t.Fatal("Wrong format bits checksum")
+	}
+
+	q.applyMask(mask)
+	defer q.applyMask(mask)
+	var raw []byte
+	var current byte
+	n := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if q.isFunction[y][x] {
+					continue
+				}
+				current <<= 1
+				if q.modules[y][x] {
+					current |= 1
+				}
+				n++
+				if n%8 == 0 {
+					raw = append(raw, current)
+				}
+			}
+		}
+	}
+
+	numBlocks := qrNumBlocksM[q.version]
+	eccLen := qrECCPerBlockM[q.version]
+	rawCodewords := qrNumRawDataModules(q.version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i < shortBlockLen+1; i++ {
+		for j := range blocks {
+			if i == shortBlockLen-eccLen && j < numShortBlocks {
+				continue
+			}
+			blocks[j] = append(blocks[j], raw[k])
+			k++
+		}
+	}
+
+	var data []byte
+	for _, block := range blocks {
+		// the codewords are a multiple of the generator, so they evaluate
+		// to zero in all of its roots
+		root := byte(1)
+		for i := 0; i < eccLen; i++ {
+			var value byte
+			for _, c := range block {
+				value = gfMultiply(value, root) ^ c
+			}
+			if value != 0 {
+				t.Fatal("Wrong error correction codewords")
+			}
+			root = gfMultiply(root, 2)
+		}
+		data = append(data, block[:len(block)-eccLen]...)
+	}
+
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("Wrong mode: %x", data[0]>>4)
+	}
+	var bb bitBuffer
+	for _, b := range data {
+		bb.append(int(b), 8)
+	}
+	readBits := func(start, length int) int {
+		v := 0
+		for _, b := range bb[start : start+length] {
+			v <<= 1
+			if b {
+				v |= 1
+			}
+		}
+		return v
+	}
+	countBits := qrCharCountBits(q.version)
+	length := readBits(4, countBits)
+	result := make([]byte, length)
+	for i := range result {
+		result[i] = byte(readBits(4+countBits+i*8, 8))
+	}
+	return result
+}
+
+func TestQRCode(t *testing.T) {
+	bridges := "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw iat-mode=0"
+	for _, data := range []string{"", "a", "bridges", bridges, strings.Repeat(bridges, 3), strings.Repeat("x", 2331)} {
+		q, err := NewQRCode([]byte(data))
+		if err != nil {
+			t.Fatalf("Can't encode %d bytes: %v", len(data), err)
+		}
+		if q.size != q.version*4+17 {
+			t.Errorf("Wrong size %d for version %d", q.size, q.version)
+		}
+		if read := readQRCode(t, q); string(read) != data {
+			t.Errorf("Wrong data read back for %d bytes: %q", len(data), read)
+		}
+	}
+}
+
+func TestQRCodePNG(t *testing.T) {
+	q, err := NewQRCode([]byte("bridges"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := q.PNG(4)
+	if err != nil {
+		t.Fatal("Can't encode the PNG:", err)
+	}
+	img, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal("Can't decode the PNG:", err)
+	}
+	width := (21 + qrQuietZone*2) * 4
+	if img.Bounds().Dx() != width || img.Bounds().Dy() != width {
+		t.Errorf("Wrong image size: %v", img.Bounds())
+	}
+	// the corner of the top left finder pattern is dark
+	if r, _, _, _ := img.At(qrQuietZone*4, qrQuietZone*4).RGBA(); r != 0 {
+		t.Error("The finder pattern is not dark")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/email"
+)
+
+const (
+	replyLimitWindow = time.Hour
+
+	limitSender = "sender"
+	limitDomain = "domain"
+)
+
+var throttledEmailsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "email_throttled_total",
+	Help: "The total number of emails not replied because their sender or its domain got too many replies",
+},
+	[]string{"address", "limit"},
+)
+
+// replyHistory are the times of the replies in the last hour.  The senders are
+// hashed with a secret key, to not keep the email addresses on disk.
+type replyHistory struct {
+	Senders map[core.Hashkey][]time.Time `json:"senders"`
+	Domains map[string][]time.Time       `json:"domains"`
+}
+
+// replyLimiter limits the replies to each sender and to each domain, so a
+// forged or abusive sender can't make us send unlimited emails.  It's nil if
+// there are no limits.
+type replyLimiter struct {
+	sync.Mutex
+	maxSender int
+	maxDomain int
+	hasher    *senderHasher
+	history   replyHistory
+	store     persistence.Mechanism
+}
+
+func newReplyLimiter(cfg *internal.EmailConfig) *replyLimiter {
+	if cfg.MaxRepliesPerHour <= 0 && cfg.MaxDomainRepliesPerHour <= 0 {
+		return nil
+	}
+
+	l := &replyLimiter{
+		maxSender: cfg.MaxRepliesPerHour,
+		maxDomain: cfg.MaxDomainRepliesPerHour,
+		hasher:    newSenderHasher(cfg),
+	}
+	if cfg.StorageDir != "" {
+		l.store = pjson.New("replies-"+cfg.Address, cfg.StorageDir)
+		err := l.store.Load(&l.history)
+		if err != nil {
+			log.Println("Can't load the email replies:", err)
+		}
+	}
+	if l.history.Senders == nil {
+		l.history.Senders = make(map[core.Hashkey][]time.Time)
+	}
+	if l.history.Domains == nil {
+		l.history.Domains = make(map[string][]time.Time)
+	}
+	return l
+}
+
+// senderKeys returns the keys of the normalized address and of its domain.
+func (l *replyLimiter) senderKeys(address string) (core.Hashkey, string) {
+	address = email.NormalizeAddress(address)
+	domain := ""
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		domain = address[i+1:]
+	}
+	return l.hasher.hash(address), domain
+}
+
+// allow checks if we can reply to the address.  If we can't it returns false
+// and the limit that was hit, sender or domain.
+func (l *replyLimiter) allow(address string) (bool, string) {
+	if l == nil {
+		return true, ""
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	sender, domain := l.senderKeys(address)
+	if l.maxSender > 0 && len(pruneReplies(l.history.Senders[sender], now)) >= l.maxSender {
+		return false, limitSender
+	}
+	if l.maxDomain > 0 && domain != "" && len(pruneReplies(l.history.Domains[domain], now)) >= l.maxDomain {
+		return false, limitDomain
+	}
+	return true, ""
+}
+
+// record adds a reply to the address to the history.
+func (l *replyLimiter) record(address string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	sender, domain := l.senderKeys(address)
+	l.history.Senders[sender] = append(l.history.Senders[sender], now)
+	if domain != "" {
+		l.history.Domains[domain] = append(l.history.Domains[domain], now)
+	}
+	l.prune(now)
+	l.save()
+}
+
+// prune forgets the replies out of the window, it needs to be called with the
+// lock held.
+func (l *replyLimiter) prune(now time.Time) {
+	for sender, replies := range l.history.Senders {
+		if replies = pruneReplies(replies, now); len(replies) == 0 {
+			delete(l.history.Senders, sender)
+		} else {
+			l.history.Senders[sender] = replies
+		}
+	}
+	for domain, replies := range l.history.Domains {
+		if replies = pruneReplies(replies, now); len(replies) == 0 {
+			delete(l.history.Domains, domain)
+		} else {
+			l.history.Domains[domain] = replies
+		}
+	}
+}
+
+func (l *replyLimiter) save() {
+	if l.store == nil {
+		return
+	}
+	err := l.store.Save(l.history)
+	if err != nil {
+		log.Println("Can't save the email replies:", err)
+	}
+}
+
+func pruneReplies(replies []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(replies) && now.Sub(replies[i]) >= replyLimitWindow {
+		i++
+	}
+	return replies[i:]
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestReplyLimiter(t *testing.T) {
+	if newReplyLimiter(&internal.EmailConfig{}) != nil {
+		t.Error("Limiter created without limits")
+	}
+	var nilLimiter *replyLimiter
+	if ok, _ := nilLimiter.allow("user@example.org"); !ok {
+		t.Error("The nil limiter didn't allow a reply")
+	}
+
+	dir, err := ioutil.TempDir("", "replies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &internal.EmailConfig{
+		Address:                 "test@example.com",
+		MaxRepliesPerHour:       2,
+		MaxDomainRepliesPerHour: 3,
+		StorageDir:              dir,
+	}
+
+	l := newReplyLimiter(cfg)
+	l.record("user@gmail.com")
+	l.record("u.s.e.r+gettor@gmail.com")
+	if ok, limit := l.allow("User@Gmail.com"); ok || limit != limitSender {
+		t.Errorf("The sender was not throttled: %v %s", ok, limit)
+	}
+	if ok, _ := l.allow("other@gmail.com"); !ok {
+		t.Error("Other sender of the domain was throttled")
+	}
+	l.record("other@gmail.com")
+	if ok, limit := l.allow("another@gmail.com"); ok || limit != limitDomain {
+		t.Errorf("The domain was not throttled: %v %s", ok, limit)
+	}
+	if ok, _ := l.allow("user@riseup.net"); !ok {
+		t.Error("Sender of other domain was throttled")
+	}
+
+	// the limits survive restarts
+	l = newReplyLimiter(cfg)
+	if ok, _ := l.allow("user@gmail.com"); ok {
+		t.Error("The sender was not throttled after loading the replies")
+	}
+
+	// and they expire after an hour
+	sender, _ := l.senderKeys("user@gmail.com")
+	for i := range l.history.Senders[sender] {
+		l.history.Senders[sender][i] = time.Now().Add(-replyLimitWindow)
+	}
+	if ok, limit := l.allow("user@gmail.com"); ok || limit != limitDomain {
+		t.Errorf("The sender was throttled after the window: %v %s", ok, limit)
+	}
+}
+
+func TestSenderHasher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &internal.EmailConfig{Address: "test@example.com", StorageDir: dir}
+
+	h := newSenderHasher(cfg)
+	if h.hash("user@gmail.com") == core.NewHashkey("user@gmail.com") {
+		t.Error("The sender was hashed without the key")
+	}
+	if newSenderHasher(cfg).hash("user@gmail.com") != h.hash("user@gmail.com") {
+		t.Error("The key of the storage dir was not kept")
+	}
+	if newSenderHasher(&internal.EmailConfig{}).hash("user@gmail.com") == h.hash("user@gmail.com") {
+		t.Error("Two keys hashed the sender to the same value")
+	}
+
+	cfg.HashKeyFile = dir + "/key"
+	if err := ioutil.WriteFile(cfg.HashKeyFile, []byte("c2hvcnQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHashKey(cfg.HashKeyFile, false); err == nil {
+		t.Error("Loaded a short hash key")
+	}
+	if _, err := loadHashKey(dir+"/missing", false); err == nil {
+		t.Error("Created the configured hash key file")
+	}
+}
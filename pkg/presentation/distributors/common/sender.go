@@ -0,0 +1,132 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// The actions for the emails that fail the sender verification
+	SenderVerificationDrop = "drop"
+	SenderVerificationFlag = "flag"
+)
+
+var (
+	SenderNotVerifiedError = errors.New("the sender couldn't be verified with DKIM or SPF")
+	MissingSenderError     = errors.New("the email doesn't have a single sender")
+
+	commentRegexp = regexp.MustCompile(`\([^)]*\)`)
+)
+
+// verifySender checks that the From address of the email is not spoofed.  It
+// needs a valid DKIM signature of the domain of the address, or an SPF pass
+// of the domain of the envelope sender recorded by our MTA in an
+// Authentication-Results header with authservID.  The domains only need to
+// have the same organizational domain, like mail.example.com and example.com.
+func verifySender(raw []byte, email *mail.Message, authservID string, lookup txtLookupFunc) error {
+	from, err := fromAddress(email.Header)
+	if err != nil {
+		return err
+	}
+	fromDomain := addressDomain(from.Address)
+
+	domains, dkimErr := verifyDKIM(raw, lookup)
+	for _, domain := range domains {
+		if alignedDomains(domain, fromDomain) {
+			return nil
+		}
+	}
+
+	if authservID != "" {
+		result, domain := spfResult(email.Header, authservID)
+		if result == "pass" && alignedDomains(domain, fromDomain) {
+			return nil
+		}
+	}
+
+	if dkimErr != nil {
+		return fmt.Errorf("%w: %v", SenderNotVerifiedError, dkimErr)
+	}
+	return fmt.Errorf("%w: the DKIM signatures are not of %s", SenderNotVerifiedError, fromDomain)
+}
+
+// fromAddress returns the only address of the From header.  Emails with
+// several From headers are rejected, as different parts of the code could
+// look at different ones and the DKIM signature could be of another one.
+func fromAddress(header mail.Header) (*mail.Address, error) {
+	if len(header["From"]) != 1 {
+		return nil, MissingSenderError
+	}
+	from, err := header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return nil, MissingSenderError
+	}
+	return from[0], nil
+}
+
+// spfResult returns the SPF result and the domain of the envelope sender from
+// the first Authentication-Results header of our MTA.  The MTA adds it on top
+// of the ones that came with the email, that can be forged.
+func spfResult(header mail.Header, authservID string) (result string, domain string) {
+	for _, value := range header["Authentication-Results"] {
+		value = commentRegexp.ReplaceAllString(value, "")
+		parts := strings.Split(value, ";")
+		id := strings.Fields(parts[0])
+		if len(id) == 0 || !strings.EqualFold(id[0], authservID) {
+			continue
+		}
+
+		for _, part := range parts[1:] {
+			words := strings.Fields(part)
+			if len(words) == 0 || !strings.HasPrefix(strings.ToLower(words[0]), "spf=") {
+				continue
+			}
+			result = strings.TrimPrefix(strings.ToLower(words[0]), "spf=")
+			for _, property := range words[1:] {
+				kv := strings.SplitN(property, "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "smtp.mailfrom") {
+					domain = addressDomain(kv[1])
+				}
+			}
+			return result, domain
+		}
+		return "", ""
+	}
+	return "", ""
+}
+
+// addressDomain returns the domain of an email address, or the address itself
+// if it's only a domain.
+func addressDomain(address string) string {
+	address = strings.Trim(address, "<>")
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		address = address[i+1:]
+	}
+	return strings.ToLower(address)
+}
+
+// alignedDomains checks if both domains have the same organizational domain.
+func alignedDomains(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return organizationalDomain(a) == organizationalDomain(b)
+}
+
+func organizationalDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+// tokenBucket allows rate events per minute, with bursts of up to a minute
+// worth of them.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take returns true if there was a token, otherwise it returns when the next
+// one will be available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Minutes() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, now
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Minute))
+	return false, now.Add(wait)
+}
+
+// sendShaper limits the rate of the replies sent to each recipient domain, as
+// the big providers throttle or block the senders of bursts of emails.  A nil
+// sendShaper doesn't limit anything.
+type sendShaper struct {
+	defaultRate int
+	domainRates map[string]int
+	buckets     map[string]*tokenBucket
+}
+
+func newSendShaper(cfg *internal.EmailConfig) *sendShaper {
+	if cfg.SendRatePerMinute == 0 && len(cfg.DomainSendRatePerMinute) == 0 {
+		return nil
+	}
+	domainRates := make(map[string]int, len(cfg.DomainSendRatePerMinute))
+	for domain, rate := range cfg.DomainSendRatePerMinute {
+		domainRates[strings.ToLower(domain)] = rate
+	}
+	return &sendShaper{
+		defaultRate: cfg.SendRatePerMinute,
+		domainRates: domainRates,
+		buckets:     make(map[string]*tokenBucket),
+	}
+}
+
+// allow returns true if an email can be sent now to the address, otherwise it
+// returns when to try again.
+func (s *sendShaper) allow(address string, now time.Time) (bool, time.Time) {
+	if s == nil {
+		return true, now
+	}
+
+	domain := addressDomain(address)
+	rate, ok := s.domainRates[domain]
+	if !ok {
+		rate = s.defaultRate
+	}
+	if rate <= 0 {
+		return true, now
+	}
+
+	bucket, ok := s.buckets[domain]
+	if !ok {
+		bucket = &tokenBucket{}
+		s.buckets[domain] = bucket
+	}
+	bucket.rate = float64(rate)
+	return bucket.take(now)
+}
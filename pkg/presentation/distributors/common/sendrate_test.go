@@ -0,0 +1,57 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestSendShaper(t *testing.T) {
+	var sent []string
+	o := newOutbox("test@example.com", func(to string, msg []byte) error {
+		sent = append(sent, to)
+		return nil
+	}, nil, nil)
+	o.shaper = newSendShaper(&internal.EmailConfig{
+		SendRatePerMinute:       2,
+		DomainSendRatePerMinute: map[string]int{"Riseup.net": 1, "example.net": 0},
+	})
+
+	for _, to := range []string{"a@gmail.com", "b@gmail.com", "c@gmail.com", "a@riseup.net", "b@riseup.net", "a@example.net", "b@example.net", "c@example.net"} {
+		o.enqueue(to, []byte("hello"))
+	}
+
+	now := time.Now()
+	o.sendDue(now)
+	if len(sent) != 6 || o.pending() != 2 {
+		t.Fatalf("Wrong first burst: %v", sent)
+	}
+	if wait := o.nextWait(now); wait <= 0 || wait > time.Minute {
+		t.Errorf("Wrong wait for the delayed emails: %s", wait)
+	}
+
+	o.sendDue(now.Add(10 * time.Second))
+	if len(sent) != 6 {
+		t.Errorf("Emails sent over the rate: %v", sent)
+	}
+
+	o.sendDue(now.Add(time.Minute))
+	if len(sent) != 8 || o.pending() != 0 {
+		t.Errorf("The delayed emails were not sent: %v", sent)
+	}
+}
+
+func TestNoSendShaper(t *testing.T) {
+	shaper := newSendShaper(&internal.EmailConfig{})
+	if shaper != nil {
+		t.Fatal("Shaper created without rates")
+	}
+	if ok, _ := shaper.allow("test@example.org", time.Now()); !ok {
+		t.Error("A nil shaper should allow everything")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+const (
+	// StatusEndpoint is where every distributor frontend exposes the health
+	// and the stats of its distributor.
+	StatusEndpoint = "/status"
+)
+
+// Status is the response of the status endpoint.
+type Status struct {
+	Healthy bool               `json:"healthy"`
+	Error   string             `json:"error,omitempty"`
+	Stats   distributors.Stats `json:"stats"`
+}
+
+// StatusHandler returns a handler for the status endpoint of the given
+// distributor.  It answers with HTTP status code 503 if the distributor isn't
+// healthy, so it can be used for health checks.
+func StatusHandler(dist distributors.Distributor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := Status{
+			Healthy: true,
+			Stats:   dist.Stats(),
+		}
+		if err := dist.Healthz(); err != nil {
+			status.Healthy = false
+			status.Error = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Error encoding the status: %s", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+type testStatusDistributor struct {
+	resources int
+}
+
+func (d *testStatusDistributor) Init(cfg *internal.Config) {}
+func (d *testStatusDistributor) Shutdown()                 {}
+func (d *testStatusDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+func (d *testStatusDistributor) Stats() distributors.Stats {
+	return distributors.Stats{Resources: map[string]int{"obfs4": d.resources}}
+}
+
+func getStatus(t *testing.T, dist distributors.Distributor) (int, Status) {
+	w := httptest.NewRecorder()
+	StatusHandler(dist)(w, httptest.NewRequest("GET", StatusEndpoint, nil))
+
+	var status Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal("Can't decode the status:", err)
+	}
+	return w.Code, status
+}
+
+func TestStatusHandler(t *testing.T) {
+	dist := &testStatusDistributor{}
+	code, status := getStatus(t, dist)
+	if code != http.StatusServiceUnavailable {
+		t.Error("Wrong status code for an unhealthy distributor:", code)
+	}
+	if status.Healthy || status.Error != distributors.NoResourcesError.Error() {
+		t.Error("Wrong status for an unhealthy distributor:", status)
+	}
+
+	dist.resources = 3
+	code, status = getStatus(t, dist)
+	if code != http.StatusOK {
+		t.Error("Wrong status code for a healthy distributor:", code)
+	}
+	if !status.Healthy || status.Error != "" {
+		t.Error("Wrong status for a healthy distributor:", status)
+	}
+	if status.Stats.Resources["obfs4"] != 3 {
+		t.Error("Wrong stats:", status.Stats)
+	}
+}
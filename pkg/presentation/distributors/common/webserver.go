@@ -62,6 +62,9 @@ func ListenWebServer(listener net.Listener, apiCfg *internal.WebApiConfig, distC
 	}()
 
 	mux := http.NewServeMux()
+	if _, exists := handlers[StatusEndpoint]; !exists {
+		mux.Handle(StatusEndpoint, StatusHandler(dist))
+	}
 	for endpoint, handlerFunc := range handlers {
 		mux.Handle(endpoint, handlerFunc)
 	}
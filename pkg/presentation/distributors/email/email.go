@@ -0,0 +1,138 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/email"
+)
+
+// InitFrontend is the entry point to the bridges email frontend. It will
+// connect to it's IMAP account and reply to any incoming email until it
+// receives a SIGINT.
+func InitFrontend(cfg *internal.Config) {
+	dist := &email.EmailDistributor{}
+
+	handler := func(msg *mail.Message, send common.SendFunction) error {
+		from, err := mail.ParseAddress(msg.Header.Get("From"))
+		if err != nil {
+			return err
+		}
+		if !dist.IsAllowedAddress(from.Address) {
+			log.Printf("Ignoring email from a not allowed provider.")
+			return nil
+		}
+
+		subject := msg.Header.Get("Subject")
+		body := io.MultiReader(strings.NewReader(subject+" "), common.TextBody(msg))
+		command := dist.ParseCommand(body)
+		if command.Command == email.CommandHelp {
+			return sendHelp(dist, send)
+		}
+
+		ctx, cancel := common.NewRequestContext()
+		defer cancel()
+		resources, err := dist.GetResources(ctx, from.Address, command)
+		if err != nil {
+			if errors.Is(err, email.NoBridgesError) {
+				return send(bridgesSubject, noBridgesBody, "")
+			}
+			return err
+		}
+		bridgeLines := ""
+		lines := make([]string, len(resources))
+		for i, r := range resources {
+			bridgeLines += "\t" + r.String() + "\n"
+			lines[i] = r.String()
+		}
+		var attachments []common.Attachment
+		if qr, err := qrCodeAttachment(lines); err != nil {
+			log.Println("Can't create the QR code of the bridges:", err)
+		} else {
+			attachments = append(attachments, qr)
+		}
+		return send(bridgesSubject, fmt.Sprintf(bridgesBody, bridgeLines), "", attachments...)
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(common.StatusEndpoint, common.StatusHandler(dist))
+	go http.ListenAndServe(cfg.Distributors.Email.MetricsAddress, nil)
+
+	common.StartEmail(
+		&cfg.Distributors.Email.Email,
+		cfg,
+		dist,
+		handler,
+	)
+}
+
+// qrCodeAttachment returns a PNG with the QR code of the bridge lines, that
+// Tor Browser for Android can scan.
+func qrCodeAttachment(lines []string) (common.Attachment, error) {
+	q, err := common.NewQRCode([]byte(common.QRCodeBridges(lines)))
+	if err != nil {
+		return common.Attachment{}, err
+	}
+	png, err := q.PNG(qrCodeScale)
+	if err != nil {
+		return common.Attachment{}, err
+	}
+	return common.Attachment{Filename: "bridges.png", ContentType: "image/png", Content: png}, nil
+}
+
+func sendHelp(dist *email.EmailDistributor, send common.SendFunction) error {
+	types := ""
+	for _, t := range dist.SupportedTypes() {
+		types += "\t" + t + "\n"
+	}
+	return send(helpSubject, fmt.Sprintf(helpBody, types), "")
+}
+
+const (
+	// qrCodeScale is the number of pixels per module of the attached QR code
+	qrCodeScale = 4
+
+	bridgesSubject = "[Tor] Your bridges"
+	bridgesBody    = `This is an automated email response from the Tor bridges distributor.
+
+Here are your bridges:
+
+%s
+To use them, open Tor Browser settings, go to the "Connection" section and
+click on "Add a Bridge Manually". Copy the lines above and paste them there.
+In Tor Browser for Android you can scan instead the QR code attached to this
+email.
+
+You will get the same bridges if you ask again during the next hours.
+`
+	noBridgesBody = `This is an automated email response from the Tor bridges distributor.
+
+There are no bridges available for your request right now, please try again
+later or ask for another type of bridges.
+`
+	helpSubject = "[Tor] How to get bridges"
+	helpBody    = `This is an automated email response from the Tor bridges distributor.
+
+Bridges are hidden Tor relays that can circumvent censorship. To get bridges
+reply to this email writing "get bridges" in the body. By default you will
+get obfs4 bridges, you can ask for other type of bridges by writing its name
+in the email. We support the following types of bridges:
+
+%s
+If you want IPv6 bridges add the word "ipv6", for example:
+
+	get bridges obfs4 ipv6
+`
+)
@@ -0,0 +1,99 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/gettor"
+)
+
+const linksEndpoint = "/gettor/links"
+
+// apiLink is a link as the API returns it.
+type apiLink struct {
+	Product  string `json:"product"`
+	Platform string `json:"platform"`
+	Arch     string `json:"arch,omitempty"`
+	Channel  string `json:"channel"`
+	Locale   string `json:"locale"`
+	Version  string `json:"version"`
+	Provider string `json:"provider"`
+	FileName string `json:"file_name"`
+	Link     string `json:"link"`
+	SigLink  string `json:"sig_link"`
+	Checksum string `json:"checksum,omitempty"`
+	Magnet   string `json:"magnet,omitempty"`
+}
+
+type linksResponse struct {
+	Links []apiLink `json:"links"`
+}
+
+// startApi serves the links of the distributor as JSON in address.
+func startApi(address, token string, dist *gettor.GettorDistributor) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(linksEndpoint, linksHandler(dist, token))
+	log.Println("Starting the gettor links API at", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Println("The gettor links API failed:", err)
+	}
+}
+
+// linksHandler returns the links that the distributor hands out.  They can be
+// filtered with the product, platform, channel, locale and provider
+// parameters of the query.  If there is a token the requests need it as a
+// bearer token, otherwise any web page can get the links.
+func linksHandler(dist *gettor.GettorDistributor, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+				return
+			}
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		query := r.URL.Query()
+		links := dist.ListLinks(gettor.LinksFilter{
+			Product:  query.Get("product"),
+			Platform: query.Get("platform"),
+			Channel:  query.Get("channel"),
+			Locale:   query.Get("locale"),
+			Provider: query.Get("provider"),
+		})
+
+		response := linksResponse{Links: make([]apiLink, 0, len(links))}
+		for _, link := range links {
+			response.Links = append(response.Links, apiLink{
+				Product:  link.ReleaseProduct(),
+				Platform: link.Platform,
+				Arch:     link.Arch,
+				Channel:  link.ReleaseChannel(),
+				Locale:   link.Locale,
+				Version:  link.Version.String(),
+				Provider: link.Provider,
+				FileName: link.FileName,
+				Link:     link.Link,
+				SigLink:  link.SigLink,
+				Checksum: link.Checksum,
+				Magnet:   link.Magnet,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error encoding the gettor links: %v", err)
+		}
+	}
+}
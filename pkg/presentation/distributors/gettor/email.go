@@ -7,14 +7,30 @@ package gettor
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/mail"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/gettor"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	// maxSignatureSize is the maximum size of the signature files to attach
+	maxSignatureSize = 64 * 1024
+)
+
+var (
+	// attachSignatures attaches the signature files to the signature replies
+	attachSignatures bool
+	signatureClient  = &http.Client{Timeout: 30 * time.Second}
 )
 
 // InitFrontend is the entry point to gettor email frontend. It will connect
@@ -23,33 +39,31 @@ import (
 func InitFrontend(cfg *internal.Config) {
 	dist := &gettor.GettorDistributor{}
 
+	attachSignatures = cfg.Distributors.Gettor.AttachSignatures
+	var err error
+	locales, err = common.NewLocales(cfg.Distributors.Gettor.LocalesDir, "gettor")
+	if err != nil {
+		log.Fatalf("Can't load locales %s: %v", cfg.Distributors.Gettor.LocalesDir, err)
+	}
+
 	handler := func(msg *mail.Message, send common.SendFunction) error {
 		subject := msg.Header.Get("Subject")
-		body := io.MultiReader(strings.NewReader(subject+" "), msg.Body)
+		body := io.MultiReader(strings.NewReader(subject+" "), common.TextBody(msg))
 		command := dist.ParseCommand(body)
-		switch command.Command {
-		case gettor.CommandLinks:
-			links := dist.GetLinks(command.Platform, command.Locale)
-			if len(links) == 0 {
-				return sendHelp(dist, send)
-			}
-
-			linkMsg := ""
-			for _, link := range links {
-				linkMsg += "\t" + link.Provider + ": " + link.Link + "\n"
-				linkMsg += "\tSignature file: " + link.SigLink + "\n\n"
-			}
-			verificationComm := fmt.Sprintf(platformVerficationCommand[command.Platform[:3]], links[0].FileName, links[0].FileName)
-			body := fmt.Sprintf(linksBody, command.Platform, linkMsg, platformVerfication[command.Platform[:3]], verificationComm)
-			return send(linksSubject, body)
-		case gettor.CommandHelp:
-			return sendHelp(dist, send)
+		outcome, err := reply(dist, send, command)
+		if err != nil {
+			outcome = gettor.OutcomeSendFailed
 		}
-		return nil
+		gettor.CountReply(command, outcome)
+		return err
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(common.StatusEndpoint, common.StatusHandler(dist))
 	go http.ListenAndServe(cfg.Distributors.Gettor.MetricsAddress, nil)
+	if cfg.Distributors.Gettor.ApiAddress != "" {
+		go startApi(cfg.Distributors.Gettor.ApiAddress, cfg.Distributors.Gettor.ApiToken, dist)
+	}
 
 	common.StartEmail(
 		&cfg.Distributors.Gettor.Email,
@@ -59,6 +73,121 @@ func InitFrontend(cfg *internal.Config) {
 	)
 }
 
+// reply answers the command and returns the outcome of the reply for the
+// metrics.
+func reply(dist *gettor.GettorDistributor, send common.SendFunction, command *gettor.Command) (string, error) {
+	switch command.Command {
+	case gettor.CommandLinks:
+		if err := dist.CheckVersion(command); err != nil {
+			return gettor.OutcomeVersionNotAvailable, sendVersionNotAvailable(dist, send, command)
+		}
+		links, locale, fallback := dist.FindLinks(command)
+		if len(links) == 0 {
+			return gettor.OutcomeNoLinks, sendHelp(dist, send, command.Locale, nil)
+		}
+
+		linkMsg := ""
+		for _, link := range links {
+			linkMsg += "\t" + linkName(link) + ": " + link.Link + "\n"
+			linkMsg += "\tSignature file: " + link.SigLink + "\n"
+			if link.Checksum != "" {
+				linkMsg += "\tSHA-256: " + link.Checksum + "\n"
+			}
+			linkMsg += "\n"
+		}
+		if command.Torrent {
+			linkMsg += magnetList(links)
+		}
+		verificationComm := fmt.Sprintf(platformVerficationCommand[command.Platform[:3]], links[0].FileName, links[0].FileName)
+		body := localize(command.Locale, msgLinksBody, map[string]interface{}{
+			"Product":             isolate(command.Locale, productName(command)),
+			"Platform":            isolate(command.Locale, platformName(command)),
+			"LocaleNote":          localeNote(command.Locale, locale, fallback),
+			"Links":               linkMsg,
+			"Verification":        platformVerfication[command.Platform[:3]],
+			"VerificationCommand": verificationComm,
+		})
+		return gettor.OutcomeSent, send(localize(command.Locale, msgLinksSubject, nil), body, common.TextToHTML(body, isRTL(command.Locale)))
+	case gettor.CommandSignature:
+		if err := dist.CheckVersion(command); err != nil {
+			return gettor.OutcomeVersionNotAvailable, sendVersionNotAvailable(dist, send, command)
+		}
+		links, locale, fallback := dist.FindLinks(command)
+		if len(links) == 0 {
+			return gettor.OutcomeNoLinks, sendHelp(dist, send, command.Locale, nil)
+		}
+
+		linkMsg := ""
+		for _, link := range links {
+			linkMsg += "\t" + linkName(link) + ": " + link.SigLink + "\n"
+		}
+		body := fmt.Sprintf(signatureBody, productName(command), platformName(command), links[0].Version.String(), localeNote(command.Locale, locale, fallback), linkMsg)
+		var attachments []common.Attachment
+		if attachSignatures {
+			attachments = signatureAttachments(links)
+		}
+		return gettor.OutcomeSent, send(signatureSubject, body, "", attachments...)
+	case gettor.CommandChecksum:
+		version, ok := dist.LatestVersion(command.Product, command.Platform, command.Channel)
+		if command.Version != nil {
+			version, ok = *command.Version, true
+		}
+		if !ok {
+			return gettor.OutcomeNoLinks, sendHelp(dist, send, command.Locale, nil)
+		}
+
+		checksum, signature := dist.GetChecksumLinks(version)
+		body := fmt.Sprintf(checksumBody, version.String(), checksumList(dist.GetChecksums(command)), checksum, signature)
+		return gettor.OutcomeSent, send(checksumSubject, body, "")
+	case gettor.CommandHelp:
+		return gettor.OutcomeSent, sendHelp(dist, send, command.Locale, command.Error)
+	}
+	return gettor.OutcomeSent, nil
+}
+
+// signatureAttachments downloads the signature files of the links, the ones
+// that fail are not attached.
+func signatureAttachments(links []*resources.TBLink) []common.Attachment {
+	var attachments []common.Attachment
+	attached := make(map[string]bool)
+	for _, link := range links {
+		if link.SigLink == "" || attached[link.FileName] {
+			continue
+		}
+		signature, err := downloadSignature(link.SigLink)
+		if err != nil {
+			log.Println("Can't download the signature", link.SigLink, ":", err)
+			continue
+		}
+		attached[link.FileName] = true
+		attachments = append(attachments, common.Attachment{
+			Filename:    link.FileName + ".asc",
+			ContentType: "application/pgp-signature",
+			Content:     signature,
+		})
+	}
+	return attachments
+}
+
+func downloadSignature(url string) ([]byte, error) {
+	resp, err := signatureClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	signature, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) > maxSignatureSize {
+		return nil, fmt.Errorf("the signature is bigger than %d bytes", maxSignatureSize)
+	}
+	return signature, nil
+}
+
 func emailList(items []string) string {
 	str := ""
 	for _, item := range items {
@@ -67,103 +196,173 @@ func emailList(items []string) string {
 	return str
 }
 
-func sendHelp(dist *gettor.GettorDistributor, send common.SendFunction) error {
-	platforms := emailList(dist.SupportedPlatforms())
-	locales := emailList(dist.SupportedLocales())
-	body := fmt.Sprintf(helpBody, platforms, locales)
-	return send(helpSubject, body)
+// sendHelp sends the help in the locale, with the reason why the request
+// couldn't be parsed if parseErr is not nil.
+func sendHelp(dist *gettor.GettorDistributor, send common.SendFunction, locale string, parseErr error) error {
+	body := localize(locale, msgHelpBody, map[string]interface{}{
+		"Platforms": emailList(dist.SupportedPlatforms()),
+		"Locales":   emailList(dist.SupportedLocales()),
+	}) + productsHelp(dist.AvailableProducts())
+	if parseErr != nil {
+		body = localize(locale, msgHelpError, map[string]interface{}{
+			"Error": isolate(locale, parseErr.Error()),
+		}) + body
+	}
+	return send(localize(locale, msgHelpSubject, nil), body, common.TextToHTML(body, isRTL(locale)))
+}
+
+// platformName returns the platform of the command and its channel, if it's
+// not the release one.
+func platformName(command *gettor.Command) string {
+	if command.Channel == "" {
+		return command.Platform
+	}
+	return command.Platform + " (" + command.Channel + ")"
+}
+
+// productName returns the name of the product of the command.
+func productName(command *gettor.Command) string {
+	if command.Product == "" {
+		return resources.ProductNames[resources.ProductTorBrowser]
+	}
+	return resources.ProductNames[command.Product]
+}
+
+// productsHelp returns the help about the products other than Tor Browser, or
+// an empty string if we don't have links for any.
+func productsHelp(products []string) string {
+	if len(products) == 0 {
+		return ""
+	}
+	list := ""
+	for _, product := range products {
+		list += "\t" + product + "\t" + resources.ProductNames[product] + "\n"
+	}
+	return fmt.Sprintf(productsHelpBody, list)
+}
+
+// linkName returns the provider of the link and its architecture, if it has
+// one.
+func linkName(link *resources.TBLink) string {
+	if link.Arch == "" {
+		return link.Provider
+	}
+	return link.Provider + " (" + link.Arch + ")"
+}
+
+// magnetList returns the magnet links of the links, without repeating the ones
+// of the same file, or a note if there are none.
+func magnetList(links []*resources.TBLink) string {
+	list := ""
+	seen := make(map[string]bool)
+	for _, link := range links {
+		if link.Magnet == "" || seen[link.Magnet] {
+			continue
+		}
+		seen[link.Magnet] = true
+		list += "\t" + link.FileName + ": " + link.Magnet + "\n"
+	}
+	if list == "" {
+		return noMagnetsNote
+	}
+	return fmt.Sprintf(magnetsBody, list)
+}
+
+// checksumList returns the checksums in the format of sha256sum, sorted by
+// file name, or an empty string if there are none.
+func checksumList(checksums map[string]string) string {
+	if len(checksums) == 0 {
+		return ""
+	}
+	fileNames := make([]string, 0, len(checksums))
+	for fileName := range checksums {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	list := ""
+	for _, fileName := range fileNames {
+		list += "\t" + checksums[fileName] + "  " + fileName + "\n"
+	}
+	return fmt.Sprintf(checksumListBody, list)
+}
+
+// localeNote tells the user that the links are not for the requested locale,
+// if it's a fallback.
+func localeNote(requested, locale string, fallback bool) string {
+	if !fallback {
+		return ""
+	}
+	return localize(requested, msgLocaleFallback, map[string]interface{}{
+		"Requested": isolate(requested, requested),
+		"Locale":    isolate(requested, locale),
+	})
+}
+
+func sendVersionNotAvailable(dist *gettor.GettorDistributor, send common.SendFunction, command *gettor.Command) error {
+	latest, ok := dist.LatestVersion(command.Product, command.Platform, command.Channel)
+	if !ok {
+		return sendHelp(dist, send, command.Locale, nil)
+	}
+	body := fmt.Sprintf(versionNotAvailableBody, command.Version.String(), platformName(command), latest.String())
+	return send(localize(command.Locale, msgHelpSubject, nil), body, "")
 }
 
 var platformVerfication = map[string]string{
 	"win": "\tIf you run Windows, download Gpg4win and run its installer. In order to verify the\n\tsignature you will need to type a few commands in windows command-line, cmd.exe.",
 	"osx": "\tIf you are using macOS, you can install GPGTools. In order to verify the signature\n\tyou will need to type a few commands in the Terminal (under \"Applications\").",
 	"lin": "\tIf you are using GNU/Linux, then you probably already have GnuPG in your system,\n\tas most GNU/Linux distributions come with it preinstalled. In order to verify the\n\tsignature you will need to type a few commands in a terminal window.",
+	"and": "\tIf you are using Android, copy the APK and its signature to a computer with GnuPG.\n\tIn order to verify the signature you will need to type a few commands in a terminal\n\twindow.",
 }
 
 var platformVerficationCommand = map[string]string{
 	"win": "gpgv --keyring .\\tor.keyring Downloads\\%s.asc Downloads\\%s",
 	"lin": "gpgv --keyring ./tor.keyring ~/Downloads/%s.asc ~/Downloads/%s",
 	"osx": "gpgv --keyring ./tor.keyring ~/Downloads/%s.asc ~/Downloads/%s",
+	"and": "gpgv --keyring ./tor.keyring ~/Downloads/%s.asc ~/Downloads/%s",
 }
 
 const (
-	linksSubject = "[GetTor] Links for your request"
-	linksBody    = `This is an automated email response from GetTor.
-
-You requested Tor Browser for %s.
-
-Step 1: Download Tor Browser
-
-	First, try downloading Tor Browser from our mirrors:
-
+	signatureSubject = "[GetTor] Signature for your request"
+	signatureBody    = `This is an automated email response from GetTor.
 
+You requested the signature file of %s for %s, version %s:
 %s
-Step 2: Verify the signature (Optional)
-
-	Verifying the signature ensures that a certain package was generated by its
-	developers, and has not been tampered with.  This email provides links to signature
-	files that have the same name as the Tor Browser file, but end with ".asc" instead.
-
 %s
-
-	The Tor Browser team signs Tor Browser releases. Import the Tor Browser Developers
-	signing key (0xEF6E286DDA85EA2A4BA7DE684E2C6E8793298290):
-
-		gpg --auto-key-locate nodefault,wkd --locate-keys torbrowser@torproject.org
-
-	This should show you something like:
-
-		gpg: key 4E2C6E8793298290: public key "Tor Browser Developers (signing key) <torbrowser@torproject.org>" imported
-		gpg: Total number processed: 1
-		gpg:               imported: 1
-		pub   rsa4096 2014-12-15 [C] [expires: 2020-08-24]
-		      EF6E286DDA85EA2A4BA7DE684E2C6E8793298290
-		uid           [ unknown] Tor Browser Developers (signing key) <torbrowser@torproject.org>
-		sub   rsa4096 2018-05-26 [S] [expires: 2020-09-12]
-
-	After importing the key, you can save it to a file (identifying it by fingerprint here):
-
-		gpg --output ./tor.keyring --export 0xEF6E286DDA85EA2A4BA7DE684E2C6E8793298290
-
-	Next, you will need to download the corresponding ".asc" signature file and verify it
-	with the command:
-
-		%s
-
-	The result of the command should produce something like this:
-
-		gpgv: Signature made 07/08/19 04:03:49 Pacific Daylight Time
-		gpgv:                using RSA key EB774491D9FF06E2
-		gpgv: Good signature from "Tor Browser Developers (signing key) <torbrowser@torproject.org>"
-
-
-Step 3: Get Bridges (Optional)
-
-	If you believe that Tor is blocked where you are, you can use bridges to connect
-	to Tor.  Bridges are hidden Tor relays that can circumvent censorship.
-	Tor Browser includes a list of built-in bridges, which you should  try first.
-	You can activate built-in bridges inside of Tor Browser's settings, under the
-	"Tor" menu.  If built-in bridges don't work, try requesting different bridges,
-	which you can also do in the "Tor" menu inside Tor Browser's settings.
+	See the GetTor help for how to verify the signature.
 `
-	helpSubject = "[GetTor] Help Email"
-	helpBody    = `This is an automated email response from GetTor.
-
-GetTor can send you download links for Tor Browser.
-Simply reply to this email and write the operating system you want to install
-Tor Browser on in your response. We support the following operating systems:
+	checksumSubject = "[GetTor] Checksums for your request"
+	checksumBody    = `This is an automated email response from GetTor.
 
+You requested the checksums of Tor Browser %s:
 %s
+	Checksum file: %s
+	Signature file: %s
 
-GetTor will then respond with download instructions.
-If you want Tor Browser in a language other than English, mention one of the
-following language codes in your response:
+	The checksum file lists the SHA-256 of every Tor Browser file of the release
+	and it's signed by the Tor Browser developers.
+`
+	checksumListBody = `
+	These are the SHA-256 checksums of the files that GetTor distributes.  If you
+	downloaded Tor Browser from a mirror you don't trust, compare them with the
+	output of "sha256sum" on GNU/Linux, "shasum -a 256" on macOS or
+	"Get-FileHash" on Windows:
 
-%s
+%s`
+	versionNotAvailableBody = `This is an automated email response from GetTor.
 
-For example, if you want Tor Browser for Windows in Arabic your email content
-will look like:
+Tor Browser %s for %s is not available, the version that GetTor can send you is
+%s.  Write only the operating system in your response to get it.
+`
+	magnetsBody = `	You can also download the files with BitTorrent, open these magnet links
+	in your BitTorrent client:
 
-	windows ar
+%s
 `
+	noMagnetsNote    = "\tThere are no magnet links for these files yet.\n\n"
+	productsHelpBody = `
+GetTor can also send you other Tor software. Write its name with the operating
+system, like "orbot android". The following ones are available:
+
+%s`
 )
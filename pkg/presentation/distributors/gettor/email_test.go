@@ -0,0 +1,43 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestSignatureAttachments(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tor.exe.asc":
+			w.Write([]byte("-----BEGIN PGP SIGNATURE-----"))
+		case "/big.asc":
+			w.Write([]byte(strings.Repeat("a", maxSignatureSize+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	links := []*resources.TBLink{
+		{FileName: "tor.exe", SigLink: server.URL + "/tor.exe.asc"},
+		{FileName: "tor.exe", SigLink: server.URL + "/tor.exe.asc"},
+		{FileName: "big.exe", SigLink: server.URL + "/big.asc"},
+		{FileName: "missing.exe", SigLink: server.URL + "/missing.asc"},
+		{FileName: "nosig.exe"},
+	}
+	attachments := signatureAttachments(links)
+	if len(attachments) != 1 {
+		t.Fatalf("Wrong number of attachments: %d", len(attachments))
+	}
+	if attachments[0].Filename != "tor.exe.asc" || string(attachments[0].Content) != "-----BEGIN PGP SIGNATURE-----" {
+		t.Errorf("Wrong attachment: %v", attachments[0])
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"strings"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+)
+
+const (
+	// leftToRightIsolate and popDirectionalIsolate enclose the text that is
+	// always written left to right, like versions, platforms or commands, so
+	// it doesn't get reordered inside a right to left sentence
+	leftToRightIsolate    = "\u2066"
+	popDirectionalIsolate = "\u2069"
+)
+
+// The help and links emails are go-i18n messages, translated in the
+// gettor.<language>.json files of the locales_dir.  Their text is a
+// text/template filled with the data of the reply.
+var (
+	msgLinksSubject = &i18n.Message{
+		ID:    "GettorLinksSubject",
+		Other: "[GetTor] Links for your request",
+	}
+	msgLinksBody = &i18n.Message{
+		ID: "GettorLinksBody",
+		Other: `This is an automated email response from GetTor.
+
+You requested {{.Product}} for {{.Platform}}.
+{{.LocaleNote}}
+Step 1: Download Tor Browser
+
+	First, try downloading Tor Browser from our mirrors:
+
+
+{{.Links}}
+Step 2: Verify the signature (Optional)
+
+	Verifying the signature ensures that a certain package was generated by its
+	developers, and has not been tampered with.  This email provides links to signature
+	files that have the same name as the Tor Browser file, but end with ".asc" instead.
+
+{{.Verification}}
+
+	The Tor Browser team signs Tor Browser releases. Import the Tor Browser Developers
+	signing key (0xEF6E286DDA85EA2A4BA7DE684E2C6E8793298290):
+
+		gpg --auto-key-locate nodefault,wkd --locate-keys torbrowser@torproject.org
+
+	This should show you something like:
+
+		gpg: key 4E2C6E8793298290: public key "Tor Browser Developers (signing key) <torbrowser@torproject.org>" imported
+		gpg: Total number processed: 1
+		gpg:               imported: 1
+		pub   rsa4096 2014-12-15 [C] [expires: 2020-08-24]
+		      EF6E286DDA85EA2A4BA7DE684E2C6E8793298290
+		uid           [ unknown] Tor Browser Developers (signing key) <torbrowser@torproject.org>
+		sub   rsa4096 2018-05-26 [S] [expires: 2020-09-12]
+
+	After importing the key, you can save it to a file (identifying it by fingerprint here):
+
+		gpg --output ./tor.keyring --export 0xEF6E286DDA85EA2A4BA7DE684E2C6E8793298290
+
+	Next, you will need to download the corresponding ".asc" signature file and verify it
+	with the command:
+
+		{{.VerificationCommand}}
+
+	The result of the command should produce something like this:
+
+		gpgv: Signature made 07/08/19 04:03:49 Pacific Daylight Time
+		gpgv:                using RSA key EB774491D9FF06E2
+		gpgv: Good signature from "Tor Browser Developers (signing key) <torbrowser@torproject.org>"
+
+
+Step 3: Get Bridges (Optional)
+
+	If you believe that Tor is blocked where you are, you can use bridges to connect
+	to Tor.  Bridges are hidden Tor relays that can circumvent censorship.
+	Tor Browser includes a list of built-in bridges, which you should  try first.
+	You can activate built-in bridges inside of Tor Browser's settings, under the
+	"Tor" menu.  If built-in bridges don't work, try requesting different bridges,
+	which you can also do in the "Tor" menu inside Tor Browser's settings.
+`,
+	}
+	msgLocaleFallback = &i18n.Message{
+		ID: "GettorLocaleFallback",
+		Other: `
+	Tor Browser is not available in {{.Requested}}, the links are for the closest language
+	available: {{.Locale}}.
+`,
+	}
+	msgHelpSubject = &i18n.Message{
+		ID:    "GettorHelpSubject",
+		Other: "[GetTor] Help Email",
+	}
+	msgHelpError = &i18n.Message{
+		ID: "GettorHelpError",
+		Other: `Sorry, GetTor couldn't understand your request: {{.Error}}.
+
+`,
+	}
+	msgHelpBody = &i18n.Message{
+		ID: "GettorHelpBody",
+		Other: `This is an automated email response from GetTor.
+
+GetTor can send you download links for Tor Browser.
+Simply reply to this email and write the operating system you want to install
+Tor Browser on in your response. We support the following operating systems:
+
+{{.Platforms}}
+
+GetTor will then respond with download instructions.
+If you want Tor Browser in a language other than English, mention one of the
+following language codes in your response:
+
+{{.Locales}}
+
+For example, if you want Tor Browser for Windows in Arabic your email content
+will look like:
+
+	windows ar
+
+You can also write one of the following words with the operating system:
+
+	signature	to get only the signature files
+	checksums	to get the checksums of the files and the checksum file of
+			the release
+	torrent		to get also the magnet links to download the files with
+			BitTorrent
+	version 12.0.1	to get that version of Tor Browser, if it's available
+	alpha		to get the alpha version of Tor Browser, for testers
+	nightly		to get the nightly build of Tor Browser, for testers
+
+For Android you can also write the architecture of your phone, one of armv7,
+aarch64, x86 or x86_64, like:
+
+	android aarch64
+`,
+	}
+
+	// rtlLanguages are the languages written right to left
+	rtlLanguages = map[string]bool{
+		"ar": true,
+		"fa": true,
+		"he": true,
+		"ur": true,
+	}
+
+	locales *common.Locales
+)
+
+// localize translates the message to the locale of the command.
+func localize(locale string, msg *i18n.Message, data map[string]interface{}) string {
+	return common.Localize(locales.Localizer(locale), msg, data)
+}
+
+// isRTL checks if the locale is written right to left.
+func isRTL(locale string) bool {
+	lang := strings.SplitN(strings.ToLower(locale), "-", 2)[0]
+	return rtlLanguages[lang]
+}
+
+// isolate returns text, that is written left to right, ready to be included in
+// a sentence in the locale.  In right to left locales it's isolated, otherwise
+// the bidi algorithm can move around its numbers and punctuation.
+func isolate(locale, text string) string {
+	if !isRTL(locale) || text == "" {
+		return text
+	}
+	return leftToRightIsolate + text + popDirectionalIsolate
+}
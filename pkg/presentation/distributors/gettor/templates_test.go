@@ -0,0 +1,64 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+)
+
+const localesDir = "../../../../locales"
+
+func TestLocalizeTemplates(t *testing.T) {
+	var err error
+	locales, err = common.NewLocales(localesDir, "gettor")
+	if err != nil {
+		t.Fatal("Can't load locales:", err)
+	}
+
+	data := map[string]interface{}{
+		"Platforms": "\twindows\n",
+		"Locales":   "\tes-ES\n",
+	}
+	for locale, intro := range map[string]string{
+		"es-ES": "Este es un correo",
+		"en-US": "This is an automated email",
+		"fa":    "This is an automated email",
+	} {
+		body := localize(locale, msgHelpBody, data)
+		if !strings.HasPrefix(body, intro) {
+			t.Errorf("Wrong help for %s: %s", locale, body)
+		}
+		if !strings.Contains(body, "\twindows\n") || !strings.Contains(body, "\tes-ES\n") {
+			t.Errorf("The help for %s is missing the template data: %s", locale, body)
+		}
+	}
+
+	if subject := localize("pt-BR", msgHelpSubject, nil); subject != msgHelpSubject.Other {
+		t.Errorf("Untranslated locale didn't fall back to English: %s", subject)
+	}
+}
+
+func TestIsolate(t *testing.T) {
+	for locale, expected := range map[string]string{
+		"fa":    "⁦win32⁩",
+		"ar":    "⁦win32⁩",
+		"fa-IR": "⁦win32⁩",
+		"es-ES": "win32",
+		"en-US": "win32",
+	} {
+		if text := isolate(locale, "win32"); text != expected {
+			t.Errorf("Wrong isolation for %s: %q", locale, text)
+		}
+	}
+
+	locales, _ = common.NewLocales(localesDir, "gettor")
+	note := localeNote("fa", "en-US", true)
+	if !strings.Contains(note, "⁦en-US⁩") {
+		t.Errorf("The locale is not isolated in the persian note: %q", note)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+)
+
+const (
+	defaultFlyerNumBridges = 3
+	// flyerQRScale is the number of pixels per module of the QR codes, big
+	// enough to be scanned once printed
+	flyerQRScale = 6
+)
+
+var (
+	msgFlyerTitle = &i18n.Message{
+		ID:    "FlyerTitle",
+		Other: "Connect to Tor with bridges",
+	}
+	msgFlyerIntro = &i18n.Message{
+		ID:    "FlyerIntro",
+		Other: "If Tor is blocked where you are, bridges can help you connect. These bridges are not publicly listed, please share them only with people you trust.",
+	}
+	msgFlyerStepDownload = &i18n.Message{
+		ID:    "FlyerStepDownload",
+		Other: "Install Tor Browser from torproject.org or from a friend.",
+	}
+	msgFlyerStepConfigure = &i18n.Message{
+		ID:    "FlyerStepConfigure",
+		Other: "Open Tor Browser, go to the connection settings and choose to add a bridge manually.",
+	}
+	msgFlyerStepAdd = &i18n.Message{
+		ID:    "FlyerStepAdd",
+		Other: "Scan one of the QR codes with Tor Browser for Android, or type the bridge line next to it.",
+	}
+	msgFlyerNoBridges = &i18n.Message{
+		ID:    "FlyerNoBridges",
+		Other: "There are no bridges available right now, please try again later.",
+	}
+)
+
+var flyerTemplate = template.Must(template.New("flyer").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}" dir="{{.Dir}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+@page { size: A4; margin: 15mm; }
+body { font-family: sans-serif; max-width: 180mm; margin: auto; }
+ol { font-size: 1.1em; }
+.bridge { display: flex; align-items: center; page-break-inside: avoid; margin: 5mm 0; }
+.bridge img { width: 45mm; height: 45mm; image-rendering: pixelated; }
+.bridge code { font-size: 0.8em; word-break: break-all; margin: 0 5mm; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Intro}}</p>
+<ol>
+{{range .Steps}}<li>{{.}}</li>
+{{end}}</ol>
+{{range .Bridges}}<div class="bridge"><img src="{{.QRCode}}" alt=""><code dir="ltr">{{.Line}}</code></div>
+{{end}}</body>
+</html>
+`))
+
+type flyerBridge struct {
+	Line   string
+	QRCode template.URL
+}
+
+type flyerData struct {
+	Lang    string
+	Dir     string
+	Title   string
+	Intro   string
+	Steps   []string
+	Bridges []flyerBridge
+}
+
+// qrCodeDataURL returns the PNG of the QR code of text as a data URL, so the
+// flyer is a single self contained file.
+func qrCodeDataURL(text string) (template.URL, error) {
+	q, err := common.NewQRCode([]byte(text))
+	if err != nil {
+		return "", err
+	}
+	png, err := q.PNG(flyerQRScale)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// FlyerHandler handles requests for /flyer.  It renders a printable page with
+// a few bridges as QR codes and instructions in the language of the user, or
+// only the QR code of all the bridges if the format is png.
+func FlyerHandler(w http.ResponseWriter, r *http.Request) {
+	localizer := locales.Localizer(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+
+	num := flyerNumBridges
+	if n, err := strconv.Atoi(r.URL.Query().Get("bridges")); err == nil && n > 0 && n < num {
+		num = n
+	}
+	key := core.NewHashkey("flyer-" + requestAddressPrefix(r))
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	resources, err := dist.RequestFlyerBridges(ctx, key, num)
+	if err != nil {
+		http.Error(w, common.Localize(localizer, msgFlyerNoBridges, nil), http.StatusServiceUnavailable)
+		return
+	}
+	lines := make([]string, len(resources))
+	for i, res := range resources {
+		lines[i] = res.String()
+	}
+
+	if r.URL.Query().Get("format") == "png" {
+		q, err := common.NewQRCode([]byte(common.QRCodeBridges(lines)))
+		if err == nil {
+			var png []byte
+			png, err = q.PNG(flyerQRScale)
+			if err == nil {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(png)
+				return
+			}
+		}
+		log.Printf("Error creating the flyer QR code: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	lang, dir := common.PageLanguage(localizer, msgFlyerTitle)
+	data := flyerData{
+		Lang:  lang,
+		Dir:   dir,
+		Title: common.Localize(localizer, msgFlyerTitle, nil),
+		Intro: common.Localize(localizer, msgFlyerIntro, nil),
+		Steps: []string{
+			common.Localize(localizer, msgFlyerStepDownload, nil),
+			common.Localize(localizer, msgFlyerStepConfigure, nil),
+			common.Localize(localizer, msgFlyerStepAdd, nil),
+		},
+	}
+	for _, line := range lines {
+		qr, err := qrCodeDataURL(common.QRCodeBridges([]string{line}))
+		if err != nil {
+			log.Printf("Error creating the flyer QR code: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		data.Bridges = append(data.Bridges, flyerBridge{Line: line, QRCode: qr})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = flyerTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("Error rendering the flyer: %v", err)
+	}
+}
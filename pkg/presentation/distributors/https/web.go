@@ -5,23 +5,35 @@
 package https
 
 import (
-	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 
+	"gitlab.torproject.org/tpo/anti-censorship/geoip"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/https"
 )
 
-var dist *https.HttpsDistributor
+var (
+	dist            *https.HttpsDistributor
+	locales         *common.Locales
+	flyerNumBridges int
+	geoipdb         *geoip.Geoip
+)
 
 // mapRequestToHashkey maps the given HTTP request to a hash key.  It does so
 // by taking the /16 of the client's IP address.  For example, if the client's
 // address is 1.2.3.4, the function turns it into 1.2., computes its CRC64, and
 // returns the resulting hash key.
 func mapRequestToHashkey(r *http.Request) core.Hashkey {
+	return core.NewHashkey(requestAddressPrefix(r))
+}
+
+// requestAddressPrefix returns the /16 of the client's IP address.
+func requestAddressPrefix(r *http.Request) string {
 
 	i := 0
 	for numDots := 0; i < len(r.RemoteAddr) && numDots < 2; i++ {
@@ -32,33 +44,74 @@ func mapRequestToHashkey(r *http.Request) core.Hashkey {
 	slash16 := r.RemoteAddr[:i]
 	log.Printf("Using address prefix %q as hash key.", slash16)
 
-	return core.NewHashkey(slash16)
+	return slash16
 }
 
-// RequestHandler handles requests for /.
-func RequestHandler(w http.ResponseWriter, r *http.Request) {
+// requestIP returns the client's IP address, or nil if it can't be parsed.
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+// countryFromIP returns the lowercase country code of the ip, or an empty
+// string if it's unknown.
+func countryFromIP(ip net.IP) string {
+	country, ok := geoipdb.GetCountryByAddr(ip)
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(country)
+}
 
-	resources, err := dist.RequestBridges(mapRequestToHashkey(r))
+// RequestHandler handles requests for /.  It renders the bridges page with
+// bridges of the transport parameter, if any.
+func RequestHandler(w http.ResponseWriter, r *http.Request) {
+	page := common.BridgesPage{Transports: dist.SupportedTransports()}
+	page.Transport = common.RequestedTransport(r, page.Transports)
+
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	resources, err := dist.RequestBridges(ctx, mapRequestToHashkey(r), requestIP(r), page.Transport)
 	if err != nil {
-		fmt.Fprintf(w, err.Error())
+		log.Printf("Error requesting bridges: %v", err)
+		page.NoBridges = true
 	} else {
-		fmt.Fprintf(w, "Your %s bridge(s):<br>", resources[0].Type())
+		page.BridgesType = resources[0].Type()
 		for _, res := range resources {
-			fmt.Fprintf(w, fmt.Sprintf("<tt>%s</tt><br>", res.String()))
+			page.Bridges = append(page.Bridges, res.String())
 		}
 	}
+	locales.WriteBridgesPage(w, r, page)
 }
 
 // InitFrontend is the entry point to HTTPS's Web frontend.  It spins up the
 // Web server and then waits until it receives a SIGINT.
 func InitFrontend(cfg *internal.Config) {
 
+	var err error
+	locales, err = common.NewLocales(cfg.Distributors.Https.LocalesDir, "https")
+	if err != nil {
+		log.Fatalf("Can't load the locales: %v", err)
+	}
+	flyerNumBridges = cfg.Distributors.Https.FlyerNumBridges
+	if flyerNumBridges <= 0 {
+		flyerNumBridges = defaultFlyerNumBridges
+	}
+
 	dist = &https.HttpsDistributor{}
+	if cfg.Distributors.Https.ExcludeSameCountry {
+		geoipdb, err = geoip.New(cfg.Distributors.Https.GeoipDB, cfg.Distributors.Https.Geoip6DB)
+		if err != nil {
+			log.Fatal("Can't load geoip databases", cfg.Distributors.Https.GeoipDB, cfg.Distributors.Https.Geoip6DB, ":", err)
+		}
+		dist.CountryFromIP = countryFromIP
+	}
 	handlers := map[string]http.HandlerFunc{
-		"/": http.HandlerFunc(RequestHandler),
+		"/":      http.HandlerFunc(RequestHandler),
+		"/flyer": http.HandlerFunc(FlyerHandler),
 	}
 
 	common.StartWebServer(
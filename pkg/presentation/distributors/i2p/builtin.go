@@ -0,0 +1,249 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+)
+
+const (
+	// builtinPath is where the eepsite of the distributor serves the
+	// published files
+	builtinPath          = "/builtin/"
+	builtinFile          = "builtin.json"
+	builtinFeedFile      = "builtin.atom.xml"
+	builtinPublicKeyFile = "builtin.pub"
+	signatureSuffix      = ".sig"
+
+	defaultBuiltinIntervalMinutes = 60
+	defaultBuiltinType            = "obfs4"
+)
+
+// builtinList is the published builtin.json.
+type builtinList struct {
+	Updated time.Time           `json:"updated"`
+	Bridges map[string][]string `json:"bridges"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Summary string      `xml:"summary"`
+	Content atomContent `xml:"content"`
+}
+
+// atomContent is xhtml, as the I2P routers show the entries of their news
+// feed.
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Div  struct {
+		XMLName xml.Name `xml:"http://www.w3.org/1999/xhtml div"`
+		Pre     string   `xml:"pre"`
+	}
+}
+
+// builtinPublisher writes the builtin bridges, and a news feed announcing
+// them, to the docroot of an eepsite, so I2P users can get them without leaving
+// I2P.  Every file has a detached Ed25519 signature next to it, with the .sig
+// extension.
+type builtinPublisher struct {
+	cfg     *internal.I2PBuiltinConfig
+	key     ed25519.PrivateKey
+	fetcher *common.BridgesFetcher
+	// published are the bridges of the last publication
+	published []byte
+}
+
+// newBuiltinPublisher loads the signing key and publishes its public key.
+func newBuiltinPublisher(builtinCfg *internal.I2PBuiltinConfig) (*builtinPublisher, error) {
+	key, err := common.LoadSigningKey(builtinCfg.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	p := &builtinPublisher{
+		cfg:     builtinCfg,
+		key:     key,
+		fetcher: common.NewBridgesFetcher(),
+	}
+	err = p.writeSigned(builtinPublicKeyFile, []byte(base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))+"\n"))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// loop publishes the bridges every update interval.
+func (p *builtinPublisher) loop() {
+	interval := p.cfg.UpdateIntervalMinutes
+	if interval <= 0 {
+		interval = defaultBuiltinIntervalMinutes
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := p.publish(time.Now())
+		if err != nil {
+			log.Printf("Can't publish the builtin bridges: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// publish fetches the builtin bridges and publishes them if they changed.
+func (p *builtinPublisher) publish(now time.Time) error {
+	types := p.cfg.Types
+	if len(types) == 0 {
+		types = []string{defaultBuiltinType}
+	}
+	bridges := make(map[string][]string, len(types))
+	for _, bType := range types {
+		bridgeLines, err := p.fetcher.FetchBridges(p.cfg.BridgesURL + "bridges_list." + bType + ".txt")
+		if err != nil {
+			return err
+		}
+		if len(bridgeLines) == 0 {
+			continue
+		}
+		bridges[bType] = bridgeLines
+	}
+	if len(bridges) == 0 {
+		log.Println("There are no builtin bridges to publish.")
+		return nil
+	}
+
+	// json sorts the keys of the maps, so the same bridges encode the same
+	encoded, err := json.Marshal(bridges)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(encoded, p.published) {
+		return nil
+	}
+
+	list, err := json.MarshalIndent(builtinList{Updated: now.UTC(), Bridges: bridges}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = p.writeSigned(builtinFile, append(list, '\n'))
+	if err != nil {
+		return err
+	}
+	feed, err := p.feed(bridges, encoded, now)
+	if err != nil {
+		return err
+	}
+	err = p.writeSigned(builtinFeedFile, feed)
+	if err != nil {
+		return err
+	}
+
+	p.published = encoded
+	log.Printf("Published %d types of builtin bridges in %s.", len(bridges), p.cfg.PublishDir)
+	return nil
+}
+
+// feed returns the Atom feed with an entry for the current bridges.
+func (p *builtinPublisher) feed(bridges map[string][]string, encoded []byte, now time.Time) ([]byte, error) {
+	siteURL := strings.TrimSuffix(p.cfg.SiteURL, "/") + "/"
+	updated := now.UTC().Format(time.RFC3339)
+	hash := sha256.Sum256(encoded)
+
+	var types []string
+	var lines []string
+	for bType := range bridges {
+		types = append(types, bType)
+	}
+	sort.Strings(types)
+	for _, bType := range types {
+		lines = append(lines, bridges[bType]...)
+	}
+
+	entry := atomEntry{
+		ID:      "urn:sha256:" + hex.EncodeToString(hash[:]),
+		Title:   "Tor builtin bridges",
+		Updated: updated,
+		Link:    atomLink{Href: siteURL + builtinFile},
+		Summary: "New builtin bridges of Tor Browser: " + strings.Join(types, ", "),
+	}
+	entry.Content.Type = "xhtml"
+	entry.Content.Div.Pre = strings.Join(lines, "\n")
+
+	feed := atomFeed{
+		ID:      siteURL + builtinFeedFile,
+		Title:   "Tor builtin bridges",
+		Updated: updated,
+		Link:    atomLink{Href: siteURL + builtinFeedFile, Rel: "self"},
+		Author:  "rdsys",
+		Entries: []atomEntry{entry},
+	}
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
+
+// writeSigned writes the file and its signature in the publish dir.  The files
+// are replaced atomically, so the eepsite never serves half of a file.
+func (p *builtinPublisher) writeSigned(name string, content []byte) error {
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, content)) + "\n"
+	err := writeFileAtomic(filepath.Join(p.cfg.PublishDir, name), content)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(p.cfg.PublishDir, name+signatureSuffix), []byte(signature))
+}
+
+func writeFileAtomic(filename string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func readSigned(t *testing.T, dir, name string, key ed25519.PublicKey) []byte {
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ioutil.ReadFile(filepath.Join(dir, name+signatureSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || !ed25519.Verify(key, content, raw) {
+		t.Errorf("Wrong signature of %s: %v", name, err)
+	}
+	return content
+}
+
+func TestBuiltinPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builtin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bridgesDir := filepath.Join(dir, "bridges") + "/"
+	publishDir := filepath.Join(dir, "docroot")
+	for _, d := range []string{bridgesDir, publishDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bridgeLine := "obfs4 192.0.2.1:443 AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA cert=aaa iat-mode=0"
+	if err := ioutil.WriteFile(bridgesDir+"bridges_list.obfs4.txt", []byte("# builtin\n"+bridgeLine+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	seed := make([]byte, ed25519.SeedSize)
+	if err := ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(seed)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+
+	cfg := &internal.I2PBuiltinConfig{
+		PublishDir:     publishDir,
+		SiteURL:        "http://bridges.i2p/builtin",
+		BridgesURL:     bridgesDir,
+		SigningKeyFile: keyFile,
+	}
+	p, err := newBuiltinPublisher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := p.publish(now); err != nil {
+		t.Fatal(err)
+	}
+
+	published := readSigned(t, publishDir, builtinPublicKeyFile, publicKey)
+	if strings.TrimSpace(string(published)) != base64.StdEncoding.EncodeToString(publicKey) {
+		t.Errorf("Wrong public key: %s", published)
+	}
+	var list builtinList
+	if err := json.Unmarshal(readSigned(t, publishDir, builtinFile, publicKey), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Bridges["obfs4"]) != 1 || list.Bridges["obfs4"][0] != bridgeLine || !list.Updated.Equal(now) {
+		t.Errorf("Wrong builtin bridges: %v", list)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(readSigned(t, publishDir, builtinFeedFile, publicKey), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 1 || feed.Entries[0].Content.Div.Pre != bridgeLine || feed.Entries[0].Link.Href != "http://bridges.i2p/builtin/builtin.json" {
+		t.Errorf("Wrong feed: %+v", feed)
+	}
+
+	// the files are not written again if the bridges didn't change
+	if err := p.publish(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(readSigned(t, publishDir, builtinFile, publicKey), &list); err != nil || !list.Updated.Equal(now) {
+		t.Errorf("The same bridges were published again: %v %v", list, err)
+	}
+}
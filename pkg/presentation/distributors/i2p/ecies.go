@@ -0,0 +1,104 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/eyedeekay/i2pkeys"
+)
+
+const (
+	encryptionKeySize  = 256
+	x25519KeySize      = 32
+	destinationMinSize = encryptionKeySize + 128 + 3
+
+	keyCertificateType = 5
+	x25519CryptoType   = 4
+
+	// encryptionInfo is the info of the HKDF that derives the AES key
+	encryptionInfo = "rdsys-i2p-encrypted-v1"
+)
+
+var (
+	InvalidDestinationError        = errors.New("the destination is malformed")
+	UnsupportedEncryptionTypeError = errors.New("the destination doesn't have an X25519 encryption key")
+)
+
+// destinationEncryptionKey returns the X25519 public key of the destination,
+// the first 32 bytes of it.  Only the destinations with a key certificate of
+// the ECIES-X25519 crypto type are supported.
+func destinationEncryptionKey(destination string) (*ecdh.PublicKey, error) {
+	raw, err := i2pkeys.I2PAddr(destination).ToBytes()
+	if err != nil || len(raw) < destinationMinSize {
+		return nil, InvalidDestinationError
+	}
+	certificate := raw[encryptionKeySize+128:]
+	length := int(binary.BigEndian.Uint16(certificate[1:3]))
+	if len(certificate) < 3+length {
+		return nil, InvalidDestinationError
+	}
+	if certificate[0] != keyCertificateType || length < 4 || binary.BigEndian.Uint16(certificate[5:7]) != x25519CryptoType {
+		return nil, UnsupportedEncryptionTypeError
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw[:x25519KeySize])
+	if err != nil {
+		return nil, InvalidDestinationError
+	}
+	return key, nil
+}
+
+// encryptToDestination encrypts the message so only the owner of the private
+// keys of the destination can read it: the 32 bytes of an ephemeral X25519
+// public key followed by the message encrypted with AES-256-GCM.  The key is
+// the HKDF-SHA256 of the X25519 shared secret, and as it's only used once the
+// nonce is zero.  Both public keys are the additional data.
+func encryptToDestination(destination string, message []byte) ([]byte, error) {
+	publicKey, err := destinationEncryptionKey(destination)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, InvalidDestinationError
+	}
+
+	header := append(ephemeral.PublicKey().Bytes(), publicKey.Bytes()...)
+	aead, err := newDestinationAEAD(shared, header)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephemeral.PublicKey().Bytes(), nonce, message, header), nil
+}
+
+// newDestinationAEAD returns the AES-256-GCM of the key derived from the
+// shared secret and the public keys.
+func newDestinationAEAD(shared, publicKeys []byte) (cipher.AEAD, error) {
+	// HKDF-SHA256 with an empty salt, one block of output is the key
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(encryptionInfo))
+	expand.Write(publicKeys)
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
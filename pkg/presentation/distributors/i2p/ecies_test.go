@@ -0,0 +1,196 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eyedeekay/i2pkeys"
+	i2phttps "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/i2p"
+)
+
+// testDestination returns a destination with an Ed25519 key certificate and
+// the given crypto type, and the X25519 private key of it.
+func testDestination(t *testing.T, cryptoType byte) (string, *ecdh.PrivateKey) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := make([]byte, encryptionKeySize+128)
+	rand.Read(raw)
+	copy(raw, key.PublicKey().Bytes())
+	raw = append(raw, keyCertificateType, 0, 4, 0, 7, 0, cryptoType)
+	addr, err := i2pkeys.NewI2PAddrFromBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.Base64(), key
+}
+
+func decryptFromDestination(key *ecdh.PrivateKey, encrypted []byte) ([]byte, error) {
+	if len(encrypted) < x25519KeySize {
+		return nil, InvalidDestinationError
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(encrypted[:x25519KeySize])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	header := append(ephemeral.Bytes(), key.PublicKey().Bytes()...)
+	aead, err := newDestinationAEAD(shared, header)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), encrypted[x25519KeySize:], header)
+}
+
+func decryptBundle(t *testing.T, key *ecdh.PrivateKey, msg *encryptedBundle) *i2phttps.Bundle {
+	encrypted, err := base64.StdEncoding.DecodeString(msg.Encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := decryptFromDestination(key, encrypted)
+	if err != nil {
+		t.Fatal("Can't decrypt the bundle:", err)
+	}
+	var bundle i2phttps.Bundle
+	err = json.Unmarshal(plaintext, &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &bundle
+}
+
+func TestEncryptBundle(t *testing.T) {
+	destination, key := testDestination(t, x25519CryptoType)
+	bundle := &i2phttps.Bundle{
+		Type:       i2phttps.BundleMessage,
+		Bridges:    []string{"obfs4 1.2.3.4:1234 FINGERPRINT cert=foo iat-mode=0"},
+		ValidUntil: time.Now().UTC().Truncate(time.Second),
+	}
+
+	msg, err := encryptBundle(destination, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != bundle.Type {
+		t.Errorf("Wrong type of the encrypted bundle: %s", msg.Type)
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(msg.Encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte(bundle.Bridges[0])) {
+		t.Error("The bridges are in plaintext")
+	}
+
+	decrypted := decryptBundle(t, key, msg)
+	if len(decrypted.Bridges) != 1 || decrypted.Bridges[0] != bundle.Bridges[0] || !decrypted.ValidUntil.Equal(bundle.ValidUntil) {
+		t.Errorf("Wrong decrypted bundle: %v", decrypted)
+	}
+
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err := decryptFromDestination(key, encrypted); err == nil {
+		t.Error("A tampered bundle was decrypted")
+	}
+	_, otherKey := testDestination(t, x25519CryptoType)
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err := decryptFromDestination(otherKey, encrypted); err == nil {
+		t.Error("The bundle was decrypted with another key")
+	}
+}
+
+func TestEncryptUnsupportedDestination(t *testing.T) {
+	destination, _ := testDestination(t, 0)
+	_, err := encryptToDestination(destination, []byte("bridges"))
+	if err != UnsupportedEncryptionTypeError {
+		t.Errorf("Encrypted to an ElGamal destination: %v", err)
+	}
+
+	_, err = encryptToDestination("not a destination", []byte("bridges"))
+	if err != InvalidDestinationError {
+		t.Errorf("Encrypted to an invalid destination: %v", err)
+	}
+}
+
+// recordingConn is a net.PacketConn that records the datagrams written to it.
+type recordingConn struct {
+	net.PacketConn
+	written [][]byte
+	addrs   []net.Addr
+}
+
+func (c *recordingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte{}, b...))
+	c.addrs = append(c.addrs, addr)
+	return len(b), nil
+}
+
+func TestSendBundle(t *testing.T) {
+	destination, key := testDestination(t, x25519CryptoType)
+	addr, err := i2pkeys.NewI2PAddrFromString(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &recordingConn{}
+	uc := &updateChannel{conn: conn, encrypt: true}
+	bundle := &i2phttps.Bundle{
+		Type:    i2phttps.BundleMessage,
+		Bridges: []string{"obfs4 1.2.3.4:1234 FINGERPRINT cert=foo iat-mode=0"},
+	}
+
+	// the datagrams come from an I2PAddr, that is base32 as a String
+	uc.sendBundle(addr, bundle)
+	if len(conn.written) != 1 || conn.addrs[0] != addr {
+		t.Fatalf("Expected one datagram to the subscriber, got %d", len(conn.written))
+	}
+	var msg encryptedBundle
+	if err := json.Unmarshal(conn.written[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Encrypted == "" {
+		t.Fatalf("The bundle was not encrypted: %s", conn.written[0])
+	}
+	if decrypted := decryptBundle(t, key, &msg); len(decrypted.Bridges) != 1 || decrypted.Bridges[0] != bundle.Bridges[0] {
+		t.Errorf("Wrong decrypted bundle: %v", decrypted)
+	}
+
+	// the pushes of pushLoop use the stored destination
+	uc.sendBundleTo(addrDestination(addr), bundle)
+	if len(conn.written) != 2 {
+		t.Fatalf("Expected a second datagram to the subscriber, got %d", len(conn.written))
+	}
+	if err := json.Unmarshal(conn.written[1], &msg); err != nil || msg.Encrypted == "" {
+		t.Errorf("The pushed bundle was not encrypted: %s", conn.written[1])
+	}
+}
+
+func TestEncryptedRequestOtherDestination(t *testing.T) {
+	destination, _ := testDestination(t, x25519CryptoType)
+	other, _ := testDestination(t, x25519CryptoType)
+
+	for _, remoteAddr := range []string{i2pkeys.I2PAddr(other).Base32(), "192.0.2.1:1234"} {
+		req := httptest.NewRequest("GET", encryptedPath+"?destination="+destination, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		EncryptedRequestHandler(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Expected the status code %d for the destination of another client, got %d", http.StatusForbidden, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+
+	"github.com/eyedeekay/i2pkeys"
+	"github.com/eyedeekay/sam3"
+	sam "github.com/eyedeekay/sam3/helper"
+)
+
+const (
+	defaultSamHost        = "127.0.0.1"
+	defaultSamPort        = 7656
+	defaultTunnelLength   = 3
+	defaultTunnelQuantity = 2
+)
+
+var (
+	InvalidTunnelLengthError   = errors.New("the tunnel length must be between 1 and 7")
+	InvalidTunnelQuantityError = errors.New("the tunnel quantity must be between 1 and 16")
+)
+
+// samAddress returns the address of the SAM bridge of the configuration.
+func samAddress(samCfg *internal.I2PSamConfig) string {
+	host := samCfg.Host
+	if host == "" {
+		host = defaultSamHost
+	}
+	port := samCfg.Port
+	if port == 0 {
+		port = defaultSamPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// samOptions returns the options of the I2P sessions, with the tunnel length
+// and quantity of the configuration in both directions.
+func samOptions(samCfg *internal.I2PSamConfig) ([]string, error) {
+	length := samCfg.TunnelLength
+	if length == 0 {
+		length = defaultTunnelLength
+	}
+	if length < 1 || length > 7 {
+		return nil, InvalidTunnelLengthError
+	}
+	quantity := samCfg.TunnelQuantity
+	if quantity == 0 {
+		quantity = defaultTunnelQuantity
+	}
+	if quantity < 1 || quantity > 16 {
+		return nil, InvalidTunnelQuantityError
+	}
+
+	return []string{
+		"inbound.length=" + strconv.Itoa(length),
+		"outbound.length=" + strconv.Itoa(length),
+		"inbound.lengthVariance=0",
+		"outbound.lengthVariance=0",
+		"inbound.quantity=" + strconv.Itoa(quantity),
+		"outbound.quantity=" + strconv.Itoa(quantity),
+		"inbound.backupQuantity=0",
+		"outbound.backupQuantity=0",
+	}, nil
+}
+
+// newSamSession connects to the SAM bridge of the configuration and loads the
+// keys in keysPath, generating them if they don't exist yet.  Only the owner
+// can read the private keys, the destination can be impersonated with them.
+func newSamSession(samCfg *internal.I2PSamConfig, keysPath string) (*sam3.SAM, []string, *i2pkeys.I2PKeys, error) {
+	options, err := samOptions(samCfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s, err := sam3.NewSAM(samAddress(samCfg))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keys, err := sam.GenerateOrLoadKeys(keysPath, s)
+	if err != nil {
+		s.Close()
+		return nil, nil, nil, err
+	}
+	err = os.Chmod(keysPath+".i2p.private", 0600)
+	if err != nil {
+		log.Printf("Can't restrict the permissions of the I2P keys: %v", err)
+	}
+	return s, options, keys, nil
+}
+
+// listenI2P starts a stream session called name and listens on its
+// destination.  The base32 address of the destination is written next to the
+// keys, in keysPath.i2p.public.txt.
+func listenI2P(name string, samCfg *internal.I2PSamConfig, keysPath string) (*sam3.StreamListener, error) {
+	log.Printf("Starting and registering I2P service at %s, please wait a couple of minutes...", samAddress(samCfg))
+	s, options, keys, err := newSamSession(samCfg, keysPath)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.NewStreamSession(name, *keys, options)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(keysPath+".i2p.public.txt", []byte(keys.Addr().Base32()), 0644)
+	if err != nil {
+		log.Printf("Can't store the I2P address next to the keys: %v", err)
+	}
+	return session.Listen()
+}
+
+// datagramSessionI2P starts a datagram session called name.
+func datagramSessionI2P(name string, samCfg *internal.I2PSamConfig, keysPath string) (*sam3.DatagramSession, error) {
+	s, options, keys, err := newSamSession(samCfg, keysPath)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.NewDatagramSession(name, *keys, options, 0)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return session, nil
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestSamOptions(t *testing.T) {
+	samCfg := &internal.I2PSamConfig{}
+	if address := samAddress(samCfg); address != "127.0.0.1:7656" {
+		t.Errorf("Wrong default SAM address: %s", address)
+	}
+	options, err := samOptions(samCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options[0] != "inbound.length=3" || options[4] != "inbound.quantity=2" {
+		t.Errorf("Wrong default options: %v", options)
+	}
+
+	samCfg = &internal.I2PSamConfig{Host: "::1", Port: 7000, TunnelLength: 1, TunnelQuantity: 5}
+	if address := samAddress(samCfg); address != "[::1]:7000" {
+		t.Errorf("Wrong SAM address: %s", address)
+	}
+	options, err = samOptions(samCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options[1] != "outbound.length=1" || options[5] != "outbound.quantity=5" {
+		t.Errorf("Wrong options: %v", options)
+	}
+
+	_, err = samOptions(&internal.I2PSamConfig{TunnelLength: 8})
+	if err != InvalidTunnelLengthError {
+		t.Errorf("Tunnel length too long accepted: %v", err)
+	}
+	_, err = samOptions(&internal.I2PSamConfig{TunnelQuantity: -1})
+	if err != InvalidTunnelQuantityError {
+		t.Errorf("Negative tunnel quantity accepted: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eyedeekay/i2pkeys"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	i2phttps "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/i2p"
+)
+
+const (
+	// maxDatagramSize is the maximum size of an I2P repliable datagram
+	maxDatagramSize = 31 * 1024
+	pushCheckPeriod = time.Minute
+
+	subscribeCommand   = "subscribe"
+	unsubscribeCommand = "unsubscribe"
+)
+
+// updateChannelRequest is the datagram that clients send to the update
+// channel.  The sender destination is authenticated by I2P, as repliable
+// datagrams are signed.
+type updateChannelRequest struct {
+	Command string `json:"command"`
+}
+
+type updateChannelError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// encryptedBundle carries a bundle encrypted to the destination of the
+// subscriber, see encryptToDestination.
+type encryptedBundle struct {
+	Type      string `json:"type"`
+	Encrypted string `json:"encrypted"`
+}
+
+type updateChannel struct {
+	conn     net.PacketConn
+	shutdown chan bool
+	// encrypt bundles to the destination of the subscribers
+	encrypt bool
+}
+
+// startUpdateChannel opens a datagram session on I2P and starts answering
+// subscriptions and pushing bundles to the subscribers.
+func startUpdateChannel(cfg *internal.Config) (*updateChannel, error) {
+	ucCfg := cfg.Distributors.I2P.UpdateChannel
+	conn, err := datagramSessionI2P(ucCfg.TunnelName, &cfg.Distributors.I2P.Sam, ucCfg.KeysPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Update channel listening on", conn.Addr())
+
+	uc := &updateChannel{
+		conn:     conn,
+		shutdown: make(chan bool),
+		encrypt:  ucCfg.EncryptBundles,
+	}
+	go uc.readLoop()
+	go uc.pushLoop()
+	if ucCfg.AdminApiAddress != "" {
+		go uc.startAdminApi(ucCfg.AdminApiAddress, cfg.Backend.ApiTokens[i2phttps.DistName])
+	}
+	return uc, nil
+}
+
+func (uc *updateChannel) close() {
+	close(uc.shutdown)
+	uc.conn.Close()
+}
+
+func (uc *updateChannel) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := uc.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-uc.shutdown:
+				return
+			default:
+			}
+			log.Println("Error reading from the update channel:", err)
+			continue
+		}
+
+		var request updateChannelRequest
+		err = json.Unmarshal(buf[:n], &request)
+		if err != nil {
+			uc.send(addr, updateChannelError{Type: "error", Error: "malformed request"})
+			continue
+		}
+		uc.handleRequest(addr, request)
+	}
+}
+
+// addrDestination returns the base64 destination of the address.  The String
+// of an I2P address is only its base32 hash, that isn't enough to encrypt to
+// it or to send it datagrams later.
+func addrDestination(addr net.Addr) string {
+	if i2pAddr, ok := addr.(i2pkeys.I2PAddr); ok {
+		return i2pAddr.Base64()
+	}
+	return addr.String()
+}
+
+func (uc *updateChannel) handleRequest(addr net.Addr, request updateChannelRequest) {
+	destination := addrDestination(addr)
+	switch strings.ToLower(request.Command) {
+	case subscribeCommand:
+		bundle, err := dist.Subscribe(destination)
+		if err != nil {
+			log.Println("Can't subscribe destination to the update channel:", err)
+			uc.send(addr, updateChannelError{Type: "error", Error: err.Error()})
+			return
+		}
+		uc.sendBundle(addr, bundle)
+
+	case unsubscribeCommand:
+		err := dist.Unsubscribe(destination)
+		if err != nil {
+			uc.send(addr, updateChannelError{Type: "error", Error: err.Error()})
+			return
+		}
+		uc.send(addr, updateChannelError{Type: unsubscribeCommand})
+
+	default:
+		uc.send(addr, updateChannelError{Type: "error", Error: "unknown command"})
+	}
+}
+
+func (uc *updateChannel) pushLoop() {
+	ticker := time.NewTicker(pushCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			bundles := dist.PendingBundles(now)
+			for destination, bundle := range bundles {
+				uc.sendBundleTo(destination, bundle)
+			}
+			if len(bundles) != 0 {
+				log.Println("Pushed", len(bundles), "bundles over the update channel")
+			}
+		case <-uc.shutdown:
+			return
+		}
+	}
+}
+
+func (uc *updateChannel) sendBundleTo(destination string, bundle *i2phttps.Bundle) {
+	addr, err := i2pkeys.NewI2PAddrFromString(destination)
+	if err != nil {
+		log.Println("Invalid subscriber destination:", err)
+		return
+	}
+	uc.sendBundle(addr, bundle)
+}
+
+// sendBundle sends the bundle, encrypted to the destination if the update
+// channel encrypts them.  A bundle that can't be encrypted is not sent in
+// plaintext.
+func (uc *updateChannel) sendBundle(addr net.Addr, bundle *i2phttps.Bundle) {
+	if !uc.encrypt {
+		uc.send(addr, bundle)
+		return
+	}
+	msg, err := encryptBundle(addrDestination(addr), bundle)
+	if err != nil {
+		log.Println("Can't encrypt the bundle to the subscriber destination:", err)
+		uc.send(addr, updateChannelError{Type: "error", Error: err.Error()})
+		return
+	}
+	uc.send(addr, msg)
+}
+
+func encryptBundle(destination string, bundle *i2phttps.Bundle) (*encryptedBundle, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptToDestination(destination, data)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBundle{Type: bundle.Type, Encrypted: base64.StdEncoding.EncodeToString(encrypted)}, nil
+}
+
+func (uc *updateChannel) send(addr net.Addr, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("Error encoding update channel message:", err)
+		return
+	}
+	if len(data) > maxDatagramSize {
+		log.Println("Update channel message is too big to be sent:", len(data))
+		return
+	}
+	_, err = uc.conn.WriteTo(data, addr)
+	if err != nil {
+		log.Println("Error writing to the update channel:", err)
+	}
+}
+
+type revokeRequest struct {
+	Destination string `json:"destination"`
+}
+
+// startAdminApi listens for revocations of subscribers.  It should only be
+// bound to a local address.
+func (uc *updateChannel) startAdminApi(address, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update-channel/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var request revokeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Destination == "" {
+			log.Println("Malformed revoke request:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		bundle := dist.Revoke(request.Destination)
+		uc.sendBundleTo(request.Destination, bundle)
+		log.Println("Revoked destination from the update channel")
+	})
+
+	log.Println("Starting update channel admin API at", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("Update channel admin API shut down:", err)
+	}
+}
@@ -5,65 +5,160 @@
 package i2phttps
 
 import (
-	"fmt"
+	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/eyedeekay/i2pkeys"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 	i2phttps "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/i2p"
-
-	sam "github.com/eyedeekay/sam3/helper"
 )
 
-var dist *i2phttps.I2PHttpsDistributor
+const encryptedPath = "/encrypted"
+
+var (
+	dist    *i2phttps.I2PHttpsDistributor
+	locales *common.Locales
+)
 
-// mapRequestToHashkey maps the given HTTP request to a hash key.  It does so
-// by taking the /16 of the client's IP address.  For example, if the client's
-// address is 1.2.3.4, the function turns it into 1.2., computes its CRC64, and
-// returns the resulting hash key.
+// mapRequestToHashkey maps the given HTTP request to a hash key.  The I2P
+// clients connect from their destination and the RemoteAddr of the request is
+// its base32 address, like xxx.b32.i2p, so each client gets its own key
+// instead of one per network.
 func mapRequestToHashkey(r *http.Request) core.Hashkey {
+	if !strings.HasSuffix(r.RemoteAddr, ".b32.i2p") {
+		log.Printf("The request doesn't come from an I2P destination, using its address as hash key.")
+	}
+	return dist.DestinationHashkey(r.RemoteAddr, time.Now())
+}
 
-	i := 0
-	for numDots := 0; i < len(r.RemoteAddr) && numDots < 2; i++ {
-		if r.RemoteAddr[i] == '.' {
-			numDots++
+// clearnetHashkey maps the given HTTP request from the clearnet to a hash key,
+// from the /16 of the client's IPv4 address or the /32 of its IPv6 address.
+func clearnetHashkey(r *http.Request) core.Hashkey {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	prefix := host
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			prefix = ip4.Mask(net.CIDRMask(16, 32)).String()
+		} else {
+			prefix = ip.Mask(net.CIDRMask(32, 128)).String()
 		}
 	}
-	slash16 := r.RemoteAddr[:i]
-	log.Printf("Using address prefix %q as hash key.", slash16)
-
-	return core.NewHashkey(slash16)
+	return core.NewHashkey(i2phttps.PoolClearnet + "-" + prefix)
 }
 
-// RequestHandler handles requests for /.
+// RequestHandler handles requests for / over I2P.  It renders the bridges page
+// with bridges of the transport parameter, if any.
 func RequestHandler(w http.ResponseWriter, r *http.Request) {
+	handleBridgesRequest(w, r, i2phttps.PoolI2P, mapRequestToHashkey(r))
+}
+
+// EncryptedRequestHandler handles requests for /encrypted over I2P.  It answers
+// the bridges of the transport parameter encrypted to the destination
+// parameter, the base64 destination of the client.  The destination must be
+// the one that the request comes from, its hash is the RemoteAddr.
+func EncryptedRequestHandler(w http.ResponseWriter, r *http.Request) {
+	destination, err := i2pkeys.NewI2PAddrFromString(r.URL.Query().Get("destination"))
+	if err != nil || destination.Base32() != r.RemoteAddr {
+		http.Error(w, "the destination is not the one of the client", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	transport := common.RequestedTransport(r, dist.SupportedTransports())
+	resources, err := dist.RequestBridges(ctx, mapRequestToHashkey(r), i2phttps.PoolI2P, transport)
+	if err != nil {
+		log.Printf("Error requesting bridges: %v", err)
+		http.Error(w, "no bridges available", http.StatusServiceUnavailable)
+		return
+	}
+	bundle := &i2phttps.Bundle{Type: i2phttps.BridgesMessage}
+	for _, res := range resources {
+		bundle.Bridges = append(bundle.Bridges, res.String())
+	}
+
+	msg, err := encryptBundle(destination.Base64(), bundle)
+	if err != nil {
+		log.Printf("Can't encrypt the bridges to the client destination: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		log.Printf("Error writing the encrypted bridges: %v", err)
+	}
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+// ClearnetRequestHandler handles requests for / outside of I2P, with the
+// bridges of the clearnet pool.
+func ClearnetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	handleBridgesRequest(w, r, i2phttps.PoolClearnet, clearnetHashkey(r))
+}
+
+func handleBridgesRequest(w http.ResponseWriter, r *http.Request, pool string, key core.Hashkey) {
+	page := common.BridgesPage{Transports: dist.SupportedTransports()}
+	page.Transport = common.RequestedTransport(r, page.Transports)
 
-	resources, err := dist.RequestBridges(mapRequestToHashkey(r))
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	resources, err := dist.RequestBridges(ctx, key, pool, page.Transport)
 	if err != nil {
-		fmt.Fprintf(w, err.Error())
+		log.Printf("Error requesting bridges: %v", err)
+		page.NoBridges = true
 	} else {
-		fmt.Fprintf(w, "Your %s bridge(s):<br>", resources[0].Type())
+		page.BridgesType = resources[0].Type()
 		for _, res := range resources {
-			fmt.Fprintf(w, fmt.Sprintf("<tt>%s</tt><br>", res.String()))
+			page.Bridges = append(page.Bridges, res.String())
 		}
 	}
+	locales.WriteBridgesPage(w, r, page)
 }
 
 // InitFrontend is the entry point to HTTPS's Web frontend.  It spins up the
 // Web server and then waits until it receives a SIGINT.
 func InitFrontend(cfg *internal.Config) {
 
+	var err error
+	locales, err = common.NewLocales(cfg.Distributors.I2P.LocalesDir, "i2p")
+	if err != nil {
+		log.Fatalf("Can't load the locales: %v", err)
+	}
+
 	dist = &i2phttps.I2PHttpsDistributor{}
+	ucCfg := cfg.Distributors.I2P.UpdateChannel
+	if ucCfg.Enabled && ucCfg.StorageDir != "" {
+		dist.SubscriptionStore = pjson.New("subscriptions", ucCfg.StorageDir)
+	}
 	handlers := map[string]http.HandlerFunc{
 		"/": http.HandlerFunc(RequestHandler),
 	}
+	if cfg.Distributors.I2P.EncryptResponses {
+		handlers[encryptedPath] = http.HandlerFunc(EncryptedRequestHandler)
+	}
+	if builtinCfg := &cfg.Distributors.I2P.Builtin; builtinCfg.PublishDir != "" {
+		publisher, err := newBuiltinPublisher(builtinCfg)
+		if err != nil {
+			log.Fatalf("Can't start the builtin bridges publisher: %v", err)
+		}
+		go publisher.loop()
+		handlers[builtinPath] = http.StripPrefix(builtinPath, http.FileServer(http.Dir(builtinCfg.PublishDir))).ServeHTTP
+	}
 
-	listener, err := sam.I2PListener(cfg.Distributors.I2P.WebApi.ApiAddress, "127.0.0.1:7656", cfg.Distributors.I2P.WebApi.ApiAddress)
+	keysPath := cfg.Distributors.I2P.Sam.KeysPath
+	if keysPath == "" {
+		keysPath = cfg.Distributors.I2P.WebApi.ApiAddress
+	}
+	listener, err := listenI2P(cfg.Distributors.I2P.WebApi.ApiAddress, &cfg.Distributors.I2P.Sam, keysPath)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,6 +167,18 @@ func InitFrontend(cfg *internal.Config) {
 	log.Println(cfg)
 	log.Println("...done.")
 
+	if clearnetCfg := &cfg.Distributors.I2P.ClearnetApi; clearnetCfg.ApiAddress != "" {
+		go startClearnet(clearnetCfg)
+	}
+
+	if ucCfg.Enabled {
+		uc, err := startUpdateChannel(cfg)
+		if err != nil {
+			log.Fatal("Can't start the update channel: ", err)
+		}
+		defer uc.close()
+	}
+
 	common.ListenWebServer(
 		listener,
 		&cfg.Distributors.I2P.WebApi,
@@ -80,3 +187,20 @@ func InitFrontend(cfg *internal.Config) {
 		handlers,
 	)
 }
+
+// startClearnet serves the web page outside of I2P, with the bridges of the
+// clearnet pool.
+func startClearnet(apiCfg *internal.WebApiConfig) {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(ClearnetRequestHandler))
+	mux.Handle(common.StatusEndpoint, common.StatusHandler(dist))
+
+	log.Printf("Starting clearnet Web server at %s.", apiCfg.ApiAddress)
+	var err error
+	if apiCfg.KeyFile != "" && apiCfg.CertFile != "" {
+		err = http.ListenAndServeTLS(apiCfg.ApiAddress, apiCfg.CertFile, apiCfg.KeyFile, mux)
+	} else {
+		err = http.ListenAndServe(apiCfg.ApiAddress, mux)
+	}
+	log.Printf("Clearnet Web server shut down: %s", err)
+}
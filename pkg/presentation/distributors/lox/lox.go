@@ -0,0 +1,106 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lox
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/lox"
+)
+
+// maxRequestSize limits the size of the credential requests forwarded to the
+// Lox authority
+const maxRequestSize = 64 * 1024
+
+// loxEndpoints are the credential issuance and redemption endpoints of the
+// Lox authority that are exposed to the users
+var loxEndpoints = []string{
+	"/invite",
+	"/reachability",
+	"/pubkeys",
+	"/openreq",
+	"/trustpromo",
+	"/trustmig",
+	"/levelup",
+	"/issueinvite",
+	"/redeem",
+	"/checkblockage",
+	"/blockagemigration",
+}
+
+var (
+	dist  *lox.LoxDistributor
+	token string
+)
+
+// bridgesHandler handles the requests of the Lox authority for the bridges
+// it has to distribute.
+func bridgesHandler(w http.ResponseWriter, r *http.Request) {
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		log.Printf("Invalid authentication token for the bridges of the Lox authority.")
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(dist.Bridges())
+	if err != nil {
+		log.Printf("Error sending bridges to the Lox authority: %v", err)
+	}
+}
+
+// newProxyHandler returns a handler that forwards the user requests to the Lox
+// authority.
+func newProxyHandler(authority *url.URL) http.HandlerFunc {
+	proxy := httputil.NewSingleHostReverseProxy(authority)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+		// don't leak anything that could identify the user to the authority,
+		// a nil X-Forwarded-For stops the proxy from adding the user address
+		r.Header.Del("Cookie")
+		r.Header["X-Forwarded-For"] = nil
+		r.Host = authority.Host
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// InitFrontend is the entry point to Lox's Web frontend.  It serves the
+// bridges to the Lox authority and forwards the credential requests of the
+// users to it.
+func InitFrontend(cfg *internal.Config) {
+	loxCfg := &cfg.Distributors.Lox
+	authority, err := url.Parse(loxCfg.AuthorityAddress)
+	if err != nil || authority.Host == "" {
+		log.Fatalf("Invalid Lox authority address '%s': %v", loxCfg.AuthorityAddress, err)
+	}
+
+	dist = &lox.LoxDistributor{}
+	token = loxCfg.AuthorityToken
+	proxyHandler := newProxyHandler(authority)
+	handlers := map[string]http.HandlerFunc{
+		"/lox/bridges": http.HandlerFunc(bridgesHandler),
+	}
+	for _, endpoint := range loxEndpoints {
+		handlers[endpoint] = proxyHandler
+	}
+
+	common.StartWebServer(
+		&loxCfg.WebApi,
+		cfg,
+		dist,
+		handlers,
+	)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
+)
+
+var adminTokens map[string]string
+
+// circumventionMapStore returns a persistence mechanism that writes into the
+// circumvention map file, so edits survive restarts.
+func circumventionMapStore(filename string) persistence.Mechanism {
+	name := strings.TrimSuffix(path.Base(filename), ".json")
+	if name == path.Base(filename) {
+		log.Printf("Circumvention map %s has no .json extension, edits will be saved to %s.json", filename, filename)
+	}
+	return pjson.New(name, path.Dir(filename))
+}
+
+// circumventionMapEndpoint serves the circumvention map on GET and lets
+// authenticated admins replace it with PUT or edit some countries with PATCH.
+func circumventionMapEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut, http.MethodPatch:
+		editCircumventionMapHandler(w, r)
+	default:
+		circumventionMapHandler(w, r)
+	}
+}
+
+func editCircumventionMapHandler(w http.ResponseWriter, r *http.Request) {
+	name := getTokenName(w, r)
+	if name == "" {
+		return
+	}
+	defer r.Body.Close()
+
+	var err error
+	dec := json.NewDecoder(r.Body)
+	if r.Method == http.MethodPut {
+		var m moat.CircumventionMap
+		err = dec.Decode(&m)
+		if err == nil {
+			err = dist.SetCircumventionMap(m)
+		}
+	} else {
+		var patch map[string]*moat.CircumventionSettings
+		err = dec.Decode(&patch)
+		if err == nil {
+			err = dist.PatchCircumventionMap(patch)
+		}
+	}
+	if err != nil {
+		log.Printf("Error editing the circumvention map by %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Circumvention map edited by %s.", name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func getTokenName(w http.ResponseWriter, r *http.Request) string {
+	tokenLine := r.Header.Get("Authorization")
+	if tokenLine == "" {
+		log.Printf("Request carries no 'Authorization' HTTP header.")
+		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
+		return ""
+	}
+	if !strings.HasPrefix(tokenLine, "Bearer ") {
+		log.Printf("Authorization header contains no bearer token.")
+		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
+		return ""
+	}
+	fields := strings.Split(tokenLine, " ")
+	givenToken := fields[1]
+
+	for name, savedToken := range adminTokens {
+		if savedToken != "" && subtle.ConstantTimeCompare([]byte(givenToken), []byte(savedToken)) == 1 {
+			return name
+		}
+	}
+
+	log.Printf("Invalid authentication token.")
+	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+	return ""
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheMaxAge = time.Hour
+
+// responseCache remembers when the content served under each key last changed,
+// so we can provide a meaningful Last-Modified header.
+type responseCache struct {
+	sync.Mutex
+	maxAge  string
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	hash     string
+	modified time.Time
+}
+
+func newResponseCache(maxAgeSeconds int) *responseCache {
+	maxAge := int(defaultCacheMaxAge.Seconds())
+	if maxAgeSeconds > 0 {
+		maxAge = maxAgeSeconds
+	}
+	return &responseCache{
+		maxAge:  strconv.Itoa(maxAge),
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// lastModified returns the time since which the content identified by key has
+// the given hash.
+func (c *responseCache) lastModified(key, hash string) time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.hash != hash {
+		// HTTP dates have a resolution of one second
+		entry = cacheEntry{hash, time.Now().UTC().Truncate(time.Second)}
+		c.entries[key] = entry
+	}
+	return entry.modified
+}
+
+// writeJSON encodes v into w with caching and compression headers, and its
+// signature for the endpoint.  The ETag is calculated from canonical, which
+// must hold the same content as v in a deterministic order.  If the request
+// has matching conditional headers a 304 is returned instead of the content.
+func (c *responseCache) writeJSON(w http.ResponseWriter, r *http.Request, endpoint, key string, v, canonical interface{}) error {
+	canonicalBody, err := json.Marshal(canonical)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(canonicalBody)
+	hash := hex.EncodeToString(sum[:16])
+	modified := c.lastModified(key, hash)
+	// the gzip response has other bytes than the uncompressed one, so it
+	// needs another strong ETag
+	gzipped := acceptsGzip(r)
+	etag := `"` + hash + `"`
+	if gzipped {
+		etag = `"` + hash + `-gzip"`
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age="+c.maxAge)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	signer.setSignature(w, endpoint, body)
+
+	if !gzipped {
+		_, err = w.Write(body)
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write(body)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modified.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			q := strings.TrimSpace(param)
+			if strings.HasPrefix(q, "q=") {
+				weight, err := strconv.ParseFloat(q[2:], 64)
+				return err == nil && weight > 0
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var cachedContent = map[string][]string{"obfs4": {"obfs4 192.0.2.1:443"}}
+
+func cachedRequest(t *testing.T, c *responseCache, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/moat/circumvention/builtin", nil)
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	if err := c.writeJSON(w, r, "builtin", "builtin:obfs4", cachedContent, cachedContent); err != nil {
+		t.Fatal("Can't write the response:", err)
+	}
+	return w
+}
+
+func TestCacheNotModified(t *testing.T) {
+	c := newResponseCache(0)
+
+	w := cachedRequest(t, c, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("Missing cache headers: %v", w.Header())
+	}
+	if maxAge := w.Header().Get("Cache-Control"); maxAge != "public, max-age=3600" {
+		t.Errorf("Wrong Cache-Control: %s", maxAge)
+	}
+
+	w = cachedRequest(t, c, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected a 304 without body, got %d: %q", w.Code, w.Body.String())
+	}
+	w = cachedRequest(t, c, map[string]string{"If-None-Match": `"other", W/` + etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected a 304 for a list of tags, got %d", w.Code)
+	}
+	w = cachedRequest(t, c, map[string]string{"If-None-Match": `"other"`})
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a 200 for other tag, got %d", w.Code)
+	}
+	w = cachedRequest(t, c, map[string]string{"If-Modified-Since": w.Header().Get("Last-Modified")})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected a 304 since the last modification, got %d", w.Code)
+	}
+}
+
+func TestCacheGzip(t *testing.T) {
+	c := newResponseCache(0)
+
+	identity := cachedRequest(t, c, nil)
+	w := cachedRequest(t, c, map[string]string{"Accept-Encoding": "deflate, gzip;q=0.5"})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("The response is not compressed: %v", w.Header())
+	}
+	etag := w.Header().Get("ETag")
+	if etag == identity.Header().Get("ETag") || !strings.HasSuffix(etag, `-gzip"`) {
+		t.Errorf("The compressed response has the ETag %s, the uncompressed one %s", etag, identity.Header().Get("ETag"))
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal("Invalid gzip response:", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal("Invalid gzip response:", err)
+	}
+	if string(body) != identity.Body.String() {
+		t.Errorf("The compressed response is %q instead of %q", body, identity.Body.String())
+	}
+
+	w = cachedRequest(t, c, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": identity.Header().Get("ETag")})
+	if w.Code != http.StatusOK {
+		t.Errorf("The ETag of the uncompressed response matched the compressed one: %d", w.Code)
+	}
+	w = cachedRequest(t, c, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected a 304 for the compressed response, got %d", w.Code)
+	}
+
+	for _, encoding := range []string{"gzip;q=0", "gzip; q=0.0", "deflate", "br, identity"} {
+		w = cachedRequest(t, c, map[string]string{"Accept-Encoding": encoding})
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("The response was compressed for %q", encoding)
+		}
+		if w.Header().Get("ETag") != identity.Header().Get("ETag") {
+			t.Errorf("Wrong ETag for %q: %s", encoding, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestCacheSignature(t *testing.T) {
+	publicKey := initSigner(t)
+	c := newResponseCache(0)
+
+	for _, encoding := range []string{"", "gzip"} {
+		w := cachedRequest(t, c, map[string]string{"Accept-Encoding": encoding})
+		if w.Header().Get(signatureHeader) == "" || w.Header().Get(timestampHeader) == "" {
+			t.Fatalf("Missing signature headers: %v", w.Header())
+		}
+		body := w.Body.Bytes()
+		if encoding == "gzip" {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal("Invalid gzip response:", err)
+			}
+			body, err = ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatal("Invalid gzip response:", err)
+			}
+		}
+		if !verifySignature(publicKey, "builtin", w.Result().Header, body) {
+			t.Errorf("Invalid signature of the uncompressed body with %q encoding", encoding)
+		}
+	}
+
+	w := cachedRequest(t, c, map[string]string{"If-None-Match": cachedRequest(t, c, nil).Header().Get("ETag")})
+	if w.Code != http.StatusNotModified || w.Header().Get(signatureHeader) != "" {
+		t.Errorf("The 304 response has a signature: %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+var defaultCorsMethods = []string{http.MethodGet, http.MethodPost}
+
+// corsPolicy decides which cross-origin requests are allowed to reach the
+// moat API and sets the corresponding Access-Control-* headers.
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	methods   string
+	headers   string
+	maxAge    string
+}
+
+func newCorsPolicy(cfg *internal.CorsConfig) *corsPolicy {
+	if len(cfg.AllowedOrigins) == 0 {
+		return nil
+	}
+
+	p := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	allowedMethods := cfg.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = defaultCorsMethods
+	}
+	methods := make([]string, 0, len(allowedMethods)+1)
+	for _, method := range allowedMethods {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	p.methods = strings.Join(append(methods, http.MethodOptions), ", ")
+	p.headers = strings.Join(cfg.AllowedHeaders, ", ")
+	if cfg.MaxAgeSeconds > 0 {
+		p.maxAge = strconv.Itoa(cfg.MaxAgeSeconds)
+	}
+	return p
+}
+
+func (p *corsPolicy) allowedOrigin(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+// wrap returns a handler that adds CORS headers to the responses of handler
+// and answers preflight requests without calling it.
+func (p *corsPolicy) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !p.allowedOrigin(origin) {
+			if r.Method == http.MethodOptions && origin != "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			handler(w, r)
+			return
+		}
+
+		if p.anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", p.methods)
+			if p.headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", p.headers)
+			}
+			if p.maxAge != "" {
+				w.Header().Set("Access-Control-Max-Age", p.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
+)
+
+const (
+	unknownCountry = "unknown"
+	noTransport    = "none"
+)
+
+var (
+	requestsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "moat_request_total",
+		Help: "The total number of moat requests",
+	},
+		[]string{"endpoint", "country", "transport"},
+	)
+)
+
+// metricsCountry returns the country to use as the label of the metrics.  The
+// countries of the requests are chosen by the clients, so only valid country
+// codes are used and the others are unknown, to keep the number of labels
+// bounded.
+func metricsCountry(country string) string {
+	country = strings.ToLower(country)
+	if !moat.ValidCountryCode(country) {
+		return unknownCountry
+	}
+	return country
+}
+
+// countSettings increments the counter once for each transport served in the
+// settings, or once with transport "none" if there are none.
+func countSettings(endpoint, country string, s *moat.CircumventionSettings) {
+	country = metricsCountry(country)
+	if s == nil || len(s.Settings) == 0 {
+		requestsCount.WithLabelValues(endpoint, country, noTransport).Inc()
+		return
+	}
+	for _, settings := range s.Settings {
+		requestsCount.WithLabelValues(endpoint, country, settings.Bridges.Type).Inc()
+	}
+}
+
+// countFeedback increments the counter once for each transport of the
+// feedback.
+func countFeedback(country string, results []moat.FeedbackResult) {
+	country = metricsCountry(country)
+	for _, result := range results {
+		requestsCount.WithLabelValues("feedback", country, result.Transport).Inc()
+	}
+}
+
+func countBuiltin(country string, bb map[string][]string) {
+	country = metricsCountry(country)
+	if len(bb) == 0 {
+		requestsCount.WithLabelValues("builtin", country, noTransport).Inc()
+		return
+	}
+	for transport := range bb {
+		requestsCount.WithLabelValues("builtin", country, transport).Inc()
+	}
+}
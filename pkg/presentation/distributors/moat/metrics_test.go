@@ -0,0 +1,23 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import "testing"
+
+func TestMetricsCountry(t *testing.T) {
+	for country, label := range map[string]string{
+		"cn":     "cn",
+		"RU":     "ru",
+		"zz":     "zz",
+		"":       unknownCountry,
+		"usa":    unknownCountry,
+		"c1":     unknownCountry,
+		"../etc": unknownCountry,
+	} {
+		if l := metricsCountry(country); l != label {
+			t.Errorf("The label of %q is %q instead of %q", country, l, label)
+		}
+	}
+}
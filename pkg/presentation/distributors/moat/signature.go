@@ -0,0 +1,95 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+)
+
+const (
+	signatureHeader = "X-Moat-Signature"
+	// timestampHeader carries when the response was signed, in Unix seconds
+	timestampHeader = "X-Moat-Signature-Timestamp"
+)
+
+// responseSigner produces detached Ed25519 signatures over response bodies,
+// the endpoint that served them and the time when they were signed.
+type responseSigner struct {
+	key ed25519.PrivateKey
+}
+
+var signer *responseSigner
+
+// loadSigner reads the signing key from a file containing the base64 encoding
+// of either a 32 bytes seed or a 64 bytes private key.
+func loadSigner(keyFile string) (*responseSigner, error) {
+	key, err := common.LoadSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &responseSigner{key}, nil
+}
+
+// signedMessage returns the message that is signed for the body served by
+// the endpoint at the given time, so a response can't be passed off as the
+// response of another endpoint and clients can reject old responses.
+func signedMessage(endpoint string, timestamp int64, body []byte) []byte {
+	message := []byte(fmt.Sprintf("moat %s %d\x00", endpoint, timestamp))
+	return append(message, body...)
+}
+
+// setSignature adds the signature and timestamp headers for the body served
+// by the endpoint if a signing key is configured.
+func (s *responseSigner) setSignature(w http.ResponseWriter, endpoint string, body []byte) {
+	if s == nil {
+		return
+	}
+	timestamp := time.Now().Unix()
+	signature := ed25519.Sign(s.key, signedMessage(endpoint, timestamp, body))
+	w.Header().Set(timestampHeader, strconv.FormatInt(timestamp, 10))
+	w.Header().Set(signatureHeader, base64.StdEncoding.EncodeToString(signature))
+}
+
+func (s *responseSigner) publicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// writeSignedJSON encodes v into w with its signature for the endpoint in the
+// headers.
+func writeSignedJSON(w http.ResponseWriter, endpoint string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	signer.setSignature(w, endpoint, body)
+	_, err = w.Write(body)
+	return err
+}
+
+func publicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(map[string]string{
+		"algorithm":        "ed25519",
+		"public_key":       signer.publicKey(),
+		"header":           signatureHeader,
+		"timestamp_header": timestampHeader,
+	})
+	if err != nil {
+		log.Println("Error encoding public key:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// verifySignature tells if the signature headers are valid for the body
+// served by the endpoint, as the clients verify them.
+func verifySignature(key ed25519.PublicKey, endpoint string, header http.Header, body []byte) bool {
+	timestamp, err := strconv.ParseInt(header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(header.Get(signatureHeader))
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, signedMessage(endpoint, timestamp, body), signature)
+}
+
+func initSigner(t *testing.T) ed25519.PublicKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer = &responseSigner{privateKey}
+	t.Cleanup(func() { signer = nil })
+	return publicKey
+}
+
+func TestSignature(t *testing.T) {
+	publicKey := initSigner(t)
+
+	w := httptest.NewRecorder()
+	err := writeSignedJSON(w, "settings", map[string]string{"country": "cn"})
+	if err != nil {
+		t.Fatal("Can't write the signed response:", err)
+	}
+	body := w.Body.Bytes()
+	header := w.Result().Header
+	if !verifySignature(publicKey, "settings", header, body) {
+		t.Fatal("The signature of the response is not valid")
+	}
+
+	if verifySignature(publicKey, "defaults", header, body) {
+		t.Error("The signature is valid for another endpoint")
+	}
+	if verifySignature(publicKey, "settings", header, append([]byte(" "), body...)) {
+		t.Error("The signature is valid for another body")
+	}
+
+	timestamp, err := strconv.ParseInt(header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		t.Fatal("Invalid timestamp header:", err)
+	}
+	header.Set(timestampHeader, strconv.FormatInt(timestamp-3600, 10))
+	if verifySignature(publicKey, "settings", header, body) {
+		t.Error("The signature is valid for another timestamp")
+	}
+}
@@ -5,19 +5,21 @@
 package moat
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.torproject.org/tpo/anti-censorship/geoip"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/moat"
 )
@@ -25,6 +27,7 @@ import (
 var (
 	dist    *moat.MoatDistributor
 	geoipdb *geoip.Geoip
+	cache   *responseCache
 )
 
 type jsonError struct {
@@ -37,25 +40,53 @@ type jsonErrorEntry struct {
 }
 
 var (
-	invalidRequest = jsonError{[]jsonErrorEntry{{
-		Code:   400,
-		Detail: "Not valid request",
-	}}}
-	countryNotFound = jsonError{[]jsonErrorEntry{{
-		Code:   406,
-		Detail: "Could not find country code for circumvention settings",
-	}}}
-	transportNotFound = jsonError{[]jsonErrorEntry{{
-		Code:   404,
-		Detail: "No provided transport is available for this country",
-	}}}
+	invalidRequest = &i18n.Message{
+		ID:    "MoatInvalidRequest",
+		Other: "Not valid request",
+	}
+	countryNotFound = &i18n.Message{
+		ID:    "MoatCountryNotFound",
+		Other: "Could not find country code for circumvention settings",
+	}
+	transportNotFound = &i18n.Message{
+		ID:    "MoatTransportNotFound",
+		Other: "No provided transport is available for this country",
+	}
+	feedbackDisabled = &i18n.Message{
+		ID:    "MoatFeedbackDisabled",
+		Other: "Circumvention feedback is not collected",
+	}
+	feedbackRateLimited = &i18n.Message{
+		ID:    "MoatFeedbackRateLimited",
+		Other: "Too much circumvention feedback, try again later",
+	}
+
+	locales *common.Locales
 )
 
+// newJSONError builds an error response with the detail translated to the
+// language of the request.
+func newJSONError(r *http.Request, code int, msg *i18n.Message) jsonError {
+	return jsonError{[]jsonErrorEntry{{
+		Code:   code,
+		Detail: common.Localize(locales.RequestLocalizer(r), msg, nil),
+	}}}
+}
+
 // InitFrontend is the entry point to HTTPS's Web frontend.  It spins up the
 // Web server and then waits until it receives a SIGINT.
 func InitFrontend(cfg *internal.Config) {
+	fetcher := common.NewBridgesFetcher()
 	dist = &moat.MoatDistributor{
-		FetchBridges: fetchBridges,
+		FetchBridges:  fetcher.FetchBridges,
+		CountryFromIP: countryFromIP,
+	}
+	if cfg.Distributors.Moat.StorageDir != "" {
+		dist.BuiltinStore = pjson.New("builtin_bridges", cfg.Distributors.Moat.StorageDir)
+	}
+	adminTokens = cfg.Distributors.Moat.AdminTokens
+	if len(adminTokens) != 0 {
+		dist.CircumventionStore = circumventionMapStore(cfg.Distributors.Moat.CircumventionMap)
 	}
 	err := loadCircumventionFile(cfg.Distributors.Moat.CircumventionMap, dist.LoadCircumventionMap)
 	if err != nil {
@@ -71,17 +102,44 @@ func InitFrontend(cfg *internal.Config) {
 		log.Fatal("Can't load geoip databases", cfg.Distributors.Moat.GeoipDB, cfg.Distributors.Moat.Geoip6DB, ":", err)
 	}
 
+	locales, err = common.NewLocales(cfg.Distributors.Moat.LocalesDir, "moat")
+	if err != nil {
+		log.Fatalf("Can't load locales %s: %v", cfg.Distributors.Moat.LocalesDir, err)
+	}
+
+	cache = newResponseCache(cfg.Distributors.Moat.CacheMaxAgeSeconds)
+	if cfg.Distributors.Moat.SigningKeyFile != "" {
+		signer, err = loadSigner(cfg.Distributors.Moat.SigningKeyFile)
+		if err != nil {
+			log.Fatalf("Can't load signing key %s: %v", cfg.Distributors.Moat.SigningKeyFile, err)
+		}
+	}
+
 	handlers := map[string]http.HandlerFunc{
-		"/moat/circumvention/map":            http.HandlerFunc(circumventionMapHandler),
+		"/moat/circumvention/map":            http.HandlerFunc(circumventionMapEndpoint),
 		"/moat/circumvention/countries":      http.HandlerFunc(countriesHandler),
 		"/moat/circumvention/settings":       http.HandlerFunc(circumventionSettingsHandler),
 		"/moat/circumvention/builtin":        http.HandlerFunc(builtinHandler),
 		"/moat/circumvention/defaults":       http.HandlerFunc(circumventionDefaultsHandler),
+		"/moat/circumvention/feedback":       http.HandlerFunc(feedbackHandler),
 		"/meek/moat/circumvention/map":       http.HandlerFunc(circumventionMapHandler),
 		"/meek/moat/circumvention/countries": http.HandlerFunc(countriesHandler),
 		"/meek/moat/circumvention/settings":  http.HandlerFunc(circumventionSettingsHandler),
 		"/meek/moat/circumvention/builtin":   http.HandlerFunc(builtinHandler),
 		"/meek/moat/circumvention/defaults":  http.HandlerFunc(circumventionDefaultsHandler),
+		"/meek/moat/circumvention/feedback":  http.HandlerFunc(feedbackHandler),
+	}
+	if signer != nil {
+		handlers["/moat/circumvention/publickey"] = http.HandlerFunc(publicKeyHandler)
+		handlers["/meek/moat/circumvention/publickey"] = http.HandlerFunc(publicKeyHandler)
+	}
+	if cfg.Distributors.Moat.MetricsAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go http.ListenAndServe(cfg.Distributors.Moat.MetricsAddress, nil)
+	}
+	cors := newCorsPolicy(&cfg.Distributors.Moat.Cors)
+	for endpoint, handler := range handlers {
+		handlers[endpoint] = cors.wrap(handler)
 	}
 
 	common.StartWebServer(
@@ -105,8 +163,7 @@ func loadCircumventionFile(path string, loadFn func(r io.Reader) error) error {
 func circumventionMapHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/json; charset=utf-8")
 	m := dist.GetCircumventionMap()
-	enc := json.NewEncoder(w)
-	err := enc.Encode(m)
+	err := cache.writeJSON(w, r, "map", "map", m, m)
 	if err != nil {
 		log.Println("Error encoding circumvention map:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -142,7 +199,7 @@ func circumventionSettingsHandler(w http.ResponseWriter, r *http.Request) {
 	err := dec.Decode(&request)
 	if err != nil && !errors.Is(err, io.EOF) {
 		log.Println("Error decoding circumvention settings request:", err)
-		err = enc.Encode(invalidRequest)
+		err = enc.Encode(newJSONError(r, 400, invalidRequest))
 		if err != nil {
 			log.Println("Error encoding jsonError:", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -155,7 +212,7 @@ func circumventionSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		request.Country = countryFromIP(ip)
 		if request.Country == "" {
 			log.Println("Could not find country code for cicrumvention settings")
-			err = enc.Encode(countryNotFound)
+			err = enc.Encode(newJSONError(r, 406, countryNotFound))
 			if err != nil {
 				log.Println("Error encoding jsonError:", err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -164,10 +221,13 @@ func circumventionSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	s, err := dist.GetCircumventionSettings(request.Country, request.Transports, ip)
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	s, err := dist.GetCircumventionSettings(ctx, request.Country, request.Transports, ip)
+	countSettings("settings", request.Country, s)
 	if err != nil {
 		if errors.Is(err, moat.NoTransportError) {
-			err = enc.Encode(transportNotFound)
+			err = enc.Encode(newJSONError(r, 404, transportNotFound))
 			if err != nil {
 				log.Println("Error encoding jsonError:", err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -179,7 +239,7 @@ func circumventionSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = enc.Encode(s)
+	err = writeSignedJSON(w, "settings", s)
 	if err != nil {
 		log.Println("Error encoding circumvention settings:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -195,7 +255,7 @@ func circumventionDefaultsHandler(w http.ResponseWriter, r *http.Request) {
 	err := dec.Decode(&request)
 	if err != nil && !errors.Is(err, io.EOF) {
 		log.Println("Error decoding circumvention defaults request:", err)
-		err = enc.Encode(invalidRequest)
+		err = enc.Encode(newJSONError(r, 400, invalidRequest))
 		if err != nil {
 			log.Println("Error encoding jsonError:", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -204,10 +264,13 @@ func circumventionDefaultsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ip := ipFromRequest(r)
-	s, err := dist.GetCircumventionDefaults(request.Transports, ip)
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	s, err := dist.GetCircumventionDefaults(ctx, request.Transports, ip)
+	countSettings("defaults", countryFromIP(ip), s)
 	if err != nil {
 		if errors.Is(err, moat.NoTransportError) {
-			err = enc.Encode(transportNotFound)
+			err = enc.Encode(newJSONError(r, 404, transportNotFound))
 			if err != nil {
 				log.Println("Error encoding jsonError:", err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -219,17 +282,83 @@ func circumventionDefaultsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if s == nil {
-		w.Write([]byte("{}"))
+		body := []byte("{}")
+		signer.setSignature(w, "defaults", body)
+		w.Write(body)
 		return
 	}
 
-	err = enc.Encode(s)
+	err = writeSignedJSON(w, "defaults", s)
 	if err != nil {
 		log.Println("Error encoding circumvention defaults:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+type feedbackRequest struct {
+	Country string                `json:"country"`
+	Results []moat.FeedbackResult `json:"results"`
+}
+
+// feedbackHandler counts whether the settings that a client tried worked.  We
+// don't keep anything about the client, its address is only used to locate it
+// if the request has no country and, hashed, to limit its feedback.
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+
+	var request feedbackRequest
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&request)
+	if err != nil {
+		log.Println("Error decoding circumvention feedback request:", err)
+		err = enc.Encode(newJSONError(r, 400, invalidRequest))
+		if err != nil {
+			log.Println("Error encoding jsonError:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	ip := ipFromRequest(r)
+	if request.Country == "" {
+		request.Country = countryFromIP(ip)
+		if request.Country == "" {
+			log.Println("Could not find country code for circumvention feedback")
+			err = enc.Encode(newJSONError(r, 406, countryNotFound))
+			if err != nil {
+				log.Println("Error encoding jsonError:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	err = dist.RecordFeedback(request.Country, request.Results, ip)
+	if err != nil {
+		log.Println("Error recording circumvention feedback:", err)
+		if errors.Is(err, moat.FeedbackDisabledError) {
+			err = enc.Encode(newJSONError(r, 404, feedbackDisabled))
+		} else if errors.Is(err, moat.FeedbackRateLimitError) {
+			err = enc.Encode(newJSONError(r, 429, feedbackRateLimited))
+		} else {
+			err = enc.Encode(newJSONError(r, 400, invalidRequest))
+		}
+		if err != nil {
+			log.Println("Error encoding jsonError:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	countFeedback(request.Country, request.Results)
+
+	err = enc.Encode(struct{}{})
+	if err != nil {
+		log.Println("Error encoding circumvention feedback response:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 func ipFromRequest(r *http.Request) net.IP {
 	header := r.Header.Get("X-Forwarded-For")
 	forwarded := strings.Split(header, ",")
@@ -279,7 +408,7 @@ func builtinHandler(w http.ResponseWriter, r *http.Request) {
 	err := dec.Decode(&request)
 	if err != nil && !errors.Is(err, io.EOF) {
 		log.Println("Error decoding builtin request:", err)
-		err = enc.Encode(invalidRequest)
+		err = enc.Encode(newJSONError(r, 400, invalidRequest))
 		if err != nil {
 			log.Println("Error encoding jsonError:", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -288,27 +417,33 @@ func builtinHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	bb := dist.GetBuiltInBridges(request.Transports)
-	err = enc.Encode(bb)
+	countBuiltin(countryFromIP(ipFromRequest(r)), bb)
+	err = cache.writeJSON(w, r, "builtin", builtinCacheKey(bb), bb, sortedBridges(bb))
 	if err != nil {
 		log.Println("Error encoding builtin bridges:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
-func fetchBridges(url string) ([]string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Status code: %d", resp.StatusCode)
+// builtinCacheKey identifies the set of transports included in a builtin
+// response.  It only contains transports we know about, so it stays bounded no
+// matter what clients request.
+func builtinCacheKey(bb map[string][]string) string {
+	types := make([]string, 0, len(bb))
+	for t := range bb {
+		types = append(types, t)
 	}
+	sort.Strings(types)
+	return "builtin:" + strings.Join(types, ",")
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// sortedBridges returns a copy of the builtin bridges in a deterministic order,
+// as GetBuiltInBridges shuffles them on every call.
+func sortedBridges(bb map[string][]string) map[string][]string {
+	sorted := make(map[string][]string, len(bb))
+	for t, bridges := range bb {
+		sorted[t] = append([]string{}, bridges...)
+		sort.Strings(sorted[t])
 	}
-	body = bytes.TrimSpace(body)
-	return strings.Split(string(body), "\n"), nil
+	return sorted
 }
@@ -0,0 +1,194 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// KindEncryptedDM is the kind of the NIP-04 encrypted direct messages.
+const KindEncryptedDM = 4
+
+var InvalidContentError = errors.New("invalid encrypted content")
+
+// Event is a nostr event as defined in NIP-01.
+type Event struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// hash returns the sha256 of the serialized event, that is its id.
+func (e *Event) hash() ([]byte, error) {
+	tags := e.Tags
+	if tags == nil {
+		tags = [][]string{}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode([]interface{}{0, e.PubKey, e.CreatedAt, e.Kind, tags, e.Content})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return h[:], nil
+}
+
+// Sign sets the public key, id and signature of the event.
+func (e *Event) Sign(key *PrivateKey) error {
+	e.PubKey = hex.EncodeToString(key.PublicKey())
+	if e.Tags == nil {
+		e.Tags = [][]string{}
+	}
+	id, err := e.hash()
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(id, rand.Reader, nil)
+	if err != nil {
+		return err
+	}
+	e.ID = hex.EncodeToString(id)
+	e.Sig = hex.EncodeToString(sig)
+	return nil
+}
+
+// Verify checks that the id and signature of the event are valid.
+func (e *Event) Verify() error {
+	id, err := e.hash()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(id) != strings.ToLower(e.ID) {
+		return errors.New("the event id doesn't match its content")
+	}
+	pubKey, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return InvalidKeyError
+	}
+	sig, err := hex.DecodeString(e.Sig)
+	if err != nil {
+		return InvalidSignatureError
+	}
+	return Verify(pubKey, id, sig)
+}
+
+// Tag returns the value of the first tag with the given name.
+func (e *Event) Tag(name string) string {
+	for _, tag := range e.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// NewEncryptedDM returns an unsigned NIP-04 direct message for the hex encoded
+// public key to.
+func NewEncryptedDM(key *PrivateKey, to string, text string, createdAt int64) (*Event, error) {
+	pubKey, err := hex.DecodeString(to)
+	if err != nil {
+		return nil, InvalidKeyError
+	}
+	content, err := encrypt(key, pubKey, text)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{
+		CreatedAt: createdAt,
+		Kind:      KindEncryptedDM,
+		Tags:      [][]string{{"p", to}},
+		Content:   content,
+	}, nil
+}
+
+// DecryptDM returns the text of a NIP-04 direct message sent to key.
+func DecryptDM(key *PrivateKey, e *Event) (string, error) {
+	pubKey, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return "", InvalidKeyError
+	}
+	return decrypt(key, pubKey, e.Content)
+}
+
+// encrypt implements the NIP-04 encryption: AES-256-CBC with the ECDH shared
+// secret as key, encoded as "<base64 ciphertext>?iv=<base64 iv>".
+func encrypt(key *PrivateKey, pubKey []byte, text string) (string, error) {
+	secret, err := key.SharedSecret(pubKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(iv)
+	if err != nil {
+		return "", err
+	}
+	padding := aes.BlockSize - len(text)%aes.BlockSize
+	plaintext := append([]byte(text), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return base64.StdEncoding.EncodeToString(ciphertext) + "?iv=" + base64.StdEncoding.EncodeToString(iv), nil
+}
+
+func decrypt(key *PrivateKey, pubKey []byte, content string) (string, error) {
+	parts := strings.SplitN(content, "?iv=", 2)
+	if len(parts) != 2 {
+		return "", InvalidContentError
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", InvalidContentError
+	}
+	iv, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(iv) != aes.BlockSize {
+		return "", InvalidContentError
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", InvalidContentError
+	}
+
+	secret, err := key.SharedSecret(pubKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return "", InvalidContentError
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return "", InvalidContentError
+		}
+	}
+	return string(plaintext[:len(plaintext)-padding]), nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func newKey(t *testing.T) *PrivateKey {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	key, err := NewPrivateKey(raw)
+	if err != nil {
+		t.Fatal("Can't create private key:", err)
+	}
+	return key
+}
+
+func TestEncryptedDM(t *testing.T) {
+	alice := newKey(t)
+	bob := newKey(t)
+	text := "Hello <bob> & \"friends\", aquí van los puentes"
+
+	e, err := NewEncryptedDM(alice, hex.EncodeToString(bob.PublicKey()), text, 1650000000)
+	if err != nil {
+		t.Fatal("Can't create DM:", err)
+	}
+	err = e.Sign(alice)
+	if err != nil {
+		t.Fatal("Can't sign the event:", err)
+	}
+	if err = e.Verify(); err != nil {
+		t.Error("Can't verify the event:", err)
+	}
+	if e.Tag("p") != hex.EncodeToString(bob.PublicKey()) {
+		t.Error("Wrong p tag:", e.Tags)
+	}
+
+	decrypted, err := DecryptDM(bob, e)
+	if err != nil {
+		t.Fatal("Can't decrypt DM:", err)
+	}
+	if decrypted != text {
+		t.Errorf("Wrong decrypted text: %s", decrypted)
+	}
+
+	e.Content += "x"
+	if err = e.Verify(); err == nil {
+		t.Error("Modified event verified")
+	}
+}
+
+func TestEventID(t *testing.T) {
+	e := Event{
+		PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		CreatedAt: 1650000000,
+		Kind:      1,
+		Content:   "<a> & \"b\"\n",
+	}
+	id, err := e.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NIP-01 serialization doesn't escape html characters
+	expected := sha256.Sum256([]byte(`[0,"79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",1650000000,1,[],"<a> & \"b\"\n"]`))
+	if !bytes.Equal(id, expected[:]) {
+		t.Errorf("Wrong event id: %x", id)
+	}
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	alice := newKey(t)
+	bob := newKey(t)
+	for _, content := range []string{"", "abc", "YWJj?iv=YWJj", "?iv=AAAAAAAAAAAAAAAAAAAAAA=="} {
+		_, err := decrypt(bob, alice.PublicKey(), content)
+		if err == nil {
+			t.Errorf("Malformed content '%s' decrypted", content)
+		}
+	}
+}
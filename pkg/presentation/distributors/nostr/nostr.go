@@ -0,0 +1,249 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/nostr"
+)
+
+const (
+	maxReconnectDelay = 10 * time.Minute
+	// seenExpiry is how long we remember the ids of the events already
+	// answered, as the same event is received from all the relays
+	seenExpiry = 24 * time.Hour
+
+	helpMessage = `Hello, this is the Tor bridges bot.
+
+Send a direct message with the word "bridges" to get Tor bridges. The same key gets the same bridges for a while, so there is no need to ask repeatedly.`
+	bridgesMessage     = "Your bridges:"
+	noBridgesMessage   = "There are no bridges available right now, please try again later."
+	bridgesCommandWord = "bridges"
+)
+
+type bot struct {
+	key    *PrivateKey
+	pubKey string
+	dist   *nostr.NostrDistributor
+
+	lock     sync.Mutex
+	relays   map[string]*Relay
+	seen     map[string]time.Time
+	stopping bool
+}
+
+// InitFrontend is the entry point to the Nostr frontend.  It connects to the
+// relays and replies to the encrypted direct messages until it receives a
+// SIGINT.
+func InitFrontend(cfg *internal.Config) {
+	nostrCfg := &cfg.Distributors.Nostr
+	rawKey, err := hex.DecodeString(nostrCfg.PrivateKey)
+	if err != nil {
+		log.Fatal("Malformed nostr private key: ", err)
+	}
+	key, err := NewPrivateKey(rawKey)
+	if err != nil {
+		log.Fatal("Invalid nostr private key: ", err)
+	}
+	if len(nostrCfg.Relays) == 0 {
+		log.Fatal("No nostr relays configured.")
+	}
+
+	dist := &nostr.NostrDistributor{}
+	dist.Init(cfg)
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(common.StatusEndpoint, common.StatusHandler(dist))
+	go http.ListenAndServe(nostrCfg.MetricsAddress, nil)
+
+	b := &bot{
+		key:    key,
+		pubKey: hex.EncodeToString(key.PublicKey()),
+		dist:   dist,
+		relays: make(map[string]*Relay),
+		seen:   make(map[string]time.Time),
+	}
+	log.Printf("Nostr public key: %s", b.pubKey)
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT)
+	signal.Notify(signalChan, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		log.Printf("Caught SIGINT.")
+		b.lock.Lock()
+		b.stopping = true
+		for _, relay := range b.relays {
+			relay.Close()
+		}
+		b.lock.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for _, url := range nostrCfg.Relays {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			b.connect(url)
+		}(url)
+	}
+	wg.Wait()
+
+	dist.Shutdown()
+}
+
+// connect keeps a connection to the relay, reconnecting with an exponential
+// backoff, until the bot is stopped.
+func (b *bot) connect(url string) {
+	since := time.Now().Unix()
+	delay := time.Second
+	for {
+		relay, err := DialRelay(url)
+		b.lock.Lock()
+		if b.stopping {
+			b.lock.Unlock()
+			if relay != nil {
+				relay.Close()
+			}
+			return
+		}
+		if err == nil {
+			b.relays[url] = relay
+		}
+		b.lock.Unlock()
+
+		if err != nil {
+			log.Printf("Can't connect to the relay %s: %v. Trying again in %v.", url, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		log.Printf("Connected to the relay %s.", url)
+		delay = time.Second
+
+		err = b.serve(relay, since)
+		relay.Close()
+		since = time.Now().Unix()
+
+		b.lock.Lock()
+		delete(b.relays, url)
+		if b.stopping {
+			b.lock.Unlock()
+			return
+		}
+		b.lock.Unlock()
+		log.Printf("Disconnected from the relay %s: %v", url, err)
+	}
+}
+
+// serve replies to the direct messages received from the relay until the
+// connection fails.
+func (b *bot) serve(relay *Relay, since int64) error {
+	err := relay.Subscribe(b.pubKey, since)
+	if err != nil {
+		return err
+	}
+
+	for {
+		e, err := relay.Receive()
+		if err != nil {
+			return err
+		}
+		if e.Kind != KindEncryptedDM || e.Tag("p") != b.pubKey {
+			continue
+		}
+		if err := e.Verify(); err != nil {
+			log.Printf("Invalid event from %s: %v", relay.URL, err)
+			continue
+		}
+		if !b.firstSeen(e.ID) {
+			continue
+		}
+
+		text, err := DecryptDM(b.key, e)
+		if err != nil {
+			log.Printf("Can't decrypt the message from %s: %v", relay.URL, err)
+			continue
+		}
+		b.reply(e.PubKey, b.replyTo(e.PubKey, text))
+	}
+}
+
+// firstSeen returns true the first time it's called for an event id.
+func (b *bot) firstSeen(id string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	for seenID, date := range b.seen {
+		if now.Sub(date) > seenExpiry {
+			delete(b.seen, seenID)
+		}
+	}
+	b.seen[id] = now
+	return true
+}
+
+func (b *bot) replyTo(pubKey, text string) string {
+	if !strings.Contains(strings.ToLower(text), bridgesCommandWord) {
+		return helpMessage
+	}
+
+	ctx, cancel := common.NewRequestContext()
+	defer cancel()
+	resources, err := b.dist.GetResources(ctx, pubKey)
+	if err != nil {
+		if !errors.Is(err, nostr.NoBridgesError) {
+			log.Printf("Error getting bridges: %v", err)
+		}
+		return noBridgesMessage
+	}
+	reply := bridgesMessage
+	for _, r := range resources {
+		reply += "\n" + r.String()
+	}
+	return reply
+}
+
+// reply sends the message to all the connected relays, as we don't know
+// which ones the user reads from.
+func (b *bot) reply(to, text string) {
+	e, err := NewEncryptedDM(b.key, to, text, time.Now().Unix())
+	if err == nil {
+		err = e.Sign(b.key)
+	}
+	if err != nil {
+		log.Printf("Can't create the reply: %v", err)
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for url, relay := range b.relays {
+		err = relay.Publish(e)
+		if err != nil {
+			log.Printf("Can't publish the reply to %s: %v", url, err)
+		}
+	}
+}
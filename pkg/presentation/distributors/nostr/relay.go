@@ -0,0 +1,113 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+const subscriptionID = "rdsys"
+
+// Relay is a websocket connection to a nostr relay.
+type Relay struct {
+	URL string
+
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+type filter struct {
+	Kinds []int    `json:"kinds"`
+	P     []string `json:"#p"`
+	Since int64    `json:"since"`
+}
+
+// DialRelay connects to the relay in url.
+func DialRelay(url string) (*Relay, error) {
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	return &Relay{URL: url, conn: conn}, nil
+}
+
+func (r *Relay) send(msg []interface{}) error {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return websocket.JSON.Send(r.conn, msg)
+}
+
+// Subscribe asks the relay for the direct messages sent to pubKey since the
+// given timestamp.
+func (r *Relay) Subscribe(pubKey string, since int64) error {
+	return r.send([]interface{}{"REQ", subscriptionID, filter{
+		Kinds: []int{KindEncryptedDM},
+		P:     []string{pubKey},
+		Since: since,
+	}})
+}
+
+// Publish sends the event to the relay.
+func (r *Relay) Publish(e *Event) error {
+	return r.send([]interface{}{"EVENT", e})
+}
+
+// Receive returns the next event of our subscription.  Notices from the relay
+// are logged.
+func (r *Relay) Receive() (*Event, error) {
+	for {
+		var msg []json.RawMessage
+		err := websocket.JSON.Receive(r.conn, &msg)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg) < 2 {
+			continue
+		}
+
+		var msgType string
+		json.Unmarshal(msg[0], &msgType)
+		switch msgType {
+		case "EVENT":
+			if len(msg) < 3 {
+				continue
+			}
+			var e Event
+			err = json.Unmarshal(msg[2], &e)
+			if err != nil {
+				log.Printf("Malformed event from %s: %v", r.URL, err)
+				continue
+			}
+			return &e, nil
+		case "NOTICE":
+			var notice string
+			json.Unmarshal(msg[1], &notice)
+			log.Printf("Notice from %s: %s", r.URL, notice)
+		case "OK":
+			if len(msg) < 4 {
+				continue
+			}
+			var accepted bool
+			var reason string
+			json.Unmarshal(msg[2], &accepted)
+			json.Unmarshal(msg[3], &reason)
+			if !accepted {
+				log.Printf("Event rejected by %s: %s", r.URL, reason)
+			}
+		case "CLOSED":
+			return nil, errors.New("subscription closed by the relay")
+		}
+	}
+}
+
+// Close closes the connection to the relay.
+func (r *Relay) Close() error {
+	return r.conn.Close()
+}
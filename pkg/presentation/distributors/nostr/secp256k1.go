@@ -0,0 +1,433 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"math/bits"
+)
+
+// The secp256k1 operations needed by nostr: BIP-340 schnorr signatures and the
+// ECDH used by NIP-04.  The arithmetic works on fixed size limbs without
+// branches or memory accesses that depend on secret values, and the points are
+// added with the complete formulas of Renes, Costello and Batina, so signing
+// and ECDH take the same time for every key and every public key.
+
+var (
+	InvalidKeyError       = errors.New("invalid key")
+	InvalidSignatureError = errors.New("invalid signature")
+)
+
+// limbs is a 256 bits number as little endian 64 bits words.
+type limbs [4]uint64
+
+// modulus holds the constants of the Montgomery arithmetic modulo m, with R =
+// 2^256.
+type modulus struct {
+	m limbs
+	// inv is -m^-1 mod 2^64
+	inv uint64
+	// rr is R^2 mod m, one is R mod m
+	rr, one limbs
+}
+
+func newModulus(hex string) *modulus {
+	m, _ := new(big.Int).SetString(hex, 16)
+	mod := &modulus{m: limbsFromBig(m)}
+
+	x := uint64(1)
+	for i := 0; i < 6; i++ {
+		x *= 2 - mod.m[0]*x
+	}
+	mod.inv = -x
+
+	r := new(big.Int).Lsh(big.NewInt(1), 256)
+	mod.one = limbsFromBig(new(big.Int).Mod(r, m))
+	mod.rr = limbsFromBig(new(big.Int).Mod(new(big.Int).Mul(r, r), m))
+	return mod
+}
+
+var (
+	fieldP  = newModulus("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F")
+	scalarN = newModulus("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141")
+
+	// sqrtExp is (p+1)/4, as p = 3 mod 4 the square root of a is a^sqrtExp,
+	// and invExp is p-2
+	sqrtExp = limbsFromHex("3FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFBFFFFF0C")
+	invExp  = limbsFromHex("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2D")
+
+	curveB3 = fieldP.fromUint(3 * 7)
+	curveB9 = fieldP.fromUint(9 * 7)
+
+	generator = &point{
+		x: fieldP.toMont(limbsFromHex("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798")),
+		y: fieldP.toMont(limbsFromHex("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8")),
+		z: fieldP.one,
+	}
+)
+
+func limbsFromBig(n *big.Int) limbs {
+	var b [32]byte
+	n.FillBytes(b[:])
+	return limbsFromBytes(b[:])
+}
+
+func limbsFromHex(hex string) limbs {
+	n, _ := new(big.Int).SetString(hex, 16)
+	return limbsFromBig(n)
+}
+
+// limbsFromBytes parses 32 big endian bytes.
+func limbsFromBytes(b []byte) limbs {
+	var l limbs
+	for i := 0; i < 4; i++ {
+		l[i] = binary.BigEndian.Uint64(b[24-8*i:])
+	}
+	return l
+}
+
+func (l limbs) bytes() []byte {
+	b := make([]byte, 32)
+	for i := 0; i < 4; i++ {
+		binary.BigEndian.PutUint64(b[24-8*i:], l[i])
+	}
+	return b
+}
+
+func (l limbs) bit(i int) uint64 {
+	return (l[i/64] >> (i % 64)) & 1
+}
+
+func (l limbs) isZero() int {
+	return subtle.ConstantTimeCompare(l.bytes(), make([]byte, 32))
+}
+
+func (l limbs) equal(o limbs) int {
+	return subtle.ConstantTimeCompare(l.bytes(), o.bytes())
+}
+
+// sub returns l - o and the borrow.
+func (l limbs) sub(o limbs) (limbs, uint64) {
+	var d limbs
+	var b uint64
+	for i := 0; i < 4; i++ {
+		d[i], b = bits.Sub64(l[i], o[i], b)
+	}
+	return d, b
+}
+
+// selectLimbs returns a if bit is 1 and b if it's 0.
+func selectLimbs(bit uint64, a, b limbs) limbs {
+	mask := -bit
+	var r limbs
+	for i := 0; i < 4; i++ {
+		r[i] = (a[i] & mask) | (b[i] &^ mask)
+	}
+	return r
+}
+
+// lessThan returns 1 if l < the modulus.
+func (mod *modulus) lessThan(l limbs) uint64 {
+	_, b := l.sub(mod.m)
+	return b
+}
+
+// reduce returns the given number modulo m, if it's smaller than 2m.
+func (mod *modulus) reduce(l limbs) limbs {
+	d, b := l.sub(mod.m)
+	return selectLimbs(b, l, d)
+}
+
+func (mod *modulus) add(x, y limbs) limbs {
+	var s limbs
+	var c uint64
+	for i := 0; i < 4; i++ {
+		s[i], c = bits.Add64(x[i], y[i], c)
+	}
+	d, b := s.sub(mod.m)
+	// the sum is at least m if it overflowed or if subtracting m didn't
+	return selectLimbs(c|(b^1), d, s)
+}
+
+func (mod *modulus) sub(x, y limbs) limbs {
+	d, b := x.sub(y)
+	mask := -b
+	var c uint64
+	for i := 0; i < 4; i++ {
+		d[i], c = bits.Add64(d[i], mod.m[i]&mask, c)
+	}
+	return d
+}
+
+func (mod *modulus) neg(x limbs) limbs {
+	return mod.sub(limbs{}, x)
+}
+
+// mul returns x*y/R mod m.
+func (mod *modulus) mul(x, y limbs) limbs {
+	var t [6]uint64
+	for i := 0; i < 4; i++ {
+		var c, hi, lo, c1, c2 uint64
+		for j := 0; j < 4; j++ {
+			hi, lo = bits.Mul64(x[j], y[i])
+			lo, c1 = bits.Add64(lo, t[j], 0)
+			lo, c2 = bits.Add64(lo, c, 0)
+			t[j], c = lo, hi+c1+c2
+		}
+		t[4], c1 = bits.Add64(t[4], c, 0)
+		t[5] = c1
+
+		q := t[0] * mod.inv
+		hi, lo = bits.Mul64(q, mod.m[0])
+		_, c1 = bits.Add64(lo, t[0], 0)
+		c = hi + c1
+		for j := 1; j < 4; j++ {
+			hi, lo = bits.Mul64(q, mod.m[j])
+			lo, c1 = bits.Add64(lo, t[j], 0)
+			lo, c2 = bits.Add64(lo, c, 0)
+			t[j-1], c = lo, hi+c1+c2
+		}
+		t[3], c1 = bits.Add64(t[4], c, 0)
+		t[4] = t[5] + c1
+	}
+
+	r := limbs{t[0], t[1], t[2], t[3]}
+	d, b := r.sub(mod.m)
+	return selectLimbs(t[4]|(b^1), d, r)
+}
+
+func (mod *modulus) toMont(x limbs) limbs {
+	return mod.mul(x, mod.rr)
+}
+
+func (mod *modulus) fromMont(x limbs) limbs {
+	return mod.mul(x, limbs{1})
+}
+
+func (mod *modulus) fromUint(v uint64) limbs {
+	return mod.toMont(limbs{v})
+}
+
+// exp returns x^e in Montgomery form.  The exponent is public, the time only
+// depends on it.
+func (mod *modulus) exp(x, e limbs) limbs {
+	r := mod.one
+	for i := 255; i >= 0; i-- {
+		r = mod.mul(r, r)
+		if e.bit(i) == 1 {
+			r = mod.mul(r, x)
+		}
+	}
+	return r
+}
+
+// mulScalars returns x*y mod n of two scalars that are not in Montgomery form.
+func mulScalars(x, y limbs) limbs {
+	return scalarN.mul(scalarN.mul(x, y), scalarN.rr)
+}
+
+// point is a point of the curve in projective coordinates, with the
+// coordinates in Montgomery form.  The point at infinity has z = 0.
+type point struct {
+	x, y, z limbs
+}
+
+var infinity = &point{y: fieldP.one}
+
+// add returns p+q.  The formulas of algorithm 7 of "Complete addition formulas
+// for prime order elliptic curves" also work for doubling and the point at
+// infinity.
+func (p *point) add(q *point) *point {
+	f := fieldP
+	xx := f.mul(p.x, q.x)
+	yy := f.mul(p.y, q.y)
+	zz := f.mul(p.z, q.z)
+	xy := f.sub(f.mul(f.add(p.x, p.y), f.add(q.x, q.y)), f.add(xx, yy))
+	yz := f.sub(f.mul(f.add(p.y, p.z), f.add(q.y, q.z)), f.add(yy, zz))
+	xz := f.sub(f.mul(f.add(p.x, p.z), f.add(q.x, q.z)), f.add(xx, zz))
+
+	bzz3 := f.mul(curveB3, zz)
+	yyMinus := f.sub(yy, bzz3)
+	yyPlus := f.add(yy, bzz3)
+	xx3 := f.add(f.add(xx, xx), xx)
+	return &point{
+		x: f.sub(f.mul(xy, yyMinus), f.mul(f.mul(curveB3, yz), xz)),
+		y: f.add(f.mul(yyPlus, yyMinus), f.mul(f.mul(curveB9, xx), xz)),
+		z: f.add(f.mul(yz, yyPlus), f.mul(xx3, xy)),
+	}
+}
+
+// mul returns k*p, doing the same operations for every scalar k.
+func (p *point) mul(k limbs) *point {
+	r := infinity
+	for i := 255; i >= 0; i-- {
+		r = r.add(r)
+		sum := r.add(p)
+		bit := k.bit(i)
+		r = &point{
+			x: selectLimbs(bit, sum.x, r.x),
+			y: selectLimbs(bit, sum.y, r.y),
+			z: selectLimbs(bit, sum.z, r.z),
+		}
+	}
+	return r
+}
+
+func (p *point) neg() *point {
+	return &point{p.x, fieldP.neg(p.y), p.z}
+}
+
+func (p *point) isInfinity() bool {
+	return p.z.isZero() == 1
+}
+
+// affine returns the x and y coordinates of a point that isn't the point at
+// infinity, not in Montgomery form.
+func (p *point) affine() (limbs, limbs) {
+	zInv := fieldP.exp(p.z, invExp)
+	return fieldP.fromMont(fieldP.mul(p.x, zInv)), fieldP.fromMont(fieldP.mul(p.y, zInv))
+}
+
+// liftX returns the point with the given x coordinate and even y.
+func liftX(xBytes []byte) (*point, error) {
+	x := limbsFromBytes(xBytes)
+	if fieldP.lessThan(x) == 0 {
+		return nil, InvalidKeyError
+	}
+	f := fieldP
+	xm := f.toMont(x)
+	c := f.add(f.mul(f.mul(xm, xm), xm), f.fromUint(7))
+	y := f.exp(c, sqrtExp)
+	if f.mul(y, y).equal(c) != 1 {
+		return nil, InvalidKeyError
+	}
+	odd := f.fromMont(y).bit(0)
+	return &point{x: xm, y: selectLimbs(odd, f.neg(y), y), z: f.one}, nil
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// hashToScalar returns the tagged hash of the data modulo n.
+func hashToScalar(tag string, data ...[]byte) limbs {
+	// 2^256 < 2n, so a single reduction is enough
+	return scalarN.reduce(limbsFromBytes(taggedHash(tag, data...)))
+}
+
+// PrivateKey is a secp256k1 private key.
+type PrivateKey struct {
+	d limbs
+	// pubKey is the x-only public key and pubKeyOdd is 1 if the y
+	// coordinate of d*G is odd.
+	pubKey    []byte
+	pubKeyOdd uint64
+}
+
+// NewPrivateKey parses a 32 bytes private key.
+func NewPrivateKey(key []byte) (*PrivateKey, error) {
+	if len(key) != 32 {
+		return nil, InvalidKeyError
+	}
+	d := limbsFromBytes(key)
+	if d.isZero() == 1 || scalarN.lessThan(d) == 0 {
+		return nil, InvalidKeyError
+	}
+	x, y := generator.mul(d).affine()
+	return &PrivateKey{d: d, pubKey: x.bytes(), pubKeyOdd: y.bit(0)}, nil
+}
+
+// PublicKey returns the x-only public key as defined in BIP-340.
+func (k *PrivateKey) PublicKey() []byte {
+	return append([]byte{}, k.pubKey...)
+}
+
+// Sign returns the BIP-340 schnorr signature of the 32 bytes msg.  aux is the
+// auxiliary random data, if nil 32 bytes are read from rand.
+func (k *PrivateKey) Sign(msg []byte, rand io.Reader, aux []byte) ([]byte, error) {
+	if aux == nil {
+		aux = make([]byte, 32)
+		_, err := io.ReadFull(rand, aux)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := selectLimbs(k.pubKeyOdd, scalarN.neg(k.d), k.d)
+	t := d.bytes()
+	auxHash := taggedHash("BIP0340/aux", aux)
+	for i := range t {
+		t[i] ^= auxHash[i]
+	}
+
+	k0 := hashToScalar("BIP0340/nonce", t, k.pubKey, msg)
+	if k0.isZero() == 1 {
+		return nil, errors.New("invalid nonce")
+	}
+	rx, ry := generator.mul(k0).affine()
+	k0 = selectLimbs(ry.bit(0), scalarN.neg(k0), k0)
+
+	rBytes := rx.bytes()
+	e := hashToScalar("BIP0340/challenge", rBytes, k.pubKey, msg)
+	s := scalarN.add(k0, mulScalars(e, d))
+	return append(rBytes, s.bytes()...), nil
+}
+
+// Verify checks the BIP-340 schnorr signature of msg for the x-only pubKey.
+func Verify(pubKey, msg, sig []byte) error {
+	if len(pubKey) != 32 || len(sig) != 64 {
+		return InvalidSignatureError
+	}
+	p, err := liftX(pubKey)
+	if err != nil {
+		return err
+	}
+	r := limbsFromBytes(sig[:32])
+	s := limbsFromBytes(sig[32:])
+	if fieldP.lessThan(r) == 0 || scalarN.lessThan(s) == 0 {
+		return InvalidSignatureError
+	}
+
+	e := hashToScalar("BIP0340/challenge", sig[:32], pubKey, msg)
+	rp := generator.mul(s).add(p.mul(e).neg())
+	if rp.isInfinity() {
+		return InvalidSignatureError
+	}
+	x, y := rp.affine()
+	if y.bit(0) != 0 || x.equal(r) != 1 {
+		return InvalidSignatureError
+	}
+	return nil
+}
+
+// SharedSecret returns the x coordinate of the ECDH point between the private
+// key and the x-only pubKey, as used by NIP-04.
+func (k *PrivateKey) SharedSecret(pubKey []byte) ([]byte, error) {
+	if len(pubKey) != 32 {
+		return nil, InvalidKeyError
+	}
+	p, err := liftX(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	shared := p.mul(k.d)
+	if shared.isInfinity() {
+		return nil, InvalidKeyError
+	}
+	x, _ := shared.affine()
+	return x.bytes(), nil
+}
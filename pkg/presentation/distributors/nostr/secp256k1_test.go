@@ -0,0 +1,115 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+// test vectors from BIP-340
+var signVectors = []struct {
+	secKey, pubKey, aux, msg, sig string
+}{
+	{
+		"0000000000000000000000000000000000000000000000000000000000000003",
+		"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+	},
+	{
+		"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"0000000000000000000000000000000000000000000000000000000000000001",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+	},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSign(t *testing.T) {
+	for _, v := range signVectors {
+		key, err := NewPrivateKey(decodeHex(t, v.secKey))
+		if err != nil {
+			t.Fatal("Can't parse the private key:", err)
+		}
+		pubKey := decodeHex(t, v.pubKey)
+		if !bytes.Equal(key.PublicKey(), pubKey) {
+			t.Errorf("Wrong public key: %x", key.PublicKey())
+		}
+
+		msg := decodeHex(t, v.msg)
+		sig, err := key.Sign(msg, nil, decodeHex(t, v.aux))
+		if err != nil {
+			t.Fatal("Can't sign:", err)
+		}
+		if !bytes.Equal(sig, decodeHex(t, v.sig)) {
+			t.Errorf("Wrong signature: %x", sig)
+		}
+		if err = Verify(pubKey, msg, sig); err != nil {
+			t.Error("Can't verify the signature:", err)
+		}
+
+		msg[0] ^= 1
+		if err = Verify(pubKey, msg, sig); err != InvalidSignatureError {
+			t.Error("Signature verified with the wrong message:", err)
+		}
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	var keys []*PrivateKey
+	for i := 0; i < 2; i++ {
+		raw := make([]byte, 32)
+		rand.Read(raw)
+		key, err := NewPrivateKey(raw)
+		if err != nil {
+			t.Fatal("Can't create private key:", err)
+		}
+		keys = append(keys, key)
+	}
+
+	s1, err := keys[0].SharedSecret(keys[1].PublicKey())
+	if err != nil {
+		t.Fatal("Can't compute shared secret:", err)
+	}
+	s2, err := keys[1].SharedSecret(keys[0].PublicKey())
+	if err != nil {
+		t.Fatal("Can't compute shared secret:", err)
+	}
+	if !bytes.Equal(s1, s2) {
+		t.Errorf("Shared secrets don't match: %x %x", s1, s2)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	for _, k := range []string{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141",
+		"0102",
+	} {
+		_, err := NewPrivateKey(decodeHex(t, k))
+		if err != InvalidKeyError {
+			t.Errorf("Expected invalid key error for %s: %v", k, err)
+		}
+	}
+
+	// from BIP-340: the public key is not a valid x coordinate
+	pubKey := decodeHex(t, "EEFDEA4CDB677750A420FEE807EACF21EB9898AE79B9768766E4FAA04A2D4A34")
+	sig := make([]byte, 64)
+	if err := Verify(pubKey, make([]byte, 32), sig); err != InvalidKeyError {
+		t.Error("Expected invalid key error:", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reserved
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/reserved"
+)
+
+const maxRequestSize = 8 * 1024
+
+var (
+	dist           *reserved.ReservedDistributor
+	operatorTokens map[string]string
+)
+
+type handoutRequest struct {
+	Recipient string `json:"recipient"`
+	Note      string `json:"note"`
+	Type      string `json:"type"`
+	Country   string `json:"country"`
+	Num       int    `json:"num"`
+}
+
+// authenticate returns the name of the operator that owns the token of the
+// request, or an empty string if there is none.
+func authenticate(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	token := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	operator := ""
+	for name, t := range operatorTokens {
+		if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			operator = name
+		}
+	}
+	return operator
+}
+
+func writeResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// handoutHandler hands out reserved bridges to the recipient of the request.
+func handoutHandler(w http.ResponseWriter, r *http.Request) {
+	operator := authenticate(r)
+	if operator == "" {
+		log.Printf("Invalid authentication token for a reserved handout.")
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req handoutRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+
+	handout, _, err := dist.HandOut(reserved.HandoutRequest{
+		Operator:  operator,
+		Recipient: req.Recipient,
+		Note:      req.Note,
+		Type:      req.Type,
+		Country:   req.Country,
+		Num:       req.Num,
+	})
+	switch {
+	case errors.Is(err, reserved.InvalidRequestError),
+		errors.Is(err, reserved.UnsupportedTypeError),
+		errors.Is(err, reserved.TooManyBridgesError):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, reserved.NoBridgesError):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err != nil:
+		log.Printf("Error handing out reserved bridges: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	default:
+		writeResponse(w, handout)
+	}
+}
+
+// handoutsHandler lists the handouts of the operator of the request.
+func handoutsHandler(w http.ResponseWriter, r *http.Request) {
+	operator := authenticate(r)
+	if operator == "" {
+		log.Printf("Invalid authentication token for the reserved handouts.")
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+	writeResponse(w, dist.Handouts(operator))
+}
+
+// InitFrontend is the entry point to the reserved distributor's Web API.  It
+// lets the operators hand out the reserved bridges until it receives a
+// SIGINT.
+func InitFrontend(cfg *internal.Config) {
+	reservedCfg := &cfg.Distributors.Reserved
+	if len(reservedCfg.OperatorTokens) == 0 {
+		log.Printf("No operator tokens configured, nobody will be able to hand out reserved bridges.")
+	}
+	for name, token := range reservedCfg.OperatorTokens {
+		if strings.Contains(token, "Placeholder") {
+			log.Fatalf("The operator token of %s is a placeholder, replace it with a random token.", name)
+		}
+	}
+
+	dist = &reserved.ReservedDistributor{
+		HandoutsStore: pjson.New("handouts", reservedCfg.StorageDir),
+	}
+	operatorTokens = reservedCfg.OperatorTokens
+	handlers := map[string]http.HandlerFunc{
+		"/reserved/handout":  http.HandlerFunc(handoutHandler),
+		"/reserved/handouts": http.HandlerFunc(handoutsHandler),
+		"/metrics":           promhttp.Handler().ServeHTTP,
+	}
+
+	common.StartWebServer(
+		&reservedCfg.WebApi,
+		cfg,
+		dist,
+		handlers,
+	)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/file"
@@ -35,7 +36,9 @@ func ProxiesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no field 'type' given", http.StatusBadRequest)
 		return
 	}
-	proxies, err := dist.GetProxies(secretId[0], rType[0])
+	// The country is optional, proxies blocked in it are not returned.
+	country := strings.ToLower(r.Form.Get("country"))
+	proxies, err := dist.GetProxies(secretId[0], rType[0], country)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -5,15 +5,75 @@
 package stub
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/stub"
 )
 
-var dist *stub.StubDistributor
+var (
+	dist        *stub.StubDistributor
+	adminTokens map[string]string
+)
+
+// partitionResponse is the response of /stub/partition.
+type partitionResponse struct {
+	Resources []core.Resource  `json:"resources"`
+	Stream    stub.StreamStats `json:"stream"`
+}
+
+func getTokenName(w http.ResponseWriter, r *http.Request) string {
+	tokenLine := r.Header.Get("Authorization")
+	if tokenLine == "" {
+		log.Printf("Request carries no 'Authorization' HTTP header.")
+		http.Error(w, "request carries no 'Authorization' HTTP header", http.StatusBadRequest)
+		return ""
+	}
+	if !strings.HasPrefix(tokenLine, "Bearer ") {
+		log.Printf("Authorization header contains no bearer token.")
+		http.Error(w, "authorization header contains no bearer token", http.StatusBadRequest)
+		return ""
+	}
+	givenToken := strings.TrimPrefix(tokenLine, "Bearer ")
+
+	for name, savedToken := range adminTokens {
+		if savedToken != "" && subtle.ConstantTimeCompare([]byte(givenToken), []byte(savedToken)) == 1 {
+			return name
+		}
+	}
+
+	log.Printf("Invalid authentication token.")
+	http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+	return ""
+}
+
+// authenticated wraps the given handler so it only serves the requests that
+// carry one of the admin tokens.
+func authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if getTokenName(w, r) == "" {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
 
 // RequestHandler handles requests for /.
 func RequestHandler(w http.ResponseWriter, r *http.Request) {
@@ -21,7 +81,9 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	// Call our distributor backend to get bridges.
-	resources, err := dist.RequestBridges(0)
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	resources, err := dist.RequestBridges(ctx, 0)
 	if err != nil {
 		fmt.Fprintf(w, err.Error())
 	} else {
@@ -31,18 +93,78 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// PartitionHandler handles requests for /stub/partition.  It returns all the
+// resources of the distributor's partition and the stats of the resource
+// stream.
+func PartitionHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, partitionResponse{
+		Resources: dist.Partition(),
+		Stream:    dist.StreamStats(),
+	})
+}
+
+// LookupHandler handles requests for /stub/lookup?fingerprint=...  It returns
+// the resources of the partition with the given fingerprint.
+func LookupHandler(w http.ResponseWriter, r *http.Request) {
+	fingerprint := r.URL.Query().Get("fingerprint")
+	if fingerprint == "" {
+		http.Error(w, "missing fingerprint", http.StatusBadRequest)
+		return
+	}
+	found := dist.Lookup(fingerprint)
+	if len(found) == 0 {
+		http.Error(w, "fingerprint not found", http.StatusNotFound)
+		return
+	}
+	writeResponse(w, found)
+}
+
+// SimulateHandler handles requests for /stub/simulate?requests=...  It makes
+// the given number of bridge requests and reports how they went.
+func SimulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	num, err := strconv.Atoi(r.URL.Query().Get("requests"))
+	if err != nil {
+		http.Error(w, "invalid number of requests", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	report, err := dist.SimulateLoad(ctx, num)
+	if errors.Is(err, stub.InvalidLoadError) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeResponse(w, report)
+}
+
 // InitFrontend is the entry point to stub's Web frontend.  It spins up a Web
 // server and then waits until it receives a SIGINT.  Note that we can
 // implement all sorts of user-facing frontends here.  It doesn't have to be a
 // Web server.  It could be an SMTP server, BitTorrent tracker, message board,
 // etc.
+//
+// The stub is meant for developers: all of its endpoints need one of the
+// admin tokens of the configuration.
 func InitFrontend(cfg *internal.Config) {
 
+	adminTokens = cfg.Distributors.Stub.AdminTokens
+	if len(adminTokens) == 0 {
+		log.Printf("No admin tokens configured, nobody will be able to use the %s distributor.", stub.DistName)
+	}
+
 	// Start our distributor backend, which takes care of the distribution
 	// logic.  This file implements the user-facing distribution code.
 	dist = &stub.StubDistributor{}
 	handlers := map[string]http.HandlerFunc{
-		"/": http.HandlerFunc(RequestHandler),
+		"/":               authenticated(RequestHandler),
+		"/stub/partition": authenticated(PartitionHandler),
+		"/stub/lookup":    authenticated(LookupHandler),
+		"/stub/simulate":  authenticated(SimulateHandler),
 	}
 
 	common.StartWebServer(
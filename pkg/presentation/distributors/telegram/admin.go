@@ -0,0 +1,94 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// maxPoolListing is the maximum number of resources listed by /pool, to keep
+// the reply under the telegram message size limit.
+const maxPoolListing = 20
+
+// adminOnly wraps an admin command handler so it's silently ignored for users
+// that are not configured as admins.
+func (t *TBot) adminOnly(handler func(*tb.Message)) func(*tb.Message) {
+	return func(m *tb.Message) {
+		if !t.dist.IsAdmin(m.Sender.ID) {
+			log.Printf("User %d tried to use the admin command %s.", m.Sender.ID, m.Text)
+			return
+		}
+		handler(m)
+	}
+}
+
+func (t *TBot) stats(m *tb.Message) {
+	stats := t.dist.PoolStats()
+	response := fmt.Sprintf("Old pool: %d resources\nNew pool: %d resources", stats.OldResources, stats.NewResources)
+
+	updaters := make([]string, 0, len(stats.DynamicBridges))
+	for updater := range stats.DynamicBridges {
+		updaters = append(updaters, updater)
+	}
+	sort.Strings(updaters)
+	for _, updater := range updaters {
+		lastUpdate := "never"
+		if date, ok := stats.LastUpdates[updater]; ok {
+			lastUpdate = date.UTC().Format(time.RFC3339)
+		}
+		response += fmt.Sprintf("\nUpdater %s: %d bridges, last push %s", updater, stats.DynamicBridges[updater], lastUpdate)
+	}
+	t.bot.Send(m.Sender, response)
+}
+
+func (t *TBot) pool(m *tb.Message) {
+	pool := strings.TrimSpace(m.Payload)
+	resources, err := t.dist.PoolResources(pool)
+	if err != nil {
+		t.bot.Send(m.Sender, fmt.Sprintf("Usage: /pool %s|%s", telegram.NewPool, telegram.OldPool))
+		return
+	}
+
+	response := fmt.Sprintf("Pool %s: %d resources", pool, len(resources))
+	for i, r := range resources {
+		if i == maxPoolListing {
+			response += fmt.Sprintf("\n... and %d more", len(resources)-maxPoolListing)
+			break
+		}
+		response += "\n" + r.String()
+	}
+	t.bot.Send(m.Sender, response)
+}
+
+func (t *TBot) lookup(m *tb.Message) {
+	fingerprint := strings.TrimSpace(m.Payload)
+	if fingerprint == "" {
+		t.bot.Send(m.Sender, "Usage: /lookup <fingerprint>")
+		return
+	}
+
+	results := t.dist.Lookup(fingerprint)
+	if len(results) == 0 {
+		t.bot.Send(m.Sender, "No resources found with fingerprint "+fingerprint)
+		return
+	}
+
+	response := fmt.Sprintf("Found %d resources:", len(results))
+	for _, result := range results {
+		response += "\n" + result.Pool + " pool"
+		if result.Updater != "" {
+			response += " (updater " + result.Updater + ")"
+		}
+		response += ": " + result.Resource.String()
+	}
+	t.bot.Send(m.Sender, response)
+}
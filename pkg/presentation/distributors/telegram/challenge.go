@@ -0,0 +1,75 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"errors"
+	"log"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const challengeButtonsPerRow = 3
+
+var challengeButton = tb.InlineButton{Unique: "challenge"}
+
+// sendChallenge asks the user to select the right option of an inline
+// keyboard before we hand out bridges.
+func (t *TBot) sendChallenge(user *tb.User) {
+	challenge := t.dist.NewChallenge(user.ID)
+
+	var keyboard [][]tb.InlineButton
+	var row []tb.InlineButton
+	for _, option := range challenge.Options {
+		button := challengeButton.With(option.Token)
+		button.Text = option.Symbol
+		row = append(row, *button)
+		if len(row) == challengeButtonsPerRow {
+			keyboard = append(keyboard, row)
+			row = nil
+		}
+	}
+	if len(row) != 0 {
+		keyboard = append(keyboard, row)
+	}
+
+	animal := challenge.Answer.Name
+	if msg, ok := animalNames[animal]; ok {
+		animal = t.localize(user, msg, nil)
+	}
+	text := t.localize(user, msgChallenge, map[string]interface{}{"Animal": animal})
+	_, err := t.bot.Send(user, text, &tb.ReplyMarkup{InlineKeyboard: keyboard})
+	if err != nil {
+		log.Println("Error sending challenge:", err)
+	}
+}
+
+func (t *TBot) challengeCallback(c *tb.Callback) {
+	if c.Sender == nil || c.Sender.IsBot {
+		t.bot.Respond(c)
+		return
+	}
+
+	err := t.dist.SolveChallenge(c.Sender.ID, c.Data)
+	if c.Message != nil {
+		// remove the keyboard, so the same challenge can't be answered again
+		t.bot.Delete(c.Message)
+	}
+
+	switch {
+	case err == nil:
+		t.bot.Respond(c, &tb.CallbackResponse{Text: t.localize(c.Sender, msgChallengeCorrect, nil)})
+		t.sendBridges(c.Sender)
+	case errors.Is(err, telegram.TooManyAttemptsError):
+		t.bot.Respond(c, &tb.CallbackResponse{Text: t.localize(c.Sender, msgChallengeTooManyAttempts, nil)})
+	case errors.Is(err, telegram.WrongAnswerError):
+		t.bot.Respond(c, &tb.CallbackResponse{Text: t.localize(c.Sender, msgChallengeWrong, nil)})
+		t.sendChallenge(c.Sender)
+	default:
+		t.bot.Respond(c, &tb.CallbackResponse{Text: t.localize(c.Sender, msgChallengeExpired, nil)})
+		t.sendChallenge(c.Sender)
+	}
+}
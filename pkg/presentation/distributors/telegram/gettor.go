@@ -0,0 +1,332 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/gettor"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const gettorButtonsPerRow = 3
+
+var (
+	gettorButton = tb.InlineButton{Unique: "gettor"}
+
+	msgGettorSelectPlatform = &i18n.Message{
+		ID:    "TelegramGettorSelectPlatform",
+		Other: "Select the platform you want to download Tor Browser for:",
+	}
+	msgGettorLinks = &i18n.Message{
+		ID:    "TelegramGettorLinks",
+		Other: "Tor Browser {{.Version}} for {{.Platform}}:",
+	}
+	msgGettorSignature = &i18n.Message{
+		ID:    "TelegramGettorSignature",
+		Other: "Signature file",
+	}
+	msgGettorNoLinks = &i18n.Message{
+		ID:    "TelegramGettorNoLinks",
+		Other: "There are no download links available right now, please try again later.",
+	}
+	msgGettorSignatures = &i18n.Message{
+		ID:    "TelegramGettorSignatures",
+		Other: "Signature files of Tor Browser {{.Version}} for {{.Platform}}:",
+	}
+	msgGettorChecksum = &i18n.Message{
+		ID:    "TelegramGettorChecksum",
+		Other: "Checksum file of Tor Browser {{.Version}}:",
+	}
+	msgGettorChecksums = &i18n.Message{
+		ID:    "TelegramGettorChecksums",
+		Other: "SHA-256 checksums of the Tor Browser {{.Version}} files, compare them with the files you download from a mirror you don't trust:",
+	}
+	msgGettorVersionNotAvailable = &i18n.Message{
+		ID:    "TelegramGettorVersionNotAvailable",
+		Other: "Tor Browser {{.Version}} is not available for {{.Platform}}, the available version is {{.Latest}}.",
+	}
+	msgGettorLocaleFallback = &i18n.Message{
+		ID:    "TelegramGettorLocaleFallback",
+		Other: "Tor Browser is not available in {{.Requested}}, the links are for the closest language available: {{.Locale}}.",
+	}
+	msgGettorHelp = &i18n.Message{
+		ID:    "TelegramGettorHelp",
+		Other: "Send /gettor followed by the platform, like /gettor windows. Add 'signature' to get only the signature files, 'checksums' to get the checksums of the files and the checksum file of the release, 'version 12.0.1' to request a version, or 'alpha' or 'nightly' to get the test builds.",
+	}
+
+	gettorErrors = map[error]*i18n.Message{
+		gettor.MissingVersionError: {
+			ID:    "TelegramGettorMissingVersion",
+			Other: "The version is missing, please write it after 'version', like 'version 12.0.1'.",
+		},
+		gettor.InvalidVersionError: {
+			ID:    "TelegramGettorInvalidVersion",
+			Other: "That is not a valid version, please write it like 12.0.1.",
+		},
+		gettor.MissingPlatformError: {
+			ID:    "TelegramGettorMissingPlatform",
+			Other: "The platform is missing, please write it after /gettor, like /gettor windows signature.",
+		},
+	}
+)
+
+// getTorBrowser replies with the download links for the platform given as
+// argument of the command, or asks for one with an inline keyboard.
+func (t *TBot) getTorBrowser(m *tb.Message) {
+	command := t.gettor.ParseCommandWithLocale(strings.NewReader(m.Payload), t.gettorLocale(m.Sender))
+	switch {
+	case command.Error != nil:
+		t.sendGettorHelp(m.Sender, command)
+	case command.Command == gettor.CommandLinks:
+		t.sendVersionLinks(m.Sender, command)
+	case command.Command == gettor.CommandSignature:
+		t.sendSignatures(m.Sender, command)
+	case command.Command == gettor.CommandChecksum:
+		t.sendChecksum(m.Sender, command)
+	default:
+		t.sendPlatforms(m.Sender)
+	}
+}
+
+// sendGettorHelp explains the usage of /gettor and why the command failed.
+func (t *TBot) sendGettorHelp(user *tb.User, command *gettor.Command) {
+	response := t.localize(user, msgGettorHelp, nil)
+	for err, msg := range gettorErrors {
+		if errors.Is(command.Error, err) {
+			response = t.localize(user, msg, nil) + "\n\n" + response
+			break
+		}
+	}
+	t.sendGettorReply(user, command, gettor.OutcomeSent, response)
+}
+
+// sendGettorReply sends the reply to the command and counts its outcome.
+func (t *TBot) sendGettorReply(user *tb.User, command *gettor.Command, outcome string, what interface{}, options ...interface{}) {
+	if _, err := t.bot.Send(user, what, options...); err != nil {
+		outcome = gettor.OutcomeSendFailed
+	}
+	gettor.CountReply(command, outcome)
+}
+
+// sendVersionLinks sends the links of the command if the requested version
+// is available.
+func (t *TBot) sendVersionLinks(user *tb.User, command *gettor.Command) {
+	if !t.versionAvailable(user, command) {
+		return
+	}
+	t.sendLinks(user, command)
+}
+
+// versionAvailable checks that the version requested in the command is the
+// one we have, and tells the user if it isn't.
+func (t *TBot) versionAvailable(user *tb.User, command *gettor.Command) bool {
+	err := t.gettor.CheckVersion(command)
+	if !errors.Is(err, gettor.VersionNotAvailableError) {
+		return true
+	}
+
+	latest, ok := t.gettor.LatestVersion(command.Product, command.Platform, command.Channel)
+	if !ok {
+		t.sendGettorReply(user, command, gettor.OutcomeNoLinks, t.localize(user, msgGettorNoLinks, nil))
+		return false
+	}
+	t.sendGettorReply(user, command, gettor.OutcomeVersionNotAvailable, t.localize(user, msgGettorVersionNotAvailable, map[string]interface{}{
+		"Version":  command.Version.String(),
+		"Platform": platformName(command),
+		"Latest":   latest.String(),
+	}))
+	return false
+}
+
+func (t *TBot) sendSignatures(user *tb.User, command *gettor.Command) {
+	if !t.versionAvailable(user, command) {
+		return
+	}
+	links, locale, fallback := t.gettor.FindLinks(command)
+	if len(links) == 0 {
+		t.sendGettorReply(user, command, gettor.OutcomeNoLinks, t.localize(user, msgGettorNoLinks, nil))
+		return
+	}
+
+	response := t.localeNote(user, command.Locale, locale, fallback)
+	response += t.localize(user, msgGettorSignatures, map[string]interface{}{
+		"Version":  links[0].Version.String(),
+		"Platform": platformName(command),
+	})
+	for _, link := range links {
+		response += "\n\n" + linkName(link) + ": " + link.SigLink
+	}
+	t.sendGettorReply(user, command, gettor.OutcomeSent, response, tb.NoPreview)
+}
+
+func (t *TBot) sendChecksum(user *tb.User, command *gettor.Command) {
+	version, ok := t.gettor.LatestVersion(command.Product, command.Platform, command.Channel)
+	if command.Version != nil {
+		version, ok = *command.Version, true
+	}
+	if !ok {
+		t.sendGettorReply(user, command, gettor.OutcomeNoLinks, t.localize(user, msgGettorNoLinks, nil))
+		return
+	}
+
+	response := ""
+	checksums := t.gettor.GetChecksums(command)
+	if len(checksums) != 0 {
+		response = t.localize(user, msgGettorChecksums, map[string]interface{}{
+			"Version": version.String(),
+		}) + "\n"
+		fileNames := make([]string, 0, len(checksums))
+		for fileName := range checksums {
+			fileNames = append(fileNames, fileName)
+		}
+		sort.Strings(fileNames)
+		for _, fileName := range fileNames {
+			response += "\n" + fileName + ": " + checksums[fileName]
+		}
+		response += "\n\n"
+	}
+
+	checksum, signature := t.gettor.GetChecksumLinks(version)
+	response += t.localize(user, msgGettorChecksum, map[string]interface{}{
+		"Version": version.String(),
+	})
+	response += "\n\n" + checksum
+	response += "\n" + t.localize(user, msgGettorSignature, nil) + ": " + signature
+	t.sendGettorReply(user, command, gettor.OutcomeSent, response, tb.NoPreview)
+}
+
+func (t *TBot) sendPlatforms(user *tb.User) {
+	platforms := t.gettor.AvailablePlatforms()
+	if len(platforms) == 0 {
+		t.bot.Send(user, t.localize(user, msgGettorNoLinks, nil))
+		return
+	}
+
+	var keyboard [][]tb.InlineButton
+	var row []tb.InlineButton
+	for _, platform := range platforms {
+		button := gettorButton.With(platform)
+		button.Text = platform
+		row = append(row, *button)
+		if len(row) == gettorButtonsPerRow {
+			keyboard = append(keyboard, row)
+			row = nil
+		}
+	}
+	if len(row) != 0 {
+		keyboard = append(keyboard, row)
+	}
+
+	_, err := t.bot.Send(user, t.localize(user, msgGettorSelectPlatform, nil), &tb.ReplyMarkup{InlineKeyboard: keyboard})
+	if err != nil {
+		log.Println("Error sending platforms:", err)
+	}
+}
+
+func (t *TBot) gettorCallback(c *tb.Callback) {
+	t.bot.Respond(c)
+	if c.Sender == nil || c.Sender.IsBot {
+		return
+	}
+	if c.Message != nil {
+		t.bot.Delete(c.Message)
+	}
+	// The callback data comes from the client, it's only used if it's one of
+	// the platforms of the keyboard
+	if !t.availablePlatform(c.Data) {
+		t.sendPlatforms(c.Sender)
+		return
+	}
+	t.sendLinks(c.Sender, &gettor.Command{
+		Command:  gettor.CommandLinks,
+		Platform: c.Data,
+		Locale:   t.gettorLocale(c.Sender),
+	})
+}
+
+func (t *TBot) availablePlatform(platform string) bool {
+	for _, p := range t.gettor.AvailablePlatforms() {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TBot) sendLinks(user *tb.User, command *gettor.Command) {
+	links, locale, fallback := t.gettor.FindLinks(command)
+	if len(links) == 0 {
+		t.sendGettorReply(user, command, gettor.OutcomeNoLinks, t.localize(user, msgGettorNoLinks, nil))
+		return
+	}
+
+	response := t.localeNote(user, command.Locale, locale, fallback)
+	response += t.localize(user, msgGettorLinks, map[string]interface{}{
+		"Version":  links[0].Version.String(),
+		"Platform": platformName(command),
+	})
+	signature := t.localize(user, msgGettorSignature, nil)
+	for _, link := range links {
+		response += "\n\n" + linkName(link) + ": " + link.Link
+		response += "\n" + signature + ": " + link.SigLink
+		if link.Checksum != "" {
+			response += "\nSHA-256: " + link.Checksum
+		}
+		if command.Torrent && link.Magnet != "" {
+			response += "\nMagnet: " + link.Magnet
+		}
+	}
+	t.sendGettorReply(user, command, gettor.OutcomeSent, response, tb.NoPreview)
+}
+
+// platformName returns the platform of the command, its channel, if it's not
+// the release one, and its product, if it's not Tor Browser.
+func platformName(command *gettor.Command) string {
+	name := command.Platform
+	if command.Channel != "" {
+		name += " (" + command.Channel + ")"
+	}
+	if command.Product != "" {
+		name += " (" + resources.ProductNames[command.Product] + ")"
+	}
+	return name
+}
+
+// linkName returns the provider of the link and its architecture, if it has
+// one.
+func linkName(link *resources.TBLink) string {
+	if link.Arch == "" {
+		return link.Provider
+	}
+	return link.Provider + " (" + link.Arch + ")"
+}
+
+// localeNote tells the user that the links are not for the requested
+// language, if it's a fallback.
+func (t *TBot) localeNote(user *tb.User, requested, locale string, fallback bool) string {
+	if !fallback {
+		return ""
+	}
+	return t.localize(user, msgGettorLocaleFallback, map[string]interface{}{
+		"Requested": requested,
+		"Locale":    locale,
+	}) + "\n\n"
+}
+
+// gettorLocale returns the language of the user, the gettor distributor
+// chooses the closest Tor Browser locale for it.
+func (t *TBot) gettorLocale(user *tb.User) string {
+	lang := t.languages.get(user.ID)
+	if lang == "" {
+		lang = user.LanguageCode
+	}
+	return lang
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+var (
+	msgInviteRedeemed = &i18n.Message{
+		ID:    "TelegramInviteRedeemed",
+		Other: "Welcome! You joined with an invite, send /bridges to get your bridges.",
+	}
+	msgInviteInvalid = &i18n.Message{
+		ID:    "TelegramInviteInvalid",
+		Other: "This invite is not valid or it was already used.",
+	}
+	msgInviteLink = &i18n.Message{
+		ID:    "TelegramInviteLink",
+		Other: "Share this link with someone you trust, it can only be used once:\n{{.Link}}",
+	}
+	msgNoInvitesLeft = &i18n.Message{
+		ID:    "TelegramNoInvitesLeft",
+		Other: "You can't create more invites.",
+	}
+)
+
+// start handles the /start command, that carries the invite token as payload
+// when the user arrives with an invite link.
+func (t *TBot) start(m *tb.Message) {
+	token := strings.TrimSpace(m.Payload)
+	if token == "" {
+		t.help(m)
+		return
+	}
+
+	err := t.dist.RedeemInvite(m.Sender.ID, token)
+	if err != nil {
+		if !errors.Is(err, telegram.InvalidInviteError) {
+			log.Printf("Error redeeming invite for %d: %v", m.Sender.ID, err)
+		}
+		t.bot.Send(m.Sender, t.localize(m.Sender, msgInviteInvalid, nil))
+		return
+	}
+	t.bot.Send(m.Sender, t.localize(m.Sender, msgInviteRedeemed, nil))
+}
+
+func (t *TBot) invite(m *tb.Message) {
+	token, err := t.dist.CreateInvite(m.Sender.ID)
+	if err != nil {
+		if !errors.Is(err, telegram.NoInvitesLeftError) {
+			log.Printf("Error creating invite for %d: %v", m.Sender.ID, err)
+		}
+		t.bot.Send(m.Sender, t.localize(m.Sender, msgNoInvitesLeft, nil))
+		return
+	}
+
+	link := "https://t.me/" + t.bot.Me.Username + "?start=" + token
+	t.bot.Send(m.Sender, t.localize(m.Sender, msgInviteLink, map[string]interface{}{"Link": link}), tb.NoPreview)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+var (
+	msgYourBridges = &i18n.Message{
+		ID:    "TelegramYourBridges",
+		Other: "Your bridges:",
+	}
+	msgNoBridgesForBots = &i18n.Message{
+		ID:    "TelegramNoBridgesForBots",
+		Other: "No bridges for bots, sorry",
+	}
+	msgThrottled = &i18n.Message{
+		ID:    "TelegramThrottled",
+		Other: "You have requested bridges too many times, please try again later.",
+	}
+	msgHelp = &i18n.Message{
+		ID:    "TelegramHelp",
+		Other: "Send /bridges to get Tor bridges.\nUse /language to change the language of the bot.",
+	}
+	msgChallenge = &i18n.Message{
+		ID:    "TelegramChallenge",
+		Other: "Before getting bridges, please tap the {{.Animal}}:",
+	}
+	msgChallengeCorrect = &i18n.Message{
+		ID:    "TelegramChallengeCorrect",
+		Other: "Correct!",
+	}
+	msgChallengeWrong = &i18n.Message{
+		ID:    "TelegramChallengeWrong",
+		Other: "Wrong answer, please try again.",
+	}
+	msgChallengeTooManyAttempts = &i18n.Message{
+		ID:    "TelegramChallengeTooManyAttempts",
+		Other: "Too many failed attempts, please try again later.",
+	}
+	msgChallengeExpired = &i18n.Message{
+		ID:    "TelegramChallengeExpired",
+		Other: "The challenge expired, please try again.",
+	}
+	msgLanguageSet = &i18n.Message{
+		ID:    "TelegramLanguageSet",
+		Other: "The language is now {{.Language}}.",
+	}
+	msgLanguageList = &i18n.Message{
+		ID:    "TelegramLanguageList",
+		Other: "Available languages: {{.Languages}}\nSend /language followed by the code of one of them to select it.",
+	}
+
+	animalNames = map[string]*i18n.Message{
+		"cat":       {ID: "TelegramAnimalCat", Other: "cat"},
+		"dog":       {ID: "TelegramAnimalDog", Other: "dog"},
+		"fox":       {ID: "TelegramAnimalFox", Other: "fox"},
+		"bear":      {ID: "TelegramAnimalBear", Other: "bear"},
+		"panda":     {ID: "TelegramAnimalPanda", Other: "panda"},
+		"frog":      {ID: "TelegramAnimalFrog", Other: "frog"},
+		"monkey":    {ID: "TelegramAnimalMonkey", Other: "monkey"},
+		"penguin":   {ID: "TelegramAnimalPenguin", Other: "penguin"},
+		"owl":       {ID: "TelegramAnimalOwl", Other: "owl"},
+		"octopus":   {ID: "TelegramAnimalOctopus", Other: "octopus"},
+		"mouse":     {ID: "TelegramAnimalMouse", Other: "mouse"},
+		"rabbit":    {ID: "TelegramAnimalRabbit", Other: "rabbit"},
+		"tiger":     {ID: "TelegramAnimalTiger", Other: "tiger"},
+		"lion":      {ID: "TelegramAnimalLion", Other: "lion"},
+		"cow":       {ID: "TelegramAnimalCow", Other: "cow"},
+		"pig":       {ID: "TelegramAnimalPig", Other: "pig"},
+		"koala":     {ID: "TelegramAnimalKoala", Other: "koala"},
+		"chicken":   {ID: "TelegramAnimalChicken", Other: "chicken"},
+		"horse":     {ID: "TelegramAnimalHorse", Other: "horse"},
+		"unicorn":   {ID: "TelegramAnimalUnicorn", Other: "unicorn"},
+		"bee":       {ID: "TelegramAnimalBee", Other: "bee"},
+		"butterfly": {ID: "TelegramAnimalButterfly", Other: "butterfly"},
+		"snail":     {ID: "TelegramAnimalSnail", Other: "snail"},
+		"turtle":    {ID: "TelegramAnimalTurtle", Other: "turtle"},
+		"snake":     {ID: "TelegramAnimalSnake", Other: "snake"},
+		"crab":      {ID: "TelegramAnimalCrab", Other: "crab"},
+		"dolphin":   {ID: "TelegramAnimalDolphin", Other: "dolphin"},
+		"whale":     {ID: "TelegramAnimalWhale", Other: "whale"},
+		"shark":     {ID: "TelegramAnimalShark", Other: "shark"},
+		"crocodile": {ID: "TelegramAnimalCrocodile", Other: "crocodile"},
+		"elephant":  {ID: "TelegramAnimalElephant", Other: "elephant"},
+		"camel":     {ID: "TelegramAnimalCamel", Other: "camel"},
+		"giraffe":   {ID: "TelegramAnimalGiraffe", Other: "giraffe"},
+		"zebra":     {ID: "TelegramAnimalZebra", Other: "zebra"},
+		"kangaroo":  {ID: "TelegramAnimalKangaroo", Other: "kangaroo"},
+		"hedgehog":  {ID: "TelegramAnimalHedgehog", Other: "hedgehog"},
+		"bat":       {ID: "TelegramAnimalBat", Other: "bat"},
+		"eagle":     {ID: "TelegramAnimalEagle", Other: "eagle"},
+		"duck":      {ID: "TelegramAnimalDuck", Other: "duck"},
+		"parrot":    {ID: "TelegramAnimalParrot", Other: "parrot"},
+	}
+)
+
+// userLanguages keeps the language selected by each user with /language.
+type userLanguages struct {
+	sync.RWMutex
+	languages map[int64]string
+	store     persistence.Mechanism
+}
+
+func newUserLanguages(store persistence.Mechanism) *userLanguages {
+	ul := &userLanguages{
+		languages: make(map[int64]string),
+		store:     store,
+	}
+	if store != nil {
+		err := store.Load(&ul.languages)
+		if err != nil {
+			log.Println("Can't load user languages:", err)
+			ul.languages = make(map[int64]string)
+		}
+	}
+	return ul
+}
+
+func (ul *userLanguages) get(id int64) string {
+	ul.RLock()
+	defer ul.RUnlock()
+	return ul.languages[id]
+}
+
+func (ul *userLanguages) set(id int64, lang string) {
+	ul.Lock()
+	defer ul.Unlock()
+	ul.languages[id] = lang
+	if ul.store != nil {
+		err := ul.store.Save(ul.languages)
+		if err != nil {
+			log.Println("Can't save user languages:", err)
+		}
+	}
+}
+
+// localizer returns the localizer for the language selected by the user, or
+// the language of its telegram client if it didn't select any.
+func (t *TBot) localizer(user *tb.User) *i18n.Localizer {
+	return t.locales.Localizer(t.languages.get(user.ID), user.LanguageCode)
+}
+
+func (t *TBot) localize(user *tb.User, msg *i18n.Message, data map[string]interface{}) string {
+	return common.Localize(t.localizer(user), msg, data)
+}
+
+func (t *TBot) availableLanguages() []string {
+	languages := []string{"en"}
+	for _, tag := range t.locales.Languages() {
+		if tag.String() != "en" {
+			languages = append(languages, tag.String())
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+func (t *TBot) help(m *tb.Message) {
+	t.bot.Send(m.Sender, t.localize(m.Sender, msgHelp, nil))
+}
+
+func (t *TBot) selectLanguage(m *tb.Message) {
+	available := t.availableLanguages()
+	lang := strings.TrimSpace(m.Payload)
+	for _, l := range available {
+		if strings.EqualFold(l, lang) {
+			t.languages.set(m.Sender.ID, l)
+			t.bot.Send(m.Sender, t.localize(m.Sender, msgLanguageSet, map[string]interface{}{"Language": l}))
+			return
+		}
+	}
+
+	t.bot.Send(m.Sender, t.localize(m.Sender, msgLanguageList, map[string]interface{}{
+		"Languages": strings.Join(available, ", "),
+	}))
+}
@@ -5,6 +5,9 @@
 package telegram
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -17,6 +20,8 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
 	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/gettor"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/telegram"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
@@ -29,6 +34,9 @@ type TBot struct {
 	bot          *tb.Bot
 	dist         *telegram.TelegramDistributor
 	updateTokens map[string]string
+	locales      *common.Locales
+	languages    *userLanguages
+	gettor       *gettor.GettorDistributor
 }
 
 // InitFrontend is the entry point to telegram'ss frontend.  It connects to telegram over
@@ -42,6 +50,10 @@ func InitFrontend(cfg *internal.Config) {
 	dist := telegram.TelegramDistributor{
 		NewBridgesStore: newBridgesStore,
 	}
+	if cfg.Distributors.Telegram.StorageDir != "" {
+		dist.InvitesStore = pjson.New("invites", cfg.Distributors.Telegram.StorageDir)
+		dist.RequestsStore = pjson.New("requests", cfg.Distributors.Telegram.StorageDir)
+	}
 	dist.Init(cfg)
 
 	tbot, err := newTBot(cfg.Distributors.Telegram.Token, &dist)
@@ -49,6 +61,21 @@ func InitFrontend(cfg *internal.Config) {
 		log.Fatal(err)
 	}
 	tbot.updateTokens = cfg.Distributors.Telegram.UpdaterTokens
+	tbot.locales, err = common.NewLocales(cfg.Distributors.Telegram.LocalesDir, "telegram")
+	if err != nil {
+		log.Fatalf("Can't load locales %s: %v", cfg.Distributors.Telegram.LocalesDir, err)
+	}
+	var languagesStore persistence.Mechanism
+	if cfg.Distributors.Telegram.StorageDir != "" {
+		languagesStore = pjson.New("languages", cfg.Distributors.Telegram.StorageDir)
+	}
+	tbot.languages = newUserLanguages(languagesStore)
+	if cfg.Distributors.Telegram.EnableGettor {
+		tbot.gettor = &gettor.GettorDistributor{}
+		tbot.gettor.Init(cfg)
+		tbot.bot.Handle("/gettor", tbot.getTorBrowser)
+		tbot.bot.Handle(&gettorButton, tbot.gettorCallback)
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT)
@@ -57,6 +84,9 @@ func InitFrontend(cfg *internal.Config) {
 		<-signalChan
 		log.Printf("Caught SIGINT.")
 		dist.Shutdown()
+		if tbot.gettor != nil {
+			tbot.gettor.Shutdown()
+		}
 
 		log.Printf("Shutting down the telegram bot.")
 		tbot.Stop()
@@ -64,6 +94,7 @@ func InitFrontend(cfg *internal.Config) {
 
 	http.HandleFunc("/update", tbot.updateHandler)
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(common.StatusEndpoint, common.StatusHandler(&dist))
 	go http.ListenAndServe(cfg.Distributors.Telegram.ApiAddress, nil)
 
 	tbot.Start()
@@ -82,7 +113,15 @@ func newTBot(token string, dist *telegram.TelegramDistributor) (*TBot, error) {
 		return nil, err
 	}
 
+	t.bot.Handle("/start", t.start)
+	t.bot.Handle("/invite", t.invite)
+	t.bot.Handle("/help", t.help)
+	t.bot.Handle("/language", t.selectLanguage)
 	t.bot.Handle("/bridges", t.getBridges)
+	t.bot.Handle(&challengeButton, t.challengeCallback)
+	t.bot.Handle("/stats", t.adminOnly(t.stats))
+	t.bot.Handle("/pool", t.adminOnly(t.pool))
+	t.bot.Handle("/lookup", t.adminOnly(t.lookup))
 	return &t, nil
 }
 
@@ -96,17 +135,32 @@ func (t *TBot) Stop() {
 
 func (t *TBot) getBridges(m *tb.Message) {
 	if m.Sender.IsBot {
-		t.bot.Send(m.Sender, "No bridges for bots, sorry")
+		t.bot.Send(m.Sender, t.localize(m.Sender, msgNoBridgesForBots, nil))
 		return
 	}
 
-	userID := m.Sender.ID
-	resources := t.dist.GetResources(userID)
-	response := "Your bridges:"
+	if !t.dist.HasPassed(m.Sender.ID) {
+		t.sendChallenge(m.Sender)
+		return
+	}
+	t.sendBridges(m.Sender)
+}
+
+func (t *TBot) sendBridges(user *tb.User) {
+	if err := t.dist.AllowRequest(user.ID); err != nil {
+		log.Printf("User %d throttled.", user.ID)
+		t.bot.Send(user, t.localize(user, msgThrottled, nil))
+		return
+	}
+
+	ctx, cancel := common.NewRequestContext()
+	defer cancel()
+	resources := t.dist.GetResources(ctx, user.ID)
+	response := t.localize(user, msgYourBridges, nil)
 	for _, r := range resources {
 		response += "\n" + r.String()
 	}
-	t.bot.Send(m.Sender, response)
+	t.bot.Send(user, response)
 }
 
 func (t *TBot) updateHandler(w http.ResponseWriter, r *http.Request) {
@@ -116,7 +170,21 @@ func (t *TBot) updateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	switch r.Method {
+	case http.MethodGet:
+		t.listBridges(w, name)
+		return
+	case http.MethodDelete:
+		t.deleteBridges(w, r, name)
+		return
+	}
+
 	err := t.dist.LoadNewBridges(name, r.Body)
+	if errors.Is(err, telegram.NoValidBridgesError) {
+		log.Printf("Error loading bridges from %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("Error loading bridges: %v", err)
 		http.Error(w, "error while loading bridges", http.StatusInternalServerError)
@@ -126,6 +194,35 @@ func (t *TBot) updateHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (t *TBot) listBridges(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(map[string]interface{}{
+		"bridges": t.dist.DynamicBridges(name),
+	})
+	if err != nil {
+		log.Printf("Error encoding bridges of %s: %v", name, err)
+	}
+}
+
+// deleteBridges removes the bridge with the fingerprint given in the query,
+// or all the bridges of the updater if there is none.
+func (t *TBot) deleteBridges(w http.ResponseWriter, r *http.Request, name string) {
+	fingerprint := r.URL.Query().Get("fingerprint")
+	removed, err := t.dist.RemoveDynamicBridges(name, fingerprint)
+	if err != nil {
+		log.Printf("Error removing bridges: %v", err)
+		http.Error(w, "error while removing bridges", http.StatusInternalServerError)
+		return
+	}
+	if removed == 0 && fingerprint != "" {
+		http.Error(w, "bridge not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 func (t *TBot) getTokenName(w http.ResponseWriter, r *http.Request) string {
 	tokenLine := r.Header.Get("Authorization")
 	if tokenLine == "" {
@@ -142,7 +239,7 @@ func (t *TBot) getTokenName(w http.ResponseWriter, r *http.Request) string {
 	givenToken := fields[1]
 
 	for name, savedToken := range t.updateTokens {
-		if givenToken == savedToken {
+		if savedToken != "" && subtle.ConstantTimeCompare([]byte(givenToken), []byte(savedToken)) == 1 {
 			return name
 		}
 	}
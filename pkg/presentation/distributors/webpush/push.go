@@ -0,0 +1,290 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The Web Push protocol (RFC 8030) with VAPID authentication (RFC 8292) and
+// the aes128gcm payload encryption (RFC 8291).
+
+const (
+	recordSize   = 4096
+	pushTTL      = 24 * time.Hour
+	vapidExpiry  = 12 * time.Hour
+	pushTimeout  = 30 * time.Second
+	saltLength   = 16
+	authLength   = 16
+	p256KeyBytes = 65
+)
+
+var (
+	InvalidKeyError       = errors.New("invalid push subscription keys")
+	SubscriptionGoneError = errors.New("the push subscription is gone")
+	ForbiddenAddressError = errors.New("the push endpoint is not a public address")
+	pushClient            = newPushClient()
+	webPushInfoPrefix     = []byte("WebPush: info\x00")
+	cekInfo               = []byte("Content-Encoding: aes128gcm\x00")
+	nonceInfo             = []byte("Content-Encoding: nonce\x00")
+)
+
+// newPushClient returns the HTTP client that sends the pushes.  The endpoints
+// come from the subscribers, so it only connects to public addresses, after
+// resolving them, doesn't follow redirects and doesn't use proxies.
+func newPushClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: pushTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicIP(net.ParseIP(host)) {
+				return fmt.Errorf("%w: %s", ForbiddenAddressError, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: pushTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: pushTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicIP checks that the ip is not loopback, private, link local,
+// multicast or unspecified.
+func publicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// vapidKey is the key that identifies the distributor to the push services.
+type vapidKey struct {
+	key     *ecdsa.PrivateKey
+	subject string
+}
+
+// loadVAPIDKey reads the PEM encoded key from filename, creating a new one if
+// the file doesn't exist.
+func loadVAPIDKey(filename, subject string) (*vapidKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		err = ioutil.WriteFile(filename, data, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &vapidKey{key, subject}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("the VAPID key has to be a P-256 key")
+	}
+	return &vapidKey{key, subject}, nil
+}
+
+// PublicKey returns the uncompressed public key, as expected by the
+// applicationServerKey of PushManager.subscribe().
+func (v *vapidKey) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), v.key.X, v.key.Y))
+}
+
+// authorization returns the VAPID Authorization header for the endpoint.
+func (v *vapidKey) authorization(endpoint *url.URL) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(vapidExpiry).Unix(),
+		"sub": v.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, v.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	copy(sig[32-len(r.Bytes()):32], r.Bytes())
+	copy(sig[64-len(s.Bytes()):], s.Bytes())
+
+	jwt := unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return "vapid t=" + jwt + ", k=" + v.PublicKey(), nil
+}
+
+// decodeKey decodes the base64url keys of the subscriptions, browsers don't
+// agree on the padding.
+func decodeKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// encryptPayload encrypts the payload for the browser keys p256dh and auth
+// with the aes128gcm content encoding.
+func encryptPayload(payload []byte, p256dh, auth string) ([]byte, error) {
+	uaPublic, err := decodeKey(p256dh)
+	if err != nil || len(uaPublic) != p256KeyBytes {
+		return nil, InvalidKeyError
+	}
+	authSecret, err := decodeKey(auth)
+	if err != nil || len(authSecret) != authLength {
+		return nil, InvalidKeyError
+	}
+	asPrivate, _, _, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltLength)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return encrypt(payload, uaPublic, authSecret, asPrivate, salt)
+}
+
+// encrypt implements the encryption of RFC 8291 for the user agent public key
+// uaPublic, with the application server ephemeral key asPrivate.
+func encrypt(payload, uaPublic, authSecret, asPrivate, salt []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, InvalidKeyError
+	}
+	asX, asY := curve.ScalarBaseMult(asPrivate)
+	asPublic := elliptic.Marshal(curve, asX, asY)
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	copy(ecdhSecret[32-len(sharedX.Bytes()):], sharedX.Bytes())
+
+	// HKDF with a single block of output, as all the keys are shorter than
+	// the hash
+	prkKey := hmacSHA256(authSecret, ecdhSecret)
+	ikm := hmacSHA256(prkKey, webPushInfoPrefix, uaPublic, asPublic, []byte{1})
+	prk := hmacSHA256(salt, ikm)
+	cek := hmacSHA256(prk, cekInfo, []byte{1})[:16]
+	nonce := hmacSHA256(prk, nonceInfo, []byte{1})[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// single record, ended by the padding delimiter
+	plaintext := append(append([]byte{}, payload...), 2)
+	if len(plaintext)+gcm.Overhead() > recordSize {
+		return nil, errors.New("the push payload is too big")
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(recordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+// sendPush sends the encrypted payload to the push endpoint.
+func sendPush(v *vapidKey, endpoint, p256dh, auth string, payload []byte) error {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	body, err := encryptPayload(payload, p256dh, auth)
+	if err != nil {
+		return err
+	}
+	authorization, err := v.authorization(endpointURL)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL/time.Second)))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return SubscriptionGoneError
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("the push service replied with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	// example from RFC 8291 appendix A
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	body, err := encrypt(
+		[]byte("When I grow up, I want to be a watermelon"),
+		decode("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		decode("BTBZMqHH6r4Tts7J_aSIgg"),
+		decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"),
+		decode("DGv6ra1nlYgDCS1FRnbzlw"),
+	)
+	if err != nil {
+		t.Fatal("Can't encrypt:", err)
+	}
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if encoded := base64.RawURLEncoding.EncodeToString(body); encoded != expected {
+		t.Errorf("Wrong encrypted body: %s", encoded)
+	}
+}
+
+func TestEncryptInvalidKeys(t *testing.T) {
+	for _, keys := range [][2]string{
+		{"", "BTBZMqHH6r4Tts7J_aSIgg"},
+		{"BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4", "abc"},
+		{"BCVxsr7M_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4", "BTBZMqHH6r4Tts7J_aSIgg"},
+	} {
+		_, err := encryptPayload([]byte("bridges"), keys[0], keys[1])
+		if err != InvalidKeyError {
+			t.Errorf("Expected invalid key error for %v: %v", keys, err)
+		}
+	}
+}
+
+func TestVAPID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webpush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "vapid.pem")
+
+	v, err := loadVAPIDKey(filename, "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal("Can't create VAPID key:", err)
+	}
+	v2, err := loadVAPIDKey(filename, "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal("Can't load VAPID key:", err)
+	}
+	if v.PublicKey() != v2.PublicKey() {
+		t.Error("The loaded VAPID key is different from the created one")
+	}
+
+	endpoint, _ := url.Parse("https://push.example.com/send/abc")
+	header, err := v.authorization(endpoint)
+	if err != nil {
+		t.Fatal("Can't create authorization:", err)
+	}
+	if !strings.HasPrefix(header, "vapid t=") || !strings.HasSuffix(header, ", k="+v.PublicKey()) {
+		t.Fatal("Malformed authorization header:", header)
+	}
+	jwt := strings.TrimSuffix(strings.TrimPrefix(header, "vapid t="), ", k="+v.PublicKey())
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatal("Malformed JWT:", jwt)
+	}
+
+	rawClaims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	json.Unmarshal(rawClaims, &claims)
+	if claims["aud"] != "https://push.example.com" || claims["sub"] != "mailto:admin@example.com" {
+		t.Error("Wrong claims:", claims)
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&v.key.PublicKey, hash[:], r, s) {
+		t.Error("Invalid JWT signature")
+	}
+}
+
+func TestPushClientAddresses(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.216.34": true,
+		"2606:2800::1":  true,
+		"127.0.0.1":     false,
+		"10.1.2.3":      false,
+		"192.168.1.1":   false,
+		"169.254.1.1":   false,
+		"0.0.0.0":       false,
+		"::1":           false,
+		"fd00::1":       false,
+		"fe80::1":       false,
+	} {
+		if publicIP(net.ParseIP(addr)) != public {
+			t.Errorf("Wrong public address check of %s, expected %v", addr, public)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The push client connected to a loopback address")
+	}))
+	defer ts.Close()
+	_, err := pushClient.Post(ts.URL, "application/octet-stream", nil)
+	if !errors.Is(err, ForbiddenAddressError) {
+		t.Errorf("Expected forbidden address error: %v", err)
+	}
+}
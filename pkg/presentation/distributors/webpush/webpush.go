@@ -0,0 +1,232 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/webpush"
+)
+
+const maxRequestSize = 8 * 1024
+
+var (
+	dist  *webpush.WebPushDistributor
+	vapid *vapidKey
+)
+
+type subscribeRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Type    string `json:"type"`
+	Country string `json:"country"`
+}
+
+type subscriptionRequest struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type bridgesResponse struct {
+	ID      string   `json:"id,omitempty"`
+	Token   string   `json:"token,omitempty"`
+	Bridges []string `json:"bridges"`
+}
+
+func bridgelines(resources []core.Resource) []string {
+	lines := make([]string, len(resources))
+	for i, r := range resources {
+		lines[i] = r.String()
+	}
+	return lines
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(v)
+	if err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, webpush.InvalidSubscriptionError),
+		errors.Is(err, webpush.UnsupportedTypeError),
+		errors.Is(err, webpush.UnknownPushServiceError),
+		errors.Is(err, InvalidKeyError):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, webpush.RateLimitedError):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, webpush.UnknownSubscriptionError):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, webpush.NoBridgesError),
+		errors.Is(err, webpush.TooManySubscriptionsError):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Printf("Error handling the request: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// requestAddressPrefix returns the /16 of the client's IPv4 address or the /32
+// of its IPv6 address, that identifies the subscriber.
+func requestAddressPrefix(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// vapidHandler returns the public key that extensions have to use as
+// applicationServerKey when subscribing.
+func vapidHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, map[string]string{"public_key": vapid.PublicKey()})
+}
+
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscribeRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	// make sure we will be able to push to the subscription
+	_, err := encryptPayload([]byte{}, req.Keys.P256dh, req.Keys.Auth)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sub, resources, err := dist.Subscribe(webpush.Subscription{
+		Endpoint: req.Endpoint,
+		P256dh:   req.Keys.P256dh,
+		Auth:     req.Keys.Auth,
+		Type:     req.Type,
+		Country:  req.Country,
+		Address:  requestAddressPrefix(r),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, bridgesResponse{ID: sub.ID, Token: sub.Token, Bridges: bridgelines(resources)})
+}
+
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	err := dist.Unsubscribe(req.ID, req.Token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bridgesHandler returns the current bridges of a subscription, for the
+// extensions that missed a push.
+func bridgesHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	ctx, cancel := common.RequestContext(r)
+	defer cancel()
+	resources, err := dist.GetResources(ctx, req.ID, req.Token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, bridgesResponse{Bridges: bridgelines(resources)})
+}
+
+// notify pushes the new bridges to the extension.
+func notify(sub webpush.Subscription, resources []core.Resource) bool {
+	if !dist.AllowedEndpoint(sub.Endpoint) {
+		log.Printf("Removing subscription %s of an unknown push service.", sub.ID)
+		return false
+	}
+	payload, err := json.Marshal(bridgesResponse{Bridges: bridgelines(resources)})
+	if err != nil {
+		log.Printf("Error encoding the push payload: %v", err)
+		return true
+	}
+	err = sendPush(vapid, sub.Endpoint, sub.P256dh, sub.Auth, payload)
+	if errors.Is(err, SubscriptionGoneError) || errors.Is(err, InvalidKeyError) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error pushing bridges to subscription %s: %v", sub.ID, err)
+	}
+	return true
+}
+
+// InitFrontend is the entry point to the web push frontend.  It spins up the
+// subscription API and pushes the new bridges to the subscribed extensions
+// until it receives a SIGINT.
+func InitFrontend(cfg *internal.Config) {
+	pushCfg := &cfg.Distributors.WebPush
+	var err error
+	vapid, err = loadVAPIDKey(pushCfg.VAPIDKeyFile, pushCfg.VAPIDSubject)
+	if err != nil {
+		log.Fatalf("Can't load the VAPID key %s: %v", pushCfg.VAPIDKeyFile, err)
+	}
+
+	dist = &webpush.WebPushDistributor{
+		Notifier:           notify,
+		SubscriptionsStore: pjson.New("subscriptions", pushCfg.StorageDir),
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/webpush/vapid":       http.HandlerFunc(vapidHandler),
+		"/webpush/subscribe":   http.HandlerFunc(subscribeHandler),
+		"/webpush/unsubscribe": http.HandlerFunc(unsubscribeHandler),
+		"/webpush/bridges":     http.HandlerFunc(bridgesHandler),
+	}
+	if pushCfg.MetricsAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go http.ListenAndServe(pushCfg.MetricsAddress, nil)
+	}
+
+	common.StartWebServer(
+		&pushCfg.WebApi,
+		cfg,
+		dist,
+		handlers,
+	)
+}
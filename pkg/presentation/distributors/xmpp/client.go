@@ -0,0 +1,345 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal XMPP client (RFC 6120) supporting only what the distributor
+// needs: STARTTLS, SASL PLAIN, resource binding and direct messages.
+
+const (
+	nsStreams = "http://etherx.jabber.org/streams"
+	nsClient  = "jabber:client"
+	nsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
+
+	defaultPort    = "5222"
+	clientResource = "rdsys"
+	dialTimeout    = 30 * time.Second
+)
+
+type streamFeatures struct {
+	XMLName    xml.Name        `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS   *struct{}       `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms *saslMechanisms `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
+	Bind       *struct{}       `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Session    *struct{}       `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+}
+
+type saslMechanisms struct {
+	Mechanism []string `xml:"mechanism"`
+}
+
+type bindResult struct {
+	Type string `xml:"type,attr"`
+	Bind struct {
+		JID string `xml:"jid"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+// Message is a received message stanza.
+type Message struct {
+	From      string    `xml:"from,attr"`
+	Type      string    `xml:"type,attr"`
+	Body      string    `xml:"body"`
+	Encrypted *struct{} `xml:"eu.siacs.conversations.axolotl encrypted"`
+}
+
+type presence struct {
+	From string `xml:"from,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type iq struct {
+	ID   string    `xml:"id,attr"`
+	From string    `xml:"from,attr"`
+	Type string    `xml:"type,attr"`
+	Ping *struct{} `xml:"urn:xmpp:ping ping"`
+}
+
+// Client is a connection to an XMPP server.
+type Client struct {
+	jid    string
+	domain string
+	conn   net.Conn
+	dec    *xml.Decoder
+
+	writeLock sync.Mutex
+
+	// AllowSubscription decides if a subscription request of the JID is
+	// accepted, all of them are if it's nil.
+	AllowSubscription func(jid string) bool
+}
+
+// Dial connects and authenticates to the XMPP server of jid.  If address is
+// empty the domain of the jid is used.
+func Dial(jid, password, address string) (*Client, error) {
+	parts := strings.SplitN(jid, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Malformed JID %s", jid)
+	}
+	user, domain := parts[0], parts[1]
+	if address == "" {
+		address = net.JoinHostPort(domain, defaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{jid: jid, domain: domain, conn: conn}
+	err = c.negotiate(user, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) negotiate(user, password string) error {
+	features, err := c.startStream()
+	if err != nil {
+		return err
+	}
+	if features.StartTLS == nil {
+		return errors.New("The server doesn't support STARTTLS")
+	}
+	err = c.send("<starttls xmlns='" + nsTLS + "'/>")
+	if err != nil {
+		return err
+	}
+	se, err := c.nextElement()
+	if err != nil {
+		return err
+	}
+	if se.Name.Space != nsTLS || se.Name.Local != "proceed" {
+		return fmt.Errorf("STARTTLS failed: %s", se.Name.Local)
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{ServerName: c.domain})
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	c.conn = tlsConn
+
+	features, err = c.startStream()
+	if err != nil {
+		return err
+	}
+	if features.Mechanisms == nil || !contains(features.Mechanisms.Mechanism, "PLAIN") {
+		return errors.New("The server doesn't support SASL PLAIN")
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
+	err = c.send("<auth xmlns='" + nsSASL + "' mechanism='PLAIN'>" + auth + "</auth>")
+	if err != nil {
+		return err
+	}
+	se, err = c.nextElement()
+	if err != nil {
+		return err
+	}
+	if se.Name.Space != nsSASL || se.Name.Local != "success" {
+		return errors.New("Authentication failed")
+	}
+	c.dec.Skip()
+
+	features, err = c.startStream()
+	if err != nil {
+		return err
+	}
+	if features.Bind == nil {
+		return errors.New("The server doesn't support resource binding")
+	}
+	err = c.send("<iq type='set' id='bind'><bind xmlns='" + nsBind + "'><resource>" + clientResource + "</resource></bind></iq>")
+	if err != nil {
+		return err
+	}
+	var bind bindResult
+	err = c.decodeNext(&bind)
+	if err != nil {
+		return err
+	}
+	if bind.Type != "result" {
+		return errors.New("Resource binding failed")
+	}
+	if bind.Bind.JID != "" {
+		c.jid = bind.Bind.JID
+	}
+
+	if features.Session != nil {
+		err = c.send("<iq type='set' id='session'><session xmlns='" + nsSession + "'/></iq>")
+		if err != nil {
+			return err
+		}
+		_, err = c.nextElement()
+		if err != nil {
+			return err
+		}
+		c.dec.Skip()
+	}
+
+	return c.send("<presence/>")
+}
+
+// startStream opens a new stream over the connection and returns the
+// features announced by the server.
+func (c *Client) startStream() (*streamFeatures, error) {
+	err := c.send("<?xml version='1.0'?><stream:stream to='" + escape(c.domain) +
+		"' xmlns='" + nsClient + "' xmlns:stream='" + nsStreams + "' version='1.0'>")
+	if err != nil {
+		return nil, err
+	}
+
+	c.dec = xml.NewDecoder(c.conn)
+	se, err := c.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	if se.Name.Space != nsStreams || se.Name.Local != "stream" {
+		return nil, fmt.Errorf("Expected stream start, got %s", se.Name.Local)
+	}
+
+	var features streamFeatures
+	err = c.decodeNext(&features)
+	return &features, err
+}
+
+// nextElement returns the start of the next element, or an error if it's a
+// stream error.
+func (c *Client) nextElement() (*xml.StartElement, error) {
+	for {
+		t, err := c.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Space == nsStreams && t.Name.Local == "error" {
+				c.dec.Skip()
+				return nil, errors.New("Stream error from the server")
+			}
+			return &t, nil
+		case xml.EndElement:
+			if t.Name.Space == nsStreams && t.Name.Local == "stream" {
+				return nil, io.EOF
+			}
+		}
+	}
+}
+
+func (c *Client) decodeNext(v interface{}) error {
+	se, err := c.nextElement()
+	if err != nil {
+		return err
+	}
+	return c.dec.DecodeElement(v, se)
+}
+
+func (c *Client) send(s string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := io.WriteString(c.conn, s)
+	return err
+}
+
+// SendMessage sends a chat message to jid.
+func (c *Client) SendMessage(to, body string) error {
+	return c.send("<message to='" + escape(to) + "' type='chat'><body>" + escape(body) + "</body></message>")
+}
+
+// KeepAlive sends a whitespace ping, so the connection is not closed for
+// being idle.
+func (c *Client) KeepAlive() error {
+	return c.send(" ")
+}
+
+// Close ends the stream and closes the connection.
+func (c *Client) Close() error {
+	c.send("</stream:stream>")
+	return c.conn.Close()
+}
+
+// Receive returns the next message received.  It takes care of accepting
+// subscription requests and answering pings while waiting for it.  The
+// subscription requests that AllowSubscription rejects are ignored.
+func (c *Client) Receive() (*Message, error) {
+	for {
+		se, err := c.nextElement()
+		if err != nil {
+			return nil, err
+		}
+
+		switch se.Name.Local {
+		case "message":
+			var msg Message
+			err = c.dec.DecodeElement(&msg, se)
+			if err != nil {
+				return nil, err
+			}
+			return &msg, nil
+		case "presence":
+			var p presence
+			err = c.dec.DecodeElement(&p, se)
+			if err != nil {
+				return nil, err
+			}
+			if p.Type == "subscribe" && (c.AllowSubscription == nil || c.AllowSubscription(p.From)) {
+				err = c.send("<presence to='" + escape(p.From) + "' type='subscribed'/>")
+			}
+		case "iq":
+			var q iq
+			err = c.dec.DecodeElement(&q, se)
+			if err != nil {
+				return nil, err
+			}
+			err = c.answerIq(&q)
+		default:
+			err = c.dec.Skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) answerIq(q *iq) error {
+	if q.Type != "get" && q.Type != "set" {
+		return nil
+	}
+	if q.Ping != nil {
+		return c.send("<iq type='result' id='" + escape(q.ID) + "' to='" + escape(q.From) + "'/>")
+	}
+	return c.send("<iq type='error' id='" + escape(q.ID) + "' to='" + escape(q.From) + "'>" +
+		"<error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>")
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/xmpp"
+)
+
+const (
+	subscriptionLimitWindow = time.Hour
+
+	defaultSubscriptionsPerJID    = 3
+	defaultSubscriptionsPerDomain = 100
+
+	limitJID    = "jid"
+	limitDomain = "domain"
+)
+
+var throttledSubscriptionsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "xmpp_throttled_subscriptions_total",
+	Help: "The total number of subscription requests not accepted because their account or its domain made too many",
+},
+	[]string{"limit"},
+)
+
+// subscriptionLimiter limits the subscription requests that we accept from
+// each account and from each domain, so a forged or abusive account can't make
+// us send unlimited presences.
+type subscriptionLimiter struct {
+	sync.Mutex
+	maxJID    int
+	maxDomain int
+	jids      map[string][]time.Time
+	domains   map[string][]time.Time
+}
+
+func newSubscriptionLimiter(cfg *internal.XMPPDistConfig) *subscriptionLimiter {
+	l := &subscriptionLimiter{
+		maxJID:    cfg.MaxSubscriptionsPerHour,
+		maxDomain: cfg.MaxDomainSubscriptionsPerHour,
+		jids:      make(map[string][]time.Time),
+		domains:   make(map[string][]time.Time),
+	}
+	if l.maxJID == 0 {
+		l.maxJID = defaultSubscriptionsPerJID
+	}
+	if l.maxDomain == 0 {
+		l.maxDomain = defaultSubscriptionsPerDomain
+	}
+	return l
+}
+
+// allow checks if we can accept a subscription request from the JID, and
+// records it if we can.
+func (l *subscriptionLimiter) allow(jid string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+	bare := xmpp.BareJID(jid)
+	domain := bare
+	if i := strings.LastIndex(bare, "@"); i != -1 {
+		domain = bare[i+1:]
+	}
+	if len(l.jids[bare]) >= l.maxJID {
+		throttledSubscriptionsCount.WithLabelValues(limitJID).Inc()
+		return false
+	}
+	if len(l.domains[domain]) >= l.maxDomain {
+		throttledSubscriptionsCount.WithLabelValues(limitDomain).Inc()
+		return false
+	}
+	l.jids[bare] = append(l.jids[bare], now)
+	l.domains[domain] = append(l.domains[domain], now)
+	return true
+}
+
+// prune forgets the subscriptions out of the window, it needs to be called
+// with the lock held.
+func (l *subscriptionLimiter) prune(now time.Time) {
+	for _, requests := range []map[string][]time.Time{l.jids, l.domains} {
+		for key, times := range requests {
+			i := 0
+			for i < len(times) && now.Sub(times[i]) >= subscriptionLimitWindow {
+				i++
+			}
+			if i == len(times) {
+				delete(requests, key)
+			} else {
+				requests[key] = times[i:]
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func TestSubscriptionLimiter(t *testing.T) {
+	l := newSubscriptionLimiter(&internal.XMPPDistConfig{
+		MaxSubscriptionsPerHour:       2,
+		MaxDomainSubscriptionsPerHour: 3,
+	})
+
+	if !l.allow("user@example.org/phone") || !l.allow("User@example.org/laptop") {
+		t.Fatal("The first subscriptions of the account were throttled")
+	}
+	if l.allow("user@example.org") {
+		t.Error("The account was not throttled")
+	}
+	if !l.allow("other@example.org") {
+		t.Error("Other account of the domain was throttled")
+	}
+	if l.allow("another@example.org") {
+		t.Error("The domain was not throttled")
+	}
+	if !l.allow("user@example.net") {
+		t.Error("An account of other domain was throttled")
+	}
+
+	for _, requests := range []map[string][]time.Time{l.jids, l.domains} {
+		for _, times := range requests {
+			for i := range times {
+				times[i] = times[i].Add(-subscriptionLimitWindow)
+			}
+		}
+	}
+	if !l.allow("user@example.org") {
+		t.Error("The account was throttled after the window")
+	}
+	l.prune(time.Now())
+	if len(l.jids) != 1 || len(l.domains) != 1 {
+		t.Errorf("The old subscriptions were not pruned: %v %v", l.jids, l.domains)
+	}
+
+	l = newSubscriptionLimiter(&internal.XMPPDistConfig{})
+	if l.maxJID != defaultSubscriptionsPerJID || l.maxDomain != defaultSubscriptionsPerDomain {
+		t.Errorf("Wrong default limits: %d %d", l.maxJID, l.maxDomain)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/presentation/distributors/common"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/xmpp"
+)
+
+const (
+	keepAliveInterval = time.Minute
+	maxReconnectDelay = 10 * time.Minute
+
+	helpMessage = `Hello, this is the Tor bridges bot.
+
+Send a message with the word "bridges" to get Tor bridges. The same account gets the same bridges for a while, so there is no need to ask repeatedly.`
+	bridgesMessage     = "Your bridges:"
+	noBridgesMessage   = "There are no bridges available right now, please try again later."
+	encryptedMessage   = "This bot can't read encrypted messages, please disable OMEMO for this chat and try again."
+	bridgesCommandWord = "bridges"
+)
+
+// InitFrontend is the entry point to the XMPP frontend.  It connects to the
+// XMPP server and replies to the direct messages until it receives a SIGINT.
+func InitFrontend(cfg *internal.Config) {
+	dist := &xmpp.XMPPDistributor{}
+	dist.Init(cfg)
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(common.StatusEndpoint, common.StatusHandler(dist))
+	go http.ListenAndServe(cfg.Distributors.XMPP.MetricsAddress, nil)
+
+	var lock sync.Mutex
+	var client *Client
+	stopping := false
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT)
+	signal.Notify(signalChan, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		log.Printf("Caught SIGINT.")
+		lock.Lock()
+		stopping = true
+		if client != nil {
+			client.Close()
+		}
+		lock.Unlock()
+	}()
+
+	xmppCfg := &cfg.Distributors.XMPP
+	limiter := newSubscriptionLimiter(xmppCfg)
+	delay := time.Second
+	for {
+		c, err := Dial(xmppCfg.JID, xmppCfg.Password, xmppCfg.ServerAddress)
+		lock.Lock()
+		if stopping {
+			lock.Unlock()
+			break
+		}
+		client = c
+		lock.Unlock()
+
+		if err != nil {
+			log.Printf("Can't connect to the XMPP server: %v. Trying again in %v.", err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		log.Printf("Connected to the XMPP server as %s.", xmppCfg.JID)
+		delay = time.Second
+		c.AllowSubscription = limiter.allow
+
+		err = serve(c, dist)
+		c.Close()
+
+		lock.Lock()
+		client = nil
+		if stopping {
+			lock.Unlock()
+			break
+		}
+		lock.Unlock()
+		log.Printf("Disconnected from the XMPP server: %v", err)
+	}
+
+	dist.Shutdown()
+}
+
+// serve replies to the messages received until the connection fails.
+func serve(c *Client, dist *xmpp.XMPPDistributor) error {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.KeepAlive()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		// we only reply to direct messages
+		if msg.From == "" || (msg.Type != "" && msg.Type != "chat" && msg.Type != "normal") {
+			continue
+		}
+
+		reply := replyTo(msg, dist)
+		if reply == "" {
+			continue
+		}
+		err = c.SendMessage(msg.From, reply)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func replyTo(msg *Message, dist *xmpp.XMPPDistributor) string {
+	if msg.Encrypted != nil {
+		return encryptedMessage
+	}
+	body := strings.ToLower(strings.TrimSpace(msg.Body))
+	if body == "" {
+		// chat states and other notifications without body
+		return ""
+	}
+	if !strings.Contains(body, bridgesCommandWord) {
+		return helpMessage
+	}
+
+	ctx, cancel := common.NewRequestContext()
+	defer cancel()
+	resources, err := dist.GetResources(ctx, msg.From)
+	if err != nil {
+		if !errors.Is(err, xmpp.NoBridgesError) {
+			log.Printf("Error getting bridges: %v", err)
+		}
+		return noBridgesMessage
+	}
+	reply := bridgesMessage
+	for _, r := range resources {
+		reply += "\n" + r.String()
+	}
+	return reply
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxDownloadAttempts = 5
+	downloadBackoff     = 2 * time.Second
+	// checksumsFile is the list of SHA-256 checksums published next to the
+	// binaries of each Tor Browser release
+	checksumsFile = "sha256sums-signed-build.txt"
+)
+
+var (
+	DownloadSizeError     = errors.New("the size of the download doesn't match the one of the server")
+	ChecksumMismatchError = errors.New("the checksum of the download doesn't match the published one")
+
+	// sleep is replaced in the tests to not wait for the backoff
+	sleep = time.Sleep
+)
+
+// getAsset downloads the url into tmpDir, resuming the download if it gets
+// interrupted, and returns the path of the file.
+func getAsset(url string, tmpDir string) (string, error) {
+	segments := strings.Split(url, "/")
+	filePath := path.Join(tmpDir, segments[len(segments)-1])
+
+	backoff := downloadBackoff
+	var err error
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		err = resumeDownload(url, filePath)
+		if err == nil {
+			return filePath, nil
+		}
+		log.Printf("Error downloading %s (attempt %d of %d): %v", url, attempt, maxDownloadAttempts, err)
+		if errors.Is(err, DownloadSizeError) {
+			// what we have is not a prefix of the file, start again
+			os.Remove(filePath)
+		}
+		if attempt < maxDownloadAttempts {
+			sleep(backoff)
+			backoff *= 2
+		}
+	}
+	os.Remove(filePath)
+	return "", err
+}
+
+// resumeDownload continues the download of url into filePath from the bytes
+// that are already there.  It fails with DownloadSizeError if the file doesn't
+// end up with the size announced by the server.
+func resumeDownload(url string, filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server doesn't support ranges or we didn't ask for one
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+		size = resp.ContentLength
+	case http.StatusPartialContent:
+		var start int64
+		start, size, err = parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return fmt.Errorf("the server resumed from byte %d instead of %d: %w", start, offset, DownloadSizeError)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// we might have the whole file already
+		_, size, err = parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || size != offset {
+			return fmt.Errorf("the server can't resume from byte %d: %w", offset, DownloadSizeError)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected status downloading: %s", resp.Status)
+	}
+
+	n, err := io.Copy(file, resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case size < 0:
+		return nil
+	case offset+n < size:
+		return io.ErrUnexpectedEOF
+	case offset+n > size:
+		return fmt.Errorf("got %d bytes of %d: %w", offset+n, size, DownloadSizeError)
+	}
+	return nil
+}
+
+// parseContentRange returns the first byte and the size of the file of a
+// Content-Range header like "bytes 100-199/200" or "bytes */200".
+func parseContentRange(contentRange string) (start int64, size int64, err error) {
+	var byteRange, total string
+	n, _ := fmt.Sscanf(strings.Replace(contentRange, "/", " ", 1), "bytes %s %s", &byteRange, &total)
+	if n != 2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", contentRange)
+	}
+
+	size = -1
+	if total != "*" {
+		size, err = strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range: %q", contentRange)
+		}
+	}
+	if byteRange == "*" {
+		return 0, size, nil
+	}
+	start, err = strconv.ParseInt(strings.SplitN(byteRange, "-", 2)[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", contentRange)
+	}
+	return start, size, nil
+}
+
+// releaseChecksums fetches and caches the checksums files of the releases, so
+// they are fetched once per update and not once per locale.
+type releaseChecksums struct {
+	// sums are the checksums indexed by the URL of the checksums file and
+	// the name of the file
+	sums map[string]map[string]string
+	errs map[string]error
+}
+
+func newReleaseChecksums() *releaseChecksums {
+	return &releaseChecksums{
+		sums: make(map[string]map[string]string),
+		errs: make(map[string]error),
+	}
+}
+
+// verify checks the SHA-256 checksum of the download of urls["binary"].  The
+// expected checksum is the "sha256" of the entry in downloads.json, if there
+// is one, or the one in the checksums file of the release.  A release without
+// checksums file is not an error, the binary is still verified by its
+// signature.
+func (r *releaseChecksums) verify(urls map[string]string, checksum string) error {
+	expected := urls["sha256"]
+	if expected == "" {
+		binaryURL := urls["binary"]
+		sumsURL := binaryURL[:strings.LastIndex(binaryURL, "/")+1] + checksumsFile
+		sums, err := r.get(sumsURL)
+		if err != nil {
+			log.Printf("Can't get the checksums of %s: %v", binaryURL, err)
+			return nil
+		}
+		var ok bool
+		expected, ok = sums[path.Base(binaryURL)]
+		if !ok {
+			log.Printf("%s is not in %s", path.Base(binaryURL), sumsURL)
+			return nil
+		}
+	}
+
+	if !strings.EqualFold(expected, checksum) {
+		return fmt.Errorf("%s instead of %s: %w", checksum, expected, ChecksumMismatchError)
+	}
+	return nil
+}
+
+func (r *releaseChecksums) get(sumsURL string) (map[string]string, error) {
+	if sums, ok := r.sums[sumsURL]; ok {
+		return sums, r.errs[sumsURL]
+	}
+
+	sums, err := fetchChecksums(sumsURL)
+	r.sums[sumsURL] = sums
+	r.errs[sumsURL] = err
+	return sums, err
+}
+
+// fetchChecksums downloads a checksums file in the sha256sum format, lines
+// like "<checksum>  <file name>", and returns the checksums by file name.
+func fetchChecksums(sumsURL string) (map[string]string, error) {
+	resp, err := http.Get(sumsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAssetResume(t *testing.T) {
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	content := bytes.Repeat([]byte("tor browser "), 1000)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// the connection is closed in the middle of the file
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:len(content)/2])
+			return
+		}
+		http.ServeContent(w, r, "tor-browser.tar.xz", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "gettor-download-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filePath, err := getAsset(ts.URL+"/torbrowser/12.0.1/tor-browser.tar.xz", tmpDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(filePath, tmpDir))
+	downloaded, err := ioutil.ReadFile(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(content)/2)}, ranges)
+}
+
+func TestGetAssetFailure(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "gettor-download-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	_, err = getAsset(ts.URL+"/tor-browser.tar.xz", tmpDir)
+	assert.Error(t, err)
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}, delays)
+	files, _ := ioutil.ReadDir(tmpDir)
+	assert.Len(t, files, 0)
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, size, err := parseContentRange("bytes 100-199/200")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), start)
+	assert.Equal(t, int64(200), size)
+
+	_, size, err = parseContentRange("bytes */200")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), size)
+
+	_, _, err = parseContentRange("100-199")
+	assert.Error(t, err)
+}
+
+func TestReleaseChecksums(t *testing.T) {
+	sum := sha256.Sum256([]byte("tor browser"))
+	checksum := hex.EncodeToString(sum[:])
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/torbrowser/12.0.1/sha256sums-signed-build.txt", r.URL.Path)
+		fmt.Fprintf(w, "%s  tor-browser-linux64-12.0.1_ALL.tar.xz\n", checksum)
+		fmt.Fprintf(w, "%s  torbrowser-install-12.0.1_ALL.exe\n", strings.Repeat("0", 64))
+	}))
+	defer ts.Close()
+
+	checksums := newReleaseChecksums()
+	linux := map[string]string{"binary": ts.URL + "/torbrowser/12.0.1/tor-browser-linux64-12.0.1_ALL.tar.xz"}
+	assert.NoError(t, checksums.verify(linux, checksum))
+
+	win := map[string]string{"binary": ts.URL + "/torbrowser/12.0.1/torbrowser-install-12.0.1_ALL.exe"}
+	err := checksums.verify(win, checksum)
+	assert.True(t, errors.Is(err, ChecksumMismatchError), err)
+	assert.Equal(t, 1, requests)
+
+	// the checksum in downloads.json takes precedence
+	win["sha256"] = checksum
+	assert.NoError(t, checksums.verify(win, checksum))
+}
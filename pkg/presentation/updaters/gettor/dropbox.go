@@ -0,0 +1,249 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"golang.org/x/oauth2"
+)
+
+const (
+	dropboxAPIURL     = "https://api.dropboxapi.com/2/"
+	dropboxContentURL = "https://content.dropboxapi.com/2/"
+	dropboxTokenURL   = "https://api.dropboxapi.com/oauth2/token"
+	// dropboxChunkSize is the size of the chunks of the upload sessions,
+	// dropbox doesn't accept more than 150MB per request
+	dropboxChunkSize = 64 << 20
+)
+
+var dropboxNotFoundError = errors.New("the file doesn't exist in dropbox")
+
+func newDropboxProvider(cfg *internal.Dropbox) (provider, error) {
+	if cfg.AppKey == "" || cfg.RefreshToken == "" {
+		return nil, errors.New("the dropbox app key and refresh token are not configured")
+	}
+
+	ctx := context.Background()
+	config := &oauth2.Config{
+		ClientID:     cfg.AppKey,
+		ClientSecret: cfg.AppSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: dropboxTokenURL},
+	}
+	return &dropboxProvider{
+		client:     config.Client(ctx, &oauth2.Token{RefreshToken: cfg.RefreshToken}),
+		cfg:        cfg,
+		apiURL:     dropboxAPIURL,
+		contentURL: dropboxContentURL,
+	}, nil
+}
+
+type dropboxProvider struct {
+	client     *http.Client
+	cfg        *internal.Dropbox
+	apiURL     string
+	contentURL string
+}
+
+func (d *dropboxProvider) needsUpdate(platform string, version resources.Version) bool {
+	err := d.call("files/get_metadata", map[string]string{"path": d.filePath(d.formatNameForExistenceObject(platform, version))}, nil)
+	if errors.Is(err, dropboxNotFoundError) {
+		return true
+	}
+	if err != nil {
+		log.Println("[Dropbox] unable to check for update", err)
+	}
+	return false
+}
+
+func (d *dropboxProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	existenceObject := d.filePath(d.formatNameForExistenceObject(platform, version))
+	if err := d.upload(existenceObject, bytes.NewReader([]byte{0x00})); err != nil {
+		log.Println("[Dropbox] Unable to create existence object", err)
+		return nil
+	}
+
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		link := resources.NewTBLink()
+
+		var err error
+		link.Link, err = d.uploadFileAndGetLink(binaryPath)
+		if err != nil {
+			log.Println("[Dropbox] Unable to create link for binary", err)
+			return nil
+		}
+		link.SigLink, err = d.uploadFileAndGetLink(sigPath)
+		if err != nil {
+			log.Println("[Dropbox] Unable to create link for signature", err)
+			return nil
+		}
+
+		link.Version = version
+		link.Provider = "Dropbox"
+		link.Platform = platform
+		link.Locale = locale
+		link.FileName = path.Base(binaryPath)
+		return link
+	}
+}
+
+func (d *dropboxProvider) uploadFileAndGetLink(filePath string) (string, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	dropboxPath := d.filePath(path.Base(filePath))
+	if err := d.upload(dropboxPath, fd); err != nil {
+		return "", err
+	}
+	return d.sharedLink(dropboxPath)
+}
+
+// upload uploads the content of the reader with an upload session, as it
+// supports files of any size.
+func (d *dropboxProvider) upload(dropboxPath string, reader io.Reader) error {
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	err := d.callContent("files/upload_session/start", map[string]interface{}{}, &bytes.Buffer{}, &session)
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	chunk := make([]byte, dropboxChunkSize)
+	for {
+		n, err := io.ReadFull(reader, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		arg := map[string]interface{}{
+			"cursor": map[string]interface{}{"session_id": session.SessionID, "offset": offset},
+		}
+		if err := d.callContent("files/upload_session/append_v2", arg, bytes.NewReader(chunk[:n]), nil); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	arg := map[string]interface{}{
+		"cursor": map[string]interface{}{"session_id": session.SessionID, "offset": offset},
+		"commit": map[string]interface{}{"path": dropboxPath, "mode": "overwrite", "mute": true},
+	}
+	return d.callContent("files/upload_session/finish", arg, &bytes.Buffer{}, nil)
+}
+
+// sharedLink returns a public link that downloads the file directly.
+func (d *dropboxProvider) sharedLink(dropboxPath string) (string, error) {
+	var link struct {
+		URL   string `json:"url"`
+		Links []struct {
+			URL string `json:"url"`
+		} `json:"links"`
+	}
+	arg := map[string]interface{}{
+		"path":     dropboxPath,
+		"settings": map[string]string{"requested_visibility": "public"},
+	}
+	err := d.call("sharing/create_shared_link_with_settings", arg, &link)
+	if err != nil {
+		// if the file was uploaded before it might already have a link
+		listErr := d.call("sharing/list_shared_links", map[string]interface{}{"path": dropboxPath, "direct_only": true}, &link)
+		if listErr != nil || len(link.Links) == 0 {
+			return "", err
+		}
+		link.URL = link.Links[0].URL
+	}
+	return directDropboxLink(link.URL), nil
+}
+
+// directDropboxLink changes the shared link to download the file instead of
+// showing the dropbox preview page.
+func directDropboxLink(link string) string {
+	if strings.Contains(link, "dl=0") {
+		return strings.Replace(link, "dl=0", "dl=1", 1)
+	}
+	if strings.Contains(link, "?") {
+		return link + "&dl=1"
+	}
+	return link + "?dl=1"
+}
+
+// call does an RPC request to the dropbox API with arg as JSON body, and
+// decodes the JSON response into result if it's not nil.
+func (d *dropboxProvider) call(endpoint string, arg interface{}, result interface{}) error {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.apiURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return d.do(req, result)
+}
+
+// callContent does a content request to the dropbox API, with arg in the
+// Dropbox-API-Arg header and the content as body.
+func (d *dropboxProvider) callContent(endpoint string, arg interface{}, content io.Reader, result interface{}) error {
+	header, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.contentURL+endpoint, content)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", string(header))
+	return d.do(req, result)
+}
+
+func (d *dropboxProvider) do(req *http.Request, result interface{}) error {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusConflict && strings.Contains(string(body), "not_found") {
+			return dropboxNotFoundError
+		}
+		return fmt.Errorf("dropbox answered %s: %s", resp.Status, body)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (d *dropboxProvider) filePath(fileName string) string {
+	return path.Join("/", d.cfg.Folder, fileName)
+}
+
+func (d *dropboxProvider) formatNameForExistenceObject(platform string, version resources.Version) string {
+	return fmt.Sprintf("%v-%v.exist-gettor", platform, version.String())
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// fakeDropbox implements the parts of the dropbox API used by the provider
+type fakeDropbox struct {
+	files    map[string][]byte
+	sessions map[string][]byte
+}
+
+func (f *fakeDropbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var arg struct {
+		Path   string `json:"path"`
+		Cursor struct {
+			SessionID string `json:"session_id"`
+		} `json:"cursor"`
+		Commit struct {
+			Path string `json:"path"`
+		} `json:"commit"`
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if header := r.Header.Get("Dropbox-API-Arg"); header != "" {
+		json.Unmarshal([]byte(header), &arg)
+	} else {
+		json.Unmarshal(body, &arg)
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/2/") {
+	case "files/get_metadata":
+		if _, ok := f.files[arg.Path]; !ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error_summary": "path/not_found/"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"path_display": arg.Path})
+	case "files/upload_session/start":
+		id := "session" + string(rune('a'+len(f.sessions)))
+		f.sessions[id] = body
+		json.NewEncoder(w).Encode(map[string]string{"session_id": id})
+	case "files/upload_session/append_v2":
+		f.sessions[arg.Cursor.SessionID] = append(f.sessions[arg.Cursor.SessionID], body...)
+	case "files/upload_session/finish":
+		f.files[arg.Commit.Path] = f.sessions[arg.Cursor.SessionID]
+		json.NewEncoder(w).Encode(map[string]string{"path_display": arg.Commit.Path})
+	case "sharing/create_shared_link_with_settings":
+		json.NewEncoder(w).Encode(map[string]string{"url": "https://www.dropbox.com/s/id" + arg.Path + "?dl=0"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDropbox(t *testing.T) {
+	fake := &fakeDropbox{files: make(map[string][]byte), sessions: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	d := &dropboxProvider{
+		client:     server.Client(),
+		cfg:        &internal.Dropbox{Folder: "/gettor"},
+		apiURL:     server.URL + "/2/",
+		contentURL: server.URL + "/2/",
+	}
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	assert.True(t, d.needsUpdate("linux64", version))
+
+	dir, err := ioutil.TempDir("", "gettor-dropbox-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binaryPath := path.Join(dir, "tor-browser.tar.xz")
+	sigPath := binaryPath + ".asc"
+	assert.NoError(t, ioutil.WriteFile(binaryPath, []byte("binary"), 0644))
+	assert.NoError(t, ioutil.WriteFile(sigPath, []byte("signature"), 0644))
+
+	upload := d.newRelease("linux64", version)
+	if !assert.NotNil(t, upload) {
+		return
+	}
+	link := upload(binaryPath, sigPath, "en-US")
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, "https://www.dropbox.com/s/id/gettor/tor-browser.tar.xz?dl=1", link.Link)
+	assert.Equal(t, "https://www.dropbox.com/s/id/gettor/tor-browser.tar.xz.asc?dl=1", link.SigLink)
+	assert.Equal(t, "tor-browser.tar.xz", link.FileName)
+	assert.Equal(t, []byte("binary"), fake.files["/gettor/tor-browser.tar.xz"])
+	assert.False(t, d.needsUpdate("linux64", version))
+	assert.True(t, d.needsUpdate("win32", version))
+}
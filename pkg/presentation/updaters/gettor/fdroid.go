@@ -0,0 +1,180 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	fdroidCommand = "fdroid"
+	// fdroidReleasesDir is the directory of the F-Droid repository where the
+	// provider records the releases it added, it's not published
+	fdroidReleasesDir = "gettor"
+)
+
+// fdroidProvider keeps an F-Droid repository with the Android releases, so the
+// F-Droid app can install and update them.  The APKs are copied into the repo
+// directory, fdroid signs the new index with the key of the repository and the
+// repo is pushed with rsync to the server that publishes it.  All the links
+// point to the repository.
+type fdroidProvider struct {
+	// lock serializes the updates of the repository, fdroid can't update it
+	// from several processes at the same time
+	lock        sync.Mutex
+	repoDir     string
+	url         string
+	fingerprint string
+	fdroid      commandFunc
+	// transfer is nil if the repository is published from repoDir
+	transfer *rsyncTransfer
+}
+
+func newFDroidProvider(cfg *internal.FDroid) (provider, error) {
+	if cfg.RepoDir == "" || cfg.URL == "" || cfg.Fingerprint == "" {
+		return nil, errors.New("the F-Droid repo needs a repo directory, a url and the fingerprint of its signing key")
+	}
+	if _, err := exec.LookPath(fdroidCommand); err != nil {
+		return nil, err
+	}
+
+	f := &fdroidProvider{
+		repoDir:     cfg.RepoDir,
+		url:         strings.TrimSuffix(cfg.URL, "/"),
+		fingerprint: strings.Replace(cfg.Fingerprint, ":", "", -1),
+		fdroid:      runCommandIn(cfg.RepoDir, fdroidCommand),
+	}
+	if cfg.Destination != "" {
+		if _, err := exec.LookPath(rsyncCommand); err != nil {
+			return nil, err
+		}
+		f.transfer = &rsyncTransfer{destination: cfg.Destination, sshKey: cfg.SSHKey, run: runCommand(rsyncCommand)}
+	}
+	return f, nil
+}
+
+// runCommandIn is like runCommand but runs the command in dir.
+func runCommandIn(dir, name string) commandFunc {
+	return func(input string, args ...string) ([]byte, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(input)
+		return cmd.CombinedOutput()
+	}
+}
+
+// isFDroidPlatform checks if the platform has APKs, the ones of Tor Browser for
+// Android and Orbot.
+func isFDroidPlatform(platform string) bool {
+	if strings.HasPrefix(platform, resources.ProductTorExpertBundle+"-") {
+		return false
+	}
+	for _, p := range strings.Split(platform, "-") {
+		if p == "android" {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fdroidProvider) releasePath(platform string, version resources.Version) string {
+	return filepath.Join(f.repoDir, fdroidReleasesDir, platform, version.String())
+}
+
+func (f *fdroidProvider) needsUpdate(platform string, version resources.Version) bool {
+	if !isFDroidPlatform(platform) {
+		return false
+	}
+	_, err := os.Stat(f.releasePath(platform, version))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[F-Droid] unable to check for update: %v", err)
+		return false
+	}
+	return err != nil
+}
+
+func (f *fdroidProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if err := f.addRelease(platform, version, binaryPath, sigPath); err != nil {
+			log.Printf("[F-Droid] Unable to add %s to the repo: %v", binaryPath, err)
+			return nil
+		}
+
+		link := resources.NewTBLink()
+		link.Link = f.url + "?fingerprint=" + f.fingerprint
+		link.SigLink = f.url + "/" + path.Base(sigPath)
+		link.Version = version
+		link.Provider = "F-Droid"
+		link.Platform = platform
+		link.Locale = locale
+		link.FileName = path.Base(binaryPath)
+		// all the links are the repo, the file makes them different
+		oid := core.NewHashkey(link.Link + " " + link.FileName)
+		link.CustomOid = &oid
+		return link
+	}
+}
+
+// addRelease copies the files into the repo, updates its index and publishes
+// it.  The release is recorded once it's published.
+func (f *fdroidProvider) addRelease(platform string, version resources.Version, binaryPath, sigPath string) error {
+	repo := filepath.Join(f.repoDir, "repo")
+	for _, file := range []string{binaryPath, sigPath} {
+		if err := copyFile(file, filepath.Join(repo, filepath.Base(file))); err != nil {
+			return err
+		}
+	}
+
+	output, err := f.fdroid("", "update", "--create-metadata")
+	if err != nil {
+		return commandError(err, output)
+	}
+	if f.transfer != nil {
+		output, err := f.transfer.run("", f.transfer.args("--recursive", "--times", "--delete", repo+"/", f.transfer.remotePath("repo"))...)
+		if err != nil {
+			return commandError(err, output)
+		}
+	}
+
+	releasePath := f.releasePath(platform, version)
+	if err := os.MkdirAll(filepath.Dir(releasePath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(releasePath, nil, 0644)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
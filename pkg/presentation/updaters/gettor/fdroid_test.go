@@ -0,0 +1,64 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestFDroid(t *testing.T) {
+	repoDir, err := ioutil.TempDir("", "gettor-fdroid-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(repoDir)
+	assert.NoError(t, os.Mkdir(filepath.Join(repoDir, "repo"), 0755))
+	binaryPath := filepath.Join(repoDir, "tor-browser-12.0.1-android-aarch64-multi.apk")
+	assert.NoError(t, ioutil.WriteFile(binaryPath, []byte("apk"), 0644))
+	assert.NoError(t, ioutil.WriteFile(binaryPath+".asc", []byte("signature"), 0644))
+
+	var fdroidCalls, rsyncCalls [][]string
+	f := &fdroidProvider{
+		repoDir:     repoDir,
+		url:         "https://fdroid.example.org/fdroid/repo",
+		fingerprint: "0123ABCD",
+		fdroid: func(input string, args ...string) ([]byte, error) {
+			fdroidCalls = append(fdroidCalls, args)
+			return nil, nil
+		},
+		transfer: &rsyncTransfer{
+			destination: "gettor@fdroid.example.org:/var/www/fdroid",
+			run: func(input string, args ...string) ([]byte, error) {
+				rsyncCalls = append(rsyncCalls, args)
+				return nil, nil
+			},
+		},
+	}
+
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	assert.False(t, f.needsUpdate("win32", version))
+	assert.False(t, f.needsUpdate("tor-expert-bundle-android-aarch64", version))
+	assert.True(t, f.needsUpdate("orbot-android-aarch64", version))
+	assert.True(t, f.needsUpdate("android-aarch64", version))
+
+	link := f.newRelease("android-aarch64", version)(binaryPath, binaryPath+".asc", "ALL")
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, "https://fdroid.example.org/fdroid/repo?fingerprint=0123ABCD", link.Link)
+	assert.Equal(t, "https://fdroid.example.org/fdroid/repo/tor-browser-12.0.1-android-aarch64-multi.apk.asc", link.SigLink)
+	assert.Equal(t, "F-Droid", link.Provider)
+	assert.NotEqual(t, link.Uid(), (&resources.TBLink{Link: link.Link}).Oid())
+	assert.FileExists(t, filepath.Join(repoDir, "repo", "tor-browser-12.0.1-android-aarch64-multi.apk"))
+	assert.False(t, f.needsUpdate("android-aarch64", version))
+
+	assert.Equal(t, [][]string{{"update", "--create-metadata"}}, fdroidCalls)
+	assert.Equal(t, [][]string{{"-e", "ssh -o BatchMode=yes", "--recursive", "--times", "--delete",
+		filepath.Join(repoDir, "repo") + "/", "gettor@fdroid.example.org:/var/www/fdroid/repo"}}, rsyncCalls)
+}
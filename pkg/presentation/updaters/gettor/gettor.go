@@ -5,7 +5,11 @@
 package gettor
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,6 +17,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -24,12 +29,22 @@ import (
 
 const (
 	downloadsURL    = "https://aus1.torproject.org/torbrowser/update_3/release/downloads.json"
+	alphaURL        = "https://aus1.torproject.org/torbrowser/update_3/alpha/downloads.json"
 	updateFrequency = time.Hour
+	backendTimeout  = time.Minute
 	releaseName     = "Tor Browser %s-%s"
 )
 
 var (
 	releaseBody = "These releases were uploaded to be distributed with gettor."
+
+	// defaultChannelURLs are the downloads.json of the channels that have
+	// one in aus1.  The nightly builds don't, their URL needs to be
+	// configured.
+	defaultChannelURLs = map[string]string{
+		resources.ChannelRelease: downloadsURL,
+		resources.ChannelAlpha:   alphaURL,
+	}
 )
 
 // updatedLinks keeps the links to be sent to the backend
@@ -52,6 +67,11 @@ type downloadsLinks struct {
 }
 
 func InitUpdater(cfg *internal.Config) {
+	verifier, err := newSignatureVerifier(cfg.Updaters.Gettor.Keyring)
+	if err != nil {
+		log.Fatalf("Can't verify the Tor Browser signatures: %v", err)
+	}
+
 	updater := &gettor.GettorUpdater{}
 	updater.Init(cfg)
 
@@ -66,28 +86,75 @@ func InitUpdater(cfg *internal.Config) {
 		close(stop)
 	}()
 
+	limits := cfg.Updaters.Gettor.ProviderConcurrency
 	gh := newGithubProvider(&cfg.Updaters.Gettor.Github)
-	providers := []provider{gh}
+	providers := []provider{limitProvider("github", gh, limits)}
 
 	gl, err := newGitlabProvider(&cfg.Updaters.Gettor.Gitlab)
 	if err != nil {
 		log.Printf("cannot create GitLab provider: %v", err)
 	} else {
-		providers = append(providers, gl)
+		providers = append(providers, limitProvider("gitlab", gl, limits))
 	}
 
 	googleDrive, err := newGoogleDriveUpdater(&cfg.Updaters.Gettor.GoogleDriveUpdater)
 	if err != nil {
 		log.Printf("cannot create Google Drive provider: %v", err)
 	} else {
-		providers = append(providers, googleDrive)
+		providers = append(providers, limitProvider("gdrive", googleDrive, limits))
+	}
+
+	dropbox, err := newDropboxProvider(&cfg.Updaters.Gettor.Dropbox)
+	if err != nil {
+		log.Printf("cannot create Dropbox provider: %v", err)
+	} else {
+		providers = append(providers, limitProvider("dropbox", dropbox, limits))
+	}
+
+	oneDrive, err := newOneDriveProvider(&cfg.Updaters.Gettor.OneDrive)
+	if err != nil {
+		log.Printf("cannot create OneDrive provider: %v", err)
+	} else {
+		providers = append(providers, limitProvider("onedrive", oneDrive, limits))
+	}
+
+	sourceforge, err := newSourceforgeProvider(&cfg.Updaters.Gettor.Sourceforge)
+	if err != nil {
+		log.Printf("cannot create Sourceforge provider: %v", err)
+	} else {
+		providers = append(providers, limitProvider("sourceforge", sourceforge, limits))
+	}
+
+	fdroid, err := newFDroidProvider(&cfg.Updaters.Gettor.FDroid)
+	if err != nil {
+		log.Printf("cannot create F-Droid provider: %v", err)
+	} else {
+		providers = append(providers, limitProvider("fdroid", fdroid, limits))
+	}
+
+	for _, mirrorConfig := range cfg.Updaters.Gettor.Mirrors {
+		mirror, err := newMirrorProvider(&mirrorConfig)
+		if err != nil {
+			log.Printf("cannot create %s mirror provider: %v", mirrorConfig.Name, err)
+			continue
+		}
+		providers = append(providers, limitProvider(mirrorConfig.Name, mirror, limits))
+	}
+
+	for _, pluginConfig := range cfg.Updaters.Gettor.Plugins {
+		plugin, err := newPluginProvider(&pluginConfig)
+		if err != nil {
+			log.Printf("cannot create %s plugin provider: %v", pluginConfig.Name, err)
+			continue
+		}
+		providers = append(providers, limitProvider(pluginConfig.Name, plugin, limits))
 	}
 
 	i2pUpdater := newI2PProvider(&cfg.Updaters.Gettor.I2P)
 	if err != nil {
 		log.Printf("cannot create I2P provider: %v", err)
 	} else {
-		providers = append(providers, i2pUpdater)
+		providers = append(providers, limitProvider("i2p", i2pUpdater, limits))
 	}
 
 	for _, s3Config := range cfg.Updaters.Gettor.S3Updaters {
@@ -95,27 +162,162 @@ func InitUpdater(cfg *internal.Config) {
 		if err != nil {
 			log.Printf("cannot create S3 provider: %v", err)
 		}
-		providers = append(providers, s3Provider)
+		providers = append(providers, limitProvider(s3Config.Name, s3Provider, limits))
 	}
 
-	updateIfNeeded(updater, providers)
+	feeds := channelFeeds(cfg.Updaters.Gettor.Channels, verifier)
+	feeds = append(feeds, productFeeds(cfg.Updaters.Gettor.Products, verifier)...)
+	opts := newUpdateOptions(&cfg.Updaters.Gettor)
+	pending := newReleaseRemovals()
+	updateFeeds(updater, pending, providers, opts, feeds)
+	if opts.dryRun {
+		updater.Shutdown()
+		return
+	}
 	for {
 		select {
 		case <-stop:
 			return
 		case <-time.After(updateFrequency):
-			updateIfNeeded(updater, providers)
+			updateFeeds(updater, pending, providers, opts, feeds)
+		}
+	}
+}
+
+// channelURLs returns the downloads.json URL of each configured channel.
+func channelURLs(channels map[string]string) map[string]string {
+	if len(channels) == 0 {
+		return map[string]string{resources.ChannelRelease: downloadsURL}
+	}
+
+	urls := make(map[string]string)
+	for channel, url := range channels {
+		if url == "" {
+			url = defaultChannelURLs[channel]
+		}
+		if url == "" {
+			log.Printf("No downloads.json URL for the %s channel, it will not be updated", channel)
+			continue
 		}
+		urls[channel] = url
 	}
+	return urls
 }
 
-func updateIfNeeded(updater *gettor.GettorUpdater, providers []provider) {
-	downloads, version, err := getDownloadLinks()
+// updateOptions are the options of the updater that change what an update
+// does.
+type updateOptions struct {
+	workers int
+	// dryRun only reports what would be uploaded
+	dryRun bool
+	// platforms and locales restrict the update to them if they are not
+	// empty
+	platforms map[string]bool
+	locales   map[string]bool
+	// torrent makes magnet links of the downloaded binaries if it's enabled
+	torrent internal.Torrent
+}
+
+func newUpdateOptions(cfg *internal.GettorUpdater) updateOptions {
+	opts := updateOptions{
+		workers:   cfg.UploadWorkers,
+		dryRun:    cfg.DryRun,
+		platforms: make(map[string]bool),
+		locales:   make(map[string]bool),
+		torrent:   cfg.Torrent,
+	}
+	for _, platform := range cfg.Platforms {
+		opts.platforms[platform] = true
+	}
+	for _, locale := range cfg.Locales {
+		opts.locales[locale] = true
+	}
+	return opts
+}
+
+// includesPlatform checks if the platform, with or without its channel
+// prefix, is in the update.
+func (o updateOptions) includesPlatform(platform, channel string) bool {
+	return len(o.platforms) == 0 || o.platforms[platform] || o.platforms[providerPlatform(platform, channel)]
+}
+
+// filterLocales returns the locales that are in the update.
+func (o updateOptions) filterLocales(locales map[string]map[string]string) map[string]map[string]string {
+	if len(o.locales) == 0 {
+		return locales
+	}
+	filtered := make(map[string]map[string]string)
+	for locale, urls := range locales {
+		if o.locales[locale] {
+			filtered[locale] = urls
+		}
+	}
+	return filtered
+}
+
+// updateFeeds updates the releases of the feeds and removes the links of the
+// releases that the providers deleted, that are kept in pending until the
+// backend removes them.
+func updateFeeds(updater *gettor.GettorUpdater, pending *releaseRemovals, providers []provider, opts updateOptions, feeds []feed) {
+	for _, f := range feeds {
+		updateIfNeeded(updater, pending, providers, opts, f)
+	}
+	removeLinks(updater, pending)
+}
+
+// providerPlatform returns the name of the platform for the providers, with
+// the channel as prefix if it's not the release one, like "alpha-win32", so
+// the releases of each channel are kept apart.
+func providerPlatform(platform, channel string) string {
+	if channel == resources.ChannelRelease {
+		return platform
+	}
+	return channel + "-" + platform
+}
+
+// staleVersions returns the versions that are not between the keep newest
+// ones.  The current version is always kept, and the versions that can't be
+// parsed are ignored.
+func staleVersions(versions []string, current resources.Version, keep int) []string {
+	type parsedVersion struct {
+		name    string
+		version resources.Version
+	}
+	var parsed []parsedVersion
+	for _, name := range versions {
+		version, err := resources.Str2Version(name)
+		if err != nil || version.Compare(current) == 0 {
+			continue
+		}
+		parsed = append(parsed, parsedVersion{name, version})
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].version.Compare(parsed[j].version) == 1
+	})
+
+	// the current version takes one of the places
+	keep--
+	var stale []string
+	for i, v := range parsed {
+		if i >= keep {
+			stale = append(stale, v.name)
+		}
+	}
+	return stale
+}
+
+// updateIfNeeded uploads the releases of the feed that the providers don't
+// have yet.  The files are uploaded by workers goroutines, the limits of each
+// provider are in limitedProvider.  The releases that the providers delete are
+// added to pending.
+func updateIfNeeded(updater *gettor.GettorUpdater, pending *releaseRemovals, providers []provider, opts updateOptions, f feed) {
+	downloads, version, err := getDownloadLinks(f.url)
 	if err != nil {
-		log.Println("Error fetching downloads.json:", err)
+		log.Printf("Error fetching the release json of %s: %v", f.name(), err)
 		return
 	}
 
+	checksums := newReleaseChecksums()
 	tmpDir, err := ioutil.TempDir("", "gettor-")
 	if err != nil {
 		log.Println("Can't create temporary file:", err)
@@ -123,70 +325,185 @@ func updateIfNeeded(updater *gettor.GettorUpdater, providers []provider) {
 	}
 	defer os.RemoveAll(tmpDir)
 
+	channel := f.channel
 	for platform, locales := range downloads.Downloads {
+		if !opts.includesPlatform(productPlatform(f.product, platform), channel) {
+			continue
+		}
+		locales = opts.filterLocales(locales)
+		if len(locales) == 0 {
+			continue
+		}
+
 		shouldDownload := false
-		uploadFuncs := []uploadFileFunc{}
+		outdated := []provider{}
+		pPlatform := providerPlatform(productPlatform(f.product, platform), channel)
 		for _, p := range providers {
-			if p.needsUpdate(platform, version) {
+			if p.needsUpdate(pPlatform, version) {
 				if refreshOnly, ok := p.(providerExtRefreshLink); ok {
-					if !refreshOnly.needsUpdateRefreshOnly(platform, version) {
+					if !refreshOnly.needsUpdateRefreshOnly(pPlatform, version) {
 						shouldDownload = true
 					}
 				} else {
 					shouldDownload = true
 				}
-				fn := p.newRelease(platform, version)
-				if fn != nil {
-					uploadFuncs = append(uploadFuncs, fn)
-				}
+				outdated = append(outdated, p)
 			}
 		}
-		if len(uploadFuncs) == 0 {
+		if len(outdated) == 0 {
+			continue
+		}
+		if opts.dryRun {
+			reportDryRun(pPlatform, version, locales, outdated)
+			continue
+		}
+
+		// The binaries are verified before any provider creates the release,
+		// so nothing gets published if one of them has a bad signature.
+		assets, err := getAssets(locales, tmpDir, shouldDownload, f.verifier, checksums)
+		if err != nil {
+			log.Printf("Refusing to publish %s %s: %v", pPlatform, version.String(), err)
 			continue
 		}
 
-		for locale, assets := range locales {
-			log.Println("Uploading to distributors", assets["binary"])
-			getAssetPath := getAsset
-			if !shouldDownload {
-				getAssetPath = constructAssetPath
+		errs := make(uploadErrors)
+		releases := []uploadJob{}
+		for _, p := range outdated {
+			fn := p.newRelease(pPlatform, version)
+			if fn != nil {
+				releases = append(releases, uploadJob{provider: providerName(p), upload: fn})
+			} else {
+				errs[providerName(p)]++
 			}
-			binaryPath, err := getAssetPath(assets["binary"], tmpDir)
-			if err != nil {
-				log.Println("Error getting asset:", err)
-				continue
+		}
+
+		// the jobs of a locale are together so the uploads of the same file
+		// to different providers run at the same time
+		jobs := []uploadJob{}
+		for locale, asset := range assets {
+			log.Println("Uploading to distributors", asset.binaryPath)
+			for _, release := range releases {
+				release.locale = locale
+				release.asset = asset
+				jobs = append(jobs, release)
 			}
-			sigPath, err := getAssetPath(assets["sig"], tmpDir)
-			if err != nil {
-				log.Println("Error getting asset:", err)
+		}
+		links, uploadErrs := uploadAll(jobs, opts.workers)
+		if shouldDownload && opts.torrent.Enable {
+			addMagnets(&opts.torrent, links, jobs, pPlatform, version)
+		}
+		for i, link := range links {
+			if link == nil {
 				continue
 			}
-
-			for _, fn := range uploadFuncs {
-				link := fn(binaryPath, sigPath, locale)
-				if link != nil {
-					updatedLinks = append(updatedLinks, link)
-				}
+			link.Platform, link.Arch = resources.SplitPlatformArch(platform)
+			if channel != resources.ChannelRelease {
+				link.Channel = channel
 			}
+			link.Product = f.product
+			if jobs[i].asset.checksum != "" {
+				link.Checksum = jobs[i].asset.checksum
+			}
+			updatedLinks = append(updatedLinks, link)
+		}
+		removeAssets(assets)
+		pending.addAll(collectRemovedReleases(outdated))
 
-			os.Remove(binaryPath)
-			os.Remove(sigPath)
+		for name, count := range uploadErrs {
+			errs[name] += count
+		}
+		if len(errs) != 0 {
+			log.Printf("Failed uploads of %s %s: %s", pPlatform, version.String(), errs)
 		}
 
 		if len(updatedLinks) == 0 {
 			return
 		}
 
-		err = updater.AddLinks(updatedLinks)
+		ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+		err = updater.AddLinks(ctx, updatedLinks)
+		cancel()
 		if err != nil {
 			log.Println("Error sending links to the backend:", err)
 		} else {
-			log.Println("Updated links for", platform, version.String(), "in the backend")
+			log.Println("Updated links for", pPlatform, version.String(), "in the backend")
 			updatedLinks = nil
 		}
 	}
 }
 
+// reportDryRun logs what would be uploaded of the platform.
+func reportDryRun(platform string, version resources.Version, locales map[string]map[string]string, outdated []provider) {
+	var names []string
+	for _, p := range outdated {
+		names = append(names, providerName(p))
+	}
+	for locale, urls := range locales {
+		log.Printf("[dry-run] Would upload %s %s %s to %s: %s", platform, version.String(), locale, strings.Join(names, ", "), urls["binary"])
+	}
+}
+
+// asset is a binary of a locale and its signature
+type asset struct {
+	binaryPath string
+	sigPath    string
+	checksum   string
+}
+
+// getAssets gets the binary and the signature of each locale.  If download is
+// true they are downloaded and the binaries verified against their checksum
+// and signature, if any of them fails the verification none of the assets is
+// returned.  If
+// it's false only the file names are needed, for the providers that just
+// refresh their links.
+func getAssets(locales map[string]map[string]string, tmpDir string, download bool, verifier *signatureVerifier, checksums *releaseChecksums) (map[string]asset, error) {
+	getAssetPath := getAsset
+	if !download {
+		getAssetPath = constructAssetPath
+	}
+
+	assets := make(map[string]asset)
+	for locale, urls := range locales {
+		binaryPath, err := getAssetPath(urls["binary"], tmpDir)
+		if err != nil {
+			log.Println("Error getting asset:", err)
+			continue
+		}
+		sigPath, err := getAssetPath(urls["sig"], tmpDir)
+		if err != nil {
+			log.Println("Error getting asset:", err)
+			os.Remove(binaryPath)
+			continue
+		}
+		a := asset{binaryPath: binaryPath, sigPath: sigPath}
+		assets[locale] = a
+		if !download {
+			continue
+		}
+
+		a.checksum, err = fileChecksum(binaryPath)
+		if err != nil {
+			log.Println("Error calculating the checksum of", binaryPath, err)
+		} else if err := checksums.verify(urls, a.checksum); err != nil {
+			removeAssets(assets)
+			return nil, fmt.Errorf("the binary of the %s locale: %w", locale, err)
+		}
+		if err := verifier.verify(binaryPath, sigPath); err != nil {
+			removeAssets(assets)
+			return nil, fmt.Errorf("the binary of the %s locale: %w", locale, err)
+		}
+		assets[locale] = a
+	}
+	return assets, nil
+}
+
+func removeAssets(assets map[string]asset) {
+	for _, a := range assets {
+		os.Remove(a.binaryPath)
+		os.Remove(a.sigPath)
+	}
+}
+
 func constructAssetPath(url string, tmpDir string) (filePath string, err error) {
 	segments := strings.Split(url, "/")
 	fileName := segments[len(segments)-1]
@@ -194,29 +511,23 @@ func constructAssetPath(url string, tmpDir string) (filePath string, err error)
 	return fileName, nil
 }
 
-func getAsset(url string, tmpDir string) (filePath string, err error) {
-	filePath, err = constructAssetPath(url, tmpDir)
-	if err != nil {
-		return
-	}
-	file, err := os.Create(filePath)
+// fileChecksum returns the hex encoded SHA-256 of the file
+func fileChecksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return
+		return "", err
 	}
 	defer file.Close()
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(file, resp.Body)
-	return
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func getDownloadLinks() (downloads downloadsLinks, version resources.Version, err error) {
-	resp, err := http.Get(downloadsURL)
+func getDownloadLinks(url string) (downloads downloadsLinks, version resources.Version, err error) {
+	resp, err := http.Get(url)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// checkProvider records the platforms it was asked about and fails the test
+// if a release is created.
+type checkProvider struct {
+	t         *testing.T
+	platforms []string
+}
+
+func (c *checkProvider) needsUpdate(platform string, version resources.Version) bool {
+	c.platforms = append(c.platforms, platform)
+	return true
+}
+
+func (c *checkProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	c.t.Errorf("Release of %s created in a dry run", platform)
+	return nil
+}
+
+func TestUpdateOptions(t *testing.T) {
+	opts := newUpdateOptions(&internal.GettorUpdater{
+		Platforms: []string{"win32", "alpha-linux64"},
+		Locales:   []string{"en-US"},
+	})
+	assert.True(t, opts.includesPlatform("win32", resources.ChannelRelease))
+	assert.True(t, opts.includesPlatform("win32", resources.ChannelAlpha))
+	assert.True(t, opts.includesPlatform("linux64", resources.ChannelAlpha))
+	assert.False(t, opts.includesPlatform("linux64", resources.ChannelRelease))
+
+	locales := map[string]map[string]string{"en-US": {}, "es-ES": {}}
+	assert.Equal(t, map[string]map[string]string{"en-US": {}}, opts.filterLocales(locales))
+
+	opts = newUpdateOptions(&internal.GettorUpdater{})
+	assert.True(t, opts.includesPlatform("linux64", resources.ChannelRelease))
+	assert.Equal(t, locales, opts.filterLocales(locales))
+}
+
+func TestUpdateDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": "12.0.1", "downloads": {
+			"win32": {"ALL": {"binary": "https://dist.torproject.org/torbrowser/12.0.1/torbrowser-install-12.0.1_ALL.exe"}},
+			"linux64": {"ALL": {"binary": "https://dist.torproject.org/torbrowser/12.0.1/tor-browser-linux64-12.0.1_ALL.tar.xz"}}
+		}}`)
+	}))
+	defer ts.Close()
+
+	p := &checkProvider{t: t}
+	opts := newUpdateOptions(&internal.GettorUpdater{DryRun: true, Platforms: []string{"win32"}})
+	updateIfNeeded(nil, newReleaseRemovals(), []provider{p}, opts, feed{channel: resources.ChannelRelease, url: ts.URL})
+	assert.Equal(t, []string{"win32"}, p.platforms)
+}
+
+func TestStaleVersions(t *testing.T) {
+	current := resources.Version{Mayor: 12, Minor: 0, Patch: 3}
+	versions := []string{"12.0.1", "12.0.3", "invalid", "11.5.8", "12.0.2"}
+	assert.Equal(t, []string{"12.0.1", "11.5.8"}, staleVersions(versions, current, 2))
+	assert.Equal(t, []string{"12.0.2", "12.0.1", "11.5.8"}, staleVersions(versions, current, 1))
+	assert.Len(t, staleVersions(versions, current, 4), 0)
+}
+
+func TestUpdateProductDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": "17.2.1", "downloads": {
+			"android-aarch64": {"ALL": {"binary": "https://example.com/Orbot-17.2.1-arm64-v8a-release.apk"}}
+		}}`)
+	}))
+	defer ts.Close()
+
+	p := &checkProvider{t: t}
+	opts := newUpdateOptions(&internal.GettorUpdater{DryRun: true})
+	updateIfNeeded(nil, newReleaseRemovals(), []provider{p}, opts, feed{product: resources.ProductOrbot, channel: resources.ChannelRelease, url: ts.URL})
+	assert.Equal(t, []string{"orbot-android-aarch64"}, p.platforms)
+
+	link := &resources.TBLink{Platform: "android", Arch: "aarch64", Product: resources.ProductOrbot}
+	assert.Equal(t, "orbot-android-aarch64", linkPlatform(link))
+}
+
+func TestProductFeeds(t *testing.T) {
+	verifier := &signatureVerifier{keyring: "tor.keyring", fingerprint: torBrowserSigningKey}
+	feeds := productFeeds(map[string]internal.GettorProduct{
+		resources.ProductTorExpertBundle: {URL: "https://example.com/tor-expert-bundle.json"},
+		resources.ProductOrbot:           {Keyring: "orbot.keyring"},
+		"unknown":                        {URL: "https://example.com/unknown.json"},
+	}, verifier)
+	if assert.Len(t, feeds, 1) {
+		assert.Equal(t, resources.ProductTorExpertBundle, feeds[0].product)
+		assert.Equal(t, verifier, feeds[0].verifier)
+	}
+
+	_, err := newProductVerifier(internal.GettorProduct{Keyring: "orbot.keyring"}, verifier)
+	assert.Equal(t, MissingSigningKeyError, err)
+}
+
+func TestAddMagnets(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gettor-torrent-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	binaryPath := path.Join(tmpDir, "torbrowser-install-12.0.1_ALL.exe")
+	assert.NoError(t, ioutil.WriteFile(binaryPath, []byte("tor browser"), 0644))
+
+	fileLink := &resources.TBLink{Link: "https://github.com/TheTorProject/gettorbrowser/releases/download/win32-12.0.1/torbrowser-install-12.0.1_ALL.exe"}
+	shareLink := &resources.TBLink{Link: "https://drive.google.com/uc?id=1234"}
+	jobs := []uploadJob{{asset: asset{binaryPath: binaryPath}}, {asset: asset{binaryPath: binaryPath}}, {asset: asset{binaryPath: binaryPath}}}
+	cfg := &internal.Torrent{Enable: true, WebSeeds: []string{"https://mirror.example.org/{platform}/{version}/{file}"}}
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	addMagnets(cfg, []*resources.TBLink{fileLink, nil, shareLink}, jobs, "win32", version)
+
+	assert.NotEmpty(t, fileLink.Magnet)
+	assert.Equal(t, fileLink.Magnet, shareLink.Magnet)
+	assert.Contains(t, fileLink.Magnet, "ws="+url.QueryEscape("https://mirror.example.org/win32/12.0.1/torbrowser-install-12.0.1_ALL.exe"))
+	assert.Contains(t, fileLink.Magnet, "ws="+url.QueryEscape(fileLink.Link))
+	assert.NotContains(t, fileLink.Magnet, url.QueryEscape(shareLink.Link))
+}
@@ -26,6 +26,7 @@ type githubProvider struct {
 	client *github.Client
 	ctx    context.Context
 	cfg    *internal.Github
+	*releaseRemovals
 }
 
 func newGithubProvider(cfg *internal.Github) *githubProvider {
@@ -35,7 +36,7 @@ func newGithubProvider(cfg *internal.Github) *githubProvider {
 	)
 	tc := oauth2.NewClient(ctx, ts)
 	client := github.NewClient(tc)
-	return &githubProvider{client, ctx, cfg}
+	return &githubProvider{client, ctx, cfg, newReleaseRemovals()}
 }
 
 func (gh *githubProvider) needsUpdate(platform string, version resources.Version) bool {
@@ -50,12 +51,14 @@ func (gh *githubProvider) needsUpdate(platform string, version resources.Version
 	}
 
 	for _, release := range releases {
-		parts := strings.Split(*release.TagName, "-")
-		if len(parts) != 2 {
+		// the tag is <platform>-<version> and the platform might have
+		// dashes, like android-aarch64 or alpha-win32
+		tag := strings.TrimPrefix(*release.TagName, platform+"-")
+		if strings.Contains(tag, "-") {
 			continue
 		}
 
-		releaseVersion, err := resources.Str2Version(parts[1])
+		releaseVersion, err := resources.Str2Version(tag)
 		if err != nil {
 			continue
 		}
@@ -92,6 +95,10 @@ func (gh *githubProvider) newRelease(platform string, version resources.Version)
 		_, err := gh.client.Repositories.DeleteRelease(gh.ctx, gh.cfg.Owner, gh.cfg.Repo, *release.ID)
 		if err != nil {
 			log.Println("[Github] Error deleting a release", release.TagName, ":", err)
+			continue
+		}
+		if releaseVersion, err := resources.Str2Version(strings.TrimPrefix(*release.TagName, platform+"-")); err == nil {
+			gh.add(githubPlatform, platform, releaseVersion)
 		}
 	}
 
@@ -142,7 +149,7 @@ func (gh *githubProvider) getReleases(platform string) ([]*github.RepositoryRele
 
 	platformReleases := []*github.RepositoryRelease{}
 	for _, release := range releases {
-		if strings.HasPrefix(*release.TagName, platform) {
+		if strings.HasPrefix(*release.TagName, platform+"-") {
 			platformReleases = append(platformReleases, release)
 		}
 	}
@@ -23,8 +23,15 @@ import (
 	"google.golang.org/api/option"
 )
 
+const (
+	// the files are tagged with their platform and version in their
+	// appProperties to find the old releases
+	gdrivePlatformProperty = "gettor_platform"
+	gdriveVersionProperty  = "gettor_version"
+)
+
 func newGoogleDriveUpdater(cfg *internal.GoogleDriveUpdater) (provider, error) {
-	updater := googleDriveUpdater{config: cfg, ctx: context.Background()}
+	updater := googleDriveUpdater{config: cfg, ctx: context.Background(), releaseRemovals: newReleaseRemovals()}
 	var err error
 	updater.drive, err = updater.createApiClientFromConfig()
 	return &updater, err
@@ -34,6 +41,7 @@ type googleDriveUpdater struct {
 	ctx    context.Context
 	config *internal.GoogleDriveUpdater
 	drive  *drive.Service
+	*releaseRemovals
 }
 
 func (g googleDriveUpdater) needsUpdate(platform string, version resources.Version) bool {
@@ -46,17 +54,26 @@ func (g googleDriveUpdater) needsUpdate(platform string, version resources.Versi
 }
 
 func (g googleDriveUpdater) newRelease(platform string, version resources.Version) uploadFileFunc {
-	if _, err := g.uploadFileAndGetLink(g.formatNameForExistenceObject(platform, version), bytes.NewReader([]byte{0x00})); err != nil {
+	properties := map[string]string{
+		gdrivePlatformProperty: platform,
+		gdriveVersionProperty:  version.String(),
+	}
+	if _, err := g.uploadFileAndGetLink(g.formatNameForExistenceObject(platform, version), bytes.NewReader([]byte{0x00}), properties); err != nil {
 		log.Println("[Google Drive] Unable to create existence object", err)
 		return nil
 	}
+	if g.config.KeepVersions > 0 {
+		if err := g.pruneReleases(platform, version); err != nil {
+			log.Println("[Google Drive] Unable to delete the old releases", err)
+		}
+	}
 
 	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
 		link := resources.NewTBLink()
 
 		{
 			var err error
-			link.Link, err = g.createLinkFromPath(binaryPath)
+			link.Link, err = g.createLinkFromPath(binaryPath, properties)
 			if err != nil {
 				log.Println("[Google Drive] Unable to create link for binary ", err)
 				return nil
@@ -64,7 +81,7 @@ func (g googleDriveUpdater) newRelease(platform string, version resources.Versio
 		}
 		{
 			var err error
-			link.SigLink, err = g.createLinkFromPath(sigPath)
+			link.SigLink, err = g.createLinkFromPath(sigPath, properties)
 			if err != nil {
 				log.Println("[Google Drive] Unable to create link for binary ", err)
 				return nil
@@ -81,7 +98,7 @@ func (g googleDriveUpdater) newRelease(platform string, version resources.Versio
 
 }
 
-func (g googleDriveUpdater) createLinkFromPath(filePath string) (string, error) {
+func (g googleDriveUpdater) createLinkFromPath(filePath string, properties map[string]string) (string, error) {
 	filename := path.Base(filePath)
 	fd, err := os.Open(filePath)
 	if err != nil {
@@ -90,7 +107,7 @@ func (g googleDriveUpdater) createLinkFromPath(filePath string) (string, error)
 	}
 	defer fd.Close()
 
-	downloadLink, err := g.uploadFileAndGetLink(filename, fd)
+	downloadLink, err := g.uploadFileAndGetLink(filename, fd, properties)
 	if err != nil {
 		log.Println("[Google Drive] Unable to get file link ", err)
 		return "", err
@@ -171,8 +188,8 @@ func (g googleDriveUpdater) checkFileExistence(filename string) (bool, error) {
 	return true, nil
 }
 
-func (g googleDriveUpdater) uploadFileAndGetLink(filename string, reader io.Reader) (string, error) {
-	file := &drive.File{Name: filename, Parents: []string{g.config.ParentFolderID}}
+func (g googleDriveUpdater) uploadFileAndGetLink(filename string, reader io.Reader, properties map[string]string) (string, error) {
+	file := &drive.File{Name: filename, Parents: []string{g.config.ParentFolderID}, AppProperties: properties}
 	result, err := g.drive.Files.Create(file).Media(reader).Do()
 	if err != nil {
 		return "", err
@@ -211,3 +228,45 @@ func (g googleDriveUpdater) createToken(authCode string) error {
 func (g googleDriveUpdater) formatNameForExistenceObject(platform string, version resources.Version) string {
 	return fmt.Sprintf("%v-%v.exist-gettor", platform, version.String())
 }
+
+// pruneReleases deletes the files of the platform that are not in the
+// KeepVersions newest versions.  Only the files uploaded with their
+// appProperties are found.
+func (g googleDriveUpdater) pruneReleases(platform string, version resources.Version) error {
+	query := fmt.Sprintf("'%v' in parents and appProperties has { key='%v' and value='%v' } and trashed = false",
+		g.config.ParentFolderID, gdrivePlatformProperty, platform)
+	files := make(map[string][]*drive.File)
+	err := g.drive.Files.List().Q(query).Fields("nextPageToken, files(id, name, appProperties)").
+		Pages(g.ctx, func(fileList *drive.FileList) error {
+			for _, file := range fileList.Files {
+				fileVersion := file.AppProperties[gdriveVersionProperty]
+				files[fileVersion] = append(files[fileVersion], file)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	var versions []string
+	for fileVersion := range files {
+		versions = append(versions, fileVersion)
+	}
+	for _, stale := range staleVersions(versions, version, g.config.KeepVersions) {
+		deleted := true
+		for _, file := range files[stale] {
+			if err := g.drive.Files.Delete(file.Id).Do(); err != nil {
+				log.Println("[Google Drive] Unable to delete", file.Name, err)
+				deleted = false
+			}
+		}
+		if !deleted {
+			continue
+		}
+		log.Println("[Google Drive] Deleted the release", platform, stale)
+		if staleVersion, err := resources.Str2Version(stale); err == nil {
+			g.add("Google Drive", platform, staleVersion)
+		}
+	}
+	return nil
+}
@@ -6,13 +6,18 @@ package gettor
 
 import (
 	"bytes"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"strconv"
 	"testing"
 	"time"
@@ -57,7 +62,7 @@ func TestUploadFile(t *testing.T) {
 	io.ReadFull(rand.New(rand.NewSource(time.Now().Unix())), buf)
 
 	t.Run("upload", func(t *testing.T) {
-		link, err := updaterInternal.uploadFileAndGetLink("testing", bytes.NewReader(buf))
+		link, err := updaterInternal.uploadFileAndGetLink("testing", bytes.NewReader(buf), nil)
 		assert.NoError(t, err)
 		t.Run("check file existence", func(t *testing.T) {
 			exist, err := updaterInternal.checkFileExistence("testing")
@@ -146,3 +151,38 @@ func TestGoogleDrive(t *testing.T) {
 	})
 
 }
+
+func TestGoogleDriveRetention(t *testing.T) {
+	var deleted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			assert.Contains(t, r.URL.Query().Get("q"), "value='win32'")
+			io.WriteString(w, `{"files": [
+				{"id": "1", "name": "torbrowser-install-12.0.1_ALL.exe", "appProperties": {"gettor_version": "12.0.1"}},
+				{"id": "2", "name": "win32-12.0.1.exist-gettor", "appProperties": {"gettor_version": "12.0.1"}},
+				{"id": "3", "name": "torbrowser-install-12.0.2_ALL.exe", "appProperties": {"gettor_version": "12.0.2"}},
+				{"id": "4", "name": "torbrowser-install-12.0.3_ALL.exe", "appProperties": {"gettor_version": "12.0.3"}}
+			]}`)
+		case http.MethodDelete:
+			deleted = append(deleted, path.Base(r.URL.Path))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(ts.Client()), option.WithEndpoint(ts.URL+"/drive/v3/"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	updater := googleDriveUpdater{
+		ctx:             ctx,
+		config:          &internal.GoogleDriveUpdater{ParentFolderID: "folder", KeepVersions: 2},
+		drive:           srv,
+		releaseRemovals: newReleaseRemovals(),
+	}
+	assert.NoError(t, updater.pruneReleases("win32", resources.Version{Mayor: 12, Minor: 0, Patch: 3}))
+	assert.Equal(t, []string{"1", "2"}, deleted)
+	assert.Equal(t, []removedRelease{{provider: "Google Drive", platform: "win32", version: resources.Version{Mayor: 12, Minor: 0, Patch: 1}}}, updater.removedReleases())
+}
@@ -5,32 +5,94 @@
 package gettor
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	//"github.com/google/go-github/github"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 const (
 	i2pPlatform = "github"
+
+	defaultI2PHttpProxy = "http://127.0.0.1:4444"
+	// i2pChecksumsFile is the name of the checksums inside the torrents
+	i2pChecksumsFile = "sha256sums.txt"
+	// i2pTrackerTimeout is long, the requests over I2P are slow
+	i2pTrackerTimeout = 5 * time.Minute
 )
 
 type i2pProvider struct {
-	ctx   context.Context
-	cfg   *internal.I2P
-	cache map[string]*resources.TBLink
+	ctx    context.Context
+	cfg    *internal.I2P
+	seeder *i2pSeeder
+	store  persistence.Mechanism
+
+	sync.Mutex
+	cache    map[string]*resources.TBLink
+	torrents map[string]*i2pTorrent
+}
+
+// i2pTorrent is a torrent made by the I2P provider, indexed by its name.
+type i2pTorrent struct {
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	InfoHash string `json:"info_hash"`
+	Torrent  []byte `json:"torrent"`
+}
+
+// i2pState is what the I2P provider keeps in its storage dir, so it doesn't
+// make the torrents again and seeds them after a restart.
+type i2pState struct {
+	Links    map[string]*resources.TBLink `json:"links"`
+	Torrents map[string]*i2pTorrent       `json:"torrents"`
 }
 
 func newI2PProvider(cfg *internal.I2P) *i2pProvider {
 	ctx := context.Background()
-	return &i2pProvider{ctx, cfg, make(map[string]*resources.TBLink)}
+	i := &i2pProvider{
+		ctx:      ctx,
+		cfg:      cfg,
+		cache:    make(map[string]*resources.TBLink),
+		torrents: make(map[string]*i2pTorrent),
+	}
+	if cfg.StorageDir != "" {
+		i.store = pjson.New("i2p-torrents", cfg.StorageDir)
+		var state i2pState
+		err := i.store.Load(&state)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("[I2P] Can't load the torrents:", err)
+		}
+		for platform, link := range state.Links {
+			i.cache[platform] = link
+		}
+		for name, torrent := range state.Torrents {
+			i.torrents[name] = torrent
+		}
+	}
+	if cfg.Seeder.ApiUrl != "" {
+		i.seeder = newI2PSeeder(&cfg.Seeder)
+		go i.seedAll()
+	}
+	return i
 }
 
 //needsUpdate(platform string, version resources.Version) bool
@@ -40,7 +102,9 @@ func (i *i2pProvider) needsUpdate(platform string, version resources.Version) bo
 		log.Println("[I2P] Error fetching latest release:", err)
 		return false
 	}
+	i.Lock()
 	cached, ok := i.cache[platform]
+	i.Unlock()
 	if !ok {
 		log.Println("[I2P] No cached release for", platform)
 		return true
@@ -70,36 +134,214 @@ func (i *i2pProvider) needsUpdate(platform string, version resources.Version) bo
 
 func (i *i2pProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
 	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
-		if _, ok := i.cache[platform]; !ok {
-			i.cache[platform] = resources.NewTBLink()
+		files := []resources.TorrentFile{
+			{Name: path.Base(binaryPath), Path: binaryPath},
+			{Name: path.Base(sigPath), Path: sigPath},
 		}
-		for index, filePath := range []string{binaryPath, sigPath} {
-			filename := path.Base(filePath)
-			if index == 0 {
-				MagnetLink, err := i.cache[platform].GenerateFileMagnet(filename)
-				if err != nil {
-					log.Println("[I2P] Couldn't generate a magnet link for", filename, ":", err)
-					return nil
-				}
-				i.cache[platform].Link = MagnetLink
-			} else {
-				SigMagnetLink, err := i.cache[platform].GenerateSigMagnet(filename)
-				if err != nil {
-					log.Println("[I2P] Couldn't generate a magnet link for", filename, ":", err)
-					return nil
-				}
-				i.cache[platform].SigLink = SigMagnetLink
+		if i.cfg.TorrentChecksums {
+			sumsPath := binaryPath + ".sha256sums.txt"
+			err := writeChecksums(sumsPath, files)
+			if err != nil {
+				log.Println("[I2P] Couldn't write the checksums of", path.Base(binaryPath), ":", err)
+				return nil
 			}
+			files = append(files, resources.TorrentFile{Name: i2pChecksumsFile, Path: sumsPath})
+		}
+
+		name := releaseTorrentName(path.Base(binaryPath))
+		webSeeds := expandWebSeeds(i.cfg.WebSeeds, platform, version, name)
+		magnet, torrent, err := resources.GenerateReleaseMagnet(name, files, i.cfg.Trackers, webSeeds)
+		if err != nil {
+			log.Println("[I2P] Couldn't generate a magnet link for", name, ":", err)
+			return nil
+		}
+		i.announce(name, torrent)
+		t := &i2pTorrent{Platform: platform, Version: version.String(), InfoHash: magnetInfoHash(magnet), Torrent: torrent}
+		if i.seeder != nil {
+			err = i.seeder.seed(name, files, t)
+			if err != nil {
+				log.Println("[I2P] Couldn't seed", name, ":", err)
+			}
+		}
+
+		link := resources.NewTBLink()
+		// the signature is in the same torrent as the binary
+		link.Link = magnet
+		link.SigLink = magnet
+		link.Version = version
+		link.Provider = i2pPlatform
+		link.Platform = platform
+		link.Locale = locale
+		link.FileName = path.Base(binaryPath)
+		i.addRelease(name, link, t)
+		return link
+	}
+}
+
+// addRelease caches the link and the torrent of a release, and forgets the
+// torrents of the older versions of the platform.
+func (i *i2pProvider) addRelease(name string, link *resources.TBLink, torrent *i2pTorrent) {
+	i.Lock()
+	defer i.Unlock()
+
+	i.cache[link.Platform] = link
+	i.torrents[name] = torrent
+	for oldName, old := range i.torrents {
+		if old.Platform != torrent.Platform || old.Version == torrent.Version {
+			continue
 		}
+		delete(i.torrents, oldName)
+		if i.seeder != nil {
+			go i.seeder.remove(oldName, old)
+		}
+	}
+	i.save()
+}
 
-		i.cache[platform].Version = version
-		i.cache[platform].Provider = i2pPlatform
-		i.cache[platform].Platform = platform
-		i.cache[platform].Locale = locale
-		i.cache[platform].FileName = path.Base(binaryPath)
+// save stores the state of the provider, it needs to be called with the lock
+// held.
+func (i *i2pProvider) save() {
+	if i.store == nil {
+		return
+	}
+	err := i.store.Save(i2pState{Links: i.cache, Torrents: i.torrents})
+	if err != nil {
+		log.Println("[I2P] Can't save the torrents:", err)
+	}
+}
 
-		return i.cache[platform]
+// seedAll adds the stored torrents to the seeder, for the ones made before a
+// restart.
+func (i *i2pProvider) seedAll() {
+	i.Lock()
+	torrents := make(map[string]*i2pTorrent, len(i.torrents))
+	for name, torrent := range i.torrents {
+		torrents[name] = torrent
+	}
+	i.Unlock()
+
+	for name, torrent := range torrents {
+		err := i.seeder.add(torrent)
+		if err != nil {
+			log.Println("[I2P] Couldn't seed", name, ":", err)
+		}
+	}
+}
+
+// magnetInfoHash returns the hex encoded info hash of the magnet URI.
+func magnetInfoHash(magnet string) string {
+	u, err := url.Parse(magnet)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimPrefix(u.Query().Get("xt"), "urn:btih:"))
+}
+
+// releaseTorrentName returns the name of the torrent of the binary, its file
+// name without the extension.
+func releaseTorrentName(binaryName string) string {
+	for _, ext := range []string{".tar.xz", ".tar.gz", ".tar.bz2"} {
+		if strings.HasSuffix(binaryName, ext) {
+			return strings.TrimSuffix(binaryName, ext)
+		}
+	}
+	// versions like tor-0.4.7.13 don't have an extension
+	ext := path.Ext(binaryName)
+	if strings.IndexFunc(ext, unicode.IsLetter) == -1 {
+		return binaryName
+	}
+	return strings.TrimSuffix(binaryName, ext)
+}
+
+// writeChecksums writes the SHA-256 checksums of the files in the sha256sum
+// format.
+func writeChecksums(sumsPath string, files []resources.TorrentFile) error {
+	var sums strings.Builder
+	for _, file := range files {
+		checksum, err := fileChecksum(file.Path)
+		if err != nil {
+			return err
+		}
+		sums.WriteString(checksum + "  " + file.Name + "\n")
+	}
+	return ioutil.WriteFile(sumsPath, []byte(sums.String()), 0644)
+}
+
+// announce posts the torrent of the file to the tracker API, if it's
+// configured.  The magnet links work without it, so the errors are only logged.
+func (i *i2pProvider) announce(fileName string, torrent []byte) {
+	if i.cfg.TrackerApi.Url == "" {
+		return
+	}
+	err := i.postTorrent(fileName, torrent)
+	if err != nil {
+		log.Println("[I2P] Couldn't post the torrent of", fileName, "to the tracker:", err)
+		return
+	}
+	log.Println("[I2P] Posted the torrent of", fileName, "to the tracker")
+}
+
+// postTorrent posts the torrent as the "torrent" file of a multipart form to
+// the tracker API.
+func (i *i2pProvider) postTorrent(fileName string, torrent []byte) error {
+	apiCfg := &i.cfg.TrackerApi
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("torrent", fileName+".torrent")
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(torrent)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodPost, apiCfg.Url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if apiCfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+apiCfg.Token)
+	}
+	client, err := i.trackerClient(req.URL)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the tracker answered %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// trackerClient returns the HTTP client for the tracker API, that goes through
+// the HTTP proxy of the I2P router for the .i2p hosts.
+func (i *i2pProvider) trackerClient(trackerURL *url.URL) (*http.Client, error) {
+	client := &http.Client{Timeout: i2pTrackerTimeout}
+	if !strings.HasSuffix(trackerURL.Hostname(), ".i2p") {
+		return client, nil
+	}
+	proxy := i.cfg.TrackerApi.HttpProxy
+	if proxy == "" {
+		proxy = defaultI2PHttpProxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
 	}
+	client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	return client, nil
 }
 
 func (i *i2pProvider) getRelease() (string, error) {
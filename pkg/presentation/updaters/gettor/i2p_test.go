@@ -1,9 +1,17 @@
 package gettor
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 func TestGetReleases(t *testing.T) {
@@ -16,3 +24,123 @@ func TestGetReleases(t *testing.T) {
 		t.Errorf("got no releases")
 	}
 }
+
+func TestPostTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdsys-i2p-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "tor-browser-linux64-12.0.1_ALL.tar.xz")
+	if err := ioutil.WriteFile(filePath, []byte(strings.Repeat("tor browser", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var posted []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		file, header, err := r.FormFile("torrent")
+		if err != nil || header.Filename != "tor-browser-linux64-12.0.1_ALL.tar.xz.torrent" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		posted, _ = ioutil.ReadAll(file)
+	}))
+	defer ts.Close()
+
+	cfg := &internal.I2P{
+		Trackers:   []string{"http://tracker.example.i2p/a", "http://tracker2.example.i2p/a"},
+		WebSeeds:   []string{"http://mirror.example.i2p/{platform}/{file}"},
+		TrackerApi: internal.I2PTrackerApi{Url: ts.URL, Token: "token"},
+	}
+	i := newI2PProvider(cfg)
+	webSeeds := expandWebSeeds(cfg.WebSeeds, "linux64", resources.Version{}, "tor-browser-linux64-12.0.1_ALL.tar.xz")
+	magnet, torrent, err := resources.NewTBLink().GenerateFileMagnet(filePath, cfg.Trackers, webSeeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Query()["tr"]) != 2 || u.Query().Get("ws") != "http://mirror.example.i2p/linux64/tor-browser-linux64-12.0.1_ALL.tar.xz" {
+		t.Errorf("Wrong trackers or web seeds in the magnet: %s", magnet)
+	}
+
+	err = i.postTorrent(filepath.Base(filePath), torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(posted) != string(torrent) {
+		t.Errorf("The tracker got a different torrent")
+	}
+
+	cfg.TrackerApi.Token = "wrong"
+	if err := i.postTorrent(filepath.Base(filePath), torrent); err == nil {
+		t.Errorf("No error when the tracker rejects the torrent")
+	}
+}
+
+func TestReleaseTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdsys-i2p-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binaryPath := filepath.Join(dir, "tor-browser-linux64-12.0.1_ALL.tar.xz")
+	sigPath := binaryPath + ".asc"
+	if err := ioutil.WriteFile(binaryPath, []byte(strings.Repeat("tor browser", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sigPath, []byte("signature"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &internal.I2P{
+		WebSeeds:         []string{"http://mirror.example.i2p/{platform}/"},
+		TorrentChecksums: true,
+	}
+	i := newI2PProvider(cfg)
+	version, _ := resources.Str2Version("12.0.1")
+	link := i.newRelease("linux64", version)(binaryPath, sigPath, "ALL")
+	if link == nil {
+		t.Fatal("No link for the release")
+	}
+	if link.Link != link.SigLink {
+		t.Errorf("The signature is not in the torrent of the binary: %s %s", link.Link, link.SigLink)
+	}
+	u, err := url.Parse(link.Link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("dn") != "tor-browser-linux64-12.0.1_ALL" || u.Query().Get("ws") != "http://mirror.example.i2p/linux64/" {
+		t.Errorf("Wrong magnet: %s", link.Link)
+	}
+
+	sums, err := ioutil.ReadFile(binaryPath + ".sha256sums.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sums), "  tor-browser-linux64-12.0.1_ALL.tar.xz.asc\n") {
+		t.Errorf("The signature is not in the checksums:\n%s", sums)
+	}
+
+	again := newI2PProvider(cfg).newRelease("linux64", version)(binaryPath, sigPath, "ALL")
+	if again == nil || again.Link != link.Link {
+		t.Errorf("The release torrent is not stable")
+	}
+
+	for name, expected := range map[string]string{
+		"torbrowser-install-12.0.1_ALL.exe":   "torbrowser-install-12.0.1_ALL",
+		"tor-expert-bundle-0.4.7.13.tar.gz":   "tor-expert-bundle-0.4.7.13",
+		"tor-0.4.7.13":                        "tor-0.4.7.13",
+		"Orbot-17.0.0-fullperm-arm64-v8a.apk": "Orbot-17.0.0-fullperm-arm64-v8a",
+	} {
+		if torrentName := releaseTorrentName(name); torrentName != expected {
+			t.Errorf("Wrong torrent name for %s: %s", name, torrentName)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const i2pSeederTimeout = time.Minute
+
+var SeederLoginError = errors.New("the torrent client rejected the username or password")
+
+// i2pSeeder seeds the torrents of the I2P provider with the Web API of a
+// qBittorrent client with I2P enabled, so the new releases have a seeder from
+// the start.
+type i2pSeeder struct {
+	cfg    *internal.I2PSeeder
+	client *http.Client
+}
+
+func newI2PSeeder(cfg *internal.I2PSeeder) *i2pSeeder {
+	// cookiejar.New never fails without options
+	jar, _ := cookiejar.New(nil)
+	return &i2pSeeder{
+		cfg:    cfg,
+		client: &http.Client{Jar: jar, Timeout: i2pSeederTimeout},
+	}
+}
+
+// seed copies the files of the torrent to the data dir, where the client reads
+// them, and adds the torrent to the client.
+func (s *i2pSeeder) seed(name string, files []resources.TorrentFile, torrent *i2pTorrent) error {
+	dir := filepath.Join(s.cfg.DataDir, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = copyFile(file.Path, filepath.Join(dir, file.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return s.add(torrent)
+}
+
+// add adds the torrent to the client, that checks the files in the data dir
+// and starts seeding them.  Adding a torrent the client already has is not an
+// error.
+func (s *i2pSeeder) add(torrent *i2pTorrent) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("torrents", torrent.InfoHash+".torrent")
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(torrent.Torrent)
+	if err != nil {
+		return err
+	}
+	err = writer.WriteField("savepath", s.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return s.post("/api/v2/torrents/add", writer.FormDataContentType(), body.Bytes())
+}
+
+// remove stops seeding the torrent and deletes its files.
+func (s *i2pSeeder) remove(name string, torrent *i2pTorrent) {
+	form := url.Values{"hashes": {torrent.InfoHash}, "deleteFiles": {"false"}}
+	err := s.post("/api/v2/torrents/delete", "application/x-www-form-urlencoded", []byte(form.Encode()))
+	if err != nil {
+		log.Println("[I2P] Couldn't stop seeding", name, ":", err)
+		return
+	}
+	err = os.RemoveAll(filepath.Join(s.cfg.DataDir, name))
+	if err != nil {
+		log.Println("[I2P] Couldn't delete the files of", name, ":", err)
+	}
+}
+
+// post sends a request to the API, logging in first if the client doesn't
+// know us or the session expired.
+func (s *i2pSeeder) post(endpoint string, contentType string, body []byte) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, s.apiURL(endpoint), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Referer", s.cfg.ApiUrl)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusForbidden && attempt == 0 {
+			err = s.login()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("the torrent client answered %s: %s", resp.Status, respBody)
+		}
+		return nil
+	}
+}
+
+func (s *i2pSeeder) login() error {
+	form := url.Values{"username": {s.cfg.Username}, "password": {s.cfg.Password}}
+	req, err := http.NewRequest(http.MethodPost, s.apiURL("/api/v2/auth/login"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", s.cfg.ApiUrl)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(respBody)) != "Ok." {
+		return SeederLoginError
+	}
+	return nil
+}
+
+func (s *i2pSeeder) apiURL(endpoint string) string {
+	return strings.TrimSuffix(s.cfg.ApiUrl, "/") + endpoint
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// fakeQBittorrent is the part of the Web API of qBittorrent used by the
+// seeder.
+type fakeQBittorrent struct {
+	sync.Mutex
+	added   map[string]bool
+	deleted []string
+}
+
+func (q *fakeQBittorrent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.Lock()
+	defer q.Unlock()
+
+	if r.URL.Path == "/api/v2/auth/login" {
+		if r.FormValue("username") != "admin" || r.FormValue("password") != "secret" {
+			w.Write([]byte("Fails."))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "SID", Value: "session", Path: "/"})
+		w.Write([]byte("Ok."))
+		return
+	}
+	if cookie, err := r.Cookie("SID"); err != nil || cookie.Value != "session" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/api/v2/torrents/add":
+		_, header, err := r.FormFile("torrents")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q.added[strings.TrimSuffix(header.Filename, ".torrent")] = true
+	case "/api/v2/torrents/delete":
+		q.deleted = append(q.deleted, r.FormValue("hashes"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+	w.Write([]byte("Ok."))
+}
+
+func (q *fakeQBittorrent) reset() {
+	q.Lock()
+	defer q.Unlock()
+	q.added = make(map[string]bool)
+	q.deleted = nil
+}
+
+func (q *fakeQBittorrent) hasTorrent(infoHash string) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.added[infoHash]
+}
+
+func writeRelease(t *testing.T, dir string, version string) (string, string) {
+	binaryPath := filepath.Join(dir, "tor-browser-linux64-"+version+"_ALL.tar.xz")
+	sigPath := binaryPath + ".asc"
+	if err := ioutil.WriteFile(binaryPath, []byte(strings.Repeat("tor browser "+version, 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sigPath, []byte("signature "+version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return binaryPath, sigPath
+}
+
+func TestI2PSeeder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdsys-i2p-seeder-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	qbittorrent := &fakeQBittorrent{}
+	qbittorrent.reset()
+	ts := httptest.NewServer(qbittorrent)
+	defer ts.Close()
+
+	cfg := &internal.I2P{
+		StorageDir: filepath.Join(dir, "storage"),
+		Seeder: internal.I2PSeeder{
+			ApiUrl:   ts.URL,
+			Username: "admin",
+			Password: "secret",
+			DataDir:  filepath.Join(dir, "seed"),
+		},
+	}
+	version, _ := resources.Str2Version("12.0.1")
+	binaryPath, sigPath := writeRelease(t, dir, "12.0.1")
+	link := newI2PProvider(cfg).newRelease("linux64", version)(binaryPath, sigPath, "ALL")
+	if link == nil {
+		t.Fatal("No link for the release")
+	}
+	infoHash := magnetInfoHash(link.Link)
+	if !qbittorrent.hasTorrent(infoHash) {
+		t.Errorf("The torrent %s was not added to the client", infoHash)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Seeder.DataDir, "tor-browser-linux64-12.0.1_ALL", "tor-browser-linux64-12.0.1_ALL.tar.xz.asc")); err != nil {
+		t.Errorf("The files were not copied to the data dir: %v", err)
+	}
+
+	// after a restart the provider knows the release and seeds it again
+	qbittorrent.reset()
+	i := newI2PProvider(cfg)
+	i.Lock()
+	cached, ok := i.cache["linux64"]
+	i.Unlock()
+	if !ok || cached.Link != link.Link {
+		t.Fatalf("The release was not loaded after a restart: %v", cached)
+	}
+	for start := time.Now(); !qbittorrent.hasTorrent(infoHash); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The stored torrent was not seeded after a restart")
+		}
+	}
+
+	newVersion, _ := resources.Str2Version("12.0.2")
+	binaryPath, sigPath = writeRelease(t, dir, "12.0.2")
+	if i.newRelease("linux64", newVersion)(binaryPath, sigPath, "ALL") == nil {
+		t.Fatal("No link for the new release")
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		qbittorrent.Lock()
+		deleted := len(qbittorrent.deleted) == 1 && qbittorrent.deleted[0] == infoHash
+		qbittorrent.Unlock()
+		if deleted {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The old release is still seeded")
+		}
+	}
+	i.Lock()
+	numTorrents := len(i.torrents)
+	torrent := i.torrents[releaseTorrentName(path.Base(binaryPath))]
+	i.Unlock()
+	if numTorrents != 1 || torrent == nil {
+		t.Errorf("The old torrent is still stored: %d torrents", numTorrents)
+	}
+
+	seeder := newI2PSeeder(&internal.I2PSeeder{ApiUrl: ts.URL, Username: "admin", Password: "wrong"})
+	if err := seeder.add(torrent); err != SeederLoginError {
+		t.Errorf("Wrong error with a wrong password: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	MirrorProtocolRsync = "rsync"
+	MirrorProtocolSFTP  = "sftp"
+
+	rsyncCommand = "rsync"
+	sftpCommand  = "sftp"
+	// rsyncMissingFileStatus is the exit status of rsync when the remote
+	// path doesn't exist
+	rsyncMissingFileStatus = 23
+	// sftpFailedStatus is the exit status of sftp when a command of the batch
+	// fails, it's 255 if it can't connect
+	sftpFailedStatus = 1
+)
+
+// commandFunc runs the command with the arguments and the input as stdin, and
+// returns its output.
+type commandFunc func(input string, args ...string) ([]byte, error)
+
+// mirrorTransfer copies the files to the destination of a mirror.  The dir are
+// relative to the destination.
+type mirrorTransfer interface {
+	exists(dir string) (bool, error)
+	upload(dir string, files ...string) error
+}
+
+// mirrorProvider pushes the releases to a server in a directory per platform
+// and version, like <platform>/<version>/<file>, and makes the links from a
+// URL template.  The version directory works as existence object.
+type mirrorProvider struct {
+	name        string
+	urlTemplate string
+	transfer    mirrorTransfer
+}
+
+func newMirrorProvider(cfg *internal.Mirror) (provider, error) {
+	if cfg.Name == "" || cfg.Destination == "" || cfg.URLTemplate == "" {
+		return nil, errors.New("the mirror needs a name, a destination and a url template")
+	}
+
+	var transfer mirrorTransfer
+	switch cfg.Protocol {
+	case MirrorProtocolRsync, "":
+		if _, err := exec.LookPath(rsyncCommand); err != nil {
+			return nil, err
+		}
+		transfer = &rsyncTransfer{destination: cfg.Destination, sshKey: cfg.SSHKey, run: runCommand(rsyncCommand)}
+	case MirrorProtocolSFTP:
+		if _, err := exec.LookPath(sftpCommand); err != nil {
+			return nil, err
+		}
+		host, dir, err := splitSFTPDestination(cfg.Destination)
+		if err != nil {
+			return nil, err
+		}
+		transfer = &sftpTransfer{host: host, dir: dir, sshKey: cfg.SSHKey, run: runCommand(sftpCommand)}
+	default:
+		return nil, fmt.Errorf("unknown mirror protocol %q", cfg.Protocol)
+	}
+
+	return &mirrorProvider{name: cfg.Name, urlTemplate: cfg.URLTemplate, transfer: transfer}, nil
+}
+
+func runCommand(name string) commandFunc {
+	return func(input string, args ...string) ([]byte, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = strings.NewReader(input)
+		return cmd.CombinedOutput()
+	}
+}
+
+func (m *mirrorProvider) needsUpdate(platform string, version resources.Version) bool {
+	exists, err := m.transfer.exists(path.Join(platform, version.String()))
+	if err != nil {
+		log.Printf("[%s] unable to check for update: %v", m.name, err)
+		return false
+	}
+	return !exists
+}
+
+func (m *mirrorProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		if err := m.transfer.upload(path.Join(platform, version.String()), binaryPath, sigPath); err != nil {
+			log.Printf("[%s] Unable to upload %s: %v", m.name, binaryPath, err)
+			return nil
+		}
+
+		link := resources.NewTBLink()
+		link.Link = m.link(platform, version, locale, path.Base(binaryPath))
+		link.SigLink = m.link(platform, version, locale, path.Base(sigPath))
+		link.Version = version
+		link.Provider = m.name
+		link.Platform = platform
+		link.Locale = locale
+		link.FileName = path.Base(binaryPath)
+		return link
+	}
+}
+
+// link fills the URL template of the mirror.
+func (m *mirrorProvider) link(platform string, version resources.Version, locale, fileName string) string {
+	return strings.NewReplacer(
+		"{platform}", platform,
+		"{version}", version.String(),
+		"{locale}", locale,
+		"{file}", fileName,
+	).Replace(m.urlTemplate)
+}
+
+func sshCommand(sshKey string) string {
+	ssh := "ssh -o BatchMode=yes"
+	if sshKey != "" {
+		ssh += " -i " + sshKey
+	}
+	return ssh
+}
+
+// commandError adds the output of the command to the error.
+func commandError(err error, output []byte) error {
+	return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+}
+
+// rsyncTransfer pushes the files with rsync, over ssh unless the destination
+// is an rsync:// URL.
+type rsyncTransfer struct {
+	destination string
+	sshKey      string
+	run         commandFunc
+}
+
+func (r *rsyncTransfer) args(args ...string) []string {
+	if strings.HasPrefix(r.destination, "rsync://") {
+		return args
+	}
+	return append([]string{"-e", sshCommand(r.sshKey)}, args...)
+}
+
+func (r *rsyncTransfer) remotePath(dir string) string {
+	return strings.TrimSuffix(r.destination, "/") + "/" + dir
+}
+
+func (r *rsyncTransfer) exists(dir string) (bool, error) {
+	output, err := r.run("", r.args("--list-only", r.remotePath(dir)+"/")...)
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rsyncMissingFileStatus {
+		return false, nil
+	}
+	return false, commandError(err, output)
+}
+
+// upload links the files into dir of a staging directory and rsyncs it, so
+// rsync creates the remote directories.
+func (r *rsyncTransfer) upload(dir string, files ...string) error {
+	stage, err := ioutil.TempDir("", "gettor-rsync-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	stageDir := filepath.Join(stage, filepath.FromSlash(dir))
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(absPath, filepath.Join(stageDir, filepath.Base(file))); err != nil {
+			return err
+		}
+	}
+
+	output, err := r.run("", r.args("--recursive", "--copy-links", "--times", stage+"/", r.remotePath(""))...)
+	if err != nil {
+		return commandError(err, output)
+	}
+	return nil
+}
+
+// sftpTransfer pushes the files with batches of sftp commands.
+type sftpTransfer struct {
+	host   string
+	dir    string
+	sshKey string
+	run    commandFunc
+}
+
+// splitSFTPDestination splits a destination like user@host:/var/www into the
+// host and the directory.
+func splitSFTPDestination(destination string) (string, string, error) {
+	parts := strings.SplitN(destination, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("the sftp destination %q is not like user@host:/path", destination)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (s *sftpTransfer) batch(commands []string) ([]byte, error) {
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if s.sshKey != "" {
+		args = append(args, "-i", s.sshKey)
+	}
+	return s.run(strings.Join(commands, "\n")+"\n", append(args, s.host)...)
+}
+
+func (s *sftpTransfer) remotePath(dir string) string {
+	return path.Join(s.dir, dir)
+}
+
+func (s *sftpTransfer) exists(dir string) (bool, error) {
+	output, err := s.batch([]string{"ls " + quoteSFTP(s.remotePath(dir))})
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == sftpFailedStatus {
+		return false, nil
+	}
+	return false, commandError(err, output)
+}
+
+func (s *sftpTransfer) upload(dir string, files ...string) error {
+	var commands []string
+	// mkdir of each level of dir, the '-' makes sftp ignore the errors if
+	// they already exist
+	remoteDir := s.dir
+	for _, elem := range strings.Split(dir, "/") {
+		remoteDir = path.Join(remoteDir, elem)
+		commands = append(commands, "-mkdir "+quoteSFTP(remoteDir))
+	}
+	for _, file := range files {
+		commands = append(commands, "put "+quoteSFTP(file)+" "+quoteSFTP(remoteDir+"/"))
+	}
+
+	output, err := s.batch(commands)
+	if err != nil {
+		return commandError(err, output)
+	}
+	return nil
+}
+
+func quoteSFTP(arg string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, c := range arg {
+		if c == '"' || c == '\\' {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteRune(c)
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestMirrorSFTP(t *testing.T) {
+	var batches []string
+	uploaded := false
+	sftp := func(input string, args ...string) ([]byte, error) {
+		assert.Equal(t, []string{"-b", "-", "-o", "BatchMode=yes", "-i", "/etc/gettor/id_ed25519", "gettor@mirror.example.org"}, args)
+		batches = append(batches, input)
+		if strings.HasPrefix(input, "ls ") && !uploaded {
+			return []byte("Can't ls: not found"), exec.Command("sh", "-c", "exit 1").Run()
+		}
+		uploaded = true
+		return nil, nil
+	}
+	host, dir, err := splitSFTPDestination("gettor@mirror.example.org:/var/www/gettor")
+	assert.NoError(t, err)
+	m := &mirrorProvider{
+		name:        "Example",
+		urlTemplate: "https://mirror.example.org/{platform}/{version}/{locale}/{file}",
+		transfer:    &sftpTransfer{host: host, dir: dir, sshKey: "/etc/gettor/id_ed25519", run: sftp},
+	}
+
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	assert.True(t, m.needsUpdate("win32", version))
+	link := m.newRelease("win32", version)("/tmp/torbrowser-install.exe", "/tmp/torbrowser-install.exe.asc", "es-ES")
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, "https://mirror.example.org/win32/12.0.1/es-ES/torbrowser-install.exe", link.Link)
+	assert.Equal(t, "https://mirror.example.org/win32/12.0.1/es-ES/torbrowser-install.exe.asc", link.SigLink)
+	assert.Equal(t, "Example", link.Provider)
+	assert.False(t, m.needsUpdate("win32", version))
+
+	assert.Equal(t, []string{
+		"ls \"/var/www/gettor/win32/12.0.1\"\n",
+		"-mkdir \"/var/www/gettor/win32\"\n" +
+			"-mkdir \"/var/www/gettor/win32/12.0.1\"\n" +
+			"put \"/tmp/torbrowser-install.exe\" \"/var/www/gettor/win32/12.0.1/\"\n" +
+			"put \"/tmp/torbrowser-install.exe.asc\" \"/var/www/gettor/win32/12.0.1/\"\n",
+		"ls \"/var/www/gettor/win32/12.0.1\"\n",
+	}, batches)
+}
+
+func TestMirrorRsyncDaemon(t *testing.T) {
+	var calls [][]string
+	rsync := func(input string, args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		return nil, nil
+	}
+	r := &rsyncTransfer{destination: "rsync://mirror.example.org/gettor/", run: rsync}
+	exists, err := r.exists("linux64/12.0.1")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"--list-only", "rsync://mirror.example.org/gettor/linux64/12.0.1/"}, calls[0])
+}
+
+func TestNewMirrorProvider(t *testing.T) {
+	for _, cfg := range []internal.Mirror{
+		{Destination: "gettor@mirror.example.org:/var/www", URLTemplate: "https://mirror.example.org/{file}"},
+		{Name: "Example", URLTemplate: "https://mirror.example.org/{file}"},
+		{Name: "Example", Destination: "gettor@mirror.example.org:/var/www"},
+		{Name: "Example", Protocol: "ftp", Destination: "mirror.example.org", URLTemplate: "https://mirror.example.org/{file}"},
+	} {
+		_, err := newMirrorProvider(&cfg)
+		assert.Error(t, err, cfg)
+	}
+	_, _, err := splitSFTPDestination("/var/www")
+	assert.Error(t, err)
+}
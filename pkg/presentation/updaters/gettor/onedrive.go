@@ -0,0 +1,240 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/microsoft"
+)
+
+const (
+	oneDriveAPIURL = "https://graph.microsoft.com/v1.0/me/drive/"
+	// oneDriveChunkSize is the size of the chunks of the upload sessions, it
+	// needs to be a multiple of 320KiB
+	oneDriveChunkSize = 60 * 320 << 10
+)
+
+var (
+	oneDriveScopes        = []string{"Files.ReadWrite", "offline_access"}
+	oneDriveNotFoundError = errors.New("the file doesn't exist in onedrive")
+)
+
+func newOneDriveProvider(cfg *internal.OneDrive) (provider, error) {
+	if cfg.ClientID == "" || cfg.RefreshToken == "" {
+		return nil, errors.New("the onedrive client id and refresh token are not configured")
+	}
+
+	ctx := context.Background()
+	config := &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     microsoft.AzureADEndpoint(cfg.Tenant),
+		Scopes:       oneDriveScopes,
+	}
+	return &oneDriveProvider{
+		client: config.Client(ctx, &oauth2.Token{RefreshToken: cfg.RefreshToken}),
+		cfg:    cfg,
+		apiURL: oneDriveAPIURL,
+	}, nil
+}
+
+type oneDriveProvider struct {
+	client *http.Client
+	cfg    *internal.OneDrive
+	apiURL string
+}
+
+type oneDriveItem struct {
+	ID string `json:"id"`
+}
+
+func (o *oneDriveProvider) needsUpdate(platform string, version resources.Version) bool {
+	err := o.call(http.MethodGet, o.itemURL(o.formatNameForExistenceObject(platform, version)), nil, nil)
+	if errors.Is(err, oneDriveNotFoundError) {
+		return true
+	}
+	if err != nil {
+		log.Println("[OneDrive] unable to check for update", err)
+	}
+	return false
+}
+
+func (o *oneDriveProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	existenceObject := o.formatNameForExistenceObject(platform, version)
+	if _, err := o.upload(existenceObject, bytes.NewReader([]byte{0x00}), 1); err != nil {
+		log.Println("[OneDrive] Unable to create existence object", err)
+		return nil
+	}
+
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		link := resources.NewTBLink()
+
+		var err error
+		link.Link, err = o.uploadFileAndGetLink(binaryPath)
+		if err != nil {
+			log.Println("[OneDrive] Unable to create link for binary", err)
+			return nil
+		}
+		link.SigLink, err = o.uploadFileAndGetLink(sigPath)
+		if err != nil {
+			log.Println("[OneDrive] Unable to create link for signature", err)
+			return nil
+		}
+
+		link.Version = version
+		link.Provider = "OneDrive"
+		link.Platform = platform
+		link.Locale = locale
+		link.FileName = path.Base(binaryPath)
+		return link
+	}
+}
+
+func (o *oneDriveProvider) uploadFileAndGetLink(filePath string) (string, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	item, err := o.upload(path.Base(filePath), fd, info.Size())
+	if err != nil {
+		return "", err
+	}
+	return o.sharedLink(item.ID)
+}
+
+// upload uploads the content of the reader with an upload session, as it
+// supports files of any size.
+func (o *oneDriveProvider) upload(fileName string, reader io.Reader, size int64) (*oneDriveItem, error) {
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	arg := map[string]interface{}{
+		"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"},
+	}
+	err := o.call(http.MethodPost, o.itemURL(fileName)+":/createUploadSession", arg, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	// the upload URL is already authenticated, the chunks are sent without
+	// the oauth token
+	var item oneDriveItem
+	var offset int64
+	chunk := make([]byte, oneDriveChunkSize)
+	for offset < size {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, session.UploadURL, bytes.NewReader(chunk[:n]))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size))
+		if err := o.do(http.DefaultClient, req, &item); err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+	}
+	return &item, nil
+}
+
+// sharedLink returns an anonymous link that downloads the item directly.
+func (o *oneDriveProvider) sharedLink(itemID string) (string, error) {
+	var permission struct {
+		Link struct {
+			WebURL string `json:"webUrl"`
+		} `json:"link"`
+	}
+	arg := map[string]string{"type": "view", "scope": "anonymous"}
+	err := o.call(http.MethodPost, o.apiURL+"items/"+url.PathEscape(itemID)+"/createLink", arg, &permission)
+	if err != nil {
+		return "", err
+	}
+	return directOneDriveLink(permission.Link.WebURL), nil
+}
+
+// directOneDriveLink changes the shared link to download the file instead of
+// showing the onedrive preview page.
+func directOneDriveLink(link string) string {
+	if strings.Contains(link, "?") {
+		return link + "&download=1"
+	}
+	return link + "?download=1"
+}
+
+// itemURL returns the URL of the file in the configured folder.
+func (o *oneDriveProvider) itemURL(fileName string) string {
+	itemPath := strings.TrimPrefix(path.Join("/", o.cfg.Folder, fileName), "/")
+	return o.apiURL + "root:/" + (&url.URL{Path: itemPath}).EscapedPath()
+}
+
+// call does a request to the graph API with arg as JSON body, if it's not
+// nil, and decodes the JSON response into result if it's not nil.
+func (o *oneDriveProvider) call(method, endpoint string, arg interface{}, result interface{}) error {
+	var body io.Reader
+	if arg != nil {
+		b, err := json.Marshal(arg)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if arg != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return o.do(o.client, req, result)
+}
+
+func (o *oneDriveProvider) do(client *http.Client, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return oneDriveNotFoundError
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("onedrive answered %s: %s", resp.Status, body)
+	}
+	if result == nil || resp.StatusCode == http.StatusAccepted {
+		// the intermediate chunks of an upload session answer with 202
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (o *oneDriveProvider) formatNameForExistenceObject(platform string, version resources.Version) string {
+	return fmt.Sprintf("%v-%v.exist-gettor", platform, version.String())
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// fakeOneDrive implements the parts of the graph API used by the provider,
+// the items are identified by their path.
+type fakeOneDrive struct {
+	url   string
+	files map[string][]byte
+}
+
+func (f *fakeOneDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const root = "/drive/root:/"
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/"):
+		name := strings.TrimPrefix(r.URL.Path, "/upload/")
+		body, _ := ioutil.ReadAll(r.Body)
+		f.files[name] = append(f.files[name], body...)
+		json.NewEncoder(w).Encode(map[string]string{"id": name})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":/createUploadSession"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, root), ":/createUploadSession")
+		f.files[name] = nil
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": f.url + "/upload/" + name})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/createLink"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/drive/items/"), "/createLink")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"link": map[string]string{"webUrl": "https://1drv.ms/u/" + id},
+		})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, root):
+		if _, ok := f.files[strings.TrimPrefix(r.URL.Path, root)]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": r.URL.Path})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestOneDrive(t *testing.T) {
+	fake := &fakeOneDrive{files: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.url = server.URL
+
+	o := &oneDriveProvider{
+		client: server.Client(),
+		cfg:    &internal.OneDrive{Folder: "gettor"},
+		apiURL: server.URL + "/drive/",
+	}
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	assert.True(t, o.needsUpdate("win32", version))
+
+	dir, err := ioutil.TempDir("", "gettor-onedrive-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binaryPath := path.Join(dir, "torbrowser-install.exe")
+	sigPath := binaryPath + ".asc"
+	assert.NoError(t, ioutil.WriteFile(binaryPath, []byte("binary"), 0644))
+	assert.NoError(t, ioutil.WriteFile(sigPath, []byte("signature"), 0644))
+
+	upload := o.newRelease("win32", version)
+	if !assert.NotNil(t, upload) {
+		return
+	}
+	link := upload(binaryPath, sigPath, "en-US")
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, "https://1drv.ms/u/gettor/torbrowser-install.exe?download=1", link.Link)
+	assert.Equal(t, "https://1drv.ms/u/gettor/torbrowser-install.exe.asc?download=1", link.SigLink)
+	assert.Equal(t, []byte("binary"), fake.files["gettor/torbrowser-install.exe"])
+	assert.False(t, o.needsUpdate("win32", version))
+	assert.True(t, o.needsUpdate("osx64", version))
+}
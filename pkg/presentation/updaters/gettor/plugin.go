@@ -0,0 +1,246 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	pluginMethodNeedsUpdate = "needs_update"
+	pluginMethodNewRelease  = "new_release"
+	pluginMethodUpload      = "upload"
+
+	defaultPluginTimeout = 10 * time.Minute
+	// maxPluginOutput is the maximum size of the response of a plugin
+	maxPluginOutput = 1 << 20
+)
+
+var (
+	PluginTimeoutError  = errors.New("the plugin didn't answer in time")
+	PluginResponseError = errors.New("the plugin answered an invalid response")
+)
+
+// pluginRequest is the JSON-RPC 2.0 request written to the stdin of the
+// plugin, there is one request per execution.
+type pluginRequest struct {
+	JSONRPC string       `json:"jsonrpc"`
+	ID      int          `json:"id"`
+	Method  string       `json:"method"`
+	Params  pluginParams `json:"params"`
+}
+
+type pluginParams struct {
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	Locale   string `json:"locale,omitempty"`
+	// Files are the absolute paths of the files to upload, indexed by
+	// "binary" and "signature"
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// pluginResponse is the JSON-RPC 2.0 response that the plugin writes to its
+// stdout.
+type pluginResponse struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Result  *pluginResult `json:"result"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type pluginResult struct {
+	NeedsUpdate bool   `json:"needs_update"`
+	Link        string `json:"link"`
+	SigLink     string `json:"sig_link"`
+}
+
+// pluginProvider is a provider implemented by an external program.  The
+// program is executed for every request with a JSON-RPC request in its stdin,
+// in an empty working directory, with a minimal environment and killed with
+// all its children if it doesn't answer before the timeout.
+type pluginProvider struct {
+	cfg     *internal.Plugin
+	timeout time.Duration
+}
+
+func newPluginProvider(cfg *internal.Plugin) (provider, error) {
+	if cfg.Name == "" || len(cfg.Command) == 0 {
+		return nil, errors.New("the plugin needs a name and a command")
+	}
+	if _, err := exec.LookPath(cfg.Command[0]); err != nil {
+		return nil, err
+	}
+	if err := checkSandbox(cfg); err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPluginTimeout
+	}
+	return &pluginProvider{cfg: cfg, timeout: timeout}, nil
+}
+
+func (p *pluginProvider) needsUpdate(platform string, version resources.Version) bool {
+	result, err := p.call(pluginMethodNeedsUpdate, pluginParams{Platform: platform, Version: version.String()})
+	if err != nil {
+		log.Printf("[%s] unable to check for update: %v", p.cfg.Name, err)
+		return false
+	}
+	return result.NeedsUpdate
+}
+
+func (p *pluginProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	_, err := p.call(pluginMethodNewRelease, pluginParams{Platform: platform, Version: version.String()})
+	if err != nil {
+		log.Printf("[%s] Unable to create the release: %v", p.cfg.Name, err)
+		return nil
+	}
+
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		files := make(map[string]string)
+		for name, filePath := range map[string]string{"binary": binaryPath, "signature": sigPath} {
+			absPath, err := filepath.Abs(filePath)
+			if err != nil {
+				log.Printf("[%s] Unable to upload %s: %v", p.cfg.Name, filePath, err)
+				return nil
+			}
+			files[name] = absPath
+		}
+
+		result, err := p.call(pluginMethodUpload, pluginParams{
+			Platform: platform,
+			Version:  version.String(),
+			Locale:   locale,
+			Files:    files,
+		})
+		if err != nil {
+			log.Printf("[%s] Unable to upload %s: %v", p.cfg.Name, binaryPath, err)
+			return nil
+		}
+		if result.Link == "" || result.SigLink == "" {
+			log.Printf("[%s] The plugin didn't return the links of %s", p.cfg.Name, binaryPath)
+			return nil
+		}
+
+		link := resources.NewTBLink()
+		link.Link = result.Link
+		link.SigLink = result.SigLink
+		link.Version = version
+		link.Provider = p.cfg.Name
+		link.Platform = platform
+		link.Locale = locale
+		link.FileName = path.Base(binaryPath)
+		return link
+	}
+}
+
+// call executes the plugin with the request and returns its result.
+func (p *pluginProvider) call(method string, params pluginParams) (*pluginResult, error) {
+	request, err := json.Marshal(pluginRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+
+	workDir, err := ioutil.TempDir("", "gettor-plugin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	var stdout, stderr limitedBuffer
+	stdout.limit = maxPluginOutput
+	stderr.limit = maxPluginOutput
+	cmd := exec.Command(p.cfg.Command[0], p.cfg.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Dir = workDir
+	cmd.Env = p.environment(workDir)
+	if err := sandbox(cmd, p.cfg, workDir); err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(p.timeout):
+		killProcessGroup(cmd)
+		<-done
+		return nil, PluginTimeoutError
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		log.Printf("[%s] %s", p.cfg.Name, msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("the plugin failed: %v", err)
+	}
+
+	var response pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, PluginResponseError)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("the plugin answered the error %d: %s", response.Error.Code, response.Error.Message)
+	}
+	if response.JSONRPC != "2.0" || response.ID != 1 || response.Result == nil {
+		return nil, PluginResponseError
+	}
+	return response.Result, nil
+}
+
+// environment returns the environment of the plugin, only the PATH of the
+// updater and the configured variables are passed to it.
+func (p *pluginProvider) environment(workDir string) []string {
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + workDir,
+		"TMPDIR=" + workDir,
+	}
+	for key, value := range p.cfg.Env {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+// limitedBuffer is a buffer that discards what is written after the limit,
+// so a plugin can't use all the memory of the updater.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
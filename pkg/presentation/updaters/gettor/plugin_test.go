@@ -0,0 +1,112 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// testPlugin answers the requests like a plugin that has the win32 release
+// uploaded, it saves the last request in request.json of the directory of the
+// script.
+const testPlugin = `#!/bin/sh
+dir=$(dirname "$0")
+request=$(cat)
+echo "$request" > "$dir/request.json"
+case "$request" in
+*'"needs_update"'*'"platform":"win32"'*)
+	echo '{"jsonrpc": "2.0", "id": 1, "result": {"needs_update": false}}' ;;
+*'"needs_update"'*)
+	echo '{"jsonrpc": "2.0", "id": 1, "result": {"needs_update": true}}' ;;
+*'"new_release"'*)
+	echo '{"jsonrpc": "2.0", "id": 1, "result": {}}' ;;
+*'"upload"'*)
+	echo "uploading as $HOME" >&2
+	echo '{"jsonrpc": "2.0", "id": 1, "result": {"link": "https://example.com/tb", "sig_link": "https://example.com/tb.asc"}}' ;;
+esac
+`
+
+func writePlugin(t *testing.T, dir, name, script string) string {
+	pluginPath := path.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(pluginPath, []byte(script), 0755))
+	return pluginPath
+}
+
+func TestPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gettor-plugin-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &internal.Plugin{
+		Name:    "Example",
+		Command: []string{writePlugin(t, dir, "plugin.sh", testPlugin)},
+		Env:     map[string]string{"EXAMPLE_TOKEN": "secret"},
+	}
+	p, err := newPluginProvider(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	assert.False(t, p.needsUpdate("win32", version))
+	assert.True(t, p.needsUpdate("linux64", version))
+
+	upload := p.newRelease("linux64", version)
+	if !assert.NotNil(t, upload) {
+		return
+	}
+	link := upload("tor-browser.tar.xz", "tor-browser.tar.xz.asc", "en-US")
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, "https://example.com/tb", link.Link)
+	assert.Equal(t, "https://example.com/tb.asc", link.SigLink)
+	assert.Equal(t, "Example", link.Provider)
+	assert.Equal(t, "tor-browser.tar.xz", link.FileName)
+
+	request, err := ioutil.ReadFile(path.Join(dir, "request.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(request), `"method":"upload"`)
+	assert.Contains(t, string(request), `"locale":"en-US"`)
+	assert.NotContains(t, string(request), `"binary":"tor-browser.tar.xz"`, "the paths should be absolute")
+}
+
+func TestPluginSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gettor-plugin-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the environment of the updater is not passed to the plugin
+	os.Setenv("GETTOR_TEST_SECRET", "secret")
+	defer os.Unsetenv("GETTOR_TEST_SECRET")
+	env := writePlugin(t, dir, "env.sh", `#!/bin/sh
+echo "{\"jsonrpc\": \"2.0\", \"id\": 1, \"result\": {\"needs_update\": $([ -z "$GETTOR_TEST_SECRET" ] && [ "$(pwd)" = "$HOME" ] && echo true || echo false)}}"
+`)
+	p := &pluginProvider{cfg: &internal.Plugin{Name: "env", Command: []string{env}}, timeout: defaultPluginTimeout}
+	assert.True(t, p.needsUpdate("win32", resources.Version{Mayor: 12}))
+
+	sleep := writePlugin(t, dir, "sleep.sh", "#!/bin/sh\nsleep 60 &\nsleep 60\n")
+	p = &pluginProvider{cfg: &internal.Plugin{Name: "sleep", Command: []string{sleep}}, timeout: 100 * time.Millisecond}
+	_, err = p.call(pluginMethodNeedsUpdate, pluginParams{Platform: "win32"})
+	assert.True(t, errors.Is(err, PluginTimeoutError), err)
+
+	invalid := writePlugin(t, dir, "invalid.sh", "#!/bin/sh\necho '{\"result\": {}}'\n")
+	p = &pluginProvider{cfg: &internal.Plugin{Name: "invalid", Command: []string{invalid}}, timeout: defaultPluginTimeout}
+	_, err = p.call(pluginMethodNeedsUpdate, pluginParams{Platform: "win32"})
+	assert.True(t, errors.Is(err, PluginResponseError), err)
+
+	failing := writePlugin(t, dir, "error.sh", "#!/bin/sh\necho '{\"jsonrpc\": \"2.0\", \"id\": 1, \"error\": {\"code\": 1, \"message\": \"quota exceeded\"}}'\n")
+	p = &pluginProvider{cfg: &internal.Plugin{Name: "error", Command: []string{failing}}, timeout: defaultPluginTimeout}
+	assert.Nil(t, p.newRelease("win32", resources.Version{Mayor: 12}))
+}
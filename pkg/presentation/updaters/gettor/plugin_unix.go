@@ -0,0 +1,58 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package gettor
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func checkSandbox(cfg *internal.Plugin) error {
+	if cfg.User == "" {
+		return nil
+	}
+	_, err := user.Lookup(cfg.User)
+	return err
+}
+
+// sandbox runs the plugin in its own process group, so it can be killed with
+// all its children, and as the configured user if there is one.
+func sandbox(cmd *exec.Cmd, cfg *internal.Plugin, workDir string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if cfg.User == "" {
+		return nil
+	}
+
+	u, err := user.Lookup(cfg.User)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(workDir, int(uid), int(gid)); err != nil {
+		return err
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	// the process group id is the pid of the plugin, as it's the leader
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"os/exec"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+func checkSandbox(cfg *internal.Plugin) error {
+	if cfg.User != "" {
+		return errors.New("running plugins as another user is not supported in windows")
+	}
+	return nil
+}
+
+func sandbox(cmd *exec.Cmd, cfg *internal.Plugin, workDir string) error {
+	return checkSandbox(cfg)
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
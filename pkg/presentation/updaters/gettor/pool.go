@@ -0,0 +1,135 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	defaultUploadWorkers       = 4
+	defaultProviderConcurrency = 2
+)
+
+// limitedProvider limits the number of files that are uploaded at the same
+// time to a provider.
+type limitedProvider struct {
+	provider
+	name  string
+	slots chan struct{}
+}
+
+// limitProvider wraps the provider to upload at most limits[name] files at the
+// same time, or defaultProviderConcurrency if there is no limit for it.
+func limitProvider(name string, p provider, limits map[string]int) provider {
+	limit, ok := limits[name]
+	if !ok || limit <= 0 {
+		limit = defaultProviderConcurrency
+	}
+	return &limitedProvider{provider: p, name: name, slots: make(chan struct{}, limit)}
+}
+
+func (l *limitedProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	fn := l.provider.newRelease(platform, version)
+	if fn == nil {
+		return nil
+	}
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		l.slots <- struct{}{}
+		defer func() { <-l.slots }()
+		return fn(binaryPath, sigPath, locale)
+	}
+}
+
+// needsUpdateRefreshOnly keeps the refresh only check of the wrapped provider,
+// the providers without it always need the files.
+func (l *limitedProvider) needsUpdateRefreshOnly(platform string, version resources.Version) bool {
+	if refreshOnly, ok := l.provider.(providerExtRefreshLink); ok {
+		return refreshOnly.needsUpdateRefreshOnly(platform, version)
+	}
+	return false
+}
+
+// removedReleases returns the releases deleted by the wrapped provider, if it
+// deletes them.
+func (l *limitedProvider) removedReleases() []removedRelease {
+	if r, ok := l.provider.(providerExtRemovedReleases); ok {
+		return r.removedReleases()
+	}
+	return nil
+}
+
+// providerName returns the name of the provider, if it has one.
+func providerName(p provider) string {
+	if l, ok := p.(*limitedProvider); ok {
+		return l.name
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+// uploadJob is the upload of the files of a locale to a provider
+type uploadJob struct {
+	locale   string
+	asset    asset
+	provider string
+	upload   uploadFileFunc
+}
+
+// uploadErrors counts the failed uploads per provider
+type uploadErrors map[string]int
+
+func (e uploadErrors) String() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failures []string
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s %d", name, e[name]))
+	}
+	return strings.Join(failures, ", ")
+}
+
+// uploadAll runs the jobs with the given number of workers and returns the
+// links of the jobs, nil for the failed ones, in the same order.
+func uploadAll(jobs []uploadJob, workers int) ([]*resources.TBLink, uploadErrors) {
+	if workers <= 0 {
+		workers = defaultUploadWorkers
+	}
+
+	links := make([]*resources.TBLink, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				job := jobs[i]
+				links[i] = job.upload(job.asset.binaryPath, job.asset.sigPath, job.locale)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	errs := make(uploadErrors)
+	for i, link := range links {
+		if link == nil {
+			errs[jobs[i].provider]++
+		}
+	}
+	return links, errs
+}
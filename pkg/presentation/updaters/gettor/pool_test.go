@@ -0,0 +1,109 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// fakeProvider records how many uploads run at the same time and fails the
+// uploads of the locales in fail.
+type fakeProvider struct {
+	sync.Mutex
+	running    int
+	maxRunning int
+	fail       map[string]bool
+}
+
+func (f *fakeProvider) needsUpdate(platform string, version resources.Version) bool {
+	return true
+}
+
+func (f *fakeProvider) newRelease(platform string, version resources.Version) uploadFileFunc {
+	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
+		f.Lock()
+		f.running++
+		if f.running > f.maxRunning {
+			f.maxRunning = f.running
+		}
+		f.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		f.Lock()
+		f.running--
+		f.Unlock()
+		if f.fail[locale] {
+			return nil
+		}
+		link := resources.NewTBLink()
+		link.Link = binaryPath
+		link.Locale = locale
+		return link
+	}
+}
+
+type refreshProvider struct {
+	fakeProvider
+}
+
+func (r *refreshProvider) needsUpdateRefreshOnly(platform string, version resources.Version) bool {
+	return true
+}
+
+func TestUploadAll(t *testing.T) {
+	slow := &fakeProvider{fail: map[string]bool{"es-ES": true}}
+	fast := &fakeProvider{}
+	providers := []provider{
+		limitProvider("slow", slow, map[string]int{"slow": 1, "fast": 3}),
+		limitProvider("fast", fast, map[string]int{"slow": 1, "fast": 3}),
+	}
+
+	var jobs []uploadJob
+	for _, locale := range []string{"en-US", "es-ES", "ru", "fa", "ar", "de"} {
+		for _, p := range providers {
+			jobs = append(jobs, uploadJob{
+				locale:   locale,
+				asset:    asset{binaryPath: locale + ".exe"},
+				provider: providerName(p),
+				upload:   p.newRelease("win32", resources.Version{Mayor: 12}),
+			})
+		}
+	}
+	links, errs := uploadAll(jobs, 4)
+
+	assert.Len(t, links, len(jobs))
+	for i, link := range links {
+		if jobs[i].provider == "slow" && jobs[i].locale == "es-ES" {
+			assert.Nil(t, link)
+			continue
+		}
+		if assert.NotNil(t, link) {
+			assert.Equal(t, jobs[i].locale, link.Locale)
+			assert.Equal(t, jobs[i].asset.binaryPath, link.Link)
+		}
+	}
+	assert.Equal(t, uploadErrors{"slow": 1}, errs)
+	assert.Equal(t, "slow 1", errs.String())
+	assert.Equal(t, 1, slow.maxRunning)
+	assert.True(t, fast.maxRunning > 1 && fast.maxRunning <= 3, fast.maxRunning)
+}
+
+func TestLimitedProviderRefreshOnly(t *testing.T) {
+	p := limitProvider("s3", &refreshProvider{}, nil)
+	refreshOnly, ok := p.(providerExtRefreshLink)
+	assert.True(t, ok)
+	assert.True(t, refreshOnly.needsUpdateRefreshOnly("win32", resources.Version{Mayor: 12}))
+
+	p = limitProvider("github", &fakeProvider{}, nil)
+	refreshOnly = p.(providerExtRefreshLink)
+	assert.False(t, refreshOnly.needsUpdateRefreshOnly("win32", resources.Version{Mayor: 12}))
+	assert.Equal(t, "github", providerName(p))
+}
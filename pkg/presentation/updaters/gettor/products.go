@@ -0,0 +1,99 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+var MissingSigningKeyError = errors.New("the product has a keyring but not the fingerprint of its signing key")
+
+// feed is a release json that the updater watches, of a release channel of
+// Tor Browser or of another product.
+type feed struct {
+	// product is empty for Tor Browser
+	product  string
+	channel  string
+	url      string
+	verifier *signatureVerifier
+}
+
+// name returns how the feed is called in the logs.
+func (f feed) name() string {
+	if f.product != "" {
+		return f.product
+	}
+	return "the " + f.channel + " channel"
+}
+
+// channelFeeds returns the feeds of the Tor Browser channels.
+func channelFeeds(channels map[string]string, verifier *signatureVerifier) []feed {
+	var feeds []feed
+	for channel, url := range channelURLs(channels) {
+		feeds = append(feeds, feed{channel: channel, url: url, verifier: verifier})
+	}
+	return feeds
+}
+
+// productFeeds returns the feeds of the products.  Their binaries are verified
+// with the Tor Browser signing key, like the ones of the Tor Expert Bundle,
+// unless the product has its own.
+func productFeeds(products map[string]internal.GettorProduct, verifier *signatureVerifier) []feed {
+	var feeds []feed
+	for product, cfg := range products {
+		if _, ok := resources.ProductNames[product]; !ok || product == resources.ProductTorBrowser {
+			log.Printf("Unknown product %s, it will not be updated", product)
+			continue
+		}
+		if cfg.URL == "" {
+			log.Printf("No release json URL for %s, it will not be updated", product)
+			continue
+		}
+		v, err := newProductVerifier(cfg, verifier)
+		if err != nil {
+			log.Printf("Can't verify the signatures of %s, it will not be updated: %v", product, err)
+			continue
+		}
+		feeds = append(feeds, feed{product: product, channel: resources.ChannelRelease, url: cfg.URL, verifier: v})
+	}
+	return feeds
+}
+
+// newProductVerifier returns a verifier for the signing key of the product, or
+// verifier if the product doesn't have one.
+func newProductVerifier(cfg internal.GettorProduct, verifier *signatureVerifier) (*signatureVerifier, error) {
+	if cfg.Keyring == "" && cfg.SigningKey == "" {
+		return verifier, nil
+	}
+	if cfg.SigningKey == "" {
+		return nil, MissingSigningKeyError
+	}
+
+	keyring := cfg.Keyring
+	if keyring == "" {
+		keyring = verifier.keyring
+	}
+	v, err := newSignatureVerifier(keyring)
+	if err != nil {
+		return nil, err
+	}
+	v.fingerprint = strings.Replace(cfg.SigningKey, " ", "", -1)
+	return v, nil
+}
+
+// productPlatform returns the platform with the product as prefix if it's not
+// Tor Browser, like "orbot-android-aarch64", so the releases of each product
+// are kept apart in the providers.
+func productPlatform(product, platform string) string {
+	if product == "" {
+		return platform
+	}
+	return product + "-" + platform
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/updaters/gettor"
+)
+
+// removedRelease is a release that a provider deleted
+type removedRelease struct {
+	// provider is the provider of the links of the release
+	provider string
+	// platform is the platform of the provider, with the channel prefix
+	platform string
+	version  resources.Version
+}
+
+// providerExtRemovedReleases is implemented by the providers that delete old
+// releases.
+type providerExtRemovedReleases interface {
+	// removedReleases returns the releases deleted since the last call
+	removedReleases() []removedRelease
+}
+
+// releaseRemovals records the releases that a provider deletes.
+type releaseRemovals struct {
+	lock    sync.Mutex
+	removed []removedRelease
+}
+
+func newReleaseRemovals() *releaseRemovals {
+	return &releaseRemovals{}
+}
+
+func (r *releaseRemovals) add(provider, platform string, version resources.Version) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.removed = append(r.removed, removedRelease{provider: provider, platform: platform, version: version})
+}
+
+// addAll records releases that were already removed, like the ones that we
+// failed to remove from the backend.
+func (r *releaseRemovals) addAll(removed []removedRelease) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.removed = append(r.removed, removed...)
+}
+
+func (r *releaseRemovals) removedReleases() []removedRelease {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	removed := r.removed
+	r.removed = nil
+	return removed
+}
+
+// collectRemovedReleases returns the releases that the providers deleted.
+func collectRemovedReleases(providers []provider) []removedRelease {
+	var removed []removedRelease
+	for _, p := range providers {
+		if r, ok := p.(providerExtRemovedReleases); ok {
+			removed = append(removed, r.removedReleases()...)
+		}
+	}
+	return removed
+}
+
+// linkPlatform returns the platform of the link as the providers name it,
+// like "alpha-android-aarch64" or "orbot-android-aarch64".
+func linkPlatform(link *resources.TBLink) string {
+	platform, arch := link.PlatformArch()
+	if arch != "" {
+		platform += "-" + arch
+	}
+	return providerPlatform(productPlatform(link.Product, platform), link.ReleaseChannel())
+}
+
+// removedLinks returns the links of the removed releases.
+func removedLinks(links []*resources.TBLink, removed []removedRelease) []*resources.TBLink {
+	var gone []*resources.TBLink
+	for _, link := range links {
+		for _, r := range removed {
+			if link.Provider == r.provider && linkPlatform(link) == r.platform && link.Version.Compare(r.version) == 0 {
+				gone = append(gone, link)
+				break
+			}
+		}
+	}
+	return gone
+}
+
+// removeLinks tells the backend to remove the links of the pending releases
+// that the providers deleted.  If the backend fails they are kept in pending
+// to retry.
+func removeLinks(updater *gettor.GettorUpdater, pending *releaseRemovals) {
+	removed := pending.removedReleases()
+	if len(removed) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	links, err := updater.GetLinks(ctx)
+	if err != nil {
+		log.Println("Error getting the links from the backend:", err)
+		pending.addAll(removed)
+		return
+	}
+	gone := removedLinks(links, removed)
+	if len(gone) != 0 {
+		if err := updater.RemoveLinks(ctx, gone); err != nil {
+			log.Println("Error removing links from the backend:", err)
+			pending.addAll(removed)
+			return
+		}
+		log.Println("Removed", len(gone), "links of deleted releases from the backend")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestRemovedLinks(t *testing.T) {
+	newLink := func(provider, platform, arch, channel string, version resources.Version) *resources.TBLink {
+		link := resources.NewTBLink()
+		link.Provider = provider
+		link.Platform = platform
+		link.Arch = arch
+		link.Channel = channel
+		link.Version = version
+		link.Link = provider + platform + arch + channel + version.String()
+		return link
+	}
+	old := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	current := resources.Version{Mayor: 12, Minor: 0, Patch: 2}
+	links := []*resources.TBLink{
+		newLink("Google Drive", "win32", "", "", old),
+		newLink("Google Drive", "win32", "", "", current),
+		newLink("Google Drive", "win32", "", resources.ChannelAlpha, old),
+		newLink("github", "win32", "", "", old),
+		newLink("github", "android", "aarch64", "", old),
+	}
+
+	removals := newReleaseRemovals()
+	removals.add("Google Drive", "win32", old)
+	removals.add("github", "android-aarch64", old)
+	p := limitProvider("gdrive", &struct {
+		fakeProvider
+		*releaseRemovals
+	}{releaseRemovals: removals}, nil)
+	removed := collectRemovedReleases([]provider{p})
+	assert.Len(t, removed, 2)
+	assert.Len(t, collectRemovedReleases([]provider{p}), 0, "the removed releases should be returned once")
+
+	assert.Equal(t, []*resources.TBLink{links[0], links[4]}, removedLinks(links, removed))
+	assert.Equal(t, "alpha-win32", linkPlatform(links[2]))
+}
@@ -10,15 +10,19 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"log"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
@@ -26,13 +30,32 @@ import (
 
 func newS3Updater(cfg *internal.S3Updater) (provider, error) {
 	s3Client := constructS3ClientFromConfig(*cfg)
-	return s3updater{config: cfg, s3: s3Client, ctx: context.Background()}, nil
+	return s3updater{
+		config:          cfg,
+		s3:              s3Client,
+		ctx:             context.Background(),
+		releasesLock:    &sync.Mutex{},
+		releaseRemovals: newReleaseRemovals(),
+	}, nil
 }
 
 type s3updater struct {
 	config *internal.S3Updater
 	s3     *s3.Client
 	ctx    context.Context
+	// releasesLock protects the releases object, that is updated by the
+	// uploads of all the locales
+	releasesLock *sync.Mutex
+	*releaseRemovals
+}
+
+// s3Releases are the objects uploaded for each version of a platform, they
+// are kept in an object to delete the old versions.
+type s3Releases map[string][]s3ReleaseObject
+
+type s3ReleaseObject struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
 }
 
 func (s s3updater) needsUpdate(platform string, version resources.Version) bool {
@@ -55,6 +78,12 @@ func (s s3updater) newRelease(platform string, version resources.Version) upload
 		log.Println("[S3] Unable to create existence object", err)
 		return nil
 	}
+	if !updateLinkOnly && s.config.KeepVersions > 0 {
+		s.recordObject(platform, version, existenceObject)
+		if err := s.pruneReleases(platform, version); err != nil {
+			log.Println("[S3] Unable to delete the old releases", err)
+		}
+	}
 
 	return func(binaryPath string, sigPath string, locale string) *resources.TBLink {
 		link := resources.NewTBLink()
@@ -76,6 +105,9 @@ func (s s3updater) newRelease(platform string, version resources.Version) upload
 					log.Println("[S3] Unable to upload file ", err)
 					return nil
 				}
+				if s.config.KeepVersions > 0 {
+					s.recordObject(platform, version, objectName)
+				}
 			}
 			downloadLink, err := s.createLink(objectName)
 			if err != nil {
@@ -198,6 +230,107 @@ func (s s3updater) formatNameForFile(platform string, version resources.Version,
 		bucket: bucketName}
 }
 
+func (s s3updater) formatNameForReleasesObject(platform string) s3Object {
+	bucketName := s.createProcedurallyGeneratedName(
+		fmt.Sprintf("%v,%v,%v", platform, "tor-s3-releases", s.config.Name))
+	if s.config.Bucket != "" {
+		bucketName = s.config.Bucket
+	}
+	return s3Object{name: fmt.Sprintf("%v.releases-gettor", platform),
+		bucket: bucketName}
+}
+
+// recordObject adds the object to the releases of the platform.
+func (s s3updater) recordObject(platform string, version resources.Version, obj s3Object) {
+	s.releasesLock.Lock()
+	defer s.releasesLock.Unlock()
+
+	releases, err := s.readReleases(platform)
+	if err != nil {
+		log.Println("[S3] Unable to read the releases of", platform, err)
+		return
+	}
+	object := s3ReleaseObject{Bucket: obj.bucket, Name: obj.name}
+	for _, o := range releases[version.String()] {
+		if o == object {
+			return
+		}
+	}
+	releases[version.String()] = append(releases[version.String()], object)
+	if err := s.writeReleases(platform, releases); err != nil {
+		log.Println("[S3] Unable to write the releases of", platform, err)
+	}
+}
+
+// pruneReleases deletes the objects of the platform that are not in the
+// KeepVersions newest versions.  Only the objects uploaded while KeepVersions
+// is set are in the releases of the platform.
+func (s s3updater) pruneReleases(platform string, version resources.Version) error {
+	s.releasesLock.Lock()
+	defer s.releasesLock.Unlock()
+
+	releases, err := s.readReleases(platform)
+	if err != nil {
+		return err
+	}
+	var versions []string
+	for v := range releases {
+		versions = append(versions, v)
+	}
+	stale := staleVersions(versions, version, s.config.KeepVersions)
+	if len(stale) == 0 {
+		return nil
+	}
+
+	for _, v := range stale {
+		// the objects that fail to be deleted are kept to try again
+		var failed []s3ReleaseObject
+		for _, o := range releases[v] {
+			_, err := s.s3.DeleteObject(s.ctx, &s3.DeleteObjectInput{Bucket: &o.Bucket, Key: &o.Name})
+			if err != nil {
+				log.Println("[S3] Unable to delete", o.Name, err)
+				failed = append(failed, o)
+			}
+		}
+		if len(failed) == 0 {
+			delete(releases, v)
+			log.Println("[S3] Deleted the release", platform, v)
+			if staleVersion, err := resources.Str2Version(v); err == nil {
+				s.add(s.config.Name, platform, staleVersion)
+			}
+		} else {
+			releases[v] = failed
+		}
+	}
+	return s.writeReleases(platform, releases)
+}
+
+func (s s3updater) readReleases(platform string) (s3Releases, error) {
+	obj := s.formatNameForReleasesObject(platform)
+	output, err := s.s3.GetObject(s.ctx, &s3.GetObjectInput{Bucket: &obj.bucket, Key: &obj.name})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		var noSuchBucket *types.NoSuchBucket
+		if errors.As(err, &noSuchKey) || errors.As(err, &noSuchBucket) {
+			return make(s3Releases), nil
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	releases := make(s3Releases)
+	err = json.NewDecoder(output.Body).Decode(&releases)
+	return releases, err
+}
+
+func (s s3updater) writeReleases(platform string, releases s3Releases) error {
+	content, err := json.Marshal(releases)
+	if err != nil {
+		return err
+	}
+	return s.createObject(s.formatNameForReleasesObject(platform), bytes.NewReader(content))
+}
+
 func (s s3updater) createProcedurallyGeneratedName(input string) string {
 	nameHmac := hmac.New(func() hash.Hash {
 		return sha256.New()
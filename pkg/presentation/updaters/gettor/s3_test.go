@@ -9,9 +9,13 @@ import (
 	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -350,3 +354,87 @@ func TestStandardS3(t *testing.T) {
 		})
 	}
 }
+
+// fakeS3 is an S3 server that keeps the objects in memory
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(key, "/") {
+		// the bucket operations always succeed
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		content, _ := io.ReadAll(r.Body)
+		f.objects[key] = content
+	case http.MethodGet, http.MethodHead:
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Write(content)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Retention(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	s3Updater, _ := newS3Updater(&internal.S3Updater{
+		AccessKey:     "key",
+		AccessSecret:  "secret",
+		SigningMethod: "v4",
+		EndpointUrl:   ts.URL,
+		Name:          "testing",
+		Bucket:        "gettor",
+		KeepVersions:  2,
+	})
+
+	tmpDir, err := os.MkdirTemp("", "gettor-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, v := range []string{"12.0.1", "12.0.2", "12.0.3"} {
+		version, _ := resources.Str2Version(v)
+		binaryPath := path.Join(tmpDir, "tor-browser-linux64-"+v+"_ALL.tar.xz")
+		sigPath := binaryPath + ".asc"
+		assert.NoError(t, os.WriteFile(binaryPath, []byte(v), 0644))
+		assert.NoError(t, os.WriteFile(sigPath, []byte(v), 0644))
+
+		upload := s3Updater.newRelease("linux64", version)
+		if !assert.NotNil(t, upload) {
+			return
+		}
+		assert.NotNil(t, upload(binaryPath, sigPath, "ALL"))
+	}
+
+	var names []string
+	for key := range fake.objects {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		"gettor/linux64-12.0.2.exist-gettor",
+		"gettor/linux64-12.0.3.exist-gettor",
+		"gettor/linux64.releases-gettor",
+		"gettor/tor-browser-linux64-12.0.2_ALL.tar.xz",
+		"gettor/tor-browser-linux64-12.0.2_ALL.tar.xz.asc",
+		"gettor/tor-browser-linux64-12.0.3_ALL.tar.xz",
+		"gettor/tor-browser-linux64-12.0.3_ALL.tar.xz.asc",
+	}, names)
+	removed := s3Updater.(s3updater).removedReleases()
+	assert.Equal(t, []removedRelease{{provider: "testing", platform: "linux64", version: resources.Version{Mayor: 12, Minor: 0, Patch: 1}}}, removed)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"os/exec"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+)
+
+const (
+	sourceforgeHost = "frs.sourceforge.net"
+	// sourceforgeDownloadURL redirects to the closest sourceforge mirror
+	sourceforgeDownloadURL = "https://downloads.sourceforge.net/project/"
+)
+
+// newSourceforgeProvider returns a mirror provider that uploads the releases
+// to the file storage of a sourceforge project with rsync over ssh.
+func newSourceforgeProvider(cfg *internal.Sourceforge) (provider, error) {
+	if cfg.User == "" || cfg.Project == "" {
+		return nil, errors.New("the sourceforge user and project are not configured")
+	}
+	if _, err := exec.LookPath(rsyncCommand); err != nil {
+		return nil, err
+	}
+	return sourceforgeMirror(cfg, runCommand(rsyncCommand)), nil
+}
+
+func sourceforgeMirror(cfg *internal.Sourceforge, run commandFunc) *mirrorProvider {
+	host := cfg.Host
+	if host == "" {
+		host = sourceforgeHost
+	}
+	return &mirrorProvider{
+		name:        "Sourceforge",
+		urlTemplate: sourceforgeDownloadURL + cfg.Project + "/{platform}/{version}/{file}",
+		transfer: &rsyncTransfer{
+			destination: cfg.User + "@" + host + ":/home/frs/project/" + cfg.Project,
+			sshKey:      cfg.SSHKey,
+			run:         run,
+		},
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestSourceforge(t *testing.T) {
+	const remote = "gettor@frs.sourceforge.net:/home/frs/project/torbrowser"
+	files := make(map[string][]byte)
+	rsync := func(input string, args ...string) ([]byte, error) {
+		assert.Equal(t, []string{"-e", "ssh -o BatchMode=yes -i /etc/gettor/id_ed25519"}, args[:2])
+		dst := strings.TrimPrefix(args[len(args)-1], remote)
+		if args[2] == "--list-only" {
+			for name := range files {
+				if strings.HasPrefix(name, dst) {
+					return nil, nil
+				}
+			}
+			return []byte("No such file or directory"), exec.Command("sh", "-c", "exit 23").Run()
+		}
+
+		src := args[len(args)-2]
+		return nil, filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := ioutil.ReadFile(filePath)
+			files[dst+strings.TrimPrefix(filePath, src)] = content
+			return err
+		})
+	}
+	s := sourceforgeMirror(&internal.Sourceforge{
+		User:    "gettor",
+		Project: "torbrowser",
+		SSHKey:  "/etc/gettor/id_ed25519",
+	}, rsync)
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	assert.True(t, s.needsUpdate("linux64", version))
+
+	dir, err := ioutil.TempDir("", "gettor-sourceforge-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binaryPath := path.Join(dir, "tor-browser.tar.xz")
+	sigPath := binaryPath + ".asc"
+	assert.NoError(t, ioutil.WriteFile(binaryPath, []byte("binary"), 0644))
+	assert.NoError(t, ioutil.WriteFile(sigPath, []byte("signature"), 0644))
+
+	link := s.newRelease("linux64", version)(binaryPath, sigPath, "en-US")
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, "https://downloads.sourceforge.net/project/torbrowser/linux64/12.0.1/tor-browser.tar.xz", link.Link)
+	assert.Equal(t, "https://downloads.sourceforge.net/project/torbrowser/linux64/12.0.1/tor-browser.tar.xz.asc", link.SigLink)
+	assert.Equal(t, []byte("binary"), files["/linux64/12.0.1/tor-browser.tar.xz"])
+	assert.Equal(t, []byte("signature"), files["/linux64/12.0.1/tor-browser.tar.xz.asc"])
+	assert.False(t, s.needsUpdate("linux64", version))
+	assert.True(t, s.needsUpdate("win32", version))
+}
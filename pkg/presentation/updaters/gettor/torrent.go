@@ -0,0 +1,85 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+// addMagnets makes a magnet link of each uploaded binary and adds it to the
+// links of the binary of all the providers.  links are the results of the jobs
+// of uploadAll, the HTTP links between them are web seeds of the torrent
+// together with the configured ones.
+func addMagnets(cfg *internal.Torrent, links []*resources.TBLink, jobs []uploadJob, platform string, version resources.Version) {
+	binaries := make(map[string][]*resources.TBLink)
+	var order []string
+	for i, link := range links {
+		if link == nil {
+			continue
+		}
+		binaryPath := jobs[i].asset.binaryPath
+		if _, ok := binaries[binaryPath]; !ok {
+			order = append(order, binaryPath)
+		}
+		binaries[binaryPath] = append(binaries[binaryPath], link)
+	}
+
+	for _, binaryPath := range order {
+		if _, err := os.Stat(binaryPath); err != nil {
+			log.Printf("Can't make a magnet link of %s: %v", binaryPath, err)
+			continue
+		}
+		magnet, err := resources.GenerateMagnet(binaryPath, cfg.Trackers, webSeeds(cfg, binaries[binaryPath], platform, version, path.Base(binaryPath)))
+		if err != nil {
+			log.Printf("Can't make a magnet link of %s: %v", binaryPath, err)
+			continue
+		}
+		for _, link := range binaries[binaryPath] {
+			link.Magnet = magnet
+		}
+	}
+}
+
+// webSeeds returns the configured web seeds of the file and the HTTP links to
+// it of the providers.  The links that don't end in the file name, like the
+// share pages of some providers, are not web seeds.
+func webSeeds(cfg *internal.Torrent, links []*resources.TBLink, platform string, version resources.Version, fileName string) []string {
+	seeds := expandWebSeeds(cfg.WebSeeds, platform, version, fileName)
+	for _, link := range links {
+		if isFileURL(link.Link, fileName) {
+			seeds = append(seeds, link.Link)
+		}
+	}
+	return seeds
+}
+
+// expandWebSeeds replaces {platform}, {version} and {file} in the web seeds.
+func expandWebSeeds(templates []string, platform string, version resources.Version, fileName string) []string {
+	replacer := strings.NewReplacer(
+		"{platform}", platform,
+		"{version}", version.String(),
+		"{file}", fileName,
+	)
+	var seeds []string
+	for _, seed := range templates {
+		seeds = append(seeds, replacer.Replace(seed))
+	}
+	return seeds
+}
+
+func isFileURL(link, fileName string) bool {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	return path.Base(u.Path) == fileName
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// torBrowserSigningKey is the fingerprint of the primary key of the Tor
+	// Browser Developers, the releases are signed by one of its subkeys.
+	torBrowserSigningKey = "EF6E286DDA85EA2A4BA7DE684E2C6E8793298290"
+
+	gpgvCommand  = "gpgv"
+	statusPrefix = "[GNUPG:] "
+)
+
+var (
+	SignatureVerificationError = errors.New("the signature is not valid")
+	MissingKeyringError        = errors.New("the keyring with the Tor Browser signing key is not configured")
+)
+
+// signatureVerifier verifies the Tor Browser binaries with gpgv against the
+// signing key of the Tor Browser Developers in the keyring.
+type signatureVerifier struct {
+	keyring     string
+	fingerprint string
+}
+
+func newSignatureVerifier(keyring string) (*signatureVerifier, error) {
+	if keyring == "" {
+		return nil, MissingKeyringError
+	}
+	if _, err := os.Stat(keyring); err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(gpgvCommand); err != nil {
+		return nil, err
+	}
+	return &signatureVerifier{
+		keyring:     keyring,
+		fingerprint: torBrowserSigningKey,
+	}, nil
+}
+
+// verify returns an error wrapping SignatureVerificationError unless the
+// signature is a good signature of the binary made by the pinned key.
+func (v *signatureVerifier) verify(binaryPath, sigPath string) error {
+	var status bytes.Buffer
+	cmd := exec.Command(gpgvCommand, "--status-fd", "1", "--keyring", v.keyring, sigPath, binaryPath)
+	cmd.Stdout = &status
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gpgv failed for %s (%v): %w", binaryPath, err, SignatureVerificationError)
+	}
+	return checkValidSig(status.Bytes(), v.fingerprint)
+}
+
+// checkValidSig looks in the gpgv status output for a valid signature made by
+// the key with the given fingerprint, or by one of its subkeys.  The format of
+// the VALIDSIG line is described in doc/DETAILS of GnuPG:
+//
+//	VALIDSIG <fpr> <date> <timestamp> <expire> <version> <reserved> <algo> <hash> <class> [<primary-fpr>]
+func checkValidSig(status []byte, fingerprint string) error {
+	var signers []string
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, statusPrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, statusPrefix))
+		if len(fields) < 2 || fields[0] != "VALIDSIG" {
+			continue
+		}
+		signer := fields[len(fields)-1]
+		if len(fields) < 11 {
+			signer = fields[1]
+		}
+		if strings.EqualFold(signer, fingerprint) {
+			return nil
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return fmt.Errorf("no valid signature found: %w", SignatureVerificationError)
+	}
+	return fmt.Errorf("signed by %s instead of %s: %w", strings.Join(signers, ", "), fingerprint, SignatureVerificationError)
+}
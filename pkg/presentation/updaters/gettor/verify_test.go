@@ -0,0 +1,50 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	subkeyFingerprint = "DA4241738B4500CAB57309345789951636D7562C"
+	otherFingerprint  = "25770D8C448442B8A663FE727072101B1739F480"
+)
+
+func TestCheckValidSig(t *testing.T) {
+	validSig := func(primary string) []byte {
+		return []byte(`[GNUPG:] NEWSIG
+[GNUPG:] KEY_CONSIDERED ` + primary + ` 0
+[GNUPG:] GOODSIG 5789951636D7562C Tor Browser Developers (signing key) <torbrowser@torproject.org>
+[GNUPG:] VALIDSIG ` + subkeyFingerprint + ` 2022-11-23 1669200000 0 4 0 1 10 00 ` + primary + `
+`)
+	}
+
+	if err := checkValidSig(validSig(torBrowserSigningKey), torBrowserSigningKey); err != nil {
+		t.Errorf("Valid signature rejected: %v", err)
+	}
+
+	for name, status := range map[string][]byte{
+		"other key":    validSig(otherFingerprint),
+		"no VALIDSIG":  []byte("[GNUPG:] NEWSIG\n[GNUPG:] BADSIG 5789951636D7562C Tor Browser Developers\n"),
+		"empty status": {},
+		"not a status": []byte("gpgv: VALIDSIG " + torBrowserSigningKey + "\n"),
+	} {
+		err := checkValidSig(status, torBrowserSigningKey)
+		if !errors.Is(err, SignatureVerificationError) {
+			t.Errorf("Wrong error for %s: %v", name, err)
+		}
+	}
+}
+
+func TestNewSignatureVerifier(t *testing.T) {
+	if _, err := newSignatureVerifier(""); !errors.Is(err, MissingKeyringError) {
+		t.Errorf("Wrong error without keyring: %v", err)
+	}
+	if _, err := newSignatureVerifier("/nonexistent/tor.keyring"); err == nil {
+		t.Errorf("Accepted a keyring that doesn't exist")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testsupport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	// Timeout is how long the fake backend waits for the distributor
+	// before giving up.
+	Timeout = 5 * time.Second
+)
+
+var (
+	TimeoutError       = errors.New("timed out waiting for the distributor")
+	StreamStoppedError = errors.New("the distributor stopped the resource stream")
+)
+
+// FakeBackend is an in-memory delivery.Mechanism that plays the role of the
+// rdsys backend in tests: instead of talking to the backend over HTTP, the
+// distributor gets its resource diffs from Send and Play.  A fake backend
+// serves a single resource stream.
+type FakeBackend struct {
+	// JsonHandler answers the JSON requests of the distributor by filling
+	// in resp.  If nil, JSON requests succeed without a response.
+	JsonHandler func(req interface{}, resp interface{}) error
+
+	lock         sync.Mutex
+	request      *core.ResourceRequest
+	jsonRequests []interface{}
+	started      chan bool
+	stopped      chan bool
+}
+
+// NewFakeBackend returns a fake backend that waits for a distributor to start
+// its resource stream.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		started: make(chan bool),
+		stopped: make(chan bool),
+	}
+}
+
+// StartStream implements delivery.Mechanism.
+func (b *FakeBackend) StartStream(req *core.ResourceRequest) {
+	b.lock.Lock()
+	b.request = req
+	b.lock.Unlock()
+	close(b.started)
+}
+
+// StopStream implements delivery.Mechanism.
+func (b *FakeBackend) StopStream() {
+	close(b.stopped)
+}
+
+// MakeJsonRequest implements delivery.Mechanism.  It records the request and
+// passes it to the JsonHandler.
+func (b *FakeBackend) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.jsonRequests = append(b.jsonRequests, req)
+	b.lock.Unlock()
+
+	if b.JsonHandler == nil {
+		return nil
+	}
+	return b.JsonHandler(req, resp)
+}
+
+// JsonRequests returns all the JSON requests that the distributor made so
+// far, in order.
+func (b *FakeBackend) JsonRequests() []interface{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	requests := make([]interface{}, len(b.jsonRequests))
+	copy(requests, b.jsonRequests)
+	return requests
+}
+
+// ResourceRequest waits for the distributor to start its resource stream and
+// returns the request that it made, so tests can check the resource types
+// that the distributor asked for.
+func (b *FakeBackend) ResourceRequest() (*core.ResourceRequest, error) {
+	select {
+	case <-b.started:
+	case <-time.After(Timeout):
+		return nil, TimeoutError
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.request, nil
+}
+
+// Send sends the given diff to the distributor and returns once the
+// distributor received it.  The distributor may still be processing the diff
+// when Send returns, use WaitFor to wait for its effects.  Sending diffs
+// after shutting down the distributor is an error.
+func (b *FakeBackend) Send(diff *core.ResourceDiff) error {
+	req, err := b.ResourceRequest()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-b.stopped:
+		return StreamStoppedError
+	default:
+	}
+
+	select {
+	case req.Receiver <- diff:
+		return nil
+	case <-b.stopped:
+		return StreamStoppedError
+	case <-time.After(Timeout):
+		return TimeoutError
+	}
+}
+
+// Sync returns once the distributor processed all the diffs sent so far.
+// Distributors process their diffs one at a time and in order, so by the time
+// they receive the empty diff that Sync sends they are done with the previous
+// ones.
+func (b *FakeBackend) Sync() error {
+	return b.Send(core.NewResourceDiff())
+}
+
+// Play sends all the diffs of the given script to the distributor, in order.
+func (b *FakeBackend) Play(script *Script) error {
+	for _, diff := range script.Diffs() {
+		if err := b.Send(diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitFor polls the given condition until it holds, and returns
+// TimeoutError if it doesn't hold within Timeout.
+func WaitFor(cond func() bool) error {
+	deadline := time.Now().Add(Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return TimeoutError
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testsupport
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+)
+
+// Make sure that the fake backend can replace the real one.
+var _ delivery.Mechanism = &FakeBackend{}
+
+func TestScript(t *testing.T) {
+	dummies := Dummies(3)
+	if dummies[0].Oid() == dummies[1].Oid() {
+		t.Error("Dummies share the same hashkey")
+	}
+	if Dummies(1)[0].Oid() != dummies[0].Oid() {
+		t.Error("Dummies aren't the same across calls")
+	}
+
+	diffs := NewScript().Add(dummies...).Change(dummies[0]).Remove(dummies[1:]...).Diffs()
+	if len(diffs) != 3 {
+		t.Fatalf("Wrong number of diffs: %d", len(diffs))
+	}
+	if len(diffs[0].New["dummy"]) != 3 || len(diffs[0].Changed) != 0 || len(diffs[0].Gone) != 0 {
+		t.Errorf("Wrong first diff: %s", diffs[0])
+	}
+	if len(diffs[1].Changed["dummy"]) != 1 {
+		t.Errorf("Wrong second diff: %s", diffs[1])
+	}
+	if len(diffs[2].Gone["dummy"]) != 2 {
+		t.Errorf("Wrong third diff: %s", diffs[2])
+	}
+}
+
+func TestStream(t *testing.T) {
+	backend := NewFakeBackend()
+	rStream := make(chan *core.ResourceDiff)
+	backend.StartStream(&core.ResourceRequest{
+		RequestOrigin: "test",
+		ResourceTypes: []string{"dummy"},
+		Receiver:      rStream,
+	})
+
+	ring := core.NewHashring()
+	done := make(chan bool)
+	go func() {
+		for diff := range rStream {
+			ring.ApplyDiff(diff)
+		}
+		close(done)
+	}()
+
+	req, err := backend.ResourceRequest()
+	if err != nil || req.RequestOrigin != "test" {
+		t.Fatalf("Wrong resource request: %+v %v", req, err)
+	}
+	if err := backend.Play(NewScript().Add(Dummies(3)...).Remove(Dummies(1)...)); err != nil {
+		t.Fatal("Can't play the script:", err)
+	}
+	if err := backend.Sync(); err != nil {
+		t.Fatal("Can't sync with the distributor:", err)
+	}
+	if ring.Len() != 2 {
+		t.Errorf("Wrong number of resources in the hashring: %d", ring.Len())
+	}
+
+	backend.StopStream()
+	close(rStream)
+	<-done
+	if err := backend.Send(core.NewResourceDiff()); !errors.Is(err, StreamStoppedError) {
+		t.Error("Expected stream stopped error:", err)
+	}
+}
+
+func TestMakeJsonRequest(t *testing.T) {
+	backend := NewFakeBackend()
+	var resp string
+	if err := backend.MakeJsonRequest(context.Background(), "foo", &resp); err != nil {
+		t.Error("Unexpected error without a handler:", err)
+	}
+
+	backend.JsonHandler = func(req interface{}, resp interface{}) error {
+		*resp.(*string) = req.(string) + "bar"
+		return nil
+	}
+	if err := backend.MakeJsonRequest(context.Background(), "foo", &resp); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if resp != "foobar" {
+		t.Errorf("Wrong response: %s", resp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := backend.MakeJsonRequest(ctx, "foo", &resp); !errors.Is(err, context.Canceled) {
+		t.Error("Expected a canceled error:", err)
+	}
+	if len(backend.JsonRequests()) != 2 {
+		t.Errorf("Wrong number of recorded requests: %d", len(backend.JsonRequests()))
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testsupport
+
+import (
+	"fmt"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// Script is a sequence of resource diffs, as the backend would send them to a
+// distributor.  Each of its methods appends one diff to the script, so they
+// can be chained:
+//
+//	script := NewScript().Add(Dummies(3)...).Remove(Dummies(1)...)
+type Script struct {
+	diffs []*core.ResourceDiff
+}
+
+// NewScript returns an empty script.
+func NewScript() *Script {
+	return &Script{}
+}
+
+// groupByType returns the given resources in a resource map.
+func groupByType(rs []core.Resource) core.ResourceMap {
+	m := make(core.ResourceMap)
+	for _, r := range rs {
+		m[r.Type()] = append(m[r.Type()], r)
+	}
+	return m
+}
+
+// Add appends a diff with the given new resources.
+func (s *Script) Add(rs ...core.Resource) *Script {
+	diff := core.NewResourceDiff()
+	diff.New = groupByType(rs)
+	s.diffs = append(s.diffs, diff)
+	return s
+}
+
+// Change appends a diff with the given changed resources.
+func (s *Script) Change(rs ...core.Resource) *Script {
+	diff := core.NewResourceDiff()
+	diff.Changed = groupByType(rs)
+	s.diffs = append(s.diffs, diff)
+	return s
+}
+
+// Remove appends a diff with the given gone resources.
+func (s *Script) Remove(rs ...core.Resource) *Script {
+	diff := core.NewResourceDiff()
+	diff.Gone = groupByType(rs)
+	s.diffs = append(s.diffs, diff)
+	return s
+}
+
+// Diffs returns the diffs of the script, in order.
+func (s *Script) Diffs() []*core.ResourceDiff {
+	return s.diffs
+}
+
+// Dummies returns n dummy resources with distinct hashkeys.  Every call
+// returns the same resources, so a test can remove what it added before.
+func Dummies(n int) []core.Resource {
+	rs := make([]core.Resource, n)
+	for i := range rs {
+		rs[i] = core.NewDummy(
+			core.NewHashkey(fmt.Sprintf("oid-%d", i)),
+			core.NewHashkey(fmt.Sprintf("uid-%d", i)))
+	}
+	return rs
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/distributorsdk"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	DistName = resources.DistributorEmail
+
+	CommandHelp    = "help"
+	CommandBridges = "bridges"
+
+	defaultType = "obfs4"
+)
+
+var (
+	requestsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_request_total",
+		Help: "The total number of email requests",
+	},
+		[]string{"command", "type", "ipv6", "status"},
+	)
+
+	NoBridgesError = distributorsdk.NoBridgesError
+)
+
+// EmailDistributor distributes bridges over email.
+type EmailDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+
+	base *distributorsdk.Distributor
+	cfg  *internal.EmailDistConfig
+}
+
+// Command is a request parsed from an email, like "get bridges obfs4 ipv6".
+type Command struct {
+	Command string
+	Type    string
+	IPv6    bool
+}
+
+// ParseCommand parses the words of the email looking for the type of bridges
+// requested and if they should be IPv6.  A request without "bridges" nor a
+// bridge type is a help request.
+func (d *EmailDistributor) ParseCommand(body io.Reader) *Command {
+	command := Command{}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		word := strings.ToLower(scanner.Text())
+		switch {
+		case word == "bridges" || word == "bridge":
+			command.Command = CommandBridges
+		case word == "ipv6":
+			command.IPv6 = true
+		case word == "help":
+			if command.Command == "" {
+				command.Command = CommandHelp
+			}
+		case command.Type == "" && d.isResourceType(word):
+			command.Type = word
+			command.Command = CommandBridges
+		}
+	}
+
+	if command.Command == "" {
+		command.Command = CommandHelp
+	}
+	if command.Type == "" {
+		command.Type = d.defaultType()
+	}
+	return &command
+}
+
+// SupportedTypes returns the types of bridges that can be requested.
+func (d *EmailDistributor) SupportedTypes() []string {
+	return d.cfg.Resources
+}
+
+func (d *EmailDistributor) isResourceType(rType string) bool {
+	for _, t := range d.cfg.Resources {
+		if t == rType {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *EmailDistributor) defaultType() string {
+	if d.isResourceType(defaultType) || len(d.cfg.Resources) == 0 {
+		return defaultType
+	}
+	return d.cfg.Resources[0]
+}
+
+// IsAllowedAddress returns true if the email address is from one of the
+// allowed email providers.
+func (d *EmailDistributor) IsAllowedAddress(address string) bool {
+	parts := strings.Split(strings.ToLower(address), "@")
+	if len(parts) != 2 {
+		return false
+	}
+	for _, domain := range d.cfg.AllowedDomains {
+		if parts[1] == strings.ToLower(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeAddress returns a canonical version of the email address, so the
+// different ways of writing the same mailbox get the same bridges.  It
+// removes the +suffix of the local part, and the dots for gmail addresses.
+func NormalizeAddress(address string) string {
+	address = strings.ToLower(strings.TrimSpace(address))
+	parts := strings.Split(address, "@")
+	if len(parts) != 2 {
+		return address
+	}
+	local, domain := parts[0], parts[1]
+
+	local = strings.SplitN(local, "+", 2)[0]
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		local = strings.Replace(local, ".", "", -1)
+	}
+	return local + "@" + domain
+}
+
+// GetResources returns the bridges for the email address and command.  The
+// same address gets the same bridges during a rotation period.  No bridges are
+// handed out if the given context is done.
+func (d *EmailDistributor) GetResources(ctx context.Context, address string, command *Command) ([]core.Resource, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ipv6 := fmt.Sprintf("%t", command.IPv6)
+	hashKey := core.NewHashkey(fmt.Sprintf("%s-%s-%s-%d", NormalizeAddress(address), command.Type, ipv6, distributorsdk.RotationPeriod(d.cfg.RotationPeriodHours)))
+
+	ring := d.base.Ring.Filter(func(r core.Resource) bool {
+		return r.Type() == command.Type && isIPv6(r) == command.IPv6
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ring.Len() == 0 {
+		requestsCount.WithLabelValues(command.Command, command.Type, ipv6, "error").Inc()
+		return nil, NoBridgesError
+	}
+
+	num := d.cfg.NumBridgesPerRequest
+	if num > ring.Len() {
+		num = ring.Len()
+	}
+	res, err := ring.GetMany(hashKey, num)
+	if err != nil {
+		requestsCount.WithLabelValues(command.Command, command.Type, ipv6, "error").Inc()
+		return nil, err
+	}
+	requestsCount.WithLabelValues(command.Command, command.Type, ipv6, "success").Inc()
+	return res, nil
+}
+
+func isIPv6(r core.Resource) bool {
+	var addr resources.Addr
+	switch b := r.(type) {
+	case *resources.Transport:
+		addr = b.Address
+	case *resources.Bridge:
+		addr = b.Address
+	default:
+		return false
+	}
+	if addr.Addr == nil {
+		return false
+	}
+	ip := net.ParseIP(addr.String())
+	return ip != nil && ip.To4() == nil
+}
+
+// Init initialises the given email distributor.
+func (d *EmailDistributor) Init(cfg *internal.Config) {
+	log.Printf("Initialising %s distributor.", DistName)
+
+	d.cfg = &cfg.Distributors.Email
+	sdkCfg := distributorsdk.FromRdsysConfig(cfg, DistName, d.cfg.Resources)
+	if d.IPC != nil {
+		sdkCfg.IPC = d.IPC
+	}
+	d.base = distributorsdk.New(sdkCfg, distributorsdk.Hooks{})
+	d.base.Start()
+}
+
+// Shutdown shuts down the given email distributor.
+func (d *EmailDistributor) Shutdown() {
+	log.Printf("Shutting down %s distributor.", DistName)
+
+	d.base.Stop()
+}
+
+// Healthz returns an error if the distributor has no bridges to hand out.
+func (d *EmailDistributor) Healthz() error {
+	return d.base.Healthz()
+}
+
+// Stats returns the number of bridges of each type in the hashring.
+func (d *EmailDistributor) Stats() distributors.Stats {
+	return d.base.Stats()
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+var config = internal.Config{
+	Distributors: internal.Distributors{
+		Email: internal.EmailDistConfig{
+			Resources:            []string{"obfs4", "vanilla"},
+			NumBridgesPerRequest: 2,
+			RotationPeriodHours:  24,
+			AllowedDomains:       []string{"gmail.com", "riseup.net"},
+		},
+	},
+}
+
+func newTransport(rType, ip string, port uint16) *resources.Transport {
+	t := resources.NewTransport()
+	t.SetType(rType)
+	t.Address = resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP(ip)}}
+	t.Port = port
+	t.Fingerprint = fmt.Sprintf("%040d", port)
+	return t
+}
+
+func TestParseCommand(t *testing.T) {
+	d := EmailDistributor{cfg: &config.Distributors.Email}
+
+	for body, expected := range map[string]Command{
+		"get bridges":            {CommandBridges, "obfs4", false},
+		"GET BRIDGES IPv6":       {CommandBridges, "obfs4", true},
+		"get vanilla":            {CommandBridges, "vanilla", false},
+		"get bridges obfs4 ipv6": {CommandBridges, "obfs4", true},
+		"help":                   {CommandHelp, "obfs4", false},
+		"hello there":            {CommandHelp, "obfs4", false},
+		"get meek bridges":       {CommandBridges, "obfs4", false},
+	} {
+		command := d.ParseCommand(strings.NewReader(body))
+		if *command != expected {
+			t.Errorf("Wrong command for '%s': %v", body, *command)
+		}
+	}
+}
+
+func TestAllowedAddress(t *testing.T) {
+	d := EmailDistributor{cfg: &config.Distributors.Email}
+
+	for address, allowed := range map[string]bool{
+		"user@gmail.com":    true,
+		"User@RiseUp.net":   true,
+		"user@example.com":  false,
+		"user@gmail.com.ru": false,
+		"gmail.com":         false,
+	} {
+		if d.IsAllowedAddress(address) != allowed {
+			t.Errorf("Wrong allowed for %s", address)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for address, normalized := range map[string]string{
+		"user@riseup.net":         "user@riseup.net",
+		"User+bridges@riseup.net": "user@riseup.net",
+		"u.s.e.r+foo@gmail.com":   "user@gmail.com",
+		"u.ser@googlemail.com":    "user@gmail.com",
+		"first.last@example.com":  "first.last@example.com",
+	} {
+		if n := NormalizeAddress(address); n != normalized {
+			t.Errorf("Wrong normalization of %s: %s", address, n)
+		}
+	}
+}
+
+func TestGetResources(t *testing.T) {
+	d := EmailDistributor{}
+	d.Init(&config)
+	defer d.Shutdown()
+
+	_, err := d.GetResources(context.Background(), "user@gmail.com", &Command{CommandBridges, "obfs4", false})
+	if !errors.Is(err, NoBridgesError) {
+		t.Error("Expected no bridges error:", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		d.base.Ring.Add(newTransport("obfs4", fmt.Sprintf("192.0.2.%d", i+1), uint16(1000+i)))
+		d.base.Ring.Add(newTransport("obfs4", fmt.Sprintf("2001:db8::%d", i+1), uint16(2000+i)))
+		d.base.Ring.Add(newTransport("vanilla", fmt.Sprintf("198.51.100.%d", i+1), uint16(3000+i)))
+	}
+
+	res, err := d.GetResources(context.Background(), "u.ser@gmail.com", &Command{CommandBridges, "obfs4", true})
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Wrong number of resources: %d", len(res))
+	}
+	for _, r := range res {
+		if r.Type() != "obfs4" || !isIPv6(r) {
+			t.Errorf("Wrong resource: %s", r.String())
+		}
+	}
+
+	res2, err := d.GetResources(context.Background(), "user+foo@gmail.com", &Command{CommandBridges, "obfs4", true})
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	for i := range res {
+		if res[i] != res2[i] {
+			t.Error("Different resources for the same mailbox:", res[i], res2[i])
+		}
+	}
+
+	res, err = d.GetResources(context.Background(), "user@gmail.com", &Command{CommandBridges, "vanilla", false})
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	for _, r := range res {
+		if r.Type() != "vanilla" || isIPv6(r) {
+			t.Errorf("Wrong resource: %s", r.String())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exposure
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+)
+
+const (
+	ReportInterval = 10 * time.Minute
+	// ReportTimeout is how long we wait for the backend to answer a report.
+	ReportTimeout = time.Minute
+)
+
+// Deprioritizer is implemented by the hashrings and collections that can
+// deprioritize over-exposed resources.
+type Deprioritizer interface {
+	SetDeprioritized(uids []core.Hashkey)
+}
+
+// Reporter counts the resources handed out by a distributor and periodically
+// reports them to the backend.  The resources that the backend considers
+// over-exposed get deprioritized in the distributor's hashring.
+type Reporter struct {
+	distName string
+	ring     Deprioritizer
+	ipc      delivery.Mechanism
+	wg       sync.WaitGroup
+	shutdown chan bool
+
+	handoutsLock sync.Mutex
+	handouts     map[core.Hashkey]int
+}
+
+// NewReporter returns a reporter for the given distributor, or nil if the
+// backend has no handouts endpoint configured.  All the methods of Reporter
+// can be called on a nil reporter and do nothing.
+func NewReporter(cfg *internal.Config, distName string, ring Deprioritizer) *Reporter {
+	if cfg.Backend.HandoutsEndpoint == "" {
+		return nil
+	}
+
+	return &Reporter{
+		distName: distName,
+		ring:     ring,
+		ipc: internal.NewBackendIpc(
+			cfg,
+			cfg.Backend.HandoutsEndpoint,
+			"POST",
+			cfg.Backend.ApiTokens[distName]),
+		shutdown: make(chan bool),
+		handouts: make(map[core.Hashkey]int),
+	}
+}
+
+// Record counts a handout of the given resources.
+func (r *Reporter) Record(resources []core.Resource) {
+	if r == nil {
+		return
+	}
+
+	r.handoutsLock.Lock()
+	defer r.handoutsLock.Unlock()
+	for _, resource := range resources {
+		r.handouts[resource.Uid()]++
+	}
+}
+
+// Start reports the handouts to the backend every ReportInterval.
+func (r *Reporter) Start() {
+	if r == nil {
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(ReportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.report()
+			case <-r.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic reports and sends the remaining handouts.
+func (r *Reporter) Stop() {
+	if r == nil {
+		return
+	}
+
+	close(r.shutdown)
+	r.wg.Wait()
+	r.report()
+}
+
+// report sends the handouts since the last report to the backend and
+// deprioritizes the resources that the backend flags as over-exposed.  If the
+// report fails the handouts are kept for the next one.
+func (r *Reporter) report() {
+	r.handoutsLock.Lock()
+	handouts := r.handouts
+	r.handouts = make(map[core.Hashkey]int)
+	r.handoutsLock.Unlock()
+
+	req := core.HandoutReport{
+		RequestOrigin: r.distName,
+		Handouts:      handouts,
+	}
+	var resp core.ExposureReport
+	ctx, cancel := context.WithTimeout(context.Background(), ReportTimeout)
+	defer cancel()
+	if err := r.ipc.MakeJsonRequest(ctx, req, &resp); err != nil {
+		log.Printf("Failed to report handouts to the backend: %s", err)
+		r.handoutsLock.Lock()
+		for uid, num := range handouts {
+			r.handouts[uid] += num
+		}
+		r.handoutsLock.Unlock()
+		return
+	}
+
+	if len(resp.OverExposed) != 0 {
+		log.Printf("Deprioritizing %d over-exposed resources.", len(resp.OverExposed))
+	}
+	r.ring.SetDeprioritized(resp.OverExposed)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exposure
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+// dummyBackend records the handout reports and flags as over-exposed the
+// resources that were handed out more than once
+type dummyBackend struct {
+	fail     bool
+	handouts map[core.Hashkey]int
+}
+
+func (d *dummyBackend) StartStream(*core.ResourceRequest) {}
+func (d *dummyBackend) StopStream()                       {}
+func (d *dummyBackend) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
+	if d.fail {
+		return errors.New("backend unreachable")
+	}
+
+	report := resp.(*core.ExposureReport)
+	for uid, num := range req.(core.HandoutReport).Handouts {
+		d.handouts[uid] += num
+		if d.handouts[uid] > 1 {
+			report.OverExposed = append(report.OverExposed, uid)
+		}
+	}
+	return nil
+}
+
+func TestNilReporter(t *testing.T) {
+	r := NewReporter(&internal.Config{}, "https", core.NewHashring())
+	if r != nil {
+		t.Fatal("Got a reporter without a handouts endpoint")
+	}
+	r.Start()
+	r.Record([]core.Resource{core.NewDummy(1, 1)})
+	r.Stop()
+}
+
+func TestReport(t *testing.T) {
+	cfg := internal.Config{}
+	cfg.Backend.HandoutsEndpoint = "/handouts"
+	ring := core.NewHashring()
+	d1 := core.NewDummy(1, 1)
+	d2 := core.NewDummy(2, 2)
+	ring.Add(d1)
+	ring.Add(d2)
+
+	backend := &dummyBackend{fail: true, handouts: make(map[core.Hashkey]int)}
+	r := NewReporter(&cfg, "https", ring)
+	r.ipc = backend
+
+	r.Record([]core.Resource{d1})
+	r.report()
+	if len(r.handouts) != 1 {
+		t.Fatal("Handouts were lost after a failed report")
+	}
+
+	backend.fail = false
+	r.Record([]core.Resource{d1, d2})
+	r.report()
+	if len(r.handouts) != 0 {
+		t.Error("Handouts were not reset after a report")
+	}
+	if !ring.IsDeprioritized(d1.Uid()) || ring.IsDeprioritized(d2.Uid()) {
+		t.Error("Wrong resources deprioritized")
+	}
+}
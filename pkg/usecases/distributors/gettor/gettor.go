@@ -6,27 +6,52 @@ package gettor
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 const (
 	DistName = "gettor"
 
-	CommandHelp  = "help"
-	CommandLinks = "links"
+	CommandHelp      = "help"
+	CommandLinks     = "links"
+	CommandSignature = "signature"
+	CommandChecksum  = "checksum"
+
+	// DefaultChecksumURL is where the checksum files of the Tor Browser
+	// releases are published, in a directory per version.
+	DefaultChecksumURL = "https://dist.torproject.org/torbrowser/"
+	checksumFileName   = "sha256sums-signed-build.txt"
+
+	defaultLocale = "en-US"
 )
 
+var (
+	MissingVersionError      = errors.New("the version needs a version number, like 'version 12.0.1'")
+	InvalidVersionError      = errors.New("the version number is not valid")
+	MissingPlatformError     = errors.New("the platform is missing")
+	VersionNotAvailableError = errors.New("the requested version is not available")
+)
+
+// versionRegexp matches the Tor Browser version numbers, like 12.0, 12.0.1 or
+// the alpha ones like 12.5a1
+var versionRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+(\.[0-9]+)?([a-z]+[0-9]+)?$`)
+
 var (
 	requestsCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "gettor_request_total",
@@ -41,8 +66,56 @@ var (
 	},
 		[]string{"platform", "locale"},
 	)
+
+	servedLinksCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gettor_served_links_total",
+		Help: "The total number of links served by gettor, by provider",
+	},
+		[]string{"provider", "platform"},
+	)
+
+	parseErrorsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gettor_parse_error_total",
+		Help: "The total number of gettor requests that couldn't be parsed",
+	},
+		[]string{"error"},
+	)
+
+	repliesCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gettor_reply_total",
+		Help: "The total number of gettor replies, by command and outcome",
+	},
+		[]string{"command", "outcome"},
+	)
+)
+
+// The outcomes of the replies for CountReply
+const (
+	OutcomeSent                = "sent"
+	OutcomeNoLinks             = "no_links"
+	OutcomeVersionNotAvailable = "version_not_available"
+	OutcomeSendFailed          = "send_failed"
 )
 
+// parseErrorLabels are the labels of the parse errors in the metrics
+var parseErrorLabels = map[error]string{
+	MissingVersionError:  "missing_version",
+	InvalidVersionError:  "invalid_version",
+	MissingPlatformError: "missing_platform",
+}
+
+// CountReply records the reply to the command in the metrics.
+func CountReply(command *Command, outcome string) {
+	repliesCount.WithLabelValues(command.Command, outcome).Inc()
+}
+
+// countServedLinks records the providers of the links handed out.
+func countServedLinks(links []*resources.TBLink) {
+	for _, link := range links {
+		servedLinksCount.WithLabelValues(link.Provider, link.Platform).Inc()
+	}
+}
+
 var platformAliases = map[string]string{
 	"linux":   "linux64",
 	"lin":     "linux64",
@@ -53,34 +126,386 @@ var platformAliases = map[string]string{
 	"mac":     "osx64",
 }
 
+// localeAliases map lowercase language codes to the Tor Browser locale for
+// them, when it's not the language code itself
+var localeAliases = map[string]string{
+	"en":      "en-US",
+	"es":      "es-ES",
+	"ga":      "ga-IE",
+	"nb":      "nb-NO",
+	"pt":      "pt-BR",
+	"pt-pt":   "pt-BR",
+	"sv":      "sv-SE",
+	"zh":      "zh-CN",
+	"zh-hans": "zh-CN",
+	"zh-sg":   "zh-CN",
+	"zh-hant": "zh-TW",
+	"zh-hk":   "zh-TW",
+	"iw":      "he",
+}
+
+var commandAliases = map[string]string{
+	"links":      CommandLinks,
+	"signature":  CommandSignature,
+	"sig":        CommandSignature,
+	"asc":        CommandSignature,
+	"checksum":   CommandChecksum,
+	"checksums":  CommandChecksum,
+	"sha256sums": CommandChecksum,
+}
+
+// torrentWords ask for the magnet links
+var torrentWords = map[string]bool{
+	"torrent":    true,
+	"bittorrent": true,
+	"magnet":     true,
+}
+
+// productAliases map the words of the requests to the products other than Tor
+// Browser
+var productAliases = map[string]string{
+	"orbot":             resources.ProductOrbot,
+	"tor-expert-bundle": resources.ProductTorExpertBundle,
+	"expert":            resources.ProductTorExpertBundle,
+	"teb":               resources.ProductTorExpertBundle,
+}
+
+// channelAliases map the words of the requests to the release channels
+var channelAliases = map[string]string{
+	"release": "",
+	"stable":  "",
+	"alpha":   resources.ChannelAlpha,
+	"nightly": resources.ChannelNightly,
+}
+
 type GettorDistributor struct {
 	ipc      delivery.Mechanism
 	wg       sync.WaitGroup
 	shutdown chan bool
-	tblinks  TBLinkList
 
-	// latest version of Tor Browser per platform
+	// lock protects tblinks, version, locales and the test results of the
+	// links, that are updated by the housekeeping
+	lock    sync.RWMutex
+	tblinks TBLinkList
+
+	checksumURL string
+
+	// linkCheckInterval is how often a sample of linkCheckSample links is
+	// checked, the links are not checked if it's 0
+	linkCheckInterval time.Duration
+	linkCheckSample   int
+
+	// latest version of Tor Browser per platform, indexed like TBLinkList
 	version map[string]resources.Version
 
 	// locales map a lowercase locale to its correctly cased locale
 	locales map[string]string
 }
 
-// TBLinkList are indexed first by platform and last by locale
+// TBLinkList are indexed first by platform and last by locale.  The links of
+// other channels than release are indexed by the platform and the channel,
+// like "win32/alpha", and the ones of other products than Tor Browser with the
+// product as prefix, like "orbot:android".
 type TBLinkList map[string]map[string][]*resources.TBLink
 
+// linksKey returns the index in TBLinkList of the product, platform and
+// channel.
+func linksKey(product, platform, channel string) string {
+	key := platform
+	if linksChannel(channel) != "" {
+		key += "/" + channel
+	}
+	if linksProduct(product) != "" {
+		key = product + ":" + key
+	}
+	return key
+}
+
+// splitLinksKey returns the product, the platform and the channel of the index
+// in TBLinkList, the product is empty for Tor Browser and the channel for the
+// release channel.
+func splitLinksKey(key string) (string, string, string) {
+	product := ""
+	if i := strings.Index(key, ":"); i != -1 {
+		product, key = key[:i], key[i+1:]
+	}
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) == 1 {
+		return product, key, ""
+	}
+	return product, parts[0], parts[1]
+}
+
+// linksProduct returns the product as it's used in the TBLinkList index.
+func linksProduct(product string) string {
+	if product == resources.ProductTorBrowser {
+		return ""
+	}
+	return product
+}
+
+// linksChannel returns the channel as it's used in the TBLinkList index.
+func linksChannel(channel string) string {
+	if channel == resources.ChannelRelease {
+		return ""
+	}
+	return channel
+}
+
 type Command struct {
 	Locale   string
 	Platform string
-	Command  string
+	// Arch is the architecture requested for the platforms that have a
+	// binary per architecture, or empty for all of them
+	Arch string
+	// Channel is the release channel requested, empty for the release one
+	Channel string
+	// Product is the product requested, empty for Tor Browser
+	Product string
+	// Torrent asks for the magnet links of the files too
+	Torrent bool
+	Command string
+	// Version is the Tor Browser version requested, or nil for the latest
+	Version *resources.Version
+	// Error is why the request couldn't be parsed, the command is
+	// CommandHelp if it's set
+	Error error
 }
 
 func (d *GettorDistributor) GetLinks(platform, locale string) []*resources.TBLink {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 	linkResponseCount.WithLabelValues(platform, locale).Inc()
-	return d.tblinks[platform][locale]
+	links := aliveLinks(d.tblinks[platform][locale])
+	countServedLinks(links)
+	return links
+}
+
+// CheckVersion returns VersionNotAvailableError if the command requests a
+// version and it's not the version we have links for in its platform and
+// channel.
+func (d *GettorDistributor) CheckVersion(command *Command) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if command.Version != nil {
+		latest, ok := d.version[linksKey(command.Product, command.Platform, command.Channel)]
+		if !ok || latest.Compare(*command.Version) != 0 {
+			return VersionNotAvailableError
+		}
+	}
+	return nil
+}
+
+// FindLinks returns the links for the platform, channel and architecture of
+// the command in the first locale of the fallback chain of the command locale
+// that has links, and that locale.  fallback is true if it's not the locale
+// requested.  An empty arch matches all the architectures, and links without
+// architecture match any arch.
+func (d *GettorDistributor) FindLinks(command *Command) (links []*resources.TBLink, locale string, fallback bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	lang := command.Locale
+	if lang == "" {
+		lang = defaultLocale
+	}
+	requested := d.exactLocale(lang)
+	if requested == "" {
+		requested = lang
+	}
+
+	key := linksKey(command.Product, command.Platform, command.Channel)
+	for _, locale := range d.localeChain(lang) {
+		links := filterArch(aliveLinks(d.tblinks[key][locale]), command.Arch)
+		if len(links) != 0 {
+			linkResponseCount.WithLabelValues(command.Platform, locale).Inc()
+			countServedLinks(links)
+			return links, locale, !strings.EqualFold(locale, requested)
+		}
+	}
+	return nil, "", false
+}
+
+func filterArch(links []*resources.TBLink, arch string) []*resources.TBLink {
+	if arch == "" {
+		return links
+	}
+	var filtered []*resources.TBLink
+	for _, link := range links {
+		if link.Arch == "" || link.Arch == arch {
+			filtered = append(filtered, link)
+		}
+	}
+	return filtered
+}
+
+// LinksFilter selects the links of ListLinks, its empty fields match every
+// link.
+type LinksFilter struct {
+	Product  string
+	Platform string
+	Channel  string
+	Locale   string
+	Provider string
+}
+
+// ListLinks returns copies of the links that we hand out that match the
+// filter, sorted by their index in TBLinkList, locale and provider.
+func (d *GettorDistributor) ListLinks(filter LinksFilter) []*resources.TBLink {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	keys := make([]string, 0, len(d.tblinks))
+	for key := range d.tblinks {
+		product, platform, channel := splitLinksKey(key)
+		if filter.Product != "" && product != linksProduct(filter.Product) {
+			continue
+		}
+		if filter.Platform != "" && platform != filter.Platform {
+			continue
+		}
+		if filter.Channel != "" && channel != linksChannel(filter.Channel) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var links []*resources.TBLink
+	for _, key := range keys {
+		locales := make([]string, 0, len(d.tblinks[key]))
+		for locale := range d.tblinks[key] {
+			if filter.Locale == "" || strings.EqualFold(locale, filter.Locale) {
+				locales = append(locales, locale)
+			}
+		}
+		sort.Strings(locales)
+		for _, locale := range locales {
+			var found []*resources.TBLink
+			for _, link := range aliveLinks(d.tblinks[key][locale]) {
+				if filter.Provider == "" || strings.EqualFold(link.Provider, filter.Provider) {
+					copied := *link
+					if test := link.TestResult(); test != nil {
+						testCopy := *test
+						copied.SetTestResult(&testCopy)
+					}
+					found = append(found, &copied)
+				}
+			}
+			sort.SliceStable(found, func(i, j int) bool { return found[i].Provider < found[j].Provider })
+			links = append(links, found...)
+		}
+	}
+	return links
+}
+
+// LatestVersion returns the version we have links for in the product, platform
+// and channel, or the highest version of all platforms of the product and
+// channel if platform is empty.
+func (d *GettorDistributor) LatestVersion(product, platform, channel string) (resources.Version, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if platform != "" {
+		version, ok := d.version[linksKey(product, platform, channel)]
+		return version, ok
+	}
+
+	var latest resources.Version
+	found := false
+	for key, version := range d.version {
+		if p, _, c := splitLinksKey(key); p != linksProduct(product) || c != linksChannel(channel) {
+			continue
+		}
+		if !found || version.Compare(latest) == 1 {
+			latest = version
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// GetChecksumLinks returns the links to the checksum file of the Tor Browser
+// release and to its signature.
+func (d *GettorDistributor) GetChecksumLinks(version resources.Version) (checksum string, signature string) {
+	checksumURL := d.checksumURL
+	if checksumURL == "" {
+		checksumURL = DefaultChecksumURL
+	}
+	if !strings.HasSuffix(checksumURL, "/") {
+		checksumURL += "/"
+	}
+
+	checksum = checksumURL + releaseName(version) + "/" + checksumFileName
+	return checksum, checksum + ".asc"
+}
+
+// GetChecksums returns the SHA-256 of the binaries we have links for in the
+// product, platform, channel and architecture of the command, indexed by file
+// name.  If the command has no platform it returns the ones of all the
+// platforms of the product and channel, and if it has a version only the ones
+// of that version.
+func (d *GettorDistributor) GetChecksums(command *Command) map[string]string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	checksums := make(map[string]string)
+	for key, locales := range d.tblinks {
+		product, platform, channel := splitLinksKey(key)
+		if product != linksProduct(command.Product) || channel != linksChannel(command.Channel) {
+			continue
+		}
+		if command.Platform != "" && platform != command.Platform {
+			continue
+		}
+		for _, links := range locales {
+			for _, link := range filterArch(links, command.Arch) {
+				if link.Checksum == "" {
+					continue
+				}
+				if command.Version != nil && link.Version.Compare(*command.Version) != 0 {
+					continue
+				}
+				checksums[link.FileName] = link.Checksum
+			}
+		}
+	}
+	return checksums
+}
+
+// releaseName returns the version as Tor Browser names its releases, without
+// the patch number if it's 0, like 12.0 or 12.5a1.
+func releaseName(version resources.Version) string {
+	if version.Patch == 0 {
+		return fmt.Sprintf("%d.%d%s", version.Mayor, version.Minor, version.Pre)
+	}
+	return version.String()
+}
+
+// parseVersion parses a Tor Browser version number, like 12.0 or 12.0.1
+func parseVersion(word string) (*resources.Version, error) {
+	if !versionRegexp.MatchString(word) {
+		return nil, InvalidVersionError
+	}
+	version, err := resources.Str2Version(word)
+	if err != nil {
+		return nil, InvalidVersionError
+	}
+	return &version, nil
 }
 
 func (d *GettorDistributor) ParseCommand(body io.Reader) *Command {
+	return d.ParseCommandWithLocale(body, defaultLocale)
+}
+
+// ParseCommandWithLocale parses the command like ParseCommand, but uses
+// defaultLang if the body doesn't mention any locale.  The locale of the
+// command is the supported locale for the language, if there is one, or the
+// language as it was requested otherwise.  FindLinks does the fallback to
+// other locales.
+func (d *GettorDistributor) ParseCommandWithLocale(body io.Reader, defaultLang string) *Command {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
 	command := Command{
 		Locale:   "",
 		Platform: "",
@@ -91,7 +516,7 @@ func (d *GettorDistributor) ParseCommand(body io.Reader) *Command {
 	scanner.Split(bufio.ScanWords)
 	requestedPlatform := ""
 	for scanner.Scan() {
-		if command.Locale != "" && (command.Platform != "" || command.Command != "") {
+		if command.Locale != "" && (command.Platform != "" || command.Command == CommandHelp) {
 			break
 		}
 
@@ -101,14 +526,57 @@ func (d *GettorDistributor) ParseCommand(body io.Reader) *Command {
 			continue
 		}
 
+		if word == "version" {
+			if command.Version != nil || command.Error != nil {
+				continue
+			}
+			if !scanner.Scan() {
+				command.Error = MissingVersionError
+				break
+			}
+			command.Version, command.Error = parseVersion(scanner.Text())
+			continue
+		}
+
+		if torrentWords[word] {
+			command.Torrent = true
+			continue
+		}
+
+		if command.Command == "" {
+			if c, exists := commandAliases[word]; exists {
+				command.Command = c
+				continue
+			}
+		}
+
 		if command.Locale == "" {
-			locale, exists := d.locales[word]
+			locale, exists := d.parseLocale(word)
 			if exists {
 				command.Locale = locale
 				continue
 			}
 		}
 
+		if channel, exists := channelAliases[word]; exists {
+			command.Channel = channel
+			continue
+		}
+
+		if command.Product == "" {
+			if product, exists := productAliases[word]; exists {
+				command.Product = product
+				continue
+			}
+		}
+
+		if command.Arch == "" {
+			if arch, exists := resources.ArchAliases[word]; exists {
+				command.Arch = arch
+				continue
+			}
+		}
+
 		if command.Platform == "" {
 			platform, exists := platformAliases[word]
 			if exists {
@@ -117,8 +585,15 @@ func (d *GettorDistributor) ParseCommand(body io.Reader) *Command {
 				continue
 			}
 
-			_, exists = d.tblinks[word]
-			if exists {
+			platform, arch := resources.SplitPlatformArch(word)
+			if d.hasPlatform(platform) && arch != "" {
+				requestedPlatform = platform
+				command.Platform = platform
+				command.Arch = arch
+				continue
+			}
+
+			if d.hasPlatform(word) {
 				requestedPlatform = word
 				command.Platform = word
 				continue
@@ -134,26 +609,167 @@ func (d *GettorDistributor) ParseCommand(body io.Reader) *Command {
 			command.Command = CommandLinks
 		}
 	}
+	if (command.Command == CommandSignature || command.Command == CommandLinks) && command.Platform == "" && command.Error == nil {
+		command.Error = MissingPlatformError
+	}
+	if command.Error != nil {
+		parseErrorsCount.WithLabelValues(parseErrorLabels[command.Error]).Inc()
+		command.Command = CommandHelp
+	}
 
 	if command.Locale == "" {
-		command.Locale = "en-US"
+		command.Locale = defaultLang
+		if locale := d.exactLocale(defaultLang); locale != "" {
+			command.Locale = locale
+		}
 	}
 
 	return &command
 }
 
 func (d *GettorDistributor) SupportedPlatforms() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
 	platforms := make([]string, 0, len(platformAliases)+len(d.tblinks))
 	for platform := range platformAliases {
 		platforms = append(platforms, platform)
 	}
-	for platform := range d.tblinks {
-		platforms = append(platforms, platform)
+	for key := range d.tblinks {
+		if product, platform, channel := splitLinksKey(key); product == "" && channel == "" {
+			platforms = append(platforms, platform)
+		}
 	}
 	return platforms
 }
 
+// hasPlatform checks if we have links of the release channel for the platform
+// in any product.  It needs to be called with the lock held.
+func (d *GettorDistributor) hasPlatform(platform string) bool {
+	for key := range d.tblinks {
+		if _, p, channel := splitLinksKey(key); p == platform && channel == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// AvailableProducts returns the sorted list of products other than Tor Browser
+// that we have links for.
+func (d *GettorDistributor) AvailableProducts() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	var products []string
+	for key := range d.tblinks {
+		if product, _, _ := splitLinksKey(key); product != "" && !seen[product] {
+			seen[product] = true
+			products = append(products, product)
+		}
+	}
+	sort.Strings(products)
+	return products
+}
+
+// AvailablePlatforms returns the sorted list of platforms that we have links
+// for, without aliases.
+func (d *GettorDistributor) AvailablePlatforms() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	platforms := make([]string, 0, len(d.tblinks))
+	for key := range d.tblinks {
+		if product, platform, channel := splitLinksKey(key); product == "" && channel == "" {
+			platforms = append(platforms, platform)
+		}
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// MatchLocale returns the supported locale that better matches the language
+// code, like "es" or "pt-BR", or "en-US" if there is none.
+func (d *GettorDistributor) MatchLocale(lang string) string {
+	return d.LocaleChain(lang)[0]
+}
+
+// LocaleChain returns the supported locales that match the language code, from
+// the best match to the worst: the locale itself or its alias, the locales of
+// the same language and last en-US, that is always included.
+func (d *GettorDistributor) LocaleChain(lang string) []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.localeChain(lang)
+}
+
+// localeChain needs to be called with the lock held.
+func (d *GettorDistributor) localeChain(lang string) []string {
+	lang = normalizeLocale(lang)
+	var chain []string
+	seen := make(map[string]bool)
+	add := func(locale string) {
+		if locale != "" && !seen[locale] {
+			seen[locale] = true
+			chain = append(chain, locale)
+		}
+	}
+
+	add(d.exactLocale(lang))
+	prefix := strings.Split(lang, "-")[0]
+	add(d.exactLocale(prefix))
+	var matches []string
+	for l, locale := range d.locales {
+		if strings.HasPrefix(l, prefix+"-") {
+			matches = append(matches, locale)
+		}
+	}
+	sort.Strings(matches)
+	for _, locale := range matches {
+		add(locale)
+	}
+	add(defaultLocale)
+	return chain
+}
+
+// exactLocale returns the supported locale for the language code or its
+// alias, or an empty string if we don't support it.  It needs to be called
+// with the lock held.
+func (d *GettorDistributor) exactLocale(lang string) string {
+	lang = normalizeLocale(lang)
+	if locale, ok := d.locales[lang]; ok {
+		return locale
+	}
+	if alias, ok := localeAliases[lang]; ok {
+		if locale, ok := d.locales[strings.ToLower(alias)]; ok {
+			return locale
+		}
+	}
+	return ""
+}
+
+// parseLocale returns the locale if the word is a supported locale, an alias
+// of one or a language and region code, like fa-IR, of a supported language.
+// It needs to be called with the lock held.
+func (d *GettorDistributor) parseLocale(word string) (string, bool) {
+	if locale := d.exactLocale(word); locale != "" {
+		return locale, true
+	}
+	parts := strings.Split(normalizeLocale(word), "-")
+	if len(parts) == 2 && len(parts[0]) >= 2 && len(parts[1]) >= 2 && d.exactLocale(parts[0]) != "" {
+		return word, true
+	}
+	return "", false
+}
+
+func normalizeLocale(lang string) string {
+	return strings.ToLower(strings.Replace(lang, "_", "-", -1))
+}
+
 func (d *GettorDistributor) SupportedLocales() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
 	locales := make([]string, 0, len(d.locales))
 	for locale := range d.locales {
 		locales = append(locales, locale)
@@ -167,10 +783,33 @@ func (d *GettorDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	defer close(rStream)
 	defer d.ipc.StopStream()
 
+	var checkTicker <-chan time.Time
+	if d.linkCheckInterval != 0 {
+		ticker := time.NewTicker(d.linkCheckInterval)
+		defer ticker.Stop()
+		checkTicker = ticker.C
+	}
+	checkResults := make(chan []linkCheck)
+	checking := false
+
 	for {
 		select {
 		case diff := <-rStream:
 			d.applyDiff(diff)
+		case <-checkTicker:
+			if checking {
+				continue
+			}
+			links := d.sampleLinks(d.linkCheckSample)
+			if len(links) == 0 {
+				continue
+			}
+			checking = true
+			d.wg.Add(1)
+			go d.checkLinks(links, checkResults)
+		case checks := <-checkResults:
+			checking = false
+			d.applyLinkChecks(checks)
 		case <-d.shutdown:
 			log.Printf("Shutting down housekeeping.")
 			return
@@ -183,11 +822,14 @@ func (d *GettorDistributor) Init(cfg *internal.Config) {
 	d.tblinks = make(TBLinkList)
 	d.locales = make(map[string]string)
 	d.version = make(map[string]resources.Version)
+	d.checksumURL = cfg.Distributors.Gettor.ChecksumURL
+	d.linkCheckInterval = time.Duration(cfg.Distributors.Gettor.LinkCheckIntervalMinutes) * time.Minute
+	d.linkCheckSample = cfg.Distributors.Gettor.LinkCheckSample
+	if d.linkCheckSample == 0 {
+		d.linkCheckSample = defaultLinkCheckSample
+	}
 
-	d.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		cfg.Backend.ApiTokens[DistName])
+	d.ipc = internal.NewResourceStreamIpc(cfg, cfg.Distributors.Gettor.Resources, cfg.Backend.ApiTokens[DistName])
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
@@ -205,8 +847,37 @@ func (d *GettorDistributor) Shutdown() {
 	d.wg.Wait()
 }
 
+// Healthz returns an error if the distributor has no links to hand out.
+func (d *GettorDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of links that we hand out, the number of dead links
+// and the number of platforms with links.
+func (d *GettorDistributor) Stats() distributors.Stats {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	links := 0
+	dead := 0
+	for _, locales := range d.tblinks {
+		for _, l := range locales {
+			alive := len(aliveLinks(l))
+			links += alive
+			dead += len(l) - alive
+		}
+	}
+	return distributors.Stats{
+		Resources: map[string]int{resources.ResourceTypeTBLink: links},
+		Counters:  map[string]int{"platforms": len(d.tblinks), "dead_links": dead},
+	}
+}
+
 // applyDiff to tblinks. Ignore changes, links should not change, just appear new or be gone
 func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	needsCleanUp := map[string]struct{}{}
 	for rType, resourceQueue := range diff.New {
 		if rType != "tblink" {
@@ -218,25 +889,29 @@ func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
 				log.Println("Not valid tblink resource", r)
 				continue
 			}
-			version, ok := d.version[link.Platform]
+			link.Platform, link.Arch = link.PlatformArch()
+			link.Channel = linksChannel(link.Channel)
+			link.Product = linksProduct(link.Product)
+			key := linksKey(link.Product, link.Platform, link.Channel)
+			version, ok := d.version[key]
 			if ok {
 				switch version.Compare(link.Version) {
 				case 1:
 					// ignore resources with old versions
 					continue
 				case -1:
-					d.version[link.Platform] = link.Version
-					needsCleanUp[link.Platform] = struct{}{}
+					d.version[key] = link.Version
+					needsCleanUp[key] = struct{}{}
 				}
 			} else {
-				d.version[link.Platform] = link.Version
+				d.version[key] = link.Version
 			}
 
-			_, ok = d.tblinks[link.Platform]
+			_, ok = d.tblinks[key]
 			if !ok {
-				d.tblinks[link.Platform] = make(map[string][]*resources.TBLink)
+				d.tblinks[key] = make(map[string][]*resources.TBLink)
 			}
-			d.tblinks[link.Platform][link.Locale] = append(d.tblinks[link.Platform][link.Locale], link)
+			d.tblinks[key][link.Locale] = append(d.tblinks[key][link.Locale], link)
 
 			d.locales[strings.ToLower(link.Locale)] = link.Locale
 		}
@@ -252,14 +927,16 @@ func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
 				log.Println("Not valid tblink resource", r)
 				continue
 			}
-			_, ok = d.tblinks[link.Platform]
+			link.Platform, link.Arch = link.PlatformArch()
+			key := linksKey(link.Product, link.Platform, link.Channel)
+			_, ok = d.tblinks[key]
 			if !ok {
 				continue
 			}
-			for i, l := range d.tblinks[link.Platform][link.Locale] {
-				if l.Link == link.Link {
-					linklist := d.tblinks[link.Platform][link.Locale]
-					d.tblinks[link.Platform][link.Locale] = append(linklist[:i], linklist[i+1:]...)
+			for i, l := range d.tblinks[key][link.Locale] {
+				if l.Uid() == link.Uid() {
+					linklist := d.tblinks[key][link.Locale]
+					d.tblinks[key][link.Locale] = append(linklist[:i], linklist[i+1:]...)
 					break
 				}
 			}
@@ -271,6 +948,7 @@ func (d *GettorDistributor) applyDiff(diff *core.ResourceDiff) {
 	}
 }
 
+// deleteOldVersions needs to be called with the lock held.
 func (d *GettorDistributor) deleteOldVersions(platform string) {
 	locales := d.tblinks[platform]
 	for locale, res := range locales {
@@ -5,8 +5,14 @@
 package gettor
 
 import (
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+	"errors"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 const (
@@ -14,8 +20,8 @@ const (
 )
 
 func TestDeleteOldVersion(t *testing.T) {
-	lastVersion := resources.Version{1, 0, 0}
-	oldVersion := resources.Version{0, 1, 0}
+	lastVersion := resources.Version{Mayor: 1, Minor: 0, Patch: 0}
+	oldVersion := resources.Version{Mayor: 0, Minor: 1, Patch: 0}
 	newLink := "new"
 	oldLink := "old"
 	dist := GettorDistributor{
@@ -65,3 +71,610 @@ func TestDeleteOldVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchLocale(t *testing.T) {
+	dist := GettorDistributor{
+		locales: map[string]string{
+			"en-us": "en-US",
+			"es-es": "es-ES",
+			"pt-br": "pt-BR",
+			"pt-pt": "pt-PT",
+			"ru":    "ru",
+		},
+	}
+
+	for lang, locale := range map[string]string{
+		"es":    "es-ES",
+		"ES-es": "es-ES",
+		"pt_BR": "pt-BR",
+		"pt":    "pt-BR",
+		"ru-RU": "ru",
+		"zh":    "en-US",
+		"fr":    "en-US",
+		"":      "en-US",
+	} {
+		if l := dist.MatchLocale(lang); l != locale {
+			t.Errorf("Wrong locale for %s: %s", lang, l)
+		}
+	}
+}
+
+func TestParseCommandWithLocale(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: TBLinkList{platform: {}},
+		locales: map[string]string{"es-es": "es-ES"},
+	}
+
+	command := dist.ParseCommandWithLocale(strings.NewReader("windows"), "ru")
+	if command.Command != CommandLinks || command.Platform != platform || command.Locale != "ru" {
+		t.Errorf("Wrong command: %v", command)
+	}
+	command = dist.ParseCommandWithLocale(strings.NewReader("windows es-ES"), "ru")
+	if command.Locale != "es-ES" {
+		t.Errorf("Wrong locale: %s", command.Locale)
+	}
+}
+
+func TestParseCommandSubcommands(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: TBLinkList{platform: {}},
+		locales: map[string]string{"es-es": "es-ES"},
+	}
+
+	for body, expected := range map[string]struct {
+		command  string
+		platform string
+		version  string
+		err      error
+	}{
+		"windows":                  {CommandLinks, platform, "", nil},
+		"windows version 12.0.1":   {CommandLinks, platform, "12.0.1", nil},
+		"version 12.0 windows":     {CommandLinks, platform, "12.0.0", nil},
+		"windows signature":        {CommandSignature, platform, "", nil},
+		"sig windows es-ES":        {CommandSignature, platform, "", nil},
+		"windows asc version 11.5": {CommandSignature, platform, "11.5.0", nil},
+		"checksum":                 {CommandChecksum, "", "", nil},
+		"checksums version 12.0.1": {CommandChecksum, "", "12.0.1", nil},
+		"signature":                {CommandHelp, "", "", MissingPlatformError},
+		"windows version":          {CommandHelp, platform, "", MissingVersionError},
+		"windows version latest":   {CommandHelp, platform, "", InvalidVersionError},
+		"windows version 12":       {CommandHelp, platform, "", InvalidVersionError},
+		"windows version 1.2.3.4":  {CommandHelp, platform, "", InvalidVersionError},
+		"hello":                    {CommandHelp, "", "", nil},
+		"links windows torrent":    {CommandLinks, platform, "", nil},
+	} {
+		command := dist.ParseCommand(strings.NewReader(body))
+		if command.Command != expected.command {
+			t.Errorf("Wrong command for %q: %s", body, command.Command)
+		}
+		if command.Platform != expected.platform {
+			t.Errorf("Wrong platform for %q: %s", body, command.Platform)
+		}
+		if !errors.Is(command.Error, expected.err) {
+			t.Errorf("Wrong error for %q: %v", body, command.Error)
+		}
+		if expected.version == "" {
+			if command.Version != nil && command.Error == nil {
+				t.Errorf("Unexpected version for %q: %s", body, command.Version)
+			}
+		} else if command.Version == nil || command.Version.String() != expected.version {
+			t.Errorf("Wrong version for %q: %v", body, command.Version)
+		}
+		if command.Torrent != strings.Contains(body, "torrent") {
+			t.Errorf("Wrong torrent for %q: %v", body, command.Torrent)
+		}
+	}
+}
+
+func TestVersionLinks(t *testing.T) {
+	version := resources.Version{Mayor: 12, Minor: 0, Patch: 0}
+	dist := GettorDistributor{
+		version: map[string]resources.Version{
+			platform:  version,
+			"linux64": {Mayor: 11, Minor: 5, Patch: 8},
+		},
+		tblinks: TBLinkList{
+			platform: {"en-US": {&resources.TBLink{Link: "link", Version: version}}},
+		},
+	}
+
+	if err := dist.CheckVersion(&Command{Platform: platform, Version: &version}); err != nil {
+		t.Errorf("The latest version is not available: %v", err)
+	}
+	if err := dist.CheckVersion(&Command{Platform: platform}); err != nil {
+		t.Errorf("No version is not available: %v", err)
+	}
+	err := dist.CheckVersion(&Command{Platform: platform, Version: &resources.Version{Mayor: 11, Minor: 5, Patch: 8}})
+	if !errors.Is(err, VersionNotAvailableError) {
+		t.Errorf("Old version available: %v", err)
+	}
+
+	latest, ok := dist.LatestVersion("", "", "")
+	if !ok || latest.Compare(version) != 0 {
+		t.Errorf("Wrong latest version: %s", latest)
+	}
+
+	checksum, signature := dist.GetChecksumLinks(version)
+	if checksum != DefaultChecksumURL+"12.0/sha256sums-signed-build.txt" {
+		t.Errorf("Wrong checksum link: %s", checksum)
+	}
+	if signature != checksum+".asc" {
+		t.Errorf("Wrong checksum signature link: %s", signature)
+	}
+	checksum, _ = dist.GetChecksumLinks(resources.Version{Mayor: 12, Minor: 0, Patch: 1})
+	if checksum != DefaultChecksumURL+"12.0.1/sha256sums-signed-build.txt" {
+		t.Errorf("Wrong checksum link: %s", checksum)
+	}
+}
+
+func TestLocaleChain(t *testing.T) {
+	dist := GettorDistributor{
+		locales: map[string]string{
+			"en-us": "en-US",
+			"es-ar": "es-AR",
+			"es-es": "es-ES",
+			"fa":    "fa",
+			"pt-br": "pt-BR",
+			"zh-cn": "zh-CN",
+			"zh-tw": "zh-TW",
+		},
+	}
+
+	for lang, chain := range map[string][]string{
+		"es-ES":   {"es-ES", "es-AR", "en-US"},
+		"es-MX":   {"es-ES", "es-AR", "en-US"},
+		"fa-IR":   {"fa", "en-US"},
+		"pt":      {"pt-BR", "en-US"},
+		"pt-PT":   {"pt-BR", "en-US"},
+		"zh-Hant": {"zh-TW", "zh-CN", "en-US"},
+		"fr":      {"en-US"},
+	} {
+		if c := dist.LocaleChain(lang); strings.Join(c, ",") != strings.Join(chain, ",") {
+			t.Errorf("Wrong chain for %s: %v", lang, c)
+		}
+	}
+}
+
+func TestFindLinks(t *testing.T) {
+	link := func(locale string) []*resources.TBLink {
+		return []*resources.TBLink{{Link: locale, Locale: locale}}
+	}
+	dist := GettorDistributor{
+		tblinks: TBLinkList{
+			platform: {
+				"en-US": link("en-US"),
+				"fa":    link("fa"),
+				"pt-BR": link("pt-BR"),
+			},
+			"linux64": {
+				"en-US": link("en-US"),
+			},
+		},
+		locales: map[string]string{
+			"en-us": "en-US",
+			"fa":    "fa",
+			"pt-br": "pt-BR",
+		},
+	}
+
+	for _, tc := range []struct {
+		platform string
+		lang     string
+		locale   string
+		fallback bool
+	}{
+		{platform, "pt-BR", "pt-BR", false},
+		{platform, "pt", "pt-BR", false},
+		{platform, "fa-IR", "fa", true},
+		{platform, "fr", "en-US", true},
+		{platform, "", "en-US", false},
+		{"linux64", "fa", "en-US", true},
+	} {
+		links, locale, fallback := dist.FindLinks(&Command{Platform: tc.platform, Locale: tc.lang})
+		if len(links) != 1 || locale != tc.locale || fallback != tc.fallback {
+			t.Errorf("Wrong links for %s %s: %v %s %v", tc.platform, tc.lang, links, locale, fallback)
+		}
+	}
+
+	links, _, _ := dist.FindLinks(&Command{Platform: "osx64", Locale: "en-US"})
+	if len(links) != 0 {
+		t.Errorf("Links for a platform we don't have: %v", links)
+	}
+}
+
+func TestParseCommandLocale(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: TBLinkList{platform: {}},
+		locales: map[string]string{"fa": "fa", "pt-br": "pt-BR"},
+	}
+
+	for body, locale := range map[string]string{
+		"windows pt":    "pt-BR",
+		"windows pt-BR": "pt-BR",
+		"windows fa-IR": "fa-ir",
+		"windows fr":    "en-US",
+		"windows":       "en-US",
+	} {
+		command := dist.ParseCommand(strings.NewReader(body))
+		if command.Locale != locale {
+			t.Errorf("Wrong locale for %q: %s", body, command.Locale)
+		}
+	}
+}
+
+func TestAndroidArch(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: make(TBLinkList),
+		locales: make(map[string]string),
+		version: make(map[string]resources.Version),
+	}
+
+	diff := core.NewResourceDiff()
+	for _, platform := range []string{"android-aarch64", "android-armv7", "android-x86_64", "win32"} {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Locale = "en-US"
+		link.Link = platform
+		link.Version = resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+		diff.New[resources.ResourceTypeTBLink] = append(diff.New[resources.ResourceTypeTBLink], link)
+	}
+	dist.applyDiff(diff)
+
+	if platforms := dist.AvailablePlatforms(); strings.Join(platforms, ",") != "android,win32" {
+		t.Fatalf("Wrong platforms: %v", platforms)
+	}
+
+	for body, expected := range map[string]struct {
+		platform string
+		arch     string
+		links    []string
+	}{
+		"android":                 {"android", "", []string{"android-aarch64", "android-armv7", "android-x86_64"}},
+		"android aarch64":         {"android", "aarch64", []string{"android-aarch64"}},
+		"arm64-v8a android":       {"android", "aarch64", []string{"android-aarch64"}},
+		"android-armv7":           {"android", "armv7", []string{"android-armv7"}},
+		"android x86_64 es":       {"android", "x86_64", []string{"android-x86_64"}},
+		"android x86":             {"android", "x86", nil},
+		"windows x86_64":          {"win32", "x86_64", []string{"win32"}},
+		"android aarch64 version": {"android", "aarch64", nil},
+	} {
+		command := dist.ParseCommand(strings.NewReader(body))
+		if command.Platform != expected.platform || command.Arch != expected.arch {
+			t.Errorf("Wrong platform for %q: %s %s", body, command.Platform, command.Arch)
+			continue
+		}
+		if command.Command != CommandLinks {
+			continue
+		}
+		links, _, _ := dist.FindLinks(command)
+		var found []string
+		for _, link := range links {
+			found = append(found, link.Link)
+		}
+		sort.Strings(found)
+		if strings.Join(found, ",") != strings.Join(expected.links, ",") {
+			t.Errorf("Wrong links for %q: %v", body, found)
+		}
+	}
+
+	diff = core.NewResourceDiff()
+	link := resources.NewTBLink()
+	link.Platform = "android-armv7"
+	link.Locale = "en-US"
+	link.Link = "android-armv7"
+	diff.Gone[resources.ResourceTypeTBLink] = []core.Resource{link}
+	dist.applyDiff(diff)
+	links, _, _ := dist.FindLinks(&Command{Platform: "android", Arch: "armv7", Locale: "en-US"})
+	if len(links) != 0 {
+		t.Errorf("The armv7 link was not removed: %v", links)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: make(TBLinkList),
+		locales: make(map[string]string),
+		version: make(map[string]resources.Version),
+	}
+
+	newLink := func(channel string, version resources.Version) *resources.TBLink {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Locale = "en-US"
+		link.Channel = channel
+		link.Version = version
+		link.Link = channel + version.String()
+		return link
+	}
+	release := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	alpha := resources.Version{Mayor: 12, Minor: 5, Pre: "a1"}
+	diff := core.NewResourceDiff()
+	diff.New[resources.ResourceTypeTBLink] = []core.Resource{
+		newLink("", release),
+		newLink(resources.ChannelAlpha, alpha),
+		newLink(resources.ChannelAlpha, resources.Version{Mayor: 12, Minor: 0, Pre: "a5"}),
+	}
+	dist.applyDiff(diff)
+
+	if platforms := dist.AvailablePlatforms(); len(platforms) != 1 || platforms[0] != platform {
+		t.Errorf("Wrong platforms: %v", platforms)
+	}
+
+	for body, expected := range map[string]struct {
+		channel string
+		link    string
+	}{
+		"windows":              {"", release.String()},
+		"links windows stable": {"", release.String()},
+		"windows alpha":        {resources.ChannelAlpha, resources.ChannelAlpha + alpha.String()},
+		"links windows alpha":  {resources.ChannelAlpha, resources.ChannelAlpha + alpha.String()},
+		"nightly windows":      {resources.ChannelNightly, ""},
+	} {
+		command := dist.ParseCommand(strings.NewReader(body))
+		if command.Command != CommandLinks || command.Channel != expected.channel {
+			t.Errorf("Wrong command for %q: %s %s", body, command.Command, command.Channel)
+			continue
+		}
+		links, _, _ := dist.FindLinks(command)
+		if expected.link == "" {
+			if len(links) != 0 {
+				t.Errorf("Unexpected links for %q: %v", body, links)
+			}
+		} else if len(links) != 1 || links[0].Link != expected.link {
+			t.Errorf("Wrong links for %q: %v", body, links)
+		}
+	}
+
+	command := dist.ParseCommand(strings.NewReader("windows alpha version 12.5a1"))
+	if command.Error != nil || dist.CheckVersion(command) != nil {
+		t.Errorf("The alpha version is not available: %v", command.Error)
+	}
+	command = dist.ParseCommand(strings.NewReader("links alpha"))
+	if !errors.Is(command.Error, MissingPlatformError) {
+		t.Errorf("Wrong error for links without platform: %v", command.Error)
+	}
+
+	latest, ok := dist.LatestVersion("", "", resources.ChannelAlpha)
+	if !ok || latest.Compare(alpha) != 0 {
+		t.Errorf("Wrong latest alpha version: %s", latest)
+	}
+	latest, ok = dist.LatestVersion("", "", "")
+	if !ok || latest.Compare(release) != 0 {
+		t.Errorf("Wrong latest version: %s", latest)
+	}
+	checksum, _ := dist.GetChecksumLinks(alpha)
+	if checksum != DefaultChecksumURL+"12.5a1/sha256sums-signed-build.txt" {
+		t.Errorf("Wrong checksum link: %s", checksum)
+	}
+}
+
+func TestProducts(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: make(TBLinkList),
+		locales: make(map[string]string),
+		version: make(map[string]resources.Version),
+	}
+
+	newLink := func(product, platform string, version resources.Version) *resources.TBLink {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Locale = "en-US"
+		link.Product = product
+		link.Version = version
+		link.Link = product + platform
+		return link
+	}
+	release := resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+	orbot := resources.Version{Mayor: 17, Minor: 2, Patch: 1}
+	diff := core.NewResourceDiff()
+	diff.New[resources.ResourceTypeTBLink] = []core.Resource{
+		newLink("", platform, release),
+		newLink(resources.ProductTorExpertBundle, platform, release),
+		newLink(resources.ProductOrbot, "android-aarch64", orbot),
+	}
+	dist.applyDiff(diff)
+
+	if platforms := dist.AvailablePlatforms(); len(platforms) != 1 || platforms[0] != platform {
+		t.Errorf("Wrong platforms: %v", platforms)
+	}
+	if products := dist.AvailableProducts(); len(products) != 2 || products[0] != resources.ProductOrbot {
+		t.Errorf("Wrong products: %v", products)
+	}
+
+	for body, expected := range map[string]struct {
+		product string
+		link    string
+	}{
+		"windows":                   {"", platform},
+		"windows tor-expert-bundle": {resources.ProductTorExpertBundle, resources.ProductTorExpertBundle + platform},
+		"get orbot android":         {resources.ProductOrbot, resources.ProductOrbot + "android-aarch64"},
+		"android orbot aarch64":     {resources.ProductOrbot, resources.ProductOrbot + "android-aarch64"},
+		"orbot windows":             {resources.ProductOrbot, ""},
+	} {
+		command := dist.ParseCommand(strings.NewReader(body))
+		if command.Command != CommandLinks || command.Product != expected.product {
+			t.Errorf("Wrong command for %q: %s %s", body, command.Command, command.Product)
+			continue
+		}
+		links, _, _ := dist.FindLinks(command)
+		if expected.link == "" {
+			if len(links) != 0 {
+				t.Errorf("Unexpected links for %q: %v", body, links)
+			}
+		} else if len(links) != 1 || links[0].Link != expected.link {
+			t.Errorf("Wrong links for %q: %v", body, links)
+		}
+	}
+
+	latest, ok := dist.LatestVersion(resources.ProductOrbot, "", "")
+	if !ok || latest.Compare(orbot) != 0 {
+		t.Errorf("Wrong latest Orbot version: %s", latest)
+	}
+	latest, ok = dist.LatestVersion("", "", "")
+	if !ok || latest.Compare(release) != 0 {
+		t.Errorf("Wrong latest version: %s", latest)
+	}
+}
+
+func TestListLinks(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: make(TBLinkList),
+		locales: make(map[string]string),
+		version: make(map[string]resources.Version),
+	}
+
+	newLink := func(platform, channel, locale, provider string) *resources.TBLink {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Locale = locale
+		link.Channel = channel
+		link.Provider = provider
+		link.Version = resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+		link.Link = strings.Join([]string{platform, channel, locale, provider}, "/")
+		return link
+	}
+	diff := core.NewResourceDiff()
+	diff.New[resources.ResourceTypeTBLink] = []core.Resource{
+		newLink(platform, "", "es-ES", "github"),
+		newLink(platform, "", "en-US", "gitlab"),
+		newLink(platform, "", "en-US", "github"),
+		newLink("linux64", "", "en-US", "github"),
+		newLink(platform, resources.ChannelAlpha, "en-US", "github"),
+	}
+	dist.applyDiff(diff)
+
+	for filter, expected := range map[LinksFilter][]string{
+		{}: {
+			"linux64//en-US/github",
+			"win32//en-US/github",
+			"win32//en-US/gitlab",
+			"win32//es-ES/github",
+			"win32/alpha/en-US/github",
+		},
+		{Platform: platform, Channel: resources.ChannelRelease, Locale: "en-us"}: {
+			"win32//en-US/github",
+			"win32//en-US/gitlab",
+		},
+		{Provider: "gitlab"}:                                        {"win32//en-US/gitlab"},
+		{Channel: resources.ChannelAlpha}:                           {"win32/alpha/en-US/github"},
+		{Product: resources.ProductOrbot}:                           {},
+		{Product: resources.ProductTorBrowser, Platform: "linux64"}: {"linux64//en-US/github"},
+	} {
+		links := dist.ListLinks(filter)
+		if len(links) != len(expected) {
+			t.Errorf("Wrong links for %+v: %v", filter, links)
+			continue
+		}
+		for i, link := range links {
+			if link.Link != expected[i] {
+				t.Errorf("Wrong link %d for %+v: %s", i, filter, link.Link)
+			}
+		}
+	}
+
+	// the listed links are copies
+	links := dist.ListLinks(LinksFilter{Provider: "gitlab"})
+	links[0].Link = "modified"
+	if link := dist.ListLinks(LinksFilter{Provider: "gitlab"})[0]; link.Link != "win32//en-US/gitlab" {
+		t.Errorf("Modifying a listed link modified the distributor's link: %s", link.Link)
+	}
+
+	// listing links while the housekeeping updates them is safe
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			dist.ListLinks(LinksFilter{})
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		diff := core.NewResourceDiff()
+		diff.New[resources.ResourceTypeTBLink] = []core.Resource{newLink(platform, "", "es-ES", "gitlab")}
+		dist.applyDiff(diff)
+		dist.applyLinkChecks([]linkCheck{{link: links[0]}})
+	}
+	<-done
+}
+
+func TestGetChecksums(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: make(TBLinkList),
+		locales: make(map[string]string),
+		version: make(map[string]resources.Version),
+	}
+
+	newLink := func(platform, channel, fileName, checksum string) *resources.TBLink {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Locale = "en-US"
+		link.Channel = channel
+		link.Version = resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+		link.FileName = fileName
+		link.Link = "https://example.com/" + fileName
+		link.Checksum = checksum
+		return link
+	}
+	diff := core.NewResourceDiff()
+	diff.New[resources.ResourceTypeTBLink] = []core.Resource{
+		newLink(platform, "", "torbrowser-install.exe", "aaaa"),
+		newLink("linux64", "", "tor-browser-linux64.tar.xz", "bbbb"),
+		newLink("osx64", "", "TorBrowser.dmg", ""),
+		newLink(platform, resources.ChannelAlpha, "torbrowser-install-alpha.exe", "cccc"),
+	}
+	dist.applyDiff(diff)
+
+	for body, expected := range map[string]map[string]string{
+		"checksums windows": {"torbrowser-install.exe": "aaaa"},
+		"checksums": {
+			"torbrowser-install.exe":     "aaaa",
+			"tor-browser-linux64.tar.xz": "bbbb",
+		},
+		"checksums alpha":                  {"torbrowser-install-alpha.exe": "cccc"},
+		"checksums osx":                    {},
+		"checksums windows version 12.0.2": {},
+	} {
+		command := dist.ParseCommand(strings.NewReader(body))
+		if command.Command != CommandChecksum {
+			t.Errorf("Wrong command for %q: %s", body, command.Command)
+			continue
+		}
+		checksums := dist.GetChecksums(command)
+		if len(checksums) != len(expected) {
+			t.Errorf("Wrong checksums for %q: %v", body, checksums)
+			continue
+		}
+		for fileName, checksum := range expected {
+			if checksums[fileName] != checksum {
+				t.Errorf("Wrong checksum of %s for %q: %s", fileName, body, checksums[fileName])
+			}
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dist := GettorDistributor{
+		tblinks: TBLinkList{
+			platform: {
+				"en-US": {
+					{Link: "a", Provider: "GitLab", Platform: platform},
+					{Link: "b", Provider: "S3", Platform: platform},
+				},
+			},
+		},
+		locales: map[string]string{"en-us": "en-US"},
+	}
+
+	missingVersion := parseErrorsCount.WithLabelValues("missing_version")
+	before := testutil.ToFloat64(missingVersion)
+	dist.ParseCommand(strings.NewReader("windows version"))
+	if testutil.ToFloat64(missingVersion) != before+1 {
+		t.Errorf("The parse error was not counted")
+	}
+
+	gitlab := servedLinksCount.WithLabelValues("GitLab", platform)
+	before = testutil.ToFloat64(gitlab)
+	dist.FindLinks(&Command{Platform: platform, Locale: "en-US"})
+	if testutil.ToFloat64(gitlab) != before+1 {
+		t.Errorf("The served link was not counted")
+	}
+}
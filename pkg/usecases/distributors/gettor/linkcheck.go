@@ -0,0 +1,171 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	defaultLinkCheckSample = 20
+	linkCheckTimeout       = 30 * time.Second
+
+	linkAlive = "alive"
+	linkDead  = "dead"
+)
+
+var linkCheckCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gettor_link_check_total",
+	Help: "The total number of gettor links checked, by provider and result",
+},
+	[]string{"provider", "result"},
+)
+
+// linkCheck is the result of checking if a link can be downloaded, err is nil
+// if it can.
+type linkCheck struct {
+	link *resources.TBLink
+	err  error
+}
+
+// isAlive returns false if the last check of the link failed.
+func isAlive(link *resources.TBLink) bool {
+	test := link.TestResult()
+	return test == nil || test.State != core.StateDysfunctional
+}
+
+// aliveLinks returns the links that didn't fail their last check.
+func aliveLinks(links []*resources.TBLink) []*resources.TBLink {
+	alive := make([]*resources.TBLink, 0, len(links))
+	for _, link := range links {
+		if isAlive(link) {
+			alive = append(alive, link)
+		}
+	}
+	return alive
+}
+
+// sampleLinks returns up to n random links of all the ones we have, including
+// the dead ones so they come back if the provider recovers.
+func (d *GettorDistributor) sampleLinks(n int) []*resources.TBLink {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var links []*resources.TBLink
+	for _, locales := range d.tblinks {
+		for _, l := range locales {
+			links = append(links, l...)
+		}
+	}
+	rand.Shuffle(len(links), func(i, j int) { links[i], links[j] = links[j], links[i] })
+	if len(links) > n {
+		links = links[:n]
+	}
+	return links
+}
+
+// checkLinks requests the links and sends the results to the housekeeping.  It
+// gives up if the distributor shuts down.
+func (d *GettorDistributor) checkLinks(links []*resources.TBLink, results chan<- []linkCheck) {
+	defer d.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	checks := make([]linkCheck, 0, len(links))
+	for _, link := range links {
+		checks = append(checks, linkCheck{link: link, err: checkLink(ctx, link.Link)})
+	}
+	select {
+	case results <- checks:
+	case <-d.shutdown:
+	}
+}
+
+// checkLink does a HEAD request to the url and returns an error if it doesn't
+// succeed.  Some providers only sign their links for GET, like S3, if they
+// don't accept the HEAD the first byte is requested instead.
+func checkLink(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, linkCheckTimeout)
+	defer cancel()
+
+	status, err := requestLink(ctx, http.MethodHead, url)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		status, err = requestLink(ctx, http.MethodGet, url)
+		if err != nil {
+			return err
+		}
+	}
+	if status >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status: %d %s", status, http.StatusText(status))
+	}
+	return nil
+}
+
+func requestLink(ctx context.Context, method, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// applyLinkChecks marks the links that failed as dysfunctional, so they are not
+// handed out, and the ones that succeed as functional.
+func (d *GettorDistributor) applyLinkChecks(checks []linkCheck) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	for _, c := range checks {
+		state := core.StateFunctional
+		result := linkAlive
+		errStr := ""
+		if c.err != nil {
+			log.Printf("Link %s of %s is dead: %v", c.link.Link, c.link.Provider, c.err)
+			state = core.StateDysfunctional
+			result = linkDead
+			errStr = c.err.Error()
+		} else if !isAlive(c.link) {
+			log.Printf("Link %s of %s is alive again", c.link.Link, c.link.Provider)
+		}
+		linkCheckCount.WithLabelValues(c.link.Provider, result).Inc()
+
+		if test := c.link.TestResult(); test != nil {
+			test.State = state
+			test.LastTested = now
+			test.Error = errStr
+		}
+	}
+}
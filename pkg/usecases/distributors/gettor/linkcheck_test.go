@@ -0,0 +1,79 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gettor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+func TestLinkCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alive.exe":
+		case "/get-only.exe":
+			// like the links signed only for GET
+			if r.Method != http.MethodGet || r.Header.Get("Range") != "bytes=0-0" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusPartialContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	dist := GettorDistributor{
+		tblinks: make(TBLinkList),
+		locales: make(map[string]string),
+		version: make(map[string]resources.Version),
+	}
+	diff := core.NewResourceDiff()
+	for _, fileName := range []string{"alive.exe", "get-only.exe", "dead.exe"} {
+		link := resources.NewTBLink()
+		link.Platform = platform
+		link.Locale = "en-US"
+		link.Provider = "github"
+		link.Version = resources.Version{Mayor: 12, Minor: 0, Patch: 1}
+		link.Link = ts.URL + "/" + fileName
+		diff.New[resources.ResourceTypeTBLink] = append(diff.New[resources.ResourceTypeTBLink], link)
+	}
+	dist.applyDiff(diff)
+
+	links := dist.sampleLinks(2)
+	if len(links) != 2 {
+		t.Fatal("Wrong number of sampled links:", len(links))
+	}
+	links = dist.sampleLinks(defaultLinkCheckSample)
+	checks := make([]linkCheck, 0, len(links))
+	for _, link := range links {
+		checks = append(checks, linkCheck{link: link, err: checkLink(context.Background(), link.Link)})
+	}
+	dist.applyLinkChecks(checks)
+
+	links = dist.GetLinks(platform, "en-US")
+	if len(links) != 2 {
+		t.Fatal("Wrong number of alive links:", links)
+	}
+	for _, link := range links {
+		if link.Link == ts.URL+"/dead.exe" {
+			t.Error("Dead link handed out:", link.Link)
+		}
+	}
+	command := dist.ParseCommand(strings.NewReader("windows"))
+	if found, _, _ := dist.FindLinks(command); len(found) != 2 {
+		t.Error("Wrong number of links found:", found)
+	}
+	if stats := dist.Stats(); stats.Resources[resources.ResourceTypeTBLink] != 2 || stats.Counters["dead_links"] != 1 {
+		t.Error("Wrong stats:", stats)
+	}
+}
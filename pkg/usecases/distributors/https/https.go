@@ -5,15 +5,18 @@
 package https
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net"
 	"sync"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/exposure"
 )
 
 const (
@@ -25,9 +28,15 @@ const (
 type HttpsDistributor struct {
 	ring     *core.Hashring
 	ipc      delivery.Mechanism
+	reporter *exposure.Reporter
 	cfg      *internal.Config
 	wg       sync.WaitGroup
 	shutdown chan bool
+
+	// CountryFromIP locates the requester to avoid handing out bridges
+	// hosted in its country.  Bridges are handed out regardless of their
+	// location if nil.
+	CountryFromIP func(ip net.IP) string
 }
 
 // housekeeping keeps track of periodic tasks.
@@ -49,15 +58,58 @@ func (d *HttpsDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 }
 
 // RequestBridges takes as input a hashkey (it is the frontend's responsibility
-// to derive the hashkey) and uses it to return a slice of resources.
-func (d *HttpsDistributor) RequestBridges(key core.Hashkey) ([]core.Resource, error) {
+// to derive the hashkey), the requester's ip and the transport it asks for, and
+// uses them to return a slice of resources.  Any transport is handed out if
+// transport is empty.  No resources are handed out if the given context is
+// done, e.g. because the requester went away.
+func (d *HttpsDistributor) RequestBridges(ctx context.Context, key core.Hashkey, ip net.IP, transport string) ([]core.Resource, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ring := d.ring
+	if transport != "" {
+		ring = ring.Filter(core.OfType(transport))
+	}
+	if d.cfg.Distributors.Https.ExcludeSameCountry && d.CountryFromIP != nil && ip != nil {
+		if country := d.CountryFromIP(ip); country != "" {
+			ring = ring.Filter(core.NotHostedIn(country))
+		}
+	}
+	if ring.Len() == 0 {
+		return nil, errors.New("no bridges available")
+	}
+
+	resources, err := ring.GetMany(key, 1)
+	d.reporter.Record(resources)
+	return resources, err
+}
+
+// SupportedTransports returns the transports that can be requested.
+func (d *HttpsDistributor) SupportedTransports() []string {
+	return d.cfg.Distributors.Https.Resources
+}
+
+// RequestFlyerBridges returns num resources for the given hashkey, to be
+// printed in a flyer.  No resources are handed out if the given context is
+// done.
+func (d *HttpsDistributor) RequestFlyerBridges(ctx context.Context, key core.Hashkey, num int) ([]core.Resource, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	if d.ring.Len() == 0 {
 		return nil, errors.New("no bridges available")
 	}
 
-	r, err := d.ring.Get(key)
-	return []core.Resource{r}, err
+	if num > d.ring.Len() {
+		num = d.ring.Len()
+	}
+	resources, err := d.ring.GetMany(key, num)
+	d.reporter.Record(resources)
+	return resources, err
 }
 
 // Init initialises the given HTTPS distributor.
@@ -69,10 +121,7 @@ func (d *HttpsDistributor) Init(cfg *internal.Config) {
 	d.ring = core.NewHashring()
 
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		d.cfg.Backend.ApiTokens[DistName])
+	d.ipc = internal.NewResourceStreamIpc(cfg, d.cfg.Distributors.Https.Resources, d.cfg.Backend.ApiTokens[DistName])
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
@@ -83,6 +132,9 @@ func (d *HttpsDistributor) Init(cfg *internal.Config) {
 
 	d.wg.Add(1)
 	go d.housekeeping(rStream)
+
+	d.reporter = exposure.NewReporter(cfg, DistName, d.ring)
+	d.reporter.Start()
 }
 
 // Shutdown shuts down the given HTTPS distributor.
@@ -92,4 +144,15 @@ func (d *HttpsDistributor) Shutdown() {
 	// Signal to housekeeping that it's time to stop.
 	close(d.shutdown)
 	d.wg.Wait()
+	d.reporter.Stop()
+}
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *HttpsDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in the hashring.
+func (d *HttpsDistributor) Stats() distributors.Stats {
+	return distributors.Stats{Resources: distributors.CountResources(d.ring)}
 }
@@ -5,20 +5,31 @@
 package i2phttps
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
 )
 
 const (
 	DistName             = "i2p"
 	BridgeReloadInterval = time.Minute * 10
+
+	// PoolI2P and PoolClearnet are the pools of resources handed out to the
+	// requests over I2P and over the clearnet
+	PoolI2P      = "i2p"
+	PoolClearnet = "clearnet"
+
+	defaultClearnetFraction = 0.2
 )
 
 // I2PHttpsDistributor contains all the context that the distributor needs to run.
@@ -28,6 +39,20 @@ type I2PHttpsDistributor struct {
 	cfg      *internal.Config
 	wg       sync.WaitGroup
 	shutdown chan bool
+
+	subscriptions     subscriptionState
+	subscriptionsLock sync.Mutex
+	// subscriptionsDirty tells if the subscriptions changed since they were
+	// saved
+	subscriptionsDirty bool
+	// newSubscriptions counts the destinations that subscribed in the
+	// rotation period newSubscriptionsPeriod
+	newSubscriptions       int
+	newSubscriptionsPeriod int64
+
+	// SubscriptionStore keeps the subscribers of the update channel
+	// across restarts
+	SubscriptionStore persistence.Mechanism
 }
 
 // housekeeping keeps track of periodic tasks.
@@ -37,29 +62,87 @@ func (d *I2PHttpsDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	defer close(rStream)
 	defer d.ipc.StopStream()
 
+	ticker := time.NewTicker(SubscriptionsSaveInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case diff := <-rStream:
 			d.ring.ApplyDiff(diff)
+		case <-ticker.C:
+			d.saveDirtySubscriptions()
 		case <-d.shutdown:
 			log.Printf("Shutting down housekeeping.")
+			d.saveDirtySubscriptions()
 			return
 		}
 	}
 }
 
 // RequestBridges takes as input a hashkey (it is the frontend's responsibility
-// to derive the hashkey) and uses it to return a slice of resources.
-func (d *I2PHttpsDistributor) RequestBridges(key core.Hashkey) ([]core.Resource, error) {
+// to derive the hashkey), the pool of the request and the transport the
+// requester asks for, and uses them to return a slice of resources.  Any
+// transport is handed out if transport is empty.  No resources are handed out
+// if the given context is done.
+func (d *I2PHttpsDistributor) RequestBridges(ctx context.Context, key core.Hashkey, pool, transport string) ([]core.Resource, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	if d.ring.Len() == 0 {
+	ring := d.poolRing(pool)
+	if transport != "" {
+		ring = ring.Filter(core.OfType(transport))
+	}
+	if ring.Len() == 0 {
 		return nil, errors.New("no bridges available")
 	}
 
-	r, err := d.ring.Get(key)
+	r, err := ring.Get(key)
 	return []core.Resource{r}, err
 }
 
+// poolRing returns the hashring of the resources of the pool.  If the clearnet
+// is not served all the resources are in the I2P pool.
+func (d *I2PHttpsDistributor) poolRing(pool string) *core.Hashring {
+	if d.cfg.Distributors.I2P.ClearnetApi.ApiAddress == "" {
+		return d.ring
+	}
+	clearnet := pool == PoolClearnet
+	fraction := d.clearnetFraction()
+	return d.ring.Filter(func(r core.Resource) bool {
+		return inClearnetPool(r, fraction) == clearnet
+	})
+}
+
+func (d *I2PHttpsDistributor) clearnetFraction() float64 {
+	fraction := d.cfg.Distributors.I2P.ClearnetFraction
+	if fraction <= 0 || fraction >= 1 {
+		return defaultClearnetFraction
+	}
+	return fraction
+}
+
+// inClearnetPool decides the pool of the resource from its unique ID, so it
+// stays in the same pool while its address changes.
+func inClearnetPool(r core.Resource, fraction float64) bool {
+	h := core.NewHashkey(fmt.Sprintf("%s-pool-%d", DistName, r.Uid()))
+	return float64(h%10000) < fraction*10000
+}
+
+// DestinationHashkey returns the hash key of the requester's I2P destination,
+// its base32 address.  It's salted with the rotation period, so a destination
+// gets the same bridges during a period and new ones in the next.
+func (d *I2PHttpsDistributor) DestinationHashkey(destination string, now time.Time) core.Hashkey {
+	destination = strings.ToLower(strings.TrimSpace(destination))
+	return core.NewHashkey(fmt.Sprintf("%s-%d", destination, d.period(now)))
+}
+
+// SupportedTransports returns the transports that can be requested.
+func (d *I2PHttpsDistributor) SupportedTransports() []string {
+	return d.cfg.Distributors.I2P.Resources
+}
+
 // Init initialises the given HTTPS distributor.
 func (d *I2PHttpsDistributor) Init(cfg *internal.Config) {
 	log.Printf("Initialising %s distributor.", DistName)
@@ -67,16 +150,14 @@ func (d *I2PHttpsDistributor) Init(cfg *internal.Config) {
 	d.cfg = cfg
 	d.shutdown = make(chan bool)
 	d.ring = core.NewHashring()
+	d.loadSubscriptions()
 
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		d.cfg.Backend.ApiTokens[DistName])
+	d.ipc = internal.NewResourceStreamIpc(cfg, d.cfg.Distributors.I2P.Resources, d.cfg.Backend.ApiTokens[DistName])
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
-		ResourceTypes: d.cfg.Distributors.Https.Resources,
+		ResourceTypes: d.cfg.Distributors.I2P.Resources,
 		Receiver:      rStream,
 	}
 	d.ipc.StartStream(&req)
@@ -93,3 +174,21 @@ func (d *I2PHttpsDistributor) Shutdown() {
 	close(d.shutdown)
 	d.wg.Wait()
 }
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *I2PHttpsDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in the hashring and the
+// number of subscribers of the update channel.
+func (d *I2PHttpsDistributor) Stats() distributors.Stats {
+	d.subscriptionsLock.Lock()
+	subscribers := len(d.subscriptions.Subscribers)
+	d.subscriptionsLock.Unlock()
+
+	return distributors.Stats{
+		Resources: distributors.CountResources(d.ring),
+		Counters:  map[string]int{"subscribers": subscribers},
+	}
+}
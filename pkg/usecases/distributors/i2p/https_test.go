@@ -0,0 +1,69 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestPools(t *testing.T) {
+	d := initDistributor()
+	for i := 10; i < 1000; i++ {
+		d.ring.Add(core.NewDummy(core.NewHashkey(fmt.Sprintf("oid-%d", i)), core.NewHashkey(fmt.Sprintf("uid-%d", i))))
+	}
+
+	if d.poolRing(PoolClearnet).Len() != d.ring.Len() {
+		t.Error("The resources are split without a clearnet server")
+	}
+
+	d.cfg.Distributors.I2P.ClearnetApi.ApiAddress = "127.0.0.1:7800"
+	i2pRing := d.poolRing(PoolI2P)
+	clearnetRing := d.poolRing(PoolClearnet)
+	if i2pRing.Len()+clearnetRing.Len() != d.ring.Len() {
+		t.Fatalf("The pools don't have all the resources: %d + %d != %d", i2pRing.Len(), clearnetRing.Len(), d.ring.Len())
+	}
+	if clearnetRing.Len() < 150 || clearnetRing.Len() > 250 {
+		t.Errorf("The clearnet pool doesn't have the default fraction: %d", clearnetRing.Len())
+	}
+
+	clearnet := make(map[core.Hashkey]bool)
+	for _, r := range clearnetRing.GetAll() {
+		clearnet[r.Uid()] = true
+	}
+	for i := 0; i < 100; i++ {
+		key := core.NewHashkey(fmt.Sprintf("key-%d", i))
+		resources, err := d.RequestBridges(context.Background(), key, PoolI2P, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clearnet[resources[0].Uid()] {
+			t.Errorf("A bridge of the clearnet pool was handed out over I2P")
+		}
+		resources, err = d.RequestBridges(context.Background(), key, PoolClearnet, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !clearnet[resources[0].Uid()] {
+			t.Errorf("A bridge of the I2P pool was handed out over the clearnet")
+		}
+	}
+
+	bridges, err := d.subscriberBridges(destination, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range clearnetRing.GetAll() {
+		for _, bridge := range bridges {
+			if r.String() == bridge {
+				t.Errorf("A bridge of the clearnet pool was pushed to a subscriber")
+			}
+		}
+	}
+}
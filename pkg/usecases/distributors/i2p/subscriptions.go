@@ -0,0 +1,358 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+const (
+	BundleMessage  = "bundle"
+	RevokedMessage = "revoked"
+	// BridgesMessage are the bridges answered by the encrypted web endpoint
+	BridgesMessage = "bridges"
+
+	defaultMaxSubscribers         = 10000
+	defaultNewSubscriptionsPeriod = 1000
+	defaultRevokedTTLDays         = 30
+)
+
+// SubscriptionsSaveInterval is how often the subscriptions are saved, if they
+// changed since they were last saved.
+var SubscriptionsSaveInterval = time.Minute
+
+var (
+	RevokedDestinationError = errors.New("destination has been revoked")
+	NotSubscribedError      = errors.New("destination is not subscribed")
+	TooManySubscribersError = errors.New("too many subscribers")
+	RateLimitedError        = errors.New("too many new subscriptions, try again later")
+)
+
+// Subscriber is a long-lived client, identified by its I2P destination, that
+// gets bridge bundles pushed over the update channel.
+type Subscriber struct {
+	Destination string    `json:"destination"`
+	Since       time.Time `json:"since"`
+	LastPush    time.Time `json:"last_push"`
+	// Sent are the bridge lines of the last bundle pushed to the subscriber.
+	Sent []string `json:"sent"`
+}
+
+// Bundle is the message pushed to subscribers.  Revoked contains the bridges
+// of previous bundles that the subscriber should stop using.
+type Bundle struct {
+	Type       string    `json:"type"`
+	Bridges    []string  `json:"bridges,omitempty"`
+	Revoked    []string  `json:"revoked,omitempty"`
+	ValidUntil time.Time `json:"valid_until,omitempty"`
+}
+
+type subscriptionState struct {
+	Subscribers map[string]*Subscriber `json:"subscribers"`
+	Revoked     map[string]time.Time   `json:"revoked"`
+}
+
+func (d *I2PHttpsDistributor) updateChannelCfg() *internal.I2PUpdateChannelConfig {
+	return &d.cfg.Distributors.I2P.UpdateChannel
+}
+
+func (d *I2PHttpsDistributor) loadSubscriptions() {
+	d.subscriptions = subscriptionState{
+		Subscribers: make(map[string]*Subscriber),
+		Revoked:     make(map[string]time.Time),
+	}
+	if d.SubscriptionStore == nil {
+		return
+	}
+
+	var state subscriptionState
+	err := d.SubscriptionStore.Load(&state)
+	if err != nil {
+		log.Println("Can't load subscriptions:", err)
+		return
+	}
+	if state.Subscribers != nil {
+		d.subscriptions.Subscribers = state.Subscribers
+	}
+	if state.Revoked != nil {
+		d.subscriptions.Revoked = state.Revoked
+	}
+	d.pruneRevoked(time.Now())
+	log.Println("Loaded", len(d.subscriptions.Subscribers), "subscribers to the update channel")
+}
+
+// saveSubscriptions needs to be called with subscriptionsLock held.
+func (d *I2PHttpsDistributor) saveSubscriptions() {
+	if d.SubscriptionStore == nil {
+		return
+	}
+	d.subscriptionsDirty = false
+	err := d.SubscriptionStore.Save(d.subscriptions)
+	if err != nil {
+		log.Println("Can't save subscriptions:", err)
+	}
+}
+
+// saveDirtySubscriptions saves the subscriptions if they changed since they
+// were last saved, and forgets the revocations that expired.
+func (d *I2PHttpsDistributor) saveDirtySubscriptions() {
+	d.subscriptionsLock.Lock()
+	defer d.subscriptionsLock.Unlock()
+
+	d.pruneRevoked(time.Now())
+	if d.subscriptionsDirty {
+		d.saveSubscriptions()
+	}
+}
+
+// pruneRevoked forgets the revoked destinations after the revoked TTL, so
+// they can subscribe again.  It needs to be called with subscriptionsLock
+// held.
+func (d *I2PHttpsDistributor) pruneRevoked(now time.Time) {
+	ttl := d.revokedTTL()
+	for destination, revoked := range d.subscriptions.Revoked {
+		if now.Sub(revoked) >= ttl {
+			delete(d.subscriptions.Revoked, destination)
+			d.subscriptionsDirty = true
+		}
+	}
+}
+
+// allowNewSubscription counts a new subscriber if the update channel is not
+// full and not too many destinations subscribed in the current rotation
+// period.  It needs to be called with subscriptionsLock held.
+func (d *I2PHttpsDistributor) allowNewSubscription(now time.Time) error {
+	cfg := d.updateChannelCfg()
+	maxSubscribers := cfg.MaxSubscribers
+	if maxSubscribers <= 0 {
+		maxSubscribers = defaultMaxSubscribers
+	}
+	if len(d.subscriptions.Subscribers) >= maxSubscribers {
+		return TooManySubscribersError
+	}
+
+	if period := d.period(now); period != d.newSubscriptionsPeriod {
+		d.newSubscriptionsPeriod = period
+		d.newSubscriptions = 0
+	}
+	maxNew := cfg.MaxNewSubscriptionsPerPeriod
+	if maxNew <= 0 {
+		maxNew = defaultNewSubscriptionsPeriod
+	}
+	if d.newSubscriptions >= maxNew {
+		return RateLimitedError
+	}
+	d.newSubscriptions++
+	return nil
+}
+
+// Subscribe registers the destination in the update channel and returns the
+// first bundle to be sent to it.  The number of subscribers and of new
+// subscriptions in each rotation period are limited.
+func (d *I2PHttpsDistributor) Subscribe(destination string) (*Bundle, error) {
+	d.subscriptionsLock.Lock()
+	defer d.subscriptionsLock.Unlock()
+
+	now := time.Now()
+	if revoked, ok := d.subscriptions.Revoked[destination]; ok {
+		if now.Sub(revoked) < d.revokedTTL() {
+			return nil, RevokedDestinationError
+		}
+		delete(d.subscriptions.Revoked, destination)
+	}
+
+	subscriber, ok := d.subscriptions.Subscribers[destination]
+	if !ok {
+		if err := d.allowNewSubscription(now); err != nil {
+			return nil, err
+		}
+		subscriber = &Subscriber{
+			Destination: destination,
+			Since:       now,
+		}
+		d.subscriptions.Subscribers[destination] = subscriber
+	}
+
+	bundle, err := d.nextBundle(subscriber, now)
+	if err != nil {
+		return nil, err
+	}
+	d.subscriptionsDirty = true
+	return bundle, nil
+}
+
+// Unsubscribe removes the destination from the update channel.
+func (d *I2PHttpsDistributor) Unsubscribe(destination string) error {
+	d.subscriptionsLock.Lock()
+	defer d.subscriptionsLock.Unlock()
+
+	if _, ok := d.subscriptions.Subscribers[destination]; !ok {
+		return NotSubscribedError
+	}
+	delete(d.subscriptions.Subscribers, destination)
+	d.subscriptionsDirty = true
+	return nil
+}
+
+// Revoke removes the destination from the update channel and prevents it
+// from subscribing again.  It returns the message that should be sent to the
+// destination to notify it, that includes all the bridges it was given.
+func (d *I2PHttpsDistributor) Revoke(destination string) *Bundle {
+	d.subscriptionsLock.Lock()
+	defer d.subscriptionsLock.Unlock()
+
+	bundle := &Bundle{Type: RevokedMessage}
+	if subscriber, ok := d.subscriptions.Subscribers[destination]; ok {
+		bundle.Revoked = subscriber.Sent
+		delete(d.subscriptions.Subscribers, destination)
+	}
+	d.subscriptions.Revoked[destination] = time.Now()
+	d.subscriptionsDirty = true
+	return bundle
+}
+
+// PendingBundles returns the bundles that need to be pushed to each
+// subscriber, indexed by destination.  A subscriber gets a new bundle when its
+// rotation period ends, when any of its bridges is gone, or when the push
+// interval has passed since the last push.
+func (d *I2PHttpsDistributor) PendingBundles(now time.Time) map[string]*Bundle {
+	d.subscriptionsLock.Lock()
+	defer d.subscriptionsLock.Unlock()
+
+	pushInterval := d.pushInterval()
+	bundles := make(map[string]*Bundle)
+	for destination, subscriber := range d.subscriptions.Subscribers {
+		bridges, err := d.subscriberBridges(destination, now)
+		if err != nil {
+			log.Println("Can't get bridges for subscriber:", err)
+			continue
+		}
+		if sameBridges(bridges, subscriber.Sent) && now.Sub(subscriber.LastPush) < pushInterval {
+			continue
+		}
+
+		bundle, err := d.nextBundle(subscriber, now)
+		if err != nil {
+			log.Println("Can't create bundle for subscriber:", err)
+			continue
+		}
+		bundles[destination] = bundle
+	}
+	if len(bundles) != 0 {
+		d.subscriptionsDirty = true
+	}
+	return bundles
+}
+
+// nextBundle needs to be called with subscriptionsLock held.
+func (d *I2PHttpsDistributor) nextBundle(subscriber *Subscriber, now time.Time) (*Bundle, error) {
+	bridges, err := d.subscriberBridges(subscriber.Destination, now)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool, len(bridges))
+	for _, bridge := range bridges {
+		current[bridge] = true
+	}
+	bundle := &Bundle{
+		Type:       BundleMessage,
+		Bridges:    bridges,
+		ValidUntil: d.periodEnd(now),
+	}
+	for _, bridge := range subscriber.Sent {
+		if !current[bridge] {
+			bundle.Revoked = append(bundle.Revoked, bridge)
+		}
+	}
+
+	subscriber.Sent = bridges
+	subscriber.LastPush = now
+	return bundle, nil
+}
+
+// subscriberBridges returns the bridges assigned to the destination for the
+// rotation period of the given time.
+func (d *I2PHttpsDistributor) subscriberBridges(destination string, now time.Time) ([]string, error) {
+	num := d.updateChannelCfg().NumBridgesPerBundle
+	if num <= 0 {
+		num = 1
+	}
+	ring := d.poolRing(PoolI2P)
+	if ring.Len() == 0 {
+		return nil, errors.New("no bridges available")
+	}
+	if ring.Len() < num {
+		num = ring.Len()
+	}
+
+	hashKey := core.NewHashkey(fmt.Sprintf("%s-%d", destination, d.period(now)))
+	resources, err := ring.GetMany(hashKey, num)
+	if err != nil {
+		return nil, err
+	}
+
+	bridges := make([]string, 0, len(resources))
+	for _, r := range resources {
+		bridges = append(bridges, r.String())
+	}
+	sort.Strings(bridges)
+	return bridges, nil
+}
+
+func (d *I2PHttpsDistributor) rotationPeriod() time.Duration {
+	hours := d.updateChannelCfg().RotationPeriodHours
+	if hours <= 0 {
+		hours = 24
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// pushInterval returns how often the bundles are pushed again if they didn't
+// change, 6 hours if it's not configured.
+func (d *I2PHttpsDistributor) pushInterval() time.Duration {
+	minutes := d.updateChannelCfg().PushIntervalMinutes
+	if minutes <= 0 {
+		minutes = 6 * 60
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// revokedTTL returns how long a revoked destination can't subscribe again, 30
+// days if it's not configured.
+func (d *I2PHttpsDistributor) revokedTTL() time.Duration {
+	days := d.updateChannelCfg().RevokedTTLDays
+	if days <= 0 {
+		days = defaultRevokedTTLDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (d *I2PHttpsDistributor) period(now time.Time) int64 {
+	return now.Unix() / int64(d.rotationPeriod().Seconds())
+}
+
+func (d *I2PHttpsDistributor) periodEnd(now time.Time) time.Time {
+	return time.Unix((d.period(now)+1)*int64(d.rotationPeriod().Seconds()), 0)
+}
+
+func sameBridges(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
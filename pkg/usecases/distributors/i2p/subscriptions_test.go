@@ -0,0 +1,247 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i2phttps
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+const destination = "test-destination"
+
+func initDistributor() *I2PHttpsDistributor {
+	cfg := internal.Config{
+		Distributors: internal.Distributors{
+			I2P: internal.I2PHttpsDistConfig{
+				UpdateChannel: internal.I2PUpdateChannelConfig{
+					NumBridgesPerBundle: 2,
+					RotationPeriodHours: 1,
+					PushIntervalMinutes: 60,
+				},
+			},
+		},
+	}
+	d := &I2PHttpsDistributor{
+		cfg:  &cfg,
+		ring: core.NewHashring(),
+	}
+	for i := 0; i < 10; i++ {
+		d.ring.Add(core.NewDummy(core.NewHashkey(fmt.Sprintf("oid-%d", i)), core.NewHashkey(fmt.Sprintf("uid-%d", i))))
+	}
+	d.loadSubscriptions()
+	return d
+}
+
+func TestSubscribe(t *testing.T) {
+	d := initDistributor()
+
+	bundle, err := d.Subscribe(destination)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	if bundle.Type != BundleMessage {
+		t.Errorf("Unexpected bundle type: %s", bundle.Type)
+	}
+	if len(bundle.Bridges) != 2 {
+		t.Errorf("Wrong number of bridges: %v", bundle.Bridges)
+	}
+
+	bundles := d.PendingBundles(time.Now())
+	if len(bundles) != 0 {
+		t.Errorf("Unexpected pending bundles: %v", bundles)
+	}
+
+	err = d.Unsubscribe(destination)
+	if err != nil {
+		t.Error("Can't unsubscribe:", err)
+	}
+	err = d.Unsubscribe(destination)
+	if !errors.Is(err, NotSubscribedError) {
+		t.Error("Expected a not subscribed error:", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	d := initDistributor()
+
+	bundle, err := d.Subscribe(destination)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+
+	bundles := d.PendingBundles(time.Now().Add(2 * time.Hour))
+	next, ok := bundles[destination]
+	if !ok {
+		t.Fatal("No bundle pushed after the push interval")
+	}
+
+	nextBridges := make(map[string]bool)
+	for _, bridge := range next.Bridges {
+		nextBridges[bridge] = true
+	}
+	for _, bridge := range bundle.Bridges {
+		if nextBridges[bridge] {
+			continue
+		}
+		found := false
+		for _, revoked := range next.Revoked {
+			if revoked == bridge {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Bridge %s was rotated but not revoked", bridge)
+		}
+	}
+}
+
+func TestDefaultPushInterval(t *testing.T) {
+	d := initDistributor()
+	d.updateChannelCfg().PushIntervalMinutes = 0
+
+	if _, err := d.Subscribe(destination); err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	if bundles := d.PendingBundles(time.Now().Add(time.Second)); len(bundles) != 0 {
+		t.Errorf("Bundles pushed again without a push interval: %v", bundles)
+	}
+	if interval := d.pushInterval(); interval != 6*time.Hour {
+		t.Errorf("Wrong default push interval: %s", interval)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	d := initDistributor()
+
+	bundle, err := d.Subscribe(destination)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+
+	revocation := d.Revoke(destination)
+	if revocation.Type != RevokedMessage {
+		t.Errorf("Unexpected revocation type: %s", revocation.Type)
+	}
+	if len(revocation.Revoked) != len(bundle.Bridges) {
+		t.Errorf("Not all bridges are revoked: %v", revocation.Revoked)
+	}
+
+	_, err = d.Subscribe(destination)
+	if !errors.Is(err, RevokedDestinationError) {
+		t.Error("Revoked destination could subscribe again:", err)
+	}
+	if len(d.PendingBundles(time.Now().Add(2*time.Hour))) != 0 {
+		t.Error("Bundles pending for a revoked destination")
+	}
+}
+
+func TestSubscriptionLimits(t *testing.T) {
+	d := initDistributor()
+	d.updateChannelCfg().MaxSubscribers = 3
+	d.updateChannelCfg().MaxNewSubscriptionsPerPeriod = 2
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.Subscribe(fmt.Sprintf("destination-%d", i)); err != nil {
+			t.Fatal("Can't subscribe:", err)
+		}
+	}
+	if _, err := d.Subscribe("destination-0"); err != nil {
+		t.Error("A subscriber can't subscribe again:", err)
+	}
+	_, err := d.Subscribe("destination-2")
+	if !errors.Is(err, RateLimitedError) {
+		t.Error("Expected a rate limited error:", err)
+	}
+
+	d.newSubscriptionsPeriod--
+	if _, err := d.Subscribe("destination-2"); err != nil {
+		t.Fatal("Can't subscribe in the next period:", err)
+	}
+	_, err = d.Subscribe("destination-3")
+	if !errors.Is(err, TooManySubscribersError) {
+		t.Error("Expected a too many subscribers error:", err)
+	}
+}
+
+func TestRevokedTTL(t *testing.T) {
+	d := initDistributor()
+	d.updateChannelCfg().RevokedTTLDays = 1
+
+	d.Revoke(destination)
+	d.Revoke("other-destination")
+	if _, err := d.Subscribe(destination); !errors.Is(err, RevokedDestinationError) {
+		t.Fatal("Revoked destination could subscribe again:", err)
+	}
+
+	d.subscriptions.Revoked[destination] = time.Now().Add(-25 * time.Hour)
+	if _, err := d.Subscribe(destination); err != nil {
+		t.Error("Can't subscribe after the revocation expired:", err)
+	}
+
+	d.subscriptions.Revoked["other-destination"] = time.Now().Add(-25 * time.Hour)
+	d.saveDirtySubscriptions()
+	if len(d.subscriptions.Revoked) != 0 {
+		t.Errorf("The expired revocations were not pruned: %v", d.subscriptions.Revoked)
+	}
+}
+
+func TestSaveDirtySubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "i2p-subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/subscriptions.json"
+
+	d := initDistributor()
+	d.SubscriptionStore = pjson.New("subscriptions", dir)
+	if _, err := d.Subscribe(destination); err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("The subscriptions were saved on subscribe:", err)
+	}
+
+	d.saveDirtySubscriptions()
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatal("The dirty subscriptions were not saved:", err)
+	}
+	if d.subscriptionsDirty {
+		t.Error("The subscriptions are still dirty after saving them")
+	}
+
+	loaded := initDistributor()
+	loaded.SubscriptionStore = d.SubscriptionStore
+	loaded.loadSubscriptions()
+	if _, ok := loaded.subscriptions.Subscribers[destination]; !ok {
+		t.Error("The subscriber was not saved")
+	}
+}
+
+func TestDestinationHashkey(t *testing.T) {
+	d := initDistributor()
+	now := time.Now()
+	b32 := "ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p"
+
+	key := d.DestinationHashkey(b32, now)
+	if key != d.DestinationHashkey(strings.ToUpper(b32), now) {
+		t.Error("The same destination got different keys")
+	}
+	if key == d.DestinationHashkey("x"+b32[1:], now) {
+		t.Error("Different destinations got the same key")
+	}
+	if key == d.DestinationHashkey(b32, now.Add(d.rotationPeriod())) {
+		t.Error("The key didn't change in the next rotation period")
+	}
+}
@@ -5,11 +5,56 @@
 package distributors
 
 import (
+	"errors"
+
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+var (
+	NoResourcesError = errors.New("no resources to distribute")
 )
 
 // Distributor represents a distribution mechanism, e.g. Salmon or HTTPS.
 type Distributor interface {
 	Init(*internal.Config)
 	Shutdown()
+	// Healthz returns an error if the distributor can't currently answer
+	// requests, e.g. because it has no resources to hand out.
+	Healthz() error
+	// Stats returns a summary of the distributor's state.
+	Stats() Stats
+}
+
+// Stats summarizes the state of a distributor for its status endpoint.
+type Stats struct {
+	// Resources counts the resources that the distributor can hand out,
+	// by resource type.
+	Resources map[string]int `json:"resources"`
+	// Counters holds distributor specific numbers, e.g. the number of
+	// users or subscriptions.
+	Counters map[string]int `json:"counters,omitempty"`
+}
+
+// CountResources returns the number of resources of each type in the given
+// hashrings.
+func CountResources(rings ...*core.Hashring) map[string]int {
+	count := make(map[string]int)
+	for _, ring := range rings {
+		for _, r := range ring.GetAll() {
+			count[r.Type()]++
+		}
+	}
+	return count
+}
+
+// CheckResources returns NoResourcesError if the given stats have no
+// resources.
+func CheckResources(stats Stats) error {
+	for _, num := range stats.Resources {
+		if num != 0 {
+			return nil
+		}
+	}
+	return NoResourcesError
 }
@@ -0,0 +1,103 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lox
+
+import (
+	"log"
+	"sort"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/distributorsdk"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	DistName = "lox"
+)
+
+// LoxBridge is a bridge as handed to the Lox authority.
+type LoxBridge struct {
+	Type        string   `json:"type"`
+	Fingerprint string   `json:"fingerprint"`
+	Bridgeline  string   `json:"bridgeline"`
+	BlockedIn   []string `json:"blocked_in"`
+}
+
+// LoxDistributor feeds the Lox authority with bridges.  The anonymous
+// credentials (trust levels, migrations and invitations) are handled by the
+// Lox authority itself, this distributor keeps its set of bridges in sync
+// with the backend.
+type LoxDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+
+	base *distributorsdk.Distributor
+	cfg  *internal.LoxDistConfig
+}
+
+// Bridges returns all the bridges assigned to lox, sorted by fingerprint so
+// the authority gets a stable list.
+func (d *LoxDistributor) Bridges() []LoxBridge {
+	all := d.base.Ring.GetAll()
+	bridges := make([]LoxBridge, 0, len(all))
+	for _, r := range all {
+		bridge := LoxBridge{
+			Type:       r.Type(),
+			Bridgeline: r.String(),
+			BlockedIn:  []string{},
+		}
+		switch b := r.(type) {
+		case *resources.Transport:
+			bridge.Fingerprint = b.Fingerprint
+		case *resources.Bridge:
+			bridge.Fingerprint = b.Fingerprint
+		}
+		for location := range r.BlockedIn() {
+			bridge.BlockedIn = append(bridge.BlockedIn, location)
+		}
+		sort.Strings(bridge.BlockedIn)
+		bridges = append(bridges, bridge)
+	}
+
+	sort.Slice(bridges, func(i, j int) bool {
+		if bridges[i].Fingerprint != bridges[j].Fingerprint {
+			return bridges[i].Fingerprint < bridges[j].Fingerprint
+		}
+		return bridges[i].Bridgeline < bridges[j].Bridgeline
+	})
+	return bridges
+}
+
+// Init initialises the given Lox distributor.
+func (d *LoxDistributor) Init(cfg *internal.Config) {
+	log.Printf("Initialising %s distributor.", DistName)
+
+	d.cfg = &cfg.Distributors.Lox
+	sdkCfg := distributorsdk.FromRdsysConfig(cfg, DistName, d.cfg.Resources)
+	if d.IPC != nil {
+		sdkCfg.IPC = d.IPC
+	}
+	d.base = distributorsdk.New(sdkCfg, distributorsdk.Hooks{})
+	d.base.Start()
+}
+
+// Shutdown shuts down the given Lox distributor.
+func (d *LoxDistributor) Shutdown() {
+	log.Printf("Shutting down %s distributor.", DistName)
+
+	d.base.Stop()
+}
+
+// Healthz returns an error if the distributor has no bridges to hand out.
+func (d *LoxDistributor) Healthz() error {
+	return d.base.Healthz()
+}
+
+// Stats returns the number of bridges of each type in the hashring.
+func (d *LoxDistributor) Stats() distributors.Stats {
+	return d.base.Stats()
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lox
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+var config = internal.Config{
+	Distributors: internal.Distributors{
+		Lox: internal.LoxDistConfig{
+			Resources: []string{"obfs4"},
+		},
+	},
+}
+
+func newTransport(i int) *resources.Transport {
+	t := resources.NewTransport()
+	t.SetType("obfs4")
+	t.Address = resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP(fmt.Sprintf("192.0.2.%d", i))}}
+	t.Port = 443
+	t.Fingerprint = fmt.Sprintf("%040d", i)
+	t.Parameters["cert"] = "foo"
+	return t
+}
+
+func TestBridges(t *testing.T) {
+	d := LoxDistributor{}
+	d.Init(&config)
+	defer d.Shutdown()
+
+	if len(d.Bridges()) != 0 {
+		t.Fatal("Expected no bridges")
+	}
+
+	for i := 3; i > 0; i-- {
+		d.base.Ring.Add(newTransport(i))
+	}
+	blocked := newTransport(4)
+	blocked.SetBlockedIn(core.LocationSet{"ru": true, "cn": true})
+	d.base.Ring.Add(blocked)
+
+	bridges := d.Bridges()
+	if len(bridges) != 4 {
+		t.Fatalf("Wrong number of bridges: %d", len(bridges))
+	}
+	for i, bridge := range bridges {
+		if bridge.Fingerprint != fmt.Sprintf("%040d", i+1) {
+			t.Errorf("Bridges are not sorted: %s in position %d", bridge.Fingerprint, i)
+		}
+		if bridge.Type != "obfs4" {
+			t.Errorf("Wrong bridge type: %s", bridge.Type)
+		}
+		expected := fmt.Sprintf("obfs4 192.0.2.%d:443 %040d cert=foo", i+1, i+1)
+		if bridge.Bridgeline != expected {
+			t.Errorf("Wrong bridgeline: %s", bridge.Bridgeline)
+		}
+	}
+	if len(bridges[3].BlockedIn) != 2 || bridges[3].BlockedIn[0] != "cn" || bridges[3].BlockedIn[1] != "ru" {
+		t.Errorf("Wrong blocked locations: %v", bridges[3].BlockedIn)
+	}
+	if len(bridges[0].BlockedIn) != 0 {
+		t.Errorf("Unexpected blocked locations: %v", bridges[0].BlockedIn)
+	}
+}
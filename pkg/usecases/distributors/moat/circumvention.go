@@ -0,0 +1,117 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+var countryCodeRegexp = regexp.MustCompile("^[a-z]{2}$")
+
+// ValidCountryCode returns true if the country is a two lower case letters
+// country code.
+func ValidCountryCode(country string) bool {
+	return countryCodeRegexp.MatchString(country)
+}
+
+// KnownCountry returns true if the country is a valid country code of the
+// circumvention map.
+func (d *MoatDistributor) KnownCountry(country string) bool {
+	if !ValidCountryCode(country) {
+		return false
+	}
+	_, ok := d.GetCircumventionMap()[country]
+	return ok
+}
+
+// SetCircumventionMap replaces the whole circumvention map with the given one
+// after validating it.
+func (d *MoatDistributor) SetCircumventionMap(m CircumventionMap) error {
+	for country, settings := range m {
+		err := d.validateCountrySettings(country, settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.circumventionLock.Lock()
+	defer d.circumventionLock.Unlock()
+	d.circumventionMap = m
+	d.reorderCircumventionMap()
+	return d.saveCircumventionMap()
+}
+
+// PatchCircumventionMap updates the settings of the countries present in
+// patch.  A nil value removes the country from the map.
+func (d *MoatDistributor) PatchCircumventionMap(patch map[string]*CircumventionSettings) error {
+	for country, settings := range patch {
+		if settings == nil {
+			continue
+		}
+		err := d.validateCountrySettings(country, *settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.circumventionLock.Lock()
+	defer d.circumventionLock.Unlock()
+
+	// the map is never modified in place, as GetCircumventionMap hands it out
+	m := make(CircumventionMap, len(d.circumventionMap)+len(patch))
+	for country, settings := range d.circumventionMap {
+		m[country] = settings
+	}
+	for country, settings := range patch {
+		if settings == nil {
+			delete(m, country)
+			continue
+		}
+		m[country] = *settings
+	}
+	d.circumventionMap = m
+	d.reorderCircumventionMap()
+	return d.saveCircumventionMap()
+}
+
+// saveCircumventionMap needs to be called with circumventionLock held.
+func (d *MoatDistributor) saveCircumventionMap() error {
+	if d.CircumventionStore == nil {
+		return nil
+	}
+	err := d.CircumventionStore.Save(d.circumventionMap)
+	if err != nil {
+		log.Println("Can't persist the circumvention map:", err)
+	}
+	return err
+}
+
+func (d *MoatDistributor) validateCountrySettings(country string, cs CircumventionSettings) error {
+	if !countryCodeRegexp.MatchString(country) {
+		return fmt.Errorf("Not valid country code %q", country)
+	}
+
+	for _, settings := range cs.Settings {
+		bridges := settings.Bridges
+		switch bridges.Source {
+		case "builtin":
+			if !contains(d.cfg.BuiltInBridgesTypes, bridges.Type) {
+				return fmt.Errorf("Unknown builtin transport %q for %s", bridges.Type, country)
+			}
+		case "bridgedb":
+			if !contains(d.cfg.Resources, bridges.Type) {
+				return fmt.Errorf("Unknown bridgedb transport %q for %s", bridges.Type, country)
+			}
+		default:
+			return fmt.Errorf("Unknown bridge source %q for %s", bridges.Source, country)
+		}
+		if len(bridges.BridgeStrings) != 0 {
+			return fmt.Errorf("The circumvention map can't include bridge strings (%s)", country)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package moat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+)
+
+const (
+	FeedbackReportInterval = 10 * time.Minute
+	// feedbackReportTimeout is how long we wait for the backend to answer a
+	// feedback report.
+	feedbackReportTimeout = time.Minute
+
+	feedbackLimitWindow       = time.Hour
+	defaultFeedbackMaxPerHour = 10
+	defaultFeedbackMaxMoves   = 1
+)
+
+var (
+	FeedbackDisabledError  = errors.New("Circumvention feedback is disabled")
+	InvalidFeedbackError   = errors.New("Not valid circumvention feedback")
+	FeedbackRateLimitError = errors.New("Too much circumvention feedback from this address")
+)
+
+// FeedbackResult tells if a client could connect with the settings of a
+// transport.
+type FeedbackResult struct {
+	Transport string `json:"transport"`
+	Worked    bool   `json:"worked"`
+}
+
+// feedbackReporter counts the feedback results of the clients and reports
+// them to the backend.  It only keeps the number of results of each country
+// and transport, and the times of the last hour's feedback of each hashed
+// address prefix to limit how much feedback a client can send.
+type feedbackReporter struct {
+	ipc        delivery.Mechanism
+	maxPerHour int
+
+	resultsLock sync.Mutex
+	results     map[string]map[string]core.FeedbackResults
+	senders     map[core.Hashkey][]time.Time
+}
+
+// newFeedbackReporter returns a feedback reporter that sends its reports with
+// the given mechanism, or to the backend if it's nil.  It returns nil if
+// there is no mechanism and the backend has no feedback endpoint configured.
+func newFeedbackReporter(cfg *internal.Config, ipc delivery.Mechanism) *feedbackReporter {
+	if ipc == nil {
+		if cfg.Backend.FeedbackEndpoint == "" {
+			return nil
+		}
+		ipc = internal.NewBackendIpc(cfg, cfg.Backend.FeedbackEndpoint, "POST", cfg.Backend.ApiTokens[DistName])
+	}
+	maxPerHour := cfg.Distributors.Moat.FeedbackMaxPerHour
+	if maxPerHour <= 0 {
+		maxPerHour = defaultFeedbackMaxPerHour
+	}
+	return &feedbackReporter{
+		ipc:        ipc,
+		maxPerHour: maxPerHour,
+		results:    make(map[string]map[string]core.FeedbackResults),
+		senders:    make(map[core.Hashkey][]time.Time),
+	}
+}
+
+// RecordFeedback counts the results of the settings that a client of the
+// given country and IP address tried.  The transports must be ones that moat
+// hands out, and each transport is only counted once per call.  Each address
+// prefix, /16 for IPv4 and /32 for IPv6, can only send feedback_max_per_hour
+// feedbacks, the others return FeedbackRateLimitError.
+func (d *MoatDistributor) RecordFeedback(country string, results []FeedbackResult, ip net.IP) error {
+	if d.feedback == nil {
+		return FeedbackDisabledError
+	}
+	if !countryCodeRegexp.MatchString(country) {
+		return fmt.Errorf("%w: country code %q", InvalidFeedbackError, country)
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("%w: no results", InvalidFeedbackError)
+	}
+	for _, result := range results {
+		if !contains(d.cfg.Resources, result.Transport) && !contains(d.cfg.BuiltInBridgesTypes, result.Transport) {
+			return fmt.Errorf("%w: unknown transport %q", InvalidFeedbackError, result.Transport)
+		}
+	}
+
+	r := d.feedback
+	r.resultsLock.Lock()
+	defer r.resultsLock.Unlock()
+	now := time.Now()
+	sender := ipHashkey(ip)
+	feedbacks := pruneFeedbacks(r.senders[sender], now)
+	if len(feedbacks) >= r.maxPerHour {
+		r.senders[sender] = feedbacks
+		return FeedbackRateLimitError
+	}
+	r.senders[sender] = append(feedbacks, now)
+
+	if r.results[country] == nil {
+		r.results[country] = make(map[string]core.FeedbackResults)
+	}
+	seen := make(map[string]bool)
+	for _, result := range results {
+		if seen[result.Transport] {
+			continue
+		}
+		seen[result.Transport] = true
+
+		counts := r.results[country][result.Transport]
+		if result.Worked {
+			counts.Worked++
+		} else {
+			counts.Failed++
+		}
+		r.results[country][result.Transport] = counts
+	}
+	return nil
+}
+
+// reportFeedback reports the feedback to the backend when it starts, every
+// FeedbackReportInterval and when moat shuts down.
+func (d *MoatDistributor) reportFeedback() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(FeedbackReportInterval)
+	defer ticker.Stop()
+
+	d.sendFeedback()
+	for {
+		select {
+		case <-ticker.C:
+			d.sendFeedback()
+		case <-d.shutdown:
+			d.sendFeedback()
+			return
+		}
+	}
+}
+
+// sendFeedback sends the feedback since the last report to the backend and
+// reorders the circumvention map with the effectiveness that the backend
+// answers.  If the report fails the results are kept for the next one.
+func (d *MoatDistributor) sendFeedback() {
+	r := d.feedback
+	r.resultsLock.Lock()
+	results := r.results
+	r.results = make(map[string]map[string]core.FeedbackResults)
+	now := time.Now()
+	for sender, feedbacks := range r.senders {
+		if feedbacks = pruneFeedbacks(feedbacks, now); len(feedbacks) == 0 {
+			delete(r.senders, sender)
+		} else {
+			r.senders[sender] = feedbacks
+		}
+	}
+	r.resultsLock.Unlock()
+
+	req := core.FeedbackReport{
+		RequestOrigin: DistName,
+		Results:       results,
+	}
+	var resp core.EffectivenessReport
+	ctx, cancel := context.WithTimeout(context.Background(), feedbackReportTimeout)
+	defer cancel()
+	if err := r.ipc.MakeJsonRequest(ctx, req, &resp); err != nil {
+		log.Printf("Failed to report circumvention feedback to the backend: %s", err)
+		r.resultsLock.Lock()
+		for country, transports := range results {
+			if r.results[country] == nil {
+				r.results[country] = make(map[string]core.FeedbackResults)
+			}
+			for transport, counts := range transports {
+				total := r.results[country][transport]
+				total.Worked += counts.Worked
+				total.Failed += counts.Failed
+				r.results[country][transport] = total
+			}
+		}
+		r.resultsLock.Unlock()
+		return
+	}
+
+	d.circumventionLock.Lock()
+	defer d.circumventionLock.Unlock()
+	d.effectiveness = resp.Effectiveness
+	d.reorderCircumventionMap()
+}
+
+// reorderCircumventionMap updates the circumvention map that we hand out with
+// the current effectiveness of the transports.  It needs to be called with
+// circumventionLock held, every time the circumvention map or the
+// effectiveness change.
+func (d *MoatDistributor) reorderCircumventionMap() {
+	if len(d.effectiveness) == 0 {
+		d.orderedMap = nil
+		return
+	}
+
+	maxMoves := d.cfg.FeedbackMaxMoves
+	if maxMoves <= 0 {
+		maxMoves = defaultFeedbackMaxMoves
+	}
+	m := make(CircumventionMap, len(d.circumventionMap))
+	for country, cs := range d.circumventionMap {
+		cs.Settings = orderByEffectiveness(cs.Settings, d.effectiveness[country], maxMoves)
+		m[country] = cs
+	}
+	d.orderedMap = m
+}
+
+// orderByEffectiveness returns the settings sorted by the success rate of
+// their transports, the most effective first.  The settings of transports
+// without enough feedback keep their position, so the ones that the admins
+// put first stay first until the clients tell us otherwise, and a rated
+// setting moves at most maxMoves places among the rated ones, so the feedback
+// can't turn the order of the admins upside down.  The given slice is not
+// modified.
+func orderByEffectiveness(settings []Settings, effectiveness map[string]core.FeedbackResults, maxMoves int) []Settings {
+	var positions []int
+	for i, s := range settings {
+		if _, ok := effectiveness[s.Bridges.Type]; ok {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) < 2 {
+		return settings
+	}
+
+	rate := func(i int) float64 {
+		return effectiveness[settings[positions[i]].Bridges.Type].SuccessRate()
+	}
+	// Fill each place with the most effective setting that is at most
+	// maxMoves places behind it, unless the first setting left would fall
+	// more than maxMoves places behind its own.
+	placed := make([]bool, len(positions))
+	rated := make([]int, 0, len(positions))
+	for place := range positions {
+		first := 0
+		for placed[first] {
+			first++
+		}
+		best := first
+		if first > place-maxMoves {
+			for i := first + 1; i < len(positions) && i <= place+maxMoves; i++ {
+				if !placed[i] && rate(i) > rate(best) {
+					best = i
+				}
+			}
+		}
+		placed[best] = true
+		rated = append(rated, best)
+	}
+
+	ordered := append([]Settings{}, settings...)
+	for place, i := range rated {
+		ordered[positions[place]] = settings[positions[i]]
+	}
+	return ordered
+}
+
+// pruneFeedbacks returns the times of the feedbacks that are in the limit
+// window.
+func pruneFeedbacks(feedbacks []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(feedbacks) && now.Sub(feedbacks[i]) >= feedbackLimitWindow {
+		i++
+	}
+	return feedbacks[i:]
+}
@@ -5,8 +5,10 @@
 package moat
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	mrand "math/rand"
@@ -18,12 +20,15 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors/exposure"
 )
 
 const (
 	DistName              = "moat"
 	builtinRefreshSeconds = time.Hour
+	builtinRetryMinDelay  = time.Minute
 )
 
 var (
@@ -36,6 +41,12 @@ type CircumventionMap map[string]CircumventionSettings
 type CircumventionSettings struct {
 	Settings []Settings `json:"settings"`
 	Country  string     `json:"country,omitempty"`
+	// ValidUntil is the end of the current rotation period, when the
+	// bridges provided will change
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	// PoolID identifies the pool the bridges come from, if it changes the
+	// client is getting a different set of bridges
+	PoolID string `json:"pool_id,omitempty"`
 }
 
 type Settings struct {
@@ -55,15 +66,51 @@ type MoatDistributor struct {
 	circumventionDefaults CircumventionSettings
 	cfg                   *internal.MoatDistConfig
 	ipc                   delivery.Mechanism
+	reporter              *exposure.Reporter
+	feedback              *feedbackReporter
 	wg                    sync.WaitGroup
 	shutdown              chan bool
 
+	// circumventionLock protects the circumventionMap from being swapped
+	// while being read
+	circumventionLock sync.RWMutex
+	// effectiveness maps countries to transports to the feedback results
+	// that the backend aggregated, and orderedMap is the circumvention map
+	// reordered by them.  Both are protected by circumventionLock.
+	effectiveness map[string]map[string]core.FeedbackResults
+	orderedMap    CircumventionMap
+
+	// builtinLock protects builtinBridges
+	builtinLock sync.RWMutex
+
+	// CircumventionStore persists the changes done to the circumvention map
+	CircumventionStore persistence.Mechanism
+	// BuiltinStore keeps the last good list of builtin bridges
+	BuiltinStore persistence.Mechanism
+
 	FetchBridges func(url string) (bridgeLines []string, err error)
+	// CountryFromIP locates the requester to pick its country pool.  We
+	// don't use the country provided in the request, otherwise an attacker
+	// could enumerate the pools of other countries.
+	CountryFromIP func(ip net.IP) string
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+	// FeedbackIPC replaces the HTTP connection to the feedback endpoint of
+	// the backend if set, e.g. in tests.
+	FeedbackIPC delivery.Mechanism
+	// Now returns the current time that decides the rotation period.  It's
+	// time.Now if nil.
+	Now func() time.Time
 }
 
 func (d *MoatDistributor) LoadCircumventionMap(r io.Reader) error {
+	d.circumventionLock.Lock()
+	defer d.circumventionLock.Unlock()
+
 	dec := json.NewDecoder(r)
-	return dec.Decode(&d.circumventionMap)
+	err := dec.Decode(&d.circumventionMap)
+	d.reorderCircumventionMap()
+	return err
 }
 
 func (d *MoatDistributor) LoadCircumventionDefaults(r io.Reader) error {
@@ -71,58 +118,148 @@ func (d *MoatDistributor) LoadCircumventionDefaults(r io.Reader) error {
 	return dec.Decode(&d.circumventionDefaults)
 }
 
+// GetCircumventionMap returns the circumvention map, with the settings of each
+// country reordered by the feedback of the clients if there is any.
 func (d *MoatDistributor) GetCircumventionMap() CircumventionMap {
+	d.circumventionLock.RLock()
+	defer d.circumventionLock.RUnlock()
+	if d.orderedMap != nil {
+		return d.orderedMap
+	}
 	return d.circumventionMap
 }
 
-func (d *MoatDistributor) GetCircumventionSettings(country string, types []string, ip net.IP) (*CircumventionSettings, error) {
-	cc, ok := d.circumventionMap[country]
+// GetCircumventionSettings returns the circumvention settings for the given
+// country, with bridges of the given types for the requester's ip.  It gives
+// up when the given context is done.
+func (d *MoatDistributor) GetCircumventionSettings(ctx context.Context, country string, types []string, ip net.IP) (*CircumventionSettings, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cc, ok := d.GetCircumventionMap()[country]
 	cc.Country = country
 	if !ok || len(cc.Settings) == 0 {
 		// json.Marshal will return null for an empty slice unless we *make* it
 		cc.Settings = make([]Settings, 0)
 		return &cc, nil
 	}
-	return d.populateCircumventionSettings(&cc, types, ip)
+	return d.populateCircumventionSettings(ctx, &cc, types, ip)
 }
 
-func (d *MoatDistributor) GetCircumventionDefaults(types []string, ip net.IP) (*CircumventionSettings, error) {
-	return d.populateCircumventionSettings(&d.circumventionDefaults, types, ip)
+// GetCircumventionDefaults returns the default circumvention settings, with
+// bridges of the given types for the requester's ip.  It gives up when the
+// given context is done.
+func (d *MoatDistributor) GetCircumventionDefaults(ctx context.Context, types []string, ip net.IP) (*CircumventionSettings, error) {
+	return d.populateCircumventionSettings(ctx, &d.circumventionDefaults, types, ip)
 }
 
-func (d *MoatDistributor) populateCircumventionSettings(cc *CircumventionSettings, types []string, ip net.IP) (*CircumventionSettings, error) {
+func (d *MoatDistributor) populateCircumventionSettings(ctx context.Context, cc *CircumventionSettings, types []string, ip net.IP) (*CircumventionSettings, error) {
 	circumventionSettings := CircumventionSettings{
 		Settings: make([]Settings, 0, len(cc.Settings)),
 		Country:  cc.Country,
 	}
 
 	for _, settings := range cc.Settings {
-		if len(types) != 0 {
-			requestedType := false
-			for _, t := range types {
-				if t == settings.Bridges.Type {
-					requestedType = true
-					break
-				}
-			}
-
-			if !requestedType {
-				continue
-			}
+		if len(types) != 0 && !contains(types, settings.Bridges.Type) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
 		settings.Bridges.BridgeStrings = d.getBridges(settings.Bridges, ip)
 		circumventionSettings.Settings = append(circumventionSettings.Settings, settings)
 	}
 
+	if !hasBridges(circumventionSettings.Settings) {
+		fallback := d.getFallbackSettings(types, ip)
+		if fallback != nil {
+			log.Println("Using fallback transport", fallback.Bridges.Type, "for", cc.Country)
+			circumventionSettings.Settings = []Settings{*fallback}
+		}
+	}
+
 	if len(circumventionSettings.Settings) == 0 {
 		log.Println("Could not find the requested type of bridge", types)
 		return nil, NoTransportError
 	}
 
+	if usesBridgedb(circumventionSettings.Settings) {
+		circumventionSettings.ValidUntil = d.periodEnd()
+		circumventionSettings.PoolID = d.poolID(ip)
+	}
 	return &circumventionSettings, nil
 }
 
+func usesBridgedb(settings []Settings) bool {
+	for _, s := range settings {
+		if s.Bridges.Source == "bridgedb" {
+			return true
+		}
+	}
+	return false
+}
+
+// periodEnd returns the time when the current rotation period ends, or nil if
+// there is no rotation configured.
+func (d *MoatDistributor) periodEnd() *time.Time {
+	if d.cfg.RotationPeriodHours == 0 {
+		return nil
+	}
+	end := time.Unix(int64((d.getPeriod()+1)*d.cfg.RotationPeriodHours*60*60), 0).UTC()
+	return &end
+}
+
+// poolID returns an opaque identifier of the pool assigned to the ip in the
+// current rotation period.
+func (d *MoatDistributor) poolID(ip net.IP) string {
+	key := fmt.Sprintf("%s-%d", d.getProportionIndex(), d.getPeriod())
+	if pool, ok := d.countryPoolIndex(ip); ok {
+		key += fmt.Sprintf("-%d", pool)
+	}
+	return fmt.Sprintf("%016x", uint64(core.NewHashkey(key)))
+}
+
+func hasBridges(settings []Settings) bool {
+	for _, s := range settings {
+		if len(s.Bridges.BridgeStrings) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getFallbackSettings walks the configured fallback chain and returns settings
+// for the first transport, of the ones accepted by the client, that has bridges
+// available.  It returns nil if none is found.
+func (d *MoatDistributor) getFallbackSettings(types []string, ip net.IP) *Settings {
+	for _, fallbackType := range d.cfg.FallbackTransports {
+		if len(types) != 0 && !contains(types, fallbackType) {
+			continue
+		}
+		if _, ok := d.collection[fallbackType]; !ok {
+			continue
+		}
+
+		bridges := BridgeSettings{Type: fallbackType, Source: "bridgedb"}
+		bridges.BridgeStrings = d.getBridges(bridges, ip)
+		if len(bridges.BridgeStrings) != 0 {
+			return &Settings{Bridges: bridges}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *MoatDistributor) getBridges(bs BridgeSettings, ip net.IP) []string {
 	switch bs.Source {
 	case "builtin":
@@ -131,6 +268,9 @@ func (d *MoatDistributor) getBridges(bs BridgeSettings, ip net.IP) []string {
 
 	case "bridgedb":
 		hashring := d.collection.GetHashring(d.getProportionIndex(), bs.Type)
+		hashring = d.countryPool(hashring, ip)
+		hashring = d.unblockedPool(hashring, ip)
+		hashring = d.foreignPool(hashring, ip)
 		var resources []core.Resource
 		if hashring.Len() <= d.cfg.NumBridgesPerRequest {
 			resources = hashring.GetAll()
@@ -141,6 +281,7 @@ func (d *MoatDistributor) getBridges(bs BridgeSettings, ip net.IP) []string {
 				log.Println("Error getting resources from the subhashring:", err)
 			}
 		}
+		d.reporter.Record(resources)
 		bridgestrings := []string{}
 		for _, resource := range resources {
 			bridgestrings = append(bridgestrings, resource.String())
@@ -153,6 +294,69 @@ func (d *MoatDistributor) getBridges(bs BridgeSettings, ip net.IP) []string {
 	}
 }
 
+// countryPool returns the part of the hashring assigned to the country of the
+// ip during the current rotation period.  Resources and countries are mapped
+// into NumCountryPools buckets, and the mapping changes every period.
+func (d *MoatDistributor) countryPool(hashring *core.Hashring, ip net.IP) *core.Hashring {
+	pool, ok := d.countryPoolIndex(ip)
+	if !ok {
+		return hashring
+	}
+
+	period := d.getPeriod()
+	numPools := uint64(d.cfg.NumCountryPools)
+	countryHashring := hashring.Filter(func(r core.Resource) bool {
+		return uint64(core.NewHashkey(fmt.Sprintf("%d-%d", r.Uid(), period)))%numPools == pool
+	})
+
+	if countryHashring.Len() == 0 {
+		log.Printf("Country pool %d is empty, using the whole rotation pool.", pool)
+		return hashring
+	}
+	return countryHashring
+}
+
+// unblockedPool returns the resources of the hashring that are not blocked in
+// the country of the ip.  Resources blocked in other countries are still
+// handed out here.
+func (d *MoatDistributor) unblockedPool(hashring *core.Hashring, ip net.IP) *core.Hashring {
+	if d.CountryFromIP == nil || ip == nil {
+		return hashring
+	}
+
+	country := d.CountryFromIP(ip)
+	if country == "" {
+		return hashring
+	}
+	return hashring.Filter(core.NotBlockedIn(country))
+}
+
+// foreignPool returns the resources of the hashring that are not hosted in
+// the country of the ip, if the distributor is configured to exclude them.
+func (d *MoatDistributor) foreignPool(hashring *core.Hashring, ip net.IP) *core.Hashring {
+	if !d.cfg.ExcludeSameCountry || d.CountryFromIP == nil || ip == nil {
+		return hashring
+	}
+
+	country := d.CountryFromIP(ip)
+	if country == "" {
+		return hashring
+	}
+	return hashring.Filter(core.NotHostedIn(country))
+}
+
+// countryPoolIndex returns the country pool of the ip for the current rotation
+// period, and false if country pools are not in use.
+func (d *MoatDistributor) countryPoolIndex(ip net.IP) (uint64, bool) {
+	if d.cfg.NumCountryPools <= 1 || d.CountryFromIP == nil || ip == nil {
+		return 0, false
+	}
+
+	country := d.CountryFromIP(ip)
+	numPools := uint64(d.cfg.NumCountryPools)
+	return uint64(core.NewHashkey(fmt.Sprintf("%s-%d", country, d.getPeriod()))) % numPools, true
+}
+
 func ipHashkey(ip net.IP) core.Hashkey {
 	mask := net.CIDRMask(32, 128)
 	if ip.To4() != nil {
@@ -162,20 +366,18 @@ func ipHashkey(ip net.IP) core.Hashkey {
 }
 
 func (d *MoatDistributor) GetBuiltInBridges(types []string) map[string][]string {
-	builtinBridges := map[string][]string{}
-	if len(types) == 0 {
-		builtinBridges = d.builtinBridges
-	}
+	d.builtinLock.RLock()
+	defer d.builtinLock.RUnlock()
 
-	for _, t := range types {
-		bridges, ok := d.builtinBridges[t]
-		if ok {
-			builtinBridges[t] = bridges
+	builtinBridges := map[string][]string{}
+	for t, bridges := range d.builtinBridges {
+		if len(types) != 0 && !contains(types, t) {
+			continue
 		}
-	}
-
-	for _, bridges := range builtinBridges {
-		mrand.Shuffle(len(bridges), func(i, j int) { bridges[i], bridges[j] = bridges[j], bridges[i] })
+		// copy the list so we don't shuffle the one we share
+		shuffled := append([]string{}, bridges...)
+		mrand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		builtinBridges[t] = shuffled
 	}
 	return builtinBridges
 }
@@ -186,13 +388,24 @@ func (d *MoatDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	defer close(rStream)
 	defer d.ipc.StopStream()
 
+	retryDelay := builtinRetryMinDelay
 	ticker := time.NewTimer(builtinRefreshSeconds)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			d.fetchBuiltinBridges()
+			if d.fetchBuiltinBridges() {
+				retryDelay = builtinRetryMinDelay
+				ticker.Reset(builtinRefreshSeconds)
+			} else {
+				log.Println("Retrying to fetch builtin bridges in", retryDelay)
+				ticker.Reset(retryDelay)
+				retryDelay *= 2
+				if retryDelay > builtinRefreshSeconds {
+					retryDelay = builtinRefreshSeconds
+				}
+			}
 		case diff := <-rStream:
 			d.collection.ApplyDiff(diff)
 		case <-d.shutdown:
@@ -202,14 +415,56 @@ func (d *MoatDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	}
 }
 
-func (d *MoatDistributor) fetchBuiltinBridges() {
+// fetchBuiltinBridges updates the builtin bridges of each type and returns
+// false if any of them failed.  If a type fails we keep the last good list.
+func (d *MoatDistributor) fetchBuiltinBridges() bool {
+	success := true
+	builtinBridges := make(map[string][]string, len(d.cfg.BuiltInBridgesTypes))
 	for _, bType := range d.cfg.BuiltInBridgesTypes {
-		builtinBridges, err := d.FetchBridges(d.cfg.BuiltInBridgesURL + "bridges_list." + bType + ".txt")
+		bridgeLines, err := d.FetchBridges(d.cfg.BuiltInBridgesURL + "bridges_list." + bType + ".txt")
+		if err == nil && len(bridgeLines) == 0 {
+			err = errors.New("empty bridge list")
+		}
 		if err != nil {
 			log.Println("Failed to fetch builtin bridges of type", bType, ":", err)
+			success = false
+			builtinBridges[bType] = d.getBuiltinBridgesOfType(bType)
 			continue
 		}
-		d.builtinBridges[bType] = builtinBridges
+		builtinBridges[bType] = bridgeLines
+	}
+
+	d.builtinLock.Lock()
+	d.builtinBridges = builtinBridges
+	d.builtinLock.Unlock()
+
+	if d.BuiltinStore != nil {
+		err := d.BuiltinStore.Save(builtinBridges)
+		if err != nil {
+			log.Println("Can't persist the builtin bridges:", err)
+		}
+	}
+	return success
+}
+
+func (d *MoatDistributor) getBuiltinBridgesOfType(bType string) []string {
+	d.builtinLock.RLock()
+	defer d.builtinLock.RUnlock()
+	return d.builtinBridges[bType]
+}
+
+// loadBuiltinBridges loads the last good list of builtin bridges, so we have
+// something to distribute if the first fetch fails.
+func (d *MoatDistributor) loadBuiltinBridges() {
+	d.builtinBridges = make(map[string][]string)
+	if d.BuiltinStore == nil {
+		return
+	}
+
+	err := d.BuiltinStore.Load(&d.builtinBridges)
+	if err != nil {
+		log.Println("Can't load stored builtin bridges:", err)
+		d.builtinBridges = make(map[string][]string)
 	}
 }
 
@@ -225,14 +480,14 @@ func (d *MoatDistributor) Init(cfg *internal.Config) {
 		d.collection.AddResourceType(rType, len(proportions) == 0, proportions)
 	}
 
-	d.builtinBridges = make(map[string][]string)
+	d.loadBuiltinBridges()
 	d.fetchBuiltinBridges()
 
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		cfg.Backend.ApiTokens[DistName])
+	d.ipc = d.IPC
+	if d.ipc == nil {
+		d.ipc = internal.NewResourceStreamIpc(cfg, d.cfg.Resources, cfg.Backend.ApiTokens[DistName])
+	}
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: "settings",
@@ -243,6 +498,15 @@ func (d *MoatDistributor) Init(cfg *internal.Config) {
 
 	d.wg.Add(1)
 	go d.housekeeping(rStream)
+
+	d.reporter = exposure.NewReporter(cfg, DistName, d.collection)
+	d.reporter.Start()
+
+	d.feedback = newFeedbackReporter(cfg, d.FeedbackIPC)
+	if d.feedback != nil {
+		d.wg.Add(1)
+		go d.reportFeedback()
+	}
 }
 
 func (d *MoatDistributor) makeProportions() map[string]int {
@@ -258,9 +522,20 @@ func (d *MoatDistributor) getProportionIndex() string {
 		return ""
 	}
 
-	now := int(time.Now().Unix() / (60 * 60))
-	period := now / d.cfg.RotationPeriodHours
-	return strconv.Itoa(period % d.cfg.NumPeriods)
+	return strconv.Itoa(d.getPeriod() % d.cfg.NumPeriods)
+}
+
+// getPeriod returns the number of rotation periods since the epoch
+func (d *MoatDistributor) getPeriod() int {
+	if d.cfg.RotationPeriodHours == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if d.Now != nil {
+		now = d.Now()
+	}
+	return int(now.Unix()/(60*60)) / d.cfg.RotationPeriodHours
 }
 
 func (d *MoatDistributor) Shutdown() {
@@ -268,4 +543,36 @@ func (d *MoatDistributor) Shutdown() {
 
 	close(d.shutdown)
 	d.wg.Wait()
+	d.reporter.Stop()
+}
+
+// Healthz returns an error if the distributor has neither resources from the
+// backend nor builtin bridges to hand out.
+func (d *MoatDistributor) Healthz() error {
+	stats := d.Stats()
+	if stats.Counters["builtin_bridges"] != 0 {
+		return nil
+	}
+	return distributors.CheckResources(stats)
+}
+
+// Stats returns the number of resources of each type in the collection and
+// the number of builtin bridges.
+func (d *MoatDistributor) Stats() distributors.Stats {
+	resources := make(map[string]int)
+	for rType, hashring := range d.collection {
+		resources[rType] = hashring.Len()
+	}
+
+	d.builtinLock.RLock()
+	builtin := 0
+	for _, bridges := range d.builtinBridges {
+		builtin += len(bridges)
+	}
+	d.builtinLock.RUnlock()
+
+	return distributors.Stats{
+		Resources: resources,
+		Counters:  map[string]int{"builtin_bridges": builtin},
+	}
 }
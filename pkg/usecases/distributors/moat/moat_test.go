@@ -5,11 +5,18 @@
 package moat
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 )
 
 var (
@@ -72,6 +79,12 @@ func TestCircumventionMap(t *testing.T) {
 	if m["cn"].Settings[0].Bridges.Type != "snowflake" {
 		t.Error("Wrong type of 'cn' bridge", m["cn"].Settings[0].Bridges.Type)
 	}
+
+	for country, known := range map[string]bool{"cn": true, "fr": true, "de": false, "CN": false, "c\"n": false, "": false} {
+		if d.KnownCountry(country) != known {
+			t.Errorf("KnownCountry(%q) is not %v", country, known)
+		}
+	}
 }
 
 func TestCircumventionSettings(t *testing.T) {
@@ -83,7 +96,7 @@ func TestCircumventionSettings(t *testing.T) {
 		t.Fatal("Can parse circumventionMap", err)
 	}
 
-	settings, err := d.GetCircumventionSettings("gb", []string{}, nil)
+	settings, err := d.GetCircumventionSettings(context.Background(), "gb", []string{}, nil)
 	if err != nil {
 		t.Fatal("Can get circumvention settings for gb:", err)
 	}
@@ -94,7 +107,7 @@ func TestCircumventionSettings(t *testing.T) {
 		t.Error("Unexpected country for 'gb'", settings.Country)
 	}
 
-	settings, err = d.GetCircumventionSettings("cn", []string{}, nil)
+	settings, err = d.GetCircumventionSettings(context.Background(), "cn", []string{}, nil)
 	if err != nil {
 		t.Fatal("Can get circumvention settings for cn:", err)
 	}
@@ -105,7 +118,7 @@ func TestCircumventionSettings(t *testing.T) {
 		t.Error("Wrong type of 'cn' settings bridge", settings.Settings[0].Bridges.Type)
 	}
 
-	settings, err = d.GetCircumventionSettings("fr", []string{}, nil)
+	settings, err = d.GetCircumventionSettings(context.Background(), "fr", []string{}, nil)
 	if err != nil {
 		t.Fatal("Can get circumvention settings for fr:", err)
 	}
@@ -119,7 +132,7 @@ func TestCircumventionSettings(t *testing.T) {
 		t.Error("Unexpected country for 'fr'", settings.Country)
 	}
 
-	settings, err = d.GetCircumventionSettings("fr", []string{"snowflake"}, nil)
+	settings, err = d.GetCircumventionSettings(context.Background(), "fr", []string{"snowflake"}, nil)
 	if err != nil {
 		t.Fatal("Can get circumvention settings for fr:", err)
 	}
@@ -130,7 +143,7 @@ func TestCircumventionSettings(t *testing.T) {
 		t.Error("Now snowlfake type of 'fr' settings bridge", settings.Settings[0].Bridges.Type)
 	}
 
-	settings, err = d.GetCircumventionSettings("fr", []string{"snowflake", "dummy"}, nil)
+	settings, err = d.GetCircumventionSettings(context.Background(), "fr", []string{"snowflake", "dummy"}, nil)
 	if err != nil {
 		t.Fatal("Can get circumvention settings for fr:", err)
 	}
@@ -142,6 +155,23 @@ func TestCircumventionSettings(t *testing.T) {
 	}
 }
 
+func TestCircumventionSettingsCanceled(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+
+	err := d.LoadCircumventionMap(strings.NewReader(circumventionMap))
+	if err != nil {
+		t.Fatal("Can parse circumventionMap", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.GetCircumventionSettings(ctx, "cn", []string{}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("Expected a canceled error:", err)
+	}
+}
+
 func TestBuiltInBridges(t *testing.T) {
 	d := initDistributor()
 	defer d.Shutdown()
@@ -167,3 +197,446 @@ func TestBuiltInBridges(t *testing.T) {
 		t.Fatal("No snowflake bridges found")
 	}
 }
+
+func TestCountryPools(t *testing.T) {
+	cfg := config
+	cfg.Distributors.Moat.NumCountryPools = 4
+	cfg.Distributors.Moat.RotationPeriodHours = 24
+	countries := map[string]string{
+		"192.0.2.1":    "aa",
+		"198.51.100.1": "bb",
+		"203.0.113.1":  "cc",
+		"100.64.0.1":   "dd",
+	}
+	d := MoatDistributor{
+		FetchBridges: fetchBridges,
+		CountryFromIP: func(ip net.IP) string {
+			return countries[ip.String()]
+		},
+	}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	for i := 0; i < 100; i++ {
+		d.collection["dummy"].Add(core.NewDummy(core.NewHashkey(fmt.Sprintf("oid-%d", i)), core.NewHashkey(fmt.Sprintf("uid-%d", i))))
+	}
+	hashring := d.collection.GetHashring(d.getProportionIndex(), "dummy")
+
+	pools := make(map[string]map[core.Hashkey]bool)
+	for ip, country := range countries {
+		pool := d.countryPool(hashring, net.ParseIP(ip))
+		if pool.Len() == 0 || pool.Len() == hashring.Len() {
+			t.Fatalf("Unexpected size of the pool for %s: %d", country, pool.Len())
+		}
+		pools[country] = make(map[core.Hashkey]bool)
+		for _, r := range pool.GetAll() {
+			pools[country][r.Uid()] = true
+		}
+	}
+
+	for country, pool := range pools {
+		for otherCountry, otherPool := range pools {
+			if country == otherCountry {
+				continue
+			}
+			overlap := 0
+			for uid := range pool {
+				if otherPool[uid] {
+					overlap++
+				}
+			}
+			if overlap != 0 && overlap != len(pool) {
+				t.Errorf("Pools of %s and %s partially overlap", country, otherCountry)
+			}
+		}
+	}
+}
+
+func TestBlockedBridges(t *testing.T) {
+	cfg := config
+	cfg.Distributors.Moat.NumBridgesPerRequest = 1
+	d := MoatDistributor{
+		FetchBridges: fetchBridges,
+		CountryFromIP: func(ip net.IP) string {
+			return map[string]string{"192.0.2.1": "ru", "198.51.100.1": "fr"}[ip.String()]
+		},
+	}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	blocked := core.NewDummy(core.NewHashkey("oid"), core.NewHashkey("uid"))
+	blocked.SetBlockedIn(core.LocationSet{"ru": true})
+	d.collection["dummy"].Add(blocked)
+
+	bs := BridgeSettings{Type: "dummy", Source: "bridgedb"}
+	if bridges := d.getBridges(bs, net.ParseIP("192.0.2.1")); len(bridges) != 0 {
+		t.Errorf("Got bridges blocked in the country of the request: %v", bridges)
+	}
+	if bridges := d.getBridges(bs, net.ParseIP("198.51.100.1")); len(bridges) != 1 {
+		t.Errorf("Didn't get the bridge blocked in another country: %v", bridges)
+	}
+}
+
+func TestSameCountryBridges(t *testing.T) {
+	cfg := config
+	cfg.Distributors.Moat.NumBridgesPerRequest = 1
+	cfg.Distributors.Moat.ExcludeSameCountry = true
+	d := MoatDistributor{
+		FetchBridges: fetchBridges,
+		CountryFromIP: func(ip net.IP) string {
+			return map[string]string{"192.0.2.1": "ru", "198.51.100.1": "fr"}[ip.String()]
+		},
+	}
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	local := core.NewDummy(core.NewHashkey("oid"), core.NewHashkey("uid"))
+	local.Loc = &core.Location{CountryCode: "RU"}
+	d.collection["dummy"].Add(local)
+
+	bs := BridgeSettings{Type: "dummy", Source: "bridgedb"}
+	if bridges := d.getBridges(bs, net.ParseIP("192.0.2.1")); len(bridges) != 0 {
+		t.Errorf("Got bridges hosted in the country of the request: %v", bridges)
+	}
+	if bridges := d.getBridges(bs, net.ParseIP("198.51.100.1")); len(bridges) != 1 {
+		t.Errorf("Didn't get the bridge hosted in another country: %v", bridges)
+	}
+}
+
+func TestFallbackTransports(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+
+	err := d.LoadCircumventionMap(strings.NewReader(circumventionMap))
+	if err != nil {
+		t.Fatal("Can parse circumventionMap", err)
+	}
+
+	_, err = d.GetCircumventionSettings(context.Background(), "cn", []string{"dummy"}, nil)
+	if !errors.Is(err, NoTransportError) {
+		t.Fatal("Expected NoTransportError without fallback:", err)
+	}
+
+	cfg := *d.cfg
+	cfg.FallbackTransports = []string{"obfs4", "dummy"}
+	cfg.NumBridgesPerRequest = 1
+	d.cfg = &cfg
+	settings, err := d.GetCircumventionSettings(context.Background(), "cn", []string{"dummy"}, nil)
+	if err != nil {
+		t.Fatal("Can get fallback circumvention settings for cn:", err)
+	}
+	if len(settings.Settings) != 1 {
+		t.Fatal("Wrong number of fallback settings", settings.Settings)
+	}
+	if settings.Settings[0].Bridges.Type != "dummy" || settings.Settings[0].Bridges.Source != "bridgedb" {
+		t.Error("Unexpected fallback settings", settings.Settings[0].Bridges)
+	}
+	if len(settings.Settings[0].Bridges.BridgeStrings) != 1 {
+		t.Error("Wrong fallback bridges", settings.Settings[0].Bridges.BridgeStrings)
+	}
+
+	_, err = d.GetCircumventionSettings(context.Background(), "cn", []string{"vanilla"}, nil)
+	if !errors.Is(err, NoTransportError) {
+		t.Error("Expected NoTransportError for a transport out of the fallback chain:", err)
+	}
+}
+
+func TestEditCircumventionMap(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+
+	err := d.LoadCircumventionMap(strings.NewReader(circumventionMap))
+	if err != nil {
+		t.Fatal("Can parse circumventionMap", err)
+	}
+	oldMap := d.GetCircumventionMap()
+
+	ru := CircumventionSettings{Settings: []Settings{{Bridges: BridgeSettings{Type: "dummy", Source: "bridgedb"}}}}
+	err = d.PatchCircumventionMap(map[string]*CircumventionSettings{
+		"ru": &ru,
+		"cn": nil,
+	})
+	if err != nil {
+		t.Fatal("Can't patch the circumvention map:", err)
+	}
+	m := d.GetCircumventionMap()
+	if _, ok := m["cn"]; ok {
+		t.Error("cn was not removed from the map")
+	}
+	if _, ok := m["fr"]; !ok {
+		t.Error("fr was removed from the map")
+	}
+	if m["ru"].Settings[0].Bridges.Type != "dummy" {
+		t.Error("Wrong settings for ru", m["ru"])
+	}
+	if _, ok := oldMap["cn"]; !ok {
+		t.Error("The old map was modified in place")
+	}
+
+	invalid := []CircumventionMap{
+		{"ru": {Settings: []Settings{{Bridges: BridgeSettings{Type: "obfs4", Source: "bridgedb"}}}}},
+		{"ru": {Settings: []Settings{{Bridges: BridgeSettings{Type: "dummy", Source: "unknown"}}}}},
+		{"ru": {Settings: []Settings{{Bridges: BridgeSettings{Type: "dummy", Source: "builtin"}}}}},
+		{"RUS": {Settings: []Settings{}}},
+	}
+	for _, invalidMap := range invalid {
+		err = d.SetCircumventionMap(invalidMap)
+		if err == nil {
+			t.Error("Invalid map was accepted:", invalidMap)
+		}
+	}
+
+	err = d.SetCircumventionMap(CircumventionMap{"ru": ru})
+	if err != nil {
+		t.Fatal("Can't set the circumvention map:", err)
+	}
+	if len(d.GetCircumventionMap()) != 1 {
+		t.Error("Wrong circumvention map", d.GetCircumventionMap())
+	}
+}
+
+func TestBuiltinBridgesLastGood(t *testing.T) {
+	store := pjson.New("builtin_bridges", t.TempDir())
+	d := MoatDistributor{
+		FetchBridges: fetchBridges,
+		BuiltinStore: store,
+	}
+	d.Init(&config)
+	d.Shutdown()
+
+	failingFetch := func(url string) ([]string, error) {
+		return nil, errors.New("network is down")
+	}
+	d.FetchBridges = failingFetch
+	if d.fetchBuiltinBridges() {
+		t.Error("Failed fetch reported as success")
+	}
+	if len(d.GetBuiltInBridges([]string{"snowflake"})["snowflake"]) != 1 {
+		t.Error("Lost the last good builtin bridges after a failed fetch")
+	}
+
+	d = MoatDistributor{
+		FetchBridges: failingFetch,
+		BuiltinStore: store,
+	}
+	d.Init(&config)
+	defer d.Shutdown()
+	if len(d.GetBuiltInBridges([]string{"snowflake"})["snowflake"]) != 1 {
+		t.Error("Builtin bridges were not loaded from the store")
+	}
+}
+
+func TestExpiryHints(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+
+	err := d.LoadCircumventionMap(strings.NewReader(circumventionMap))
+	if err != nil {
+		t.Fatal("Can parse circumventionMap", err)
+	}
+	cfg := *d.cfg
+	cfg.RotationPeriodHours = 24
+	d.cfg = &cfg
+
+	settings, err := d.GetCircumventionSettings(context.Background(), "cn", []string{}, nil)
+	if err != nil {
+		t.Fatal("Can get circumvention settings for cn:", err)
+	}
+	if settings.ValidUntil != nil || settings.PoolID != "" {
+		t.Error("Builtin only settings should not have expiry hints", settings)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	settings, err = d.GetCircumventionSettings(context.Background(), "fr", []string{}, ip)
+	if err != nil {
+		t.Fatal("Can get circumvention settings for fr:", err)
+	}
+	if settings.ValidUntil == nil {
+		t.Fatal("No valid_until in the settings of fr")
+	}
+	untilEnd := time.Until(*settings.ValidUntil)
+	if untilEnd <= 0 || untilEnd > 24*time.Hour {
+		t.Error("valid_until is not in the current rotation period:", settings.ValidUntil)
+	}
+	if settings.PoolID == "" {
+		t.Error("No pool_id in the settings of fr")
+	}
+
+	other, err := d.GetCircumventionSettings(context.Background(), "fr", []string{}, net.ParseIP("192.0.2.2"))
+	if err != nil {
+		t.Fatal("Can get circumvention settings for fr:", err)
+	}
+	if other.PoolID != settings.PoolID {
+		t.Error("Different pool for requests in the same pool:", other.PoolID, settings.PoolID)
+	}
+}
+
+// feedbackBackend records the feedback reports and answers with its
+// effectiveness.  It writes to reported after each report.
+type feedbackBackend struct {
+	sync.Mutex
+	reports       []core.FeedbackReport
+	effectiveness map[string]map[string]core.FeedbackResults
+	reported      chan bool
+}
+
+func (f *feedbackBackend) StartStream(*core.ResourceRequest) {}
+func (f *feedbackBackend) StopStream()                       {}
+func (f *feedbackBackend) MakeJsonRequest(ctx context.Context, req interface{}, resp interface{}) error {
+	f.Lock()
+	defer f.Unlock()
+	f.reports = append(f.reports, req.(core.FeedbackReport))
+	resp.(*core.EffectivenessReport).Effectiveness = f.effectiveness
+	select {
+	case f.reported <- true:
+	default:
+	}
+	return nil
+}
+
+var clientIP = net.ParseIP("192.0.2.1")
+
+func TestFeedback(t *testing.T) {
+	d := initDistributor()
+	defer d.Shutdown()
+	if err := d.RecordFeedback("fr", []FeedbackResult{{Transport: "dummy", Worked: true}}, clientIP); !errors.Is(err, FeedbackDisabledError) {
+		t.Errorf("Got the error %v instead of disabled feedback", err)
+	}
+
+	backend := &feedbackBackend{reported: make(chan bool, 1)}
+	d = &MoatDistributor{FetchBridges: fetchBridges, FeedbackIPC: backend}
+	d.Init(&config)
+	defer d.Shutdown()
+	// moat reports when it starts
+	<-backend.reported
+	err := d.LoadCircumventionMap(strings.NewReader(circumventionMap))
+	if err != nil {
+		t.Fatal("Can parse circumventionMap", err)
+	}
+
+	invalid := []struct {
+		country string
+		results []FeedbackResult
+	}{
+		{"FRA", []FeedbackResult{{Transport: "dummy"}}},
+		{"fr", nil},
+		{"fr", []FeedbackResult{{Transport: "obfs4"}}},
+	}
+	for _, feedback := range invalid {
+		if err := d.RecordFeedback(feedback.country, feedback.results, clientIP); !errors.Is(err, InvalidFeedbackError) {
+			t.Errorf("Got the error %v instead of invalid feedback for %v", err, feedback)
+		}
+	}
+	results := []FeedbackResult{{Transport: "dummy", Worked: false}, {Transport: "dummy", Worked: true}, {Transport: "snowflake", Worked: true}}
+	if err := d.RecordFeedback("fr", results, clientIP); err != nil {
+		t.Fatal("Can't record feedback:", err)
+	}
+
+	backend.Lock()
+	backend.effectiveness = map[string]map[string]core.FeedbackResults{
+		"fr": {"dummy": {Worked: 1, Failed: 9}, "snowflake": {Worked: 9, Failed: 1}},
+	}
+	backend.Unlock()
+	oldMap := d.GetCircumventionMap()
+	d.sendFeedback()
+	backend.Lock()
+	report := backend.reports[len(backend.reports)-1]
+	backend.Unlock()
+	if counts := report.Results["fr"]["dummy"]; counts.Worked != 0 || counts.Failed != 1 {
+		t.Errorf("Wrong feedback reported for dummy: %v", report.Results)
+	}
+	if counts := report.Results["fr"]["snowflake"]; counts.Worked != 1 {
+		t.Errorf("Wrong feedback reported for snowflake: %v", report.Results)
+	}
+
+	fr := d.GetCircumventionMap()["fr"].Settings
+	if len(fr) != 2 || fr[0].Bridges.Type != "snowflake" || fr[1].Bridges.Type != "dummy" {
+		t.Errorf("The settings of fr were not reordered: %v", fr)
+	}
+	if oldMap["fr"].Settings[0].Bridges.Type != "dummy" {
+		t.Error("The old map was modified in place")
+	}
+	if d.circumventionMap["fr"].Settings[0].Bridges.Type != "dummy" {
+		t.Error("The reordering changed the map of the admins")
+	}
+}
+
+func TestOrderByEffectiveness(t *testing.T) {
+	settings := []Settings{
+		{Bridges: BridgeSettings{Type: "obfs4", Source: "bridgedb"}},
+		{Bridges: BridgeSettings{Type: "meek", Source: "builtin"}},
+		{Bridges: BridgeSettings{Type: "snowflake", Source: "builtin"}},
+	}
+	effectiveness := map[string]core.FeedbackResults{
+		"obfs4":     {Worked: 1, Failed: 1},
+		"snowflake": {Worked: 2},
+	}
+	ordered := orderByEffectiveness(settings, effectiveness, 1)
+	types := []string{}
+	for _, s := range ordered {
+		types = append(types, s.Bridges.Type)
+	}
+	if strings.Join(types, ",") != "snowflake,meek,obfs4" {
+		t.Errorf("Wrong order of the settings: %v", types)
+	}
+	if settings[0].Bridges.Type != "obfs4" {
+		t.Error("The settings were modified in place")
+	}
+
+	// the least effective setting of the admins can only move up one place
+	settings = []Settings{
+		{Bridges: BridgeSettings{Type: "obfs4"}},
+		{Bridges: BridgeSettings{Type: "meek"}},
+		{Bridges: BridgeSettings{Type: "snowflake"}},
+		{Bridges: BridgeSettings{Type: "webtunnel"}},
+	}
+	effectiveness = map[string]core.FeedbackResults{
+		"obfs4":     {Worked: 1, Failed: 3},
+		"meek":      {Worked: 2, Failed: 2},
+		"snowflake": {Worked: 3, Failed: 1},
+		"webtunnel": {Worked: 4},
+	}
+	for maxMoves, expected := range map[int]string{
+		1: "meek,obfs4,webtunnel,snowflake",
+		2: "snowflake,webtunnel,obfs4,meek",
+		3: "webtunnel,snowflake,meek,obfs4",
+	} {
+		types = []string{}
+		for _, s := range orderByEffectiveness(settings, effectiveness, maxMoves) {
+			types = append(types, s.Bridges.Type)
+		}
+		if strings.Join(types, ",") != expected {
+			t.Errorf("Wrong order of the settings with %d moves: %v instead of %s", maxMoves, types, expected)
+		}
+	}
+}
+
+func TestFeedbackRateLimit(t *testing.T) {
+	backend := &feedbackBackend{reported: make(chan bool, 1)}
+	d := &MoatDistributor{FetchBridges: fetchBridges, FeedbackIPC: backend}
+	cfg := config
+	cfg.Distributors.Moat.FeedbackMaxPerHour = 2
+	d.Init(&cfg)
+	defer d.Shutdown()
+
+	results := []FeedbackResult{{Transport: "dummy", Worked: true}}
+	for i := 0; i < 2; i++ {
+		if err := d.RecordFeedback("fr", results, net.ParseIP("192.0.2.1")); err != nil {
+			t.Fatal("Can't record feedback:", err)
+		}
+	}
+	// the same /16
+	if err := d.RecordFeedback("fr", results, net.ParseIP("192.0.3.1")); !errors.Is(err, FeedbackRateLimitError) {
+		t.Errorf("Got the error %v instead of a rate limit", err)
+	}
+	if err := d.RecordFeedback("fr", results, net.ParseIP("198.51.100.1")); err != nil {
+		t.Errorf("The feedback of another address was limited: %v", err)
+	}
+
+	d.feedback.resultsLock.Lock()
+	counts := d.feedback.results["fr"]["dummy"]
+	d.feedback.resultsLock.Unlock()
+	if counts.Worked != 3 {
+		t.Errorf("Counted %d results instead of 3", counts.Worked)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/distributorsdk"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+const (
+	DistName = "nostr"
+
+	// pubKeyLength is the length of a nostr public key, the x coordinate of
+	// a secp256k1 point
+	pubKeyLength = 32
+)
+
+var (
+	NoBridgesError     = distributorsdk.NoBridgesError
+	InvalidPubKeyError = errors.New("invalid public key")
+)
+
+// NostrDistributor contains all the context that the distributor needs to run.
+type NostrDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+
+	base *distributorsdk.Distributor
+	cfg  *internal.NostrDistConfig
+}
+
+// GetResources returns the resources for the hex encoded public key of the
+// user.  The same key gets the same resources during a rotation period.  No
+// resources are handed out if the given context is done.
+func (d *NostrDistributor) GetResources(ctx context.Context, pubkey string) ([]core.Resource, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(pubkey)
+	if err != nil || len(key) != pubKeyLength {
+		d.base.RecordRequest("error")
+		return nil, InvalidPubKeyError
+	}
+	period := distributorsdk.RotationPeriod(d.cfg.RotationPeriodHours)
+	hashKey := core.NewHashkey(fmt.Sprintf("%x-%d", key, period))
+	return d.base.HandOut(hashKey, d.cfg.NumBridgesPerRequest)
+}
+
+// Init initialises the given Nostr distributor.
+func (d *NostrDistributor) Init(cfg *internal.Config) {
+	log.Printf("Initialising %s distributor.", DistName)
+
+	d.cfg = &cfg.Distributors.Nostr
+	sdkCfg := distributorsdk.FromRdsysConfig(cfg, DistName, d.cfg.Resources)
+	if d.IPC != nil {
+		sdkCfg.IPC = d.IPC
+	}
+	d.base = distributorsdk.New(sdkCfg, distributorsdk.Hooks{})
+	d.base.Start()
+}
+
+// Shutdown shuts down the given Nostr distributor.
+func (d *NostrDistributor) Shutdown() {
+	log.Printf("Shutting down %s distributor.", DistName)
+
+	d.base.Stop()
+}
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *NostrDistributor) Healthz() error {
+	return d.base.Healthz()
+}
+
+// Stats returns the number of resources of each type in the hashring.
+func (d *NostrDistributor) Stats() distributors.Stats {
+	return d.base.Stats()
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nostr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+)
+
+const pubkey = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+
+var config = internal.Config{
+	Distributors: internal.Distributors{
+		Nostr: internal.NostrDistConfig{
+			Resources:            []string{"dummy"},
+			NumBridgesPerRequest: 2,
+			RotationPeriodHours:  24,
+		},
+	},
+}
+
+func TestGetResources(t *testing.T) {
+	backend := testsupport.NewFakeBackend()
+	d := NostrDistributor{IPC: backend}
+	d.Init(&config)
+	defer d.Shutdown()
+
+	_, err := d.GetResources(context.Background(), pubkey)
+	if !errors.Is(err, NoBridgesError) {
+		t.Error("Expected no bridges error:", err)
+	}
+
+	if err := backend.Play(testsupport.NewScript().Add(testsupport.Dummies(5)...)); err != nil {
+		t.Fatal("Can't send resources:", err)
+	}
+	if err := testsupport.WaitFor(func() bool { return d.Stats().Resources["dummy"] == 5 }); err != nil {
+		t.Fatal("The distributor didn't get the resources:", err)
+	}
+
+	res, err := d.GetResources(context.Background(), pubkey)
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Wrong number of resources: %d", len(res))
+	}
+	res2, err := d.GetResources(context.Background(), strings.ToUpper(pubkey))
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	for i := range res {
+		if res[i] != res2[i] {
+			t.Error("Different resources for the same key:", res[i], res2[i])
+		}
+	}
+}
+
+func TestGetResourcesInvalidKey(t *testing.T) {
+	d := NostrDistributor{}
+	d.Init(&config)
+	defer d.Shutdown()
+	d.base.Ring.Add(core.NewDummy(core.NewHashkey("oid"), core.NewHashkey("uid")))
+
+	for _, key := range []string{"", "npub1abc", pubkey[:62], pubkey + "00"} {
+		_, err := d.GetResources(context.Background(), key)
+		if !errors.Is(err, InvalidPubKeyError) {
+			t.Errorf("Expected invalid key error for '%s': %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reserved
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/distributorsdk"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+const (
+	DistName = "reserved"
+
+	defaultBridgesPerHandout = 1
+	maxBridgesPerHandout     = 20
+)
+
+var (
+	handedOutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reserved_bridges_handed_out_total",
+		Help: "The total number of reserved bridges handed out by each operator",
+	}, []string{"operator"})
+
+	NoBridgesError       = distributorsdk.NoBridgesError
+	InvalidRequestError  = errors.New("invalid handout request")
+	UnsupportedTypeError = errors.New("unsupported resource type")
+	TooManyBridgesError  = errors.New("too many bridges requested")
+)
+
+// HandoutRequest is what an operator asks for to hand out bridges to a
+// partner.
+type HandoutRequest struct {
+	Operator  string
+	Recipient string
+	Note      string
+	Type      string
+	// Country is where the recipient will use the bridges, the resources
+	// blocked in it are not handed out
+	Country string
+	Num     int
+}
+
+// Handout is the record of some bridges handed out manually.
+type Handout struct {
+	ID        int       `json:"id"`
+	Operator  string    `json:"operator"`
+	Recipient string    `json:"recipient"`
+	Note      string    `json:"note"`
+	Country   string    `json:"country"`
+	Time      time.Time `json:"time"`
+	// Resources are the unique ids of the handed out resources, and
+	// Bridges their bridge lines at the time
+	Resources []core.Hashkey `json:"resources"`
+	Bridges   []string       `json:"bridges"`
+}
+
+// ReservedDistributor holds resources that are never distributed
+// automatically.  Operators hand them out manually to partners, and each
+// handout is recorded.
+type ReservedDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+
+	base *distributorsdk.Distributor
+	cfg  *internal.ReservedDistConfig
+
+	lock     sync.Mutex
+	handouts []Handout
+	// timesHandedOut counts the handouts of each resource unique id
+	timesHandedOut map[core.Hashkey]int
+
+	// HandoutsStore keeps the records of the handouts
+	HandoutsStore persistence.Mechanism
+}
+
+func (d *ReservedDistributor) supportsType(rType string) bool {
+	for _, t := range d.cfg.Resources {
+		if t == rType {
+			return true
+		}
+	}
+	return false
+}
+
+// HandOut picks the requested bridges, preferring the ones that were handed
+// out the fewest times, and records the handout.
+func (d *ReservedDistributor) HandOut(req HandoutRequest) (*Handout, []core.Resource, error) {
+	if req.Operator == "" || req.Recipient == "" || req.Num < 0 {
+		return nil, nil, InvalidRequestError
+	}
+	if req.Num == 0 {
+		req.Num = defaultBridgesPerHandout
+	}
+	if req.Num > maxBridgesPerHandout {
+		return nil, nil, TooManyBridgesError
+	}
+	if req.Type != "" && !d.supportsType(req.Type) {
+		return nil, nil, UnsupportedTypeError
+	}
+	country := strings.ToLower(req.Country)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	candidates := d.base.Ring.Filter(func(r core.Resource) bool {
+		if req.Type != "" && r.Type() != req.Type {
+			return false
+		}
+		_, blocked := r.BlockedIn()[country]
+		return country == "" || !blocked
+	}).GetAll()
+	if len(candidates) == 0 {
+		return nil, nil, NoBridgesError
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ti := d.timesHandedOut[candidates[i].Uid()]
+		tj := d.timesHandedOut[candidates[j].Uid()]
+		if ti != tj {
+			return ti < tj
+		}
+		return candidates[i].Uid() < candidates[j].Uid()
+	})
+	if len(candidates) > req.Num {
+		candidates = candidates[:req.Num]
+	}
+
+	handout := Handout{
+		ID:        len(d.handouts) + 1,
+		Operator:  req.Operator,
+		Recipient: req.Recipient,
+		Note:      req.Note,
+		Country:   country,
+		Time:      time.Now().UTC(),
+	}
+	for _, r := range candidates {
+		handout.Resources = append(handout.Resources, r.Uid())
+		handout.Bridges = append(handout.Bridges, r.String())
+		d.timesHandedOut[r.Uid()]++
+	}
+	d.handouts = append(d.handouts, handout)
+	d.saveHandouts()
+
+	log.Printf("Operator %s handed out %d reserved bridges to %q.", req.Operator, len(candidates), req.Recipient)
+	handedOutCount.WithLabelValues(req.Operator).Add(float64(len(candidates)))
+	return &handout, candidates, nil
+}
+
+// Handouts returns the records of all the handouts, the ones of operator if
+// it's not empty.
+func (d *ReservedDistributor) Handouts(operator string) []Handout {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	handouts := []Handout{}
+	for _, h := range d.handouts {
+		if operator == "" || h.Operator == operator {
+			handouts = append(handouts, h)
+		}
+	}
+	return handouts
+}
+
+func (d *ReservedDistributor) loadHandouts() {
+	d.timesHandedOut = make(map[core.Hashkey]int)
+	if d.HandoutsStore == nil {
+		return
+	}
+	err := d.HandoutsStore.Load(&d.handouts)
+	if err != nil {
+		log.Println("Can't load the handouts:", err)
+	}
+	for _, h := range d.handouts {
+		for _, uid := range h.Resources {
+			d.timesHandedOut[uid]++
+		}
+	}
+}
+
+// saveHandouts needs to be called with the lock held.
+func (d *ReservedDistributor) saveHandouts() {
+	if d.HandoutsStore == nil {
+		return
+	}
+	err := d.HandoutsStore.Save(d.handouts)
+	if err != nil {
+		log.Println("Can't save the handouts:", err)
+	}
+}
+
+// Init initialises the given reserved distributor.
+func (d *ReservedDistributor) Init(cfg *internal.Config) {
+	log.Printf("Initialising %s distributor.", DistName)
+
+	d.cfg = &cfg.Distributors.Reserved
+	d.loadHandouts()
+
+	sdkCfg := distributorsdk.FromRdsysConfig(cfg, DistName, d.cfg.Resources)
+	if d.IPC != nil {
+		sdkCfg.IPC = d.IPC
+	}
+	d.base = distributorsdk.New(sdkCfg, distributorsdk.Hooks{})
+	d.base.Start()
+}
+
+// Shutdown shuts down the given reserved distributor.
+func (d *ReservedDistributor) Shutdown() {
+	log.Printf("Shutting down %s distributor.", DistName)
+
+	d.base.Stop()
+}
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *ReservedDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in the hashring and the
+// number of recorded handouts.
+func (d *ReservedDistributor) Stats() distributors.Stats {
+	d.lock.Lock()
+	handouts := len(d.handouts)
+	d.lock.Unlock()
+
+	return distributors.Stats{
+		Resources: distributors.CountResources(d.base.Ring),
+		Counters:  map[string]int{"handouts": handouts},
+	}
+}
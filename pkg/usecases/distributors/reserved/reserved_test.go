@@ -0,0 +1,147 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reserved
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+var config = internal.Config{
+	Distributors: internal.Distributors{
+		Reserved: internal.ReservedDistConfig{
+			Resources: []string{"obfs4", "vanilla"},
+		},
+	},
+}
+
+func newTransport(i int) *resources.Transport {
+	t := resources.NewTransport()
+	t.SetType("obfs4")
+	t.Address = resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP(fmt.Sprintf("192.0.2.%d", i))}}
+	t.Port = 443
+	t.Fingerprint = fmt.Sprintf("%040d", i)
+	return t
+}
+
+func newDistributor(store persistence.Mechanism) *ReservedDistributor {
+	d := &ReservedDistributor{HandoutsStore: store}
+	d.Init(&config)
+	for i := 0; i < 4; i++ {
+		d.base.Ring.Add(newTransport(i))
+	}
+	return d
+}
+
+func TestHandOut(t *testing.T) {
+	d := newDistributor(nil)
+	defer d.Shutdown()
+
+	handout, resources, err := d.HandOut(HandoutRequest{Operator: "alice", Recipient: "ngo", Num: 3})
+	if err != nil {
+		t.Fatal("Can't hand out bridges:", err)
+	}
+	if len(resources) != 3 || len(handout.Bridges) != 3 || len(handout.Resources) != 3 {
+		t.Fatalf("Wrong number of bridges: %d", len(resources))
+	}
+	if handout.ID != 1 || handout.Operator != "alice" || handout.Recipient != "ngo" {
+		t.Errorf("Unexpected handout: %+v", handout)
+	}
+
+	// the bridge that was not handed out yet goes first
+	_, second, err := d.HandOut(HandoutRequest{Operator: "bob", Recipient: "journalist", Num: 1})
+	if err != nil {
+		t.Fatal("Can't hand out bridges:", err)
+	}
+	for _, r := range resources {
+		if r.Uid() == second[0].Uid() {
+			t.Error("A handed out bridge was handed out again before the others")
+		}
+	}
+
+	if n := len(d.Handouts("")); n != 2 {
+		t.Errorf("Wrong number of handouts: %d", n)
+	}
+	if handouts := d.Handouts("bob"); len(handouts) != 1 || handouts[0].Recipient != "journalist" {
+		t.Errorf("Wrong handouts for bob: %+v", handouts)
+	}
+}
+
+func TestHandOutErrors(t *testing.T) {
+	d := newDistributor(nil)
+	defer d.Shutdown()
+
+	for _, test := range []struct {
+		req HandoutRequest
+		err error
+	}{
+		{HandoutRequest{Recipient: "ngo"}, InvalidRequestError},
+		{HandoutRequest{Operator: "alice"}, InvalidRequestError},
+		{HandoutRequest{Operator: "alice", Recipient: "ngo", Num: maxBridgesPerHandout + 1}, TooManyBridgesError},
+		{HandoutRequest{Operator: "alice", Recipient: "ngo", Type: "meek"}, UnsupportedTypeError},
+		{HandoutRequest{Operator: "alice", Recipient: "ngo", Type: "vanilla"}, NoBridgesError},
+	} {
+		_, _, err := d.HandOut(test.req)
+		if err != test.err {
+			t.Errorf("Expected error %v for %+v, got: %v", test.err, test.req, err)
+		}
+	}
+}
+
+func TestHandOutBlocked(t *testing.T) {
+	d := newDistributor(nil)
+	defer d.Shutdown()
+
+	for _, r := range d.base.Ring.GetAll() {
+		r.SetBlockedIn(core.LocationSet{"ru": true})
+	}
+	_, _, err := d.HandOut(HandoutRequest{Operator: "alice", Recipient: "ngo", Country: "RU"})
+	if err != NoBridgesError {
+		t.Errorf("Expected no bridges for a blocked country, got: %v", err)
+	}
+	_, resources, err := d.HandOut(HandoutRequest{Operator: "alice", Recipient: "ngo", Country: "IR"})
+	if err != nil || len(resources) != 1 {
+		t.Errorf("Expected a bridge for a country without blocks, got: %v", err)
+	}
+}
+
+func TestHandoutsPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reserved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newDistributor(pjson.New("handouts", dir))
+	_, resources, err := d.HandOut(HandoutRequest{Operator: "alice", Recipient: "ngo", Num: 3})
+	d.Shutdown()
+	if err != nil {
+		t.Fatal("Can't hand out bridges:", err)
+	}
+
+	d = newDistributor(pjson.New("handouts", dir))
+	defer d.Shutdown()
+	if n := len(d.Handouts("alice")); n != 1 {
+		t.Fatalf("Wrong number of handouts after restart: %d", n)
+	}
+	_, second, err := d.HandOut(HandoutRequest{Operator: "alice", Recipient: "partner", Num: 1})
+	if err != nil {
+		t.Fatal("Can't hand out bridges:", err)
+	}
+	for _, r := range resources {
+		if r.Uid() == second[0].Uid() {
+			t.Error("The handout counts were not restored")
+		}
+	}
+}
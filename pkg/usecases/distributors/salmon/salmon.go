@@ -18,7 +18,7 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
@@ -39,13 +39,22 @@ const (
 // SalmonDistributor contains all the context that the distributor needs to
 // run.
 type SalmonDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+	// Now returns the current time.  It's time.Now if nil, simulations set
+	// it to advance the days faster.
+	Now func() time.Time
+
 	ipc      delivery.Mechanism
 	cfg      *internal.Config
 	wg       sync.WaitGroup
 	shutdown chan bool
 
-	TokenCache        map[string]*TokenMetaInfo
-	tokenCacheMutex   sync.Mutex
+	TokenCache      map[string]*TokenMetaInfo
+	tokenCacheMutex sync.Mutex
+	// proxiesMutex protects the proxies from the resource stream while
+	// they are handed out.
+	proxiesMutex      sync.Mutex
 	Users             map[string]*User
 	AssignedProxies   core.ResourceMap
 	UnassignedProxies core.ResourceMap
@@ -87,6 +96,14 @@ func (s *SalmonDistributor) String() string {
 		len(s.Assignments.ProxyToUser))
 }
 
+// now returns the current time in UTC.
+func (s *SalmonDistributor) now() time.Time {
+	if s.Now == nil {
+		return time.Now().UTC()
+	}
+	return s.Now().UTC()
+}
+
 // addUser adds a new user to Salmon and sets its trust and inviter to the
 // provided variables.
 func (s *SalmonDistributor) addUser(trust Trust, inviter *User) (*User, error) {
@@ -97,6 +114,7 @@ func (s *SalmonDistributor) addUser(trust Trust, inviter *User) (*User, error) {
 	}
 	u.InvitedBy = inviter
 	u.Trust = trust
+	u.LastPromoted = s.now()
 
 	s.Users[u.SecretId] = u
 	log.Printf("Created new user with secret ID %q.", u.SecretId)
@@ -104,54 +122,61 @@ func (s *SalmonDistributor) addUser(trust Trust, inviter *User) (*User, error) {
 	return u, nil
 }
 
-// convertToProxies converts the Resource elements in the given ResourceDiff to
-// Proxy elements, which extend Resources.
-func convertToProxies(diff *core.ResourceDiff) {
+// newProxy wraps the given resource in a Proxy, which extends Resources.
+func newProxy(r core.Resource) *Proxy {
+	return &Proxy{Resource: r}
+}
 
-	convert := func(m core.ResourceMap) {
-		for _, rQueue := range m {
-			for i, r := range rQueue {
-				rQueue[i] = &Proxy{Resource: r}
-			}
-		}
+// searchProxy returns the proxy with the given UID in the given queue.
+func searchProxy(q core.ResourceQueue, uid core.Hashkey) (*Proxy, bool) {
+	r, err := q.Search(uid)
+	if err != nil {
+		return nil, false
 	}
-	convert(diff.New)
-	convert(diff.Changed)
-	convert(diff.Gone)
+	return core.As[*Proxy](r)
 }
 
 // processDiff takes as input a resource diff and feeds it into Salmon's
-// existing set of resources.
+// existing set of resources.  The given diff is not modified because it may
+// be shared with other receivers of the resource stream.
 // TODO: How should we handle new proxies that are blocked already?
 func (s *SalmonDistributor) processDiff(diff *core.ResourceDiff) {
 
-	convertToProxies(diff)
+	s.proxiesMutex.Lock()
+	defer s.proxiesMutex.Unlock()
+
+	proxies := core.ConvertDiff(diff, newProxy)
 	for rType, rQueue := range diff.Changed {
-		for _, r1 := range rQueue {
+		for i, r1 := range rQueue {
 			// Is the given resource blocked in a new place?
 			q, exists := s.AssignedProxies[rType]
 			if !exists {
 				continue
 			}
-			r2, err := q.Search(r1.Uid())
-			if err == nil {
-				if r1.BlockedIn().HasLocationsNotIn(r2.BlockedIn()) {
-					r2.(*Proxy).SetBlocked(s.Assignments)
+			if p2, ok := searchProxy(q, r1.Uid()); ok {
+				if r1.BlockedIn().HasLocationsNotIn(p2.BlockedIn()) {
+					p2.SetBlocked(s.Assignments)
 				}
+				// Our assignments point to the proxy we already have, so we
+				// update it instead of replacing it.
+				p2.Resource = r1
+				proxies.Changed[rType][i] = p2
 			}
 		}
 	}
 	// Remove proxies that are now gone.
-	for _, rQueue := range diff.Gone {
+	for rType, rQueue := range diff.Gone {
 		for _, r := range rQueue {
-			s.Assignments.RemoveProxy(r.(*Proxy))
+			if p, ok := searchProxy(s.AssignedProxies[rType], r.Uid()); ok {
+				s.Assignments.RemoveProxy(p)
+			}
 		}
 	}
 
-	s.UnassignedProxies.ApplyDiff(diff)
+	s.UnassignedProxies.ApplyDiff(proxies)
 	// New proxies only belong in UnassignedProxies.
-	diff.New = nil
-	s.AssignedProxies.ApplyDiff(diff)
+	proxies.New = nil
+	s.AssignedProxies.ApplyDiff(proxies)
 	log.Printf("Unassigned proxies: %s; assigned proxies: %s",
 		s.UnassignedProxies, s.AssignedProxies)
 }
@@ -165,10 +190,10 @@ func (s *SalmonDistributor) Init(cfg *internal.Config) {
 	s.shutdown = make(chan bool)
 
 	log.Printf("Initialising resource stream.")
-	s.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		s.cfg.Backend.ApiTokens[DistName])
+	s.ipc = s.IPC
+	if s.ipc == nil {
+		s.ipc = internal.NewResourceStreamIpc(cfg, s.cfg.Distributors.Salmon.Resources, s.cfg.Backend.ApiTokens[DistName])
+	}
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
@@ -204,8 +229,34 @@ func (s *SalmonDistributor) Shutdown() {
 	s.wg.Wait()
 }
 
+// Healthz returns an error if the distributor has no proxies to hand out.
+func (s *SalmonDistributor) Healthz() error {
+	return distributors.CheckResources(s.Stats())
+}
+
+// Stats returns the number of proxies of each type, assigned or not, and the
+// number of users.
+func (s *SalmonDistributor) Stats() distributors.Stats {
+	stats := distributors.Stats{
+		Resources: make(map[string]int),
+		Counters:  map[string]int{"users": len(s.Users)},
+	}
+	s.proxiesMutex.Lock()
+	defer s.proxiesMutex.Unlock()
+	for name, proxies := range map[string]core.ResourceMap{
+		"assigned_proxies":   s.AssignedProxies,
+		"unassigned_proxies": s.UnassignedProxies,
+	} {
+		for rType, queue := range proxies {
+			stats.Resources[rType] += len(queue)
+			stats.Counters[name] += len(queue)
+		}
+	}
+	return stats
+}
+
 // Don't call this function directly.  Call findProxies instead.
-func (s *SalmonDistributor) findAssignedProxies(inviter *User) []core.Resource {
+func (s *SalmonDistributor) findAssignedProxies(inviter *User, country string) []core.Resource {
 
 	var proxies []core.Resource
 
@@ -215,7 +266,8 @@ func (s *SalmonDistributor) findAssignedProxies(inviter *User) []core.Resource {
 		log.Printf("Inviter %q has no assigned proxies.", inviter.SecretId)
 	}
 	for _, proxy := range inviterProxies {
-		if proxy.(*Proxy).IsDepleted(s.Assignments) {
+		p, ok := core.As[*Proxy](proxy)
+		if !ok || p.IsDepleted(s.Assignments) || !core.NotBlockedIn(country)(proxy) {
 			continue
 		}
 		proxies = append(proxies, proxy)
@@ -227,7 +279,7 @@ func (s *SalmonDistributor) findAssignedProxies(inviter *User) []core.Resource {
 	// If we don't have enough proxies yet, we are going to recursively
 	// traverse invitation tree to find already-assigned, non-depleted proxies.
 	for _, invitee := range inviter.Invited {
-		ps := s.findAssignedProxies(invitee)
+		ps := s.findAssignedProxies(invitee, country)
 		proxies = append(proxies, ps...)
 		if len(proxies) >= NumProxiesPerUser {
 			return proxies[:NumProxiesPerUser]
@@ -237,7 +289,9 @@ func (s *SalmonDistributor) findAssignedProxies(inviter *User) []core.Resource {
 	return proxies
 }
 
-func (s *SalmonDistributor) findProxies(invitee *User, rType string) []core.Resource {
+// findProxies finds proxies for the given user that are not blocked in the
+// user's country.  Proxies blocked in other countries are still handed out.
+func (s *SalmonDistributor) findProxies(invitee *User, rType string, country string) []core.Resource {
 
 	if invitee == nil {
 		return nil
@@ -246,7 +300,7 @@ func (s *SalmonDistributor) findProxies(invitee *User, rType string) []core.Reso
 	var proxies []core.Resource
 	// People who registered and admin friends don't have an inviter.
 	if invitee.InvitedBy != nil {
-		proxies := s.findAssignedProxies(invitee.InvitedBy)
+		proxies := s.findAssignedProxies(invitee.InvitedBy, country)
 		if len(proxies) == NumProxiesPerUser {
 			log.Printf("Returning %d proxies to user.", len(proxies))
 			return proxies
@@ -256,25 +310,32 @@ func (s *SalmonDistributor) findProxies(invitee *User, rType string) []core.Reso
 	// Take some of our unassigned proxies and allocate them for the given user
 	// graph, T(u).
 	numRemaining := NumProxiesPerUser - len(proxies)
-	if len(s.UnassignedProxies[rType]) < numRemaining {
-		numRemaining = len(s.UnassignedProxies[rType])
+	var newProxies, remaining []core.Resource
+	for _, p := range s.UnassignedProxies[rType] {
+		if len(newProxies) < numRemaining && core.NotBlockedIn(country)(p) {
+			newProxies = append(newProxies, p)
+		} else {
+			remaining = append(remaining, p)
+		}
 	}
-	newProxies := s.UnassignedProxies[rType][:numRemaining]
-	s.UnassignedProxies[rType] = s.UnassignedProxies[rType][numRemaining:]
+	s.UnassignedProxies[rType] = remaining
 	log.Printf("Not enough assigned proxies; allocated %d unassigned proxies, %d remaining",
 		len(newProxies), len(s.UnassignedProxies))
 
 	for _, p := range newProxies {
 		s.AssignedProxies[rType] = append(s.AssignedProxies[rType], p)
-		s.Assignments.Add(invitee, p.(*Proxy))
+		if proxy, ok := core.As[*Proxy](p); ok {
+			s.Assignments.Add(invitee, proxy)
+		}
 		proxies = append(proxies, p)
 	}
 
 	return proxies
 }
 
-// GetProxies attempts to return proxies for the given user.
-func (s *SalmonDistributor) GetProxies(secretId string, rType string) ([]core.Resource, error) {
+// GetProxies attempts to return proxies for the given user.  If the user's
+// country is given, the proxies blocked there are not returned.
+func (s *SalmonDistributor) GetProxies(secretId string, rType string, country string) ([]core.Resource, error) {
 
 	user, exists := s.Users[secretId]
 	if !exists {
@@ -300,13 +361,22 @@ func (s *SalmonDistributor) GetProxies(secretId string, rType string) ([]core.Re
 		return nil, errors.New("user is blocked and therefore unable to get proxies")
 	}
 
-	// Does the user already have assigned proxies?
-	userProxies := s.Assignments.GetProxies(user)
+	s.proxiesMutex.Lock()
+	defer s.proxiesMutex.Unlock()
+
+	// Does the user already have assigned proxies that aren't blocked in
+	// the user's country?
+	var userProxies []core.Resource
+	for _, proxy := range s.Assignments.GetProxies(user) {
+		if core.NotBlockedIn(country)(proxy) {
+			userProxies = append(userProxies, proxy)
+		}
+	}
 	if len(userProxies) > 0 {
 		return userProxies, nil
 	}
 
-	return s.findProxies(user, rType), nil
+	return s.findProxies(user, rType, country), nil
 }
 
 // housekeeping keeps track of periodic tasks.
@@ -326,22 +396,31 @@ func (s *SalmonDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 			log.Printf("Shutting down housekeeping.")
 			return
 		case <-ticker.C:
-			// Iterate over all users and proxies and update their trust levels if
-			// necessary.
-			log.Printf("Updating trust levels of %d users.", len(s.Users))
-			for _, user := range s.Users {
-				user.UpdateTrust()
-			}
-			log.Printf("Updating trust levels of %d proxies.", len(s.AssignedProxies))
-			for _, proxies := range s.AssignedProxies {
-				for _, proxy := range proxies {
-					proxy.(*Proxy).UpdateTrust(s.Assignments)
-				}
-			}
-			log.Printf("Pruning token cache.")
-			s.pruneTokenCache()
+			s.UpdateTrustLevels()
+		}
+	}
+}
+
+// UpdateTrustLevels runs Salmon's daily tasks: it iterates over all users and
+// proxies, updates their trust levels if necessary, and prunes the token
+// cache.
+func (s *SalmonDistributor) UpdateTrustLevels() {
+
+	log.Printf("Updating trust levels of %d users.", len(s.Users))
+	now := s.now()
+	for _, user := range s.Users {
+		user.UpdateTrust(now)
+	}
+	s.proxiesMutex.Lock()
+	log.Printf("Updating trust levels of %d proxies.", len(s.AssignedProxies))
+	for _, proxies := range s.AssignedProxies {
+		for _, proxy := range core.ResourcesOf[*Proxy](proxies) {
+			proxy.UpdateTrust(s.Assignments)
 		}
 	}
+	s.proxiesMutex.Unlock()
+	log.Printf("Pruning token cache.")
+	s.pruneTokenCache()
 }
 
 // pruneTokenCache removes expired tokens from our token cache.
@@ -352,7 +431,7 @@ func (s *SalmonDistributor) pruneTokenCache() {
 
 	prevLen := len(s.TokenCache)
 	for token, metaInfo := range s.TokenCache {
-		if time.Since(metaInfo.IssueTime) > InvitationTokenExpiry {
+		if s.now().Sub(metaInfo.IssueTime) > InvitationTokenExpiry {
 			// Time to delete the token.
 			log.Printf("Deleting expired token %q issued by user %q.", token, metaInfo.SecretInviterId)
 			delete(s.TokenCache, token)
@@ -401,7 +480,7 @@ func (s *SalmonDistributor) CreateInvite(secretId string) (string, error) {
 
 	// Add token to our token cache, where it remains until it's redeemed or
 	// until it expires.
-	s.TokenCache[token] = &TokenMetaInfo{secretId, time.Now().UTC()}
+	s.TokenCache[token] = &TokenMetaInfo{secretId, s.now()}
 
 	return token, nil
 }
@@ -421,7 +500,7 @@ func (s *SalmonDistributor) RedeemInvite(token string) (string, error) {
 	delete(s.TokenCache, token)
 
 	// Is our token still valid?
-	if time.Since(metaInfo.IssueTime) > InvitationTokenExpiry {
+	if s.now().Sub(metaInfo.IssueTime) > InvitationTokenExpiry {
 		return "", errors.New("invite token already expired")
 	}
 
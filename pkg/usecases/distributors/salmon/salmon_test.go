@@ -117,11 +117,18 @@ func TestProcessDiff(t *testing.T) {
 	salmon.AssignedProxies[resources.ResourceTypeObfs4] = queue
 
 	diff := core.NewResourceDiff()
-	// Create a new copy of the proxy and mark it as blocked.
-	pNew := &Proxy{Resource: resources.NewTransport()}
-	pNew.SetBlockedIn(core.LocationSet{"no": true})
-	diff.Changed = core.ResourceMap{resources.ResourceTypeObfs4: core.ResourceQueue{pNew}}
+	// Create a new copy of the proxy's resource and mark it as blocked.
+	rNew := resources.NewTransport()
+	rNew.SetBlockedIn(core.LocationSet{"no": true})
+	diff.Changed = core.ResourceMap{resources.ResourceTypeObfs4: core.ResourceQueue{rNew}}
 	salmon.processDiff(diff)
+	// The diff may be shared with other receivers, so it must not change.
+	if r := diff.Changed[resources.ResourceTypeObfs4][0]; r != rNew {
+		t.Errorf("processDiff modified the given diff: %v", r)
+	}
+	if p.Resource != rNew {
+		t.Errorf("assigned proxy doesn't wrap the changed resource: %v", p.Resource)
+	}
 
 	// User should now have a blocking event.
 	if len(u.InnocencePs) == 0 {
@@ -131,6 +138,18 @@ func TestProcessDiff(t *testing.T) {
 	if !u.Banned {
 		t.Errorf("failed to ban user")
 	}
+	// The proxy assigned to the user has to know where it's blocked.
+	proxies := a.GetProxies(u)
+	if len(proxies) != 1 || !proxies[0].BlockedIn()["no"] {
+		t.Errorf("assigned proxy didn't get updated: %v", proxies)
+	}
+
+	diff = core.NewResourceDiff()
+	diff.Gone = core.ResourceMap{resources.ResourceTypeObfs4: core.ResourceQueue{resources.NewTransport()}}
+	salmon.processDiff(diff)
+	if len(a.GetProxies(u)) != 0 {
+		t.Errorf("gone proxy is still assigned to the user")
+	}
 }
 
 // genResourceMap generates a resource map consisting of the given number of
@@ -183,7 +202,7 @@ func TestUserFlow(t *testing.T) {
 		t.Fatalf("Failed to redeem Salmon invite: %s", err)
 	}
 
-	proxies, err := salmon.GetProxies(userId, "obfs4")
+	proxies, err := salmon.GetProxies(userId, "obfs4", "")
 	if err != nil {
 		t.Fatalf("Failed to get proxies: %s", err)
 	}
@@ -192,3 +211,42 @@ func TestUserFlow(t *testing.T) {
 		t.Fatalf("Got no proxies.")
 	}
 }
+
+func TestBlockedProxies(t *testing.T) {
+
+	salmon := NewSalmonDistributor()
+	salmon.cfg.Distributors.Salmon.Resources = []string{resources.ResourceTypeObfs4}
+	salmon.UnassignedProxies = genResourceMap(NumProxiesPerUser + 1)
+	blocked := salmon.UnassignedProxies[resources.ResourceTypeObfs4][0]
+	blocked.SetBlockedIn(core.LocationSet{"ru": true})
+
+	admin, err := salmon.addUser(UntouchableTrustLevel, nil)
+	if err != nil {
+		t.Fatalf("Failed to create new admin user: %s", err)
+	}
+	proxies, err := salmon.GetProxies(admin.SecretId, "obfs4", "ru")
+	if err != nil {
+		t.Fatalf("Failed to get proxies: %s", err)
+	}
+	if len(proxies) != NumProxiesPerUser {
+		t.Fatalf("Got %d proxies instead of %d", len(proxies), NumProxiesPerUser)
+	}
+	for _, p := range proxies {
+		if p.Uid() == blocked.Uid() {
+			t.Error("Got a proxy blocked in the country of the user")
+		}
+	}
+
+	// the proxy is still handed out in other countries
+	user, err := salmon.addUser(UntouchableTrustLevel, nil)
+	if err != nil {
+		t.Fatalf("Failed to create new user: %s", err)
+	}
+	proxies, err = salmon.GetProxies(user.SecretId, "obfs4", "cn")
+	if err != nil {
+		t.Fatalf("Failed to get proxies: %s", err)
+	}
+	if len(proxies) != 1 || proxies[0].Uid() != blocked.Uid() {
+		t.Errorf("Didn't get the proxy blocked in another country: %v", proxies)
+	}
+}
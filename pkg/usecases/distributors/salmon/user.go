@@ -57,8 +57,9 @@ func NewUser() (*User, error) {
 	return u, nil
 }
 
-// UpdateTrust promotes the user's trust level if the time has come.
-func (u *User) UpdateTrust() {
+// UpdateTrust promotes the user's trust level if the time has come by the
+// given time.
+func (u *User) UpdateTrust(now time.Time) {
 
 	// Users can not be promoted beyond MaxTrustLevel.
 	if u.Trust >= MaxTrustLevel {
@@ -66,7 +67,7 @@ func (u *User) UpdateTrust() {
 	}
 
 	// A promotion from level n to n+1 takes 2^{n+1} days.
-	daysPassed := int64(time.Now().UTC().Sub(u.LastPromoted).Hours() / 24)
+	daysPassed := int64(now.UTC().Sub(u.LastPromoted).Hours() / 24)
 	daysRequired := int64(math.Exp2(math.Abs(float64(u.Trust + 1))))
 	if daysPassed >= daysRequired {
 		u.Trust++
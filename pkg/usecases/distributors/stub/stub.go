@@ -5,23 +5,61 @@
 package stub
 
 import (
+	"context"
 	"errors"
 	"log"
+	"math/rand"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
 const (
 	DistName = "stub"
+	// DefaultMaxSimulatedRequests is the maximum number of requests of a
+	// simulated load if the configuration doesn't set one.
+	DefaultMaxSimulatedRequests = 10000
 )
 
+var (
+	InvalidLoadError = errors.New("invalid number of simulated requests")
+)
+
+// StreamStats summarizes the resource stream that the distributor received
+// from the backend.
+type StreamStats struct {
+	Diffs    int       `json:"diffs"`
+	New      int       `json:"new"`
+	Changed  int       `json:"changed"`
+	Gone     int       `json:"gone"`
+	LastDiff time.Time `json:"last_diff"`
+}
+
+// LoadReport is the result of a simulated load.
+type LoadReport struct {
+	Requests int    `json:"requests"`
+	Errors   int    `json:"errors"`
+	Duration string `json:"duration"`
+	// Handouts counts how many times each resource was handed out, keyed
+	// by its string representation, to see how evenly the hashring spreads
+	// the requests.
+	Handouts map[string]int `json:"handouts"`
+}
+
 // StubDistributor contains the context that the distributor needs.  This
 // structure must implement the Distributor interface.
 type StubDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in
+	// tests.
+	IPC delivery.Mechanism
+
 	// ring contains the resources that we are going to distribute.
 	ring *core.Hashring
 	// ipc represents the IPC mechanism that we use to talk to the backend.
@@ -32,6 +70,11 @@ type StubDistributor struct {
 	shutdown chan bool
 	// wg is used to figure out when our housekeeping method is finished.
 	wg sync.WaitGroup
+
+	// streamLock protects streamStats, which counts the resource diffs
+	// that we got from the backend.
+	streamLock  sync.Mutex
+	streamStats StreamStats
 }
 
 // housekeeping keeps track of periodic tasks.
@@ -47,6 +90,7 @@ func (d *StubDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 			// We got a resource update from the backend.  Let's add it to our
 			// hashring.
 			d.ring.ApplyDiff(diff)
+			d.recordDiff(diff)
 		case <-d.shutdown:
 			// We are told to shut down.
 			log.Printf("Shutting down housekeeping.")
@@ -55,9 +99,108 @@ func (d *StubDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	}
 }
 
+// recordDiff adds the given resource diff to the stream stats.
+func (d *StubDistributor) recordDiff(diff *core.ResourceDiff) {
+	d.streamLock.Lock()
+	defer d.streamLock.Unlock()
+
+	d.streamStats.Diffs++
+	d.streamStats.LastDiff = time.Now()
+	for _, rQueue := range diff.New {
+		d.streamStats.New += len(rQueue)
+	}
+	for _, rQueue := range diff.Changed {
+		d.streamStats.Changed += len(rQueue)
+	}
+	for _, rQueue := range diff.Gone {
+		d.streamStats.Gone += len(rQueue)
+	}
+}
+
+// StreamStats returns the summary of the resource stream received so far.
+func (d *StubDistributor) StreamStats() StreamStats {
+	d.streamLock.Lock()
+	defer d.streamLock.Unlock()
+	return d.streamStats
+}
+
+// Partition returns all the resources that the backend assigned to the
+// distributor.
+func (d *StubDistributor) Partition() []core.Resource {
+	return d.ring.GetAll()
+}
+
+// Lookup returns the resources of the partition with the given fingerprint.
+func (d *StubDistributor) Lookup(fingerprint string) []core.Resource {
+	var found []core.Resource
+	for _, r := range d.ring.GetAll() {
+		var fp string
+		switch b := r.(type) {
+		case *resources.Transport:
+			fp = b.Fingerprint
+		case *resources.Bridge:
+			fp = b.Fingerprint
+		}
+		if fp != "" && strings.EqualFold(fp, fingerprint) {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// SimulateLoad makes the given number of bridge requests with random hashkeys,
+// from as many goroutines as CPUs, and reports how they went.  It stops early
+// if the given context is done.
+func (d *StubDistributor) SimulateLoad(ctx context.Context, num int) (*LoadReport, error) {
+	maxRequests := d.cfg.Distributors.Stub.MaxSimulatedRequests
+	if maxRequests == 0 {
+		maxRequests = DefaultMaxSimulatedRequests
+	}
+	if num <= 0 || num > maxRequests {
+		return nil, InvalidLoadError
+	}
+
+	report := &LoadReport{Handouts: make(map[string]int)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	keys := make(chan core.Hashkey)
+	start := time.Now()
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				resources, err := d.RequestBridges(ctx, key)
+				lock.Lock()
+				report.Requests++
+				if err != nil {
+					report.Errors++
+				}
+				for _, r := range resources {
+					report.Handouts[r.String()]++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < num && ctx.Err() == nil; i++ {
+		keys <- core.Hashkey(rand.Uint64())
+	}
+	close(keys)
+	wg.Wait()
+	report.Duration = time.Since(start).String()
+	return report, nil
+}
+
 // RequestBridges takes as input a hashkey (it is the frontend's responsibility
-// to derive the hashkey) and uses it to return a slice of resources.
-func (d *StubDistributor) RequestBridges(key core.Hashkey) ([]core.Resource, error) {
+// to derive the hashkey) and uses it to return a slice of resources.  No
+// resources are handed out if the given context is done.
+func (d *StubDistributor) RequestBridges(ctx context.Context, key core.Hashkey) ([]core.Resource, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	if d.ring.Len() == 0 {
 		return nil, errors.New("no bridges available")
@@ -82,10 +225,10 @@ func (d *StubDistributor) Init(cfg *internal.Config) {
 	// and others may change their state).  We will receive resources at the
 	// rStream channel.
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		d.cfg.Backend.ApiTokens[DistName])
+	d.ipc = d.IPC
+	if d.ipc == nil {
+		d.ipc = internal.NewResourceStreamIpc(cfg, d.cfg.Distributors.Stub.Resources, d.cfg.Backend.ApiTokens[DistName])
+	}
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
@@ -108,3 +251,13 @@ func (d *StubDistributor) Shutdown() {
 	close(d.shutdown)
 	d.wg.Wait()
 }
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *StubDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in the hashring.
+func (d *StubDistributor) Stats() distributors.Stats {
+	return distributors.Stats{Resources: distributors.CountResources(d.ring)}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const fingerprint = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+
+func newDistributor() *StubDistributor {
+	d := &StubDistributor{
+		ring: core.NewHashring(),
+		cfg:  &internal.Config{},
+	}
+	d.cfg.Distributors.Stub.MaxSimulatedRequests = 100
+
+	diff := core.NewResourceDiff()
+	bridge := resources.NewBridge()
+	bridge.Fingerprint = fingerprint
+	bridge.Address = resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}}
+	bridge.Port = 443
+	diff.New[bridge.Type()] = []core.Resource{bridge, core.NewDummy(1, 1)}
+	d.ring.ApplyDiff(diff)
+	d.recordDiff(diff)
+	return d
+}
+
+func TestStreamStats(t *testing.T) {
+	d := newDistributor()
+	if len(d.Partition()) != 2 {
+		t.Errorf("Wrong partition size: %d", len(d.Partition()))
+	}
+
+	diff := core.NewResourceDiff()
+	diff.Gone["dummy"] = []core.Resource{core.NewDummy(1, 1)}
+	d.recordDiff(diff)
+
+	stats := d.StreamStats()
+	if stats.Diffs != 2 || stats.New != 2 || stats.Gone != 1 || stats.Changed != 0 {
+		t.Errorf("Wrong stream stats: %+v", stats)
+	}
+	if stats.LastDiff.IsZero() {
+		t.Error("The time of the last diff wasn't recorded")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	d := newDistributor()
+	found := d.Lookup("2b280b23e1107bb62abfc40ddcc8824814f80a72")
+	if len(found) != 1 || found[0].(*resources.Bridge).Fingerprint != fingerprint {
+		t.Error("Can't find the bridge by fingerprint:", found)
+	}
+	if len(d.Lookup("0000000000000000000000000000000000000000")) != 0 {
+		t.Error("Found a bridge with an unknown fingerprint")
+	}
+}
+
+func TestSimulateLoad(t *testing.T) {
+	d := newDistributor()
+	for _, num := range []int{0, -1, 101} {
+		if _, err := d.SimulateLoad(context.Background(), num); !errors.Is(err, InvalidLoadError) {
+			t.Errorf("Expected an invalid load error for %d requests: %v", num, err)
+		}
+	}
+
+	report, err := d.SimulateLoad(context.Background(), 100)
+	if err != nil {
+		t.Fatal("Can't simulate load:", err)
+	}
+	if report.Requests != 100 || report.Errors != 0 {
+		t.Errorf("Wrong load report: %+v", report)
+	}
+	handouts := 0
+	for _, num := range report.Handouts {
+		handouts += num
+	}
+	if handouts != 100 {
+		t.Errorf("Wrong number of handouts: %d", handouts)
+	}
+}
+
+func TestResourceStream(t *testing.T) {
+	backend := testsupport.NewFakeBackend()
+	d := &StubDistributor{IPC: backend}
+	cfg := &internal.Config{}
+	cfg.Distributors.Stub.Resources = []string{"dummy"}
+	d.Init(cfg)
+	defer d.Shutdown()
+
+	dummies := testsupport.Dummies(3)
+	script := testsupport.NewScript().Add(dummies...).Change(dummies[0]).Remove(dummies[1:]...)
+	if err := backend.Play(script); err != nil {
+		t.Fatal("Can't play the script:", err)
+	}
+	err := testsupport.WaitFor(func() bool { return d.StreamStats().Diffs == 3 })
+	if err != nil {
+		t.Fatal("The distributor didn't get the diffs:", err)
+	}
+
+	stats := d.StreamStats()
+	if stats.New != 3 || stats.Changed != 1 || stats.Gone != 2 {
+		t.Errorf("Wrong stream stats: %+v", stats)
+	}
+	if len(d.Partition()) != 1 {
+		t.Errorf("Wrong partition size: %d", len(d.Partition()))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package targets
+
+import (
+	"context"
+	"errors"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+)
+
+var TargetsDisabledError = errors.New("the backend has no targets endpoint")
+
+// Client sends the ad-hoc queries of a distributor to the targets endpoint of
+// the backend.
+type Client struct {
+	distName string
+	ipc      delivery.Mechanism
+}
+
+// NewClient returns a client for the given distributor, or nil if the backend
+// has no targets endpoint configured.  The queries of a nil client fail with
+// TargetsDisabledError.
+func NewClient(cfg *internal.Config, distName string) *Client {
+	if cfg.Backend.TargetsEndpoint == "" {
+		return nil
+	}
+
+	return &Client{
+		distName: distName,
+		ipc: internal.NewBackendIpc(
+			cfg,
+			cfg.Backend.TargetsEndpoint,
+			"GET",
+			cfg.Backend.ApiTokens[distName]),
+	}
+}
+
+// Query sends the given request to the backend and returns its response.  The
+// request origin is set to our distributor.
+func (c *Client) Query(ctx context.Context, req core.TargetsRequest) (*core.TargetsResponse, error) {
+	if c == nil {
+		return nil, TargetsDisabledError
+	}
+
+	req.RequestOrigin = c.distName
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	var resp core.TargetsResponse
+	if err := c.ipc.MakeJsonRequest(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Owners returns the owners of the resources of the bridge with the given
+// fingerprint, or hashed fingerprint.
+func (c *Client) Owners(ctx context.Context, fingerprint string) ([]core.ResourceOwner, error) {
+	resp, err := c.Query(ctx, core.TargetsRequest{
+		Query:       core.TargetsQueryOwner,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Owners, nil
+}
+
+// Count returns the number of resources of each of the given types in the
+// partition of our distributor.  If state is not empty, only the resources in
+// that state are counted, e.g. "functional".
+func (c *Client) Count(ctx context.Context, rTypes []string, state string) (map[string]int, error) {
+	resp, err := c.Query(ctx, core.TargetsRequest{
+		Query:         core.TargetsQueryCount,
+		ResourceTypes: rTypes,
+		State:         state,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Counts, nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const throttleWindow = time.Hour
+
+var ThrottledError = errors.New("too many requests")
+
+// userActivity records the recent requests of a user and the rotation
+// periods in which it got resources.
+type userActivity struct {
+	requests []time.Time
+	periods  map[int64]bool
+}
+
+// abuseTracker keeps the activity of the users to throttle them and to find
+// the accounts that keep collecting resources period after period.
+type abuseTracker struct {
+	sync.Mutex
+	users map[int64]*userActivity
+}
+
+func newAbuseTracker() *abuseTracker {
+	return &abuseTracker{
+		users: make(map[int64]*userActivity),
+	}
+}
+
+func (a *abuseTracker) activity(id int64) *userActivity {
+	activity, ok := a.users[id]
+	if !ok {
+		activity = &userActivity{periods: make(map[int64]bool)}
+		a.users[id] = activity
+	}
+	return activity
+}
+
+// AllowRequest records a request of the user and returns ThrottledError if it
+// did more than max_requests_per_hour requests in the last hour.
+func (d *TelegramDistributor) AllowRequest(id int64) error {
+	if d.cfg.MaxRequestsPerHour <= 0 {
+		return nil
+	}
+
+	d.abuse.Lock()
+	defer d.abuse.Unlock()
+
+	now := time.Now()
+	activity := d.abuse.activity(id)
+	activity.requests = pruneRequests(activity.requests, now)
+	if len(activity.requests) >= d.cfg.MaxRequestsPerHour {
+		return ThrottledError
+	}
+	activity.requests = append(activity.requests, now)
+	return nil
+}
+
+// AbuseScore returns in how many of the last abuse_window_periods rotation
+// periods the user got resources.
+func (d *TelegramDistributor) AbuseScore(id int64) int {
+	d.abuse.Lock()
+	defer d.abuse.Unlock()
+	return d.abuseScore(id, d.currentPeriod())
+}
+
+// IsDemoted returns true if the user got resources in more than
+// abuse_max_periods rotation periods, in which case it only gets resources
+// from the new bridges pool.
+func (d *TelegramDistributor) IsDemoted(id int64) bool {
+	if d.cfg.AbuseMaxPeriods <= 0 {
+		return false
+	}
+	return d.AbuseScore(id) > d.cfg.AbuseMaxPeriods
+}
+
+// recordPeriod records that the user got resources in the given rotation
+// period.
+func (d *TelegramDistributor) recordPeriod(id int64, period int64) {
+	d.abuse.Lock()
+	defer d.abuse.Unlock()
+	d.abuse.activity(id).periods[period] = true
+}
+
+// abuseScore needs to be called with the abuse lock held.
+func (d *TelegramDistributor) abuseScore(id int64, period int64) int {
+	activity, ok := d.abuse.users[id]
+	if !ok {
+		return 0
+	}
+
+	score := 0
+	for p := range activity.periods {
+		if p > period-int64(d.cfg.AbuseWindowPeriods) {
+			score++
+		}
+	}
+	return score
+}
+
+// pruneAbuse forgets the activity that is not relevant anymore for
+// throttling or for the abuse score.
+func (d *TelegramDistributor) pruneAbuse() {
+	d.abuse.Lock()
+	defer d.abuse.Unlock()
+
+	now := time.Now()
+	period := d.currentPeriod()
+	for id, activity := range d.abuse.users {
+		activity.requests = pruneRequests(activity.requests, now)
+		for p := range activity.periods {
+			if p <= period-int64(d.cfg.AbuseWindowPeriods) {
+				delete(activity.periods, p)
+			}
+		}
+		if len(activity.requests) == 0 && len(activity.periods) == 0 {
+			delete(d.abuse.users, id)
+		}
+	}
+}
+
+func pruneRequests(requests []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(requests) && now.Sub(requests[i]) >= throttleWindow {
+		i++
+	}
+	return requests[i:]
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func initAbuseDistributor() *TelegramDistributor {
+	cfg := config.Distributors.Telegram
+	cfg.MaxRequestsPerHour = 2
+	cfg.AbuseMaxPeriods = 2
+	cfg.AbuseWindowPeriods = 4
+	return &TelegramDistributor{
+		cfg:   &cfg,
+		abuse: newAbuseTracker(),
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	id := int64(123)
+	d := initAbuseDistributor()
+
+	for i := 0; i < d.cfg.MaxRequestsPerHour; i++ {
+		err := d.AllowRequest(id)
+		if err != nil {
+			t.Fatalf("Request %d was throttled: %v", i, err)
+		}
+	}
+	err := d.AllowRequest(id)
+	if !errors.Is(err, ThrottledError) {
+		t.Error("Expected throttled error:", err)
+	}
+	err = d.AllowRequest(id + 1)
+	if err != nil {
+		t.Error("Other user was throttled:", err)
+	}
+}
+
+func TestAbuseDemotion(t *testing.T) {
+	id := int64(123)
+	d := initAbuseDistributor()
+	period := d.currentPeriod()
+
+	d.recordPeriod(id, period)
+	d.recordPeriod(id, period)
+	if d.IsDemoted(id) {
+		t.Fatal("User demoted for requesting in a single period")
+	}
+
+	// periods out of the window don't count
+	d.recordPeriod(id, period-int64(d.cfg.AbuseWindowPeriods))
+	d.recordPeriod(id, period-1)
+	if score := d.AbuseScore(id); score != 2 {
+		t.Errorf("Wrong abuse score: %d", score)
+	}
+	if d.IsDemoted(id) {
+		t.Fatal("User demoted before reaching the limit")
+	}
+
+	d.recordPeriod(id, period-2)
+	if !d.IsDemoted(id) {
+		t.Error("User not demoted after requesting in too many periods")
+	}
+
+	d.pruneAbuse()
+	if score := d.AbuseScore(id); score != 3 {
+		t.Errorf("Wrong abuse score after pruning: %d", score)
+	}
+	d.recordPeriod(id+1, period-int64(d.cfg.AbuseWindowPeriods))
+	d.pruneAbuse()
+	if _, ok := d.abuse.users[id+1]; ok {
+		t.Error("Old activity was not pruned")
+	}
+}
+
+func TestDemotedResources(t *testing.T) {
+	oldID := int64(10)
+	cfg := config
+	cfg.Distributors.Telegram.AbuseMaxPeriods = 1
+	cfg.Distributors.Telegram.AbuseWindowPeriods = 4
+	d := initDistributorWithConfig(&cfg)
+	defer d.Shutdown()
+
+	period := d.currentPeriod()
+	d.recordPeriod(oldID, period-1)
+	d.recordPeriod(oldID, period-2)
+
+	res := d.GetResources(context.Background(), oldID)
+	if len(res) != 1 {
+		t.Fatalf("Wrong number of resources for demoted: %d", len(res))
+	}
+	if res[0] != newDummyResource {
+		t.Errorf("Wrong resource: %v", res[0])
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+const (
+	OldPool = "old"
+	NewPool = "new"
+)
+
+// PoolStats summarizes the state of the resource pools of the distributor.
+type PoolStats struct {
+	OldResources   int
+	NewResources   int
+	DynamicBridges map[string]int
+	LastUpdates    map[string]time.Time
+}
+
+// LookupResult is a resource that matched a lookup and where it was found.
+// Updater is only set for resources of the new pool.
+type LookupResult struct {
+	Pool     string
+	Updater  string
+	Resource core.Resource
+}
+
+// IsAdmin returns true if the user is one of the configured admins.
+func (d *TelegramDistributor) IsAdmin(id int64) bool {
+	for _, admin := range d.cfg.AdminUserIDs {
+		if admin == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PoolStats returns the size of the pools and the state of the dynamic bridges
+// pushed by each updater.
+func (d *TelegramDistributor) PoolStats() PoolStats {
+	stats := PoolStats{
+		OldResources:   d.oldHashring.Len(),
+		DynamicBridges: make(map[string]int),
+		LastUpdates:    make(map[string]time.Time),
+	}
+
+	d.newHashrightLock.RLock()
+	defer d.newHashrightLock.RUnlock()
+	stats.NewResources = d.newHashring.Len()
+	for updater, bridges := range d.dynamicBridges {
+		stats.DynamicBridges[updater] = len(bridges)
+	}
+	for updater, lastUpdate := range d.lastUpdates {
+		stats.LastUpdates[updater] = lastUpdate
+	}
+	return stats
+}
+
+// PoolResources returns all the resources of the pool, that can be OldPool or
+// NewPool.
+func (d *TelegramDistributor) PoolResources(pool string) ([]core.Resource, error) {
+	switch pool {
+	case OldPool:
+		return d.oldHashring.GetAll(), nil
+	case NewPool:
+		d.newHashrightLock.RLock()
+		defer d.newHashrightLock.RUnlock()
+		return d.newHashring.GetAll(), nil
+	default:
+		return nil, fmt.Errorf("Unknown pool %s", pool)
+	}
+}
+
+// Lookup finds the resources with the given fingerprint in both pools.
+func (d *TelegramDistributor) Lookup(fingerprint string) []LookupResult {
+	var results []LookupResult
+	for _, r := range d.oldHashring.GetAll() {
+		if hasFingerprint(r, fingerprint) {
+			results = append(results, LookupResult{Pool: OldPool, Resource: r})
+		}
+	}
+
+	d.newHashrightLock.RLock()
+	defer d.newHashrightLock.RUnlock()
+	for _, r := range d.newHashring.GetAll() {
+		if !hasFingerprint(r, fingerprint) {
+			continue
+		}
+		result := LookupResult{Pool: NewPool, Resource: r}
+		for updater, bridges := range d.dynamicBridges {
+			for _, b := range bridges {
+				if b.Uid() == r.Uid() {
+					result.Updater = updater
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func hasFingerprint(r core.Resource, fingerprint string) bool {
+	fp, ok := resources.Fingerprint(r)
+	return ok && strings.EqualFold(fp, fingerprint)
+}
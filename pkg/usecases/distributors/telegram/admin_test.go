@@ -0,0 +1,73 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAdminStats(t *testing.T) {
+	d := TelegramDistributor{}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	c.Distributors.Telegram.AdminUserIDs = []int64{42}
+	d.Init(&c)
+	defer d.Shutdown()
+
+	if !d.IsAdmin(42) {
+		t.Error("Admin user not recognized")
+	}
+	if d.IsAdmin(43) {
+		t.Error("Non admin user recognized as admin")
+	}
+
+	r := strings.NewReader(fmt.Sprintf(`{
+		"bridgelines": [
+			"Bridge %s %s:%d %s cert=%s iat-mode=%s",
+			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
+		]
+		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"],
+		tpe, ip, port+1, fingerprint2, params["cert"], params["iat-mode"]))
+	err := d.LoadNewBridges("updater", r)
+	if err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+
+	stats := d.PoolStats()
+	if stats.NewResources != 2 || stats.OldResources != 0 {
+		t.Errorf("Wrong pool sizes: %d new %d old", stats.NewResources, stats.OldResources)
+	}
+	if stats.DynamicBridges["updater"] != 2 {
+		t.Errorf("Wrong number of dynamic bridges: %v", stats.DynamicBridges)
+	}
+	if stats.LastUpdates["updater"].IsZero() {
+		t.Error("No last update recorded")
+	}
+
+	rs, err := d.PoolResources(NewPool)
+	if err != nil {
+		t.Fatal("Can't get the new pool:", err)
+	}
+	if len(rs) != 2 {
+		t.Errorf("Wrong number of resources in the new pool: %d", len(rs))
+	}
+	_, err = d.PoolResources("unknown")
+	if err == nil {
+		t.Error("No error for an unknown pool")
+	}
+
+	results := d.Lookup(strings.ToLower(fingerprint2))
+	if len(results) != 1 {
+		t.Fatalf("Wrong number of lookup results: %d", len(results))
+	}
+	if results[0].Pool != NewPool || results[0].Updater != "updater" {
+		t.Errorf("Wrong lookup result: %v", results[0])
+	}
+	if len(d.Lookup("0000B47E84DA8F6D1030F370F2E308D574281E77")) != 0 {
+		t.Error("Found a resource with unknown fingerprint")
+	}
+}
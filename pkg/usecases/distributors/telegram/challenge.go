@@ -0,0 +1,251 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	challengeTimeout     = 5 * time.Minute
+	challengeMaxAttempts = 3
+	challengeNumOptions  = 9
+	challengeTokenLength = 9
+
+	defaultChallengeMaxFailuresPerPeriod = 10
+)
+
+var (
+	NoChallengeError      = errors.New("there is no challenge pending")
+	ChallengeExpiredError = errors.New("the challenge expired")
+	TooManyAttemptsError  = errors.New("too many failed attempts")
+	WrongAnswerError      = errors.New("wrong answer to the challenge")
+)
+
+// ChallengeOption is one of the options of a challenge.  Name is what the user
+// is asked for and Symbol what is shown in the button.  Token is a random
+// string that identifies the option in the answer, so the answer doesn't tell
+// which animal was selected.
+type ChallengeOption struct {
+	Name   string
+	Symbol string
+	Token  string
+}
+
+var challengeOptions = []ChallengeOption{
+	{Name: "cat", Symbol: "🐱"},
+	{Name: "dog", Symbol: "🐶"},
+	{Name: "fox", Symbol: "🦊"},
+	{Name: "bear", Symbol: "🐻"},
+	{Name: "panda", Symbol: "🐼"},
+	{Name: "frog", Symbol: "🐸"},
+	{Name: "monkey", Symbol: "🐵"},
+	{Name: "penguin", Symbol: "🐧"},
+	{Name: "owl", Symbol: "🦉"},
+	{Name: "octopus", Symbol: "🐙"},
+	{Name: "mouse", Symbol: "🐭"},
+	{Name: "rabbit", Symbol: "🐰"},
+	{Name: "tiger", Symbol: "🐯"},
+	{Name: "lion", Symbol: "🦁"},
+	{Name: "cow", Symbol: "🐮"},
+	{Name: "pig", Symbol: "🐷"},
+	{Name: "koala", Symbol: "🐨"},
+	{Name: "chicken", Symbol: "🐔"},
+	{Name: "horse", Symbol: "🐴"},
+	{Name: "unicorn", Symbol: "🦄"},
+	{Name: "bee", Symbol: "🐝"},
+	{Name: "butterfly", Symbol: "🦋"},
+	{Name: "snail", Symbol: "🐌"},
+	{Name: "turtle", Symbol: "🐢"},
+	{Name: "snake", Symbol: "🐍"},
+	{Name: "crab", Symbol: "🦀"},
+	{Name: "dolphin", Symbol: "🐬"},
+	{Name: "whale", Symbol: "🐳"},
+	{Name: "shark", Symbol: "🦈"},
+	{Name: "crocodile", Symbol: "🐊"},
+	{Name: "elephant", Symbol: "🐘"},
+	{Name: "camel", Symbol: "🐫"},
+	{Name: "giraffe", Symbol: "🦒"},
+	{Name: "zebra", Symbol: "🦓"},
+	{Name: "kangaroo", Symbol: "🦘"},
+	{Name: "hedgehog", Symbol: "🦔"},
+	{Name: "bat", Symbol: "🦇"},
+	{Name: "eagle", Symbol: "🦅"},
+	{Name: "duck", Symbol: "🦆"},
+	{Name: "parrot", Symbol: "🦜"},
+}
+
+// Challenge is what the user has to solve before getting bridges.  They have
+// to select the Options entry that matches the Answer.
+type Challenge struct {
+	Answer  ChallengeOption
+	Options []ChallengeOption
+
+	expires  time.Time
+	attempts int
+}
+
+// challenges keeps the pending challenges, the users that passed one in the
+// current rotation period and the failed attempts of each user in it.
+type challenges struct {
+	sync.Mutex
+	pending map[int64]*Challenge
+	passed  map[int64]bool
+	failed  map[int64]int
+	period  int64
+}
+
+func newChallenges() *challenges {
+	return &challenges{
+		pending: make(map[int64]*Challenge),
+		passed:  make(map[int64]bool),
+		failed:  make(map[int64]int),
+	}
+}
+
+// HasPassed returns true if the user solved a challenge during the current
+// rotation period or if challenges are not required.
+func (d *TelegramDistributor) HasPassed(id int64) bool {
+	if !d.cfg.RequireChallenge {
+		return true
+	}
+
+	d.challenges.Lock()
+	defer d.challenges.Unlock()
+	d.rotateChallenges()
+	return d.challenges.passed[id]
+}
+
+// NewChallenge creates a new challenge for the user, replacing any pending
+// one.  Failed attempts are kept so users can't get around the limit by
+// asking for new challenges.
+func (d *TelegramDistributor) NewChallenge(id int64) *Challenge {
+	d.challenges.Lock()
+	defer d.challenges.Unlock()
+	d.pruneChallenges()
+
+	attempts := 0
+	if old, ok := d.challenges.pending[id]; ok {
+		attempts = old.attempts
+	}
+
+	options := make([]ChallengeOption, len(challengeOptions))
+	copy(options, challengeOptions)
+	for i := len(options) - 1; i > 0; i-- {
+		j := randInt(i + 1)
+		options[i], options[j] = options[j], options[i]
+	}
+	options = options[:challengeNumOptions]
+	for i := range options {
+		options[i].Token = randToken()
+	}
+
+	challenge := &Challenge{
+		Answer:   options[randInt(len(options))],
+		Options:  options,
+		expires:  time.Now().Add(challengeTimeout),
+		attempts: attempts,
+	}
+	d.challenges.pending[id] = challenge
+	return challenge
+}
+
+// SolveChallenge checks the answer of the user to its pending challenge, the
+// token of the selected option, and marks the user as passed for the rotation
+// period if it's right.  Users that failed too many attempts in the rotation
+// period can't solve challenges until the next one.
+func (d *TelegramDistributor) SolveChallenge(id int64, answer string) error {
+	d.challenges.Lock()
+	defer d.challenges.Unlock()
+	d.rotateChallenges()
+
+	challenge, ok := d.challenges.pending[id]
+	if !ok {
+		return NoChallengeError
+	}
+	if time.Now().After(challenge.expires) {
+		return ChallengeExpiredError
+	}
+	maxFailures := d.challengeMaxFailures()
+	if challenge.attempts >= challengeMaxAttempts || d.challenges.failed[id] >= maxFailures {
+		return TooManyAttemptsError
+	}
+
+	if answer != challenge.Answer.Token {
+		challenge.attempts++
+		d.challenges.failed[id]++
+		if challenge.attempts >= challengeMaxAttempts || d.challenges.failed[id] >= maxFailures {
+			return TooManyAttemptsError
+		}
+		return WrongAnswerError
+	}
+
+	delete(d.challenges.pending, id)
+	d.challenges.passed[id] = true
+	return nil
+}
+
+// rotateChallenges forgets who passed a challenge and the failed attempts
+// when the rotation period changes.  It needs to be called with the
+// challenges lock held.
+func (d *TelegramDistributor) rotateChallenges() {
+	period := d.currentPeriod()
+	if period != d.challenges.period {
+		d.challenges.passed = make(map[int64]bool)
+		d.challenges.failed = make(map[int64]int)
+		d.challenges.period = period
+	}
+}
+
+// challengeMaxFailures returns how many failed attempts a user has in each
+// rotation period, 10 if it's not configured.
+func (d *TelegramDistributor) challengeMaxFailures() int {
+	if d.cfg.ChallengeMaxFailuresPerPeriod <= 0 {
+		return defaultChallengeMaxFailuresPerPeriod
+	}
+	return d.cfg.ChallengeMaxFailuresPerPeriod
+}
+
+// pruneChallenges removes the challenges that expired more than a timeout ago,
+// so users that reached the attempts limit can try again.  It needs to be
+// called with the challenges lock held.
+func (d *TelegramDistributor) pruneChallenges() {
+	now := time.Now()
+	for id, challenge := range d.challenges.pending {
+		if now.After(challenge.expires.Add(challengeTimeout)) {
+			delete(d.challenges.pending, id)
+		}
+	}
+}
+
+func (d *TelegramDistributor) currentPeriod() int64 {
+	now := time.Now()
+	if d.Now != nil {
+		now = d.Now()
+	}
+	return now.Unix() / (60 * 60) / int64(d.cfg.RotationPeriodHours)
+}
+
+func randInt(max int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		panic(err)
+	}
+	return int(n.Int64())
+}
+
+func randToken() string {
+	raw := make([]byte, challengeTokenLength)
+	_, err := rand.Read(raw)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
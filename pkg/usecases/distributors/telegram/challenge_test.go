@@ -0,0 +1,172 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func initChallengeDistributor() *TelegramDistributor {
+	cfg := config.Distributors.Telegram
+	cfg.RequireChallenge = true
+	return &TelegramDistributor{
+		cfg:        &cfg,
+		challenges: newChallenges(),
+	}
+}
+
+func TestSolveChallenge(t *testing.T) {
+	id := int64(123)
+	d := initChallengeDistributor()
+
+	if d.HasPassed(id) {
+		t.Fatal("User passed without solving a challenge")
+	}
+	err := d.SolveChallenge(id, "cat")
+	if !errors.Is(err, NoChallengeError) {
+		t.Error("Expected no challenge error:", err)
+	}
+
+	challenge := d.NewChallenge(id)
+	if len(challenge.Options) != challengeNumOptions {
+		t.Errorf("Wrong number of options: %d", len(challenge.Options))
+	}
+	found := false
+	for _, option := range challenge.Options {
+		if option == challenge.Answer {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("The answer is not in the options")
+	}
+
+	tokens := make(map[string]bool)
+	for _, option := range challenge.Options {
+		if option.Token == "" || option.Token == option.Name || tokens[option.Token] {
+			t.Errorf("The option %s has the token %q", option.Name, option.Token)
+		}
+		tokens[option.Token] = true
+	}
+	err = d.SolveChallenge(id, challenge.Answer.Name)
+	if !errors.Is(err, WrongAnswerError) {
+		t.Error("The name of the answer solved the challenge:", err)
+	}
+	err = d.SolveChallenge(id, challenge.Answer.Token)
+	if err != nil {
+		t.Fatal("Can't solve the challenge:", err)
+	}
+	if !d.HasPassed(id) {
+		t.Error("User didn't pass after solving the challenge")
+	}
+	if d.HasPassed(id + 1) {
+		t.Error("Other user passed without solving the challenge")
+	}
+}
+
+func TestChallengeAttempts(t *testing.T) {
+	id := int64(123)
+	d := initChallengeDistributor()
+
+	challenge := d.NewChallenge(id)
+	wrong := challenge.Options[0].Token
+	if wrong == challenge.Answer.Token {
+		wrong = challenge.Options[1].Token
+	}
+
+	for i := 0; i < challengeMaxAttempts-1; i++ {
+		err := d.SolveChallenge(id, wrong)
+		if !errors.Is(err, WrongAnswerError) {
+			t.Fatal("Expected a wrong answer error:", err)
+		}
+	}
+	err := d.SolveChallenge(id, wrong)
+	if !errors.Is(err, TooManyAttemptsError) {
+		t.Fatal("Expected a too many attempts error:", err)
+	}
+
+	challenge = d.NewChallenge(id)
+	err = d.SolveChallenge(id, challenge.Answer.Token)
+	if !errors.Is(err, TooManyAttemptsError) {
+		t.Error("A new challenge reset the attempts:", err)
+	}
+	if d.HasPassed(id) {
+		t.Error("User passed after too many attempts")
+	}
+}
+
+func TestChallengeNotRequired(t *testing.T) {
+	d := initChallengeDistributor()
+	d.cfg.RequireChallenge = false
+	if !d.HasPassed(123) {
+		t.Error("User didn't pass when challenges are not required")
+	}
+}
+
+func TestChallengeFailuresPerPeriod(t *testing.T) {
+	id := int64(123)
+	d := initChallengeDistributor()
+	d.cfg.ChallengeMaxFailuresPerPeriod = challengeMaxAttempts + 1
+	now := time.Now()
+	d.Now = func() time.Time { return now }
+
+	wrongAnswer := func(challenge *Challenge) string {
+		for _, option := range challenge.Options {
+			if option.Token != challenge.Answer.Token {
+				return option.Token
+			}
+		}
+		t.Fatal("All the options are the answer")
+		return ""
+	}
+
+	challenge := d.NewChallenge(id)
+	for i := 0; i < challengeMaxAttempts; i++ {
+		d.SolveChallenge(id, wrongAnswer(challenge))
+	}
+	// the challenge is pruned after the timeout, but the failures of the
+	// period are kept
+	delete(d.challenges.pending, id)
+	challenge = d.NewChallenge(id)
+	err := d.SolveChallenge(id, wrongAnswer(challenge))
+	if !errors.Is(err, TooManyAttemptsError) {
+		t.Fatal("Expected a too many attempts error:", err)
+	}
+	delete(d.challenges.pending, id)
+	challenge = d.NewChallenge(id)
+	err = d.SolveChallenge(id, challenge.Answer.Token)
+	if !errors.Is(err, TooManyAttemptsError) {
+		t.Error("The user solved a challenge after too many failures in the period:", err)
+	}
+
+	challenge = d.NewChallenge(id + 1)
+	if err := d.SolveChallenge(id+1, challenge.Answer.Token); err != nil {
+		t.Error("Other user can't solve the challenge:", err)
+	}
+
+	now = now.Add(time.Duration(d.cfg.RotationPeriodHours) * time.Hour)
+	delete(d.challenges.pending, id)
+	challenge = d.NewChallenge(id)
+	if err := d.SolveChallenge(id, challenge.Answer.Token); err != nil {
+		t.Error("The failures were not forgotten in the next period:", err)
+	}
+}
+
+func TestChallengeOptions(t *testing.T) {
+	if len(challengeOptions) < 4*challengeNumOptions {
+		t.Errorf("Only %d options for challenges of %d options", len(challengeOptions), challengeNumOptions)
+	}
+	names := make(map[string]bool)
+	symbols := make(map[string]bool)
+	for _, option := range challengeOptions {
+		if names[option.Name] || symbols[option.Symbol] {
+			t.Errorf("The option %s %s is repeated", option.Name, option.Symbol)
+		}
+		names[option.Name] = true
+		symbols[option.Symbol] = true
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+)
+
+// inviteTokenLength is the number of random bytes of an invite token.  Once
+// encoded it has to fit in a telegram start payload (64 characters).
+const inviteTokenLength = 18
+
+var (
+	InvalidInviteError   = errors.New("the invite token is not valid")
+	NoInvitesLeftError   = errors.New("the user can't create more invites")
+	InvitesDisabledError = errors.New("invites are not enabled")
+)
+
+// inviteState is the persistent state of the invites.
+type inviteState struct {
+	// Tokens maps each unused invite token to the user that created it
+	Tokens map[string]int64 `json:"tokens"`
+	// Invited maps each invited user to the user that invited it
+	Invited map[int64]int64 `json:"invited"`
+	// Created counts the invites created by each user
+	Created map[int64]int `json:"created"`
+}
+
+type invites struct {
+	sync.Mutex
+	state inviteState
+}
+
+func (d *TelegramDistributor) loadInvites() {
+	d.invites = &invites{
+		state: inviteState{
+			Tokens:  make(map[string]int64),
+			Invited: make(map[int64]int64),
+			Created: make(map[int64]int),
+		},
+	}
+	if d.InvitesStore == nil {
+		return
+	}
+
+	var state inviteState
+	err := d.InvitesStore.Load(&state)
+	if err != nil {
+		log.Println("Can't load invites:", err)
+		return
+	}
+	if state.Tokens != nil {
+		d.invites.state.Tokens = state.Tokens
+	}
+	if state.Invited != nil {
+		d.invites.state.Invited = state.Invited
+	}
+	if state.Created != nil {
+		d.invites.state.Created = state.Created
+	}
+}
+
+// saveInvites needs to be called with the invites lock held.
+func (d *TelegramDistributor) saveInvites() {
+	if d.InvitesStore == nil {
+		return
+	}
+	err := d.InvitesStore.Save(d.invites.state)
+	if err != nil {
+		log.Println("Can't save invites:", err)
+	}
+}
+
+// IsInvited returns true if the user joined with an invite.
+func (d *TelegramDistributor) IsInvited(id int64) bool {
+	d.invites.Lock()
+	defer d.invites.Unlock()
+	_, ok := d.invites.state.Invited[id]
+	return ok
+}
+
+// InvitesLeft returns how many invites the user can still create, or -1 if
+// there is no limit.
+func (d *TelegramDistributor) InvitesLeft(id int64) int {
+	d.invites.Lock()
+	defer d.invites.Unlock()
+	return d.invitesLeft(id)
+}
+
+// invitesLeft needs to be called with the invites lock held.
+func (d *TelegramDistributor) invitesLeft(id int64) int {
+	if d.IsAdmin(id) {
+		return -1
+	}
+	if _, ok := d.invites.state.Invited[id]; !ok {
+		return 0
+	}
+	left := d.cfg.InvitesPerUser - d.invites.state.Created[id]
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// CreateInvite returns a new one time invite token.  Admins can create as
+// many as they want and invited users up to invites_per_user.
+func (d *TelegramDistributor) CreateInvite(inviter int64) (string, error) {
+	if !d.cfg.EnableInvites {
+		return "", InvitesDisabledError
+	}
+
+	raw := make([]byte, inviteTokenLength)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	d.invites.Lock()
+	defer d.invites.Unlock()
+	if d.invitesLeft(inviter) == 0 {
+		return "", NoInvitesLeftError
+	}
+	d.invites.state.Tokens[token] = inviter
+	d.invites.state.Created[inviter]++
+	d.saveInvites()
+	return token, nil
+}
+
+// RedeemInvite marks the user as invited, consuming the invite token.
+func (d *TelegramDistributor) RedeemInvite(id int64, token string) error {
+	if !d.cfg.EnableInvites {
+		return InvitesDisabledError
+	}
+
+	d.invites.Lock()
+	defer d.invites.Unlock()
+
+	inviter, ok := d.invites.state.Tokens[token]
+	if !ok {
+		return InvalidInviteError
+	}
+	if inviter == id {
+		return InvalidInviteError
+	}
+	delete(d.invites.state.Tokens, token)
+	if _, ok := d.invites.state.Invited[id]; !ok {
+		d.invites.state.Invited[id] = inviter
+	}
+	d.saveInvites()
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telegram
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+)
+
+func initInvitesDistributor() *TelegramDistributor {
+	cfg := config.Distributors.Telegram
+	cfg.EnableInvites = true
+	cfg.InvitesPerUser = 1
+	cfg.AdminUserIDs = []int64{1}
+	d := &TelegramDistributor{cfg: &cfg}
+	d.loadInvites()
+	return d
+}
+
+func TestInvites(t *testing.T) {
+	admin := int64(1)
+	user := int64(200)
+	user2 := int64(201)
+	d := initInvitesDistributor()
+
+	_, err := d.CreateInvite(user)
+	if !errors.Is(err, NoInvitesLeftError) {
+		t.Error("Not invited user created an invite:", err)
+	}
+
+	token, err := d.CreateInvite(admin)
+	if err != nil {
+		t.Fatal("Admin can't create an invite:", err)
+	}
+	if len(token) > 64 {
+		t.Errorf("Token too long for a start payload: %s", token)
+	}
+	err = d.RedeemInvite(user, token)
+	if err != nil {
+		t.Fatal("Can't redeem the invite:", err)
+	}
+	if !d.IsInvited(user) {
+		t.Error("User is not invited after redeeming an invite")
+	}
+	err = d.RedeemInvite(user2, token)
+	if !errors.Is(err, InvalidInviteError) {
+		t.Error("Invite was redeemed twice:", err)
+	}
+
+	if d.InvitesLeft(user) != 1 {
+		t.Errorf("Wrong number of invites left: %d", d.InvitesLeft(user))
+	}
+	token, err = d.CreateInvite(user)
+	if err != nil {
+		t.Fatal("Invited user can't create an invite:", err)
+	}
+	_, err = d.CreateInvite(user)
+	if !errors.Is(err, NoInvitesLeftError) {
+		t.Error("User created more invites than allowed:", err)
+	}
+	err = d.RedeemInvite(user2, token)
+	if err != nil {
+		t.Fatal("Can't redeem the invite of a user:", err)
+	}
+	if !d.IsInvited(user2) {
+		t.Error("User is not invited after redeeming an invite")
+	}
+}
+
+func TestInvitesStore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "telegram-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d := initInvitesDistributor()
+	d.InvitesStore = pjson.New("invites", tmpDir)
+	d.loadInvites()
+	token, err := d.CreateInvite(1)
+	if err != nil {
+		t.Fatal("Admin can't create an invite:", err)
+	}
+
+	d2 := initInvitesDistributor()
+	d2.InvitesStore = d.InvitesStore
+	d2.loadInvites()
+	err = d2.RedeemInvite(200, token)
+	if err != nil {
+		t.Fatal("Can't redeem a restored invite:", err)
+	}
+}
+
+func TestInvitedResources(t *testing.T) {
+	oldID := int64(10)
+	newID := int64(101)
+
+	cfg := config
+	cfg.Distributors.Telegram.EnableInvites = true
+	cfg.Distributors.Telegram.AdminUserIDs = []int64{1}
+	d := initDistributorWithConfig(&cfg)
+	defer d.Shutdown()
+
+	res := d.GetResources(context.Background(), oldID)
+	if len(res) != 1 || res[0] != oldDummyResource {
+		t.Errorf("Wrong resources for a not invited user: %v", res)
+	}
+
+	token, err := d.CreateInvite(1)
+	if err != nil {
+		t.Fatal("Admin can't create an invite:", err)
+	}
+	err = d.RedeemInvite(newID, token)
+	if err != nil {
+		t.Fatal("Can't redeem the invite:", err)
+	}
+	res = d.GetResources(context.Background(), newID)
+	if len(res) != 1 || res[0] != newDummyResource {
+		t.Errorf("Wrong resources for an invited user: %v", res)
+	}
+}
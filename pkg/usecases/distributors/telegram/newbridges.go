@@ -6,21 +6,31 @@ package telegram
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
-	"strconv"
 	"strings"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
+// NoValidBridgesError is returned by LoadNewBridges when the updater sent
+// bridgelines but none of them is valid.
+var NoValidBridgesError = errors.New("none of the bridgelines is valid")
+
 type bridgesJSON struct {
 	Bridgelines []string `json:"bridgelines"`
 }
 
+// DynamicBridge is a bridge pushed by an updater and when it was first added.
+type DynamicBridge struct {
+	Bridgeline string    `json:"bridgeline"`
+	Added      time.Time `json:"added"`
+}
+
 func (d *TelegramDistributor) loadNewBridgesFromStore() {
 	d.newHashrightLock.Lock()
 	defer d.newHashrightLock.Unlock()
@@ -32,14 +42,23 @@ func (d *TelegramDistributor) loadNewBridgesFromStore() {
 			log.Println("Error loading updater", updater, ":", err)
 			continue
 		}
-		for _, r := range rs {
-			d.newHashring.Add(&r)
+		d.dynamicBridges[updater] = make([]core.Resource, len(rs))
+		d.bridgesAdded[updater] = make(map[core.Hashkey]time.Time)
+		for i := range rs {
+			r := &rs[i]
+			d.newHashring.Add(r)
+			d.dynamicBridges[updater][i] = r
+			d.bridgesAdded[updater][r.Uid()] = time.Now()
 		}
 	}
 }
 
 // LoadNewBridges loads bridges in bridgesJSON format from the reader into the new bridges newHashring
 //
+// Malformed bridgelines and bridges of the wrong type are skipped.  If none of
+// the bridgelines is valid NoValidBridgesError is returned and the bridges of
+// the updater are kept as they were.
+//
 // This function locks a mutex when accessing the newHashring, we should be careful to don't make
 // a deadlock with the internal mutex in the hashring. Never call this function while holding the
 // newHashring mutex.
@@ -51,17 +70,22 @@ func (d *TelegramDistributor) LoadNewBridges(name string, r io.Reader) error {
 		return err
 	}
 
-	resources := make([]core.Resource, len(updatedBridges.Bridgelines))
+	resources := make([]core.Resource, 0, len(updatedBridges.Bridgelines))
 	for i, bridgeline := range updatedBridges.Bridgelines {
 		resource, err := parseBridgeline(bridgeline)
 		if err != nil {
-			return err
+			log.Printf("Skipping bridgeline %d from %s: %v", i, name, err)
+			continue
 		}
-		if resource.Type() != d.cfg.Resource {
-			return fmt.Errorf("Not valid bridge type %s", resource.Type())
+		if !d.isResourceType(resource.Type()) {
+			log.Printf("Skipping bridgeline %d from %s: not valid bridge type %s", i, name, resource.Type())
+			continue
 		}
 
-		resources[i] = resource
+		resources = append(resources, resource)
+	}
+	if len(updatedBridges.Bridgelines) != 0 && len(resources) == 0 {
+		return NoValidBridgesError
 	}
 
 	d.newHashrightLock.Lock()
@@ -69,48 +93,108 @@ func (d *TelegramDistributor) LoadNewBridges(name string, r io.Reader) error {
 		d.newHashring.Remove(resource)
 	}
 	d.dynamicBridges[name] = resources
+	d.lastUpdates[name] = time.Now()
 
+	oldAdded := d.bridgesAdded[name]
+	d.bridgesAdded[name] = make(map[core.Hashkey]time.Time)
 	for _, resource := range resources {
 		d.newHashring.Add(resource)
+
+		added, ok := oldAdded[resource.Uid()]
+		if !ok {
+			added = time.Now()
+		}
+		d.bridgesAdded[name][resource.Uid()] = added
 	}
 	d.newHashrightLock.Unlock()
 
 	log.Println("Got", len(resources), "new bridges from", name)
 
+	return d.saveNewBridges(name, resources)
+}
+
+// DynamicBridges returns the bridges pushed by the updater.
+func (d *TelegramDistributor) DynamicBridges(name string) []DynamicBridge {
+	d.newHashrightLock.RLock()
+	defer d.newHashrightLock.RUnlock()
+
+	bridges := make([]DynamicBridge, 0, len(d.dynamicBridges[name]))
+	for _, resource := range d.dynamicBridges[name] {
+		bridges = append(bridges, DynamicBridge{
+			Bridgeline: resource.String(),
+			Added:      d.bridgesAdded[name][resource.Uid()],
+		})
+	}
+	return bridges
+}
+
+// RemoveDynamicBridges removes the bridges pushed by the updater with the
+// given fingerprint, or all of them if fingerprint is empty.  It returns the
+// number of bridges removed.
+func (d *TelegramDistributor) RemoveDynamicBridges(name string, fingerprint string) (int, error) {
+	d.newHashrightLock.Lock()
+	var kept []core.Resource
+	removed := 0
+	for _, resource := range d.dynamicBridges[name] {
+		if fingerprint != "" && !hasFingerprint(resource, fingerprint) {
+			kept = append(kept, resource)
+			continue
+		}
+		d.newHashring.Remove(resource)
+		delete(d.bridgesAdded[name], resource.Uid())
+		removed++
+	}
+	d.dynamicBridges[name] = kept
+	d.lastUpdates[name] = time.Now()
+	d.newHashrightLock.Unlock()
+
+	log.Println("Removed", removed, "bridges from", name)
+
+	return removed, d.saveNewBridges(name, kept)
+}
+
+func (d *TelegramDistributor) saveNewBridges(name string, resources []core.Resource) error {
 	persistence := d.NewBridgesStore[name]
 	if persistence != nil {
-		return d.NewBridgesStore[name].Save(resources)
+		if resources == nil {
+			resources = []core.Resource{}
+		}
+		return persistence.Save(resources)
 	}
 
 	return nil
 }
 
+// parseBridgeline parses a bridgeline of the format:
+//
+//	Bridge <type> <address:port> <fingerprint> [key=value ...]
 func parseBridgeline(bridgeline string) (core.Resource, error) {
-	bridgeParts := strings.Split(bridgeline, " ")
+	bridgeParts := strings.Fields(bridgeline)
+	if len(bridgeParts) < 4 {
+		return nil, fmt.Errorf("Not enough fields in bridgeline %q", bridgeline)
+	}
+	if bridgeParts[0] != "Bridge" {
+		return nil, fmt.Errorf("Bridgeline doesn't start with 'Bridge': %q", bridgeline)
+	}
+	if !resources.ValidFingerprint(bridgeParts[3]) {
+		return nil, fmt.Errorf("Malformed fingerprint %s", bridgeParts[3])
+	}
 
 	var bridge resources.Transport
 	bridge.RType = bridgeParts[1]
 	bridge.Fingerprint = bridgeParts[3]
 
-	addrParts := strings.Split(bridgeParts[2], ":")
-	if len(addrParts) != 2 {
-		return nil, fmt.Errorf("Malformed address %s", bridgeParts[2])
-	}
-	addr, err := net.ResolveIPAddr("", addrParts[0])
+	addr, port, err := resources.ParseAddrPort(bridgeParts[2])
 	if err != nil {
 		return nil, err
 	}
-	bridge.Address = resources.Addr{Addr: addr}
-	port, err := strconv.Atoi(addrParts[1])
-	if err != nil {
-		return nil, fmt.Errorf("Can't convert port to integer: %s", err)
-	}
-	bridge.Port = uint16(port)
+	bridge.Address = addr
+	bridge.Port = port
 
 	bridge.Parameters = make(map[string]string)
 	for _, param := range bridgeParts[4:] {
 		paramParts := strings.Split(param, "=")
-		if len(paramParts) != 2 {
+		if len(paramParts) != 2 || paramParts[0] == "" {
 			return nil, fmt.Errorf("Malformed param %s", param)
 		}
 		bridge.Parameters[paramParts[0]] = paramParts[1]
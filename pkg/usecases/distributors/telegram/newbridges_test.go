@@ -5,6 +5,7 @@
 package telegram
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -144,3 +145,142 @@ func TestLoadNewResourcesMultipleUpdaters(t *testing.T) {
 		t.Fatalf("Wrong number of resources: %d", len(rs))
 	}
 }
+
+func TestListRemoveNewResources(t *testing.T) {
+	d := TelegramDistributor{}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	d.Init(&c)
+	defer d.Shutdown()
+
+	r := strings.NewReader(fmt.Sprintf(`{
+		"bridgelines": [
+			"Bridge %s %s:%d %s cert=%s iat-mode=%s",
+			"Bridge %s %s:%d %s cert=%s iat-mode=%s"
+		]
+		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"],
+		tpe, ip, port+1, fingerprint2, params["cert"], params["iat-mode"]))
+	err := d.LoadNewBridges("updater", r)
+	if err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+
+	bridges := d.DynamicBridges("updater")
+	if len(bridges) != 2 {
+		t.Fatalf("Wrong number of bridges: %d", len(bridges))
+	}
+	for _, b := range bridges {
+		if b.Added.IsZero() {
+			t.Errorf("Bridge without added time: %s", b.Bridgeline)
+		}
+	}
+	if len(d.DynamicBridges("updater2")) != 0 {
+		t.Error("Other updater has bridges")
+	}
+
+	removed, err := d.RemoveDynamicBridges("updater", fingerprint)
+	if err != nil {
+		t.Fatalf("Error removing bridge: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Wrong number of bridges removed: %d", removed)
+	}
+	rs := d.newHashring.GetAll()
+	if len(rs) != 1 {
+		t.Fatalf("Wrong number of resources: %d", len(rs))
+	}
+	if rs[0].(*resources.Transport).Fingerprint != fingerprint2 {
+		t.Errorf("Wrong bridge removed: %s", rs[0].String())
+	}
+
+	removed, err = d.RemoveDynamicBridges("updater", "")
+	if err != nil {
+		t.Fatalf("Error removing bridges: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Wrong number of bridges removed: %d", removed)
+	}
+	if d.newHashring.Len() != 0 {
+		t.Errorf("There are still resources: %d", d.newHashring.Len())
+	}
+}
+
+func TestLoadNewResourcesMalformed(t *testing.T) {
+	d := TelegramDistributor{}
+	c := config
+	c.Distributors.Telegram.Resource = tpe
+	d.Init(&c)
+	defer d.Shutdown()
+
+	r := strings.NewReader(fmt.Sprintf(`{
+		"bridgelines": [
+			"Bridge %s %s:%d %s cert=%s iat-mode=%s",
+			"Bridge %s",
+			"Bridge vanilla %s:%d %s"
+		]
+		}`, tpe, ip, port, fingerprint, params["cert"], params["iat-mode"],
+		tpe, ip, port, fingerprint2))
+	err := d.LoadNewBridges("updater", r)
+	if err != nil {
+		t.Fatalf("Error loading new bridges: %v", err)
+	}
+	rs := d.newHashring.GetAll()
+	if len(rs) != 1 {
+		t.Fatalf("Wrong number of resources: %d", len(rs))
+	}
+
+	r = strings.NewReader(`{"bridgelines": ["Bridge", "Bridge obfs4 1.2.3.4:70000 ` + fingerprint + `"]}`)
+	err = d.LoadNewBridges("updater", r)
+	if !errors.Is(err, NoValidBridgesError) {
+		t.Fatalf("Expected NoValidBridgesError, got: %v", err)
+	}
+	rs = d.newHashring.GetAll()
+	if len(rs) != 1 {
+		t.Errorf("The bridges were not kept: %d", len(rs))
+	}
+}
+
+func TestParseBridgeline(t *testing.T) {
+	valid := map[string]string{
+		"Bridge obfs4 100.77.53.79:38248 " + fingerprint + " cert=abc iat-mode=0": "100.77.53.79",
+		"Bridge  obfs4  100.77.53.79:38248  " + fingerprint:                       "100.77.53.79",
+		"Bridge obfs4 [2001:db8::1]:443 " + fingerprint + " cert=abc":             "2001:db8::1",
+	}
+	for line, addr := range valid {
+		r, err := parseBridgeline(line)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", line, err)
+			continue
+		}
+		if r.(*resources.Transport).Address.String() != addr {
+			t.Errorf("Wrong address for %q: %s", line, r.(*resources.Transport).Address.String())
+		}
+	}
+
+	malformed := []string{
+		"",
+		"Bridge",
+		"Bridge obfs4",
+		"Bridge obfs4 100.77.53.79:38248",
+		"obfs4 100.77.53.79:38248 " + fingerprint,
+		"Bridge obfs4 100.77.53.79 " + fingerprint,
+		"Bridge obfs4 100.77.53.79:99999 " + fingerprint,
+		"Bridge obfs4 100.77.53.79:-1 " + fingerprint,
+		"Bridge obfs4 example.com:443 " + fingerprint,
+		"Bridge obfs4 100.77.53.79:38248 7DFCB47E",
+		"Bridge obfs4 100.77.53.79:38248 " + fingerprint + " cert",
+		"Bridge obfs4 100.77.53.79:38248 " + fingerprint + " =abc",
+		"Bridge obfs4 100.77.53.79:38248 " + fingerprint + " cert=a=b",
+	}
+	for _, line := range malformed {
+		if _, err := parseBridgeline(line); err == nil {
+			t.Errorf("Parsed malformed bridgeline %q", line)
+		}
+	}
+
+	// None of the prefixes of a valid bridgeline should make us panic.
+	line := "Bridge obfs4 [2001:db8::1]:443 " + fingerprint + " cert=abc iat-mode=0"
+	for i := range line {
+		parseBridgeline(line[:i])
+	}
+}
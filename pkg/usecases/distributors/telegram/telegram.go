@@ -5,6 +5,7 @@
 package telegram
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
@@ -15,8 +16,8 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
 )
 
 const (
@@ -47,42 +48,146 @@ type TelegramDistributor struct {
 	shutdown       chan bool
 	metricsChan    chan<- metricsData
 	dynamicBridges map[string][]core.Resource
+	lastUpdates    map[string]time.Time
+	bridgesAdded   map[string]map[core.Hashkey]time.Time
+	challenges     *challenges
+	abuse          *abuseTracker
+	invites        *invites
 
 	// newHashrightLock is used to block read access when an update is happening in the newHashring
 	newHashrightLock sync.RWMutex
 
 	// NewBridgesStore maps each updater to it's persistence mechanism
 	NewBridgesStore map[string]persistence.Mechanism
+
+	// InvitesStore keeps the invite tokens and the invited users
+	InvitesStore persistence.Mechanism
+
+	// RequestsStore keeps the cache of requests of the current rotation
+	// period used for the metrics
+	RequestsStore persistence.Mechanism
+
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+	// Now returns the current time that decides the rotation period.  It's
+	// time.Now if nil.
+	Now func() time.Time
 }
 
-func (d *TelegramDistributor) GetResources(id int64) []core.Resource {
-	now := time.Now().Unix() / (60 * 60)
-	period := now / int64(d.cfg.RotationPeriodHours)
+// GetResources returns the resources for the given user.  The same user gets
+// the same resources during a rotation period.  No resources are handed out if
+// the given context is done.
+func (d *TelegramDistributor) GetResources(ctx context.Context, id int64) []core.Resource {
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	period := d.currentPeriod()
 	hashKey := core.NewHashkey(fmt.Sprintf("%d-%d", id, period))
+	demoted := d.IsDemoted(id)
+	d.recordPeriod(id, period)
 
 	md := metricsData{hashKey: hashKey}
+	useOld, useNew := d.selectPools(id, demoted)
 
-	d.newHashrightLock.RLock()
-	resources, err := d.newHashring.GetMany(hashKey, d.cfg.NumBridgesPerRequest)
-	d.newHashrightLock.RUnlock()
-	if err != nil {
-		log.Println("Error getting resources from the hashring:", err)
-		md.err = err
+	var resourcesByType [][]core.Resource
+	for _, rType := range d.ResourceTypes() {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var resources []core.Resource
+		if useOld {
+			oldResources, err := getManyOfType(d.oldHashring, rType, hashKey)
+			if err != nil {
+				log.Println("Error getting resources from the old hashring:", err)
+				md.err = err
+			}
+			resources = append(resources, oldResources...)
+		}
+
+		if useNew {
+			d.newHashrightLock.RLock()
+			newResources, err := getManyOfType(d.newHashring, rType, hashKey)
+			d.newHashrightLock.RUnlock()
+			if err != nil {
+				log.Println("Error getting resources from the hashring:", err)
+				md.err = err
+			}
+			resources = append(resources, newResources...)
+		}
+		resourcesByType = append(resourcesByType, resources)
 	}
 
 	md.pool = "new"
-	if id < d.cfg.MinUserID {
+	if demoted {
+		md.pool = "demoted"
+	} else if useOld {
 		md.pool = "old"
-		oldResources, err := d.oldHashring.GetMany(hashKey, d.cfg.NumBridgesPerRequest)
-		if err != nil {
-			log.Println("Error getting resources from the old hashring:", err)
-			md.err = err
+	}
+
+	select {
+	case d.metricsChan <- md:
+	case <-ctx.Done():
+		return nil
+	}
+	return interleave(resourcesByType)
+}
+
+// selectPools returns from which pools the user gets resources.  Without
+// invites old accounts get resources from both pools and new accounts only
+// from the new pool.  With invites, invited users get them from the new pool
+// and everybody else from the old pool.  Demoted users are handled as new
+// accounts without an invite.
+func (d *TelegramDistributor) selectPools(id int64, demoted bool) (useOld bool, useNew bool) {
+	if d.cfg.EnableInvites {
+		invited := !demoted && d.IsInvited(id)
+		return !invited, invited
+	}
+	return !demoted && id < d.cfg.MinUserID, true
+}
+
+// ResourceTypes returns the types of resources distributed and how many of
+// each are included in every request.
+func (d *TelegramDistributor) ResourceTypes() []internal.TelegramResourceConfig {
+	if len(d.cfg.Resources) != 0 {
+		return d.cfg.Resources
+	}
+	return []internal.TelegramResourceConfig{{Type: d.cfg.Resource, NumBridges: d.cfg.NumBridgesPerRequest}}
+}
+
+func (d *TelegramDistributor) isResourceType(rType string) bool {
+	for _, t := range d.ResourceTypes() {
+		if t.Type == rType {
+			return true
 		}
-		resources = append(oldResources, resources...)
 	}
+	return false
+}
+
+func getManyOfType(hashring *core.Hashring, rType internal.TelegramResourceConfig, hashKey core.Hashkey) ([]core.Resource, error) {
+	typeHashring := hashring.Filter(func(r core.Resource) bool {
+		return r.Type() == rType.Type
+	})
+	return typeHashring.GetMany(hashKey, rType.NumBridges)
+}
 
-	d.metricsChan <- md
-	return resources
+// interleave merges the lists of resources taking one of each list in turns,
+// so the first resources of the result include all the types.
+func interleave(lists [][]core.Resource) []core.Resource {
+	var resources []core.Resource
+	for i := 0; ; i++ {
+		added := false
+		for _, list := range lists {
+			if i < len(list) {
+				resources = append(resources, list[i])
+				added = true
+			}
+		}
+		if !added {
+			return resources
+		}
+	}
 }
 
 // housekeeping listens to updates from the backend resources
@@ -91,10 +196,15 @@ func (d *TelegramDistributor) housekeeping(rStream chan *core.ResourceDiff) {
 	defer close(rStream)
 	defer d.ipc.StopStream()
 
+	pruneTicker := time.NewTicker(throttleWindow)
+	defer pruneTicker.Stop()
+
 	for {
 		select {
 		case diff := <-rStream:
 			d.oldHashring.ApplyDiff(diff)
+		case <-pruneTicker.C:
+			d.pruneAbuse()
 		case <-d.shutdown:
 			log.Printf("Shutting down housekeeping.")
 			return
@@ -107,22 +217,42 @@ func (d *TelegramDistributor) Init(cfg *internal.Config) {
 	d.shutdown = make(chan bool)
 	d.oldHashring = core.NewHashring()
 	d.newHashring = core.NewHashring()
-	d.loadNewBridgesFromStore()
 	d.dynamicBridges = make(map[string][]core.Resource)
+	d.lastUpdates = make(map[string]time.Time)
+	d.bridgesAdded = make(map[string]map[core.Hashkey]time.Time)
+	d.loadNewBridgesFromStore()
+	d.challenges = newChallenges()
+	d.abuse = newAbuseTracker()
+	d.loadInvites()
 
 	metricsChan := make(chan metricsData)
 	d.metricsChan = metricsChan
-	go metricsUpdater(metricsChan, cfg.Distributors.Telegram.RotationPeriodHours)
+	d.wg.Add(1)
+	go d.metricsUpdater(metricsChan)
 
 	log.Printf("Initialising resource stream.")
-	d.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourceStreamEndpoint,
-		"GET",
-		cfg.Backend.ApiTokens[DistName])
+	var resourceTypes []string
+	for _, t := range d.ResourceTypes() {
+		resourceTypes = append(resourceTypes, t.Type)
+	}
+	d.ipc = d.IPC
+	if d.ipc == nil {
+		d.ipc = internal.NewResourceStreamIpc(cfg, resourceTypes, cfg.Backend.ApiTokens[DistName])
+	}
+	// an instance dedicated to some countries can avoid the bridges hosted
+	// there
+	var notHostedIn []string
+	if d.cfg.ExcludeSameCountry {
+		notHostedIn = d.cfg.NotBlockedIn
+	}
 	rStream := make(chan *core.ResourceDiff)
 	req := core.ResourceRequest{
 		RequestOrigin: DistName,
-		ResourceTypes: []string{d.cfg.Resource},
+		ResourceTypes: resourceTypes,
+		NotBlockedIn:  d.cfg.NotBlockedIn,
+		NotHostedIn:   notHostedIn,
+		Filters:       d.cfg.Filters,
+		Labels:        d.cfg.Labels,
 		Receiver:      rStream,
 	}
 	d.ipc.StartStream(&req)
@@ -139,13 +269,39 @@ func (d *TelegramDistributor) Shutdown() {
 	d.wg.Wait()
 }
 
-func metricsUpdater(ch <-chan metricsData, rotationPeriodHours int) {
-	requestHashKeys := make(map[core.Hashkey]time.Time)
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *TelegramDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in both pools and the
+// size of each pool.
+func (d *TelegramDistributor) Stats() distributors.Stats {
+	d.newHashrightLock.RLock()
+	defer d.newHashrightLock.RUnlock()
+
+	return distributors.Stats{
+		Resources: distributors.CountResources(d.oldHashring, d.newHashring),
+		Counters: map[string]int{
+			"old_pool": d.oldHashring.Len(),
+			"new_pool": d.newHashring.Len(),
+		},
+	}
+}
+
+// metricsUpdater counts the requests, distinguishing the ones of users that
+// already got the same resources during the rotation period.  The cache of
+// requests is saved in RequestsStore so it survives restarts.
+func (d *TelegramDistributor) metricsUpdater(ch <-chan metricsData) {
+	defer d.wg.Done()
+
+	rotationPeriod := time.Hour * time.Duration(d.cfg.RotationPeriodHours)
+	requestHashKeys := loadRequestHashKeys(d.RequestsStore, time.Now().Add(-rotationPeriod))
 	lastCleanup := time.Now()
 
 	for md := range ch {
 		status := "fresh"
-		keepDate := time.Now().Add(-time.Hour * time.Duration(rotationPeriodHours))
+		keepDate := time.Now().Add(-rotationPeriod)
 		if date, ok := requestHashKeys[md.hashKey]; ok && date.After(keepDate) {
 			status = "cached"
 		} else {
@@ -162,6 +318,42 @@ func metricsUpdater(ch <-chan metricsData, rotationPeriodHours int) {
 					delete(requestHashKeys, hk)
 				}
 			}
+			lastCleanup = time.Now()
+			saveRequestHashKeys(d.RequestsStore, requestHashKeys)
+		}
+	}
+
+	saveRequestHashKeys(d.RequestsStore, requestHashKeys)
+}
+
+// loadRequestHashKeys loads the requests cache from the store, discarding the
+// requests older than keepDate.
+func loadRequestHashKeys(store persistence.Mechanism, keepDate time.Time) map[core.Hashkey]time.Time {
+	requestHashKeys := make(map[core.Hashkey]time.Time)
+	if store == nil {
+		return requestHashKeys
+	}
+
+	var stored map[core.Hashkey]time.Time
+	err := store.Load(&stored)
+	if err != nil {
+		log.Println("Can't load the requests cache:", err)
+		return requestHashKeys
+	}
+	for hk, t := range stored {
+		if t.After(keepDate) {
+			requestHashKeys[hk] = t
 		}
 	}
+	return requestHashKeys
+}
+
+func saveRequestHashKeys(store persistence.Mechanism, requestHashKeys map[core.Hashkey]time.Time) {
+	if store == nil {
+		return
+	}
+	err := store.Save(requestHashKeys)
+	if err != nil {
+		log.Println("Can't save the requests cache:", err)
+	}
 }
@@ -5,10 +5,15 @@
 package telegram
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
 )
 
 var (
@@ -28,8 +33,15 @@ var (
 )
 
 func initDistributor() *TelegramDistributor {
+	return initDistributorWithConfig(&config)
+}
+
+// initDistributorWithConfig initializes a distributor with the given
+// configuration, that must not change after it, as the goroutines of the
+// distributor read it.
+func initDistributorWithConfig(cfg *internal.Config) *TelegramDistributor {
 	d := TelegramDistributor{}
-	d.Init(&config)
+	d.Init(cfg)
 	d.newHashring.Add(newDummyResource)
 	d.oldHashring.Add(oldDummyResource)
 	return &d
@@ -42,7 +54,7 @@ func TestGetResources(t *testing.T) {
 	d := initDistributor()
 	defer d.Shutdown()
 
-	res := d.GetResources(newID)
+	res := d.GetResources(context.Background(), newID)
 	if len(res) != 1 {
 		t.Fatalf("Wrong number of resrources for new: %d", len(res))
 	}
@@ -50,7 +62,7 @@ func TestGetResources(t *testing.T) {
 		t.Errorf("Wrong resource: %v", res[0])
 	}
 
-	res = d.GetResources(oldID)
+	res = d.GetResources(context.Background(), oldID)
 	if len(res) != 2 {
 		t.Fatalf("Wrong number of resrources for old: %d", len(res))
 	}
@@ -61,3 +73,74 @@ func TestGetResources(t *testing.T) {
 		t.Errorf("Wrong resource: %v", res[1])
 	}
 }
+
+func TestGetResourcesMultipleTypes(t *testing.T) {
+	oldID := int64(10)
+
+	c := config
+	c.Distributors.Telegram.Resources = []internal.TelegramResourceConfig{
+		{Type: "obfs4", NumBridges: 2},
+		{Type: "webtunnel", NumBridges: 1},
+	}
+	d := TelegramDistributor{}
+	d.Init(&c)
+	defer d.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		for j, rType := range []string{"obfs4", "webtunnel"} {
+			oldResource, err := parseBridgeline(fmt.Sprintf("Bridge %s 192.0.2.%d:443 %040d", rType, i, j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.oldHashring.Add(oldResource)
+			newResource, err := parseBridgeline(fmt.Sprintf("Bridge %s 198.51.100.%d:443 %040d", rType, i, j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.newHashring.Add(newResource)
+		}
+	}
+
+	res := d.GetResources(context.Background(), oldID)
+	if len(res) != 6 {
+		t.Fatalf("Wrong number of resources: %d", len(res))
+	}
+	if res[0].Type() != "obfs4" || res[1].Type() != "webtunnel" {
+		t.Errorf("Resource types are not interleaved: %s %s", res[0].Type(), res[1].Type())
+	}
+	count := make(map[string]int)
+	for _, r := range res {
+		count[r.Type()]++
+	}
+	if count["obfs4"] != 4 || count["webtunnel"] != 2 {
+		t.Errorf("Wrong number of resources per type: %v", count)
+	}
+}
+
+func TestRequestsStore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "telegram-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	d := TelegramDistributor{RequestsStore: pjson.New("requests", tmpDir)}
+	d.Init(&config)
+	d.newHashring.Add(newDummyResource)
+	d.GetResources(context.Background(), 101)
+	d.Shutdown()
+
+	requestHashKeys := loadRequestHashKeys(d.RequestsStore, time.Now().Add(-time.Hour))
+	if len(requestHashKeys) != 1 {
+		t.Fatalf("Wrong number of stored requests: %d", len(requestHashKeys))
+	}
+	hashKey := core.NewHashkey(fmt.Sprintf("%d-%d", 101, d.currentPeriod()))
+	if _, ok := requestHashKeys[hashKey]; !ok {
+		t.Error("The request was not stored")
+	}
+
+	requestHashKeys = loadRequestHashKeys(d.RequestsStore, time.Now().Add(time.Minute))
+	if len(requestHashKeys) != 0 {
+		t.Errorf("Old requests were not discarded: %d", len(requestHashKeys))
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webpush
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/distributorsdk"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+const (
+	DistName = "webpush"
+
+	// idLength is the number of random bytes of the subscription ids and
+	// tokens
+	idLength = 16
+	// checkInterval is how often the subscriptions are checked for blocked
+	// or rotated resources
+	checkInterval = time.Minute
+	// defaultSubscriptionsPerAddress is how many subscriptions an address
+	// can make in each rotation period if it's not configured
+	defaultSubscriptionsPerAddress = 3
+)
+
+// DefaultPushServices are the hosts of the push services of the main
+// browsers, the endpoints have to be in them or in their subdomains.
+var DefaultPushServices = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"notify.windows.com",
+	"push.apple.com",
+}
+
+var (
+	subscriptionsCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webpush_subscriptions",
+		Help: "The number of active push subscriptions",
+	})
+	notificationsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webpush_notifications_total",
+		Help: "The total number of bridge updates pushed to the subscriptions",
+	})
+
+	NoBridgesError            = distributorsdk.NoBridgesError
+	UnknownSubscriptionError  = errors.New("unknown subscription")
+	InvalidSubscriptionError  = errors.New("invalid subscription")
+	TooManySubscriptionsError = errors.New("too many subscriptions")
+	RateLimitedError          = errors.New("too many subscriptions from the address")
+	UnknownPushServiceError   = errors.New("the endpoint is not of a known push service")
+	UnsupportedTypeError      = errors.New("unsupported resource type")
+)
+
+// Subscription is a browser push subscription.
+type Subscription struct {
+	ID string `json:"id"`
+	// Token authenticates the owner of the subscription
+	Token string `json:"token"`
+	// Endpoint, P256dh and Auth are the push subscription of the browser,
+	// as returned by PushManager.subscribe()
+	Endpoint string `json:"endpoint"`
+	P256dh   string `json:"p256dh"`
+	Auth     string `json:"auth"`
+	Type     string `json:"type"`
+	// Country is where the user is, the resources blocked in it are not
+	// handed out
+	Country string `json:"country"`
+	// Address is the network prefix of the subscriber, like the /16 of its
+	// IPv4 address.  The subscriptions of an address get the same resources,
+	// so subscribing many times doesn't reveal more of them.
+	Address string    `json:"address"`
+	Created time.Time `json:"created"`
+	// Bridges are the bridge lines last sent to the subscription
+	Bridges []string `json:"bridges"`
+}
+
+// Notifier pushes the new resources of a subscription to the browser.  It
+// returns false if the subscription is gone and has to be removed.
+type Notifier func(sub Subscription, resources []core.Resource) bool
+
+// WebPushDistributor hands out resources to browser extensions and pushes new
+// ones to them when theirs get blocked or rotated.
+type WebPushDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+
+	base *distributorsdk.Distributor
+	cfg  *internal.WebPushDistConfig
+	// lastPeriod and dirty are only used from the housekeeping hooks, dirty
+	// is set when the subscriptions may need new resources
+	lastPeriod int64
+	dirty      bool
+
+	lock          sync.Mutex
+	subscriptions map[string]*Subscription
+	// subscribes counts the subscriptions of each address in
+	// subscribesPeriod
+	subscribes       map[string]int
+	subscribesPeriod int64
+
+	// Notifier is called for each subscription that gets new resources
+	Notifier Notifier
+	// SubscriptionsStore keeps the subscriptions across restarts
+	SubscriptionsStore persistence.Mechanism
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, idLength)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (d *WebPushDistributor) supportsType(rType string) bool {
+	for _, t := range d.cfg.Resources {
+		if t == rType {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedEndpoint checks if the endpoint is an https URL of one of the
+// configured push services, or of DefaultPushServices if there are none.
+func (d *WebPushDistributor) AllowedEndpoint(endpoint string) bool {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(endpointURL.Hostname())
+	services := d.cfg.PushServices
+	if len(services) == 0 {
+		services = DefaultPushServices
+	}
+	for _, service := range services {
+		service = strings.ToLower(service)
+		if host == service || strings.HasSuffix(host, "."+service) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowSubscribe counts a subscription of the address if it didn't make too
+// many in the current rotation period.  It needs to be called with the lock
+// held.
+func (d *WebPushDistributor) allowSubscribe(address string) bool {
+	if period := d.currentPeriod(); period != d.subscribesPeriod {
+		d.subscribesPeriod = period
+		d.subscribes = make(map[string]int)
+	}
+	limit := d.cfg.MaxSubscriptionsPerAddress
+	if limit == 0 {
+		limit = defaultSubscriptionsPerAddress
+	}
+	if d.subscribes[address] >= limit {
+		return false
+	}
+	d.subscribes[address]++
+	return true
+}
+
+// Subscribe registers a new push subscription and returns it with its
+// resources.  The endpoint must be of a known push service and the address of
+// the subscriber is rate limited.
+func (d *WebPushDistributor) Subscribe(sub Subscription) (*Subscription, []core.Resource, error) {
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" || sub.P256dh == "" || sub.Auth == "" || sub.Address == "" {
+		return nil, nil, InvalidSubscriptionError
+	}
+	if !d.AllowedEndpoint(sub.Endpoint) {
+		return nil, nil, UnknownPushServiceError
+	}
+	if sub.Type == "" && len(d.cfg.Resources) != 0 {
+		sub.Type = d.cfg.Resources[0]
+	}
+	if !d.supportsType(sub.Type) {
+		return nil, nil, UnsupportedTypeError
+	}
+	sub.Country = strings.ToLower(sub.Country)
+
+	sub.ID, err = randomString()
+	if err != nil {
+		return nil, nil, err
+	}
+	sub.Token, err = randomString()
+	if err != nil {
+		return nil, nil, err
+	}
+	sub.Created = time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.cfg.MaxSubscriptions != 0 && len(d.subscriptions) >= d.cfg.MaxSubscriptions {
+		return nil, nil, TooManySubscriptionsError
+	}
+	if !d.allowSubscribe(sub.Address) {
+		return nil, nil, RateLimitedError
+	}
+
+	resources, err := d.resourcesFor(&sub)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub.Bridges = bridgelines(resources)
+	d.subscriptions[sub.ID] = &sub
+	subscriptionsCount.Set(float64(len(d.subscriptions)))
+	d.saveSubscriptions()
+	return &sub, resources, nil
+}
+
+// Unsubscribe removes the subscription if the token is valid.
+func (d *WebPushDistributor) Unsubscribe(id, token string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, err := d.getSubscription(id, token)
+	if err != nil {
+		return err
+	}
+	d.removeSubscription(id)
+	return nil
+}
+
+// GetResources returns the current resources of the subscription.  No
+// resources are handed out if the given context is done.
+func (d *WebPushDistributor) GetResources(ctx context.Context, id, token string) ([]core.Resource, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// We may have waited for the lock for a while.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sub, err := d.getSubscription(id, token)
+	if err != nil {
+		return nil, err
+	}
+	return d.resourcesFor(sub)
+}
+
+// getSubscription needs to be called with the lock held.
+func (d *WebPushDistributor) getSubscription(id, token string) (*Subscription, error) {
+	sub, ok := d.subscriptions[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(sub.Token), []byte(token)) != 1 {
+		return nil, UnknownSubscriptionError
+	}
+	return sub, nil
+}
+
+// removeSubscription needs to be called with the lock held.
+func (d *WebPushDistributor) removeSubscription(id string) {
+	delete(d.subscriptions, id)
+	subscriptionsCount.Set(float64(len(d.subscriptions)))
+	d.saveSubscriptions()
+}
+
+// resourcesFor returns the resources of the subscription for the current
+// rotation period, skipping the ones blocked in its country.  The hashkey is
+// derived from the address of the subscriber, or from its id for the
+// subscriptions stored without one.
+func (d *WebPushDistributor) resourcesFor(sub *Subscription) ([]core.Resource, error) {
+	ring := d.base.Ring.Filter(func(r core.Resource) bool {
+		if r.Type() != sub.Type {
+			return false
+		}
+		return sub.Country == "" || !r.BlockedIn()[sub.Country]
+	})
+	if ring.Len() == 0 {
+		return nil, NoBridgesError
+	}
+
+	num := d.cfg.NumBridgesPerRequest
+	if num > ring.Len() {
+		num = ring.Len()
+	}
+	identity := sub.Address
+	if identity == "" {
+		identity = sub.ID
+	}
+	hashKey := core.NewHashkey(fmt.Sprintf("%s-%d", identity, d.currentPeriod()))
+	return ring.GetMany(hashKey, num)
+}
+
+func (d *WebPushDistributor) currentPeriod() int64 {
+	return distributorsdk.RotationPeriod(d.cfg.RotationPeriodHours)
+}
+
+func bridgelines(resources []core.Resource) []string {
+	lines := make([]string, len(resources))
+	for i, r := range resources {
+		lines[i] = r.String()
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSubscriptions notifies the subscriptions whose resources changed since
+// the last notification, because they got blocked, went away or rotated.
+func (d *WebPushDistributor) checkSubscriptions() {
+	type update struct {
+		sub       Subscription
+		resources []core.Resource
+	}
+	var updates []update
+
+	d.lock.Lock()
+	for _, sub := range d.subscriptions {
+		resources, err := d.resourcesFor(sub)
+		if err != nil {
+			continue
+		}
+		lines := bridgelines(resources)
+		if equalLines(lines, sub.Bridges) {
+			continue
+		}
+		sub.Bridges = lines
+		updates = append(updates, update{*sub, resources})
+	}
+	if len(updates) != 0 {
+		d.saveSubscriptions()
+	}
+	d.lock.Unlock()
+
+	if d.Notifier == nil {
+		return
+	}
+	for _, u := range updates {
+		notificationsCount.Inc()
+		if !d.Notifier(u.sub, u.resources) {
+			log.Printf("Removing expired push subscription %s.", u.sub.ID)
+			d.lock.Lock()
+			d.removeSubscription(u.sub.ID)
+			d.lock.Unlock()
+		}
+	}
+}
+
+func (d *WebPushDistributor) loadSubscriptions() {
+	d.subscriptions = make(map[string]*Subscription)
+	if d.SubscriptionsStore == nil {
+		return
+	}
+	err := d.SubscriptionsStore.Load(&d.subscriptions)
+	if err != nil {
+		log.Println("Can't load the push subscriptions:", err)
+	}
+	if d.subscriptions == nil {
+		d.subscriptions = make(map[string]*Subscription)
+	}
+	subscriptionsCount.Set(float64(len(d.subscriptions)))
+}
+
+// saveSubscriptions needs to be called with the lock held.
+func (d *WebPushDistributor) saveSubscriptions() {
+	if d.SubscriptionsStore == nil {
+		return
+	}
+	err := d.SubscriptionsStore.Save(d.subscriptions)
+	if err != nil {
+		log.Println("Can't save the push subscriptions:", err)
+	}
+}
+
+// onDiff marks the subscriptions to be checked, as their resources may have
+// changed.
+func (d *WebPushDistributor) onDiff(diff *core.ResourceDiff) {
+	d.dirty = true
+}
+
+// onTick checks if the subscriptions need new resources, because of the
+// resource diffs since the last check or because the rotation period ended.
+func (d *WebPushDistributor) onTick() {
+	if period := d.currentPeriod(); period != d.lastPeriod {
+		d.lastPeriod = period
+		d.dirty = true
+	}
+	if d.dirty {
+		d.dirty = false
+		d.checkSubscriptions()
+	}
+}
+
+// Init initialises the given web push distributor.
+func (d *WebPushDistributor) Init(cfg *internal.Config) {
+	log.Printf("Initialising %s distributor.", DistName)
+
+	d.cfg = &cfg.Distributors.WebPush
+	d.loadSubscriptions()
+	d.lastPeriod = d.currentPeriod()
+
+	sdkCfg := distributorsdk.FromRdsysConfig(cfg, DistName, d.cfg.Resources)
+	if d.IPC != nil {
+		sdkCfg.IPC = d.IPC
+	}
+	sdkCfg.TickInterval = checkInterval
+	d.base = distributorsdk.New(sdkCfg, distributorsdk.Hooks{
+		OnDiff: d.onDiff,
+		OnTick: d.onTick,
+	})
+	d.base.Start()
+}
+
+// Shutdown shuts down the given web push distributor.
+func (d *WebPushDistributor) Shutdown() {
+	log.Printf("Shutting down %s distributor.", DistName)
+
+	d.base.Stop()
+}
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *WebPushDistributor) Healthz() error {
+	return distributors.CheckResources(d.Stats())
+}
+
+// Stats returns the number of resources of each type in the hashring and the
+// number of subscriptions.
+func (d *WebPushDistributor) Stats() distributors.Stats {
+	d.lock.Lock()
+	subscriptions := len(d.subscriptions)
+	d.lock.Unlock()
+
+	return distributors.Stats{
+		Resources: distributors.CountResources(d.base.Ring),
+		Counters:  map[string]int{"subscriptions": subscriptions},
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webpush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	pjson "gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/persistence/json"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
+)
+
+var config = internal.Config{
+	Distributors: internal.Distributors{
+		WebPush: internal.WebPushDistConfig{
+			Resources:                  []string{"obfs4"},
+			NumBridgesPerRequest:       2,
+			RotationPeriodHours:        24,
+			MaxSubscriptions:           3,
+			PushServices:               []string{"push.example.com"},
+			MaxSubscriptionsPerAddress: 2,
+		},
+	},
+}
+
+var browserSubscription = Subscription{
+	Endpoint: "https://push.example.com/send/abc",
+	P256dh:   "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM",
+	Auth:     "tBHItJI5svbpez7KI4CCXg",
+	Country:  "RU",
+	Address:  "198.51",
+}
+
+func newTransport(i int) *resources.Transport {
+	t := resources.NewTransport()
+	t.SetType("obfs4")
+	t.Address = resources.Addr{Addr: &net.IPAddr{IP: net.ParseIP(fmt.Sprintf("192.0.2.%d", i))}}
+	t.Port = 443
+	t.Fingerprint = fmt.Sprintf("%040d", i)
+	return t
+}
+
+func newDistributor(t *testing.T) *WebPushDistributor {
+	d := &WebPushDistributor{}
+	d.Init(&config)
+	for i := 0; i < 5; i++ {
+		d.base.Ring.Add(newTransport(i))
+	}
+	return d
+}
+
+func TestSubscribe(t *testing.T) {
+	d := newDistributor(t)
+	defer d.Shutdown()
+
+	sub, resources, err := d.Subscribe(browserSubscription)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("Wrong number of resources: %d", len(resources))
+	}
+	if sub.ID == "" || sub.Token == "" || sub.Type != "obfs4" || sub.Country != "ru" {
+		t.Errorf("Unexpected subscription: %+v", sub)
+	}
+
+	res2, err := d.GetResources(context.Background(), sub.ID, sub.Token)
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	if !equalLines(bridgelines(resources), bridgelines(res2)) {
+		t.Error("Different resources for the same subscription")
+	}
+
+	_, err = d.GetResources(context.Background(), sub.ID, "wrong token")
+	if !errors.Is(err, UnknownSubscriptionError) {
+		t.Error("Expected unknown subscription error:", err)
+	}
+	err = d.Unsubscribe(sub.ID, "wrong token")
+	if !errors.Is(err, UnknownSubscriptionError) {
+		t.Error("Expected unknown subscription error:", err)
+	}
+	err = d.Unsubscribe(sub.ID, sub.Token)
+	if err != nil {
+		t.Error("Can't unsubscribe:", err)
+	}
+	_, err = d.GetResources(context.Background(), sub.ID, sub.Token)
+	if !errors.Is(err, UnknownSubscriptionError) {
+		t.Error("Expected unknown subscription error:", err)
+	}
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	d := newDistributor(t)
+	defer d.Shutdown()
+
+	for _, endpoint := range []string{"", "http://push.example.com/abc", "https://"} {
+		sub := browserSubscription
+		sub.Endpoint = endpoint
+		_, _, err := d.Subscribe(sub)
+		if !errors.Is(err, InvalidSubscriptionError) {
+			t.Errorf("Expected invalid subscription error for '%s': %v", endpoint, err)
+		}
+	}
+
+	for _, endpoint := range []string{"https://127.0.0.1/abc", "https://push.example.com.evil.net/abc", "https://evilpush.example.com/abc"} {
+		sub := browserSubscription
+		sub.Endpoint = endpoint
+		_, _, err := d.Subscribe(sub)
+		if !errors.Is(err, UnknownPushServiceError) {
+			t.Errorf("Expected unknown push service error for '%s': %v", endpoint, err)
+		}
+	}
+	sub := browserSubscription
+	sub.Endpoint = "https://eu.push.example.com/abc"
+	subscribed, _, err := d.Subscribe(sub)
+	if err != nil {
+		t.Fatal("Can't subscribe to a subdomain of the push service:", err)
+	}
+	d.Unsubscribe(subscribed.ID, subscribed.Token)
+
+	sub = browserSubscription
+	sub.Type = "vanilla"
+	_, _, err = d.Subscribe(sub)
+	if !errors.Is(err, UnsupportedTypeError) {
+		t.Error("Expected unsupported type error:", err)
+	}
+
+	for i := 0; i < config.Distributors.WebPush.MaxSubscriptions; i++ {
+		sub := browserSubscription
+		sub.Address = fmt.Sprintf("203.%d", i)
+		_, _, err = d.Subscribe(sub)
+		if err != nil {
+			t.Fatal("Can't subscribe:", err)
+		}
+	}
+	sub = browserSubscription
+	sub.Address = "203.100"
+	_, _, err = d.Subscribe(sub)
+	if !errors.Is(err, TooManySubscriptionsError) {
+		t.Error("Expected too many subscriptions error:", err)
+	}
+}
+
+func TestSubscribeSameAddress(t *testing.T) {
+	d := newDistributor(t)
+	defer d.Shutdown()
+
+	sub1, res1, err := d.Subscribe(browserSubscription)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	_, res2, err := d.Subscribe(browserSubscription)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	if !equalLines(bridgelines(res1), bridgelines(res2)) {
+		t.Error("Different resources for the same address")
+	}
+
+	// unsubscribing doesn't give more subscriptions in the period
+	d.Unsubscribe(sub1.ID, sub1.Token)
+	_, _, err = d.Subscribe(browserSubscription)
+	if !errors.Is(err, RateLimitedError) {
+		t.Error("Expected rate limited error:", err)
+	}
+}
+
+func TestCheckSubscriptions(t *testing.T) {
+	d := newDistributor(t)
+	defer d.Shutdown()
+
+	notified := make(map[string][]core.Resource)
+	d.Notifier = func(sub Subscription, resources []core.Resource) bool {
+		notified[sub.ID] = resources
+		return true
+	}
+
+	sub, resources, err := d.Subscribe(browserSubscription)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	d.checkSubscriptions()
+	if len(notified) != 0 {
+		t.Fatal("Subscription notified without changes")
+	}
+
+	resources[0].SetBlockedIn(core.LocationSet{"ru": true})
+	d.checkSubscriptions()
+	newResources, ok := notified[sub.ID]
+	if !ok {
+		t.Fatal("Subscription not notified after blocking")
+	}
+	for _, r := range newResources {
+		if r.BlockedIn()["ru"] {
+			t.Error("Notified a blocked resource:", r)
+		}
+	}
+
+	d.Notifier = func(sub Subscription, resources []core.Resource) bool {
+		return false
+	}
+	newResources[0].SetBlockedIn(core.LocationSet{"ru": true})
+	d.checkSubscriptions()
+	_, err = d.GetResources(context.Background(), sub.ID, sub.Token)
+	if !errors.Is(err, UnknownSubscriptionError) {
+		t.Error("Expired subscription was not removed:", err)
+	}
+}
+
+func TestSubscriptionsStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webpush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &WebPushDistributor{SubscriptionsStore: pjson.New("subscriptions", dir)}
+	d.Init(&config)
+	d.base.Ring.Add(newTransport(1))
+	sub, _, err := d.Subscribe(browserSubscription)
+	if err != nil {
+		t.Fatal("Can't subscribe:", err)
+	}
+	d.Shutdown()
+
+	d = &WebPushDistributor{SubscriptionsStore: pjson.New("subscriptions", dir)}
+	d.Init(&config)
+	defer d.Shutdown()
+	d.base.Ring.Add(newTransport(1))
+	_, err = d.GetResources(context.Background(), sub.ID, sub.Token)
+	if err != nil {
+		t.Error("Subscription not restored:", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/distributorsdk"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+const (
+	DistName = "xmpp"
+)
+
+var (
+	NoBridgesError = distributorsdk.NoBridgesError
+)
+
+// XMPPDistributor contains all the context that the distributor needs to run.
+type XMPPDistributor struct {
+	// IPC replaces the HTTP connection to the backend if set, e.g. in tests.
+	IPC delivery.Mechanism
+
+	base *distributorsdk.Distributor
+	cfg  *internal.XMPPDistConfig
+}
+
+// BareJID removes the resource of the JID and normalizes its case, so all the
+// clients of the same account get the same resources.
+func BareJID(jid string) string {
+	return strings.ToLower(strings.SplitN(jid, "/", 2)[0])
+}
+
+// GetResources returns the resources for the JID.  The same account gets the
+// same resources during a rotation period.  No resources are handed out if the
+// given context is done.
+func (d *XMPPDistributor) GetResources(ctx context.Context, jid string) ([]core.Resource, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	period := distributorsdk.RotationPeriod(d.cfg.RotationPeriodHours)
+	hashKey := core.NewHashkey(fmt.Sprintf("%s-%d", BareJID(jid), period))
+	return d.base.HandOut(hashKey, d.cfg.NumBridgesPerRequest)
+}
+
+// Init initialises the given XMPP distributor.
+func (d *XMPPDistributor) Init(cfg *internal.Config) {
+	log.Printf("Initialising %s distributor.", DistName)
+
+	d.cfg = &cfg.Distributors.XMPP
+	sdkCfg := distributorsdk.FromRdsysConfig(cfg, DistName, d.cfg.Resources)
+	if d.IPC != nil {
+		sdkCfg.IPC = d.IPC
+	}
+	d.base = distributorsdk.New(sdkCfg, distributorsdk.Hooks{})
+	d.base.Start()
+}
+
+// Shutdown shuts down the given XMPP distributor.
+func (d *XMPPDistributor) Shutdown() {
+	log.Printf("Shutting down %s distributor.", DistName)
+
+	d.base.Stop()
+}
+
+// Healthz returns an error if the distributor has no resources to hand out.
+func (d *XMPPDistributor) Healthz() error {
+	return d.base.Healthz()
+}
+
+// Stats returns the number of resources of each type in the hashring.
+func (d *XMPPDistributor) Stats() distributors.Stats {
+	return d.base.Stats()
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/testsupport"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/distributors"
+)
+
+var config = internal.Config{
+	Distributors: internal.Distributors{
+		XMPP: internal.XMPPDistConfig{
+			Resources:            []string{"dummy"},
+			NumBridgesPerRequest: 2,
+			RotationPeriodHours:  24,
+		},
+	},
+}
+
+func TestBareJID(t *testing.T) {
+	for jid, bare := range map[string]string{
+		"user@example.com":                 "user@example.com",
+		"User@Example.com/Conversations.x": "user@example.com",
+		"user@example.com/res/with/slash":  "user@example.com",
+	} {
+		if b := BareJID(jid); b != bare {
+			t.Errorf("Wrong bare JID for %s: %s", jid, b)
+		}
+	}
+}
+
+func TestGetResources(t *testing.T) {
+	backend := testsupport.NewFakeBackend()
+	d := XMPPDistributor{IPC: backend}
+	d.Init(&config)
+	defer d.Shutdown()
+
+	_, err := d.GetResources(context.Background(), "user@example.com")
+	if !errors.Is(err, NoBridgesError) {
+		t.Error("Expected no bridges error:", err)
+	}
+
+	if err := backend.Play(testsupport.NewScript().Add(testsupport.Dummies(5)...)); err != nil {
+		t.Fatal("Can't send resources:", err)
+	}
+	if err := testsupport.WaitFor(func() bool { return d.Stats().Resources["dummy"] == 5 }); err != nil {
+		t.Fatal("The distributor didn't get the resources:", err)
+	}
+
+	res, err := d.GetResources(context.Background(), "user@example.com/phone")
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Wrong number of resources: %d", len(res))
+	}
+	res2, err := d.GetResources(context.Background(), "User@example.com/laptop")
+	if err != nil {
+		t.Fatal("Can't get resources:", err)
+	}
+	for i := range res {
+		if res[i] != res2[i] {
+			t.Error("Different resources for the same account:", res[i], res2[i])
+		}
+	}
+}
+
+func TestGetResourcesCanceled(t *testing.T) {
+	d := XMPPDistributor{}
+	d.Init(&config)
+	defer d.Shutdown()
+	d.base.Ring.Add(core.NewDummy(1, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := d.GetResources(ctx, "user@example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Error("Expected a canceled error:", err)
+	}
+	if len(res) != 0 {
+		t.Error("Got resources for a canceled request:", res)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	backend := testsupport.NewFakeBackend()
+	d := XMPPDistributor{IPC: backend}
+	d.Init(&config)
+	defer d.Shutdown()
+
+	if err := d.Healthz(); !errors.Is(err, distributors.NoResourcesError) {
+		t.Error("Expected no resources error:", err)
+	}
+
+	dummies := testsupport.Dummies(2)
+	if err := backend.Send(testsupport.NewScript().Add(dummies...).Diffs()[0]); err != nil {
+		t.Fatal("Can't send resources:", err)
+	}
+	if err := testsupport.WaitFor(func() bool { return d.Healthz() == nil }); err != nil {
+		t.Error("The distributor didn't become healthy:", err)
+	}
+	if num := d.Stats().Resources["dummy"]; num != 2 {
+		t.Errorf("Wrong number of resources in the stats: %d", num)
+	}
+
+	if err := backend.Play(testsupport.NewScript().Remove(dummies...)); err != nil {
+		t.Fatal("Can't remove resources:", err)
+	}
+	if err := testsupport.WaitFor(func() bool { return d.Healthz() != nil }); err != nil {
+		t.Error("The distributor is healthy without resources:", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,6 +29,10 @@ const (
 	DistributorUnallocated = "unallocated"
 
 	BridgeReloadInterval = time.Hour
+
+	// FingerprintLength is the number of hex characters of a bridge's
+	// fingerprint.
+	FingerprintLength = 40
 )
 
 // Type Addr is a wrapper around net.Addr which provides identical Marshalling
@@ -38,21 +43,73 @@ type Addr struct {
 	net.Addr
 }
 
+// String returns the address, or an empty string if there is none.
+func (a Addr) String() string {
+	if a.Addr == nil {
+		return ""
+	}
+	return a.Addr.String()
+}
+
 func (a Addr) MarshalJSON() ([]byte, error) {
 	return json.Marshal(a.String())
 }
 
+// UnmarshalJSON parses the IP address that MarshalJSON wrote.  An empty
+// address leaves the Addr empty.
 func (a *Addr) UnmarshalJSON(data []byte) error {
-	ipAddr := net.ParseIP(a.Addr.String())
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		a.Addr = nil
+		return nil
+	}
+
+	ipAddr, err := parseIPAddr(s)
+	if err != nil {
+		return err
+	}
+	a.Addr = ipAddr
+	return nil
+}
+
+// parseIPAddr parses an IP address with an optional zone, e.g. fe80::1%eth0.
+// Host names are not resolved.
+func parseIPAddr(s string) (*net.IPAddr, error) {
+	ip, zone := s, ""
+	if i := strings.LastIndex(s, "%"); i != -1 {
+		ip, zone = s[:i], s[i+1:]
+	}
+	ipAddr := net.ParseIP(ip)
 	if ipAddr == nil {
-		return fmt.Errorf("Invalid Address Format: %s", a.Addr.String())
+		return nil, fmt.Errorf("Invalid Address Format: %s", s)
+	}
+	return &net.IPAddr{IP: ipAddr, Zone: zone}, nil
+}
+
+// ParseAddrPort parses the ip:port address of a bridge line, where IPv6
+// addresses are enclosed by square brackets.  The port can't be zero.
+func ParseAddrPort(s string) (Addr, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr{}, 0, err
+	}
+	ipAddr, err := parseIPAddr(host)
+	if err != nil {
+		return Addr{}, 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return Addr{}, 0, fmt.Errorf("invalid port in address %q", s)
 	}
-	return json.Unmarshal(data, &ipAddr)
+	return Addr{Addr: ipAddr}, uint16(port), nil
 }
 
 // Invalid checks if is a valid public address
 func (a *Addr) Invalid() bool {
-	ipAddr := net.ParseIP(a.Addr.String())
+	ipAddr := net.ParseIP(a.String())
 	isIpAddr := ipAddr != nil
 	if !isIpAddr {
 		// if it's not an IP address, it must be a hostname, even if it's a
@@ -125,6 +182,18 @@ func (b *BridgeBase) Distributor() string {
 	return b.Distribution
 }
 
+// Parameter implements core.ParameterizedResource.  Bridges can be filtered
+// by their "port" and "protocol".
+func (b *BridgeBase) Parameter(name string) (string, bool) {
+	switch name {
+	case "port":
+		return strconv.Itoa(int(b.Port)), true
+	case "protocol":
+		return b.Protocol, true
+	}
+	return "", false
+}
+
 func (b *BridgeBase) oidString() string {
 	return fmt.Sprintf("%s|%v|%v", b.Distribution, b.ORAddresses, b.Flags)
 }
@@ -213,6 +282,28 @@ func PrintTorAddr(a *Addr) string {
 	}
 }
 
+// ValidFingerprint returns true if the given string looks like a bridge's
+// fingerprint, i.e., FingerprintLength hex characters.
+func ValidFingerprint(fingerprint string) bool {
+	if len(fingerprint) != FingerprintLength {
+		return false
+	}
+	_, err := hex.DecodeString(fingerprint)
+	return err == nil
+}
+
+// Fingerprint returns the fingerprint of the bridge of the given resource, and
+// false if the resource is neither a bridge nor a transport of a bridge.
+func Fingerprint(r core.Resource) (string, bool) {
+	if transport, ok := core.As[*Transport](r); ok {
+		return transport.Fingerprint, true
+	}
+	if bridge, ok := core.As[*Bridge](r); ok {
+		return bridge.Fingerprint, true
+	}
+	return "", false
+}
+
 // HashFingerprint takes as input a bridge's fingerprint and hashes it using
 // SHA-1, as discussed by Tor Metrics:
 // https://metrics.torproject.org/onionoo.html#parameters_lookup
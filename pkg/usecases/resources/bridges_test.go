@@ -5,6 +5,7 @@
 package resources
 
 import (
+	"encoding/json"
 	"net"
 	"testing"
 )
@@ -44,3 +45,87 @@ func TestPrintTorAddr(t *testing.T) {
 		t.Errorf("failed to print IPv666666ess correctly")
 	}
 }
+
+func TestParameter(t *testing.T) {
+	transport := NewTransport()
+	transport.Port = 443
+	transport.Parameters["iat-mode"] = "1"
+
+	for name, expected := range map[string]string{"port": "443", "protocol": ProtoTypeTCP, "iat-mode": "1"} {
+		value, exists := transport.Parameter(name)
+		if !exists || value != expected {
+			t.Errorf("expected %s=%s but got %q", name, expected, value)
+		}
+	}
+	if _, exists := transport.Parameter("cert"); exists {
+		t.Error("got a parameter that the transport doesn't have")
+	}
+
+	bridge := NewBridge()
+	bridge.Port = 9001
+	if value, exists := bridge.Parameter("port"); !exists || value != "9001" {
+		t.Errorf("expected port=9001 but got %q", value)
+	}
+}
+
+func TestAddrJSON(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4", "2001:db8::1", "fe80::1%eth0"} {
+		a := Addr{}
+		if err := json.Unmarshal([]byte(`"`+addr+`"`), &a); err != nil {
+			t.Fatalf("failed to unmarshal %s: %s", addr, err)
+		}
+		if a.String() != addr {
+			t.Errorf("expected %s but got %s", addr, a.String())
+		}
+		encoded, err := json.Marshal(a)
+		if err != nil || string(encoded) != `"`+addr+`"` {
+			t.Errorf("failed to marshal %s: %s %v", addr, encoded, err)
+		}
+	}
+
+	a := Addr{}
+	if err := json.Unmarshal([]byte(`""`), &a); err != nil || a.Addr != nil {
+		t.Errorf("empty address wasn't left empty: %v %v", a.Addr, err)
+	}
+	if a.String() != "" {
+		t.Errorf("expected an empty string but got %s", a.String())
+	}
+	if err := json.Unmarshal([]byte(`"foo"`), &a); err == nil {
+		t.Errorf("accepted invalid address")
+	}
+}
+
+func TestParseAddrPort(t *testing.T) {
+	for s, expected := range map[string]string{
+		"1.2.3.4:443":        "1.2.3.4",
+		"[2001:db8::1]:9001": "2001:db8::1",
+	} {
+		addr, port, err := ParseAddrPort(s)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", s, err)
+			continue
+		}
+		if addr.String() != expected || port == 0 {
+			t.Errorf("expected %s but got %s:%d", expected, addr.String(), port)
+		}
+	}
+
+	for _, s := range []string{"", "1.2.3.4", "1.2.3.4:", "1.2.3.4:0", "1.2.3.4:65536",
+		"1.2.3.4:-1", "2001:db8::1:443", "example.com:443", ":443", "1.2.3.4:80x"} {
+		if _, _, err := ParseAddrPort(s); err == nil {
+			t.Errorf("accepted invalid address %q", s)
+		}
+	}
+}
+
+func TestValidFingerprint(t *testing.T) {
+	if !ValidFingerprint("2B280B23E1107BB62ABFC40DDCC8824814F80A72") {
+		t.Error("rejected a valid fingerprint")
+	}
+	for _, fp := range []string{"", "2B280B23E1107BB62ABFC40DDCC8824814F80A7", "2B280B23E1107BB62ABFC40DDCC8824814F80A72A",
+		"ZB280B23E1107BB62ABFC40DDCC8824814F80A72"} {
+		if ValidFingerprint(fp) {
+			t.Errorf("accepted invalid fingerprint %q", fp)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package resources
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
@@ -52,26 +53,30 @@ func UnmarshalTmpResourceDiff(tmp *TmpResourceDiff) (*core.ResourceDiff, error)
 
 	ret := core.NewResourceDiff()
 
-	process := func(data map[string][]json.RawMessage) error {
+	process := func(data map[string][]json.RawMessage, rMap core.ResourceMap) error {
 		for k, vs := range data {
+			rFunc, ok := ResourceMap[k]
+			if !ok {
+				return fmt.Errorf("resource type %q not implemented", k)
+			}
 			for _, v := range vs {
-				rStruct := ResourceMap[k]()
+				rStruct := rFunc()
 				if err := json.Unmarshal(v, rStruct); err != nil {
 					return err
 				}
-				ret.New[k] = append(ret.New[k], rStruct.(core.Resource))
+				rMap[k] = append(rMap[k], rStruct.(core.Resource))
 			}
 		}
 		return nil
 	}
 
-	if err := process(tmp.New); err != nil {
+	if err := process(tmp.New, ret.New); err != nil {
 		return nil, err
 	}
-	if err := process(tmp.Changed); err != nil {
+	if err := process(tmp.Changed, ret.Changed); err != nil {
 		return nil, err
 	}
-	if err := process(tmp.Gone); err != nil {
+	if err := process(tmp.Gone, ret.Gone); err != nil {
 		return nil, err
 	}
 
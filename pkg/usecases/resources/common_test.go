@@ -0,0 +1,62 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resources
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
+)
+
+func TestUnmarshalTmpResourceDiff(t *testing.T) {
+	newBridge := func(ip string) *Transport {
+		tr := NewTransport()
+		tr.SetType(ResourceTypeObfs4)
+		tr.Address = Addr{Addr: &net.IPAddr{IP: net.ParseIP(ip)}}
+		tr.Port = 443
+		tr.Fingerprint = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+		return tr
+	}
+	diff := core.NewResourceDiff()
+	diff.New[ResourceTypeObfs4] = []core.Resource{newBridge("1.2.3.4")}
+	diff.Changed[ResourceTypeObfs4] = []core.Resource{newBridge("1.2.3.5")}
+	diff.Gone[ResourceTypeObfs4] = []core.Resource{newBridge("1.2.3.6"), newBridge("1.2.3.7")}
+
+	encoded, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := TmpResourceDiff{}
+	if err := json.Unmarshal(encoded, &tmp); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalTmpResourceDiff(&tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for desc, rMaps := range map[string][2]core.ResourceMap{
+		"new":     {diff.New, decoded.New},
+		"changed": {diff.Changed, decoded.Changed},
+		"gone":    {diff.Gone, decoded.Gone},
+	} {
+		orig, got := rMaps[0][ResourceTypeObfs4], rMaps[1][ResourceTypeObfs4]
+		if len(orig) != len(got) {
+			t.Fatalf("expected %d %s resources but got %d", len(orig), desc, len(got))
+		}
+		for i := range orig {
+			if orig[i].Oid() != got[i].Oid() {
+				t.Errorf("%s resource changed: %s != %s", desc, orig[i], got[i])
+			}
+		}
+	}
+
+	tmp.New["foo"] = []json.RawMessage{[]byte("{}")}
+	if _, err := UnmarshalTmpResourceDiff(&tmp); err == nil {
+		t.Errorf("accepted unknown resource type")
+	}
+}
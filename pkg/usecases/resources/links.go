@@ -7,6 +7,7 @@ package resources
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -15,19 +16,59 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/xgfone/bt/bencode"
 	"github.com/xgfone/bt/metainfo"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 )
 
+const (
+	// torrentPieceLength is the size of the pieces of the torrents made by
+	// GenerateMagnet
+	torrentPieceLength = 256 * 1024
+	// i2pTorrentPieceLength is the size of the pieces of the I2P torrents,
+	// the same as i2p.plugins.tor-manager
+	i2pTorrentPieceLength = 10240
+
+	// The release channels of Tor Browser.  The links without channel are
+	// for ChannelRelease.
+	ChannelRelease = "release"
+	ChannelAlpha   = "alpha"
+	ChannelNightly = "nightly"
+
+	// The products that gettor distributes.  The links without product are
+	// for ProductTorBrowser.
+	ProductTorBrowser      = "torbrowser"
+	ProductTorExpertBundle = "tor-expert-bundle"
+	ProductOrbot           = "orbot"
+)
+
+// ProductNames are the names of the products to show to the users
+var ProductNames = map[string]string{
+	ProductTorBrowser:      "Tor Browser",
+	ProductTorExpertBundle: "Tor Expert Bundle",
+	ProductOrbot:           "Orbot",
+}
+
 type Version struct {
 	Mayor int `json:"mayor"`
 	Minor int `json:"minor"`
 	Patch int `json:"patch"`
+	// Pre is the pre-release suffix of the alpha versions, like "a1"
+	Pre string `json:"pre,omitempty"`
 }
 
+// Str2Version parses versions like 12.0.1 or the alpha ones like 12.5a1.  Any
+// prefix before the first digit, like in the nightly versions
+// "tbb-nightly.2023.01.31", is ignored.
 func Str2Version(s string) (version Version, err error) {
+	s = strings.TrimLeftFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+	if i := strings.IndexFunc(s, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) }); i != -1 {
+		version.Pre = s[i:]
+		s = s[:i]
+	}
+
 	parts := strings.Split(s, ".")
 	version.Mayor, err = strconv.Atoi(parts[0])
 	if err != nil {
@@ -48,7 +89,7 @@ func Str2Version(s string) (version Version, err error) {
 }
 
 func (v Version) String() string {
-	return fmt.Sprintf("%d.%d.%d", v.Mayor, v.Minor, v.Patch)
+	return fmt.Sprintf("%d.%d.%d%s", v.Mayor, v.Minor, v.Patch, v.Pre)
 }
 
 // Compare returns 1 if v version is higher than v2,
@@ -72,14 +113,56 @@ func (v Version) Compare(v2 Version) int {
 		return -1
 	}
 
+	return comparePre(v.Pre, v2.Pre)
+}
+
+// comparePre compares pre-release suffixes like "a1" or "rc2", by the letters
+// and then by the number.  A version without suffix is higher than the
+// pre-releases of the same version.
+func comparePre(pre, pre2 string) int {
+	if pre == pre2 {
+		return 0
+	}
+	if pre == "" {
+		return 1
+	}
+	if pre2 == "" {
+		return -1
+	}
+
+	splitPre := func(pre string) (string, int, error) {
+		i := strings.IndexFunc(pre, unicode.IsDigit)
+		if i == -1 {
+			return pre, 0, nil
+		}
+		n, err := strconv.Atoi(pre[i:])
+		return pre[:i], n, err
+	}
+	letters, n, err := splitPre(pre)
+	letters2, n2, err2 := splitPre(pre2)
+	if err != nil || err2 != nil || letters != letters2 {
+		return strings.Compare(pre, pre2)
+	}
+	if n > n2 {
+		return 1
+	} else if n < n2 {
+		return -1
+	}
 	return 0
 }
 
 // TBLink stores a link to download Tor Browser with a certain locale for a certain platform
 type TBLink struct {
 	core.ResourceBase
-	Locale       string         `json:"locale"`
-	Platform     string         `json:"platform"`
+	Locale   string `json:"locale"`
+	Platform string `json:"platform"`
+	// Arch is the architecture of the binary for the platforms that have a
+	// binary per architecture, like android
+	Arch string `json:"arch,omitempty"`
+	// Channel is the release channel of the link, empty for ChannelRelease
+	Channel string `json:"channel,omitempty"`
+	// Product is what the link downloads, empty for ProductTorBrowser
+	Product      string         `json:"product,omitempty"`
 	Version      Version        `json:"version"`
 	Provider     string         `json:"provider"`
 	FileName     string         `json:"file_name"`
@@ -87,6 +170,72 @@ type TBLink struct {
 	SigLink      string         `json:"sig_link"`
 	CustomOid    *core.Hashkey  `json:"custom_oid"`
 	CustomExpiry *time.Duration `json:"custom_expiry"`
+	// Checksum is the hex encoded SHA-256 of the binary, empty if the
+	// updater didn't download it
+	Checksum string `json:"checksum,omitempty"`
+	// Magnet is the magnet URI of a torrent of the binary, empty if the
+	// updater didn't make one
+	Magnet string `json:"magnet,omitempty"`
+}
+
+// ArchAliases map the names of the architectures to the architecture of the
+// Tor Browser binaries.
+var ArchAliases = map[string]string{
+	"armv7":       "armv7",
+	"arm":         "armv7",
+	"armeabi-v7a": "armv7",
+	"aarch64":     "aarch64",
+	"arm64":       "aarch64",
+	"arm64-v8a":   "aarch64",
+	"x86_64":      "x86_64",
+	"x86-64":      "x86_64",
+	"x86":         "x86",
+}
+
+// archPlatforms are the platforms that have a Tor Browser binary per
+// architecture
+var archPlatforms = map[string]bool{
+	"android": true,
+}
+
+// SplitPlatformArch splits the Tor Browser platforms that include the
+// architecture, like android-aarch64, into the platform and the architecture.
+// Other platforms are returned with an empty architecture.
+func SplitPlatformArch(platform string) (string, string) {
+	i := strings.Index(platform, "-")
+	if i == -1 || !archPlatforms[platform[:i]] {
+		return platform, ""
+	}
+	arch, ok := ArchAliases[platform[i+1:]]
+	if !ok {
+		return platform, ""
+	}
+	return platform[:i], arch
+}
+
+// PlatformArch returns the platform and the architecture of the link, parsed
+// from the platform if Arch is not set.
+func (tl *TBLink) PlatformArch() (string, string) {
+	if tl.Arch != "" {
+		return tl.Platform, tl.Arch
+	}
+	return SplitPlatformArch(tl.Platform)
+}
+
+// ReleaseChannel returns the release channel of the link.
+func (tl *TBLink) ReleaseChannel() string {
+	if tl.Channel == "" {
+		return ChannelRelease
+	}
+	return tl.Channel
+}
+
+// ReleaseProduct returns the product of the link.
+func (tl *TBLink) ReleaseProduct() string {
+	if tl.Product == "" {
+		return ProductTorBrowser
+	}
+	return tl.Product
 }
 
 // NewTBLink allocates and returns a new TBLink object.
@@ -160,60 +309,131 @@ func (tl *TBLink) downloadFile(filePath, link string) (string, error) {
 	return filePath, nil
 }
 
-func (t *TBLink) generateTorrent(file string, announces []string) (*metainfo.MetaInfo, error) {
-	//info, err := metainfo.NewInfoFromFilePath(file, 5120)
-	info, err := metainfo.NewInfoFromFilePath(file, 10240)
+// generateTorrent makes the torrent of the file announced in the trackers,
+// with the web seeds as HTTP sources of the file.
+func generateTorrent(filePath string, pieceLength int64, trackers []string, webSeeds []string) (*metainfo.MetaInfo, error) {
+	info, err := metainfo.NewInfoFromFilePath(filePath, pieceLength)
 	if err != nil {
 		return nil, fmt.Errorf("GenerateTorrent: %s", err)
 	}
-	info.Name = filepath.Base(file)
+	info.Name = filepath.Base(filePath)
+	return newTorrent(info, trackers, webSeeds)
+}
+
+func newTorrent(info metainfo.Info, trackers []string, webSeeds []string) (*metainfo.MetaInfo, error) {
 	var mi metainfo.MetaInfo
+	var err error
 	mi.InfoBytes, err = bencode.EncodeBytes(info)
 	if err != nil {
 		return nil, fmt.Errorf("GenerateTorrent: %s", err)
 	}
-	switch len(announces) {
+	switch len(trackers) {
 	case 0:
-		// idk's Open Tracker inside I2P
-		mi.Announce = "http://mb5ir7klpc2tj6ha3xhmrs3mseqvanauciuoiamx2mmzujvg67uq.b32.i2p/a"
 	case 1:
-		mi.Announce = announces[0]
+		mi.Announce = trackers[0]
 	default:
-		mi.AnnounceList = metainfo.AnnounceList{announces}
-	}
-	url, err := url.Parse("http://idk.i2p/torbrowser/" + filepath.Base(file))
-	if err != nil {
-		return nil, fmt.Errorf("GenerateTorrent: %s", err)
+		mi.AnnounceList = metainfo.AnnounceList{trackers}
 	}
-	mi.URLList = []string{url.String()}
-	clearurl, err := url.Parse("https://eyedeekay.github.io/torbrowser/" + filepath.Base(file))
-	if err != nil {
-		return nil, fmt.Errorf("GenerateTorrent: %s", err)
+	for _, seed := range webSeeds {
+		if _, err := url.Parse(seed); err != nil {
+			return nil, fmt.Errorf("GenerateTorrent: %s", err)
+		}
+		mi.URLList = append(mi.URLList, seed)
 	}
-	mi.URLList = append(mi.URLList, clearurl.String())
 	return &mi, nil
 }
 
-func (tl *TBLink) GenerateFileMagnet(filePath string) (string, error) {
-	filePath, err := tl.downloadFile(filePath, tl.Link)
+// magnetLink returns the magnet URI of the torrent, with its web seeds.
+func magnetLink(mi *metainfo.MetaInfo) string {
+	magnet := mi.Magnet("", mi.InfoHash())
+	if len(mi.URLList) != 0 {
+		magnet.Params = url.Values{"ws": mi.URLList}
+	}
+	return magnet.String()
+}
+
+// GenerateMagnet returns the magnet URI of a torrent of the file announced in
+// the trackers, with the web seeds as HTTP sources of the file.
+func GenerateMagnet(filePath string, trackers []string, webSeeds []string) (string, error) {
+	mi, err := generateTorrent(filePath, torrentPieceLength, trackers, webSeeds)
 	if err != nil {
 		return "", err
 	}
-	mi, err := tl.generateTorrent(filePath, []string{})
+	return magnetLink(mi), nil
+}
+
+// GenerateFileMagnet downloads the binary of the link to filePath, if it's not
+// there yet, and returns the magnet URI and the torrent file of the binary for
+// I2P, announced in the trackers and with the web seeds.
+func (tl *TBLink) GenerateFileMagnet(filePath string, trackers []string, webSeeds []string) (string, []byte, error) {
+	filePath, err := tl.downloadFile(filePath, tl.Link)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	return mi.Magnet("", mi.InfoHash()).String(), nil
+	return i2pTorrent(filePath, trackers, webSeeds)
 }
 
-func (tl *TBLink) GenerateSigMagnet(filePath string) (string, error) {
+// GenerateSigMagnet is like GenerateFileMagnet for the signature of the link.
+func (tl *TBLink) GenerateSigMagnet(filePath string, trackers []string, webSeeds []string) (string, []byte, error) {
 	filePath, err := tl.downloadFile(filePath, tl.SigLink)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	mi, err := tl.generateTorrent(filePath, []string{})
+	return i2pTorrent(filePath, trackers, webSeeds)
+}
+
+// TorrentFile is a file of a multi-file torrent, Name is its name inside the
+// torrent and Path where it is on disk.
+type TorrentFile struct {
+	Name string
+	Path string
+}
+
+// GenerateReleaseMagnet returns the magnet URI and the torrent file of a
+// torrent for I2P with all the files of a release, like a binary and its
+// signature, in a directory called name.  The files are in the given order, so
+// the same files always make the same torrent.  The web seeds point to the
+// directory, the clients append the names of the files to them.
+func GenerateReleaseMagnet(name string, files []TorrentFile, trackers []string, webSeeds []string) (string, []byte, error) {
+	info := metainfo.Info{Name: name, PieceLength: i2pTorrentPieceLength}
+	paths := make(map[string]string, len(files))
+	for _, file := range files {
+		stat, err := os.Stat(file.Path)
+		if err != nil {
+			return "", nil, fmt.Errorf("GenerateTorrent: %s", err)
+		}
+		info.Files = append(info.Files, metainfo.File{Paths: []string{file.Name}, Length: stat.Size()})
+		paths[file.Name] = file.Path
+	}
+	var err error
+	info.Pieces, err = metainfo.GeneratePiecesFromFiles(info.Files, info.PieceLength, func(file metainfo.File) (io.ReadCloser, error) {
+		return os.Open(paths[file.Paths[0]])
+	})
 	if err != nil {
-		return "", err
+		return "", nil, fmt.Errorf("GenerateTorrent: %s", err)
+	}
+
+	mi, err := newTorrent(info, trackers, webSeeds)
+	if err != nil {
+		return "", nil, err
+	}
+	torrent, err := bencode.EncodeBytes(mi)
+	if err != nil {
+		return "", nil, fmt.Errorf("GenerateTorrent: %s", err)
+	}
+	return magnetLink(mi), torrent, nil
+}
+
+// i2pTorrent makes the torrent of the file with the settings of
+// i2p.plugins.tor-manager, so it joins the swarm of its users.
+func i2pTorrent(filePath string, trackers []string, webSeeds []string) (string, []byte, error) {
+	mi, err := generateTorrent(filePath, i2pTorrentPieceLength, trackers, webSeeds)
+	if err != nil {
+		return "", nil, err
+	}
+	torrent, err := bencode.EncodeBytes(mi)
+	if err != nil {
+		return "", nil, fmt.Errorf("GenerateTorrent: %s", err)
 	}
-	return mi.Magnet("", mi.InfoHash()).String(), nil
+	return magnetLink(mi), torrent, nil
 }
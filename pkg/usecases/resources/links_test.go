@@ -0,0 +1,161 @@
+// Copyright (c) 2021-2022, The Tor Project, Inc.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resources
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xgfone/bt/metainfo"
+)
+
+func TestStr2Version(t *testing.T) {
+	for s, expected := range map[string]Version{
+		"12.0":                   {Mayor: 12},
+		"12.0.1":                 {Mayor: 12, Patch: 1},
+		"12.5a1":                 {Mayor: 12, Minor: 5, Pre: "a1"},
+		"12.5.0a1":               {Mayor: 12, Minor: 5, Pre: "a1"},
+		"13.0a10":                {Mayor: 13, Pre: "a10"},
+		"tbb-nightly.2023.01.31": {Mayor: 2023, Minor: 1, Patch: 31},
+	} {
+		version, err := Str2Version(s)
+		if err != nil {
+			t.Errorf("Error parsing %s: %v", s, err)
+			continue
+		}
+		if version != expected {
+			t.Errorf("Wrong version for %s: %+v", s, version)
+		}
+		if v, err := Str2Version(version.String()); err != nil || v != version {
+			t.Errorf("%s doesn't parse back: %+v %v", version, v, err)
+		}
+	}
+
+	for _, s := range []string{"", "nightly", "12.x"} {
+		if _, err := Str2Version(s); err == nil {
+			t.Errorf("Parsed invalid version %q", s)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, versions := range [][2]string{
+		{"12.0.1", "12.0"},
+		{"12.0", "12.0a5"},
+		{"12.5a2", "12.5a1"},
+		{"12.5a10", "12.5a9"},
+		{"12.5b1", "12.5a9"},
+		{"12.5a1", "12.0.1"},
+	} {
+		v, _ := Str2Version(versions[0])
+		v2, _ := Str2Version(versions[1])
+		if v.Compare(v2) != 1 || v2.Compare(v) != -1 {
+			t.Errorf("%s is not higher than %s", versions[0], versions[1])
+		}
+		if v.Compare(v) != 0 {
+			t.Errorf("%s is not equal to itself", versions[0])
+		}
+	}
+}
+
+func TestSplitPlatformArch(t *testing.T) {
+	for platform, expected := range map[string][2]string{
+		"android-aarch64": {"android", "aarch64"},
+		"android-armv7":   {"android", "armv7"},
+		"android":         {"android", ""},
+		"linux-x86_64":    {"linux-x86_64", ""},
+		"win32":           {"win32", ""},
+	} {
+		p, arch := SplitPlatformArch(platform)
+		if p != expected[0] || arch != expected[1] {
+			t.Errorf("Wrong split of %s: %s %s", platform, p, arch)
+		}
+	}
+}
+
+func TestGenerateMagnet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdsys-magnet-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "tor-browser-linux64-12.0.1_ALL.tar.xz")
+	if err := ioutil.WriteFile(filePath, []byte(strings.Repeat("tor browser", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := "https://mirror.example.org/linux64/12.0.1/tor-browser-linux64-12.0.1_ALL.tar.xz"
+	magnet, err := GenerateMagnet(filePath, []string{"udp://tracker.example.org:1337"}, []string{seed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(magnet)
+	if err != nil || u.Scheme != "magnet" {
+		t.Fatalf("Invalid magnet %s: %v", magnet, err)
+	}
+	query := u.Query()
+	if !strings.HasPrefix(query.Get("xt"), "urn:btih:") {
+		t.Errorf("Wrong info hash: %s", query.Get("xt"))
+	}
+	if query.Get("dn") != "tor-browser-linux64-12.0.1_ALL.tar.xz" {
+		t.Errorf("Wrong name: %s", query.Get("dn"))
+	}
+	if query.Get("tr") != "udp://tracker.example.org:1337" {
+		t.Errorf("Wrong tracker: %s", query.Get("tr"))
+	}
+	if query.Get("ws") != seed {
+		t.Errorf("Wrong web seed: %s", query.Get("ws"))
+	}
+
+	again, err := GenerateMagnet(filePath, []string{"udp://tracker.example.org:1337"}, []string{seed})
+	if err != nil || again != magnet {
+		t.Errorf("The magnet is not stable: %s %v", again, err)
+	}
+}
+
+func TestGenerateReleaseMagnet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rdsys-magnet-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []TorrentFile
+	for _, name := range []string{"tor-browser-linux64-12.0.1_ALL.tar.xz", "tor-browser-linux64-12.0.1_ALL.tar.xz.asc"} {
+		filePath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filePath, []byte(strings.Repeat(name, 1000)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, TorrentFile{Name: name, Path: filePath})
+	}
+
+	magnet, torrent, err := GenerateReleaseMagnet("tor-browser-linux64-12.0.1_ALL", files, []string{"http://tracker.example.i2p/a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := metainfo.Load(bytes.NewReader(torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := mi.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Files) != 2 || info.Files[1].Paths[0] != files[1].Name {
+		t.Errorf("Wrong files in the torrent: %v", info.Files)
+	}
+	if !strings.Contains(magnet, mi.InfoHash().HexString()) {
+		t.Errorf("The magnet %s is not of the torrent %s", magnet, mi.InfoHash().HexString())
+	}
+
+	again, _, err := GenerateReleaseMagnet("tor-browser-linux64-12.0.1_ALL", files, []string{"http://tracker.example.i2p/a"}, nil)
+	if err != nil || again != magnet {
+		t.Errorf("The magnet is not stable: %s %v", again, err)
+	}
+}
@@ -61,6 +61,16 @@ func (t *Transport) String() string {
 	return strings.TrimSpace(strRep)
 }
 
+// Parameter implements core.ParameterizedResource.  On top of the parameters
+// of bridges, transports can be filtered by the parameters of their bridge
+// line, e.g. "iat-mode" for obfs4.
+func (t *Transport) Parameter(name string) (string, bool) {
+	if value, exists := t.Parameters[name]; exists {
+		return value, true
+	}
+	return t.BridgeBase.Parameter(name)
+}
+
 func (t *Transport) IsValid() bool {
 	return t.Type() != "" && t.Address.String() != "" && t.Port != 0
 }
@@ -5,9 +5,11 @@
 package gettor
 
 import (
+	"context"
+
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/internal"
+	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/core"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery"
-	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/delivery/mechanisms"
 	"gitlab.torproject.org/tpo/anti-censorship/rdsys/pkg/usecases/resources"
 )
 
@@ -16,19 +18,41 @@ const (
 )
 
 type GettorUpdater struct {
-	ipc delivery.Mechanism
+	ipc       delivery.Mechanism
+	getIpc    delivery.Mechanism
+	deleteIpc delivery.Mechanism
 }
 
 func (u *GettorUpdater) Init(cfg *internal.Config) {
-	u.ipc = mechanisms.NewHttpsIpc(
-		"http://"+cfg.Backend.WebApi.ApiAddress+cfg.Backend.ResourcesEndpoint,
-		"POST",
-		cfg.Backend.ApiTokens[UpdName])
+	endpoint := cfg.Backend.ResourcesEndpoint
+	token := cfg.Backend.ApiTokens[UpdName]
+	u.ipc = internal.NewBackendIpc(cfg, endpoint, "POST", token)
+	u.getIpc = internal.NewBackendIpc(cfg, endpoint, "GET", token)
+	u.deleteIpc = internal.NewBackendIpc(cfg, endpoint, "DELETE", token)
 }
 
 func (u *GettorUpdater) Shutdown() {
 }
 
-func (u *GettorUpdater) AddLinks(links []*resources.TBLink) error {
-	return u.ipc.MakeJsonRequest(&links, nil)
+// AddLinks sends the given links to the backend.  The request is aborted when
+// the given context is done.
+func (u *GettorUpdater) AddLinks(ctx context.Context, links []*resources.TBLink) error {
+	return u.ipc.MakeJsonRequest(ctx, &links, nil)
+}
+
+// GetLinks returns the links that the backend has.
+func (u *GettorUpdater) GetLinks(ctx context.Context) ([]*resources.TBLink, error) {
+	req := core.ResourceRequest{
+		RequestOrigin: UpdName,
+		ResourceTypes: []string{resources.ResourceTypeTBLink},
+	}
+	var links []*resources.TBLink
+	err := u.getIpc.MakeJsonRequest(ctx, &req, &links)
+	return links, err
+}
+
+// RemoveLinks tells the backend to remove the given links, because the files
+// they point to don't exist anymore.
+func (u *GettorUpdater) RemoveLinks(ctx context.Context, links []*resources.TBLink) error {
+	return u.deleteIpc.MakeJsonRequest(ctx, &links, nil)
 }